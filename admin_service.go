@@ -1,11 +1,20 @@
+//go:build !noreverse
+// +build !noreverse
+
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
 	"net/http"
 	"path"
+	"strings"
 
+	"github.com/coreos/go-oidc/jose"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opencensus.io/zpages"
 	"go.uber.org/zap"
 )
@@ -47,6 +56,39 @@ func (r *oauthProxy) createAdminRoutes() chi.Router {
 		admin.Get(metricsURL, r.proxyMetricsHandler)
 	}
 
+	// step: self-test
+	if r.config.EnableSelfTestEndpoint {
+		r.log.Info("enabling self-test service", zap.String("path", path.Clean(r.config.WithOAuthURI(selfTestURL))))
+		admin.Get(selfTestURL, r.selfTestHandler)
+	}
+
+	// step: session revocation
+	if r.config.EnableSessionRevocation {
+		r.log.Info("enabling session revocation service", zap.String("path", path.Clean(r.config.WithOAuthURI(sessionsURL))))
+		admin.Delete(sessionsURL, r.revokeAllSessionsHandler)
+		admin.Delete(sessionsURL+"/{subject}", r.revokeSessionsHandler)
+	}
+
+	// step: openapi
+	if r.config.EnableOpenAPIEndpoint {
+		r.log.Info("enabling openapi service", zap.String("path", path.Clean(r.config.WithOAuthURI(openAPIURL))))
+		admin.Get(openAPIURL, r.openAPIHandler)
+	}
+
+	// step: pipeline
+	if r.config.EnablePipelineEndpoint {
+		r.log.Info("enabling pipeline service", zap.String("path", path.Clean(r.config.WithOAuthURI(pipelineURL))))
+		admin.Get(pipelineURL, r.pipelineHandler)
+	}
+
+	// step: capture
+	if r.config.EnableCaptureEndpoint {
+		r.log.Info("enabling capture service", zap.String("path", path.Clean(r.config.WithOAuthURI(captureURL))))
+		admin.Post(captureURL, r.startCaptureHandler)
+		admin.Get(captureURL, r.captureHandler)
+		admin.Delete(captureURL, r.stopCaptureHandler)
+	}
+
 	// step: tracing
 	if r.config.EnableTracing {
 		r.log.Info("enabling tracing service",
@@ -76,3 +118,122 @@ func (r *oauthProxy) createDebugRoutes() chi.Router {
 	}
 	return debugEngine
 }
+
+func (r *oauthProxy) metricsHandler() http.Handler {
+	if !r.config.EnableMetrics {
+		return nil
+	}
+	return promhttp.Handler()
+}
+
+// proxyMetricsHandler forwards the request to the prometheus handler
+func (r *oauthProxy) proxyMetricsHandler(w http.ResponseWriter, req *http.Request) {
+	if !r.config.EnableMetrics {
+		return
+	}
+	if r.config.LocalhostMetrics {
+		// option to only give access to a localhost metrics collection agent
+		if !net.ParseIP(realIP(req)).IsLoopback() {
+			r.accessForbidden(w, req)
+			return
+		}
+	}
+	r.metricsHandler().ServeHTTP(w, req)
+}
+
+// selfTestHandler runs the self-test, responding 503 whenever a step fails
+func (r *oauthProxy) selfTestHandler(w http.ResponseWriter, req *http.Request) {
+	report := r.selfTest(req.Context())
+
+	w.Header().Set("Content-Type", jsonMime)
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Passed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		r.log.Warn("failed to write the self-test report", zap.Error(err))
+	}
+}
+
+// openAPIHandler serves the OpenAPI document of the endpoints of the proxy
+func (r *oauthProxy) openAPIHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", jsonMime)
+	if err := json.NewEncoder(w).Encode(r.config.generateOpenAPI()); err != nil {
+		r.log.Warn("failed to write the openapi document", zap.Error(err))
+	}
+}
+
+// isSessionRevocationAllowed checks the bearer token is either the static revocation token, or a valid token
+// holding the revocation role
+func (r *oauthProxy) isSessionRevocationAllowed(req *http.Request) bool {
+	bearer, err := getTokenInBearer(req)
+	if err != nil {
+		return false
+	}
+	if r.config.SessionRevocationToken != "" &&
+		subtle.ConstantTimeCompare([]byte(bearer), []byte(r.config.SessionRevocationToken)) == 1 {
+		return true
+	}
+	if r.config.SessionRevocationRole == "" || r.client == nil {
+		return false
+	}
+
+	token, err := jose.ParseJWT(bearer)
+	if err != nil {
+		return false
+	}
+	if err := r.verifyToken(r.client, token); err != nil {
+		return false
+	}
+	user, err := extractIdentity(token, r.config.identityClaims())
+	if err != nil {
+		return false
+	}
+
+	return containsString(r.config.SessionRevocationRole, user.roles)
+}
+
+// revokeSessionsHandler revokes all the sessions of a subject
+func (r *oauthProxy) revokeSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	subject := chi.URLParam(req, "subject")
+	r.revokeSessionsResponse(w, req, subject, func() (int, error) {
+		return r.revokeSessions(subject)
+	})
+}
+
+// revokeAllSessionsHandler revokes the sessions of all the subjects
+func (r *oauthProxy) revokeAllSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	r.revokeSessionsResponse(w, req, "*", r.revokeAllSessions)
+}
+
+func (r *oauthProxy) revokeSessionsResponse(w http.ResponseWriter, req *http.Request, subject string, revoke func() (int, error)) {
+	if !r.isSessionRevocationAllowed(req) {
+		r.errorResponse(w, req, strings.Join([]string{"session revocation requested by an unauthorized caller", "client_ip", req.RemoteAddr}, ","), http.StatusUnauthorized, nil)
+		return
+	}
+
+	revoked, err := revoke()
+	if err != nil {
+		r.errorResponse(w, req, "unable to revoke the sessions", http.StatusInternalServerError, err)
+		return
+	}
+
+	// audit trail of the revocations
+	r.log.Info("revoked sessions",
+		zap.String("subject", subject),
+		zap.Int("revoked", revoked),
+		zap.String("client_ip", req.RemoteAddr))
+
+	w.Header().Set("Content-Type", jsonMime)
+	if err := json.NewEncoder(w).Encode(revokedSessions{Revoked: revoked}); err != nil {
+		r.log.Warn("failed to write the session revocation response", zap.Error(err))
+	}
+}
+
+// pipelineHandler lists the stages run by the requests of each route of the reverse proxy
+func (r *oauthProxy) pipelineHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", jsonMime)
+	if err := json.NewEncoder(w).Encode(pipelineReport{Routes: r.pipelineRoutes}); err != nil {
+		r.log.Warn("failed to write the pipeline report", zap.Error(err))
+	}
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"io"
 	"log"
 	"net/http"
@@ -141,7 +142,10 @@ func TestAdmin(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	buf, erb := io.ReadAll(resp.Body)
 	assert.NoError(t, erb)
-	assert.Equal(t, `{"status":"OK"}`, string(buf)) // check this is our test resource being called
+	var health healthResponse
+	require.NoError(t, json.Unmarshal(buf, &health))
+	assert.Equal(t, "OK", health.Status) // check this is our test resource being called
+	assert.NotNil(t, health.JWKSRefreshedAt)
 
 	// test prometheus metrics endpoint
 	u, _ = url.Parse("http://" + e2eAdminEndpointListener + "/oauth/metrics")
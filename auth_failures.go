@@ -0,0 +1,126 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+	"go.uber.org/zap"
+)
+
+// Reasons of the authentication failures
+const (
+	authFailureMissing       = "missing"
+	authFailureInvalid       = "invalid"
+	authFailureExpired       = "expired"
+	authFailureRefreshFailed = "refresh-failed"
+	authFailureIdle          = "idle"
+	authFailureRevoked       = "revoked"
+	authFailureTooLarge      = "too-large"
+)
+
+// Families of user agents, derived from the user agent header to keep the cardinality of the metrics low
+const (
+	userAgentMobileApp = "mobile-app"
+	userAgentBrowser   = "browser"
+	userAgentCLI       = "cli"
+	userAgentBot       = "bot"
+	userAgentOther     = "other"
+)
+
+// Client id labels of the authentication failures, besides the allowed client ids
+const (
+	authFailureClientNone  = "none"
+	authFailureClientOther = "other"
+)
+
+// maxAuthFailureTokenLength bounds the bearer tokens parsed to find the client id of a failure
+const maxAuthFailureTokenLength = 16 << 10
+
+// userAgentFamilies classifies the user agents by substring of the lowercased header, the first match wins
+var userAgentFamilies = []struct {
+	family  string
+	matches []string
+}{
+	{family: userAgentBot, matches: []string{"bot", "crawler", "spider", "slurp", "facebookexternalhit", "preview"}},
+	{family: userAgentMobileApp, matches: []string{"okhttp", "dalvik", "cfnetwork", "alamofire", "dart:io", "reactnative", "expo/"}},
+	{family: userAgentCLI, matches: []string{"curl/", "wget/", "httpie/", "python-requests", "python-urllib", "go-http-client", "java/", "apache-httpclient", "postmanruntime", "insomnia"}},
+	// the android webviews embedded in the applications
+	{family: userAgentMobileApp, matches: []string{"; wv)"}},
+	{family: userAgentBrowser, matches: []string{"mozilla/", "opera/"}},
+}
+
+// userAgentFamily returns the family of the user agent of a request
+func userAgentFamily(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	for _, x := range userAgentFamilies {
+		for _, match := range x.matches {
+			if strings.Contains(userAgent, match) {
+				return x.family
+			}
+		}
+	}
+
+	return userAgentOther
+}
+
+// authFailureClientID returns the client id of the bearer token of a failing request: the azp claim, or else the
+// client_id claim, when the client id is listed in auth-failure-client-ids
+func (r *oauthProxy) authFailureClientID(req *http.Request) string {
+	bearer, err := getTokenInBearer(req)
+	if err != nil || len(bearer) > maxAuthFailureTokenLength {
+		return authFailureClientNone
+	}
+	token, err := jose.ParseJWT(bearer)
+	if err != nil {
+		return authFailureClientNone
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return authFailureClientNone
+	}
+	clientID, found, _ := claims.StringClaim(claimAuthorizedParty)
+	if !found {
+		if clientID, found, _ = claims.StringClaim(claimClientID); !found {
+			return authFailureClientNone
+		}
+	}
+	if !containedIn(clientID, r.config.AuthFailureClientIDs, false) {
+		return authFailureClientOther
+	}
+
+	return clientID
+}
+
+// recordAuthFailure counts an authentication failure and returns the fields identifying the client in the logs
+func (r *oauthProxy) recordAuthFailure(req *http.Request, reason string) []zap.Field {
+	userAgent := userAgentFamily(req.UserAgent())
+	clientID := r.authFailureClientID(req)
+
+	// @metric an authentication failure, by reason and by client
+	authFailuresMetric.WithLabelValues(reason, userAgent, clientID).Inc()
+
+	return []zap.Field{
+		zap.String("failure", reason),
+		zap.String("user_agent", userAgent),
+		zap.String("client_id", clientID),
+	}
+}
@@ -0,0 +1,111 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAgentFamily(t *testing.T) {
+	cs := []struct {
+		UserAgent string
+		Expected  string
+	}{
+		{UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", Expected: userAgentBrowser},
+		{UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", Expected: userAgentBrowser},
+		{UserAgent: "Mozilla/5.0 (Linux; Android 13; Pixel 7 Build/TQ3A; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/120.0 Mobile Safari/537.36", Expected: userAgentMobileApp},
+		{UserAgent: "okhttp/4.12.0", Expected: userAgentMobileApp},
+		{UserAgent: "MyApp/2.3.1 CFNetwork/1410.0.3 Darwin/22.6.0", Expected: userAgentMobileApp},
+		{UserAgent: "curl/8.4.0", Expected: userAgentCLI},
+		{UserAgent: "python-requests/2.31.0", Expected: userAgentCLI},
+		{UserAgent: "Go-http-client/1.1", Expected: userAgentCLI},
+		{UserAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", Expected: userAgentBot},
+		{UserAgent: "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", Expected: userAgentBot},
+		{UserAgent: "", Expected: userAgentOther},
+		{UserAgent: "something/1.0", Expected: userAgentOther},
+	}
+	for _, c := range cs {
+		assert.Equal(t, c.Expected, userAgentFamily(c.UserAgent), "user agent: %s", c.UserAgent)
+	}
+}
+
+func TestAuthFailureClientID(t *testing.T) {
+	p := &oauthProxy{config: &Config{AuthFailureClientIDs: []string{"clientid", "mobile"}}}
+	bearer := func(claims jose.Claims) *http.Request {
+		token := newTestToken("issuer")
+		for k, v := range claims {
+			token.claims.Add(k, v)
+		}
+		if claims["azp"] == "" {
+			delete(token.claims, "azp")
+		}
+		req := newFakeHTTPRequest(http.MethodGet, "/")
+		encoded := token.getToken()
+		req.Header.Set(authorizationHeader, "Bearer "+encoded.Encode())
+		return req
+	}
+
+	assert.Equal(t, "clientid", p.authFailureClientID(bearer(nil)))
+	assert.Equal(t, "mobile", p.authFailureClientID(bearer(jose.Claims{"azp": "", "client_id": "mobile"})))
+	assert.Equal(t, authFailureClientOther, p.authFailureClientID(bearer(jose.Claims{"azp": "misconfigured-build"})))
+	assert.Equal(t, authFailureClientNone, p.authFailureClientID(bearer(jose.Claims{"azp": ""})))
+
+	req := newFakeHTTPRequest(http.MethodGet, "/")
+	assert.Equal(t, authFailureClientNone, p.authFailureClientID(req), "the cookie sessions have no client id")
+	req.Header.Set(authorizationHeader, "Bearer not-a-token")
+	assert.Equal(t, authFailureClientNone, p.authFailureClientID(req))
+}
+
+func TestAuthFailureMetrics(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableMetrics = true
+	cfg.LocalhostMetrics = true
+	cfg.AuthFailureClientIDs = []string{"clientid"}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:          "/auth_all/test",
+			HasToken:     true,
+			NotSigned:    true,
+			Headers:      map[string]string{"User-Agent": "okhttp/4.12.0"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/auth_all/test",
+			HasToken:     true,
+			NotSigned:    true,
+			TokenClaims:  jose.Claims{"azp": "unknown-build"},
+			Headers:      map[string]string{"User-Agent": "curl/8.4.0"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:                     cfg.WithOAuthURI(metricsURL),
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `proxy_auth_failures_total{client_id="clientid",reason="invalid",user_agent="mobile-app"}`,
+		},
+		{
+			URI:                     cfg.WithOAuthURI(metricsURL),
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `proxy_auth_failures_total{client_id="other",reason="invalid",user_agent="cli"}`,
+		},
+	})
+}
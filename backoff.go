@@ -0,0 +1,168 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// backoff is the retry policy of a call to the provider: the delay between two attempts grows from the initial delay
+// by the multiplier, up to the max delay, and is randomized by the jitter so the replicas do not retry in step
+type backoff struct {
+	// name identifies the call in the logs
+	name       string
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	// jitter is the randomized fraction of the delay, e.g. 0.2 for +/- 20%
+	jitter float64
+	// attempts is the maximum number of attempts, zero for no limit but the context
+	attempts int
+}
+
+var (
+	// discoveryBackoff retries the discovery on startup, until the openid-provider-timeout
+	discoveryBackoff = backoff{name: "discovery", initial: time.Second, max: 10 * time.Second, multiplier: 2, jitter: 0.2}
+	// refreshBackoff retries the refresh of an access token, while the request of the user waits
+	refreshBackoff = backoff{name: "token refresh", initial: 200 * time.Millisecond, max: time.Second, multiplier: 2, jitter: 0.2, attempts: 3}
+	// revocationBackoff retries the revocation of the refresh token on logout, while the user waits
+	revocationBackoff = backoff{name: "revocation", initial: 200 * time.Millisecond, max: time.Second, multiplier: 2, jitter: 0.2, attempts: 3}
+	// codeExchangeBackoff retries the exchange of the authorization code on the callback, while the user waits
+	codeExchangeBackoff = backoff{name: "code exchange", initial: 200 * time.Millisecond, max: time.Second, multiplier: 2, jitter: 0.2, attempts: 3}
+	// loginBackoff retries the password grant of the login handler, while the user waits
+	loginBackoff = backoff{name: "login", initial: 200 * time.Millisecond, max: time.Second, multiplier: 2, jitter: 0.2, attempts: 3}
+	// tokenExchangeBackoff retries the exchange of an access token for the audience of a resource, while the request waits
+	tokenExchangeBackoff = backoff{name: "token exchange", initial: 200 * time.Millisecond, max: time.Second, multiplier: 2, jitter: 0.2, attempts: 3}
+	// umaBackoff retries the check of an uma permission, while the request waits
+	umaBackoff = backoff{name: "uma permission", initial: 200 * time.Millisecond, max: time.Second, multiplier: 2, jitter: 0.2, attempts: 3}
+	// clientTokenBackoff retries the client credentials grant of the client tokens, while the callers wait
+	clientTokenBackoff = backoff{name: "client token", initial: 200 * time.Millisecond, max: time.Second, multiplier: 2, jitter: 0.2, attempts: 3}
+	// deviceAuthorizationBackoff retries the start of a device authorization grant, while the device waits
+	deviceAuthorizationBackoff = backoff{name: "device authorization", initial: 200 * time.Millisecond, max: time.Second, multiplier: 2, jitter: 0.2, attempts: 3}
+	// forwardingLoginBackoff retries the login of the forwarding proxy, which keeps trying in the background, up to the
+	// forwarding-login-backoff-max
+	forwardingLoginBackoff = backoff{name: "forwarding login", initial: time.Second, max: 5 * time.Minute, multiplier: 2, jitter: 0.2}
+)
+
+// permanentError is a failure which is not retried, e.g. a refresh token which has expired
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// The other calls to the provider are not retried with a policy: the device authorization polling keeps its own
+// interval, which the provider asks to slow down, the forwarding proxy renews its tokens in its own loops, the signing
+// keys (JWKS) are refreshed on demand at most once per jwks-min-refresh-interval, and the health checks and the self
+// test report the state of the provider as they find it.
+
+// permanent marks an error which is not worth retrying
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &permanentError{err: err}
+}
+
+// delay returns the delay before the next attempt, after the failed attempt counted from 1
+func (b backoff) delay(attempt int, random func() float64) time.Duration {
+	delay := float64(b.initial) * math.Pow(b.multiplier, float64(attempt-1))
+	if delay > float64(b.max) {
+		delay = float64(b.max)
+	}
+
+	return time.Duration(delay * (1 + b.jitter*(2*random()-1)))
+}
+
+// waitRetry waits for the delay before the next attempt, on the clock of the retries
+func (r *oauthProxy) waitRetry(ctx context.Context, delay time.Duration) error {
+	_, err := r.waitRetryUnless(ctx, delay, nil)
+
+	return err
+}
+
+// waitRetryUnless waits for the delay before the next attempt, unless woken up earlier, which it tells
+func (r *oauthProxy) waitRetryUnless(ctx context.Context, delay time.Duration, wake <-chan struct{}) (bool, error) {
+	after := time.After
+	if r.retryAfter != nil {
+		after = r.retryAfter
+	}
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-wake:
+		return true, nil
+	case <-after(delay):
+		return false, nil
+	}
+}
+
+// waitAfterFailure logs the failed attempt of a call to the provider, and waits for the delay before the next attempt
+func (r *oauthProxy) waitAfterFailure(ctx context.Context, policy backoff, attempt int, err error) error {
+	delay := policy.delay(attempt, rand.Float64)
+	r.log.Warn("the call to the provider failed, retrying",
+		zap.String("call", policy.name),
+		zap.Int("attempt", attempt),
+		zap.Duration("retry_in", delay),
+		zap.Error(err))
+
+	return r.waitRetry(ctx, delay)
+}
+
+// retry calls the provider until the call succeeds, fails with a permanent error, or the attempts of the policy or
+// the context are exhausted. The last error is returned.
+func (r *oauthProxy) retry(ctx context.Context, policy backoff, call func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := call(ctx)
+		if err == nil {
+			return nil
+		}
+		var stop *permanentError
+		if errors.As(err, &stop) {
+			return stop.err
+		}
+		if policy.attempts > 0 && attempt >= policy.attempts {
+			r.log.Warn("the call to the provider failed, giving up",
+				zap.String("call", policy.name),
+				zap.Int("attempts", attempt),
+				zap.Error(err))
+
+			return err
+		}
+
+		if r.waitAfterFailure(ctx, policy, attempt, err) != nil {
+			r.log.Warn("the call to the provider failed, giving up",
+				zap.String("call", policy.name),
+				zap.Int("attempts", attempt),
+				zap.Error(err))
+
+			return err
+		}
+	}
+}
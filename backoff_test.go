@@ -0,0 +1,217 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeRetryClock records the delays between the attempts, and lets the next attempt run at once
+type fakeRetryClock struct {
+	sync.Mutex
+	delays []time.Duration
+}
+
+func (c *fakeRetryClock) after(delay time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	c.delays = append(c.delays, delay)
+	fired := make(chan time.Time, 1)
+	fired <- time.Now()
+
+	return fired
+}
+
+func (c *fakeRetryClock) recorded() []time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	return append([]time.Duration(nil), c.delays...)
+}
+
+// assertBackoffDelays checks the delays follow the policy, within its jitter
+func assertBackoffDelays(t *testing.T, policy backoff, delays []time.Duration) {
+	for i, delay := range delays {
+		expected := policy.delay(i+1, func() float64 { return 0.5 })
+		assert.InDelta(t, float64(expected), float64(delay), float64(expected)*policy.jitter, "attempt %d", i+1)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	policy := backoff{initial: time.Second, max: 5 * time.Second, multiplier: 2}
+	var delays []time.Duration
+	for attempt := 1; attempt <= 5; attempt++ {
+		delays = append(delays, policy.delay(attempt, func() float64 { return 0.5 }))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+
+	policy.jitter = 0.2
+	assert.Equal(t, 800*time.Millisecond, policy.delay(1, func() float64 { return 0 }))
+	assert.Equal(t, 1200*time.Millisecond, policy.delay(1, func() float64 { return 1 }))
+}
+
+func TestRetry(t *testing.T) {
+	policy := backoff{name: "test", initial: time.Second, max: time.Minute, multiplier: 2, attempts: 3}
+	failure := errors.New("unavailable")
+
+	cs := []struct {
+		Name     string
+		Failures int
+		Error    error
+		Calls    int
+		Delays   []time.Duration
+	}{
+		{Name: "success", Calls: 1},
+		{Name: "success after failures", Failures: 2, Calls: 3, Delays: []time.Duration{time.Second, 2 * time.Second}},
+		{Name: "attempts exhausted", Failures: 5, Error: failure, Calls: 3, Delays: []time.Duration{time.Second, 2 * time.Second}},
+	}
+	for _, c := range cs {
+		clock := &fakeRetryClock{}
+		r := &oauthProxy{log: zap.NewNop(), retryAfter: clock.after}
+		calls := 0
+		err := r.retry(context.Background(), policy, func(context.Context) error {
+			if calls++; calls <= c.Failures {
+				return failure
+			}
+			return nil
+		})
+		assert.Equal(t, c.Error, err, c.Name)
+		assert.Equal(t, c.Calls, calls, c.Name)
+		assert.Equal(t, c.Delays, clock.recorded(), c.Name)
+	}
+
+	// the permanent failures are not retried
+	r := &oauthProxy{log: zap.NewNop(), retryAfter: (&fakeRetryClock{}).after}
+	calls := 0
+	err := r.retry(context.Background(), policy, func(context.Context) error {
+		calls++
+		return permanent(ErrRefreshTokenExpired)
+	})
+	assert.Equal(t, ErrRefreshTokenExpired, err)
+	assert.Equal(t, 1, calls)
+
+	// the retries stop with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	err = (&oauthProxy{log: zap.NewNop()}).retry(ctx, backoff{initial: time.Hour, max: time.Hour, multiplier: 2}, func(context.Context) error {
+		calls++
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestDiscoveryRetry(t *testing.T) {
+	proxy, auth, _ := newTestProxyService(nil)
+	clock := &fakeRetryClock{}
+	proxy.retryAfter = clock.after
+
+	// the discovery is retried while the provider is unavailable
+	atomic.StoreInt32(&auth.unavailable, 3)
+	_, config, _, err := proxy.newOpenIDClient()
+	require.NoError(t, err)
+	assert.NotNil(t, config.TokenEndpoint)
+	delays := clock.recorded()
+	assert.Len(t, delays, 3)
+	assertBackoffDelays(t, discoveryBackoff, delays)
+
+	// until the timeout of the discovery
+	proxy.config.OpenIDProviderTimeout = 50 * time.Millisecond
+	proxy.retryAfter = nil
+	atomic.StoreInt32(&auth.unavailable, 100)
+	_, _, _, err = proxy.newOpenIDClient()
+	assert.Error(t, err)
+}
+
+func TestRefreshRetry(t *testing.T) {
+	proxy, auth, _ := newTestProxyService(nil)
+	clock := &fakeRetryClock{}
+	proxy.retryAfter = clock.after
+
+	// the refresh is retried while the provider is unavailable
+	atomic.StoreInt32(&auth.unavailable, 2)
+	token, _, _, _, _, err := proxy.getRefreshedToken(context.Background(), "refresh")
+	require.NoError(t, err)
+	assert.NotEmpty(t, token.Encode())
+	delays := clock.recorded()
+	assert.Len(t, delays, 2)
+	assertBackoffDelays(t, refreshBackoff, delays)
+
+	// up to the attempts of the policy
+	clock = &fakeRetryClock{}
+	proxy.retryAfter = clock.after
+	atomic.StoreInt32(&auth.unavailable, int32(refreshBackoff.attempts))
+	_, _, _, _, _, err = proxy.getRefreshedToken(context.Background(), "refresh")
+	assert.Error(t, err)
+	assert.Len(t, clock.recorded(), refreshBackoff.attempts-1)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&auth.unavailable))
+}
+
+func TestTokenExchangeRetry(t *testing.T) {
+	proxy, auth, _ := newTestProxyService(nil)
+	clock := &fakeRetryClock{}
+	proxy.retryAfter = clock.after
+	token := newTestToken(auth.getLocation()).getToken()
+
+	// the exchange is retried while the provider is unavailable
+	atomic.StoreInt32(&auth.unavailable, 2)
+	exchanged, _, err := proxy.exchangeToken(context.Background(), token.Encode(), "orders-api")
+	require.NoError(t, err)
+	assert.NotEmpty(t, exchanged)
+	delays := clock.recorded()
+	assert.Len(t, delays, 2)
+	assertBackoffDelays(t, tokenExchangeBackoff, delays)
+
+	// but not when it is refused
+	clock = &fakeRetryClock{}
+	proxy.retryAfter = clock.after
+	_, _, err = proxy.exchangeToken(context.Background(), token.Encode(), fakeDeniedAudience)
+	assert.Error(t, err)
+	assert.Empty(t, clock.recorded())
+}
+
+func TestRefusedGrant(t *testing.T) {
+	cs := []struct {
+		Err       error
+		Permanent bool
+	}{
+		{Err: errors.New("connection refused")},
+		{Err: errors.New("the authorization_code grant failed with status 503: unavailable")},
+		{Err: fmt.Errorf("%w: the password grant failed with status 401", ErrInvalidGrant), Permanent: true},
+		{Err: errors.New("invalid_grant"), Permanent: true},
+		{Err: fmt.Errorf("%w: the token exchange grant failed with status 400", oauthErrorCode("invalid_request")), Permanent: true},
+		{Err: fmt.Errorf("%w: the token exchange grant failed with status 500", oauthErrorCode(oauthErrorServerError))},
+		{Err: fmt.Errorf("%w: the token exchange grant failed with status 503", oauthErrorCode(oauthErrorTemporarilyUnavailable))},
+	}
+	for i, c := range cs {
+		var stop *permanentError
+		err := refusedGrant(c.Err)
+		assert.Equal(t, c.Permanent, errors.As(err, &stop), "case %d", i)
+		assert.ErrorIs(t, err, c.Err, "case %d", i)
+	}
+	assert.NoError(t, refusedGrant(nil))
+}
@@ -0,0 +1,127 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// callbackMaxCodeLength and callbackMaxStateLength bound the parameters of a callback
+	callbackMaxCodeLength  = 2048
+	callbackMaxStateLength = 512
+	callbackMaxErrorLength = 64
+	// callbackRejectionLogInterval is the minimum interval between two logs about the rejected callbacks
+	callbackRejectionLogInterval = 10 * time.Second
+	// callbackErrorAccessDenied is the error of the provider when the user or a policy denied the authorization
+	callbackErrorAccessDenied = "access_denied"
+)
+
+// Reasons of the rejection of a callback
+const (
+	callbackMissingCode    = "missing-code"
+	callbackMalformedCode  = "malformed-code"
+	callbackMalformedState = "malformed-state"
+	callbackMalformedError = "malformed-error"
+)
+
+// rateLimitedLog logs at most one entry per interval, and counts the entries suppressed in between
+type rateLimitedLog struct {
+	// last is the time of the last entry, in nanoseconds since the epoch
+	last       int64
+	suppressed uint64
+}
+
+// allow tells if an entry can be logged, and returns the number of entries suppressed since the last one
+func (l *rateLimitedLog) allow(interval time.Duration) (bool, uint64) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&l.last)
+	if now-last < int64(interval) || !atomic.CompareAndSwapInt64(&l.last, last, now) {
+		atomic.AddUint64(&l.suppressed, 1)
+		return false, 0
+	}
+
+	return true, atomic.SwapUint64(&l.suppressed, 0)
+}
+
+// isCallbackParameter tells if a parameter of a callback is well-formed: bounded, and made of characters which are
+// safe in an url, as well as the separators and padding of the codes issued by the providers (e.g. "4/..." codes)
+func isCallbackParameter(value string, max int) bool {
+	if value == "" || len(value) > max {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkCallbackParameters returns the reason to reject the parameters of a callback, if any. A callback without state
+// is accepted, as the logins started from a link to the authorization endpoint may not carry one.
+func checkCallbackParameters(code string, state string, hasState bool) string {
+	switch {
+	case code == "":
+		return callbackMissingCode
+	case !isCallbackParameter(code, callbackMaxCodeLength):
+		return callbackMalformedCode
+	case hasState && !isCallbackParameter(state, callbackMaxStateLength):
+		return callbackMalformedState
+	default:
+		return ""
+	}
+}
+
+// rejectCallback refuses a callback with missing or malformed parameters, without contacting the provider. The
+// rejections are counted, and logged at most once per interval as they mostly come from scanners.
+func (r *oauthProxy) rejectCallback(w http.ResponseWriter, req *http.Request, reason string) {
+	// @metric a callback was rejected before the code exchange
+	callbackRejectionsMetric.WithLabelValues(reason).Inc()
+	if allowed, suppressed := r.callbackRejections.allow(callbackRejectionLogInterval); allowed {
+		r.log.Warn("rejected a callback with invalid parameters",
+			zap.String("reason", reason),
+			zap.String("client_ip", req.RemoteAddr),
+			zap.Uint64("suppressed", suppressed))
+	}
+	errorResponse(w, "invalid callback parameters", http.StatusBadRequest)
+}
+
+// callbackErrorHandler handles a callback carrying the error of the provider instead of a code, e.g. when the user
+// denied the authorization: the denials lead to the forbidden page
+func (r *oauthProxy) callbackErrorHandler(w http.ResponseWriter, req *http.Request, failure string) {
+	if !isCallbackParameter(failure, callbackMaxErrorLength) {
+		r.rejectCallback(w, req, callbackMalformedError)
+		return
+	}
+	description, _ := queryParam(req.URL.RawQuery, "error_description")
+	if failure == callbackErrorAccessDenied {
+		r.accessForbidden(w, req, "the authorization was denied", description)
+		return
+	}
+	r.errorResponse(w, req, "the provider failed the authorization: "+failure, http.StatusBadRequest, nil)
+}
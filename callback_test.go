@@ -0,0 +1,109 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCallbackParameters(t *testing.T) {
+	cs := []struct {
+		Code     string
+		State    string
+		HasState bool
+		Reason   string
+	}{
+		{Code: "fake"},
+		{Code: "0c3d5d4e-9a1b-4c5e.8f2a-4d3b-9c1e.7e6f-4a2b", State: "f47ac10b-58cc-4372-a567-0e02b2c3d479", HasState: true},
+		{Code: "4/P7q7W91a-oMsCeLvIaQm6bTrgtp7", State: "/admin", HasState: true},
+		{Reason: callbackMissingCode},
+		{State: "xyz", HasState: true, Reason: callbackMissingCode},
+		{Code: "fa ke", Reason: callbackMalformedCode},
+		{Code: "<script>", Reason: callbackMalformedCode},
+		{Code: strings.Repeat("a", callbackMaxCodeLength+1), Reason: callbackMalformedCode},
+		{Code: "fake", HasState: true, Reason: callbackMalformedState},
+		{Code: "fake", State: "a&b", HasState: true, Reason: callbackMalformedState},
+		{Code: "fake", State: strings.Repeat("a", callbackMaxStateLength+1), HasState: true, Reason: callbackMalformedState},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Reason, checkCallbackParameters(c.Code, c.State, c.HasState), "case %d", i)
+	}
+}
+
+func TestRateLimitedLog(t *testing.T) {
+	var l rateLimitedLog
+	allowed, suppressed := l.allow(time.Hour)
+	assert.True(t, allowed)
+	assert.Zero(t, suppressed)
+
+	for i := 0; i < 3; i++ {
+		allowed, _ = l.allow(time.Hour)
+		assert.False(t, allowed)
+	}
+	allowed, suppressed = l.allow(0)
+	assert.True(t, allowed)
+	assert.Equal(t, uint64(3), suppressed)
+}
+
+func TestCallbackRejection(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	p := newFakeProxy(cfg)
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:             cfg.WithOAuthURI(callbackURL) + "?state=xyz",
+			ExpectedCode:    http.StatusBadRequest,
+			ExpectedHeaders: map[string]string{"Content-Type": jsonMime},
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fa%20ke&state=xyz",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=" + strings.Repeat("a", callbackMaxCodeLength+1),
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fake&state=%3Cscript%3E",
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			// the denials of the provider lead to the forbidden page
+			URI:          cfg.WithOAuthURI(callbackURL) + "?error=access_denied&error_description=User+denied&state=xyz",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:                     cfg.WithOAuthURI(callbackURL) + "?error=temporarily_unavailable&state=xyz",
+			ExpectedCode:            http.StatusBadRequest,
+			ExpectedContentContains: "temporarily_unavailable",
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?error=%3Cscript%3E",
+			ExpectedCode: http.StatusBadRequest,
+		},
+	})
+
+	// the provider is never contacted
+	assert.Zero(t, atomic.LoadInt32(&p.idp.tokenRequests))
+}
@@ -0,0 +1,377 @@
+//go:build !nocapture
+// +build !nocapture
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+)
+
+// captureRetention is the time the captured requests are kept after the end of the capture, for the operators to
+// retrieve them
+const captureRetention = time.Hour
+
+// captureCredentialHeaders are the parts of the header names carrying credentials, which values are replaced by
+// hashes: the cookies are handled apart, to keep their names
+var captureCredentialHeaders = []string{"authorization", "token", "secret", "password", "api-key", "apikey", "session", "csrf"}
+
+// requestCapture records the redacted headers of a sample of the requests, for a bounded time, into a ring buffer
+type requestCapture struct {
+	sync.Mutex
+	// the settings of the current capture, if any
+	sampleRate  float64
+	maxRequests int
+	path        string
+	endsAt      time.Time
+	// key hashes the credentials, it is drawn for each capture so the hashes cannot be correlated between captures
+	key []byte
+	// captured counts the requests sampled by the current capture
+	captured int
+	// the captured requests, the next one replacing the oldest once the buffer is full
+	requests []capturedRequest
+	next     int
+	size     int
+}
+
+func newRequestCapture(size int) *requestCapture {
+	return &requestCapture{size: size}
+}
+
+// isCaptureValid checks the settings of the request capture
+func (r *Config) isCaptureValid() error {
+	if !r.EnableCaptureEndpoint {
+		return nil
+	}
+	if r.CaptureToken == "" {
+		return errors.New("the capture endpoint requires a capture-token")
+	}
+	if r.CaptureBufferSize <= 0 {
+		return errors.New("the capture-buffer-size must be positive")
+	}
+	if r.CaptureMaxDuration <= 0 {
+		return errors.New("the capture-max-duration must be positive")
+	}
+
+	return nil
+}
+
+// start replaces the current capture, dropping the requests it captured
+func (c *requestCapture) start(sampleRate float64, duration time.Duration, maxRequests int, path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.sampleRate, c.maxRequests, c.path = sampleRate, maxRequests, path
+	c.endsAt = time.Now().Add(duration)
+	c.key = key
+	c.captured = 0
+	c.requests, c.next = nil, 0
+
+	// @metric a capture has been started
+	captureEventsMetric.WithLabelValues("started").Inc()
+
+	return nil
+}
+
+// stop ends the current capture, dropping the requests it captured
+func (c *requestCapture) stop() {
+	c.Lock()
+	defer c.Unlock()
+	if c.key != nil {
+		// @metric a capture has been stopped before its expiry
+		captureEventsMetric.WithLabelValues("stopped").Inc()
+	}
+	*c = requestCapture{size: c.size}
+}
+
+// expire drops the capture and its requests once retained long enough, it must be called with the lock held
+func (c *requestCapture) expire(now time.Time) {
+	if c.key != nil && now.After(c.endsAt.Add(captureRetention)) {
+		// @metric a capture has expired, with the requests it captured
+		captureEventsMetric.WithLabelValues("expired").Inc()
+		*c = requestCapture{size: c.size}
+	}
+}
+
+// sample tells if the request is captured, returning the key hashing its credentials
+func (c *requestCapture) sample(path string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	if c.key == nil || now.After(c.endsAt) || (c.maxRequests > 0 && c.captured >= c.maxRequests) {
+		return nil, false
+	}
+	if c.path != "" && !strings.HasPrefix(path, c.path) {
+		return nil, false
+	}
+	if c.sampleRate < 1 {
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil || float64(n.Int64()) >= c.sampleRate*1000000 {
+			return nil, false
+		}
+	}
+	c.captured++
+
+	return c.key, true
+}
+
+// record adds a captured request to the buffer, unless the capture was replaced meanwhile
+func (c *requestCapture) record(key []byte, request capturedRequest) {
+	c.Lock()
+	defer c.Unlock()
+	if !hmac.Equal(key, c.key) {
+		return
+	}
+
+	if len(c.requests) < c.size {
+		c.requests = append(c.requests, request)
+	} else {
+		c.requests[c.next] = request
+		c.next = (c.next + 1) % c.size
+	}
+
+	// @metric a request has been captured
+	captureEventsMetric.WithLabelValues("captured").Inc()
+}
+
+// report returns the state of the capture and its requests, the oldest first
+func (c *requestCapture) report() captureReport {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	report := captureReport{Requests: make([]capturedRequest, 0, len(c.requests))}
+	if c.key == nil {
+		return report
+	}
+	endsAt, expiresAt := c.endsAt, c.endsAt.Add(captureRetention)
+	report.Active = now.Before(endsAt) && (c.maxRequests == 0 || c.captured < c.maxRequests)
+	report.SampleRate, report.MaxRequests, report.Path = c.sampleRate, c.maxRequests, c.path
+	report.Captured = c.captured
+	report.EndsAt, report.ExpiresAt = &endsAt, &expiresAt
+	report.Requests = append(report.Requests, c.requests[c.next:]...)
+	report.Requests = append(report.Requests, c.requests[:c.next]...)
+
+	return report
+}
+
+// hashCredential replaces a credential by a keyed hash, so the same credential can be recognized within a capture
+func hashCredential(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(value))
+
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// isCredentialHeader tells if the header is named after a credential
+func isCredentialHeader(name string) bool {
+	for _, x := range captureCredentialHeaders {
+		if strings.Contains(name, x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactHeaders copies the headers, replacing the credentials by hashes: the values of the cookies, the credentials
+// of the authorization headers, keeping their scheme, and the values of the headers named after a credential
+func redactHeaders(key []byte, headers http.Header) map[string][]string {
+	redacted := make(map[string][]string, len(headers))
+	for name, values := range headers {
+		lower := strings.ToLower(name)
+		copied := make([]string, 0, len(values))
+		for _, value := range values {
+			switch {
+			case lower == "cookie":
+				var cookies []string
+				for _, x := range strings.Split(value, ";") {
+					cookie := strings.SplitN(strings.TrimSpace(x), "=", 2)
+					if len(cookie) == 2 {
+						cookies = append(cookies, cookie[0]+"="+hashCredential(key, cookie[1]))
+					}
+				}
+				value = strings.Join(cookies, "; ")
+			case lower == "set-cookie":
+				// the attributes of the cookie are kept, e.g. to debug its domain or its samesite policy
+				parts := strings.SplitN(value, ";", 2)
+				cookie := strings.SplitN(parts[0], "=", 2)
+				value = cookie[0] + "=" + hashCredential(key, strings.Join(cookie[1:], "="))
+				if len(parts) == 2 {
+					value += ";" + parts[1]
+				}
+			case strings.HasSuffix(lower, "authorization"):
+				if i := strings.Index(value, " "); i > 0 {
+					value = value[:i] + " " + hashCredential(key, value[i+1:])
+				} else {
+					value = hashCredential(key, value)
+				}
+			case isCredentialHeader(lower):
+				value = hashCredential(key, value)
+			}
+			copied = append(copied, value)
+		}
+		redacted[name] = copied
+	}
+
+	return redacted
+}
+
+// captureMiddleware captures the redacted headers and the timing of the sampled requests
+func (r *oauthProxy) captureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, sampled := r.capture.sample(req.URL.Path)
+		if !sampled {
+			next.ServeHTTP(w, req)
+			return
+		}
+		// the headers are copied before the proxy adds the identity headers
+		request := capturedRequest{
+			Time:           time.Now(),
+			Method:         req.Method,
+			Path:           req.URL.Path,
+			RequestHeaders: redactHeaders(key, req.Header),
+		}
+		next.ServeHTTP(w, req)
+
+		request.DurationSeconds = time.Since(request.Time).Seconds()
+		if resp, ok := w.(middleware.WrapResponseWriter); ok {
+			request.Status = resp.Status()
+		}
+		if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok && !scope.UpstreamStarted.IsZero() {
+			request.UpstreamSeconds = time.Since(scope.UpstreamStarted).Seconds()
+		}
+		request.ResponseHeaders = redactHeaders(key, w.Header())
+		r.capture.record(key, request)
+	})
+}
+
+// isCaptureAllowed checks the bearer token is the capture token
+func (r *oauthProxy) isCaptureAllowed(req *http.Request) bool {
+	bearer := strings.TrimPrefix(req.Header.Get(authorizationHeader), authorizationType+" ")
+
+	return bearer != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(r.config.CaptureToken)) == 1
+}
+
+// parseCaptureSettings checks the settings of a capture, the sample rate defaulting to all the requests
+func (r *oauthProxy) parseCaptureSettings(settings captureSettings) (time.Duration, error) {
+	duration, err := time.ParseDuration(settings.Duration)
+	if err != nil || duration <= 0 {
+		return 0, errors.New("the duration of the capture must be a positive duration, e.g. 10m")
+	}
+	if duration > r.config.CaptureMaxDuration {
+		return 0, fmt.Errorf("the duration of the capture cannot exceed %s", r.config.CaptureMaxDuration)
+	}
+	if settings.SampleRate < 0 || settings.SampleRate > 1 {
+		return 0, errors.New("the sample rate of the capture must be between 0 and 1")
+	}
+	if settings.MaxRequests < 0 {
+		return 0, errors.New("the maximum number of requests of the capture cannot be negative")
+	}
+	if settings.Path != "" && !strings.HasPrefix(settings.Path, "/") {
+		return 0, errors.New("the path of the capture must start with a slash")
+	}
+
+	return duration, nil
+}
+
+// startCaptureHandler starts a capture, replacing the current one
+func (r *oauthProxy) startCaptureHandler(w http.ResponseWriter, req *http.Request) {
+	if !r.isCaptureAllowed(req) {
+		r.errorResponse(w, req, strings.Join([]string{"capture requested by an unauthorized caller", "client_ip", req.RemoteAddr}, ","), http.StatusUnauthorized, nil)
+		return
+	}
+
+	var settings captureSettings
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 4096)).Decode(&settings); err != nil {
+		r.errorResponse(w, req, "the settings of the capture are not valid json", http.StatusBadRequest, err)
+		return
+	}
+	duration, err := r.parseCaptureSettings(settings)
+	if err != nil {
+		r.errorResponse(w, req, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+	if settings.SampleRate == 0 {
+		settings.SampleRate = 1
+	}
+	if err := r.capture.start(settings.SampleRate, duration, settings.MaxRequests, settings.Path); err != nil {
+		r.errorResponse(w, req, "unable to start the capture", http.StatusInternalServerError, err)
+		return
+	}
+
+	// audit trail of the captures
+	r.log.Info("started a request capture",
+		zap.Float64("sample_rate", settings.SampleRate),
+		zap.Duration("duration", duration),
+		zap.Int("max_requests", settings.MaxRequests),
+		zap.String("path", settings.Path),
+		zap.String("client_ip", req.RemoteAddr))
+
+	r.captureReportResponse(w, req)
+}
+
+// captureHandler returns the state of the capture and the requests it captured
+func (r *oauthProxy) captureHandler(w http.ResponseWriter, req *http.Request) {
+	if !r.isCaptureAllowed(req) {
+		r.errorResponse(w, req, strings.Join([]string{"capture requested by an unauthorized caller", "client_ip", req.RemoteAddr}, ","), http.StatusUnauthorized, nil)
+		return
+	}
+	r.captureReportResponse(w, req)
+}
+
+// stopCaptureHandler stops the capture and drops the requests it captured
+func (r *oauthProxy) stopCaptureHandler(w http.ResponseWriter, req *http.Request) {
+	if !r.isCaptureAllowed(req) {
+		r.errorResponse(w, req, strings.Join([]string{"capture requested by an unauthorized caller", "client_ip", req.RemoteAddr}, ","), http.StatusUnauthorized, nil)
+		return
+	}
+	r.capture.stop()
+	r.log.Info("stopped the request capture", zap.String("client_ip", req.RemoteAddr))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *oauthProxy) captureReportResponse(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", jsonMime)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(r.capture.report()); err != nil {
+		r.log.Warn("failed to write the capture report", zap.Error(err))
+	}
+}
@@ -0,0 +1,154 @@
+//go:build !noreverse && !nocapture
+// +build !noreverse,!nocapture
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	key := []byte("key")
+	headers := http.Header{
+		"Authorization": []string{"Bearer abc.def.ghi"},
+		"Cookie":        []string{"kc-access=secret; kc-state=other"},
+		"Set-Cookie":    []string{"kc-access=secret; Path=/; HttpOnly"},
+		"X-Api-Key":     []string{"secret"},
+		"User-Agent":    []string{"curl/7.0"},
+	}
+	redacted := redactHeaders(key, headers)
+
+	hash := hashCredential(key, "secret")
+	assert.Equal(t, []string{"Bearer " + hashCredential(key, "abc.def.ghi")}, redacted["Authorization"])
+	assert.Equal(t, []string{"kc-access=" + hash + "; kc-state=" + hashCredential(key, "other")}, redacted["Cookie"])
+	assert.Equal(t, []string{"kc-access=" + hash + "; Path=/; HttpOnly"}, redacted["Set-Cookie"])
+	assert.Equal(t, []string{hash}, redacted["X-Api-Key"])
+	assert.Equal(t, []string{"curl/7.0"}, redacted["User-Agent"])
+	assert.Equal(t, "Bearer abc.def.ghi", headers.Get("Authorization"), "the headers of the request are not modified")
+
+	// the hashes differ from a capture to the other
+	assert.NotEqual(t, hash, hashCredential([]byte("other"), "secret"))
+}
+
+func TestRequestCaptureBuffer(t *testing.T) {
+	c := newRequestCapture(2)
+	_, sampled := c.sample("/")
+	assert.False(t, sampled, "no capture is started")
+
+	require.NoError(t, c.start(1, time.Minute, 3, "/api"))
+	_, sampled = c.sample("/other")
+	assert.False(t, sampled)
+	for _, path := range []string{"/api/1", "/api/2", "/api/3"} {
+		key, sampled := c.sample(path)
+		require.True(t, sampled)
+		c.record(key, capturedRequest{Path: path})
+	}
+	_, sampled = c.sample("/api/4")
+	assert.False(t, sampled, "the capture ends with the maximum number of requests")
+
+	// the oldest requests are dropped first
+	report := c.report()
+	assert.False(t, report.Active)
+	assert.Equal(t, 3, report.Captured)
+	require.Len(t, report.Requests, 2)
+	assert.Equal(t, "/api/2", report.Requests[0].Path)
+	assert.Equal(t, "/api/3", report.Requests[1].Path)
+
+	// a request sampled by a replaced capture is not recorded
+	require.NoError(t, c.start(1, time.Minute, 0, ""))
+	key, sampled := c.sample("/api/5")
+	require.True(t, sampled)
+	require.NoError(t, c.start(0.5, time.Minute, 0, ""))
+	c.record(key, capturedRequest{Path: "/api/5"})
+	assert.Empty(t, c.report().Requests)
+
+	c.stop()
+	assert.Nil(t, c.report().EndsAt)
+}
+
+func TestCaptureEndpoint(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableCaptureEndpoint = true
+	cfg.CaptureToken = "capture"
+	p := newFakeProxy(cfg)
+	location := p.getServiceURL() + cfg.WithOAuthURI(captureURL)
+	call := func(method, token, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, location, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set(authorizationHeader, authorizationType+" "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp, content
+	}
+
+	resp, _ := call(http.MethodPost, "invalid", `{"duration":"1m"}`)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	for _, body := range []string{`{"duration":"2h"}`, `{"duration":"1m","sample_rate":2}`, `{"duration":"1m","path":"api"}`, `{}`} {
+		resp, _ = call(http.MethodPost, "capture", body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	resp, _ = call(http.MethodPost, "capture", `{"duration":"1m","max_requests":2,"path":"/auth_all"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	signed, err := p.idp.signToken(newTestToken(p.idp.getLocation()).claims)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+"/auth_all/test", nil)
+		require.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: cfg.CookieAccessName, Value: signed.Encode()})
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+
+	resp, content := call(http.MethodGet, "capture", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotContains(t, string(content), signed.Encode(), "the credentials are never captured")
+	var report captureReport
+	require.NoError(t, json.Unmarshal(content, &report))
+	assert.False(t, report.Active)
+	assert.Equal(t, 2, report.Captured)
+	require.Len(t, report.Requests, 2)
+	for _, x := range report.Requests {
+		assert.Equal(t, "/auth_all/test", x.Path)
+		assert.Equal(t, http.StatusOK, x.Status)
+		require.Len(t, x.RequestHeaders["Cookie"], 1)
+		assert.True(t, strings.HasPrefix(x.RequestHeaders["Cookie"][0], cfg.CookieAccessName+"=hmac:"))
+	}
+
+	resp, _ = call(http.MethodDelete, "capture", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, content = call(http.MethodGet, "capture", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.Unmarshal(content, &report))
+	assert.Empty(t, report.Requests)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The purposes of the certificates which expiry is reported
+const (
+	certificatePurposeListener       = "listener"
+	certificatePurposeUpstreamClient = "upstream-client"
+	certificatePurposeForwardingCA   = "forwarding-ca"
+)
+
+// certificateExpiry is the expiry of a certificate loaded by the proxy
+type certificateExpiry struct {
+	purpose   string
+	subject   string
+	expiresAt time.Time
+}
+
+// certificateExpiries tracks the expiry of the certificates loaded from files, which the operators have to renew
+type certificateExpiries struct {
+	sync.RWMutex
+	// the certificates by purpose and source file
+	certificates map[string]certificateExpiry
+}
+
+func newCertificateExpiries() *certificateExpiries {
+	return &certificateExpiries{certificates: make(map[string]certificateExpiry)}
+}
+
+// record tracks the expiry of a certificate, replacing the one previously loaded from the same source
+func (c *certificateExpiries) record(purpose, source string, certificate tls.Certificate) {
+	if c == nil || len(certificate.Certificate) == 0 {
+		return
+	}
+	leaf := certificate.Leaf
+	if leaf == nil {
+		parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return
+		}
+		leaf = parsed
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.certificates[purpose+"|"+source] = certificateExpiry{
+		purpose:   purpose,
+		subject:   leaf.Subject.CommonName,
+		expiresAt: leaf.NotAfter,
+	}
+	// @metric the earliest expiry of the certificates of the purpose
+	var earliest time.Time
+	for _, x := range c.certificates {
+		if x.purpose == purpose && (earliest.IsZero() || x.expiresAt.Before(earliest)) {
+			earliest = x.expiresAt
+		}
+	}
+	certificateExpiryMetric.WithLabelValues(purpose).Set(float64(earliest.Unix()))
+}
+
+// list returns the tracked certificates, the earliest expiry first
+func (c *certificateExpiries) list() []certificateExpiry {
+	if c == nil {
+		return nil
+	}
+	c.RLock()
+	defer c.RUnlock()
+
+	list := make([]certificateExpiry, 0, len(c.certificates))
+	for _, x := range c.certificates {
+		list = append(list, x)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].expiresAt.Before(list[j].expiresAt)
+	})
+
+	return list
+}
@@ -16,6 +16,8 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
@@ -27,7 +29,11 @@ import (
 	"github.com/urfave/cli"
 )
 
-const durationType = "time.Duration"
+const (
+	durationType = "time.Duration"
+	// exportOpenAPIFlag is the command line option exporting the openapi document, not part of the configuration
+	exportOpenAPIFlag = "export-openapi"
+)
 
 // newOauthProxyApp creates a new cli application and runs it
 func newOauthProxyApp() *cli.App {
@@ -38,7 +44,10 @@ func newOauthProxyApp() *cli.App {
 	app.Version = version.GetVersion()
 	app.Author = version.Author
 	app.Email = version.Email
-	app.Flags = getCommandLineOptions()
+	app.Flags = append(getCommandLineOptions(), cli.StringFlag{
+		Name:  exportOpenAPIFlag,
+		Usage: "writes the openapi document of the endpoints of the proxy to the file, or to stdout with -, then exits",
+	})
 	app.UsageText = "keycloak-gatekeeper [options]"
 
 	// step: the standard usage message isn't that helpful
@@ -49,22 +58,11 @@ func newOauthProxyApp() *cli.App {
 
 	// step: set the default action
 	app.Action = func(cx *cli.Context) error {
-		configFile := cx.String("config")
-		// step: do we have a configuration file?
-		if configFile != "" {
-			if err := readConfigFile(configFile, config); err != nil {
-				return printError("unable to read the configuration file: %s, error: %s", configFile, err.Error())
-			}
-		}
-
-		// step: parse the command line options
-		if err := parseCLIOptions(cx, config); err != nil {
-			return printError(err.Error())
+		if location := cx.String(exportOpenAPIFlag); location != "" {
+			return exportOpenAPI(cx, config, location)
 		}
-
-		// step: validate the configuration
-		if err := config.isValid(); err != nil {
-			return printError(err.Error())
+		if err := loadConfig(cx, config); err != nil {
+			return err
 		}
 
 		// step: create the proxy
@@ -81,14 +79,105 @@ func newOauthProxyApp() *cli.App {
 		// step: setup the termination signals
 		signalChannel := make(chan os.Signal, 1)
 		signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-		<-signalChannel
+		// SIGHUP reloads the forwarding credentials, or stops the proxy when there is nothing to reload
+		for {
+			if sig := <-signalChannel; sig != syscall.SIGHUP || !proxy.Reload() {
+				break
+			}
+		}
+
+		if err := proxy.Shutdown(); err != nil {
+			return printError(err.Error())
+		}
 
 		return nil
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:      "self-test",
+			Usage:     "exercises the login flow against the provider and reports the outcome of each step",
+			UsageText: "keycloak-gatekeeper self-test [options]",
+			Flags:     getCommandLineOptions(),
+			Action: func(cx *cli.Context) error {
+				if err := loadConfig(cx, config); err != nil {
+					return err
+				}
+				proxy, err := newProxy(config)
+				if err != nil {
+					return printError(err.Error())
+				}
+
+				report := proxy.selfTest(context.Background())
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				if err := encoder.Encode(report); err != nil {
+					return printError(err.Error())
+				}
+				if !report.Passed {
+					return printError("self-test failed")
+				}
+
+				return nil
+			},
+		},
+	}
+
 	return app
 }
 
+// loadConfig reads the configuration file and the command line options, then validates the configuration
+func loadConfig(cx *cli.Context, config *Config) error {
+	configFile := cx.String("config")
+	// step: do we have a configuration file?
+	if configFile != "" {
+		if err := readConfigFile(configFile, config); err != nil {
+			return printError("unable to read the configuration file: %s, error: %s", configFile, err.Error())
+		}
+	}
+
+	// step: parse the command line options
+	if err := parseCLIOptions(cx, config); err != nil {
+		return printError(err.Error())
+	}
+
+	// step: validate the configuration
+	if err := config.isValid(); err != nil {
+		return printError(err.Error())
+	}
+
+	return nil
+}
+
+// exportOpenAPI writes the openapi document of the endpoints enabled by the configuration. The configuration
+// is not validated, so the document can be generated at build time.
+func exportOpenAPI(cx *cli.Context, config *Config, location string) error {
+	if configFile := cx.String("config"); configFile != "" {
+		if err := readConfigFile(configFile, config); err != nil {
+			return printError("unable to read the configuration file: %s, error: %s", configFile, err.Error())
+		}
+	}
+	if err := parseCLIOptions(cx, config); err != nil {
+		return printError(err.Error())
+	}
+
+	content, err := json.MarshalIndent(config.generateOpenAPI(), "", "  ")
+	if err != nil {
+		return printError(err.Error())
+	}
+	content = append(content, '\n')
+	if location == "-" {
+		_, err = os.Stdout.Write(content)
+	} else {
+		err = os.WriteFile(location, content, 0o600)
+	}
+	if err != nil {
+		return printError("unable to write the openapi document: %s", err.Error())
+	}
+
+	return nil
+}
+
 // getCommandLineOptions builds the command line options by reflecting the Config struct and extracting
 // the tagged information
 func getCommandLineOptions() []cli.Flag {
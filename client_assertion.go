@@ -0,0 +1,147 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// clientAssertionType is the type of the client assertions signed by the proxy (RFC 7523)
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// clientAssertionLifetime is the validity of a client assertion, signed for a single request
+	clientAssertionLifetime = time.Minute
+)
+
+// clientAssertion signs the assertions authenticating the proxy to the token endpoint of the provider, in place of
+// the client secret (private_key_jwt)
+type clientAssertion struct {
+	key       crypto.Signer
+	algorithm string
+	kid       string
+	now       func() time.Time
+}
+
+// clientAssertionClaims are the claims of a client assertion
+type clientAssertionClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// newClientAssertion loads the private key signing the client assertions: RS256 with a rsa key, ES256 with a P-256
+// ecdsa key
+func newClientAssertion(keyFile, kid string) (*clientAssertion, error) {
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the client assertion key: %w", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("the client assertion key %s is not pem encoded", keyFile)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid client assertion key: %w", err)
+	}
+
+	assertion := &clientAssertion{kid: kid, now: time.Now}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		assertion.key, assertion.algorithm = k, "RS256"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("the ecdsa client assertion key must be on the P-256 curve (ES256)")
+		}
+		assertion.key, assertion.algorithm = k, "ES256"
+	default:
+		return nil, fmt.Errorf("unsupported client assertion key of type %T, must be a rsa or ecdsa key", key)
+	}
+
+	return assertion, nil
+}
+
+// sign returns a client assertion of the client for the audience, i.e. the token endpoint
+func (a *clientAssertion) sign(clientID, audience string) (string, error) {
+	now := a.now()
+	header, err := json.Marshal(struct {
+		Algorithm string `json:"alg"`
+		Type      string `json:"typ"`
+		KeyID     string `json:"kid,omitempty"`
+	}{Algorithm: a.algorithm, Type: "JWT", KeyID: a.kid})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(clientAssertionClaims{
+		Issuer:    clientID,
+		Subject:   clientID,
+		Audience:  audience,
+		ID:        uuid.NewString(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(clientAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	var signature []byte
+	switch key := a.key.(type) {
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(cryptorand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case *ecdsa.PrivateKey:
+		// the jws signatures are the concatenated r and s, not asn.1 encoded
+		r, s, err := ecdsa.Sign(cryptorand.Reader, key, digest[:])
+		if err != nil {
+			return "", err
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
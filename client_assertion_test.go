@@ -0,0 +1,161 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestAssertionKey writes the pem encoded private key to a file of the test
+func writeTestAssertionKey(t *testing.T, blockType string, der []byte) string {
+	location := filepath.Join(t.TempDir(), "client.pem")
+	require.NoError(t, os.WriteFile(location, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+
+	return location
+}
+
+// parseTestClientAssertion verifies the signature of a client assertion, and returns its claims
+func parseTestClientAssertion(assertion string, key crypto.PublicKey) (clientAssertionClaims, error) {
+	var claims clientAssertionClaims
+	segments := strings.Split(assertion, ".")
+	if len(segments) != 3 {
+		return claims, errors.New("the assertion is not a jwt")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return claims, err
+		}
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 || !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return claims, errors.New("invalid signature")
+		}
+	default:
+		return claims, fmt.Errorf("unsupported key %T", key)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return claims, err
+	}
+
+	return claims, json.Unmarshal(payload, &claims)
+}
+
+func TestClientAssertionClaims(t *testing.T) {
+	block, _ := pem.Decode([]byte(fakePrivateKey))
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	require.NoError(t, err)
+	assertion, err := newClientAssertion(writeTestAssertionKey(t, "RSA PRIVATE KEY", block.Bytes), "client-kid")
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	assertion.now = func() time.Time { return now }
+
+	signed, err := assertion.sign(fakeClientID, "https://idp/token")
+	require.NoError(t, err)
+	header, err := base64.RawURLEncoding.DecodeString(strings.Split(signed, ".")[0])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"alg":"RS256","typ":"JWT","kid":"client-kid"}`, string(header))
+
+	claims, err := parseTestClientAssertion(signed, &key.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, fakeClientID, claims.Issuer)
+	assert.Equal(t, fakeClientID, claims.Subject)
+	assert.Equal(t, "https://idp/token", claims.Audience)
+	assert.NotEmpty(t, claims.ID)
+	assert.Equal(t, now.Unix(), claims.IssuedAt)
+	assert.Equal(t, now.Add(clientAssertionLifetime).Unix(), claims.ExpiresAt)
+
+	// each assertion is used once
+	other, err := assertion.sign(fakeClientID, "https://idp/token")
+	require.NoError(t, err)
+	otherClaims, err := parseTestClientAssertion(other, &key.PublicKey)
+	require.NoError(t, err)
+	assert.NotEqual(t, claims.ID, otherClaims.ID)
+}
+
+func TestClientAssertionES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	sec1, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	for _, location := range []string{writeTestAssertionKey(t, "EC PRIVATE KEY", sec1), writeTestAssertionKey(t, "PRIVATE KEY", pkcs8)} {
+		assertion, err := newClientAssertion(location, "")
+		require.NoError(t, err)
+		assert.Equal(t, "ES256", assertion.algorithm)
+
+		signed, err := assertion.sign(fakeClientID, "https://idp/token")
+		require.NoError(t, err)
+		header, err := base64.RawURLEncoding.DecodeString(strings.Split(signed, ".")[0])
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"alg":"ES256","typ":"JWT"}`, string(header))
+		claims, err := parseTestClientAssertion(signed, &key.PublicKey)
+		require.NoError(t, err)
+		assert.Equal(t, int64(clientAssertionLifetime/time.Second), claims.ExpiresAt-claims.IssuedAt)
+	}
+}
+
+func TestNewClientAssertionInvalidKey(t *testing.T) {
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(p384)
+	require.NoError(t, err)
+	notPEM := filepath.Join(t.TempDir(), "client.key")
+	require.NoError(t, os.WriteFile(notPEM, []byte("secret"), 0o600))
+
+	cs := []struct {
+		Location string
+		Error    string
+	}{
+		{Location: filepath.Join(t.TempDir(), "missing.pem"), Error: "unable to read the client assertion key"},
+		{Location: notPEM, Error: "is not pem encoded"},
+		{Location: writeTestAssertionKey(t, "EC PRIVATE KEY", der), Error: "P-256 curve"},
+		{Location: writeTestAssertionKey(t, "PRIVATE KEY", []byte("invalid")), Error: "invalid client assertion key"},
+	}
+	for _, c := range cs {
+		_, err := newClientAssertion(c.Location, "")
+		if assert.Error(t, err, "key: %s", c.Location) {
+			assert.Contains(t, err.Error(), c.Error)
+		}
+	}
+}
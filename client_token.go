@@ -0,0 +1,255 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/oauth2"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// clientTokenMinValidity is the minimum remaining lifetime of a cached client token handed over to a caller
+	clientTokenMinValidity = 30 * time.Second
+	// clientTokenRateWindow is the window over which client token requests are counted
+	clientTokenRateWindow = time.Minute
+	// clientTokenRateLimitName names the rate limit of the client tokens in the store and the metrics
+	clientTokenRateLimitName = "client-token"
+)
+
+// clientTokenIssuer holds the client-credentials token minted by the proxy on behalf of trusted callers.
+//
+// The token is shared by all callers, since it is issued to our own confidential client: the concurrent callers
+// finding it about to expire wait for a single request to the provider.
+type clientTokenIssuer struct {
+	// tokenLock guards the cached token, it is never held across a request to the provider
+	tokenLock sync.RWMutex
+	token     string
+	scope     string
+	expires   time.Time
+	mints     singleflight.Group
+
+	// fixed window rate limiter, per caller
+	limitLock   sync.Mutex
+	limit       int
+	windowStart time.Time
+	counts      map[string]int
+	// shared is the rate limit shared by the replicas, if any, the local limiter is its fallback
+	shared *sharedRateLimit
+}
+
+func newClientTokenIssuer(limit int) *clientTokenIssuer {
+	return &clientTokenIssuer{
+		limit:  limit,
+		counts: make(map[string]int),
+	}
+}
+
+// allow tells if the caller has not exceeded its rate limit
+func (c *clientTokenIssuer) allow(caller string) bool {
+	if c.limit <= 0 {
+		return true
+	}
+	if c.shared != nil {
+		return c.shared.allow(caller, c.allowLocally)
+	}
+
+	return c.allowLocally(caller)
+}
+
+// allowLocally tells if the caller has not exceeded its rate limit on this replica
+func (c *clientTokenIssuer) allowLocally(caller string) bool {
+	c.limitLock.Lock()
+	defer c.limitLock.Unlock()
+
+	if now := time.Now(); now.Sub(c.windowStart) >= clientTokenRateWindow {
+		c.windowStart = now
+		c.counts = make(map[string]int, len(c.counts))
+	}
+	c.counts[caller]++
+
+	return c.counts[caller] <= c.limit
+}
+
+// get returns the cached token, or a fresh one from the provider whenever the cached one is about to expire
+func (c *clientTokenIssuer) get(mint func() (string, string, time.Time, error)) (token, scope string, expires time.Time, cached bool, err error) {
+	if token, scope, expires, ok := c.cached(); ok {
+		return token, scope, expires, true, nil
+	}
+
+	minted, err, _ := c.mints.Do("client-token", func() (interface{}, error) {
+		// the token may have been renewed by a mint which completed meanwhile
+		if token, scope, expires, ok := c.cached(); ok {
+			return clientToken{token: token, scope: scope, expires: expires}, nil
+		}
+		token, scope, expires, err := mint()
+		if err != nil {
+			return nil, err
+		}
+		c.tokenLock.Lock()
+		c.token, c.scope, c.expires = token, scope, expires
+		c.tokenLock.Unlock()
+
+		return clientToken{token: token, scope: scope, expires: expires}, nil
+	})
+	if err != nil {
+		return "", "", time.Time{}, false, err
+	}
+	fresh := minted.(clientToken)
+
+	return fresh.token, fresh.scope, fresh.expires, false, nil
+}
+
+// clientToken is a token minted by the provider, shared by the callers of a mint
+type clientToken struct {
+	token   string
+	scope   string
+	expires time.Time
+}
+
+// cached returns the cached token, provided it is not about to expire
+func (c *clientTokenIssuer) cached() (string, string, time.Time, bool) {
+	c.tokenLock.RLock()
+	defer c.tokenLock.RUnlock()
+
+	if c.token == "" || time.Until(c.expires) <= clientTokenMinValidity {
+		return "", "", time.Time{}, false
+	}
+
+	return c.token, c.scope, c.expires, true
+}
+
+// clientTokenCaller identifies a caller allowed to request a client token, either from its verified client
+// certificate or from a static key presented with basic authentication
+func (r *oauthProxy) clientTokenCaller(req *http.Request) (string, bool) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		subject := req.TLS.VerifiedChains[0][0].Subject.CommonName
+		if containsString(subject, r.config.ClientTokenAllowedSubjects) {
+			return "cn=" + subject, true
+		}
+	}
+
+	if caller, key, ok := req.BasicAuth(); ok {
+		expected, found := r.config.ClientTokenKeys[caller]
+		if found && subtle.ConstantTimeCompare([]byte(key), []byte(expected)) == 1 {
+			return caller, true
+		}
+	}
+
+	return "", false
+}
+
+// mintClientToken requests a client-credentials access token from the provider and checks its audience
+func (r *oauthProxy) mintClientToken() (string, string, time.Time, error) {
+	client, err := r.client.OAuthClient()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	// the mint is shared by the waiting callers, it is not aborted with the request of any of them
+	var resp oauth2.TokenResponse
+	err = r.retry(context.Background(), clientTokenBackoff, func(context.Context) error {
+		start := time.Now()
+		var err error
+		if resp, err = client.ClientCredsToken(r.config.ClientTokenScopes); err != nil {
+			return refusedGrant(err)
+		}
+		// @metric observe the time taken for a client credentials request
+		oauthLatencyMetric.WithLabelValues("client-token").Observe(time.Since(start).Seconds())
+
+		return nil
+	})
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	token, _, err := parseToken(resp.AccessToken)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	identity, err := extractIdentity(token, r.config.identityClaims())
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	if !identity.isAudience(r.config.ClientTokenAudience) {
+		return "", "", time.Time{}, fmt.Errorf("the client token is not issued for the audience %q, but for: %s",
+			r.config.ClientTokenAudience, strings.Join(identity.audiences, ","))
+	}
+
+	return resp.AccessToken, resp.Scope, identity.expiresAt, nil
+}
+
+// clientTokenHandler hands over a client-credentials access token to a trusted server-to-server caller,
+// so batch jobs do not have to implement oauth nor to know about the client secret
+func (r *oauthProxy) clientTokenHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, span, logger := r.traceSpan(req.Context(), "client token handler")
+	if span != nil {
+		defer span.End()
+	}
+
+	caller, ok := r.clientTokenCaller(req)
+	if !ok {
+		r.errorResponse(w, req.WithContext(ctx), strings.Join([]string{"client token requested by an unknown caller", "client_ip", req.RemoteAddr}, ","), http.StatusUnauthorized, nil)
+		return
+	}
+
+	if !r.clientTokens.allow(caller) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(clientTokenRateWindow.Seconds())))
+		r.errorResponse(w, req.WithContext(ctx), strings.Join([]string{"client token rate limit exceeded", "caller", caller}, ","), http.StatusTooManyRequests, nil)
+		return
+	}
+
+	token, scope, expires, cached, err := r.clientTokens.get(r.mintClientToken)
+	if err != nil {
+		r.errorResponse(w, req.WithContext(ctx), "unable to request the access token via grant_type 'client_credentials'", http.StatusInternalServerError, err)
+		return
+	}
+
+	// audit trail of all the tokens handed over
+	logger.Info("issuing client token",
+		zap.String("caller", caller),
+		zap.String("client_ip", req.RemoteAddr),
+		zap.String("audience", r.config.ClientTokenAudience),
+		zap.Bool("cached", cached),
+		zap.String("expires", expires.Format(time.RFC3339)))
+
+	// @metric a client token has been issued
+	oauthTokensMetric.WithLabelValues("client-token").Inc()
+
+	w.Header().Set("Content-Type", jsonMime)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(tokenResponse{
+		TokenType:   authorizationType,
+		AccessToken: token,
+		ExpiresIn:   int(time.Until(expires).Seconds()),
+		Scope:       scope,
+	}); err != nil {
+		logger.Warn("failed to write the client token response", zap.Error(err))
+	}
+}
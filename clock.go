@@ -0,0 +1,46 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "time"
+
+// clock tells the time to the lifetimes of the sessions and the renewals of the tokens, so the tests may set the time
+// at their boundaries rather than wait for it
+type clock interface {
+	Now() time.Time
+}
+
+// systemClock is the clock of the host
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// now returns the current time on the clock of the proxy, the clock of the host unless replaced by a fake clock in
+// the tests
+func (r *oauthProxy) now() time.Time {
+	if r.clock == nil {
+		return time.Now()
+	}
+
+	return r.clock.Now()
+}
+
+// until returns the duration until a time on the clock of the proxy
+func (r *oauthProxy) until(t time.Time) time.Duration {
+	return t.Sub(r.now())
+}
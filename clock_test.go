@@ -0,0 +1,61 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock which only moves when told to
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.now
+}
+
+// advance moves the clock forward
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestProxyClock(t *testing.T) {
+	r := &oauthProxy{}
+	before := time.Now()
+	assert.False(t, r.now().Before(before), "the clock of the host is used by default")
+
+	clock := newFakeClock()
+	r.clock = clock
+	assert.Equal(t, clock.Now(), r.now())
+	assert.Equal(t, time.Minute, r.until(clock.Now().Add(time.Minute)))
+	clock.advance(2 * time.Minute)
+	assert.Equal(t, -time.Minute, r.until(time.Unix(1700000000, 0).Add(time.Minute)))
+}
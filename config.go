@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"net/url"
 	"os"
-	"regexp"
 	"strings"
 	"time"
 )
@@ -40,51 +39,90 @@ func newDefaultConfig() *Config {
 	hostnames = append(hostnames, []string{"localhost", "127.0.0.1", "::1"}...)
 
 	return &Config{
-		AccessTokenDuration:           time.Duration(720) * time.Hour,
-		CookieAccessName:              accessCookie,
-		CookieRefreshName:             refreshCookie,
-		CSRFCookieName:                "kc-csrf",
-		CSRFHeader:                    "X-Csrf-Token",
-		EnableAuthorizationCookies:    false,
-		EnableAuthorizationHeader:     true,
-		EnableCSRF:                    false,
-		EnableDefaultDeny:             true,
-		EnableSessionCookies:          true,
-		EnableTokenHeader:             true,
-		EnableClaimsHeaders:           true,
-		EnableMetrics:                 true,
-		TracingExporter:               "jaeger",
-		HTTPOnlyCookie:                true,
-		Headers:                       make(map[string]string),
-		LetsEncryptCacheDir:           "./cache/",
-		MatchClaims:                   make(map[string]string),
-		MaxIdleConns:                  100,
-		MaxIdleConnsPerHost:           50,
-		OAuthURI:                      "/oauth",
-		OpenIDProviderTimeout:         30 * time.Second,
-		PreserveHost:                  false,
-		SelfSignedTLSExpiration:       3 * time.Hour,
-		SelfSignedTLSHostnames:        hostnames,
-		RequestIDHeader:               "X-Request-ID",
-		ResponseHeaders:               make(map[string]string),
-		SameSiteCookie:                SameSiteLax,
-		SecureCookie:                  true,
-		ServerIdleTimeout:             120 * time.Second,
-		ServerReadTimeout:             10 * time.Second,
-		ServerWriteTimeout:            11 * time.Second, // make it upstream timeout + 1s to avoid closing the connection before headers are sent
-		SkipOpenIDProviderTLSVerify:   false,
-		SkipUpstreamTLSVerify:         true,
-		Tags:                          make(map[string]string),
-		UpstreamExpectContinueTimeout: 10 * time.Second,
-		UpstreamKeepaliveTimeout:      10 * time.Second,
-		UpstreamKeepalives:            true,
-		UpstreamResponseHeaderTimeout: 10 * time.Second,
-		UpstreamTLSHandshakeTimeout:   10 * time.Second,
-		UpstreamTimeout:               10 * time.Second,
-		UseLetsEncrypt:                false,
+		AccessTokenDuration:            time.Duration(720) * time.Hour,
+		AllowedMethods:                 append([]string{}, defaultAllowedMethods...),
+		CookieAccessName:               accessCookie,
+		CookieFilterMode:               cookieFilterRedact,
+		ForwardedHeaders:               forwardedHeadersBoth,
+		CookieRefreshName:              refreshCookie,
+		CSRFCookieName:                 "kc-csrf",
+		CSRFHeader:                     "X-Csrf-Token",
+		ClientTokenKeys:                make(map[string]string),
+		ClientTokenRateLimit:           60,
+		EnableAuthorizationCookies:     false,
+		EnableAuthorizationHeader:      true,
+		EnableCSRF:                     false,
+		EnableDefaultDeny:              true,
+		EnableLongestMatch:             true,
+		EnableSessionCookies:           true,
+		EnableTokenHeader:              true,
+		ForwardingDrainTimeout:         10 * time.Second,
+		ForwardingLoginBackoffMax:      5 * time.Minute,
+		ForwardingTokenHeader:          authorizationHeader,
+		ForwardingTokenPrefix:          authorizationType + " ",
+		EnableClaimsHeaders:            true,
+		EnableMetrics:                  true,
+		TracingExporter:                "jaeger",
+		HTTPOnlyCookie:                 true,
+		Headers:                        make(map[string]string),
+		HeadersPrefix:                  defaultHeadersPrefix,
+		HealthCheckTimeout:             2 * time.Second,
+		HealthCertificateExpiryWarning: 14 * 24 * time.Hour,
+		HealthJWKSAgeWarning:           24 * time.Hour,
+		JWKSRefreshInterval:            time.Hour,
+		JWKSMinRefreshInterval:         10 * time.Second,
+		AcceptedSigningAlgorithms:      []string{signingAlgorithmRS256},
+		CaptureBufferSize:              100,
+		ClaimsHeaderMaxSize:            defaultClaimsHeaderMaxSize,
+		CaptureMaxDuration:             time.Hour,
+		LetsEncryptCacheDir:            "./cache/",
+		LoginReplayMaxSize:             16384,
+		MatchClaims:                    make(map[string]string),
+		MaxIdleConns:                   100,
+		MaxIdleConnsPerHost:            50,
+		OfflineSessionDuration:         30 * 24 * time.Hour,
+		OAuthURI:                       "/oauth",
+		OpenIDProviderTimeout:          30 * time.Second,
+		PreserveHost:                   false,
+		SelfSignedTLSExpiration:        3 * time.Hour,
+		SelfSignedTLSHostnames:         hostnames,
+		RequestIDHeader:                "X-Request-ID",
+		ResponseHeaders:                make(map[string]string),
+		SameSiteCookie:                 SameSiteLax,
+		SecureCookie:                   true,
+		SelfTestPath:                   "/",
+		SessionRevocationMaxAge:        10 * time.Hour,
+		SessionRevocationMaxEntries:    100000,
+		ServerIdleTimeout:              120 * time.Second,
+		ServerReadTimeout:              10 * time.Second,
+		ServerWriteTimeout:             11 * time.Second, // make it upstream timeout + 1s to avoid closing the connection before headers are sent
+		SkipOpenIDProviderTLSVerify:    false,
+		SkipUpstreamTLSVerify:          true,
+		StoreGCInterval:                10 * time.Minute,
+		Tags:                           make(map[string]string),
+		UpstreamExpectContinueTimeout:  10 * time.Second,
+		UpstreamKeepaliveTimeout:       10 * time.Second,
+		UpstreamEnableHTTP2:            true,
+		UpstreamKeepalives:             true,
+		UpstreamResponseHeaderTimeout:  10 * time.Second,
+		UpstreamTLSHandshakeTimeout:    10 * time.Second,
+		UpstreamTimeout:                10 * time.Second,
+		UMACacheTTL:                    time.Minute,
+		ExternalAuthzTimeout:           time.Second,
+		ExternalAuthzFailureMode:       externalAuthzFailureDeny,
+		UseLetsEncrypt:                 false,
 	}
 }
 
+// sessionRevocationMaxAge returns the time the revocations are kept, covering the offline sessions when enabled
+func (r *Config) sessionRevocationMaxAge() time.Duration {
+	if r.EnableOfflineTokens && r.OfflineSessionDuration > r.SessionRevocationMaxAge {
+		return r.OfflineSessionDuration
+	}
+
+	return r.SessionRevocationMaxAge
+}
+
 // WithOAuthURI returns the oauth uri
 func (r *Config) WithOAuthURI(uri string) string {
 	if r.BaseURI != "" {
@@ -103,11 +141,30 @@ func (r *Config) isValid() error {
 		return err
 	}
 
+	if err := r.isLocalAddressValid("upstream-local-address", r.UpstreamLocalAddress); err != nil {
+		return err
+	}
+	if err := r.isLocalAddressValid("openid-provider-local-address", r.OpenIDProviderLocalAddress); err != nil {
+		return err
+	}
+	if err := r.isUpstreamProxyValid(); err != nil {
+		return err
+	}
+
 	if r.UseLetsEncrypt && r.LetsEncryptCacheDir == "" {
 		return fmt.Errorf("the letsencrypt cache dir has not been set")
 	}
+	if r.ClientSecret != "" && r.ClientAssertionKey != "" {
+		return errors.New("you cannot set both the client-secret and the client-assertion-key, the client authenticates with either")
+	}
+	if r.ClientAssertionKID != "" && r.ClientAssertionKey == "" {
+		return errors.New("the client-assertion-kid requires a client-assertion-key")
+	}
 
 	if r.EnableForwarding {
+		if err := r.isReverseProxyUnused(); err != nil {
+			return err
+		}
 		return r.isForwardingValid()
 	}
 
@@ -118,13 +175,14 @@ func (r *Config) isValid() error {
 		return fmt.Errorf("unsupported trace exporter. Current supported values are %q|%q", jaegerExporter, datadogExporter)
 	}
 
-	if r.SameSiteCookie != "" && r.SameSiteCookie != SameSiteStrict && r.SameSiteCookie != SameSiteLax && r.SameSiteCookie != SameSiteNone {
-		return errors.New("same-site-cookie must be one of Strict|Lax|None")
-	}
-
 	return r.isReverseProxyValid()
 }
 
+// trustsAuthenticatorOn tells if the users on the listener are authenticated by the trusted upstream authenticator
+func (r *Config) trustsAuthenticatorOn(listen string) bool {
+	return r.TrustedAuthenticator != "" && (len(r.TrustedAuthenticatorListeners) == 0 || containsString(listen, r.TrustedAuthenticatorListeners))
+}
+
 // hasCustomSignInPage checks if there is a custom sign in  page
 func (r *Config) hasCustomSignInPage() bool {
 	return r.SignInPage != ""
@@ -135,6 +193,16 @@ func (r *Config) hasCustomForbiddenPage() bool {
 	return r.ForbiddenPage != ""
 }
 
+// hasCustomUnauthorizedPage checks if there is a custom unauthorized page
+func (r *Config) hasCustomUnauthorizedPage() bool {
+	return r.UnauthorizedPage != ""
+}
+
+// hasCustomErrorPage checks if there is a custom page for the upstream failures
+func (r *Config) hasCustomErrorPage() bool {
+	return r.ErrorPage != ""
+}
+
 // tlsAdvancedConfig holds advanced parameters to control TLS negotiation
 type tlsAdvancedConfig struct {
 	tlsUseModernSettings        bool
@@ -467,110 +535,17 @@ func (r *Config) isTLSCertValid() error {
 	return nil
 }
 
-func (r *Config) isReverseProxyValid() error {
-	switch r.Upstream {
-	case "":
-		if r.EnableDefaultDeny && !r.EnableDefaultNotFound {
-			return errors.New("you expect some default fallback routing, but have not specified an upstream endpoint to proxy to")
-		}
-		for _, resource := range r.Resources {
-			if resource.Upstream == "" {
-				return fmt.Errorf("you did not set any default upstream and you have not specified an upstream endpoint to proxy to on resource: %s", resource.URL)
-			}
-		}
-	default:
-		if _, err := url.Parse(r.Upstream); err != nil {
-			return fmt.Errorf("the upstream endpoint is invalid, %s", err)
-		}
-	}
-
-	if !r.SkipUpstreamTLSVerify && r.UpstreamCA == "" {
-		return fmt.Errorf("you cannot require to check upstream tls and omit to specify the root ca to verify it: %s", r.UpstreamCA)
-	}
-
-	// step: if token verification is enabled (skip is off), we need the below checks
-	if !r.SkipTokenVerification {
-		if err := r.isTokenConfigValid(); err != nil {
-			return err
-		}
-	}
-	// check: ensure each of the resource are valid
-	newResources := make([]*Resource, 0, len(r.Resources))
-	for _, resource := range r.Resources {
-		if err := resource.valid(); err != nil {
-			return err
-		}
-		// expand resources with multiple urls
-		if len(resource.URLs) > 0 {
-			for _, u := range resource.URLs {
-				res := &Resource{
-					URL:            u,
-					URLs:           nil,
-					Methods:        append([]string{}, resource.Methods...),
-					WhiteListed:    resource.WhiteListed,
-					BlackListed:    resource.BlackListed,
-					RequireAnyRole: resource.RequireAnyRole,
-					Roles:          append([]string{}, resource.Roles...),
-					Groups:         append([]string{}, resource.Groups...),
-					EnableCSRF:     resource.EnableCSRF,
-					StripBasePath:  resource.StripBasePath,
-					Upstream:       resource.Upstream,
-				}
-				newResources = append(newResources, res)
-			}
-		} else {
-			newResources = append(newResources, resource)
-		}
-	}
-	r.Resources = newResources
-
-	// check for duplicate uris in resources
-	uris := make(map[string]struct{}, len(r.Resources))
-	for _, resource := range r.Resources {
-		if _, ok := uris[resource.URL]; !ok {
-			uris[resource.URL] = struct{}{}
-		} else {
-			return errors.New("a duplicate entry in resource URIs has been found")
-		}
-		if resource.URL == allRoutes && r.EnableDefaultDeny && resource.WhiteListed {
-			return errors.New("you've asked for a default denial (EnableDefaultDeny is true by default) but whitelisted everything")
-		}
-	}
-
-	// step: validate the claims are validate regex's
-	for k, claim := range r.MatchClaims {
-		if _, err := regexp.Compile(claim); err != nil {
-			return fmt.Errorf("the claim matcher: %s for claim: %s is not a valid regex", claim, k)
-		}
-	}
-
-	// step: validity checks for CSRF options
-	if r.EnableCSRF {
-		if r.EncryptionKey == "" {
-			return fmt.Errorf("flag EnableCSRF requires EncryptionKey to be set")
-		}
-		var found bool
-		for _, resource := range r.Resources {
-			if resource.EnableCSRF {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return fmt.Errorf("flag EnableCSRF is set but no protected resource sets EnableCSRF")
-		}
-	}
-	return nil
-}
-
 func (r *Config) isDiscoveryValid() error {
 	if r.DiscoveryURL == "" {
 		return errors.New("you have not specified the discovery url")
 	}
-	if u, err := url.Parse(r.DiscoveryURL); err != nil || u.Scheme == "" || u.Host == "" {
-		return fmt.Errorf("discovery url is not a valid URL: %s", r.DiscoveryURL)
+	discoveryURL, err := normalizeDiscoveryURL(r.DiscoveryURL)
+	if err != nil {
+		return err
 	}
-	return nil
+	r.DiscoveryURL = discoveryURL
+
+	return r.isExtraIssuersValid()
 }
 
 func (r *Config) isTokenConfigValid() error {
@@ -609,15 +584,108 @@ func (r *Config) isTokenConfigValid() error {
 	if (r.EnableEncryptedToken || r.ForceEncryptedCookie) && r.EncryptionKey == "" {
 		return errors.New("you have not specified an encryption key for encoding the access token")
 	}
+	if r.EnableIDTokenHeader && r.CookieIDTokenName == "" {
+		return errors.New("you have enabled the id token header, but did not specify a cookie-idtoken-name to keep the id token")
+	}
 	if r.EnableRefreshTokens && r.EncryptionKey == "" {
 		return errors.New("you have not specified an encryption key for encoding the session state")
 	}
-	if r.EnableRefreshTokens && (len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32) {
+	if (r.EnableRefreshTokens || (r.StoreURL != "" && r.EncryptionKey != "")) && (len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32) {
 		return fmt.Errorf("the encryption key (%d) must be either 16 or 32 characters for AES-128/AES-256 selection", len(r.EncryptionKey))
 	}
+	if r.HealthCheckDependencies && r.HealthCheckTimeout <= 0 {
+		return errors.New("the health-check-timeout must be positive to check the dependencies")
+	}
+	if r.HealthCertificateExpiryWarning < 0 || r.HealthJWKSAgeWarning < 0 || r.HealthDiscoveryAgeWarning < 0 {
+		return errors.New("the health warning thresholds cannot be negative")
+	}
+	if r.EnablePKCE && len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+		return errors.New("the enable-pkce requires an encryption key of 16 or 32 characters, to protect the code verifier")
+	}
+	if r.SessionIdleTimeout < 0 {
+		return errors.New("the session-idle-timeout cannot be negative")
+	}
+	if r.SessionIdleTimeout > 0 && len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+		return errors.New("the session-idle-timeout requires an encryption key of 16 or 32 characters, to protect the last activity of the sessions")
+	}
+	if r.StoreGCInterval < 0 {
+		return errors.New("the store-gc-interval cannot be negative")
+	}
+	if r.JWKSRefreshInterval < 0 || r.JWKSMinRefreshInterval < 0 {
+		return errors.New("the jwks-refresh-interval and jwks-min-refresh-interval cannot be negative")
+	}
+	if err := isSigningAlgorithmsValid(r.AcceptedSigningAlgorithms); err != nil {
+		return err
+	}
+	if r.EnableServerSideSessions && (r.StoreURL == "" || !r.EnableRefreshTokens) {
+		return errors.New("server-side sessions require a store-url and the refresh tokens to be enabled")
+	}
+	if r.EnableOfflineTokens && !r.EnableServerSideSessions {
+		return errors.New("the offline tokens require server-side sessions, so they never leave the proxy")
+	}
+	if r.EnableOfflineTokens && r.OfflineSessionDuration <= 0 {
+		return errors.New("the offline-session-duration must be positive")
+	}
+	if r.EnableDeviceFlow && r.SkipTokenVerification {
+		return errors.New("the device flow requires the verification of the tokens it hands over")
+	}
+	if r.EnableLoginReplay && (r.StoreURL == "" || (len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32)) {
+		return errors.New("the login replay requires a store-url and an encryption key of 16 or 32 characters, to protect the kept requests")
+	}
+	if r.EnableLoginReplay && r.LoginReplayMaxSize <= 0 {
+		return errors.New("the login-replay-max-size must be positive")
+	}
+	if r.EnableDistributedRateLimit && !strings.HasPrefix(r.StoreURL, "redis") {
+		return errors.New("the distributed rate limit requires a redis store-url")
+	}
+	if r.EnableSessionRevocation && r.StoreURL == "" {
+		return errors.New("the session revocation requires a store-url")
+	}
+	if r.EnableSessionRevocation && r.SessionRevocationRole == "" && r.SessionRevocationToken == "" {
+		return errors.New("the session revocation requires either a session-revocation-role or a session-revocation-token")
+	}
+	if r.EnableSessionRevocation && (r.SessionRevocationMaxAge <= 0 || r.SessionRevocationMaxEntries <= 0) {
+		return errors.New("the session-revocation-max-age and session-revocation-max-entries must be positive")
+	}
 	if !r.NoRedirects && r.SecureCookie && r.RedirectionURL != "" && !strings.HasPrefix(r.RedirectionURL, "https") {
 		return errors.New("the cookie is set to secure but your redirection url is non-tls")
 	}
 
+	if err := r.isCaptureValid(); err != nil {
+		return err
+	}
+
 	return r.isStoreValid()
 }
+
+// storeRedisTLSConfig builds the tls configuration of the connection to the redis store, if any option is set
+func (r *Config) storeRedisTLSConfig() (*tls.Config, error) {
+	if r.StoreRedisCA == "" && r.StoreRedisClientCert == "" && r.StoreRedisClientKey == "" && !r.StoreRedisInsecureSkipVerify {
+		//nolint:nilnil
+		return nil, nil
+	}
+	if (r.StoreRedisClientCert == "") != (r.StoreRedisClientKey == "") {
+		return nil, errors.New("the redis store client certificate requires both store-redis-client-cert and store-redis-client-key")
+	}
+
+	//nolint:gas
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: r.StoreRedisInsecureSkipVerify,
+	}
+	if r.StoreRedisCA != "" {
+		pool, err := makeCertPool("redis store CA", r.StoreRedisCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if r.StoreRedisClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(r.StoreRedisClientCert, r.StoreRedisClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the redis store client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
@@ -18,6 +18,7 @@ package main
 import (
 	"crypto/tls"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -367,6 +368,464 @@ func TestIsConfigValid(t *testing.T) {
 				assert.Len(t, config.Resources, 2)
 			},
 		},
+		{
+			Name: "token exchange not enabled",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				Resources: []*Resource{
+					{
+						URL:              "/orders/*",
+						ExchangeAudience: "orders-api",
+					},
+				},
+			},
+			Error: "enable-token-exchange is not set",
+		},
+		{
+			Name: "uma not enabled",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				Resources: []*Resource{
+					{
+						URL:         "/orders/*",
+						UMAResource: "orders",
+					},
+				},
+			},
+			Error: "enable-uma is not set",
+		},
+		{
+			Name: "uma on a white-listed resource",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				EnableUMA:             true,
+				Resources: []*Resource{
+					{
+						URL:         "/orders/*",
+						UMAResource: "orders",
+						WhiteListed: true,
+					},
+				},
+			},
+			Error: "its uma permissions cannot be checked",
+		},
+		{
+			Name: "relative allowed redirect url",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				AllowedRedirectURLs:   []string{"/app/*"},
+			},
+			Error: "must be an absolute url",
+		},
+		{
+			Name: "cookie name suffix looks like a chunk",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				CookieNameSuffix:      "-1",
+			},
+			Error: "invalid cookie name suffix",
+		},
+		{
+			Name: "invalid forwarded trusted proxy",
+			Config: &Config{
+				Listen:                  ":8080",
+				DiscoveryURL:            "http://127.0.0.1:8080",
+				ClientID:                "client",
+				ClientSecret:            "client",
+				RedirectionURL:          "https://120.0.0.1",
+				SkipUpstreamTLSVerify:   true,
+				Upstream:                "this should not fail",
+				MaxIdleConns:            100,
+				MaxIdleConnsPerHost:     50,
+				ForwardedTrustedProxies: []string{"10.0.0.0/33"},
+			},
+			Error: "invalid trusted proxy",
+		},
+		{
+			Name: "unknown measured limit",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				MaxTokenSize:          8192,
+				MeasuredLimits:        []string{"token-length"},
+			},
+			Error: "invalid measured limit",
+		},
+		{
+			Name: "server-side sessions without a store",
+			Config: &Config{
+				Listen:                   ":8080",
+				DiscoveryURL:             "http://127.0.0.1:8080",
+				ClientID:                 "client",
+				ClientSecret:             "client",
+				RedirectionURL:           "https://120.0.0.1",
+				SkipUpstreamTLSVerify:    true,
+				Upstream:                 "this should not fail",
+				MaxIdleConns:             100,
+				MaxIdleConnsPerHost:      50,
+				EnableRefreshTokens:      true,
+				EncryptionKey:            testKey,
+				EnableServerSideSessions: true,
+			},
+			Error: "server-side sessions require a store-url",
+		},
+		{
+			Name: "offline tokens without server-side sessions",
+			Config: &Config{
+				Listen:                 ":8080",
+				DiscoveryURL:           "http://127.0.0.1:8080",
+				ClientID:               "client",
+				ClientSecret:           "client",
+				RedirectionURL:         "https://120.0.0.1",
+				SkipUpstreamTLSVerify:  true,
+				Upstream:               "this should not fail",
+				MaxIdleConns:           100,
+				MaxIdleConnsPerHost:    50,
+				EnableRefreshTokens:    true,
+				EncryptionKey:          testKey,
+				EnableOfflineTokens:    true,
+				OfflineSessionDuration: time.Hour,
+			},
+			Error: "the offline tokens require server-side sessions",
+		},
+		{
+			Name: "device flow without the verification of the tokens",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				EnableDeviceFlow:      true,
+				SkipTokenVerification: true,
+			},
+			Error: "the device flow requires the verification of the tokens",
+		},
+		{
+			Name: "upstream local address which is not an ip",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				UpstreamLocalAddress:  "eth0",
+			},
+			Error: "the upstream-local-address \"eth0\" is not an ip address",
+		},
+		{
+			Name: "provider local address not assigned to the host",
+			Config: &Config{
+				Listen:                     ":8080",
+				DiscoveryURL:               "http://127.0.0.1:8080",
+				ClientID:                   "client",
+				ClientSecret:               "client",
+				RedirectionURL:             "https://120.0.0.1",
+				SkipUpstreamTLSVerify:      true,
+				Upstream:                   "this should not fail",
+				MaxIdleConns:               100,
+				MaxIdleConnsPerHost:        50,
+				OpenIDProviderLocalAddress: "192.0.2.1",
+			},
+			Error: "the openid-provider-local-address 192.0.2.1 is not assigned to any interface of the host",
+		},
+		{
+			Name: "local address assigned later on",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				UpstreamLocalAddress:  "192.0.2.1",
+				SkipLocalAddressCheck: true,
+			},
+			Ok: true,
+		},
+		{
+			Name: "local addresses assigned to the host",
+			Config: &Config{
+				Listen:                     ":8080",
+				DiscoveryURL:               "http://127.0.0.1:8080",
+				ClientID:                   "client",
+				ClientSecret:               "client",
+				RedirectionURL:             "https://120.0.0.1",
+				SkipUpstreamTLSVerify:      true,
+				Upstream:                   "this should not fail",
+				MaxIdleConns:               100,
+				MaxIdleConnsPerHost:        50,
+				UpstreamLocalAddress:       "127.0.0.1",
+				OpenIDProviderLocalAddress: "127.0.0.1",
+			},
+			Ok: true,
+		},
+		{
+			Name: "capture endpoint without a capture token",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				EnableCaptureEndpoint: true,
+				CaptureBufferSize:     100,
+				CaptureMaxDuration:    time.Hour,
+			},
+			Error: "the capture endpoint requires a capture-token",
+		},
+		{
+			Name: "login replay without an encryption key",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				StoreURL:              "memory://",
+				EnableLoginReplay:     true,
+				LoginReplayMaxSize:    16384,
+			},
+			Error: "the login replay requires a store-url and an encryption key",
+		},
+		{
+			Name: "login replay without a size",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				StoreURL:              "memory://",
+				EncryptionKey:         testKey,
+				EnableLoginReplay:     true,
+			},
+			Error: "the login-replay-max-size must be positive",
+		},
+		{
+			Name: "distributed rate limit without redis",
+			Config: &Config{
+				Listen:                     ":8080",
+				DiscoveryURL:               "http://127.0.0.1:8080",
+				ClientID:                   "client",
+				ClientSecret:               "client",
+				RedirectionURL:             "https://120.0.0.1",
+				SkipUpstreamTLSVerify:      true,
+				Upstream:                   "this should not fail",
+				MaxIdleConns:               100,
+				MaxIdleConnsPerHost:        50,
+				StoreURL:                   "memory://",
+				EnableDistributedRateLimit: true,
+			},
+			Error: "the distributed rate limit requires a redis store-url",
+		},
+		{
+			Name: "client secret and assertion key",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				ClientAssertionKey:    "client.pem",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+			},
+			Error: "cannot set both the client-secret and the client-assertion-key",
+		},
+		{
+			Name: "session revocation without credentials",
+			Config: &Config{
+				Listen:                  ":8080",
+				DiscoveryURL:            "http://127.0.0.1:8080",
+				ClientID:                "client",
+				ClientSecret:            "client",
+				RedirectionURL:          "https://120.0.0.1",
+				SkipUpstreamTLSVerify:   true,
+				Upstream:                "this should not fail",
+				MaxIdleConns:            100,
+				MaxIdleConnsPerHost:     50,
+				StoreURL:                "redis://127.0.0.1",
+				EnableSessionRevocation: true,
+			},
+			Error: "requires either a session-revocation-role or a session-revocation-token",
+		},
+		{
+			Name: "session revocation without max age",
+			Config: &Config{
+				Listen:                      ":8080",
+				DiscoveryURL:                "http://127.0.0.1:8080",
+				ClientID:                    "client",
+				ClientSecret:                "client",
+				RedirectionURL:              "https://120.0.0.1",
+				SkipUpstreamTLSVerify:       true,
+				Upstream:                    "this should not fail",
+				MaxIdleConns:                100,
+				MaxIdleConnsPerHost:         50,
+				StoreURL:                    "redis://127.0.0.1",
+				EnableSessionRevocation:     true,
+				SessionRevocationToken:      "static-token",
+				SessionRevocationMaxEntries: 100000,
+			},
+			Error: "the session-revocation-max-age and session-revocation-max-entries must be positive",
+		},
+		{
+			Name: "store encryption with an invalid key",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				StoreURL:              "redis://127.0.0.1",
+				EncryptionKey:         "short",
+			},
+			Error: "must be either 16 or 32 characters",
+		},
+		{
+			Name: "session idle timeout without an encryption key",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				SessionIdleTimeout:    time.Hour,
+			},
+			Error: "the session-idle-timeout requires an encryption key",
+		},
+		{
+			Name: "pkce without an encryption key",
+			Config: &Config{
+				Listen:                ":8080",
+				DiscoveryURL:          "http://127.0.0.1:8080",
+				ClientID:              "client",
+				ClientSecret:          "client",
+				RedirectionURL:        "https://120.0.0.1",
+				SkipUpstreamTLSVerify: true,
+				Upstream:              "this should not fail",
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   50,
+				EnablePKCE:            true,
+			},
+			Error: "the enable-pkce requires an encryption key",
+		},
+		{
+			Name: "strict default deny with default not found",
+			Config: &Config{
+				Listen:                  ":8080",
+				DiscoveryURL:            "http://127.0.0.1:8080",
+				ClientID:                "client",
+				ClientSecret:            "client",
+				RedirectionURL:          "https://120.0.0.1",
+				SkipUpstreamTLSVerify:   true,
+				Upstream:                "this should not fail",
+				MaxIdleConns:            100,
+				MaxIdleConnsPerHost:     50,
+				EnableDefaultDenyStrict: true,
+				EnableDefaultNotFound:   true,
+			},
+			Error: "you cannot set both enable-default-deny-strict and enable-default-notfound",
+		},
+		{
+			// the requests matching no resource are refused, not proxied to a default upstream
+			Name: "strict default deny without a default upstream",
+			Config: &Config{
+				Listen:                  ":8080",
+				DiscoveryURL:            "http://127.0.0.1:8080",
+				ClientID:                "client",
+				ClientSecret:            "client",
+				RedirectionURL:          "https://120.0.0.1",
+				SkipUpstreamTLSVerify:   true,
+				MaxIdleConns:            100,
+				MaxIdleConnsPerHost:     50,
+				SecureCookie:            true,
+				EnableDefaultDeny:       true,
+				EnableDefaultDenyStrict: true,
+				Resources:               []*Resource{{URL: "/api/*", Upstream: "http://127.0.0.1:8081"}},
+			},
+			Ok: true,
+		},
 	}
 
 	for i, c := range tests {
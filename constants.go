@@ -17,20 +17,63 @@ const (
 	debugURL         = "/debug/pprof"
 	refreshURL       = "/refresh"
 	traceURL         = "/trace"
+	clientTokenURL   = "/client-token"
+	selfTestURL      = "/self-test"
+	sessionsURL      = "/sessions"
+	openAPIURL       = "/openapi.json"
+	pipelineURL      = "/pipeline"
+	captureURL       = "/capture"
+	loginReplayURL   = "/replay"
+	deviceURL        = "/device"
+
+	frontchannelLogoutURL = "/frontchannel-logout"
 
 	// default claims used to analyze access token
 	claimAudience       = "aud"
+	claimEmail          = "email"
+	claimIssuedAt       = "iat"
 	claimPreferredName  = "preferred_username"
 	claimRealmAccess    = "realm_access"
 	claimResourceAccess = "resource_access"
 	claimResourceRoles  = "roles"
 	claimGroups         = "groups"
 
+	// claims identifying the client a token was issued to
+	claimAuthorizedParty = "azp"
+	claimClientID        = "client_id"
+
+	// claimNonce binds an id token to the authorization it was issued for
+	claimNonce = "nonce"
+
+	// claimACR is the authentication context class of the session a token was issued in, e.g. its level of assurance
+	claimACR = "acr"
+
+	// claims identifying the session of the provider a token was issued in, keycloak uses the latter before version 12
+	claimSessionID    = "sid"
+	claimSessionState = "session_state"
+
+	// claimTokenType is the type of the keycloak tokens, tokenTypeOffline the one of the offline refresh tokens
+	claimTokenType   = "typ"
+	tokenTypeOffline = "Offline"
+	// scopeOfflineAccess requests an offline token, which outlives the session of the provider
+	scopeOfflineAccess = "offline_access"
+
 	// default cookies names
 	accessCookie       = "kc-access"
 	refreshCookie      = "kc-state"
 	requestURICookie   = "request_uri"
 	requestStateCookie = "OAuth_Token_Request_State"
+	activityCookie     = "kc-activity"
+	pkceCookie         = "kc-pkce"
+
+	// authDecisionHeadUnauthenticated is logged for HEAD requests rejected without initiating a login flow
+	authDecisionHeadUnauthenticated = "head-unauthenticated"
+	// authDecisionNotNavigation is logged for the requests other than GET and HEAD rejected without initiating a login
+	// flow, which would lose their body
+	authDecisionNotNavigation = "not-navigation-unauthenticated"
+
+	// memoryStoreScheme is the scheme of the in-memory store, which entries are lost on restart
+	memoryStoreScheme = "memory"
 
 	unsecureScheme = "http"
 	secureScheme   = "https"
@@ -39,10 +82,13 @@ const (
 
 	_ contextKey = iota
 	contextScopeName
+	contextTrustedAuthenticator
 
 	jsonMime                  = "application/json; charset=utf-8"
 	headerXForwardedFor       = "X-Forwarded-For"
 	headerXRealIP             = "X-Real-IP"
+	headerXForwardedAgent     = "X-Forwarded-Agent"
+	headerForwarded           = "Forwarded"
 	authorizationHeader       = "Authorization"
 	versionHeader             = "X-Auth-Proxy-Version"
 	headerXContentTypeOptions = "X-Content-Type-Options"
@@ -50,5 +96,50 @@ const (
 	headerXFrameOptions       = "X-Frame-Options"
 	headerXSTS                = "X-Strict-Transport-Security"
 	headerXPolicy             = "X-Content-Security-Policy"
+	headerUpgrade             = "Upgrade"
+	headerWebSocketProtocol   = "Sec-Websocket-Protocol"
+	headerWWWAuthenticate     = "WWW-Authenticate"
 	authorizationType         = "Bearer"
+
+	// defaultHeadersPrefix is the prefix of the identity headers injected upstream, when none is configured
+	defaultHeadersPrefix = "X-Auth-"
+	// defaultClaimsHeaderMaxSize bounds the value of the claims header, when no bound is configured
+	defaultClaimsHeaderMaxSize = 4096
+
+	// token exchange (RFC 8693)
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+
+	// keycloak authorization services (uma)
+	grantTypeUMATicket = "urn:ietf:params:oauth:grant-type:uma-ticket"
+
+	// device authorization grant (RFC 8628), and the errors of the token endpoint while polling it
+	grantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceErrorPending  = "authorization_pending"
+	deviceErrorSlowDown = "slow_down"
+	deviceErrorExpired  = "expired_token"
+	deviceErrorDenied   = "access_denied"
+
+	// the errors of the token endpoint (RFC 6749) telling the provider itself failed, which are retried
+	oauthErrorServerError            = "server_error"
+	oauthErrorTemporarilyUnavailable = "temporarily_unavailable"
+)
+
+// SameSite cookie config options
+const (
+	SameSiteStrict = "Strict"
+	SameSiteLax    = "Lax"
+	SameSiteNone   = "None"
+)
+
+// Cookie filter modes, applied to the cookies filtered out of upstream requests
+const (
+	cookieFilterRedact = "redact"
+	cookieFilterDrop   = "drop"
+)
+
+// Failure modes of the external authorization, deciding on the requests when the webhook cannot
+const (
+	externalAuthzFailureAllow = "allow"
+	externalAuthzFailureDeny  = "deny"
 )
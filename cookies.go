@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -16,25 +19,27 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"go.uber.org/zap"
 )
 
-// SameSite cookie config options
-const (
-	SameSiteStrict = "Strict"
-	SameSiteLax    = "Lax"
-	SameSiteNone   = "None"
-)
-
-// dropCookie drops a cookie into the response
-func (r *oauthProxy) dropCookie(w http.ResponseWriter, host, name, value string, duration time.Duration) {
-	cookie := r.cookieDropper(host, name, value, duration)
-	http.SetCookie(w, cookie)
+// dropCookie drops a cookie into the response: a secure one when the client reached the trusted proxies over https,
+// whatever the secure-cookie option
+func (r *oauthProxy) dropCookie(w http.ResponseWriter, req *http.Request, name, value string, duration time.Duration) {
+	cookie := r.cookieDropper(req.Host, name, value, duration)
+	cookie.Secure = cookie.Secure || forwardedOverHTTPS(req)
+	setCookie(w, cookie, r.config.EnablePartitionedCookies)
 }
 
 func (r *oauthProxy) makeCookieDropper() func(string, string, string, time.Duration) *http.Cookie {
@@ -53,6 +58,12 @@ func (r *oauthProxy) makeCookieDropper() func(string, string, string, time.Durat
 		baseCookie.SameSite = http.SameSiteStrictMode
 	case SameSiteLax:
 		baseCookie.SameSite = http.SameSiteLaxMode
+	case SameSiteNone:
+		// partitioned cookies are meant for cross-site contexts: make it explicit.
+		// Otherwise, None is left unset, as browsers used to reject it.
+		if r.config.EnablePartitionedCookies {
+			baseCookie.SameSite = http.SameSiteNoneMode
+		}
 	}
 
 	makeBase := func(name, value string) *http.Cookie {
@@ -68,7 +79,7 @@ func (r *oauthProxy) makeCookieDropper() func(string, string, string, time.Durat
 			cookie := makeBase(name, value)
 			cookie.Domain = strings.Split(host, ":")[0]
 			if duration < 0 {
-				cookie.Expires = time.Now().Add(duration)
+				cookie.Expires = r.now().Add(duration)
 			}
 			return cookie
 		}
@@ -77,7 +88,7 @@ func (r *oauthProxy) makeCookieDropper() func(string, string, string, time.Durat
 			cookie := makeBase(name, value)
 			cookie.Domain = strings.Split(host, ":")[0]
 			if duration != 0 {
-				cookie.Expires = time.Now().Add(duration)
+				cookie.Expires = r.now().Add(duration)
 			}
 			return cookie
 		}
@@ -85,7 +96,7 @@ func (r *oauthProxy) makeCookieDropper() func(string, string, string, time.Durat
 		return func(_, name, value string, duration time.Duration) *http.Cookie {
 			cookie := makeBase(name, value)
 			if duration < 0 {
-				cookie.Expires = time.Now().Add(duration)
+				cookie.Expires = r.now().Add(duration)
 			}
 			return cookie
 		}
@@ -93,7 +104,7 @@ func (r *oauthProxy) makeCookieDropper() func(string, string, string, time.Durat
 		return func(host, name, value string, duration time.Duration) *http.Cookie {
 			cookie := makeBase(name, value)
 			if duration != 0 {
-				cookie.Expires = time.Now().Add(duration)
+				cookie.Expires = r.now().Add(duration)
 			}
 			return cookie
 		}
@@ -110,6 +121,9 @@ const (
 
 // maxCookieChunkSize calculates max cookie chunk size, which can be used for cookie value
 func (r *oauthProxy) getMaxCookieChunkLength(req *http.Request, cookieName string) int {
+	if !r.config.SecureCookie && forwardedOverHTTPS(req) {
+		return r.cookieChunker(req.Host, cookieName) - len("Secure")
+	}
 	return r.cookieChunker(req.Host, cookieName)
 }
 
@@ -129,6 +143,9 @@ func (r *oauthProxy) makeCookieChunker() func(string, string) int {
 	if r.config.SecureCookie {
 		maxCookieChunkLength -= len("Secure")
 	}
+	if r.config.EnablePartitionedCookies {
+		maxCookieChunkLength -= len("; Partitioned")
+	}
 	if r.config.CookieDomain != "" {
 		maxCookieChunkLength -= len("Domain=; ")
 		maxCookieChunkLength -= len(r.config.CookieDomain)
@@ -141,100 +158,401 @@ func (r *oauthProxy) makeCookieChunker() func(string, string) int {
 	}
 }
 
-// dropCookieWithChunks drops a cookie from the response, taking into account possible chunks
+// dropCookieWithChunks drops a cookie from the response, taking into account possible chunks.
+//
+// The chunks left over by a previous, longer value are expired, so they are not appended to the new value.
 func (r *oauthProxy) dropCookieWithChunks(req *http.Request, w http.ResponseWriter, name, value string, duration time.Duration) {
 	maxCookieChunkLength := r.getMaxCookieChunkLength(req, name)
 	if len(value) <= maxCookieChunkLength {
-		r.dropCookie(w, req.Host, name, value, duration)
+		r.dropCookie(w, req, name, value, duration)
+		r.clearDividedCookiesFrom(req, w, name, 1)
 		return
 	}
 	// write divided cookies because payload is too long for single cookie
-	r.dropCookie(w, req.Host, name, value[0:maxCookieChunkLength], duration)
+	r.dropCookie(w, req, name, value[0:maxCookieChunkLength], duration)
+	chunks := 1
 	for i := maxCookieChunkLength; i < len(value); i += maxCookieChunkLength {
 		end := i + maxCookieChunkLength
 		if end > len(value) {
 			end = len(value)
 		}
-		r.dropCookie(w, req.Host, name+"-"+strconv.Itoa(i/maxCookieChunkLength), value[i:end], duration)
+		r.dropCookie(w, req, name+"-"+strconv.Itoa(i/maxCookieChunkLength), value[i:end], duration)
+		chunks++
 	}
+	r.clearDividedCookiesFrom(req, w, name, chunks)
 }
 
 // dropAccessTokenCookie drops a access token cookie from the response
 func (r *oauthProxy) dropAccessTokenCookie(req *http.Request, w http.ResponseWriter, value string, duration time.Duration) {
-	r.dropCookieWithChunks(req, w, r.config.CookieAccessName, value, duration)
+	if r.config.EnableCookieCompression {
+		value = compressCookieValue(value)
+	}
+	r.dropCookieWithChunks(req, w, r.cookieName(r.config.CookieAccessName), value, duration)
 }
 
 // dropRefreshTokenCookie drops a refresh token cookie from the response
 func (r *oauthProxy) dropRefreshTokenCookie(req *http.Request, w http.ResponseWriter, value string, duration time.Duration) {
-	r.dropCookieWithChunks(req, w, r.config.CookieRefreshName, value, duration)
+	if r.config.EnableCookieCompression {
+		value = compressCookieValue(value)
+	}
+	r.dropCookieWithChunks(req, w, r.cookieName(r.config.CookieRefreshName), value, duration)
+}
+
+// dropIDTokenCookie drops a id token cookie from the response
+func (r *oauthProxy) dropIDTokenCookie(req *http.Request, w http.ResponseWriter, value string, duration time.Duration) {
+	if r.config.EnableCookieCompression {
+		value = compressCookieValue(value)
+	}
+	r.dropCookieWithChunks(req, w, r.cookieName(r.config.CookieIDTokenName), value, duration)
+}
+
+const (
+	// compressedCookiePrefix marks a compressed cookie value. It is not part of the base64 alphabets,
+	// so it never collides with a plain JWT nor with an encrypted value
+	compressedCookiePrefix = "~"
+	// maxDecompressedCookieLength guards against decompression bombs
+	maxDecompressedCookieLength = 1 << 20
+)
+
+// compressCookieValue compresses a JWT to be stored in a cookie.
+//
+// The segments of the token are base64-decoded before being deflated, so the JSON claims
+// actually get compressed. Values which are not a JWT (e.g. encrypted tokens, which are already
+// deflated before encryption) or which do not shrink are returned unchanged.
+func compressCookieValue(value string) string {
+	segments := strings.Split(value, ".")
+	if len(segments) != 3 {
+		return value
+	}
+
+	var compressed bytes.Buffer
+	w, _ := zlib.NewWriterLevel(&compressed, zlib.BestCompression)
+	for i, segment := range segments {
+		// strict decoding guarantees we encode back exactly the same segment
+		decoded, err := base64.RawURLEncoding.Strict().DecodeString(segment)
+		if err != nil {
+			return value
+		}
+		if i > 0 {
+			// the header and the claims are JSON, hence never contain a NUL byte
+			_, _ = w.Write([]byte{0})
+		}
+		_, _ = w.Write(decoded)
+	}
+	_ = w.Close()
+
+	encoded := compressedCookiePrefix + base64.RawURLEncoding.EncodeToString(compressed.Bytes())
+	if len(encoded) >= len(value) {
+		return value
+	}
+
+	return encoded
+}
+
+// decompressCookieValue reverses compressCookieValue. Values without the compression prefix are returned as is,
+// so cookies dropped before compression was enabled keep working
+func decompressCookieValue(value string) (string, error) {
+	if !strings.HasPrefix(value, compressedCookiePrefix) {
+		return value, nil
+	}
+
+	compressed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, compressedCookiePrefix))
+	if err != nil {
+		return "", ErrInvalidSession
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return "", ErrInvalidSession
+	}
+	defer zr.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(zr, maxDecompressedCookieLength))
+	if err != nil {
+		return "", ErrInvalidSession
+	}
+
+	// the signature comes last and may contain NUL bytes
+	segments := bytes.SplitN(decoded, []byte{0}, 3)
+	if len(segments) != 3 {
+		return "", ErrInvalidSession
+	}
+	encoded := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		encoded = append(encoded, base64.RawURLEncoding.EncodeToString(segment))
+	}
+
+	return strings.Join(encoded, "."), nil
 }
 
 // writeStateParameterCookie sets a state parameter cookie into the response
 func (r *oauthProxy) writeStateParameterCookie(req *http.Request, w http.ResponseWriter) string {
-	uuid := uuid.NewString()
-	r.dropCookie(w, req.Host, requestStateCookie, uuid, 0)
+	state := uuid.NewString()
+	r.writeAuthorizationStateCookie(req, w, state)
+
+	return state
+}
+
+// writeAuthorizationStateCookie sets the state cookie of an authorization, along with a new nonce for the id token,
+// and returns the nonce
+func (r *oauthProxy) writeAuthorizationStateCookie(req *http.Request, w http.ResponseWriter, state string) string {
+	nonce := uuid.NewString()
+	r.dropCookie(w, req, r.cookieName(requestStateCookie), state+"|"+nonce, 0)
+
+	return nonce
+}
+
+// getStateParameter returns the state and the nonce of the authorization kept in the state cookie. The cookies
+// written before the nonces were introduced only carry the state.
+func (r *oauthProxy) getStateParameter(req *http.Request) (string, string, bool) {
+	cookie, err := req.Cookie(r.requestCookieName(req, requestStateCookie))
+	if err != nil {
+		return "", "", false
+	}
+	value, _ := splitStepUpState(cookie.Value)
+	// the state is anything before the last separator
+	i := strings.LastIndex(value, "|")
+	if i < 0 {
+		return value, "", true
+	}
+
+	return value[:i], value[i+1:], true
+}
+
+// pkceCookieDuration is the lifetime of the code verifier of an authorization, i.e. the time left to the user to log in
+const pkceCookieDuration = 10 * time.Minute
+
+// writeCodeVerifierCookie keeps the code verifier of an authorization in a short-lived encrypted cookie, bound to
+// the state of the authorization
+func (r *oauthProxy) writeCodeVerifierCookie(req *http.Request, w http.ResponseWriter, state, verifier string) error {
+	value, err := encodeText(state+"|"+verifier, r.config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	r.dropCookie(w, req, r.cookieName(pkceCookie), value, pkceCookieDuration)
+
+	return nil
+}
 
-	return uuid
+// getCodeVerifier returns the code verifier of the authorization with the state
+func (r *oauthProxy) getCodeVerifier(req *http.Request, state string) (string, error) {
+	cookie, err := req.Cookie(r.requestCookieName(req, pkceCookie))
+	if err != nil {
+		return "", ErrNoCodeVerifier
+	}
+	value, err := decodeText(cookie.Value, r.config.EncryptionKey)
+	if err != nil {
+		return "", ErrDecryption
+	}
+	// the verifier is base64url encoded, the state is anything before the last separator
+	i := strings.LastIndex(value, "|")
+	if i < 0 || value[:i] != state || value[i+1:] == "" {
+		return "", ErrNoCodeVerifier
+	}
+
+	return value[i+1:], nil
 }
 
 // clearAllCookies is just a helper function for the below
 func (r *oauthProxy) clearAllCookies(req *http.Request, w http.ResponseWriter) {
 	r.clearAccessTokenCookie(req, w)
 	r.clearRefreshTokenCookie(req, w)
+	r.clearIDTokenCookie(req, w)
 	r.clearStateCookie(req, w)
+	if r.config.SessionIdleTimeout > 0 {
+		r.clearCookie(req, w, activityCookie)
+	}
 }
 
 // clearRefreshSessionCookie clears the session cookie
 func (r *oauthProxy) clearRefreshTokenCookie(req *http.Request, w http.ResponseWriter) {
-	r.dropCookie(w, req.Host, r.config.CookieRefreshName, "", -10*time.Hour)
-	r.clearDividedCookies(req, w, r.config.CookieRefreshName)
+	r.clearCookie(req, w, r.config.CookieRefreshName)
 }
 
 // clearAccessTokenCookie clears the session cookie
 func (r *oauthProxy) clearAccessTokenCookie(req *http.Request, w http.ResponseWriter) {
-	r.dropCookie(w, req.Host, r.config.CookieAccessName, "", -10*time.Hour)
-	r.clearDividedCookies(req, w, r.config.CookieAccessName)
+	r.clearCookie(req, w, r.config.CookieAccessName)
+}
+
+// clearIDTokenCookie clears the id token cookie
+func (r *oauthProxy) clearIDTokenCookie(req *http.Request, w http.ResponseWriter) {
+	if r.config.CookieIDTokenName == "" {
+		return
+	}
+	r.clearCookie(req, w, r.config.CookieIDTokenName)
 }
 
 // clearStateCookie clears the session state cookie
 func (r *oauthProxy) clearStateCookie(req *http.Request, w http.ResponseWriter) {
-	r.dropCookie(w, req.Host, requestStateCookie, "", -10*time.Hour)
-	r.clearDividedCookies(req, w, requestStateCookie)
+	r.clearCookie(req, w, requestStateCookie)
+}
+
+// clearCookie expires a cookie and its chunks.
+//
+// The unsuffixed cookie left over before a cookie name suffix was set is expired too.
+func (r *oauthProxy) clearCookie(req *http.Request, w http.ResponseWriter, name string) {
+	suffixed := r.cookieName(name)
+	r.dropCookie(w, req, suffixed, "", -10*time.Hour)
+	r.clearDividedCookies(req, w, suffixed)
+	if suffixed != name && findCookie(name, req.Cookies()) != nil {
+		r.dropCookie(w, req, name, "", -10*time.Hour)
+		r.clearDividedCookies(req, w, name)
+	}
+}
+
+// expireStaleCookies expires the session cookies which are sent more than once, on the domains not matching the
+// cookie domain: the host, when the cookie domain is set, and the domains used previously
+func (r *oauthProxy) expireStaleCookies(req *http.Request, w http.ResponseWriter) {
+	host := strings.Split(req.Host, ":")[0]
+	current := r.config.CookieDomain
+	if current == "" {
+		current = host
+	}
+	domains := append([]string{host}, r.config.CookieCleanupDomains...)
+
+	names := []string{r.config.CookieAccessName, r.config.CookieRefreshName, activityCookie}
+	if r.config.CookieIDTokenName != "" {
+		names = append(names, r.config.CookieIDTokenName)
+	}
+	for _, name := range names {
+		name = r.requestCookieName(req, name)
+		if !hasDuplicateCookies(req, name) {
+			continue
+		}
+		r.log.Info("expiring the session cookie left over on another domain",
+			zap.String("cookie", name),
+			zap.Strings("domains", domains),
+			zap.String("client_ip", req.RemoteAddr))
+		for _, domain := range domains {
+			if sameCookieDomain(domain, current) {
+				continue
+			}
+			r.expireCookieOnDomain(req, w, name, domain)
+			for i := 1; findCookie(name+"-"+strconv.Itoa(i), req.Cookies()) != nil; i++ {
+				r.expireCookieOnDomain(req, w, name+"-"+strconv.Itoa(i), domain)
+			}
+		}
+	}
+}
+
+// expireCookieOnDomain expires a cookie set on a given domain, rather than on the cookie domain
+func (r *oauthProxy) expireCookieOnDomain(req *http.Request, w http.ResponseWriter, name, domain string) {
+	cookie := r.cookieDropper(req.Host, name, "", -10*time.Hour)
+	cookie.Secure = cookie.Secure || forwardedOverHTTPS(req)
+	cookie.Domain = domain
+	setCookie(w, cookie, r.config.EnablePartitionedCookies)
+}
+
+// sameCookieDomain checks if two cookie domains are the same, the leading dot being ignored by the browsers
+func sameCookieDomain(a, b string) bool {
+	return strings.EqualFold(strings.TrimPrefix(a, "."), strings.TrimPrefix(b, "."))
+}
+
+// makeCookieNameSuffix returns the suffix appended to the name of the cookies dropped by this instance
+func (r *oauthProxy) makeCookieNameSuffix() string {
+	if r.config.EnableClientIDCookieSuffix {
+		sum := sha256.Sum256([]byte(r.config.ClientID))
+		return "_" + hex.EncodeToString(sum[:4])
+	}
+
+	return r.config.CookieNameSuffix
+}
+
+// cookieName returns the name of a cookie as dropped by this instance
+func (r *oauthProxy) cookieName(name string) string {
+	return name + r.cookieSuffix
+}
+
+// requestCookieName returns the name of a cookie to be read back from the request.
+//
+// NOTE: to migrate smoothly to a cookie name suffix, the unsuffixed cookie is read when the suffixed one is not found.
+// This fallback is meant to be removed in the next release.
+func (r *oauthProxy) requestCookieName(req *http.Request, name string) string {
+	suffixed := r.cookieName(name)
+	if suffixed == name || findCookie(suffixed, req.Cookies()) != nil || findCookie(name, req.Cookies()) == nil {
+		return suffixed
+	}
+
+	return name
+}
+
+// filteredCookieNames returns the names of the cookies to filter out of upstream requests,
+// including their unsuffixed names
+func (r *oauthProxy) filteredCookieNames(names ...string) []string {
+	filtered := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		filtered = append(filtered, r.cookieName(name))
+		if r.cookieSuffix != "" {
+			filtered = append(filtered, name)
+		}
+	}
+
+	return filtered
 }
 
 func (r *oauthProxy) clearDividedCookies(req *http.Request, w http.ResponseWriter, name string) {
+	r.clearDividedCookiesFrom(req, w, name, 1)
+}
+
+// clearDividedCookiesFrom expires the chunks of a cookie sent by the client, starting at the chunk index from
+func (r *oauthProxy) clearDividedCookiesFrom(req *http.Request, w http.ResponseWriter, name string, from int) {
 	// clear divided cookies
-	for i := 1; i < len(req.Cookies()); i++ {
+	for i := from; i < len(req.Cookies()); i++ {
 		var _, err = req.Cookie(name + "-" + strconv.Itoa(i))
 		if err != nil {
 			break
 		}
-		r.dropCookie(w, req.Host, name+"-"+strconv.Itoa(i), "", -10*time.Hour)
+		r.dropCookie(w, req, name+"-"+strconv.Itoa(i), "", -10*time.Hour)
 	}
 }
 
-// filterCookies is responsible for censoring any cookies we don't want sent
-func filterCookies(req *http.Request, filter []string) error {
+// filterCookies is responsible for censoring any cookies we don't want sent.
+//
+// A filter matches the cookie with this exact name and its chunks, or any cookie
+// starting with the filter when the latter ends with a '*'. Matching cookies are
+// either redacted or dropped altogether.
+func filterCookies(req *http.Request, filter []string, drop bool) error {
 	// @NOTE: there doesn't appear to be a way of removing a cookie from the http.Request as
 	// AddCookie() just append
 	cookies := req.Cookies()
 	// @step: empty the current cookies
-	req.Header.Set("Cookie", "")
+	req.Header.Del("Cookie")
 	// @step: iterate the cookies and filter out anything we
 	for _, x := range cookies {
 		var found bool
 		// @step: does this cookie match our filter?
 		for _, n := range filter {
-			if strings.HasPrefix(x.Name, n) {
-				req.AddCookie(&http.Cookie{Name: x.Name, Value: "redacted"})
+			if matchCookieFilter(x.Name, n) {
 				found = true
 				break
 			}
 		}
-		if !found {
+		switch {
+		case !found:
 			req.AddCookie(x)
+		case !drop:
+			req.AddCookie(&http.Cookie{Name: x.Name, Value: "redacted"})
 		}
 	}
 
 	return nil
 }
+
+// matchCookieFilter tells if a cookie name matches a filter, either exactly (including chunks) or by prefix
+func matchCookieFilter(name, filter string) bool {
+	if filter == "" {
+		return false
+	}
+	if prefix := strings.TrimSuffix(filter, "*"); prefix != filter {
+		return strings.HasPrefix(name, prefix)
+	}
+	if name == filter {
+		return true
+	}
+	// chunked cookies are named after the base name, e.g. kc-access-1
+	if !strings.HasPrefix(name, filter+"-") {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimPrefix(name, filter+"-"), 10, 32)
+
+	return err == nil
+}
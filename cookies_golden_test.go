@@ -0,0 +1,331 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// updateGolden rewrites the golden files with the current output: go test -run TestGolden -update
+var updateGolden = flag.Bool("update", false, "update the golden files with the current output of the tests")
+
+const (
+	goldenDir = "fixtures/golden"
+	// goldenMaxValue is the length above which the values are rendered by their length and digest
+	goldenMaxValue = 64
+)
+
+// goldenCookieConfigs are the cookie settings rendered in the golden files, on top of the default configuration
+var goldenCookieConfigs = []struct {
+	Name   string
+	Config func(*Config)
+}{
+	{
+		Name:   "default",
+		Config: func(*Config) {},
+	},
+	{
+		Name: "cookie-domain",
+		Config: func(c *Config) {
+			c.CookieDomain = ".example.com"
+			c.EnableSessionCookies = false
+		},
+	},
+	{
+		Name: "samesite-none-partitioned",
+		Config: func(c *Config) {
+			c.SameSiteCookie = SameSiteNone
+			c.EnablePartitionedCookies = true
+		},
+	},
+	{
+		Name: "samesite-strict-insecure",
+		Config: func(c *Config) {
+			c.SameSiteCookie = SameSiteStrict
+			c.SecureCookie = false
+			c.HTTPOnlyCookie = false
+			c.EnableSessionCookies = false
+		},
+	},
+	{
+		Name: "cookie-name-suffix",
+		Config: func(c *Config) {
+			c.CookieNameSuffix = "_app"
+			c.CookieIDTokenName = "kc-id"
+			c.SessionIdleTimeout = time.Hour
+		},
+	},
+}
+
+// goldenHosts are the host headers of the requests
+var goldenHosts = []string{"127.0.0.1:3000", "[::1]:3000", "www.example.com"}
+
+// goldenCookieRequests are the shapes of the requests rendered for each configuration and host
+var goldenCookieRequests = []struct {
+	Name    string
+	Cookies func(*oauthProxy) []*http.Cookie
+	Run     func(*oauthProxy, http.ResponseWriter, *http.Request)
+}{
+	{
+		Name: "drop the access token",
+		Run: func(px *oauthProxy, w http.ResponseWriter, req *http.Request) {
+			px.dropAccessTokenCookie(req, w, goldenValue(256), time.Hour)
+		},
+	},
+	{
+		Name: "drop a long access token, in chunks",
+		Run: func(px *oauthProxy, w http.ResponseWriter, req *http.Request) {
+			px.dropAccessTokenCookie(req, w, goldenValue(10000), time.Hour)
+		},
+	},
+	{
+		Name: "drop a shorter access token, expiring the stale chunks",
+		Cookies: func(px *oauthProxy) []*http.Cookie {
+			return goldenChunkedCookies(px.cookieName(accessCookie), 3)
+		},
+		Run: func(px *oauthProxy, w http.ResponseWriter, req *http.Request) {
+			px.dropAccessTokenCookie(req, w, goldenValue(5000), time.Hour)
+		},
+	},
+	{
+		Name: "drop the refresh token",
+		Run: func(px *oauthProxy, w http.ResponseWriter, req *http.Request) {
+			px.dropRefreshTokenCookie(req, w, goldenValue(512), 24*time.Hour)
+		},
+	},
+	{
+		Name: "clear all the cookies",
+		Cookies: func(px *oauthProxy) []*http.Cookie {
+			return append(goldenChunkedCookies(px.cookieName(accessCookie), 2), goldenChunkedCookies(px.cookieName(refreshCookie), 2)...)
+		},
+		Run: func(px *oauthProxy, w http.ResponseWriter, req *http.Request) {
+			px.clearAllCookies(req, w)
+		},
+	},
+}
+
+// goldenHeaderConfigs are the settings of the identity headers injected upstream, on top of the default configuration
+var goldenHeaderConfigs = []struct {
+	Name   string
+	Config func(*Config)
+}{
+	{
+		Name:   "default",
+		Config: func(*Config) {},
+	},
+	{
+		Name: "encodings",
+		Config: func(c *Config) {
+			c.AddClaims = []string{"given_name", "tenants"}
+			c.CookieFilterMode = cookieFilterDrop
+			c.CookieNameSuffix = "_app"
+			c.IdentityHeaderEncodings = map[string]string{
+				"X-Auth-Groups":  headerEncodingJSON,
+				"X-Auth-Roles":   headerEncodingRepeat,
+				"X-Auth-Tenants": headerEncodingURL + ":;",
+			}
+		},
+	},
+	{
+		Name: "cookies",
+		Config: func(c *Config) {
+			c.EnableAuthorizationCookies = true
+			c.EnableAuthorizationHeader = false
+			c.EnableClaimsHeaders = false
+			c.EnableTokenHeader = false
+		},
+	},
+}
+
+// goldenValue returns a deterministic value of the length
+func goldenValue(length int) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	value := make([]byte, length)
+	for i := range value {
+		value[i] = alphabet[(i*7+i/len(alphabet))%len(alphabet)]
+	}
+
+	return string(value)
+}
+
+// goldenChunkedCookies returns the cookie and its chunks, as sent by a client
+func goldenChunkedCookies(name string, chunks int) []*http.Cookie {
+	cookies := []*http.Cookie{{Name: name, Value: goldenValue(32)}}
+	for i := 1; i < chunks; i++ {
+		cookies = append(cookies, &http.Cookie{Name: fmt.Sprintf("%s-%d", name, i), Value: goldenValue(32)})
+	}
+
+	return cookies
+}
+
+// newGoldenProxy creates a proxy with the cookie settings of the configuration
+func newGoldenProxy(apply func(*Config)) *oauthProxy {
+	cfg := newDefaultConfig()
+	cfg.ClientID = fakeClientID
+	apply(cfg)
+	px := &oauthProxy{config: cfg, log: zap.NewNop()}
+	px.cookieSuffix = px.makeCookieNameSuffix()
+	px.cookieChunker = px.makeCookieChunker()
+	px.cookieDropper = px.makeCookieDropper()
+
+	return px
+}
+
+// goldenRenderValue renders a value, abbreviated by its length and digest when long
+func goldenRenderValue(value string) string {
+	if len(value) <= goldenMaxValue {
+		return value
+	}
+	digest := sha256.Sum256([]byte(value))
+
+	return fmt.Sprintf("<%d bytes sha256:%s>", len(value), hex.EncodeToString(digest[:4]))
+}
+
+// goldenRenderCookie renders a Set-Cookie header, with the expiry relative to now
+func goldenRenderCookie(header string) string {
+	attributes := strings.Split(header, "; ")
+	if i := strings.Index(attributes[0], "="); i >= 0 {
+		attributes[0] = attributes[0][:i+1] + goldenRenderValue(attributes[0][i+1:])
+	}
+	for i, attribute := range attributes {
+		if !strings.HasPrefix(attribute, "Expires=") {
+			continue
+		}
+		expires, err := http.ParseTime(strings.TrimPrefix(attribute, "Expires="))
+		if err != nil {
+			continue
+		}
+		sign, after := "+", time.Until(expires).Round(time.Minute)
+		if after < 0 {
+			sign, after = "-", -after
+		}
+		attributes[i] = "Expires=<now" + sign + after.String() + ">"
+	}
+
+	return strings.Join(attributes, "; ")
+}
+
+// assertGolden compares the output with its golden file, or updates the golden file with -update
+func assertGolden(t *testing.T, name string, actual string) {
+	t.Helper()
+	location := filepath.Join(goldenDir, name+".golden")
+	if *updateGolden {
+		require.NoError(t, os.MkdirAll(goldenDir, 0o755))
+		require.NoError(t, os.WriteFile(location, []byte(actual), 0o600))
+		return
+	}
+	expected, err := os.ReadFile(location)
+	require.NoError(t, err, "the golden file is missing, run the test with -update")
+	assert.Equal(t, string(expected), actual, "the output differs from %s: run the test with -update and review the diff", location)
+}
+
+func TestGoldenCookies(t *testing.T) {
+	for _, c := range goldenCookieConfigs {
+		px := newGoldenProxy(c.Config)
+		var output strings.Builder
+		for _, host := range goldenHosts {
+			for _, shape := range goldenCookieRequests {
+				req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+				req.Host = host
+				if shape.Cookies != nil {
+					for _, cookie := range shape.Cookies(px) {
+						req.AddCookie(cookie)
+					}
+				}
+				resp := httptest.NewRecorder()
+				shape.Run(px, resp, req)
+
+				fmt.Fprintf(&output, "# %s, host %s\n", shape.Name, host)
+				for _, header := range resp.Header().Values("Set-Cookie") {
+					fmt.Fprintf(&output, "Set-Cookie: %s\n", goldenRenderCookie(header))
+				}
+				output.WriteString("\n")
+			}
+		}
+		assertGolden(t, "cookies-"+c.Name, output.String())
+	}
+}
+
+func TestGoldenIdentityHeaders(t *testing.T) {
+	claims := jose.Claims{
+		"sub":        "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"email":      "gambol99@gmail.com",
+		"given_name": "Rohith",
+		"tenants":    []interface{}{"acme corp", "umbrella;labs"},
+	}
+	token, err := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, claims)
+	require.NoError(t, err)
+	user := &userContext{
+		id:            "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		audiences:     []string{"test", "account"},
+		claims:        claims,
+		email:         "gambol99@gmail.com",
+		expiresAt:     time.Date(2030, time.January, 2, 15, 4, 5, 0, time.UTC),
+		groups:        []string{"/admins", "/dev ops"},
+		name:          "rjayawardene",
+		preferredName: "rjayawardene",
+		roles:         []string{"admin", "account:manage-account"},
+		token:         token,
+	}
+
+	for _, c := range goldenHeaderConfigs {
+		px := newGoldenProxy(c.Config)
+		var upstream http.Header
+		handler := px.identityHeadersMiddleware(px.config.AddClaims)(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			upstream = req.Header.Clone()
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		for _, cookie := range append(goldenChunkedCookies(px.cookieName(accessCookie), 2), goldenChunkedCookies(refreshCookie, 1)...) {
+			req.AddCookie(cookie)
+		}
+		req.AddCookie(&http.Cookie{Name: "session", Value: "other"})
+		handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(context.WithValue(req.Context(), contextScopeName, &RequestScope{Identity: user})))
+
+		names := make([]string, 0, len(upstream))
+		for name := range upstream {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var output strings.Builder
+		for _, name := range names {
+			for _, value := range upstream.Values(name) {
+				fmt.Fprintf(&output, "%s: %s\n", name, strings.ReplaceAll(value, token.Encode(), "<access token>"))
+			}
+		}
+		assertGolden(t, "headers-"+c.Name, output.String())
+	}
+}
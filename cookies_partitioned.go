@@ -0,0 +1,12 @@
+//go:build go1.23 && !noreverse
+// +build go1.23,!noreverse
+
+package main
+
+import "net/http"
+
+// setCookie adds a Set-Cookie header to the response, with the Partitioned attribute whenever required
+func setCookie(w http.ResponseWriter, cookie *http.Cookie, partitioned bool) {
+	cookie.Partitioned = partitioned
+	http.SetCookie(w, cookie)
+}
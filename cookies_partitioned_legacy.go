@@ -0,0 +1,20 @@
+//go:build !go1.23 && !noreverse
+// +build !go1.23,!noreverse
+
+package main
+
+import "net/http"
+
+// setCookie adds a Set-Cookie header to the response, with the Partitioned attribute whenever required.
+//
+// http.Cookie does not support the Partitioned attribute before go1.23: we append it to the raw header.
+func setCookie(w http.ResponseWriter, cookie *http.Cookie, partitioned bool) {
+	v := cookie.String()
+	if v == "" {
+		return
+	}
+	if partitioned {
+		v += "; Partitioned"
+	}
+	w.Header().Add("Set-Cookie", v)
+}
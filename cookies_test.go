@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -16,8 +19,12 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -73,7 +80,7 @@ func TestDropCookie(t *testing.T) {
 
 	req := newFakeHTTPRequest("GET", "/admin")
 	resp := httptest.NewRecorder()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -84,7 +91,7 @@ func TestDropCookie(t *testing.T) {
 	p.config.SecureCookie = false
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -95,13 +102,13 @@ func TestDropCookie(t *testing.T) {
 	p.config.SecureCookie = true
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 	assert.NotEqual(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.2; HttpOnly; Secure",
 		"we have not set the cookie, headers: %v", resp.Header())
 
 	p.config.CookieDomain = "test.com"
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 	p.config.SecureCookie = false
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
@@ -110,6 +117,32 @@ func TestDropCookie(t *testing.T) {
 		"we have not set the cookie, headers: %v", resp.Header())
 }
 
+func TestDropCookieForwardedOverHTTPS(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.SecureCookie = false
+	p.cookieChunker = p.makeCookieChunker()
+	p.cookieDropper = p.makeCookieDropper()
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
+	assert.Equal(t, "test-cookie=test-value; Path=/; Domain=127.0.0.1", resp.Header().Get("Set-Cookie"))
+	length := p.getMaxCookieChunkLength(req, "test-cookie")
+
+	// the client reached the trusted proxies over https
+	scope := &RequestScope{Forwarded: &forwardedElement{For: "192.0.2.43", Proto: "https"}}
+	req = req.WithContext(context.WithValue(req.Context(), contextScopeName, scope))
+	resp = httptest.NewRecorder()
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
+	assert.Equal(t, "test-cookie=test-value; Path=/; Domain=127.0.0.1; Secure", resp.Header().Get("Set-Cookie"))
+	assert.Equal(t, length-len("Secure"), p.getMaxCookieChunkLength(req, "test-cookie"))
+
+	scope.Forwarded.Proto = "http"
+	resp = httptest.NewRecorder()
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
+	assert.Equal(t, "test-cookie=test-value; Path=/; Domain=127.0.0.1", resp.Header().Get("Set-Cookie"))
+}
+
 func TestDropRefreshCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 
@@ -122,6 +155,49 @@ func TestDropRefreshCookie(t *testing.T) {
 		"we have not set the cookie, headers: %v", resp.Header())
 }
 
+func TestDropCookieWithChunksExpiresStaleChunks(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	name := p.config.CookieAccessName
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	chunkLength := p.getMaxCookieChunkLength(req, name)
+	resp := httptest.NewRecorder()
+	p.dropCookieWithChunks(req, resp, name, strings.Repeat("a", 2*chunkLength+10), time.Hour)
+	previous := resp.Result().Cookies()
+	require.Len(t, previous, 3)
+
+	// the browser sends back the 3 chunks, then gets a shorter value
+	req = newFakeHTTPRequest("GET", "/admin")
+	for _, cookie := range previous {
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	resp = httptest.NewRecorder()
+	p.dropCookieWithChunks(req, resp, name, "new-token", time.Hour)
+
+	jar := make(map[string]string)
+	for _, cookie := range previous {
+		jar[cookie.Name] = cookie.Value
+	}
+	expired := make(map[string]bool)
+	for _, cookie := range resp.Result().Cookies() {
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now())) {
+			expired[cookie.Name] = true
+			delete(jar, cookie.Name)
+			continue
+		}
+		jar[cookie.Name] = cookie.Value
+	}
+	assert.Equal(t, map[string]bool{name + "-1": true, name + "-2": true}, expired)
+
+	req = newFakeHTTPRequest("GET", "/admin")
+	for k, v := range jar {
+		req.AddCookie(&http.Cookie{Name: k, Value: v})
+	}
+	token, err := getTokenInCookie(req, name)
+	require.NoError(t, err)
+	assert.Equal(t, "new-token", token)
+}
+
 func TestSessionOnlyCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 	p.config.EnableSessionCookies = true
@@ -130,19 +206,43 @@ func TestSessionOnlyCookie(t *testing.T) {
 
 	req := newFakeHTTPRequest("GET", "/admin")
 	resp := httptest.NewRecorder()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 1*time.Hour)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 1*time.Hour)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
 		"we have not set the cookie, headers: %v", resp.Header())
 }
 
+func TestCookieExpiresClock(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	clock := newFakeClock()
+	p.clock = clock
+	req := newFakeHTTPRequest("GET", "/admin")
+
+	for _, sessionCookies := range []bool{false, true} {
+		p.config.EnableSessionCookies = sessionCookies
+		p.cookieDropper = p.makeCookieDropper()
+
+		resp := httptest.NewRecorder()
+		p.dropCookie(resp, req, "test-cookie", "test-value", time.Hour)
+		p.dropCookie(resp, req, "expired-cookie", "", -10*time.Hour)
+		cookies := resp.Result().Cookies()
+		require.Len(t, cookies, 2)
+		if sessionCookies {
+			assert.True(t, cookies[0].Expires.IsZero(), "the session cookies have no expiry")
+		} else {
+			assert.True(t, clock.Now().Add(time.Hour).Equal(cookies[0].Expires))
+		}
+		assert.True(t, clock.Now().Add(-10*time.Hour).Equal(cookies[1].Expires))
+	}
+}
+
 func TestSameSiteCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 
 	req := newFakeHTTPRequest("GET", "/admin")
 	resp := httptest.NewRecorder()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -153,7 +253,7 @@ func TestSameSiteCookie(t *testing.T) {
 	p.config.SameSiteCookie = SameSiteStrict
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1; SameSite=Strict",
@@ -164,7 +264,7 @@ func TestSameSiteCookie(t *testing.T) {
 	p.config.SameSiteCookie = SameSiteLax
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1; SameSite=Lax",
@@ -175,19 +275,36 @@ func TestSameSiteCookie(t *testing.T) {
 	p.config.SameSiteCookie = SameSiteNone
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
 		"we have not set the cookie, headers: %v", resp.Header())
 }
 
+func TestPartitionedCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.EnablePartitionedCookies = true
+	p.config.SecureCookie = true
+	p.config.SameSiteCookie = SameSiteNone
+	p.cookieChunker = p.makeCookieChunker()
+	p.cookieDropper = p.makeCookieDropper()
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
+
+	assert.Equal(t, resp.Header().Get("Set-Cookie"),
+		"test-cookie=test-value; Path=/; Domain=127.0.0.1; Secure; SameSite=None; Partitioned",
+		"we have not set the cookie, headers: %v", resp.Header())
+}
+
 func TestHTTPOnlyCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 
 	req := newFakeHTTPRequest("GET", "/admin")
 	resp := httptest.NewRecorder()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1",
@@ -198,7 +315,7 @@ func TestHTTPOnlyCookie(t *testing.T) {
 	p.config.HTTPOnlyCookie = true
 	p.cookieChunker = p.makeCookieChunker()
 	p.cookieDropper = p.makeCookieDropper()
-	p.dropCookie(resp, req.Host, "test-cookie", "test-value", 0)
+	p.dropCookie(resp, req, "test-cookie", "test-value", 0)
 
 	assert.Equal(t, resp.Header().Get("Set-Cookie"),
 		"test-cookie=test-value; Path=/; Domain=127.0.0.1; HttpOnly",
@@ -226,6 +343,35 @@ func TestClearRefreshAccessTokenCookie(t *testing.T) {
 		"we have not cleared the, headers: %v", resp.Header())
 }
 
+func TestDropIDTokenCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	p.config.CookieIDTokenName = "kc-id"
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.dropIDTokenCookie(req, resp, "test", 0)
+
+	assert.Equal(t, resp.Header().Get("Set-Cookie"),
+		"kc-id=test; Path=/; Domain=127.0.0.1",
+		"we have not set the cookie, headers: %v", resp.Header())
+}
+
+func TestClearIDTokenCookie(t *testing.T) {
+	p, _, _ := newTestProxyService(nil)
+	req := newFakeHTTPRequest("GET", "/admin")
+
+	resp := httptest.NewRecorder()
+	p.clearIDTokenCookie(req, resp)
+	assert.Empty(t, resp.Header().Get("Set-Cookie"), "we should not clear a cookie which is not configured")
+
+	p.config.CookieIDTokenName = "kc-id"
+	resp = httptest.NewRecorder()
+	p.clearIDTokenCookie(req, resp)
+	assert.Contains(t, resp.Header().Get("Set-Cookie"),
+		"kc-id=; Path=/; Domain=127.0.0.1; Expires=",
+		"we have not cleared the, headers: %v", resp.Header())
+}
+
 func TestClearAllCookies(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 	req := newFakeHTTPRequest("GET", "/admin")
@@ -236,6 +382,105 @@ func TestClearAllCookies(t *testing.T) {
 		"we have not cleared the, headers: %v", resp.Header())
 }
 
+func TestCookieNameSuffix(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.CookieNameSuffix = "_app"
+	p, _, _ := newTestProxyService(cfg)
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	p.dropAccessTokenCookie(req, resp, "test", 0)
+	assert.Equal(t, accessCookie+"_app=test; Path=/; Domain=127.0.0.1", resp.Header().Get("Set-Cookie"))
+
+	// unsuffixed cookies are read back until the suffixed ones are dropped
+	assert.Equal(t, accessCookie+"_app", p.requestCookieName(req, accessCookie))
+	req.AddCookie(&http.Cookie{Name: accessCookie, Value: "legacy"})
+	assert.Equal(t, accessCookie, p.requestCookieName(req, accessCookie))
+	req.AddCookie(&http.Cookie{Name: accessCookie + "_app", Value: "test"})
+	assert.Equal(t, accessCookie+"_app", p.requestCookieName(req, accessCookie))
+
+	// both are cleared
+	resp = httptest.NewRecorder()
+	p.clearAccessTokenCookie(req, resp)
+	cleared := resp.Header().Values("Set-Cookie")
+	require.Len(t, cleared, 2)
+	assert.True(t, strings.HasPrefix(cleared[0], accessCookie+"_app=; "))
+	assert.True(t, strings.HasPrefix(cleared[1], accessCookie+"=; "))
+
+	assert.Equal(t, []string{accessCookie + "_app", accessCookie}, p.filteredCookieNames(accessCookie))
+}
+
+func TestClientIDCookieSuffix(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableClientIDCookieSuffix = true
+	p, _, _ := newTestProxyService(cfg)
+	assert.Regexp(t, "^_[0-9a-f]{8}$", p.cookieSuffix)
+
+	other := newFakeKeycloakConfig()
+	other.EnableClientIDCookieSuffix = true
+	other.ClientID = "another-client"
+	q, _, _ := newTestProxyService(other)
+	assert.NotEqual(t, p.cookieSuffix, q.cookieSuffix)
+}
+
+func TestCookieNameSuffixMigration(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.CookieNameSuffix = "_app"
+	requests := []fakeRequest{
+		{
+			URI:              cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			ExpectedCookies:  map[string]string{accessCookie + "_app": ""},
+			ExpectedLocation: "/",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+		{
+			// a session started before the suffix was set is still valid
+			URI:            "/auth_all/test",
+			HasCookieToken: true,
+			ExpectedProxy:  true,
+			ExpectedCode:   http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestMatchCookieFilter(t *testing.T) {
+	cs := []struct {
+		Name     string
+		Filter   string
+		Expected bool
+	}{
+		{Name: "kc-access", Filter: "kc-access", Expected: true},
+		{Name: "kc-access-1", Filter: "kc-access", Expected: true},
+		{Name: "kc-access-12", Filter: "kc-access", Expected: true},
+		{Name: "kc-access-level", Filter: "kc-access", Expected: false},
+		{Name: "kc-access-", Filter: "kc-access", Expected: false},
+		{Name: "kc-accessor", Filter: "kc-access", Expected: false},
+		{Name: "kc-access-level", Filter: "kc-access*", Expected: true},
+		{Name: "kc-access", Filter: "kc-access*", Expected: true},
+		{Name: "kc-state", Filter: "kc-access*", Expected: false},
+		{Name: "kc-access", Filter: "", Expected: false},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, matchCookieFilter(c.Name, c.Filter), "case %d, cookie %s, filter %s", i, c.Name, c.Filter)
+	}
+}
+
+func TestFilterCookies(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		req := newFakeHTTPRequest(http.MethodGet, "/")
+		req.AddCookie(&http.Cookie{Name: "kc-access-1", Value: "chunk"})
+		req.AddCookie(&http.Cookie{Name: "kc-access-level", Value: "high"})
+		require.NoError(t, filterCookies(req, []string{"kc-access"}, drop))
+
+		if drop {
+			assert.Equal(t, "kc-access-level=high", req.Header.Get("Cookie"))
+		} else {
+			assert.Equal(t, "kc-access-1=redacted; kc-access-level=high", req.Header.Get("Cookie"))
+		}
+	}
+}
+
 func TestGetMaxCookieChunkLength(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 	req := newFakeHTTPRequest("GET", "/admin")
@@ -263,3 +508,220 @@ func TestGetMaxCookieChunkLength(t *testing.T) {
 	assert.Equal(t, 3998, p.getMaxCookieChunkLength(req, ""),
 		"cookie chunk calculation is not correct")
 }
+
+// newLargeFakeJWT builds a signed-looking JWT of about 10KB, as issued by keycloak with many client roles
+func newLargeFakeJWT(tb testing.TB) string {
+	token := newTestToken("http://127.0.0.1/auth/realms/hod-test")
+	roles := make([]string, 0, 300)
+	for i := 0; i < 300; i++ {
+		roles = append(roles, fmt.Sprintf("app-%03d:role-reader", i))
+	}
+	token.addClientRoles("clientid", roles)
+	token.addRealmRoles(roles[:50])
+	jwt := token.getToken()
+
+	signature := make([]byte, 256)
+	_, err := rand.Read(signature)
+	require.NoError(tb, err)
+	jwt.Signature = signature
+
+	return jwt.Encode()
+}
+
+func TestCompressCookieValue(t *testing.T) {
+	token := newLargeFakeJWT(t)
+
+	compressed := compressCookieValue(token)
+	assert.True(t, strings.HasPrefix(compressed, compressedCookiePrefix))
+	assert.Less(t, len(compressed), len(token)/2)
+
+	decompressed, err := decompressCookieValue(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, token, decompressed)
+
+	// legacy, uncompressed cookies are left unchanged
+	decompressed, err = decompressCookieValue(token)
+	require.NoError(t, err)
+	assert.Equal(t, token, decompressed)
+
+	// encrypted tokens are not compressed any further
+	encrypted, err := encodeText(token, secretForCookie)
+	require.NoError(t, err)
+	assert.Equal(t, encrypted, compressCookieValue(encrypted))
+
+	_, err = decompressCookieValue(compressedCookiePrefix + "garbage")
+	assert.Equal(t, ErrInvalidSession, err)
+}
+
+func TestCompressedCookieRoundTrip(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		p, _, _ := newTestProxyService(nil)
+		p.config.EnableCookieCompression = true
+		p.config.EnableEncryptedToken = encrypted
+		p.config.EncryptionKey = secretForCookie
+
+		token := newLargeFakeJWT(t)
+		value := token
+		if encrypted {
+			var err error
+			value, err = encodeText(token, p.config.EncryptionKey)
+			require.NoError(t, err)
+		}
+
+		resp := httptest.NewRecorder()
+		p.dropAccessTokenCookie(newFakeHTTPRequest("GET", "/admin"), resp, value, time.Hour)
+
+		req := newFakeHTTPRequest("GET", "/admin")
+		for _, cookie := range resp.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		user, err := p.getIdentity(req)
+		require.NoError(t, err, "encrypted: %t", encrypted)
+		assert.Equal(t, token, user.token.Encode())
+	}
+}
+
+func BenchmarkCookieChunks(b *testing.B) {
+	p, _, _ := newTestProxyService(nil)
+	token := newLargeFakeJWT(b)
+	encrypted, err := encodeText(token, secretForCookie)
+	require.NoError(b, err)
+
+	chunks := func(value string) float64 {
+		resp := httptest.NewRecorder()
+		p.dropAccessTokenCookie(newFakeHTTPRequest("GET", "/admin"), resp, value, time.Hour)
+		return float64(len(resp.Result().Cookies()))
+	}
+
+	for _, compressed := range []bool{false, true} {
+		p.config.EnableCookieCompression = compressed
+		b.Run(fmt.Sprintf("plain/compressed=%t", compressed), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.ReportMetric(chunks(token), "chunks")
+			}
+		})
+		b.Run(fmt.Sprintf("encrypted/compressed=%t", compressed), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				b.ReportMetric(chunks(encrypted), "chunks")
+			}
+		})
+	}
+}
+
+func BenchmarkDecompressCookieValue(b *testing.B) {
+	compressed := compressCookieValue(newLargeFakeJWT(b))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := decompressCookieValue(compressed); err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func TestDuplicateSessionCookies(t *testing.T) {
+	p, idp, _ := newTestProxyService(nil)
+	name := p.config.CookieAccessName
+	signed, err := idp.signToken(newTestToken(idp.getLocation()).claims)
+	require.NoError(t, err)
+	valid := signed.Encode()
+	expiredToken := newTestToken(idp.getLocation())
+	expiredToken.setExpiration(time.Now().Add(-time.Hour))
+	signed, err = idp.signToken(expiredToken.claims)
+	require.NoError(t, err)
+	expired := signed.Encode()
+
+	// split divides a value in chunk cookies
+	split := func(value string, chunks int) []*http.Cookie {
+		length := len(value)/chunks + 1
+		var cookies []*http.Cookie
+		for i := 0; i < chunks; i++ {
+			chunk := value[i*length:]
+			if len(chunk) > length {
+				chunk = chunk[:length]
+			}
+			cookieName := name
+			if i > 0 {
+				cookieName = fmt.Sprintf("%s-%d", name, i)
+			}
+			cookies = append(cookies, &http.Cookie{Name: cookieName, Value: chunk})
+		}
+		return cookies
+	}
+
+	cs := []struct {
+		Name     string
+		Cookies  [][]*http.Cookie
+		Expected string
+	}{
+		{Name: "expired then valid", Cookies: [][]*http.Cookie{split(expired, 1), split(valid, 1)}, Expected: valid},
+		{Name: "valid then expired", Cookies: [][]*http.Cookie{split(valid, 1), split(expired, 1)}, Expected: valid},
+		{Name: "more chunks in the stale cookie", Cookies: [][]*http.Cookie{split(expired, 3), split(valid, 2)}, Expected: valid},
+		{Name: "more chunks in the new cookie", Cookies: [][]*http.Cookie{split(valid, 3), split(expired, 1)}, Expected: valid},
+		{Name: "garbage then expired", Cookies: [][]*http.Cookie{{{Name: name, Value: "garbage"}}, split(expired, 2)}, Expected: expired},
+		{Name: "two valid tokens", Cookies: [][]*http.Cookie{split(valid, 1), split(valid, 1)}, Expected: valid},
+	}
+	for _, c := range cs {
+		req := newFakeHTTPRequest(http.MethodGet, "/admin")
+		// the browsers send both generations together
+		for _, generation := range c.Cookies {
+			for _, cookie := range generation {
+				req.AddCookie(cookie)
+			}
+		}
+		assert.True(t, hasDuplicateCookies(req, name), "case: %s", c.Name)
+		token, bearer, err := getTokenInRequest(req, name, p.rankAccessToken)
+		require.NoError(t, err, "case: %s", c.Name)
+		assert.False(t, bearer)
+		assert.Equal(t, c.Expected, token, "case: %s", c.Name)
+	}
+}
+
+func TestExpireStaleCookies(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.CookieDomain = ".example.com"
+	cfg.EnableCookieDomainCleanup = true
+	cfg.CookieCleanupDomains = []string{"app.example.com", "example.com"}
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	valid, err := p.idp.signToken(newTestToken(p.idp.getLocation()).claims)
+	require.NoError(t, err)
+	expiredToken := newTestToken(p.idp.getLocation())
+	expiredToken.setExpiration(time.Now().Add(-time.Hour))
+	expired, err := p.idp.signToken(expiredToken.claims)
+	require.NoError(t, err)
+
+	request := func(cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+"/auth_all/test", nil)
+		require.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// the host-scoped cookie of the previous configuration is sent along with the new one
+	resp := request(&http.Cookie{Name: cfg.CookieAccessName, Value: expired.Encode()}, &http.Cookie{Name: cfg.CookieAccessName, Value: valid.Encode()})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(testProxyAccepted))
+	var domains []string
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == cfg.CookieAccessName {
+			assert.Empty(t, cookie.Value)
+			assert.True(t, cookie.Expires.Before(time.Now()))
+			domains = append(domains, cookie.Domain)
+		}
+	}
+	// the cookies on the cookie domain are kept
+	assert.Equal(t, []string{"127.0.0.1", "app.example.com"}, domains)
+
+	// the cookies are left alone without duplicates
+	resp = request(&http.Cookie{Name: cfg.CookieAccessName, Value: valid.Encode()})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Cookies())
+}
@@ -0,0 +1,243 @@
+//go:build !noreverse
+// +build !noreverse
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const redactedValue = "redacted"
+
+// decisionCheck is a single check performed when admitting a request to a resource
+type decisionCheck struct {
+	check    string
+	passed   bool
+	required string
+	issued   string
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (c decisionCheck) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("check", c.check)
+	enc.AddBool("passed", c.passed)
+	enc.AddString("required", c.required)
+	enc.AddString("issued", c.issued)
+
+	return nil
+}
+
+type decisionChecks []decisionCheck
+
+// MarshalLogArray implements zapcore.ArrayMarshaler
+func (c decisionChecks) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, check := range c {
+		if err := enc.AppendObject(check); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decisionTrace collects the checks performed when evaluating the access to a resource,
+// so support can figure out why a given user has been denied.
+//
+// A nil decisionTrace is valid and does nothing: this is what we get when debug-authorization is disabled.
+type decisionTrace struct {
+	resource   *Resource
+	candidates []string
+	redacted   map[string]struct{}
+	checks     decisionChecks
+}
+
+// newDecisionTracer returns a constructor for decision traces, or nil when authorization debugging is disabled
+func (r *oauthProxy) newDecisionTracer(resource *Resource) func(*http.Request) *decisionTrace {
+	if !r.config.EnableDebugAuthorization {
+		return nil
+	}
+
+	redacted := make(map[string]struct{}, len(r.config.DebugAuthorizationRedactedClaims))
+	for _, claim := range r.config.DebugAuthorizationRedactedClaims {
+		redacted[claim] = struct{}{}
+	}
+	// the email, roles and groups of the user are redacted with the claims they are extracted from
+	sources := map[string][]string{
+		"email":  {claimEmail},
+		"roles":  {claimRealmAccess, claimResourceAccess, claimRoot(r.config.RolesClaim), claimRoot(r.config.ClientRolesClaim)},
+		"groups": {defaultTo(r.config.GroupsClaim, claimGroups)},
+	}
+	for field, claims := range sources {
+		for _, claim := range claims {
+			if _, isRedacted := redacted[claim]; isRedacted && claim != "" {
+				redacted[field] = struct{}{}
+			}
+		}
+	}
+
+	return func(req *http.Request) *decisionTrace {
+		return &decisionTrace{
+			resource:   resource,
+			candidates: candidateResources(req, r.config.Resources),
+			redacted:   redacted,
+			checks:     make(decisionChecks, 0, 3+len(r.config.MatchClaims)),
+		}
+	}
+}
+
+// candidateResources lists the resources which could have matched the request path, by precedence: the
+// first one is the one applied by the router
+func candidateResources(req *http.Request, resources []*Resource) []string {
+	matching := make([]*Resource, 0, len(resources))
+	for _, resource := range resources {
+		if resource.matches(req.URL.Path) && resource.matchesHeaders(req.Header) {
+			matching = append(matching, resource)
+		}
+	}
+	sortResourcesByPrecedence(matching)
+
+	candidates := make([]string, 0, len(matching))
+	for _, resource := range matching {
+		candidates = append(candidates, resource.route())
+	}
+
+	return candidates
+}
+
+// claimRoot returns the top level claim of a dot-separated claim path
+func claimRoot(path string) string {
+	return strings.SplitN(path, ".", 2)[0]
+}
+
+// add records a check, redacting the issued values whenever required
+func (d *decisionTrace) add(check string, passed bool, required, issued []string) {
+	if d == nil {
+		return
+	}
+
+	d.checks = append(d.checks, decisionCheck{
+		check:    check,
+		passed:   passed,
+		required: strings.Join(required, ","),
+		issued:   strings.Join(d.redactAll(check, issued), ","),
+	})
+}
+
+// redact returns the value of a field, or the redacted value when the field is redacted
+func (d *decisionTrace) redact(field, value string) string {
+	if _, isRedacted := d.redacted[field]; isRedacted && value != "" {
+		return redactedValue
+	}
+	return value
+}
+
+// redactAll returns the values of a field, or the redacted value when the field is redacted
+func (d *decisionTrace) redactAll(field string, values []string) []string {
+	if _, isRedacted := d.redacted[field]; isRedacted && len(values) > 0 {
+		return []string{redactedValue}
+	}
+	return values
+}
+
+// addClaim records a check against a claim, redacting the issued value whenever required
+func (d *decisionTrace) addClaim(user *userContext, claimName, required string, passed bool) {
+	if d == nil {
+		return
+	}
+
+	issued := ""
+	if value, found := user.claims[claimName]; found {
+		issued = d.redact(claimName, fmt.Sprintf("%v", value))
+	}
+
+	d.checks = append(d.checks, decisionCheck{
+		check:    "claim:" + claimName,
+		passed:   passed,
+		required: required,
+		issued:   issued,
+	})
+}
+
+// explain logs the decision with all the checks performed so far, and records it as an event of the span if any
+func (d *decisionTrace) explain(logger Logger, span *trace.Span, user *userContext, decision string) {
+	if d == nil {
+		return
+	}
+	email, roles, groups := d.redact("email", user.email), d.redactAll("roles", user.roles), d.redactAll("groups", user.groups)
+
+	logger.Debug("authorization decision",
+		zap.String("decision", decision),
+		zap.String("resource", d.resource.route()),
+		zap.Strings("methods", d.resource.Methods),
+		zap.Strings("candidates", d.candidates),
+		zap.String("email", email),
+		zap.Strings("roles", roles),
+		zap.Strings("groups", groups),
+		zap.Array("checks", d.checks),
+	)
+
+	if span == nil {
+		return
+	}
+	attributes := []trace.Attribute{
+		trace.StringAttribute("decision", decision),
+		trace.StringAttribute("resource", d.resource.route()),
+		trace.StringAttribute("methods", strings.Join(d.resource.Methods, ",")),
+		trace.StringAttribute("candidates", strings.Join(d.candidates, ",")),
+		trace.StringAttribute("email", email),
+		trace.StringAttribute("roles", strings.Join(roles, ",")),
+		trace.StringAttribute("groups", strings.Join(groups, ",")),
+	}
+	for _, check := range d.checks {
+		outcome := "failed"
+		if check.passed {
+			outcome = "passed"
+		}
+		attributes = append(attributes, trace.StringAttribute("check."+check.check,
+			fmt.Sprintf("%s, required: %s, issued: %s", outcome, check.required, check.issued)))
+	}
+	span.Annotate(attributes, "authorization decision trace")
+}
+
+// selfTestAuthorization checks the user of the self-test would be admitted to the resource protecting a path
+func (r *oauthProxy) selfTestAuthorization(path string, user *userContext) (string, error) {
+	// the most specific resource protecting the path wins
+	var resource *Resource
+	for _, candidate := range r.config.Resources {
+		if !candidate.matches(path) || !candidate.matchesHeaders(nil) || !containsString(http.MethodGet, candidate.Methods) {
+			continue
+		}
+		if resource == nil || candidate.precedes(resource) {
+			resource = candidate
+		}
+	}
+	switch {
+	case resource == nil:
+		return fmt.Sprintf("no resource protects %s", path), errSelfTestSkipped
+	case resource.WhiteListed:
+		return fmt.Sprintf("resource %s is white-listed", resource.route()), nil
+	case resource.BlackListed:
+		return "", fmt.Errorf("resource %s is black-listed", resource.route())
+	}
+
+	if roles, _ := resource.rolesFor(http.MethodGet); !hasAccess(roles, user.roles, !resource.RequireAnyRole, false) {
+		return "", fmt.Errorf("access to %s denied, required roles: %s", resource.route(), strings.Join(roles, ","))
+	}
+	if !hasAccess(resource.Groups, user.groups, false, true) {
+		return "", fmt.Errorf("access to %s denied, required groups: %s", resource.route(), strings.Join(resource.Groups, ","))
+	}
+	for claimName, match := range r.config.MatchClaims {
+		if !r.checkClaim(user, claimName, regexp.MustCompile(match), resource.route()) {
+			return "", fmt.Errorf("access to %s denied, claim %s does not match", resource.route(), claimName)
+		}
+	}
+
+	return fmt.Sprintf("access to %s permitted", resource.route()), nil
+}
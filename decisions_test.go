@@ -0,0 +1,218 @@
+//go:build !noreverse
+// +build !noreverse
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDecisionTraceDisabled(t *testing.T) {
+	p := &oauthProxy{config: newFakeKeycloakConfig()}
+	assert.Nil(t, p.newDecisionTracer(p.config.Resources[0]))
+
+	// a nil trace is a no-op
+	var decision *decisionTrace
+	decision.add("roles", true, nil, nil)
+	decision.addClaim(&userContext{}, "email", ".*", true)
+	decision.explain(nil, nil, &userContext{}, "permitted")
+}
+
+func TestDecisionTrace(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDebugAuthorization = true
+	cfg.DebugAuthorizationRedactedClaims = []string{"email"}
+	p := &oauthProxy{config: cfg}
+
+	resource := cfg.Resources[0]
+	newDecisionTrace := p.newDecisionTracer(resource)
+	require.NotNil(t, newDecisionTrace)
+
+	user := &userContext{
+		email:  "gambol99@gmail.com",
+		roles:  []string{"dummy"},
+		claims: jose.Claims{"email": "gambol99@gmail.com", "iss": "test"},
+	}
+	decision := newDecisionTrace(newFakeHTTPRequest("GET", fakeAdminRoleURL))
+	assert.Contains(t, decision.candidates, resource.URL)
+
+	decision.add("roles", false, resource.Roles, user.roles)
+	decision.addClaim(user, "email", ".*", true)
+	decision.addClaim(user, "iss", "^test$", true)
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	decision.explain(logger{Stdlog: zap.New(core)}, nil, user, "denied")
+
+	entries := logs.FilterMessage("authorization decision").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "denied", fields["decision"])
+	assert.Equal(t, resource.URL, fields["resource"])
+
+	checks, ok := fields["checks"].([]interface{})
+	require.True(t, ok)
+	require.Len(t, checks, 3)
+	assert.Equal(t, map[string]interface{}{"check": "roles", "passed": false, "required": fakeAdminRole, "issued": "dummy"}, checks[0])
+	assert.Equal(t, map[string]interface{}{"check": "claim:email", "passed": true, "required": ".*", "issued": redactedValue}, checks[1])
+	assert.Equal(t, map[string]interface{}{"check": "claim:iss", "passed": true, "required": "^test$", "issued": "test"}, checks[2])
+	assert.Equal(t, redactedValue, fields["email"])
+	assert.Equal(t, []interface{}{"dummy"}, fields["roles"])
+}
+
+func TestDecisionTraceRedactsIdentity(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDebugAuthorization = true
+	cfg.DebugAuthorizationRedactedClaims = []string{claimRealmAccess, "memberships"}
+	cfg.GroupsClaim = "memberships"
+	p := &oauthProxy{config: cfg}
+
+	user := &userContext{
+		email:  "gambol99@gmail.com",
+		roles:  []string{"admin", "auditor"},
+		groups: []string{"/finance"},
+	}
+	decision := p.newDecisionTracer(cfg.Resources[0])(newFakeHTTPRequest("GET", fakeAdminRoleURL))
+	decision.add("roles", true, []string{"admin"}, user.roles)
+	decision.add("groups", true, []string{"/finance"}, user.groups)
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	decision.explain(logger{Stdlog: zap.New(core)}, nil, user, "permitted")
+
+	entries := logs.FilterMessage("authorization decision").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "gambol99@gmail.com", fields["email"])
+	assert.Equal(t, []interface{}{redactedValue}, fields["roles"])
+	assert.Equal(t, []interface{}{redactedValue}, fields["groups"])
+	checks, ok := fields["checks"].([]interface{})
+	require.True(t, ok)
+	require.Len(t, checks, 2)
+	assert.Equal(t, map[string]interface{}{"check": "roles", "passed": true, "required": "admin", "issued": redactedValue}, checks[0])
+	assert.Equal(t, map[string]interface{}{"check": "groups", "passed": true, "required": "/finance", "issued": redactedValue}, checks[1])
+}
+
+// fakeSpanExporter collects the spans ended by the tests
+type fakeSpanExporter struct {
+	sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *fakeSpanExporter) ExportSpan(span *trace.SpanData) {
+	e.Lock()
+	defer e.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func TestDecisionTraceSpanEvent(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDebugAuthorization = true
+	cfg.DebugAuthorizationRedactedClaims = []string{"email"}
+	p := &oauthProxy{config: cfg}
+
+	exporter := &fakeSpanExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	user := &userContext{email: "gambol99@gmail.com", roles: []string{"dummy"}}
+	resource := cfg.Resources[0]
+	decision := p.newDecisionTracer(resource)(newFakeHTTPRequest("GET", fakeAdminRoleURL))
+	decision.add("roles", false, resource.Roles, user.roles)
+
+	_, span := trace.StartSpan(context.Background(), "admission middleware", trace.WithSampler(trace.AlwaysSample()))
+	decision.explain(logger{Stdlog: zap.NewNop()}, span, user, "denied")
+	span.End()
+
+	exporter.Lock()
+	defer exporter.Unlock()
+	require.Len(t, exporter.spans, 1)
+	require.Len(t, exporter.spans[0].Annotations, 1)
+	event := exporter.spans[0].Annotations[0]
+	assert.Equal(t, "authorization decision trace", event.Message)
+	assert.Equal(t, "denied", event.Attributes["decision"])
+	assert.Equal(t, resource.URL, event.Attributes["resource"])
+	assert.Equal(t, redactedValue, event.Attributes["email"])
+	assert.Equal(t, "dummy", event.Attributes["roles"])
+	assert.Equal(t, "failed, required: "+fakeAdminRole+", issued: dummy", event.Attributes["check.roles"])
+}
+
+func TestClientNetworkDecisionTrace(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDebugAuthorization = true
+	core, logs := observer.New(zapcore.DebugLevel)
+	px := &oauthProxy{config: cfg, log: zap.New(core)}
+	resource := &Resource{URL: "/admin/*", Methods: allHTTPMethods, AllowedCIDRs: []string{"10.0.0.0/8"}, DeniedCIDRs: []string{"203.0.113.0/24"}}
+	require.NoError(t, resource.valid())
+
+	// the refused client is passed on denied, so that the next middlewares skip the request
+	var denied bool
+	handler := px.clientNetworkMiddleware(resource)(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+		denied = ok && scope.AccessDenied
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), contextScopeName, &RequestScope{})))
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.True(t, denied)
+	entries := logs.FilterMessage("authorization decision").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "denied", fields["decision"])
+	checks, ok := fields["checks"].([]interface{})
+	require.True(t, ok)
+	require.Len(t, checks, 1)
+	assert.Equal(t, map[string]interface{}{"check": "cidr", "passed": false, "required": "10.0.0.0/8,!203.0.113.0/24", "issued": "192.0.2.1"}, checks[0])
+}
+
+func TestAdmissionDeniedRoles(t *testing.T) {
+	cs := []struct {
+		Method         string
+		RequireAnyRole bool
+		Roles          []string
+		Required       string
+		Rule           string
+		Missing        []interface{}
+	}{
+		{Roles: []string{"auditor"}, Required: "all", Missing: []interface{}{"admin"}},
+		{Roles: []string{"guest"}, Required: "all", Missing: []interface{}{"admin", "auditor"}},
+		{RequireAnyRole: true, Roles: []string{"guest"}, Required: "any", Missing: []interface{}{"admin", "auditor"}},
+		{Method: http.MethodDelete, Roles: []string{"admin", "auditor"}, Required: "all", Rule: "method-roles.DELETE", Missing: []interface{}{"owner"}},
+		{Method: http.MethodPost, RequireAnyRole: true, Roles: []string{"auditor"}, Required: "any", Rule: "method-roles.POST", Missing: []interface{}{"writer", "admin"}},
+	}
+	for i, c := range cs {
+		core, logs := observer.New(zapcore.WarnLevel)
+		px := &oauthProxy{config: newFakeKeycloakConfig(), log: zap.New(core)}
+		resource := &Resource{
+			URL:            "/admin/*",
+			Roles:          []string{"admin", "auditor"},
+			MethodRoles:    map[string][]string{http.MethodPost: {"writer", "admin"}, http.MethodDelete: {"owner"}},
+			RequireAnyRole: c.RequireAnyRole,
+		}
+		handler := px.admissionMiddleware(resource)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		scope := &RequestScope{Identity: &userContext{email: "user@example.com", roles: c.Roles}}
+		req := httptest.NewRequest(defaultTo(c.Method, http.MethodGet), "/admin/users", nil)
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), contextScopeName, scope)))
+
+		assert.Equal(t, http.StatusForbidden, resp.Code, "case %d", i)
+		entries := logs.FilterMessage("access denied, invalid roles").All()
+		require.Len(t, entries, 1, "case %d", i)
+		fields := entries[0].ContextMap()
+		assert.Equal(t, c.Required, fields["required"], "case %d", i)
+		assert.Equal(t, defaultTo(c.Rule, "roles"), fields["rule"], "case %d", i)
+		assert.Equal(t, c.Missing, fields["missing_roles"], "case %d", i)
+	}
+}
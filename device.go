@@ -0,0 +1,332 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+const (
+	// deviceDefaultInterval is the polling interval when the provider does not specify one
+	deviceDefaultInterval = 5 * time.Second
+	// deviceSlowDownIncrement is added to the polling interval each time the provider asks to slow down
+	deviceSlowDownIncrement = 5 * time.Second
+	// deviceMaxPendingGrants bounds the grants polled at the same time, as each one polls the provider
+	deviceMaxPendingGrants = 1000
+	// deviceGrantRetention is the time the outcome of a grant is kept for the CLI to collect it
+	deviceGrantRetention = time.Minute
+)
+
+// The states of a device authorization grant
+const (
+	deviceGrantPending    = "pending"
+	deviceGrantAuthorized = "authorized"
+	deviceGrantDenied     = "denied"
+	deviceGrantExpired    = "expired"
+	deviceGrantFailed     = "failed"
+)
+
+// deviceGrant is a device authorization grant polled by the proxy, until the user authorizes or denies it
+type deviceGrant struct {
+	state string
+	// the time the grant expires while pending, or is forgotten once resolved
+	expires time.Time
+	// the tokens of the authorized grant, verified by the proxy
+	tokens   oauth2.TokenResponse
+	token    jose.JWT
+	identity *oidc.Identity
+}
+
+// deviceGrants keeps the device authorization grants by device code
+type deviceGrants struct {
+	sync.Mutex
+	grants map[string]*deviceGrant
+}
+
+func newDeviceGrants() *deviceGrants {
+	return &deviceGrants{grants: make(map[string]*deviceGrant)}
+}
+
+// add registers a pending grant, unless too many grants are pending already
+func (d *deviceGrants) add(code string, expires time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	pending := 0
+	for k, x := range d.grants {
+		switch {
+		case now.After(x.expires):
+			delete(d.grants, k)
+		case x.state == deviceGrantPending:
+			pending++
+		}
+	}
+	if pending >= deviceMaxPendingGrants {
+		return false
+	}
+	d.grants[code] = &deviceGrant{state: deviceGrantPending, expires: expires}
+
+	return true
+}
+
+// resolve records the outcome of a grant, kept until collected by the CLI or for the retention
+func (d *deviceGrants) resolve(code string, outcome deviceGrant) {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, found := d.grants[code]; found {
+		outcome.expires = time.Now().Add(deviceGrantRetention)
+		d.grants[code] = &outcome
+	}
+}
+
+// collect returns the state of a grant, which is forgotten once resolved so the tokens are only handed over once
+func (d *deviceGrants) collect(code string) (deviceGrant, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	grant, found := d.grants[code]
+	if !found || time.Now().After(grant.expires) {
+		delete(d.grants, code)
+		return deviceGrant{}, false
+	}
+	if grant.state != deviceGrantPending {
+		delete(d.grants, code)
+	}
+
+	return *grant, true
+}
+
+// deviceAuthorizationHandler starts a device authorization grant on behalf of a CLI: the user code and verification
+// uri of the provider are returned, and the proxy polls the token endpoint until the user authorizes the CLI
+func (r *oauthProxy) deviceAuthorizationHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, span, logger := r.traceSpan(req.Context(), "device authorization handler")
+	if span != nil {
+		defer span.End()
+	}
+
+	authorization, err := r.requestDeviceAuthorization(ctx)
+	if err != nil {
+		r.errorResponse(w, req.WithContext(ctx), "unable to start the device authorization", http.StatusBadGateway, err)
+		return
+	}
+	expires := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	if !r.deviceGrants.add(authorization.DeviceCode, expires) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(deviceDefaultInterval.Seconds())))
+		r.errorResponse(w, req.WithContext(ctx), "too many device authorizations are pending", http.StatusTooManyRequests, nil)
+		return
+	}
+	go r.pollDeviceAuthorization(authorization)
+
+	logger.Info("started a device authorization",
+		zap.String("client_ip", req.RemoteAddr),
+		zap.String("user_code", authorization.UserCode),
+		zap.String("expires", expires.Format(time.RFC3339)))
+
+	w.Header().Set("Content-Type", jsonMime)
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(authorization); err != nil {
+		logger.Warn("failed to write the device authorization response", zap.Error(err))
+	}
+}
+
+// requestDeviceAuthorization starts a device authorization grant at the provider, for the scopes of the client
+func (r *oauthProxy) requestDeviceAuthorization(ctx context.Context) (deviceAuthorization, error) {
+	var authorization deviceAuthorization
+	err := r.retry(ctx, deviceAuthorizationBackoff, func(ctx context.Context) error {
+		var err error
+		authorization, err = r.postDeviceAuthorization(ctx)
+
+		return err
+	})
+
+	return authorization, err
+}
+
+// postDeviceAuthorization posts the device authorization request, only the failures of the provider being worth retrying
+func (r *oauthProxy) postDeviceAuthorization(ctx context.Context) (deviceAuthorization, error) {
+	resp, err := r.postAsClient(ctx, r.deviceEndpoint, url.Values{
+		"client_id": []string{r.config.ClientID},
+		"scope":     []string{strings.Join(append(append([]string{}, r.config.Scopes...), oidc.DefaultScope...), " ")},
+	})
+	if err != nil {
+		return deviceAuthorization{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("the device authorization endpoint responded %d", resp.StatusCode)
+		if resp.StatusCode < http.StatusInternalServerError {
+			return deviceAuthorization{}, permanent(err)
+		}
+		return deviceAuthorization{}, err
+	}
+
+	var authorization deviceAuthorization
+	if err := json.NewDecoder(resp.Body).Decode(&authorization); err != nil {
+		return deviceAuthorization{}, permanent(err)
+	}
+	if authorization.DeviceCode == "" || authorization.UserCode == "" || authorization.ExpiresIn <= 0 {
+		return deviceAuthorization{}, permanent(errors.New("the device authorization endpoint did not return a device code, a user code and an expiry"))
+	}
+
+	return authorization, nil
+}
+
+// pollDeviceAuthorization polls the token endpoint until the grant is authorized, denied or expired: the interval
+// grows each time the provider asks to slow down, and the grant expires after the time set by the provider
+func (r *oauthProxy) pollDeviceAuthorization(authorization deviceAuthorization) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(authorization.ExpiresIn)*time.Second)
+	defer cancel()
+
+	code := authorization.DeviceCode
+	interval := deviceDefaultInterval
+	if authorization.Interval > 0 {
+		interval = time.Duration(authorization.Interval) * time.Second
+	}
+	for {
+		if err := r.waitRetry(ctx, interval); err != nil {
+			r.log.Info("the device authorization has expired", zap.String("user_code", authorization.UserCode))
+			r.deviceGrants.resolve(code, deviceGrant{state: deviceGrantExpired})
+			return
+		}
+
+		resp, err := r.requestToken(ctx, url.Values{
+			"grant_type":  []string{grantTypeDeviceCode},
+			"device_code": []string{code},
+			"client_id":   []string{r.config.ClientID},
+		})
+		if err == nil {
+			r.deviceGrants.resolve(code, r.verifyDeviceTokens(resp, authorization.UserCode))
+			return
+		}
+
+		var failure oauthErrorCode
+		errors.As(err, &failure)
+		switch {
+		case failure == deviceErrorPending:
+		case failure == deviceErrorSlowDown:
+			interval += deviceSlowDownIncrement
+		case failure == deviceErrorExpired || ctx.Err() != nil:
+			r.log.Info("the device authorization has expired", zap.String("user_code", authorization.UserCode))
+			r.deviceGrants.resolve(code, deviceGrant{state: deviceGrantExpired})
+			return
+		case failure == deviceErrorDenied:
+			r.log.Info("the device authorization was denied by the user", zap.String("user_code", authorization.UserCode))
+			r.deviceGrants.resolve(code, deviceGrant{state: deviceGrantDenied})
+			return
+		case failure != "":
+			r.log.Warn("the device authorization was refused by the provider", zap.String("user_code", authorization.UserCode), zap.Error(err))
+			r.deviceGrants.resolve(code, deviceGrant{state: deviceGrantFailed})
+			return
+		default:
+			// the provider could not be reached, the polling goes on until the grant expires
+			r.log.Warn("unable to poll the device authorization", zap.String("user_code", authorization.UserCode), zap.Error(err))
+		}
+	}
+}
+
+// verifyDeviceTokens checks the access token of an authorized grant, as the callback of the code flow does
+func (r *oauthProxy) verifyDeviceTokens(resp oauth2.TokenResponse, userCode string) deviceGrant {
+	token, identity, err := parseToken(resp.AccessToken)
+	if err == nil {
+		err = r.verifyToken(r.client, token)
+	}
+	if err != nil {
+		r.log.Warn("the access token of the device authorization is not valid", zap.String("user_code", userCode), zap.Error(err))
+		return deviceGrant{state: deviceGrantFailed}
+	}
+	r.log.Info("the device authorization was granted",
+		zap.String("user_code", userCode),
+		zap.String("email", identity.Email))
+
+	// @metric a token has been issued to a device
+	oauthTokensMetric.WithLabelValues("device").Inc()
+
+	return deviceGrant{state: deviceGrantAuthorized, tokens: resp, token: token, identity: identity}
+}
+
+// deviceTokenHandler is polled by the CLI with its device code: it responds with the errors of the token endpoint
+// until the grant is resolved, then hands over the tokens once, or opens a session when the CLI asks for a cookie
+func (r *oauthProxy) deviceTokenHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, span, logger := r.traceSpan(req.Context(), "device token handler")
+	if span != nil {
+		defer span.End()
+	}
+
+	grant, found := r.deviceGrants.collect(chi.URLParam(req, "device_code"))
+	if !found {
+		r.errorResponse(w, req.WithContext(ctx), "", http.StatusNotFound, nil)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	switch grant.state {
+	case deviceGrantPending:
+		// the polling is expected, it is not logged
+		errorResponse(w, deviceErrorPending, http.StatusBadRequest)
+		return
+	case deviceGrantDenied:
+		errorResponse(w, deviceErrorDenied, http.StatusBadRequest)
+		return
+	case deviceGrantExpired:
+		errorResponse(w, deviceErrorExpired, http.StatusBadRequest)
+		return
+	case deviceGrantFailed:
+		r.errorResponse(w, req.WithContext(ctx), "the device authorization failed", http.StatusForbidden, nil)
+		return
+	}
+
+	if cookie, _ := strconv.ParseBool(req.URL.Query().Get("cookie")); cookie {
+		if err := r.openSession(w, req.WithContext(ctx), grant.token, grant.identity, grant.tokens, logger); err != nil {
+			r.errorResponse(w, req.WithContext(ctx), "unable to open the session", http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonMime)
+	if err := json.NewEncoder(w).Encode(tokenResponse{
+		TokenType:    authorizationType,
+		AccessToken:  grant.tokens.AccessToken,
+		IDToken:      grant.tokens.IDToken,
+		RefreshToken: grant.tokens.RefreshToken,
+		ExpiresIn:    int(time.Until(grant.identity.ExpiresAt).Seconds()),
+		Scope:        grant.tokens.Scope,
+	}); err != nil {
+		logger.Warn("failed to write the device token response", zap.Error(err))
+	}
+}
@@ -0,0 +1,169 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDeviceProxy returns a proxy running the device flow, polling the provider without waiting for the intervals,
+// which are recorded instead
+func newDeviceProxy(t *testing.T, polls ...string) (*fakeProxy, func() []time.Duration) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDeviceFlow = true
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+	t.Cleanup(func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	})
+	p.idp.devicePolls = polls
+
+	var lock sync.Mutex
+	var intervals []time.Duration
+	p.proxy.retryAfter = func(d time.Duration) <-chan time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		intervals = append(intervals, d)
+
+		return time.After(5 * time.Millisecond)
+	}
+
+	return p, func() []time.Duration {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return append([]time.Duration{}, intervals...)
+	}
+}
+
+// startDeviceAuthorization starts a device authorization grant as a CLI does
+func startDeviceAuthorization(t *testing.T, p *fakeProxy) deviceAuthorization {
+	resp, err := http.Post(p.getServiceURL()+p.config.WithOAuthURI(deviceURL), "", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	var authorization deviceAuthorization
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&authorization))
+	require.NotEmpty(t, authorization.DeviceCode)
+	assert.Equal(t, "ABCD-EFGH", authorization.UserCode)
+	assert.NotEmpty(t, authorization.VerificationURI)
+
+	return authorization
+}
+
+// pollDevice polls the proxy with the device code until the grant is no longer pending
+func pollDevice(t *testing.T, p *fakeProxy, code, query string) (*http.Response, []byte) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(p.getServiceURL() + p.config.WithOAuthURI(deviceURL) + "/" + code + query)
+		require.NoError(t, err)
+		content, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		var failure errorMessage
+		if resp.StatusCode != http.StatusBadRequest || json.Unmarshal(content, &failure) != nil ||
+			failure.Error != deviceErrorPending || time.Now().After(deadline) {
+			return resp, content
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	p, intervals := newDeviceProxy(t, deviceErrorPending, deviceErrorSlowDown, deviceErrorPending)
+	authorization := startDeviceAuthorization(t, p)
+
+	resp, content := pollDevice(t, p, authorization.DeviceCode, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(content))
+	var tokens tokenResponse
+	require.NoError(t, json.Unmarshal(content, &tokens))
+	assert.Equal(t, authorizationType, tokens.TokenType)
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Contains(t, tokens.Scope, "openid")
+
+	// the interval grows each time the provider asks to slow down
+	assert.Equal(t, []time.Duration{time.Second, time.Second, 6 * time.Second, 6 * time.Second}, intervals())
+
+	// the tokens are only handed over once
+	resp, _ = pollDevice(t, p, authorization.DeviceCode, "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = pollDevice(t, p, "unknown", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDeviceFlowSessionCookie(t *testing.T) {
+	p, _ := newDeviceProxy(t, deviceErrorPending)
+	authorization := startDeviceAuthorization(t, p)
+
+	resp, content := pollDevice(t, p, authorization.DeviceCode, "?cookie=true")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, string(content))
+	cookies := make(map[string]string)
+	for _, x := range resp.Cookies() {
+		cookies[x.Name] = x.Value
+	}
+	assert.NotEmpty(t, cookies[p.config.CookieAccessName])
+	assert.NotEmpty(t, cookies[p.config.CookieRefreshName])
+}
+
+func TestDeviceFlowFailures(t *testing.T) {
+	pending := make([]string, 1000)
+	for i := range pending {
+		pending[i] = deviceErrorPending
+	}
+	cs := []struct {
+		Name      string
+		Polls     []string
+		ExpiresIn int
+		Error     string
+	}{
+		{Name: "denied by the user", Polls: []string{deviceErrorPending, deviceErrorDenied}, Error: deviceErrorDenied},
+		{Name: "expired at the provider", Polls: []string{deviceErrorExpired}, Error: deviceErrorExpired},
+		{Name: "timed out", Polls: pending, ExpiresIn: 1, Error: deviceErrorExpired},
+	}
+	for _, c := range cs {
+		t.Run(c.Name, func(t *testing.T) {
+			p, _ := newDeviceProxy(t, c.Polls...)
+			p.idp.deviceExpiresIn = c.ExpiresIn
+			authorization := startDeviceAuthorization(t, p)
+
+			resp, content := pollDevice(t, p, authorization.DeviceCode, "")
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			var failure errorMessage
+			require.NoError(t, json.Unmarshal(content, &failure))
+			assert.Equal(t, c.Error, failure.Error)
+
+			resp, _ = pollDevice(t, p, authorization.DeviceCode, "")
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		})
+	}
+}
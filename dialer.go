@@ -0,0 +1,203 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// The dial settings of the connections to the provider, as those of the default transport
+const (
+	providerDialTimeout   = 30 * time.Second
+	providerDialKeepAlive = 30 * time.Second
+)
+
+// dialFunc opens the outbound connections of a transport
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// newDialer returns the dialer of the outbound connections, which source address is the local address set by the
+// option when there is one, rather than the one picked by the kernel
+func newDialer(option, local string, timeout, keepAlive time.Duration) dialFunc {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+	if local == "" {
+		return dialer.DialContext
+	}
+	// the address has been checked with the configuration
+	dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(local)}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		var failure *os.SyscallError
+		if err != nil && errors.As(err, &failure) && failure.Syscall == "bind" {
+			return nil, fmt.Errorf("unable to bind the connection to %s to the %s %s: %w", address, option, local, err)
+		}
+
+		return conn, err
+	}
+}
+
+// Dial opens a connection without a context, as the dialers of the socks5 proxies do
+func (d dialFunc) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+// proxyFunc returns the proxy the requests to a url go through, none when nil
+type proxyFunc func(*url.URL) (*url.URL, error)
+
+// newProxyFunc returns the proxy of the outbound requests: the upstream-proxy, except for the hosts of the
+// upstream-no-proxy, in place of the standard environment variables (HTTPS_PROXY, HTTP_PROXY and NO_PROXY). The
+// requests to localhost and the loopback addresses are never proxied.
+func newProxyFunc(config *Config) proxyFunc {
+	settings := httpproxy.FromEnvironment()
+	if config.UpstreamProxy != "" {
+		settings.HTTPProxy = config.UpstreamProxy
+		settings.HTTPSProxy = config.UpstreamProxy
+	}
+	if len(config.UpstreamNoProxy) > 0 {
+		settings.NoProxy = strings.Join(config.UpstreamNoProxy, ",")
+	}
+
+	return settings.ProxyFunc()
+}
+
+// ofRequest returns the proxy of a request, as the transports do
+func (p proxyFunc) ofRequest(req *http.Request) (*url.URL, error) {
+	return p(req.URL)
+}
+
+// dialThroughProxy opens a tunnel to an address through an http, https or socks5 proxy, authenticated with the
+// credentials of its url if any. The tls settings are those of the connections to an https proxy.
+func dialThroughProxy(ctx context.Context, dial dialFunc, tlsConfig *tls.Config, parent *url.URL, address string) (net.Conn, error) {
+	if parent.Scheme == "socks5" {
+		dialer, err := netproxy.FromURL(parent, dial)
+		if err != nil {
+			return nil, err
+		}
+
+		return dialer.Dial("tcp", address)
+	}
+
+	host := parent.Host
+	if parent.Port() == "" {
+		host = net.JoinHostPort(parent.Hostname(), map[string]string{unsecureScheme: "80", secureScheme: "443"}[parent.Scheme])
+	}
+	conn, err := dial(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach the upstream proxy %s: %w", parent.Host, err)
+	}
+	if parent.Scheme == secureScheme {
+		settings := &tls.Config{}
+		if tlsConfig != nil {
+			settings = tlsConfig.Clone()
+		}
+		settings.ServerName = parent.Hostname()
+		secured := tls.Client(conn, settings)
+		if err := secured.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("unable to secure the connection to the upstream proxy %s: %w", parent.Host, err)
+		}
+		conn = secured
+	}
+
+	connect := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if parent.User != nil {
+		password, _ := parent.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(parent.User.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := connect.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unable to open a tunnel to %s through the upstream proxy %s: %w", address, parent.Host, err)
+	}
+	// the client speaks first in the tunnel, nothing is read past the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("unable to open a tunnel to %s through the upstream proxy %s: %w", address, parent.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("the upstream proxy %s refused the tunnel to %s: %s", parent.Host, address, resp.Status)
+	}
+
+	return conn, nil
+}
+
+// isUpstreamProxyValid checks the upstream-proxy is the url of an http, https or socks5 proxy
+func (r *Config) isUpstreamProxyValid() error {
+	if r.UpstreamProxy == "" {
+		return nil
+	}
+	u, err := url.Parse(r.UpstreamProxy)
+	if err != nil {
+		return errors.New("the upstream-proxy is not a valid url")
+	}
+	switch u.Scheme {
+	case unsecureScheme, secureScheme, "socks5":
+	default:
+		return fmt.Errorf("invalid upstream-proxy %s, the scheme must be one of http, https or socks5", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid upstream-proxy %s, the proxy has no host", u.Redacted())
+	}
+
+	return nil
+}
+
+// isLocalAddressValid checks the address an option binds the outbound connections to is an ip address assigned to
+// the host, unless the check is skipped because the address is assigned later on
+func (r *Config) isLocalAddressValid(option, local string) error {
+	if local == "" {
+		return nil
+	}
+	ip := net.ParseIP(local)
+	if ip == nil {
+		return fmt.Errorf("the %s %q is not an ip address", option, local)
+	}
+	if r.SkipLocalAddressCheck {
+		return nil
+	}
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("unable to list the addresses of the host to check the %s %s: %w", option, local, err)
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the %s %s is not assigned to any interface of the host, set skip-local-address-check if it is assigned later on (e.g. by dhcp)", option, local)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/oidc"
+	"go.uber.org/zap"
+)
+
+// discoveryPath is the suffix of the discovery document, added by the openid client to the discovery url
+const discoveryPath = "/.well-known/openid-configuration"
+
+// normalizeDiscoveryURL accepts the realm url, with or without the discovery document path and trailing slashes,
+// and returns the url of the realm. The urls of the keycloak consoles or endpoints, which are common mistakes,
+// are rejected with a hint to the expected url.
+func normalizeDiscoveryURL(discoveryURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(discoveryURL))
+	if err != nil || u.Host == "" || (u.Scheme != unsecureScheme && u.Scheme != secureScheme) {
+		return "", fmt.Errorf("discovery url is not a valid URL: %s", discoveryURL)
+	}
+	base := u.Scheme + "://" + u.Host
+
+	// the admin console, e.g. https://keycloak/auth/admin/master/console/#/realms/myrealm
+	if i := strings.Index(u.Path+"/", "/admin/"); i >= 0 {
+		realm := "<realm>"
+		if r := keycloakRealm(u.Fragment); r != "" {
+			realm = r
+		} else if r := keycloakRealm(u.Path); r != "" {
+			realm = r
+		}
+		return "", fmt.Errorf("the discovery url %s looks like the admin console url, expected %s%s/realms/%s",
+			discoveryURL, base, u.Path[:i], realm)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("the discovery url %s cannot have a query or a fragment", discoveryURL)
+	}
+
+	path := strings.TrimRight(u.Path, "/")
+	path = strings.TrimRight(strings.TrimSuffix(path, discoveryPath), "/")
+
+	// a page or an endpoint of the realm, e.g. https://keycloak/realms/myrealm/protocol/openid-connect/auth
+	if i := strings.Index(path, "/realms/"); i >= 0 {
+		realm := strings.TrimPrefix(path[i:], "/realms/")
+		if j := strings.Index(realm, "/"); j >= 0 {
+			return "", fmt.Errorf("the discovery url %s looks like a page of the realm, expected %s%s/realms/%s",
+				discoveryURL, base, path[:i], realm[:j])
+		}
+	}
+
+	return base + path, nil
+}
+
+// isExtraIssuersValid checks the extra issuers are distinct urls, other than the discovery url
+func (r *Config) isExtraIssuersValid() error {
+	seen := map[string]bool{strings.ToLower(r.DiscoveryURL): true}
+	for i, x := range r.ExtraIssuers {
+		issuer, err := normalizeDiscoveryURL(x)
+		if err != nil {
+			return fmt.Errorf("invalid extra issuer: %w", err)
+		}
+		if seen[strings.ToLower(issuer)] {
+			return fmt.Errorf("the extra issuer %s is a duplicate", x)
+		}
+		seen[strings.ToLower(issuer)] = true
+		r.ExtraIssuers[i] = issuer
+	}
+
+	return nil
+}
+
+// keycloakRealm returns the realm of a keycloak path, e.g. /realms/myrealm/account, if any
+func keycloakRealm(path string) string {
+	i := strings.Index(path, "/realms/")
+	if i < 0 {
+		return ""
+	}
+	realm := path[i+len("/realms/"):]
+	if j := strings.IndexAny(realm, "/?#"); j >= 0 {
+		realm = realm[:j]
+	}
+
+	return realm
+}
+
+// isProviderConfigValid checks the discovery document matches the discovery url and that the endpoints of
+// the provider are absolute https urls, unless plain http is permitted
+func (r *Config) isProviderConfigValid(config oidc.ProviderConfig) error {
+	if config.Issuer == nil {
+		return fmt.Errorf("the discovery document of %s does not specify the issuer", r.DiscoveryURL)
+	}
+	issuer := strings.TrimRight(config.Issuer.String(), "/")
+	if !strings.EqualFold(issuer, strings.TrimRight(r.DiscoveryURL, "/")) {
+		return fmt.Errorf("the issuer %s of the discovery document does not match the discovery url %s", issuer, r.DiscoveryURL)
+	}
+
+	endpoints := []struct {
+		name     string
+		endpoint *url.URL
+	}{
+		{name: "authorization", endpoint: config.AuthEndpoint},
+		{name: "token", endpoint: config.TokenEndpoint},
+		{name: "userinfo", endpoint: config.UserInfoEndpoint},
+		{name: "end session", endpoint: config.EndSessionEndpoint},
+	}
+	for _, x := range endpoints {
+		if x.endpoint == nil {
+			continue
+		}
+		if err := r.isProviderEndpointValid(x.name, x.endpoint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isProviderEndpointValid checks an endpoint of the provider is an absolute https url, unless plain http is permitted
+func (r *Config) isProviderEndpointValid(name string, endpoint *url.URL) error {
+	if !endpoint.IsAbs() || endpoint.Host == "" {
+		return fmt.Errorf("the %s endpoint %s of the provider is not an absolute url", name, endpoint)
+	}
+	if endpoint.Scheme != secureScheme && !r.AllowInsecureProviderEndpoints && !isLoopbackHost(endpoint.Hostname()) {
+		return fmt.Errorf("the %s endpoint %s of the provider is not a https url, see --allow-insecure-provider-endpoints", name, endpoint)
+	}
+
+	return nil
+}
+
+// isLoopbackHost checks if the host is local, for local development against the provider
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// fetchDiscoveryDocument decodes the discovery document of the provider, for the entries which are not kept by the
+// openid client
+func fetchDiscoveryDocument(hc *http.Client, discoveryURL string, document interface{}) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, discoveryURL+discoveryPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the discovery endpoint responded %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(document)
+}
+
+// fetchCodeChallengeMethods returns the methods of proof key for code exchange advertised by the discovery document
+// of the provider
+func fetchCodeChallengeMethods(hc *http.Client, discoveryURL string) ([]string, error) {
+	var document struct {
+		CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+	}
+	if err := fetchDiscoveryDocument(hc, discoveryURL, &document); err != nil {
+		return nil, err
+	}
+
+	return document.CodeChallengeMethodsSupported, nil
+}
+
+// fetchDeviceAuthorizationEndpoint returns the device authorization endpoint advertised by the discovery document of
+// the provider, which starts the device authorization grant
+func (r *Config) fetchDeviceAuthorizationEndpoint(hc *http.Client) (string, error) {
+	var document struct {
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	}
+	if err := fetchDiscoveryDocument(hc, r.DiscoveryURL, &document); err != nil {
+		return "", err
+	}
+	if document.DeviceAuthorizationEndpoint == "" {
+		return "", fmt.Errorf("the discovery document of %s does not specify the device authorization endpoint", r.DiscoveryURL)
+	}
+	endpoint, err := url.Parse(document.DeviceAuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("the device authorization endpoint of the provider is not a valid url: %w", err)
+	}
+	if err := r.isProviderEndpointValid("device authorization", endpoint); err != nil {
+		return "", err
+	}
+
+	return endpoint.String(), nil
+}
+
+// discoverExtraIssuers retrieves the discovery document of each extra issuer, and the signing keys it announces
+func (r *oauthProxy) discoverExtraIssuers(ctx context.Context, hc *http.Client) error {
+	r.extraIssuers = make(map[string]*jwksCache, len(r.config.ExtraIssuers))
+	for _, issuer := range r.config.ExtraIssuers {
+		var config oidc.ProviderConfig
+		err := r.retry(ctx, discoveryBackoff, func(context.Context) error {
+			var erf error
+			config, erf = oidc.FetchProviderConfig(hc, issuer)
+
+			return erf
+		})
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the provider configuration of the extra issuer %s: %w", issuer, err)
+		}
+		if config.Issuer == nil || !strings.EqualFold(strings.TrimRight(config.Issuer.String(), "/"), issuer) {
+			return fmt.Errorf("the discovery document of the extra issuer %s does not match its url", issuer)
+		}
+		if config.KeysEndpoint == nil {
+			return fmt.Errorf("the discovery document of the extra issuer %s does not specify the keys endpoint", issuer)
+		}
+
+		cache := newJWKSCache(hc, config, r.config.JWKSMinRefreshInterval, r.log)
+		_ = cache.refresh(ctx, jwksRefreshStartup)
+		if r.config.JWKSRefreshInterval > 0 {
+			go cache.refreshPeriodically(context.Background(), r.config.JWKSRefreshInterval)
+		}
+		r.extraIssuers[issuer] = cache
+		r.log.Info("accepting the tokens of an extra issuer", zap.String("issuer", cache.issuer))
+	}
+
+	return nil
+}
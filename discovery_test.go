@@ -0,0 +1,196 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeDiscoveryURL(t *testing.T) {
+	cs := []struct {
+		URL      string
+		Expected string
+		Error    string
+	}{
+		{URL: "https://keycloak/realms/myrealm", Expected: "https://keycloak/realms/myrealm"},
+		{URL: "https://keycloak/realms/myrealm/", Expected: "https://keycloak/realms/myrealm"},
+		{URL: "https://keycloak/realms/myrealm/.well-known/openid-configuration", Expected: "https://keycloak/realms/myrealm"},
+		{URL: "https://keycloak/auth/realms/myrealm//", Expected: "https://keycloak/auth/realms/myrealm"},
+		{URL: "https://keycloak/auth/realms/myrealm/.well-known/openid-configuration/", Expected: "https://keycloak/auth/realms/myrealm"},
+		{URL: "https://accounts.example.com", Expected: "https://accounts.example.com"},
+		{URL: "wrong", Error: "discovery url is not a valid URL"},
+		{URL: "ftp://keycloak/realms/myrealm", Error: "discovery url is not a valid URL"},
+		{
+			URL:   "https://keycloak/auth/admin/master/console/#/realms/myrealm",
+			Error: "looks like the admin console url, expected https://keycloak/auth/realms/myrealm",
+		},
+		{
+			URL:   "https://keycloak/admin/master/console/",
+			Error: "looks like the admin console url, expected https://keycloak/realms/<realm>",
+		},
+		{
+			URL:   "https://keycloak/admin/realms/myrealm/users",
+			Error: "looks like the admin console url, expected https://keycloak/realms/myrealm",
+		},
+		{
+			URL:   "https://keycloak/realms/myrealm/protocol/openid-connect/auth",
+			Error: "looks like a page of the realm, expected https://keycloak/realms/myrealm",
+		},
+		{
+			URL:   "https://keycloak/auth/realms/myrealm/account/",
+			Error: "looks like a page of the realm, expected https://keycloak/auth/realms/myrealm",
+		},
+		{URL: "https://keycloak/realms/myrealm?client_id=test", Error: "cannot have a query or a fragment"},
+	}
+	for _, c := range cs {
+		normalized, err := normalizeDiscoveryURL(c.URL)
+		if c.Error != "" {
+			if assert.Error(t, err, "url: %s", c.URL) {
+				assert.Contains(t, err.Error(), c.Error, "url: %s", c.URL)
+			}
+			continue
+		}
+		if assert.NoError(t, err, "url: %s", c.URL) {
+			assert.Equal(t, c.Expected, normalized, "url: %s", c.URL)
+		}
+	}
+}
+
+func TestIsProviderConfigValid(t *testing.T) {
+	parse := func(location string) *url.URL {
+		u, err := url.Parse(location)
+		require.NoError(t, err)
+		return u
+	}
+	provider := func(issuer, endpoints string) oidc.ProviderConfig {
+		return oidc.ProviderConfig{
+			Issuer:             parse(issuer),
+			AuthEndpoint:       parse(endpoints + "/protocol/openid-connect/auth"),
+			TokenEndpoint:      parse(endpoints + "/protocol/openid-connect/token"),
+			UserInfoEndpoint:   parse(endpoints + "/protocol/openid-connect/userinfo"),
+			EndSessionEndpoint: parse(endpoints + "/protocol/openid-connect/logout"),
+		}
+	}
+
+	cs := []struct {
+		Config   *Config
+		Provider oidc.ProviderConfig
+		Error    string
+	}{
+		{
+			Config:   &Config{DiscoveryURL: "https://keycloak/realms/test"},
+			Provider: provider("https://keycloak/realms/test/", "https://keycloak/realms/test"),
+		},
+		{
+			Config:   &Config{DiscoveryURL: "https://keycloak/realms/test"},
+			Provider: provider("https://keycloak/realms/other", "https://keycloak/realms/other"),
+			Error:    "the issuer https://keycloak/realms/other of the discovery document does not match the discovery url",
+		},
+		{
+			Config:   &Config{DiscoveryURL: "https://keycloak/realms/test"},
+			Provider: oidc.ProviderConfig{},
+			Error:    "does not specify the issuer",
+		},
+		{
+			Config:   &Config{DiscoveryURL: "http://keycloak/realms/test"},
+			Provider: provider("http://keycloak/realms/test", "http://keycloak/realms/test"),
+			Error:    "the authorization endpoint http://keycloak/realms/test/protocol/openid-connect/auth of the provider is not a https url",
+		},
+		{
+			Config:   &Config{DiscoveryURL: "http://keycloak/realms/test", AllowInsecureProviderEndpoints: true},
+			Provider: provider("http://keycloak/realms/test", "http://keycloak/realms/test"),
+		},
+		{
+			Config:   &Config{DiscoveryURL: "http://127.0.0.1:8080/realms/test"},
+			Provider: provider("http://127.0.0.1:8080/realms/test", "http://127.0.0.1:8080/realms/test"),
+		},
+		{
+			Config:   &Config{DiscoveryURL: "https://keycloak/realms/test"},
+			Provider: provider("https://keycloak/realms/test", "/realms/test"),
+			Error:    "the authorization endpoint /realms/test/protocol/openid-connect/auth of the provider is not an absolute url",
+		},
+	}
+	for i, c := range cs {
+		err := c.Config.isProviderConfigValid(c.Provider)
+		if c.Error == "" {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		if assert.Error(t, err, "case %d", i) {
+			assert.Contains(t, err.Error(), c.Error, "case %d", i)
+		}
+	}
+}
+
+func TestIsExtraIssuersValid(t *testing.T) {
+	cs := []struct {
+		Issuers []string
+		Error   string
+	}{
+		{Issuers: []string{"https://old-sso.example.com/auth/realms/x/", "https://sso.example.com/realms/y"}},
+		{Issuers: []string{"old-sso.example.com/auth/realms/x"}, Error: "invalid extra issuer"},
+		{Issuers: []string{"https://old-sso.example.com/auth/realms/x", "https://old-sso.example.com/auth/realms/x/"}, Error: "is a duplicate"},
+		{Issuers: []string{"https://SSO.example.com/realms/x"}, Error: "is a duplicate"},
+	}
+	for i, c := range cs {
+		cfg := &Config{DiscoveryURL: "https://sso.example.com/realms/x", ExtraIssuers: c.Issuers}
+		err := cfg.isExtraIssuersValid()
+		if c.Error == "" {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		if assert.Error(t, err, "case %d", i) {
+			assert.Contains(t, err.Error(), c.Error, "case %d", i)
+		}
+	}
+
+	cfg := &Config{DiscoveryURL: "https://sso.example.com/realms/x", ExtraIssuers: []string{"https://old-sso.example.com/auth/realms/x/"}}
+	require.NoError(t, cfg.isExtraIssuersValid())
+	assert.Equal(t, []string{"https://old-sso.example.com/auth/realms/x"}, cfg.ExtraIssuers)
+}
+
+func TestPKCEDiscovery(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	assert.False(t, p.proxy.pkce)
+
+	// the proof key is used as soon as the provider advertises it
+	p.idp.pkce = true
+	_, _, _, err := p.proxy.newOpenIDClient()
+	require.NoError(t, err)
+	assert.True(t, p.proxy.pkce)
+
+	methods, err := fetchCodeChallengeMethods(http.DefaultClient, p.idp.getLocation())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plain", "S256"}, methods)
+
+	// the code verifier cannot be protected without an encryption key
+	p.proxy.config.EncryptionKey = ""
+	_, _, _, err = p.proxy.newOpenIDClient()
+	require.NoError(t, err)
+	assert.False(t, p.proxy.pkce)
+}
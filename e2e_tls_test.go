@@ -552,7 +552,9 @@ func TestTLSUpstream(t *testing.T) {
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 	buf, err = io.ReadAll(resp.Body)
 	require.NoError(t, err)
-	require.JSONEq(t, `{"status":"OK"}`, string(buf))
+	var health healthResponse
+	require.NoError(t, json.Unmarshal(buf, &health))
+	require.Equal(t, "OK", health.Status)
 
 	// check out zpages
 	u, _ = url.Parse("https://" + e2eTLSAdminEndpointListener + "/oauth/trace/rpcz")
@@ -1,12 +1,9 @@
 package main
 
 import (
-	"context"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
-	"path"
-	"strings"
 
 	"go.uber.org/zap"
 )
@@ -30,6 +27,24 @@ var (
 	ErrEncode = errors.New("failed to encode token")
 	// ErrEncryption indicates a failure to encrypt the token
 	ErrEncryption = errors.New("failed to encrypt token")
+	// ErrTokenTooLarge indicates the token exceeds the configured maximum size
+	ErrTokenTooLarge = errors.New("the token exceeds the maximum size")
+	// ErrTooManyCookieChunks indicates the session cookie is split in more chunks than allowed
+	ErrTooManyCookieChunks = errors.New("the session cookie exceeds the maximum number of chunks")
+	// ErrSessionIdle indicates the session has been idle for longer than the idle timeout
+	ErrSessionIdle = errors.New("the session has been idle for too long")
+	// ErrNoCodeVerifier indicates the code verifier of the authorization is missing, has expired or belongs to another authorization
+	ErrNoCodeVerifier = errors.New("no code verifier found for the authorization")
+	// ErrNonceMismatch indicates the nonce of the id token is not the nonce of the authorization
+	ErrNonceMismatch = errors.New("the nonce of the id token does not match the authorization")
+	// ErrNoTrustedIdentity indicates the request does not carry the identity set by the trusted authenticator
+	ErrNoTrustedIdentity = errors.New("no identity from the trusted authenticator found in request")
+	// ErrUntrustedSigner indicates the identity is not signed by a trusted load balancer
+	ErrUntrustedSigner = errors.New("the identity is not signed by a trusted load balancer")
+	// ErrInvalidGrant indicates the provider refused the grant, e.g. the credentials or the refresh token are invalid
+	ErrInvalidGrant = errors.New("the grant is invalid")
+	// ErrRefreshSubjectChanged indicates the refreshed token is issued to another subject than the session
+	ErrRefreshSubjectChanged = errors.New("the refreshed token is issued to another subject")
 )
 
 func methodNotAllowedHandler(w http.ResponseWriter, req *http.Request) {
@@ -75,38 +90,6 @@ func errorResponse(w http.ResponseWriter, msg string, code int) {
 	noSniff(w)
 	w.WriteHeader(code)
 	if len(msg) > 0 {
-		fmt.Fprintf(w, `{"error": %q}`, msg)
+		_ = json.NewEncoder(w).Encode(errorMessage{Error: msg})
 	}
 }
-
-// accessForbidden redirects the user to the forbidden page
-func (r *oauthProxy) accessForbidden(w http.ResponseWriter, req *http.Request, msgs ...string) context.Context {
-	_, logger := r.traceSpanRequest(req)
-
-	// are we using a custom http template for 403?
-	if r.config.hasCustomForbiddenPage() {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		noSniff(w)
-		w.WriteHeader(http.StatusForbidden)
-		name := path.Base(r.config.ForbiddenPage)
-		if err := r.Render(w, name, r.config.Tags); err != nil {
-			logger.Error("failed to render the template", zap.Error(err), zap.String("template", name))
-		}
-	} else {
-		var msg string
-		if len(msgs) > 0 {
-			r.log.Warn("user forbidden access", zap.Strings("extra_messages", msgs))
-
-			switch len(msgs) {
-			case 1:
-				msg = msgs[0]
-			default: // > 1
-				msg = strings.Join(msgs[:2], " ")
-			}
-		}
-		// extraMsg goes to log but only the 2 first ones are to be returned as end user error
-		r.errorResponse(w, req, msg, http.StatusForbidden, nil)
-	}
-
-	return r.revokeProxy(w, req)
-}
@@ -0,0 +1,133 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/interpreter"
+)
+
+// The expressions of the resources are common expression language (CEL) programs, type checked when compiled against
+// the variables declared below. The variables are qualified names, so that a reference to an undeclared field, e.g.
+// user.role, is refused when the expression is compiled rather than failing every evaluation.
+
+// expressionCostLimit bounds the cost of an evaluation, e.g. of the macros over large claims
+const expressionCostLimit = 100000
+
+var (
+	expressionEnvOnce sync.Once
+	expressionEnv     *cel.Env
+	expressionEnvErr  error
+)
+
+// expressionEnvironment returns the environment declaring the variables of the expressions
+func expressionEnvironment() (*cel.Env, error) {
+	expressionEnvOnce.Do(func() {
+		expressionEnv, expressionEnvErr = cel.NewEnv(
+			cel.Variable("request.method", cel.StringType),
+			cel.Variable("request.path", cel.StringType),
+			cel.Variable("request.headers", cel.MapType(cel.StringType, cel.StringType)),
+			cel.Variable("user.email", cel.StringType),
+			cel.Variable("user.roles", cel.ListType(cel.StringType)),
+			cel.Variable("user.groups", cel.ListType(cel.StringType)),
+			cel.Variable("user.claims", cel.MapType(cel.StringType, cel.DynType)),
+			// the numbers of the claims are doubles, which are compared with the int literals
+			cel.CrossTypeNumericComparisons(true),
+		)
+	})
+
+	return expressionEnv, expressionEnvErr
+}
+
+// accessExpression is the compiled expression of a resource, deciding on the access of the users
+type accessExpression struct {
+	source  string
+	program cel.Program
+}
+
+// compileAccessExpression parses and type checks an expression, which must evaluate to a bool
+func compileAccessExpression(source string) (*accessExpression, error) {
+	env, err := expressionEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if t := ast.OutputType(); !t.IsAssignableType(cel.BoolType) {
+		return nil, fmt.Errorf("the expression must evaluate to a bool, not a %s", t)
+	}
+	// the constant regular expressions are compiled, and their errors reported, with the program
+	program, err := env.Program(ast,
+		cel.OptimizeRegex(interpreter.MatchesRegexOptimization),
+		cel.CostLimit(expressionCostLimit))
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessExpression{source: source, program: program}, nil
+}
+
+// evaluate evaluates the expression against the variables of a request
+func (e *accessExpression) evaluate(vars map[string]interface{}) (bool, error) {
+	value, _, err := e.program.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.Value().(bool)
+	if !ok {
+		return false, errors.New("the expression did not evaluate to a bool")
+	}
+
+	return result, nil
+}
+
+// expressionVariablesOf returns the variables of the expressions for a request of a user: the names of the headers are
+// in lower case, and their values joined by commas
+func expressionVariablesOf(req *http.Request, user *userContext) map[string]interface{} {
+	headers := make(map[string]string, len(req.Header))
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	roles, groups := user.roles, user.groups
+	if roles == nil {
+		roles = []string{}
+	}
+	if groups == nil {
+		groups = []string{}
+	}
+	claims := map[string]interface{}(user.claims)
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+
+	return map[string]interface{}{
+		"request.method":  req.Method,
+		"request.path":    req.URL.Path,
+		"request.headers": headers,
+		"user.email":      user.email,
+		"user.roles":      roles,
+		"user.groups":     groups,
+		"user.claims":     claims,
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newExpressionVariables returns the variables of a GET request to /finance/reports of a finance user
+func newExpressionVariables(method string) map[string]interface{} {
+	req := httptest.NewRequest(method, "/finance/reports?year=2023", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Accept", "text/plain")
+	user := &userContext{
+		email:  "gambol99@gmail.com",
+		roles:  []string{"reader", "api:auditor"},
+		groups: []string{"/finance/emea", "/staff"},
+		claims: jose.Claims{
+			"department": "finance",
+			"level":      float64(3),
+			"scopes":     []interface{}{"reports", "ledger"},
+			"address":    map[string]interface{}{"country": "FR"},
+		},
+	}
+
+	return expressionVariablesOf(req, user)
+}
+
+// TestExpressionEvaluation evaluates representative expressions, as a check of the expressions of a configuration
+func TestExpressionEvaluation(t *testing.T) {
+	cs := []struct {
+		Expression string
+		Method     string
+		Expected   bool
+		Error      bool
+	}{
+		{Expression: "'admin' in user.roles || (user.claims.department == 'finance' && request.method == 'GET')", Expected: true},
+		{Expression: "'admin' in user.roles || (user.claims.department == 'finance' && request.method == 'GET')", Method: http.MethodPost},
+		{Expression: "'reader' in user.roles && !('writer' in user.roles)", Expected: true},
+		{Expression: "request.path.startsWith('/finance/') && user.email.endsWith('@gmail.com')", Expected: true},
+		{Expression: "request.headers['x-tenant'] == 'acme'", Expected: true},
+		{Expression: "request.headers['accept'].contains('text/plain')", Expected: true},
+		{Expression: "user.groups.exists(g, g.startsWith('/finance/'))", Expected: true},
+		{Expression: "user.roles.all(r, r.matches('^[a-z:]+$'))", Expected: true},
+		{Expression: "user.claims.level >= 3 && user.claims.level < 3.5", Expected: true},
+		{Expression: "user.claims.level == 3", Expected: true},
+		{Expression: "'ledger' in user.claims.scopes && size(user.claims.scopes) == 2", Expected: true},
+		{Expression: "user.claims.address.country in ['FR', 'DE']", Expected: true},
+		{Expression: "has(user.claims.department) && !has(user.claims.manager)", Expected: true},
+		{Expression: "'x-tenant' in request.headers", Expected: true},
+		{Expression: "request.method == 'GET' ? user.claims.level > 1 : user.claims.level > 5", Expected: true},
+		{Expression: "user.roles.size() + 1 == 3 && user.claims.level * 2.0 == 6.0", Expected: true},
+		{Expression: "user.claims.scopes[0] == 'reports'", Expected: true},
+		{Expression: "user.claims.department + '/' + 'emea' == 'finance/emea'", Expected: true},
+		// the errors are absorbed by the logical operators when the other operand decides
+		{Expression: "user.claims.manager == 'bob' || 'reader' in user.roles", Expected: true},
+		{Expression: "user.claims.manager == 'bob' && 'writer' in user.roles"},
+		// the evaluation errors deny the access
+		{Expression: "user.claims.manager == 'bob'", Error: true},
+		{Expression: "user.claims.department > 1", Error: true},
+		{Expression: "user.claims.scopes[2] == 'admin'", Error: true},
+		{Expression: "user.claims.scopes[1e300] == 'admin'", Error: true},
+		{Expression: "user.claims.scopes[0.5] == 'admin'", Error: true},
+		{Expression: "user.claims.level * 9223372036854775807 > 0", Error: true},
+		{Expression: "9223372036854775807 + int(user.claims.level) > 0", Error: true},
+		{Expression: "user.claims.level / 0 == 1", Error: true},
+		{Expression: "user.claims.department", Error: true},
+		{Expression: "request.headers['x-tenant'].matches(user.claims.department + '[')", Error: true},
+	}
+	for i, c := range cs {
+		expression, err := compileAccessExpression(c.Expression)
+		require.NoError(t, err, "case %d: %s", i, c.Expression)
+		method := c.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		allowed, err := expression.evaluate(newExpressionVariables(method))
+		if c.Error {
+			assert.Error(t, err, "case %d: %s", i, c.Expression)
+			assert.False(t, allowed, "case %d: %s", i, c.Expression)
+			continue
+		}
+		assert.NoError(t, err, "case %d: %s", i, c.Expression)
+		assert.Equal(t, c.Expected, allowed, "case %d: %s", i, c.Expression)
+	}
+}
+
+func TestExpressionCompilationErrors(t *testing.T) {
+	cs := []struct {
+		Expression string
+		Error      string
+	}{
+		{Expression: "'admin' in roles", Error: "undeclared reference to 'roles'"},
+		{Expression: "user.role == 'admin'", Error: "undeclared reference to 'user'"},
+		{Expression: "request.method", Error: "the expression must evaluate to a bool, not a string"},
+		{Expression: "user.email > 1", Error: "found no matching overload for '_>_' applied to '(string, int)'"},
+		{Expression: "'admin' in user.email", Error: "found no matching overload for '@in' applied to '(string, string)'"},
+		{Expression: "user.roles.startsWith('a')", Error: "found no matching overload for 'startsWith' applied to 'list(string).(string)'"},
+		{Expression: "request.path.matches('[')", Error: "missing closing ]"},
+		{Expression: "user.groups.exists('g', true)", Error: "argument must be a simple name"},
+		{Expression: "user.groups.exists(g, g)", Error: "found no matching overload for '_||_'"},
+		{Expression: "lower(user.email) == 'a'", Error: "undeclared reference to 'lower'"},
+		{Expression: "has(user)", Error: "invalid argument to has() macro"},
+		{Expression: "user.email == 'a", Error: "Syntax error"},
+		{Expression: "user.email = 'a'", Error: "Syntax error"},
+		{Expression: "(user.email == 'a'", Error: "Syntax error"},
+		{Expression: "user.email == 'a')", Error: "Syntax error"},
+		{Expression: "!request.method", Error: "found no matching overload for '!_' applied to '(string)'"},
+		{Expression: "", Error: "Syntax error"},
+	}
+	for i, c := range cs {
+		_, err := compileAccessExpression(c.Expression)
+		if assert.Error(t, err, "case %d: %s", i, c.Expression) {
+			assert.Contains(t, err.Error(), c.Error, "case %d: %s", i, c.Expression)
+		}
+	}
+}
+
+func TestExpressionVariables(t *testing.T) {
+	vars := newExpressionVariables(http.MethodGet)
+	assert.Equal(t, http.MethodGet, vars["request.method"])
+	assert.Equal(t, "/finance/reports", vars["request.path"])
+	assert.Equal(t, map[string]string{"x-tenant": "acme", "accept": "application/json, text/plain"}, vars["request.headers"])
+	assert.Equal(t, []string{"reader", "api:auditor"}, vars["user.roles"])
+	assert.Equal(t, []string{"/finance/emea", "/staff"}, vars["user.groups"])
+	assert.Equal(t, float64(3), vars["user.claims"].(map[string]interface{})["level"])
+
+	// the users without roles, groups or claims have empty ones
+	empty := expressionVariablesOf(httptest.NewRequest(http.MethodGet, "/", nil), &userContext{})
+	assert.Equal(t, []string{}, empty["user.roles"])
+	assert.Equal(t, map[string]interface{}{}, empty["user.claims"])
+}
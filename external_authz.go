@@ -0,0 +1,308 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// externalAuthzSweepSize is the size of the cache above which the expired decisions are swept
+	externalAuthzSweepSize = 1024
+	// externalAuthzMaxResponseSize bounds the responses of the webhook
+	externalAuthzMaxResponseSize = 1 << 20
+)
+
+// externalAuthzCredentialHeaders are the parts of the header names carrying credentials, which are never sent to the
+// webhook: the identity of the user is sent instead
+var externalAuthzCredentialHeaders = []string{"authorization", "cookie", "token", "secret", "password", "api-key", "apikey", "session", "csrf"}
+
+// externalAuthzQuery is the document posted to the webhook, as the input of an open policy agent query
+type externalAuthzQuery struct {
+	Input externalAuthzInput `json:"input"`
+}
+
+type externalAuthzInput struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	User    externalAuthzUser `json:"user"`
+}
+
+type externalAuthzUser struct {
+	ID     string                 `json:"id"`
+	Email  string                 `json:"email,omitempty"`
+	Roles  []string               `json:"roles"`
+	Groups []string               `json:"groups"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// externalAuthzDecision is the decision of the webhook, with the headers to add to the request proxied upstream
+type externalAuthzDecision struct {
+	Allow   bool              `json:"allow"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type cachedExternalAuthzDecision struct {
+	decision externalAuthzDecision
+	expires  time.Time
+}
+
+// externalAuthorizer asks an external webhook, e.g. an open policy agent, to decide on the requests, and caches the
+// decisions per (subject, method, path)
+type externalAuthorizer struct {
+	endpoint string
+	client   *http.Client
+
+	sync.RWMutex
+	decisions map[string]cachedExternalAuthzDecision
+}
+
+// isExternalAuthzValid validates the configuration of the external authorization
+func (r *Config) isExternalAuthzValid() error {
+	if r.ExternalAuthzURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(r.ExternalAuthzURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("the external-authz-url %q is not a valid http(s) url", r.ExternalAuthzURL)
+	}
+	if r.ExternalAuthzTimeout <= 0 {
+		return errors.New("the external-authz-timeout must be positive")
+	}
+	if r.ExternalAuthzCacheTTL < 0 {
+		return errors.New("the external-authz-cache-ttl cannot be negative")
+	}
+	if r.ExternalAuthzFailureMode != externalAuthzFailureAllow && r.ExternalAuthzFailureMode != externalAuthzFailureDeny {
+		return fmt.Errorf("the external-authz-failure-mode must be one of %s|%s", externalAuthzFailureAllow, externalAuthzFailureDeny)
+	}
+	if r.SkipTokenVerification {
+		return errors.New("the external authorization cannot be used when the token verification is skipped")
+	}
+
+	return nil
+}
+
+func newExternalAuthorizer(config *Config) *externalAuthorizer {
+	return &externalAuthorizer{
+		endpoint:  config.ExternalAuthzURL,
+		client:    &http.Client{Timeout: config.ExternalAuthzTimeout},
+		decisions: make(map[string]cachedExternalAuthzDecision),
+	}
+}
+
+func (c *externalAuthorizer) cached(key string, now time.Time) (externalAuthzDecision, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	x, found := c.decisions[key]
+	if !found || !now.Before(x.expires) {
+		return externalAuthzDecision{}, false
+	}
+
+	return x.decision, true
+}
+
+func (c *externalAuthorizer) cache(key string, decision externalAuthzDecision, now, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.decisions) >= externalAuthzSweepSize {
+		for k, x := range c.decisions {
+			if !now.Before(x.expires) {
+				delete(c.decisions, k)
+			}
+		}
+	}
+	c.decisions[key] = cachedExternalAuthzDecision{decision: decision, expires: expires}
+}
+
+// ask posts the query to the webhook and returns its decision
+func (c *externalAuthorizer) ask(ctx context.Context, query *externalAuthzQuery) (externalAuthzDecision, error) {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return externalAuthzDecision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return externalAuthzDecision{}, err
+	}
+	req.Header.Set("Content-Type", jsonMime)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return externalAuthzDecision{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, externalAuthzMaxResponseSize))
+	if err != nil {
+		return externalAuthzDecision{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return externalAuthzDecision{}, fmt.Errorf("the external authorization responded %d: %s", resp.StatusCode, content)
+	}
+	var response struct {
+		Result *externalAuthzDecision `json:"result"`
+	}
+	if err := json.Unmarshal(content, &response); err != nil {
+		return externalAuthzDecision{}, fmt.Errorf("invalid decision of the external authorization: %w", err)
+	}
+	// an open policy agent responds without result when the policy is undefined
+	if response.Result == nil {
+		return externalAuthzDecision{}, errors.New("the external authorization responded without result")
+	}
+
+	return *response.Result, nil
+}
+
+// isExternalAuthzCredentialHeader tells if the header is named after a credential
+func isExternalAuthzCredentialHeader(name string) bool {
+	lower := strings.ToLower(name)
+	for _, x := range externalAuthzCredentialHeaders {
+		if strings.Contains(lower, x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// externalAuthzQueryOf returns the query about a request of a user, without the credentials of the request
+func (r *oauthProxy) externalAuthzQueryOf(req *http.Request, user *userContext) *externalAuthzQuery {
+	headers := make(map[string]string, len(req.Header))
+	for name, values := range req.Header {
+		if !isExternalAuthzCredentialHeader(name) {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+	var claims map[string]interface{}
+	for _, name := range r.config.ExternalAuthzClaims {
+		if value, found := user.claims[name]; found {
+			if claims == nil {
+				claims = make(map[string]interface{}, len(r.config.ExternalAuthzClaims))
+			}
+			claims[name] = value
+		}
+	}
+
+	return &externalAuthzQuery{Input: externalAuthzInput{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Headers: headers,
+		User: externalAuthzUser{
+			ID:     user.id,
+			Email:  user.email,
+			Roles:  user.roles,
+			Groups: user.groups,
+			Claims: claims,
+		},
+	}}
+}
+
+// externalAuthzMiddleware asks the external authorization to decide on the admitted requests, refusing the denied
+// ones and adding the headers of the permitted ones to the request proxied upstream
+func (r *oauthProxy) externalAuthzMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, span, logger := r.traceSpan(req.Context(), "external authorization middleware")
+			if span != nil {
+				defer span.End()
+			}
+
+			scope, ok := ctx.Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			if scope.AccessDenied {
+				next.ServeHTTP(w, req)
+				return
+			}
+			user := scope.Identity
+
+			key := user.id + "|" + req.Method + "|" + req.URL.Path
+			now := r.now()
+			decision, found := r.externalAuthz.cached(key, now)
+			if !found {
+				start := time.Now()
+				var err error
+				decision, err = r.externalAuthz.ask(ctx, r.externalAuthzQueryOf(req, user))
+				// @metric observe the time taken by the external authorization
+				oauthLatencyMetric.WithLabelValues("external-authz").Observe(time.Since(start).Seconds())
+				if err != nil {
+					if r.config.ExternalAuthzFailureMode != externalAuthzFailureAllow {
+						logger.Warn("access denied, unable to check the request with the external authorization",
+							zap.String("access", "denied"),
+							zap.String("email", user.email),
+							zap.String("resource", resource.route()),
+							zap.Error(err))
+
+						next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+						return
+					}
+					// the decisions taken on failures are not cached
+					logger.Warn("unable to check the request with the external authorization, access permitted (external-authz-failure-mode)",
+						zap.String("email", user.email),
+						zap.String("resource", resource.route()),
+						zap.Error(err))
+
+					next.ServeHTTP(w, req.WithContext(ctx))
+					return
+				}
+				if r.config.ExternalAuthzCacheTTL > 0 {
+					expires := now.Add(r.config.ExternalAuthzCacheTTL)
+					if user.expiresAt.Before(expires) {
+						expires = user.expiresAt
+					}
+					r.externalAuthz.cache(key, decision, now, expires)
+				}
+			}
+
+			if !decision.Allow {
+				logger.Warn("access denied, refused by the external authorization",
+					zap.String("access", "denied"),
+					zap.String("email", user.email),
+					zap.String("resource", resource.route()),
+					zap.String("method", req.Method),
+					zap.String("path", req.URL.Path))
+
+				next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+				return
+			}
+			for name, value := range decision.Headers {
+				req.Header.Set(name, value)
+			}
+
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,246 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeExternalAuthz is an open policy agent permitting the requests to /orders/* of the users with the role orders
+type fakeExternalAuthz struct {
+	*httptest.Server
+	queries     int32
+	unavailable bool
+
+	sync.Mutex
+	last externalAuthzInput
+}
+
+func newFakeExternalAuthz() *fakeExternalAuthz {
+	f := &fakeExternalAuthz{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&f.queries, 1)
+		if f.unavailable {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var query externalAuthzQuery
+		if err := json.NewDecoder(req.Body).Decode(&query); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.Lock()
+		f.last = query.Input
+		f.Unlock()
+
+		decision := externalAuthzDecision{
+			Allow: strings.HasPrefix(query.Input.Path, "/orders/") && containsString("orders", query.Input.User.Roles),
+		}
+		if decision.Allow {
+			decision.Headers = map[string]string{"X-Orders-Tier": "gold"}
+		}
+		w.Header().Set("Content-Type", jsonMime)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": decision})
+	}))
+
+	return f
+}
+
+func newExternalAuthzConfig(endpoint string) *Config {
+	c := newFakeKeycloakConfig()
+	c.ExternalAuthzURL = endpoint
+	c.ExternalAuthzCacheTTL = time.Minute
+	c.ExternalAuthzClaims = []string{"tenant"}
+	c.Resources = []*Resource{
+		{
+			URL:     "/orders/*",
+			Methods: allHTTPMethods,
+		},
+		{
+			URL:         "/public/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+		},
+	}
+
+	return c
+}
+
+func TestExternalAuthzMiddleware(t *testing.T) {
+	authz := newFakeExternalAuthz()
+	defer authz.Close()
+
+	newFakeProxy(newExternalAuthzConfig(authz.URL)).RunTests(t, []fakeRequest{
+		{
+			URI:                  "/orders/1",
+			HasToken:             true,
+			Roles:                []string{"orders"},
+			TokenClaims:          map[string]interface{}{"tenant": "acme"},
+			Headers:              map[string]string{"X-Request-Origin": "web"},
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"X-Orders-Tier": "gold"},
+		},
+		{
+			// the decision is cached per subject, method and path
+			URI:                  "/orders/1",
+			HasToken:             true,
+			Roles:                []string{"orders"},
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"X-Orders-Tier": "gold"},
+		},
+		{
+			URI:          "/orders/2",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// the white-listed resources are not checked
+			URI:           "/public/1",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/orders/1",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&authz.queries))
+
+	authz.Lock()
+	defer authz.Unlock()
+	assert.Equal(t, http.MethodGet, authz.last.Method)
+	assert.Equal(t, "/orders/2", authz.last.Path)
+	assert.NotEmpty(t, authz.last.User.ID)
+	for name := range authz.last.Headers {
+		assert.False(t, isExternalAuthzCredentialHeader(name), "the %s header is not sent", name)
+	}
+}
+
+func TestExternalAuthzQuery(t *testing.T) {
+	cfg := newExternalAuthzConfig("http://127.0.0.1:8181/v1/data/gatekeeper")
+	p := &oauthProxy{config: cfg}
+	req := httptest.NewRequest(http.MethodPost, "/orders/1?page=2", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "kc-access=secret")
+	req.Header.Set("X-Api-Key", "secret")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Accept", "text/plain")
+	user := &userContext{
+		id:     "subject",
+		email:  "gambol99@gmail.com",
+		roles:  []string{"orders"},
+		groups: []string{"sales"},
+		claims: map[string]interface{}{"tenant": "acme", "private": "value"},
+	}
+
+	query := p.externalAuthzQueryOf(req, user)
+	assert.Equal(t, http.MethodPost, query.Input.Method)
+	assert.Equal(t, "/orders/1", query.Input.Path)
+	assert.Equal(t, map[string]string{"Accept": "application/json, text/plain"}, query.Input.Headers)
+	assert.Equal(t, externalAuthzUser{
+		ID:     "subject",
+		Email:  "gambol99@gmail.com",
+		Roles:  []string{"orders"},
+		Groups: []string{"sales"},
+		Claims: map[string]interface{}{"tenant": "acme"},
+	}, query.Input.User)
+}
+
+func TestExternalAuthzUnavailable(t *testing.T) {
+	authz := newFakeExternalAuthz()
+	defer authz.Close()
+	authz.unavailable = true
+
+	newFakeProxy(newExternalAuthzConfig(authz.URL)).RunTests(t, []fakeRequest{
+		{
+			URI:          "/orders/1",
+			HasToken:     true,
+			Roles:        []string{"orders"},
+			ExpectedCode: http.StatusForbidden,
+		},
+	})
+
+	c := newExternalAuthzConfig(authz.URL)
+	c.ExternalAuthzFailureMode = externalAuthzFailureAllow
+	newFakeProxy(c).RunTests(t, []fakeRequest{
+		{
+			URI:           "/orders/1",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the decisions taken on failures are not cached
+			URI:           "/orders/1",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+	assert.Equal(t, int32(3), atomic.LoadInt32(&authz.queries))
+}
+
+func TestExternalAuthzCache(t *testing.T) {
+	c := newExternalAuthorizer(&Config{ExternalAuthzURL: "http://127.0.0.1:8181", ExternalAuthzTimeout: time.Second})
+	now := time.Now()
+	c.cache("valid", externalAuthzDecision{Allow: true}, now, now.Add(time.Minute))
+	c.cache("expired", externalAuthzDecision{Allow: true}, now, now.Add(-time.Minute))
+
+	decision, found := c.cached("valid", now)
+	require.True(t, found)
+	assert.True(t, decision.Allow)
+	_, found = c.cached("valid", now.Add(time.Minute))
+	assert.False(t, found)
+	_, found = c.cached("expired", now)
+	assert.False(t, found)
+	_, found = c.cached("missing", now)
+	assert.False(t, found)
+}
+
+func TestIsExternalAuthzValid(t *testing.T) {
+	cases := []struct {
+		Config *Config
+		Ok     bool
+	}{
+		{Config: &Config{}, Ok: true},
+		{Config: &Config{ExternalAuthzURL: "http://127.0.0.1:8181/v1/data/gatekeeper", ExternalAuthzTimeout: time.Second, ExternalAuthzFailureMode: "deny"}, Ok: true},
+		{Config: &Config{ExternalAuthzURL: "http://127.0.0.1:8181", ExternalAuthzTimeout: time.Second, ExternalAuthzFailureMode: "allow", ExternalAuthzCacheTTL: time.Second}, Ok: true},
+		{Config: &Config{ExternalAuthzURL: "127.0.0.1:8181", ExternalAuthzTimeout: time.Second, ExternalAuthzFailureMode: "deny"}},
+		{Config: &Config{ExternalAuthzURL: "http://127.0.0.1:8181", ExternalAuthzFailureMode: "deny"}},
+		{Config: &Config{ExternalAuthzURL: "http://127.0.0.1:8181", ExternalAuthzTimeout: time.Second, ExternalAuthzFailureMode: "maybe"}},
+		{Config: &Config{ExternalAuthzURL: "http://127.0.0.1:8181", ExternalAuthzTimeout: time.Second, ExternalAuthzFailureMode: "deny", ExternalAuthzCacheTTL: -time.Second}},
+		{Config: &Config{ExternalAuthzURL: "http://127.0.0.1:8181", ExternalAuthzTimeout: time.Second, ExternalAuthzFailureMode: "deny", SkipTokenVerification: true}},
+	}
+	for i, c := range cases {
+		err := c.Config.isExternalAuthzValid()
+		assert.Equal(t, c.Ok, err == nil, "case %d: %v", i, err)
+	}
+}
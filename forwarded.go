@@ -0,0 +1,282 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Modes to propagate the forwarding headers upstream
+const (
+	forwardedHeadersBoth      = "both"
+	forwardedHeadersForwarded = "forwarded"
+	forwardedHeadersXForward  = "x-forwarded"
+)
+
+// ErrInvalidForwarded is returned when a Forwarded header cannot be parsed
+var ErrInvalidForwarded = errors.New("invalid Forwarded header")
+
+// forwardedElement is a forwarded-element of a RFC 7239 Forwarded header, i.e. what a proxy knows about a hop
+type forwardedElement struct {
+	By    string
+	For   string
+	Host  string
+	Proto string
+}
+
+// parseForwarded parses the values of RFC 7239 Forwarded headers into their elements, ordered from the client to the last proxy.
+//
+// Values are tokens or quoted strings. Unknown parameters are ignored.
+func parseForwarded(values []string) ([]forwardedElement, error) {
+	var elements []forwardedElement
+	for _, value := range values {
+		element := forwardedElement{}
+		empty := true
+		for pos := 0; ; {
+			pos = skipForwardedSpaces(value, pos)
+			if pos >= len(value) {
+				break
+			}
+
+			// parameter name
+			start := pos
+			for pos < len(value) && isForwardedTokenChar(value[pos]) {
+				pos++
+			}
+			if pos == start || pos >= len(value) || value[pos] != '=' {
+				return nil, ErrInvalidForwarded
+			}
+			name := strings.ToLower(value[start:pos])
+			pos++
+
+			// parameter value: token or quoted string
+			var param string
+			if pos < len(value) && value[pos] == '"' {
+				var b strings.Builder
+				pos++
+				for ; pos < len(value) && value[pos] != '"'; pos++ {
+					if value[pos] == '\\' {
+						pos++
+						if pos >= len(value) {
+							return nil, ErrInvalidForwarded
+						}
+					}
+					b.WriteByte(value[pos])
+				}
+				if pos >= len(value) {
+					return nil, ErrInvalidForwarded
+				}
+				pos++
+				param = b.String()
+			} else {
+				start = pos
+				for pos < len(value) && isForwardedTokenChar(value[pos]) {
+					pos++
+				}
+				if pos == start {
+					return nil, ErrInvalidForwarded
+				}
+				param = value[start:pos]
+			}
+
+			switch name {
+			case "by":
+				element.By = param
+			case "for":
+				element.For = param
+			case "host":
+				element.Host = param
+			case "proto":
+				element.Proto = strings.ToLower(param)
+			}
+			empty = false
+
+			pos = skipForwardedSpaces(value, pos)
+			if pos >= len(value) {
+				break
+			}
+			switch value[pos] {
+			case ';':
+			case ',':
+				elements = append(elements, element)
+				element = forwardedElement{}
+				empty = true
+			default:
+				return nil, ErrInvalidForwarded
+			}
+			pos++
+		}
+		if !empty {
+			elements = append(elements, element)
+		}
+	}
+
+	return elements, nil
+}
+
+func skipForwardedSpaces(value string, pos int) int {
+	for pos < len(value) && (value[pos] == ' ' || value[pos] == '\t') {
+		pos++
+	}
+	return pos
+}
+
+// isForwardedTokenChar tells if a character is allowed in a token (RFC 7230)
+func isForwardedTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+	}
+}
+
+// forwardedNodeIP returns the ip of a node identifier, e.g. 192.0.2.43:47011 or [2001:db8:cafe::17].
+// Obfuscated identifiers (e.g. _hidden) and "unknown" have no ip.
+func forwardedNodeIP(node string) net.IP {
+	host := node
+	if h, _, err := net.SplitHostPort(node); err == nil {
+		host = h
+	}
+
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// formatForwardedNode formats an ip as a node identifier
+func formatForwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		// ipv6 addresses are bracketed
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+// formatForwardedElement formats an element to be appended to a Forwarded header
+func formatForwardedElement(element forwardedElement) string {
+	pairs := make([]string, 0, 4)
+	for _, pair := range []struct{ name, value string }{
+		{name: "by", value: element.By},
+		{name: "for", value: element.For},
+		{name: "host", value: element.Host},
+		{name: "proto", value: element.Proto},
+	} {
+		if pair.value == "" {
+			continue
+		}
+		value := pair.value
+		if strings.IndexFunc(value, func(c rune) bool { return c > 0x7f || !isForwardedTokenChar(byte(c)) }) >= 0 {
+			value = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+		pairs = append(pairs, pair.name+"="+value)
+	}
+
+	return strings.Join(pairs, ";")
+}
+
+// parseTrustedProxies parses a list of ips or cidrs
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	return parseNetworks("trusted proxy", proxies)
+}
+
+// parseNetworks parses a list of ips or cidrs, the kind of the networks naming them in the errors
+func parseNetworks(kind string, values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s %q, must be an ip or a cidr", kind, value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q, must be an ip or a cidr", kind, value)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// isTrustedProxy tells if an ip belongs to one of the trusted networks
+func isTrustedProxy(ip net.IP, networks []*net.IPNet) bool {
+	return inNetworks(ip, networks)
+}
+
+// inNetworks tells if an ip belongs to one of the networks
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the ip of the client of a request: our peer, unless it is a trusted proxy. The client of a trusted
+// proxy is the one of the Forwarded element retained for the request, else the right-most entry of X-Forwarded-For
+// which is not a trusted proxy. An entry which is not an ip gives no client ip.
+func (r *oauthProxy) clientIP(req *http.Request) net.IP {
+	ip := forwardedNodeIP(req.RemoteAddr)
+	if !isTrustedProxy(ip, r.trustedProxies) {
+		return ip
+	}
+	if forwarded := getForwarded(req); forwarded != nil {
+		if client := forwardedNodeIP(forwarded.For); client != nil {
+			return client
+		}
+	}
+
+	var hops []string
+	for _, value := range req.Header.Values(headerXForwardedFor) {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if ip = forwardedNodeIP(strings.TrimSpace(hops[i])); !isTrustedProxy(ip, r.trustedProxies) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// forwardedOverHTTPS tells if the trusted proxies forwarded a request the client made over https
+func forwardedOverHTTPS(req *http.Request) bool {
+	forwarded := getForwarded(req)
+	return forwarded != nil && strings.EqualFold(forwarded.Proto, secureScheme)
+}
+
+// getForwarded returns the Forwarded element retained for a request, if any
+func getForwarded(req *http.Request) *forwardedElement {
+	scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+	if !ok {
+		return nil
+	}
+	return scope.Forwarded
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForwarded(t *testing.T) {
+	cs := []struct {
+		Values   []string
+		Expected []forwardedElement
+		Error    bool
+	}{
+		{
+			Values:   []string{`for=192.0.2.43`},
+			Expected: []forwardedElement{{For: "192.0.2.43"}},
+		},
+		{
+			Values:   []string{`For="[2001:db8:cafe::17]:4711";Proto=HTTPS;host=example.com`},
+			Expected: []forwardedElement{{For: "[2001:db8:cafe::17]:4711", Proto: "https", Host: "example.com"}},
+		},
+		{
+			Values:   []string{`for=192.0.2.43, for=198.51.100.17;by=_proxy1`, `for=unknown;ext="a, \"b\""`},
+			Expected: []forwardedElement{{For: "192.0.2.43"}, {For: "198.51.100.17", By: "_proxy1"}, {For: "unknown"}},
+		},
+		{
+			Values:   []string{`for=_hidden ; proto=http , for="10.0.0.1"`},
+			Expected: []forwardedElement{{For: "_hidden", Proto: "http"}, {For: "10.0.0.1"}},
+		},
+		{Values: []string{`for`}, Error: true},
+		{Values: []string{`for=`}, Error: true},
+		{Values: []string{`for="192.0.2.43`}, Error: true},
+		{Values: []string{`for=192.0.2.43 proto=http`}, Error: true},
+		{Values: []string{`for=[2001:db8::1]`}, Error: true},
+	}
+	for i, c := range cs {
+		elements, err := parseForwarded(c.Values)
+		if c.Error {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		require.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Expected, elements, "case %d", i)
+	}
+}
+
+func TestForwardedNodeIP(t *testing.T) {
+	assert.Equal(t, "192.0.2.43", forwardedNodeIP("192.0.2.43").String())
+	assert.Equal(t, "192.0.2.43", forwardedNodeIP("192.0.2.43:47011").String())
+	assert.Equal(t, "2001:db8:cafe::17", forwardedNodeIP("[2001:db8:cafe::17]").String())
+	assert.Equal(t, "2001:db8:cafe::17", forwardedNodeIP("[2001:db8:cafe::17]:4711").String())
+	assert.Nil(t, forwardedNodeIP("_hidden"))
+	assert.Nil(t, forwardedNodeIP("unknown"))
+}
+
+func TestFormatForwardedElement(t *testing.T) {
+	assert.Equal(t, `for=192.0.2.43;host=example.com;proto=https`,
+		formatForwardedElement(forwardedElement{For: formatForwardedNode("192.0.2.43"), Host: "example.com", Proto: "https"}))
+	assert.Equal(t, `for="[2001:db8::1]";host="example.com:8443"`,
+		formatForwardedElement(forwardedElement{For: formatForwardedNode("2001:db8::1"), Host: "example.com:8443"}))
+
+	// a formatted element is parsed back
+	element := forwardedElement{For: `"_odd\`, Host: "example.com:8443"}
+	elements, err := parseForwarded([]string{formatForwardedElement(element)})
+	require.NoError(t, err)
+	assert.Equal(t, []forwardedElement{element}, elements)
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.43", "2001:db8::1"})
+	require.NoError(t, err)
+	assert.True(t, isTrustedProxy(net.ParseIP("10.1.2.3"), networks))
+	assert.True(t, isTrustedProxy(net.ParseIP("192.0.2.43"), networks))
+	assert.True(t, isTrustedProxy(net.ParseIP("2001:db8::1"), networks))
+	assert.False(t, isTrustedProxy(net.ParseIP("192.0.2.44"), networks))
+	assert.False(t, isTrustedProxy(nil, networks))
+
+	_, err = parseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32"})
+	require.NoError(t, err)
+	p := &oauthProxy{trustedProxies: networks}
+
+	cs := []struct {
+		RemoteAddr    string
+		XForwardedFor []string
+		Forwarded     *forwardedElement
+		Expected      string
+	}{
+		{RemoteAddr: "198.51.100.1:4000", Expected: "198.51.100.1"},
+		{RemoteAddr: "[2001:db9::1]:4000", Expected: "2001:db9::1"},
+		// the headers of an untrusted peer are ignored
+		{RemoteAddr: "198.51.100.1:4000", XForwardedFor: []string{"10.0.0.1"}, Expected: "198.51.100.1"},
+		{RemoteAddr: "198.51.100.1:4000", Forwarded: &forwardedElement{For: "10.0.0.1"}, Expected: "198.51.100.1"},
+		{RemoteAddr: "10.0.0.1:4000", Expected: "10.0.0.1"},
+		{RemoteAddr: "10.0.0.1:4000", XForwardedFor: []string{"203.0.113.7"}, Expected: "203.0.113.7"},
+		// the right-most entry which is not a trusted proxy, the ones on the left being set by the client
+		{RemoteAddr: "10.0.0.1:4000", XForwardedFor: []string{"192.0.2.1, 203.0.113.7, 10.0.0.2"}, Expected: "203.0.113.7"},
+		{RemoteAddr: "10.0.0.1:4000", XForwardedFor: []string{"192.0.2.1", "203.0.113.7,10.0.0.2"}, Expected: "203.0.113.7"},
+		{RemoteAddr: "[2001:db8::1]:4000", XForwardedFor: []string{"2001:db9::7, 2001:db8::2"}, Expected: "2001:db9::7"},
+		{RemoteAddr: "10.0.0.1:4000", XForwardedFor: []string{"10.0.0.3, 10.0.0.2"}, Expected: "10.0.0.3"},
+		{RemoteAddr: "10.0.0.1:4000", XForwardedFor: []string{"192.0.2.1, unknown"}},
+		// the retained Forwarded element wins over X-Forwarded-For
+		{RemoteAddr: "10.0.0.1:4000", XForwardedFor: []string{"203.0.113.7"}, Forwarded: &forwardedElement{For: "[2001:db9::7]:1234"}, Expected: "2001:db9::7"},
+		{RemoteAddr: "10.0.0.1:4000", XForwardedFor: []string{"203.0.113.7"}, Forwarded: &forwardedElement{For: "_hidden"}, Expected: "203.0.113.7"},
+	}
+	for i, c := range cs {
+		req := &http.Request{RemoteAddr: c.RemoteAddr, Header: http.Header{headerXForwardedFor: c.XForwardedFor}}
+		req = req.WithContext(context.WithValue(context.Background(), contextScopeName, &RequestScope{Forwarded: c.Forwarded}))
+		ip := p.clientIP(req)
+		if c.Expected == "" {
+			assert.Nil(t, ip, "case %d", i)
+			continue
+		}
+		assert.Equal(t, c.Expected, ip.String(), "case %d", i)
+	}
+}
+
+func TestForwardedRequestHost(t *testing.T) {
+	req := &http.Request{
+		Method:     http.MethodGet,
+		Host:       "internal:3000",
+		RemoteAddr: "10.0.0.1:4000",
+		Header:     http.Header{headerXForwardedFor: []string{"198.51.100.17"}},
+	}
+	assert.Equal(t, "http://internal:3000", getRequestHostURL(req))
+	assert.Equal(t, "198.51.100.17", realIP(req))
+
+	scope := &RequestScope{Forwarded: &forwardedElement{For: "192.0.2.43:47011", Host: "example.com", Proto: "https"}}
+	req = req.WithContext(context.WithValue(req.Context(), contextScopeName, scope))
+	assert.Equal(t, "https://example.com", getRequestHostURL(req))
+	assert.Equal(t, "192.0.2.43", realIP(req))
+
+	// obfuscated identifiers do not give the client ip
+	scope.Forwarded.For = "_hidden"
+	assert.Equal(t, "198.51.100.17", realIP(req))
+}
@@ -20,21 +20,42 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	httplog "log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
 	"github.com/coreos/go-oidc/oidc"
 	"github.com/elazarl/goproxy"
 	"github.com/oneconcern/keycloak-gatekeeper/version"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// forwardingAcquisitionTimeout bounds the wait of a request for the token of its audience, before it is signed
+	// with the forwarding token
+	forwardingAcquisitionTimeout = 10 * time.Second
+	// forwardingAudienceRetry is the delay before a failed renewal of the token of an audience is retried
+	forwardingAudienceRetry = 10 * time.Second
+	// forwardingAudienceIdleTimeout is the time after which the token of an unused audience is no longer renewed
+	forwardingAudienceIdleTimeout = time.Hour
+	// forwardingDrainPollInterval is the interval at which the shutdown checks the requests in flight are finished
+	forwardingDrainPollInterval = 50 * time.Millisecond
 )
 
 func (r *Config) isForwardingValid() error {
@@ -44,11 +65,78 @@ func (r *Config) isForwardingValid() error {
 	if err := r.isDiscoveryValid(); err != nil {
 		return err
 	}
-	if r.ForwardingUsername == "" {
-		return errors.New("no forwarding username")
+	switch r.ForwardingGrantType {
+	case "", oauth2.GrantTypeUserCreds:
+		if r.ForwardingUsername == "" && r.ForwardingUsernameFile == "" {
+			return errors.New("no forwarding username")
+		}
+		if r.ForwardingPassword == "" && r.ForwardingPasswordFile == "" {
+			return errors.New("no forwarding password")
+		}
+	case oauth2.GrantTypeClientCreds:
+		// the service account of the client is used, there is no user
+		if r.ForwardingUsername != "" || r.ForwardingPassword != "" || r.ForwardingUsernameFile != "" || r.ForwardingPasswordFile != "" {
+			return errors.New("you cannot set forwarding-username or forwarding-password with the client_credentials forwarding grant type")
+		}
+		if r.ClientSecret == "" && r.ClientAssertionKey == "" && r.ForwardingClientSecretFile == "" {
+			return errors.New("the client_credentials forwarding grant type requires the client secret or assertion key")
+		}
+	default:
+		return fmt.Errorf("invalid forwarding grant type %q, must be one of %s|%s", r.ForwardingGrantType, oauth2.GrantTypeUserCreds, oauth2.GrantTypeClientCreds)
+	}
+	for domain, audience := range r.ForwardingAudiences {
+		if domain == "" || audience == "" {
+			return fmt.Errorf("invalid forwarding audience %q for the domain %q", audience, domain)
+		}
+		if len(r.ForwardingDomains) > 0 && !containsSubString(domain, r.ForwardingDomains) {
+			return fmt.Errorf("the domain %s of the forwarding audiences is not signed, it must be one of the forwarding-domains", domain)
+		}
+	}
+	if len(r.ForwardingAudiences) > 0 && r.ClientSecret == "" && r.ClientAssertionKey == "" && r.ForwardingClientSecretFile == "" {
+		return errors.New("the forwarding audiences require a confidential client: you have not specified the client secret or assertion key")
 	}
-	if r.ForwardingPassword == "" {
-		return errors.New("no forwarding password")
+	for domain, audience := range r.ForwardingDomainAudience {
+		if domain == "" || audience == "" {
+			return fmt.Errorf("invalid forwarding domain audience %q for the domain %q", audience, domain)
+		}
+		if len(r.ForwardingDomains) > 0 && !containsSubString(domain, r.ForwardingDomains) {
+			return fmt.Errorf("the domain %s of the forwarding domain audiences is not signed, it must be one of the forwarding-domains", domain)
+		}
+		if _, found := r.ForwardingAudiences[domain]; found {
+			return fmt.Errorf("the domain %s is set with both forwarding-audiences and forwarding-domain-audience", domain)
+		}
+	}
+	if len(r.ForwardingDomainAudience) > 0 && r.ClientSecret == "" && r.ClientAssertionKey == "" && r.ForwardingClientSecretFile == "" {
+		return errors.New("the forwarding domain audiences require a confidential client: you have not specified the client secret or assertion key")
+	}
+	if r.ForwardingLoginBackoffMax < forwardingLoginBackoff.initial {
+		return fmt.Errorf("the forwarding login backoff max must be at least %s", forwardingLoginBackoff.initial)
+	}
+	if r.ForwardingDrainTimeout < 0 {
+		return errors.New("the forwarding drain timeout cannot be negative")
+	}
+	if r.ForwardingTokenHeader == "" || strings.ContainsAny(r.ForwardingTokenHeader, " \t\r\n:") {
+		return fmt.Errorf("invalid forwarding-token-header %q, the tokens must be written to a header", r.ForwardingTokenHeader)
+	}
+	if _, err := newForwardingExclusions(r.ForwardingExcludePaths); err != nil {
+		return err
+	}
+	if err := r.isForwardingCredentialsValid(); err != nil {
+		return err
+	}
+	if err := r.isForwardingIdentitiesValid(); err != nil {
+		return err
+	}
+	if err := r.isForwardingWorkloadValid(); err != nil {
+		return err
+	}
+	for _, override := range r.ForwardingTLS {
+		if len(override.Domains) == 0 {
+			return errors.New("the forwarding tls settings must list the destination domains they apply to")
+		}
+		if err := override.isValid(); err != nil {
+			return fmt.Errorf("invalid forwarding tls settings for %s: %w", strings.Join(override.Domains, ","), err)
+		}
 	}
 	if r.TLSCertificate != "" {
 		return errors.New("you don't need to specify a tls-certificate, use tls-ca-certificate instead")
@@ -59,6 +147,40 @@ func (r *Config) isForwardingValid() error {
 	return nil
 }
 
+// isForwardingIdentitiesValid checks each identity is either a user or a client, and each domain is signed by a
+// single identity
+func (r *Config) isForwardingIdentitiesValid() error {
+	owners := make(map[string]*ForwardingIdentity)
+	for _, identity := range r.ForwardingIdentities {
+		switch {
+		case identity.Username != "" && identity.ClientID != "":
+			return errors.New("a forwarding identity is either a user (username, password) or a client (client-id, client-secret), not both")
+		case identity.Username != "" && identity.Password == "":
+			return fmt.Errorf("the forwarding identity of the user %s has no password", identity.Username)
+		case identity.ClientID != "" && identity.ClientSecret == "":
+			return fmt.Errorf("the forwarding identity of the client %s has no client secret", identity.ClientID)
+		case identity.Username == "" && identity.ClientID == "":
+			return errors.New("a forwarding identity must set either a username and password, or a client-id and client-secret")
+		}
+		if len(identity.Domains) == 0 {
+			return fmt.Errorf("the forwarding identity %s must list the destination domains it signs", defaultTo(identity.Username, identity.ClientID))
+		}
+		for _, domain := range identity.Domains {
+			normalized := normalizeForwardingDomain(domain)
+			if normalized == "" {
+				return fmt.Errorf("invalid domain %q of the forwarding identity %s", domain, defaultTo(identity.Username, identity.ClientID))
+			}
+			if owner, found := owners[normalized]; found && owner != identity {
+				return fmt.Errorf("the domain %s is signed by several forwarding identities, %s and %s", domain,
+					defaultTo(owner.Username, owner.ClientID), defaultTo(identity.Username, identity.ClientID))
+			}
+			owners[normalized] = identity
+		}
+	}
+
+	return nil
+}
+
 // createForwardingProxy creates a forwarding proxy
 func (r *oauthProxy) createForwardingProxy() error {
 	r.log.Info("enabling forward signing mode, listening on", zap.String("interface", r.config.Listen))
@@ -69,9 +191,14 @@ func (r *oauthProxy) createForwardingProxy() error {
 	if err := r.createProxy(); err != nil {
 		return err
 	}
+	transports, err := r.createForwardingTransports()
+	if err != nil {
+		return err
+	}
 
 	r.forwardCtx, r.forwardCancel = context.WithCancel(context.Background())
 	r.forwardWaitGroup, _ = errgroup.WithContext(r.forwardCtx)
+	r.forwardCredentials = newForwardingCredentials(r.config, r.log)
 
 	//nolint: bodyclose
 	forwardingHandler := r.forwardProxyHandler()
@@ -83,39 +210,52 @@ func (r *oauthProxy) createForwardingProxy() error {
 	}
 	r.router = proxy
 
-	// setup the tls configuration
+	// setup the tls configuration, using the default certificate provided by goproxy unless a CA is set
+	mitm := goproxy.MitmConnect
 	if r.config.TLSCaCertificate != "" && r.config.TLSCaPrivateKey != "" {
 		ca, err := loadCA(r.config.TLSCaCertificate, r.config.TLSCaPrivateKey)
 		if err != nil {
 			return fmt.Errorf("unable to load certificate authority, error: %s", err)
 		}
+		r.certificates.record(certificatePurposeForwardingCA, r.config.TLSCaCertificate, *ca)
 
-		// implement the goproxy connect method
-		proxy.OnRequest().HandleConnectFunc(
-			func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-				return &goproxy.ConnectAction{
-					Action:    goproxy.ConnectMitm,
-					TLSConfig: goproxy.TLSConfigFromCA(ca), // NOTE(fredbi): the default proxy config in github/elazarl/goproxy disables TLS verify
-				}, host
-			},
-		)
-	} else {
-		// use the default certificate provided by goproxy
-		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		mitm = &goproxy.ConnectAction{
+			Action:    goproxy.ConnectMitm,
+			TLSConfig: goproxy.TLSConfigFromCA(ca), // NOTE(fredbi): the default proxy config in github/elazarl/goproxy disables TLS verify
+		}
 	}
 
+	// implement the goproxy connect method: the tunnels to the hosts which are not signed are not intercepted
+	proxy.OnRequest().HandleConnectFunc(
+		func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			if !r.interceptsTunnel(host) {
+				r.log.Debug("tunneling without interception", zap.String("host", host))
+				return goproxy.OkConnect, host
+			}
+			return mitm, host
+		},
+	)
+
 	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
 		// @NOTES, somewhat annoying but goproxy hands back a nil response on proxy client errors
-		if resp != nil && r.config.EnableLogging {
-			start, asExpectedTime := ctx.UserData.(time.Time)
-			if !asExpectedTime {
-				r.log.Error("corrupted context: expected UserData to be time.Time. Skipping actual log entry")
+		if resp == nil {
+			return resp
+		}
 
-				return resp
-			}
+		timing, asExpectedTiming := ctx.UserData.(*forwardingTiming)
+		if !asExpectedTiming {
+			r.log.Error("corrupted context: expected UserData to be *forwardingTiming. Skipping metrics and actual log entry")
+
+			return resp
+		}
+
+		// @metric record the time taken by the upstream to respond, then the overall latency
+		latency := time.Since(timing.start)
+		upstreamDurationMetric.WithLabelValues("", resp.Request.Method).Observe(time.Since(timing.signed).Seconds())
+		totalDurationMetric.WithLabelValues("", resp.Request.Method).Observe(latency.Seconds())
+		latencyMetric.Observe(latency.Seconds())
 
-			latency := time.Since(start)
-			latencyMetric.Observe(latency.Seconds())
+		if r.config.EnableLogging {
 			r.log.Info("client request",
 				zap.String("method", resp.Request.Method),
 				zap.String("path", resp.Request.URL.Path),
@@ -129,16 +269,187 @@ func (r *oauthProxy) createForwardingProxy() error {
 		return resp
 	})
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		ctx.UserData = time.Now()
+		timing := &forwardingTiming{start: time.Now()}
+		ctx.UserData = timing
 		forwardingHandler(req, ctx.Resp)
 
+		// the requests in flight are counted until their response headers, so the shutdown waits for them within the
+		// drain timeout. The server also waits for the plain http requests until their response is relayed, but not
+		// for the requests in the tunnels, which connections are hijacked.
+		var next http.RoundTripper = proxy.Tr
+		if transport := transports.of(req.URL.Hostname()); transport != nil {
+			next = transport
+		}
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, _ *goproxy.ProxyCtx) (*http.Response, error) {
+			atomic.AddInt64(&r.forwardInflight, 1)
+			defer atomic.AddInt64(&r.forwardInflight, -1)
+
+			return next.RoundTrip(req)
+		})
+
+		// @metric record the time taken to sign the request
+		timing.signed = time.Now()
+		authDurationMetric.WithLabelValues("", req.Method).Observe(timing.signed.Sub(timing.start).Seconds())
+
 		return req, ctx.Resp
 	})
 
 	return nil
 }
 
-// the loop state
+// shutdownForwarding stops the forwarding proxy within the drain timeout: the listener stops accepting connections,
+// including new tunnels, the refresh loops stop, and the requests in flight are given the time to finish
+func (r *oauthProxy) shutdownForwarding() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.ForwardingDrainTimeout)
+	defer cancel()
+
+	r.log.Info("shutting down the forwarding proxy", zap.Duration("timeout", r.config.ForwardingDrainTimeout))
+	var group errgroup.Group
+	group.Go(func() error {
+		if r.server == nil {
+			return nil
+		}
+		// the tunnels are hijacked connections which are not tracked by the server: their requests are counted
+		if err := r.server.Shutdown(ctx); err != nil {
+			return fmt.Errorf("the forwarding proxy did not stop accepting connections: %w", err)
+		}
+		for atomic.LoadInt64(&r.forwardInflight) > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("%d requests through the forwarding proxy did not finish: %w", atomic.LoadInt64(&r.forwardInflight), ctx.Err())
+			case <-time.After(forwardingDrainPollInterval):
+			}
+		}
+		return nil
+	})
+	group.Go(func() error {
+		r.forwardCancel()
+		stopped := make(chan struct{})
+		go func() {
+			_ = r.forwardWaitGroup.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("the refresh loops of the forwarding proxy did not stop: %w", ctx.Err())
+		}
+	})
+
+	return group.Wait()
+}
+
+// forwardingTransports are the transports to the destination domains with their own tls settings
+type forwardingTransports []forwardingTransport
+
+// forwardingTransport is the transport to some destination domains
+type forwardingTransport struct {
+	domains   []string
+	transport *http.Transport
+}
+
+// of returns the transport to a destination host, nil when the host uses the default transport
+func (t forwardingTransports) of(hostname string) *http.Transport {
+	for _, x := range t {
+		if containsSubString(hostname, x.domains) {
+			return x.transport
+		}
+	}
+
+	return nil
+}
+
+// interceptsTunnel tells if the tunnels to a host are intercepted: only the hosts which requests are signed, or
+// which have their own tls settings, are when the forwarding domains are listed, unless forwarding-mitm-all is set
+func (r *oauthProxy) interceptsTunnel(host string) bool {
+	if r.config.ForwardingMITMAll || len(r.config.ForwardingDomains) == 0 {
+		return true
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if containsSubString(hostname, r.config.ForwardingDomains) {
+		return true
+	}
+	for _, override := range r.config.ForwardingTLS {
+		if containsSubString(hostname, override.Domains) {
+			return true
+		}
+	}
+	for _, identity := range r.config.ForwardingIdentities {
+		for _, domain := range identity.Domains {
+			if isForwardingDomainOf(hostname, normalizeForwardingDomain(domain)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// createForwardingTransports creates a transport per override of the upstream tls settings
+func (r *oauthProxy) createForwardingTransports() (forwardingTransports, error) {
+	transports := make(forwardingTransports, 0, len(r.config.ForwardingTLS))
+	for _, override := range r.config.ForwardingTLS {
+		tlsConfig, err := r.buildUpstreamTLSConfig(&override.UpstreamTLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forwarding tls settings for %s: %w", strings.Join(override.Domains, ","), err)
+		}
+		if override.SkipVerify {
+			for _, domain := range override.Domains {
+				r.warnSkippedVerification(domain)
+			}
+		}
+		if len(tlsConfig.Certificates) > 0 {
+			r.reportExpiredClientCertificate(override, tlsConfig)
+		}
+		transports = append(transports, forwardingTransport{
+			domains:   override.Domains,
+			transport: r.newForwardingTransport(tlsConfig),
+		})
+	}
+
+	return transports, nil
+}
+
+// reportExpiredClientCertificate logs an error naming the domains of the forwarding tls settings once their client
+// certificate has expired, as the upstreams requiring mutual tls refuse the connections: on startup, or on the first
+// handshake asking for the certificate after it has expired
+func (r *oauthProxy) reportExpiredClientCertificate(settings *ForwardingTLS, tlsConfig *tls.Config) {
+	certificate := tlsConfig.Certificates[0]
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return
+	}
+	var reported int32
+	report := func() {
+		if !r.now().After(leaf.NotAfter) || !atomic.CompareAndSwapInt32(&reported, 0, 1) {
+			return
+		}
+		r.log.Error("the forwarding client certificate has expired, the upstreams requiring mutual tls refuse the connections",
+			zap.Strings("domains", settings.Domains),
+			zap.String("certificate", settings.ClientCertificate),
+			zap.String("expired_at", leaf.NotAfter.Format(time.RFC3339)))
+	}
+	report()
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		report()
+		return &certificate, nil
+	}
+}
+
+// forwardingTiming tracks the time spent by a forwarded request
+type forwardingTiming struct {
+	// when the request has been received
+	start time.Time
+	// when the request has been signed and goes upstream
+	signed time.Time
+}
+
+// the loop state, only accessed by the refresh loop: the signer never reads it, each new token being published to the
+// signer as an immutable snapshot swapped atomically
 type forwardingState struct {
 	// the access token
 	token jose.JWT
@@ -152,184 +463,888 @@ type forwardingState struct {
 	login bool
 	// whether we should wait for expiration
 	wait bool
+	// the consecutive failures of the login, backing off the next attempt
+	failures int
+	// the last failure logged as a warning, with its backoff step, and the identical failures logged since at debug level
+	lastFailure string
+	lastStep    time.Duration
+	suppressed  int
+	// the tokens acquired for the audiences of some destination domains, each renewed near its own expiry
+	audiences map[string]*forwardingGrantedToken
+	// whether the credentials are reloaded before the next login, and the wake-ups to reload them at once if any
+	reload  bool
+	relogin <-chan struct{}
+}
+
+// forwardingGrantedToken is a token acquired with the forwarding grant for an audience
+type forwardingGrantedToken struct {
+	// the authorization header of the token
+	authorization string
+	// the expiry time of the token
+	expiration time.Time
+	// when the token is acquired again, within 85% of its expiration
+	renewAt time.Time
+}
+
+// forwardingAcquisition asks the refresh loop for the token of an audience which has not been acquired yet
+type forwardingAcquisition struct {
+	audience string
+	// receives the authorization header of the token, empty when it could not be acquired
+	authorization chan string
+}
+
+// forwardingSignature is an immutable snapshot of the credentials signing the outbound requests
+type forwardingSignature struct {
+	// the encoded access token
+	token string
+	// the authorization header, encoded once per token
+	authorization string
+}
+
+// forwardingAudience is the audience of the tokens signing the requests to a destination domain
+type forwardingAudience struct {
+	domain   string
+	audience string
+	// whether the tokens are acquired with the forwarding grant, rather than exchanged
+	granted bool
+}
+
+// forwardingExchange is a token exchanged for an audience
+type forwardingExchange struct {
+	// the access token it has been exchanged from
+	base string
+	// the authorization header of the exchanged token
+	authorization string
+	// when the token is exchanged again, within 85% of its expiration
+	renewAt time.Time
+}
+
+// forwardingSigner signs the outbound requests with the last token acquired by the refresh loop. The loop swaps
+// the signature wholesale, so signing a request is a single atomic load.
+type forwardingSigner struct {
+	// the domains which are signed, all when empty
+	domains []string
+	// the current *forwardingSignature, if a token has been acquired
+	signature atomic.Value
+
+	// the audiences of the destination domains, the most specific domain first
+	audiences []forwardingAudience
+	// exchange exchanges the access token for a token of an audience
+	exchange func(token, audience string) (string, time.Time, error)
+	log      *zap.Logger
+	// the exchanged tokens per audience, a single exchange being in flight per audience
+	exchangedLock sync.RWMutex
+	exchanged     map[string]forwardingExchange
+	exchanges     singleflight.Group
+	// the authorization headers of the tokens acquired for the audiences, a map[string]string swapped by the loop
+	granted atomic.Value
+	// the last use of the tokens of each audience, in unix seconds as *int64
+	grantedUses sync.Map
+	// acquisitions are served by the refresh loop
+	acquisitions chan forwardingAcquisition
+	// workload adds the identity of the local caller to the signed requests, if enabled
+	workload *forwardingWorkload
+	// the domains of the identities signing the requests to them, the longest domain first
+	identities []forwardingIdentityDomain
+	// tells the time of the renewals of the exchanged tokens and the uses of the audiences, the clock of the proxy
+	clock clock
+	// the header the tokens are written to, with their prefix, the Authorization header when empty
+	tokenHeader string
+	tokenPrefix string
+	// the paths which requests are never signed
+	exclusions []forwardingExclusion
+}
+
+// forwardingExclusion is a path which requests are never signed
+type forwardingExclusion struct {
+	// the domain of the hosts the path applies to, all when empty
+	domain string
+	// the path, matched as a prefix when it ends with a wildcard
+	path   string
+	prefix bool
+}
+
+// newForwardingExclusions parses the forwarding-exclude-paths: a path, optionally after the domain of the hosts it
+// applies to, which may end with a wildcard
+func newForwardingExclusions(entries []string) ([]forwardingExclusion, error) {
+	list := make([]forwardingExclusion, 0, len(entries))
+	for _, entry := range entries {
+		i := strings.Index(entry, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid forwarding exclude path %q, it must be a path, optionally after a domain", entry)
+		}
+		x := forwardingExclusion{domain: normalizeForwardingDomain(entry[:i]), path: entry[i:]}
+		if strings.HasSuffix(x.path, "*") {
+			x.path, x.prefix = strings.TrimSuffix(x.path, "*"), true
+		}
+		if strings.Contains(x.path, "*") || strings.ContainsAny(x.domain, "*:") {
+			return nil, fmt.Errorf("invalid forwarding exclude path %q, only a wildcard ending the path is supported", entry)
+		}
+		list = append(list, x)
+	}
+
+	return list, nil
+}
+
+// matches tells if the path of a request to a host is excluded, the path being case-sensitive
+func (x forwardingExclusion) matches(hostname, path string) bool {
+	if x.domain != "" && !isForwardingDomainOf(hostname, x.domain) {
+		return false
+	}
+	if x.prefix {
+		return strings.HasPrefix(path, x.path)
+	}
+
+	return path == x.path
+}
+
+// excludes tells if a request to a host is never signed, by its path
+func (s *forwardingSigner) excludes(hostname, path string) bool {
+	for _, x := range s.exclusions {
+		if x.matches(hostname, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardingIdentity is an identity signing the outbound requests, with its own login and refresh loop
+type forwardingIdentity struct {
+	// name identifies the identity in the logs
+	name string
+	// login acquires a new access token
+	login func(context.Context) (oauth2.TokenResponse, error)
+	// refreshes tells if the refresh tokens of the identity are refreshed with the client of the proxy
+	refreshes bool
+	// update swaps the signature for a new token
+	update func(jose.JWT)
+	// the current *forwardingSignature of the identity, if a token has been acquired
+	signature atomic.Value
+	// the credentials reloaded before the logins when rotated, those of the forwarding user or client only
+	credentials *forwardingCredentials
+}
+
+// forwardingIdentityDomain is a destination domain signed by an identity
+type forwardingIdentityDomain struct {
+	domain   string
+	identity *forwardingIdentity
+}
+
+// newForwardingIdentity returns an identity of the forwarding-identities: a user logging in with the client of the
+// proxy, or the service account of its own client
+func (r *oauthProxy) newForwardingIdentity(settings *ForwardingIdentity) *forwardingIdentity {
+	identity := &forwardingIdentity{
+		name:      defaultTo(settings.Username, settings.ClientID),
+		refreshes: settings.Username != "",
+	}
+	identity.update = func(token jose.JWT) {
+		encoded := token.Encode()
+		identity.signature.Store(&forwardingSignature{token: encoded, authorization: "Bearer " + encoded})
+	}
+	identity.login = func(ctx context.Context) (oauth2.TokenResponse, error) {
+		if settings.ClientID != "" {
+			r.log.Info("requesting access token for the service account of the client", zap.String("client_id", settings.ClientID))
+			return r.requestTokenAs(ctx, oauth2.ClientCredentials{ID: settings.ClientID, Secret: settings.ClientSecret}, url.Values{
+				"grant_type": []string{oauth2.GrantTypeClientCreds},
+				"scope":      []string{strings.Join(r.config.Scopes, " ")},
+			})
+		}
+		r.log.Info("requesting access token for user", zap.String("username", settings.Username))
+		return r.requestToken(ctx, r.forwardingGrantOf(settings.Username, settings.Password))
+	}
+
+	return identity
+}
+
+// newForwardingIdentityDomains returns the domains of the identities, the longest domain first
+func newForwardingIdentityDomains(identities []*forwardingIdentity, settings []*ForwardingIdentity) []forwardingIdentityDomain {
+	var list []forwardingIdentityDomain
+	for i, identity := range identities {
+		for _, domain := range settings[i].Domains {
+			list = append(list, forwardingIdentityDomain{domain: normalizeForwardingDomain(domain), identity: identity})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return len(list[i].domain) > len(list[j].domain)
+	})
+
+	return list
+}
+
+// normalizeForwardingDomain returns the domain matched by suffix against the destination hosts
+func normalizeForwardingDomain(domain string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// isForwardingDomainOf tells if a host is the normalized domain, or one of its subdomains
+func isForwardingDomainOf(hostname, domain string) bool {
+	hostname = strings.ToLower(hostname)
+
+	return hostname == domain || strings.HasSuffix(hostname, "."+domain)
+}
+
+// identityOf returns the identity signing the requests to a host, by the longest domain the host ends with
+func (s *forwardingSigner) identityOf(hostname string) *forwardingIdentity {
+	for _, x := range s.identities {
+		if isForwardingDomainOf(hostname, x.domain) {
+			return x.identity
+		}
+	}
+
+	return nil
+}
+
+// newForwardingAudiences returns the audiences of the destination domains, which tokens are either exchanged or
+// acquired with the forwarding grant, the longest domain first
+func newForwardingAudiences(exchanged, granted map[string]string) []forwardingAudience {
+	list := make([]forwardingAudience, 0, len(exchanged)+len(granted))
+	for domain, audience := range exchanged {
+		list = append(list, forwardingAudience{domain: domain, audience: audience})
+	}
+	for domain, audience := range granted {
+		list = append(list, forwardingAudience{domain: domain, audience: audience, granted: true})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].domain) != len(list[j].domain) {
+			return len(list[i].domain) > len(list[j].domain)
+		}
+		return list[i].domain < list[j].domain
+	})
+
+	return list
+}
+
+// update swaps the signature for a new token
+func (s *forwardingSigner) update(token jose.JWT) {
+	encoded := token.Encode()
+	s.signature.Store(&forwardingSignature{token: encoded, authorization: "Bearer " + encoded})
+}
+
+// sign adds the authorization of the current token to an outbound request, when the host is signed
+func (s *forwardingSigner) sign(req *http.Request) {
+	hostname := req.Host
+	req.URL.Host = hostname
+	// is the path excluded from the signature?
+	if s.excludes(req.URL.Hostname(), req.URL.Path) {
+		// @metric a request has been passed through by the forwarding proxy, its path is excluded
+		forwardingRequestsMetric.WithLabelValues("excluded").Inc()
+		return
+	}
+	// is the host signed by an identity of its own?
+	if identity := s.identityOf(req.URL.Hostname()); identity != nil {
+		if signature, ok := identity.signature.Load().(*forwardingSignature); ok {
+			s.authorize(req, signature.authorization)
+		}
+		s.identify(req)
+		// @metric a request has been signed by the forwarding proxy
+		forwardingRequestsMetric.WithLabelValues("signed").Inc()
+		return
+	}
+	// is the host being signed?
+	if len(s.domains) == 0 || containsSubString(hostname, s.domains) {
+		if signature, ok := s.signature.Load().(*forwardingSignature); ok {
+			s.authorize(req, s.authorizationOf(req.Context(), req.URL.Hostname(), signature))
+		}
+		s.identify(req)
+		// @metric a request has been signed by the forwarding proxy
+		forwardingRequestsMetric.WithLabelValues("signed").Inc()
+		return
+	}
+	// @metric a request has been passed through by the forwarding proxy, its domain is not signed
+	forwardingRequestsMetric.WithLabelValues("passthrough").Inc()
+}
+
+// authorize writes the token of an authorization to the token header of a signed request. The authorizations are
+// kept as bearer authorization headers: the token is written with the prefix of the token header in its place.
+func (s *forwardingSigner) authorize(req *http.Request, authorization string) {
+	if s.tokenHeader == "" {
+		req.Header.Set(authorizationHeader, authorization)
+		return
+	}
+	req.Header.Set(s.tokenHeader, s.tokenPrefix+strings.TrimPrefix(authorization, authorizationType+" "))
+}
+
+// identify adds the agent and the identity of the local caller to a signed request
+func (s *forwardingSigner) identify(req *http.Request) {
+	req.Header.Set(headerXForwardedAgent, version.Prog)
+	if s.workload != nil {
+		s.workload.identify(req)
+	}
+}
+
+// audienceOf returns the audience of the tokens signing the requests to a host, if any
+func (s *forwardingSigner) audienceOf(hostname string) (forwardingAudience, bool) {
+	for _, x := range s.audiences {
+		if strings.Contains(hostname, x.domain) {
+			return x, true
+		}
+	}
+
+	return forwardingAudience{}, false
+}
+
+// authorizationOf returns the authorization of the requests to a host: the current token, or the token of the
+// audience of the host. When the token of the audience can't be had, the request is signed with the current token.
+func (s *forwardingSigner) authorizationOf(ctx context.Context, hostname string, signature *forwardingSignature) string {
+	x, found := s.audienceOf(hostname)
+	if !found {
+		return signature.authorization
+	}
+	if x.granted {
+		return s.grantedAuthorizationOf(ctx, hostname, x.audience, signature)
+	}
+	if s.exchange == nil {
+		return signature.authorization
+	}
+	audience := x.audience
+
+	s.exchangedLock.RLock()
+	exchanged, found := s.exchanged[audience]
+	s.exchangedLock.RUnlock()
+	if found && exchanged.base == signature.token && s.now().Before(exchanged.renewAt) {
+		return exchanged.authorization
+	}
+
+	authorization, err, _ := s.exchanges.Do(audience, func() (interface{}, error) {
+		token, expires, err := s.exchange(signature.token, audience)
+		if err != nil {
+			// @metric a token exchange of the forwarding proxy has failed
+			oauthTokensMetric.WithLabelValues("forwarding-token-exchange-failed").Inc()
+			return nil, err
+		}
+		// @metric a token has been exchanged by the forwarding proxy
+		oauthTokensMetric.WithLabelValues("forwarding-token-exchange").Inc()
+
+		now := s.now()
+		exchanged := forwardingExchange{
+			base:          signature.token,
+			authorization: "Bearer " + token,
+			renewAt:       now.Add(getWithin(expires, now, 0.85)),
+		}
+		s.exchangedLock.Lock()
+		if s.exchanged == nil {
+			s.exchanged = make(map[string]forwardingExchange)
+		}
+		s.exchanged[audience] = exchanged
+		s.exchangedLock.Unlock()
+
+		return exchanged.authorization, nil
+	})
+	if err != nil {
+		s.log.Warn("unable to exchange the access token, the request is signed with the forwarding token",
+			zap.String("host", hostname),
+			zap.String("audience", audience),
+			zap.Error(err))
+
+		return signature.authorization
+	}
+
+	return authorization.(string)
+}
+
+// grantedAuthorizationOf returns the authorization of the token acquired for an audience, asking the refresh loop
+// to acquire it on first use, or once dropped after being unused
+func (s *forwardingSigner) grantedAuthorizationOf(ctx context.Context, hostname, audience string, signature *forwardingSignature) string {
+	s.use(audience)
+	if granted, ok := s.granted.Load().(map[string]string); ok {
+		if authorization, found := granted[audience]; found {
+			return authorization
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, forwardingAcquisitionTimeout)
+	defer cancel()
+	acquisition := forwardingAcquisition{audience: audience, authorization: make(chan string, 1)}
+	select {
+	case s.acquisitions <- acquisition:
+		select {
+		case authorization := <-acquisition.authorization:
+			if authorization != "" {
+				return authorization
+			}
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+	s.log.Warn("unable to acquire the token of the audience, the request is signed with the forwarding token",
+		zap.String("host", hostname),
+		zap.String("audience", audience))
+
+	return signature.authorization
+}
+
+// now returns the current time on the clock of the signer
+func (s *forwardingSigner) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+
+	return s.clock.Now()
+}
+
+// use records the use of the token of an audience
+func (s *forwardingSigner) use(audience string) {
+	now := s.now().Unix()
+	if last, loaded := s.grantedUses.LoadOrStore(audience, &now); loaded {
+		atomic.StoreInt64(last.(*int64), now)
+	}
+}
+
+// lastUse returns the last time the token of an audience has been used
+func (s *forwardingSigner) lastUse(audience string) time.Time {
+	last, found := s.grantedUses.Load(audience)
+	if !found {
+		return time.Time{}
+	}
 
-	sync.RWMutex
+	return time.Unix(atomic.LoadInt64(last.(*int64)), 0)
+}
+
+// publish swaps the authorizations of the tokens acquired for the audiences
+func (s *forwardingSigner) publish(tokens map[string]*forwardingGrantedToken) {
+	granted := make(map[string]string, len(tokens))
+	for audience, x := range tokens {
+		granted[audience] = x.authorization
+	}
+	s.granted.Store(granted)
 }
 
 // forwardProxyHandler is responsible for signing outbound requests
 func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
-	client, err := r.client.OAuthClient()
-	if err != nil {
-		r.log.Fatal("failed to create oauth client", zap.Error(err))
+	// the exclusions have been checked with the configuration
+	exclusions, _ := newForwardingExclusions(r.config.ForwardingExcludePaths)
+	signer := &forwardingSigner{
+		domains:      r.config.ForwardingDomains,
+		audiences:    newForwardingAudiences(r.config.ForwardingAudiences, r.config.ForwardingDomainAudience),
+		acquisitions: make(chan forwardingAcquisition),
+		log:          r.log,
+		clock:        r.clock,
+		tokenHeader:  r.config.ForwardingTokenHeader,
+		tokenPrefix:  r.config.ForwardingTokenPrefix,
+		exclusions:   exclusions,
+	}
+	if r.config.EnableForwardingWorkloadIdentity {
+		pod, err := resolveKubernetesPod(kubernetesServiceAccountDir)
+		if err != nil {
+			r.log.Warn("unable to resolve the pod of the workload, its identity headers are sent without it", zap.Error(err))
+		}
+		signer.workload = newForwardingWorkload(r.config, pod)
+		r.log.Info("adding the workload identity to the signed requests",
+			zap.String("workload", signer.workload.name),
+			zap.String("pod", pod))
+	}
+	if len(r.config.ForwardingAudiences) > 0 {
+		signer.exchange = func(token, audience string) (string, time.Time, error) {
+			return r.exchangeToken(r.forwardCtx, token, audience)
+		}
 	}
 
+	// each identity has its own login and refresh loop, the default one also acquiring the tokens of the audiences
+	identities := make([]*forwardingIdentity, 0, len(r.config.ForwardingIdentities))
+	for _, x := range r.config.ForwardingIdentities {
+		identities = append(identities, r.newForwardingIdentity(x))
+	}
+	signer.identities = newForwardingIdentityDomains(identities, r.config.ForwardingIdentities)
+	username, _ := r.forwardCredentials.user()
+	r.forwardWaitGroup.Go(func() error {
+		return r.forwardingLoop(&forwardingIdentity{
+			name:        defaultTo(username, r.config.ClientID),
+			login:       r.forwardingLogin,
+			refreshes:   true,
+			update:      signer.update,
+			credentials: r.forwardCredentials,
+		}, signer, signer.acquisitions)
+	})
+	for _, identity := range identities {
+		identity := identity
+		r.forwardWaitGroup.Go(func() error {
+			return r.forwardingLoop(identity, signer, nil)
+		})
+	}
+
+	return func(req *http.Request, resp *http.Response) {
+		signer.sign(req)
+	}
+}
+
+// forwardingLoop logs the identity in, then refreshes its access token or logs in again before it expires, until
+// the forwarding proxy stops
+func (r *oauthProxy) forwardingLoop(identity *forwardingIdentity, signer *forwardingSigner, acquisitions <-chan forwardingAcquisition) error {
+	log := r.log.With(zap.String("identity", identity.name))
 	state := &forwardingState{
-		login: true,
+		login:     true,
+		audiences: make(map[string]*forwardingGrantedToken),
+	}
+	if identity.credentials != nil {
+		state.relogin = identity.credentials.relogin
 	}
+	defer forwardingTokenExpiryMetric.remove(identity.name)
+	defer forwardingLoginBackoffMetric.DeleteLabelValues(identity.name)
+	for {
+		select {
+		case <-r.forwardCtx.Done():
+			return nil
+		default:
+		}
 
-	// create a routine to refresh the access tokens or login on expiration
-	r.forwardWaitGroup.Go(func() error {
-		for {
-			select {
-			case <-r.forwardCtx.Done():
-				return nil
-			default:
+		state.wait = false
+
+		// step: do we have a access token
+		if state.login {
+			// step: login into the service
+			var (
+				token   jose.JWT
+				subject *oidc.Identity
+			)
+			if state.reload && identity.credentials != nil {
+				identity.credentials.reload()
+			}
+			state.reload = false
+			resp, err := identity.login(r.forwardCtx)
+			if err == nil {
+				// step: parse the token
+				token, subject, err = parseToken(resp.AccessToken)
+			}
+			if err != nil {
+				// @metric the forwarding proxy has failed to login
+				forwardingLoginMetric.WithLabelValues("failure").Inc()
+
+				// step: back-off and reschedule, with the credentials read again if rejected, as they may have been rotated
+				state.failures++
+				state.reload = isRejectedCredential(err)
+				if r.waitAfterLoginFailure(log, identity, state, err) != nil {
+					return nil
+				}
+				continue
+			}
+			if state.failures > 0 {
+				log.Info("the login of the forwarding proxy has recovered",
+					zap.Int("attempts", state.failures+1),
+					zap.Int("suppressed", state.suppressed))
 			}
+			state.failures = 0
+			state.lastFailure = ""
+			state.lastStep = 0
+			state.suppressed = 0
+			// @metric the login of the forwarding proxy is no longer backing off
+			forwardingLoginBackoffMetric.WithLabelValues(identity.name).Set(0)
 
-			state.Lock()
-			state.wait = false
-			cloneState := state
-			state.Unlock()
+			// step: update the loop state
+			state.token = token
+			state.identity = subject
+			state.expiration = subject.ExpiresAt
+			state.wait = true
+			state.login = false
+			state.refresh = resp.RefreshToken
+			identity.update(token)
 
-			// step: do we have a access token
-			if cloneState.login {
-				r.log.Info("requesting access token for user",
-					zap.String("username", r.config.ForwardingUsername))
+			// @metric the forwarding proxy has logged in, and the lifetime left to its new token
+			forwardingLoginMetric.WithLabelValues("success").Inc()
+			forwardingTokenExpiryMetric.set(identity.name, state.expiration)
 
-				// step: login into the service
-				resp, err := client.UserCredsToken(r.config.ForwardingUsername, r.config.ForwardingPassword)
-				if err != nil {
-					r.log.Error("failed to login to authentication service", zap.Error(err))
-					// step: back-off and reschedule
-					select {
-					case <-r.forwardCtx.Done():
-						return nil
-					case <-time.After(time.Duration(5) * time.Second):
-					}
-					continue
-				}
+			log.Info("successfully retrieved access token for subject",
+				zap.String("subject", state.identity.ID),
+				zap.String("email", state.identity.Email),
+				zap.String("expires", state.expiration.Format(time.RFC3339)),
+			)
 
-				// step: parse the token
-				token, identity, err := parseToken(resp.AccessToken)
+		} else {
+			log.Info("access token is about to expiry",
+				zap.String("subject", state.identity.ID),
+				zap.String("email", state.identity.Email))
+
+			// step: if we a have a refresh token, we need to login again
+			if state.refresh != "" && identity.refreshes {
+				log.Info("attempting to refresh the access token",
+					zap.String("subject", state.identity.ID),
+					zap.String("email", state.identity.Email),
+					zap.String("expires", state.expiration.Format(time.RFC3339)))
+
+				// step: attempt to refresh the access
+				token, newRefreshToken, _, expiration, _, err := r.getRefreshedToken(r.forwardCtx, state.refresh)
 				if err != nil {
-					r.log.Error("failed to parse the access token", zap.Error(err))
-					// step: we should probably hope and reschedule here
-					select {
-					case <-r.forwardCtx.Done():
-						return nil
-					case <-time.After(time.Duration(5) * time.Second):
+					state.login = true
+					state.reload = true
+					switch err {
+					case ErrRefreshTokenExpired:
+						// @metric the refresh token of the forwarding proxy has expired
+						forwardingRefreshMetric.WithLabelValues("expired").Inc()
+						log.Warn("the refresh token has expired, need to login again",
+							zap.String("subject", state.identity.ID),
+							zap.String("email", state.identity.Email))
+					default:
+						// @metric the forwarding proxy has failed to refresh its token
+						forwardingRefreshMetric.WithLabelValues("failure").Inc()
+						log.Error("failed to refresh the access token", zap.Error(err))
 					}
+
 					continue
 				}
 
-				// step: update the loop state
-				state.Lock()
+				// step: update the state
 				state.token = token
-				state.identity = identity
-				state.expiration = identity.ExpiresAt
+				state.expiration = expiration
 				state.wait = true
 				state.login = false
-				state.refresh = resp.RefreshToken
+				if newRefreshToken != "" {
+					state.refresh = newRefreshToken
+				}
+				identity.update(token)
+
+				// @metric the forwarding proxy has refreshed its token, and the lifetime left to the new token
+				forwardingRefreshMetric.WithLabelValues("success").Inc()
+				forwardingTokenExpiryMetric.set(identity.name, state.expiration)
 
-				r.log.Info("successfully retrieved access token for subject",
+				// step: add some debugging
+				log.Info("successfully refreshed the access token",
 					zap.String("subject", state.identity.ID),
 					zap.String("email", state.identity.Email),
 					zap.String("expires", state.expiration.Format(time.RFC3339)),
 				)
-				state.Unlock()
 
 			} else {
-				r.log.Info("access token is about to expiry",
-					zap.String("subject", cloneState.identity.ID),
-					zap.String("email", cloneState.identity.Email))
-
-				// step: if we a have a refresh token, we need to login again
-				if cloneState.refresh != "" {
-					r.log.Info("attempting to refresh the access token",
-						zap.String("subject", cloneState.identity.ID),
-						zap.String("email", cloneState.identity.Email),
-						zap.String("expires", cloneState.expiration.Format(time.RFC3339)))
-
-					// step: attempt to refresh the access
-					token, newRefreshToken, expiration, _, err := getRefreshedToken(r.client, cloneState.refresh)
-					if err != nil {
-						state.Lock()
-						state.login = true
-						switch err {
-						case ErrRefreshTokenExpired:
-							r.log.Warn("the refresh token has expired, need to login again",
-								zap.String("subject", state.identity.ID),
-								zap.String("email", state.identity.Email))
-						default:
-							r.log.Error("failed to refresh the access token", zap.Error(err))
-						}
-						state.Unlock()
-
-						continue
-					}
+				log.Info("session does not support refresh token, acquiring new token",
+					zap.String("subject", state.identity.ID),
+					zap.String("email", state.identity.Email))
 
-					// step: update the state
-					state.Lock()
-					state.token = token
-					state.expiration = expiration
-					state.wait = true
-					state.login = false
-					if newRefreshToken != "" {
-						state.refresh = newRefreshToken
-					}
+				// we don't have a refresh token, we must perform a login again
+				state.wait = false
+				state.login = true
+				state.reload = true
+			}
+		}
 
-					// step: add some debugging
-					r.log.Info("successfully refreshed the access token",
-						zap.String("subject", state.identity.ID),
-						zap.String("email", state.identity.Email),
-						zap.String("expires", state.expiration.Format(time.RFC3339)),
-					)
-					state.Unlock()
-
-				} else {
-					state.Lock()
-					r.log.Info("session does not support refresh token, acquiring new token",
-						zap.String("subject", state.identity.ID),
-						zap.String("email", state.identity.Email))
-
-					// we don't have a refresh token, we must perform a login again
-					state.wait = false
-					state.login = true
-					state.Unlock()
-				}
+		// wait for an expiration to come close
+		if state.wait {
+			// set the expiration of the access token within a random 85% of actual expiration
+			now := r.now()
+			duration := getWithin(state.expiration, now, 0.85)
+			log.Info("waiting for expiration of access token",
+				zap.String("token_expiration", state.expiration.Format(time.RFC3339)),
+				zap.String("renewal_duration", duration.String()),
+			)
+
+			if !r.waitForwardingRenewal(state, signer, acquisitions, now.Add(duration)) {
+				return nil
 			}
+		}
+	}
+}
 
-			// wait for an expiration to come close
-			if cloneState.wait {
-				// set the expiration of the access token within a random 85% of actual expiration
-				duration := getWithin(cloneState.expiration, 0.85)
-				r.log.Info("waiting for expiration of access token",
-					zap.String("token_expiration", cloneState.expiration.Format(time.RFC3339)),
-					zap.String("renewal_duration", duration.String()),
-				)
+// waitAfterLoginFailure waits for the backoff before the next attempt of a failed login, until the proxy stops. The
+// failure is logged as a warning once per backoff step, the identical failures of the same step being logged at
+// debug level and counted as suppressed in the next warning.
+func (r *oauthProxy) waitAfterLoginFailure(log *zap.Logger, identity *forwardingIdentity, state *forwardingState, err error) error {
+	policy := forwardingLoginBackoff
+	policy.max = r.config.ForwardingLoginBackoffMax
+	step := policy.delay(state.failures, func() float64 { return 0.5 })
+	delay := policy.delay(state.failures, rand.Float64)
 
-				select {
-				case <-r.forwardCtx.Done():
-					return nil
-				case <-time.After(duration):
-				}
+	// @metric the delay before the next attempt of the failed login of the forwarding proxy
+	forwardingLoginBackoffMetric.WithLabelValues(identity.name).Set(delay.Seconds())
+	log.Debug("backing off the login of the forwarding proxy",
+		zap.Int("attempt", state.failures),
+		zap.Duration("step", step),
+		zap.Duration("retry_in", delay))
+
+	if err.Error() == state.lastFailure && step == state.lastStep {
+		state.suppressed++
+		log.Debug("the login of the forwarding proxy failed again, retrying",
+			zap.Int("attempt", state.failures),
+			zap.Duration("retry_in", delay),
+			zap.Error(err))
+	} else {
+		log.Warn("the login of the forwarding proxy failed, retrying",
+			zap.Int("attempt", state.failures),
+			zap.Duration("retry_in", delay),
+			zap.Int("suppressed", state.suppressed),
+			zap.Error(err))
+		state.lastFailure = err.Error()
+		state.lastStep = step
+		state.suppressed = 0
+	}
+
+	woken, err := r.waitRetryUnless(r.forwardCtx, delay, state.relogin)
+	if woken {
+		state.reload = true
+	}
+
+	return err
+}
+
+// waitForwardingRenewal waits until the forwarding token is to be renewed, meanwhile acquiring the tokens of the
+// audiences asked by the signer, if any, and renewing each of them near its own expiry. It returns false once stopped.
+func (r *oauthProxy) waitForwardingRenewal(state *forwardingState, signer *forwardingSigner, acquisitions <-chan forwardingAcquisition, renewAt time.Time) bool {
+	for {
+		next := renewAt
+		for _, x := range state.audiences {
+			if x.renewAt.Before(next) {
+				next = x.renewAt
 			}
 		}
-	})
+		timer := time.NewTimer(r.until(next))
+		select {
+		case <-r.forwardCtx.Done():
+			timer.Stop()
+			return false
+		case <-state.relogin:
+			// the credentials are reloaded, and the identity logs in again at once
+			timer.Stop()
+			state.login = true
+			state.reload = true
+			return true
+		case acquisition := <-acquisitions:
+			timer.Stop()
+			x, found := state.audiences[acquisition.audience]
+			if !found {
+				x = r.acquireForwardingAudience(state, signer, acquisition.audience)
+			}
+			authorization := ""
+			if x != nil {
+				authorization = x.authorization
+			}
+			acquisition.authorization <- authorization
+		case <-timer.C:
+			if !r.now().Before(renewAt) {
+				return true
+			}
+			r.renewForwardingAudiences(state, signer)
+		}
+	}
+}
 
-	return func(req *http.Request, resp *http.Response) {
-		hostname := req.Host
-		req.URL.Host = hostname
-		// is the host being signed?
-		if len(r.config.ForwardingDomains) == 0 || containsSubString(hostname, r.config.ForwardingDomains) {
-			var token jose.JWT
-			state.RLock()
-			token = state.token
-			state.RUnlock()
+// acquireForwardingAudience acquires the token of an audience with the forwarding grant, nil on failure
+func (r *oauthProxy) acquireForwardingAudience(state *forwardingState, signer *forwardingSigner, audience string) *forwardingGrantedToken {
+	token, expiration, err := r.forwardingAudienceLogin(audience)
+	if err != nil {
+		// @metric the acquisition of the token of an audience by the forwarding proxy has failed
+		oauthTokensMetric.WithLabelValues("forwarding-audience-failed").Inc()
+		r.log.Warn("unable to acquire the token of the audience", zap.String("audience", audience), zap.Error(err))
 
-			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.Encode()))
-			req.Header.Set("X-Forwarded-Agent", version.Prog)
+		return nil
+	}
+	// @metric a token has been acquired for an audience by the forwarding proxy
+	oauthTokensMetric.WithLabelValues("forwarding-audience").Inc()
+	r.log.Info("successfully acquired the token of the audience",
+		zap.String("audience", audience),
+		zap.String("expires", expiration.Format(time.RFC3339)))
+
+	now := r.now()
+	x := &forwardingGrantedToken{
+		authorization: "Bearer " + token,
+		expiration:    expiration,
+		renewAt:       now.Add(getWithin(expiration, now, 0.85)),
+	}
+	state.audiences[audience] = x
+	signer.publish(state.audiences)
+
+	return x
+}
+
+// renewForwardingAudiences renews the tokens of the audiences near their expiry, and drops those of the audiences
+// which have not been used for a while
+func (r *oauthProxy) renewForwardingAudiences(state *forwardingState, signer *forwardingSigner) {
+	now := r.now()
+	for audience, x := range state.audiences {
+		if now.Before(x.renewAt) {
+			continue
+		}
+		if now.Sub(signer.lastUse(audience)) > forwardingAudienceIdleTimeout {
+			r.log.Info("dropping the token of an unused audience", zap.String("audience", audience))
+			delete(state.audiences, audience)
+			continue
+		}
+		if r.acquireForwardingAudience(state, signer, audience) != nil {
+			continue
 		}
+		// the current token is kept until it expires, while the renewal is retried
+		if now.After(x.expiration) {
+			delete(state.audiences, audience)
+			continue
+		}
+		x.renewAt = now.Add(forwardingAudienceRetry)
+	}
+	signer.publish(state.audiences)
+}
+
+// forwardingAudienceLogin acquires a token for an audience with the forwarding grant type
+func (r *oauthProxy) forwardingAudienceLogin(audience string) (string, time.Time, error) {
+	form := r.forwardingGrant()
+	form.Set("audience", audience)
+	resp, err := r.requestToken(r.forwardCtx, form)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	_, identity, err := parseToken(resp.AccessToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return resp.AccessToken, identity.ExpiresAt, nil
+}
+
+// forwardingGrant returns the form of the forwarding grant type
+func (r *oauthProxy) forwardingGrant() url.Values {
+	if r.config.ForwardingGrantType == oauth2.GrantTypeClientCreds {
+		return url.Values{
+			"grant_type": []string{oauth2.GrantTypeClientCreds},
+			"scope":      []string{strings.Join(r.config.Scopes, " ")},
+		}
+	}
+
+	return r.forwardingGrantOf(r.forwardCredentials.user())
+}
+
+// forwardingGrantOf returns the form of the password grant of a forwarding user
+func (r *oauthProxy) forwardingGrantOf(username, password string) url.Values {
+	return url.Values{
+		"grant_type": []string{oauth2.GrantTypeUserCreds},
+		"username":   []string{username},
+		"password":   []string{password},
+		"scope":      []string{strings.Join(append(append([]string{}, r.config.Scopes...), oidc.DefaultScope...), " ")},
+	}
+}
+
+// forwardingLogin acquires an access token with the forwarding grant type: as the user of the forwarding credentials,
+// or as the service account of the client. The tokens of the service accounts are usually issued without refresh token,
+// and acquired again before they expire. The request is aborted with the context, e.g. when the proxy shuts down.
+func (r *oauthProxy) forwardingLogin(ctx context.Context) (oauth2.TokenResponse, error) {
+	if r.config.ForwardingGrantType == oauth2.GrantTypeClientCreds {
+		r.log.Info("requesting access token for the service account of the client",
+			zap.String("client_id", r.config.ClientID))
+	} else {
+		username, _ := r.forwardCredentials.user()
+		r.log.Info("requesting access token for user",
+			zap.String("username", username))
+	}
+
+	return r.requestToken(ctx, r.forwardingGrant())
+}
+
+// clientSecret returns the secret the client of the proxy authenticates with, the last read from the
+// forwarding-client-secret-file if set
+func (r *oauthProxy) clientSecret() string {
+	if r.forwardCredentials == nil || r.config.ForwardingClientSecretFile == "" {
+		return r.config.ClientSecret
 	}
+
+	return r.forwardCredentials.clientSecret()
+}
+
+// reloadForwarding wakes the login loop of the forwarding credentials up, to reload them and log in again at once
+func (r *oauthProxy) reloadForwarding() bool {
+	if r.forwardCredentials == nil {
+		return false
+	}
+	r.log.Info("reloading the credentials of the forwarding proxy, and logging in again")
+	r.forwardCredentials.wake()
+
+	return true
 }
 
 // createProxy creates a reverse http proxy client to the upstream
 func (r *oauthProxy) createProxy() error {
-	dialer := (&net.Dialer{
-		KeepAlive: r.config.UpstreamKeepaliveTimeout,
-		Timeout:   r.config.UpstreamTimeout,
-	}).Dial
-
 	tlsConfig, err := r.buildProxyTLSConfig()
 	if err != nil {
 		return err
@@ -347,8 +1362,38 @@ func (r *oauthProxy) createProxy() error {
 		return errors.New("invalid proxy type")
 	}
 
-	proxy.Tr = &http.Transport{
-		Dial:                  dialer,
+	proxy.Tr = r.newForwardingTransport(tlsConfig)
+	proxy.ConnectDial = r.newForwardingConnectDial(tlsConfig)
+
+	return nil
+}
+
+// newForwardingConnectDial returns the dialer of the tunnels which are not intercepted, through the upstream proxy
+// of their host if any
+func (r *oauthProxy) newForwardingConnectDial(tlsConfig *tls.Config) func(network, address string) (net.Conn, error) {
+	dial := newDialer("upstream-local-address", r.config.UpstreamLocalAddress, r.config.UpstreamTimeout, r.config.UpstreamKeepaliveTimeout)
+	proxyOf := newProxyFunc(r.config)
+
+	return func(network, address string) (net.Conn, error) {
+		parent, err := proxyOf(&url.URL{Scheme: secureScheme, Host: address})
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			return dial.Dial(network, address)
+		}
+
+		return dialThroughProxy(context.Background(), dial, tlsConfig, parent, address)
+	}
+}
+
+// newForwardingTransport creates a transport of the forwarding proxy, negotiating http/2 with the destinations unless
+// disabled, as the custom dialer and tls settings would otherwise turn it off. The requests, and the tunnels of the
+// intercepted requests, go through the upstream proxy if any.
+func (r *oauthProxy) newForwardingTransport(tlsConfig *tls.Config) *http.Transport {
+	transport := &http.Transport{
+		Proxy:                 newProxyFunc(r.config).ofRequest,
+		DialContext:           newDialer("upstream-local-address", r.config.UpstreamLocalAddress, r.config.UpstreamTimeout, r.config.UpstreamKeepaliveTimeout),
 		DisableKeepAlives:     !r.config.UpstreamKeepalives,
 		ExpectContinueTimeout: r.config.UpstreamExpectContinueTimeout,
 		ResponseHeaderTimeout: r.config.UpstreamResponseHeaderTimeout,
@@ -356,7 +1401,11 @@ func (r *oauthProxy) createProxy() error {
 		TLSHandshakeTimeout:   r.config.UpstreamTLSHandshakeTimeout,
 		MaxIdleConns:          r.config.MaxIdleConns,
 		MaxIdleConnsPerHost:   r.config.MaxIdleConnsPerHost,
+		ForceAttemptHTTP2:     r.config.UpstreamEnableHTTP2,
+	}
+	if !r.config.UpstreamEnableHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 	}
 
-	return nil
+	return transport
 }
@@ -0,0 +1,156 @@
+//go:build !noforwarding
+// +build !noforwarding
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// forwardingCredentials are the credentials of the forwarding logins, read again from their files when rotated
+type forwardingCredentials struct {
+	// the files of the credentials, if any
+	usernameFile string
+	passwordFile string
+	secretFile   string
+	log          *zap.Logger
+
+	lock     sync.RWMutex
+	username string
+	password string
+	secret   string
+
+	// relogin wakes the login loop up, to reload the credentials and log in again at once
+	relogin chan struct{}
+}
+
+// isForwardingCredentialsValid checks the credentials are either set or read from a file, and the files are readable
+func (r *Config) isForwardingCredentialsValid() error {
+	for option, x := range map[string][2]string{
+		"forwarding-username": {r.ForwardingUsername, r.ForwardingUsernameFile},
+		"forwarding-password": {r.ForwardingPassword, r.ForwardingPasswordFile},
+		"client-secret":       {r.ClientSecret, r.ForwardingClientSecretFile},
+	} {
+		value, location := x[0], x[1]
+		if location == "" {
+			continue
+		}
+		if value != "" {
+			return fmt.Errorf("you cannot set both the %s and the file it is read from", option)
+		}
+		if _, err := os.ReadFile(location); err != nil {
+			return fmt.Errorf("unable to read the %s from %s: %w", option, location, err)
+		}
+	}
+	if r.ForwardingClientSecretFile != "" && r.ClientAssertionKey != "" {
+		return errors.New("you cannot set both the forwarding-client-secret-file and the client-assertion-key, the client authenticates with either")
+	}
+
+	return nil
+}
+
+// newForwardingCredentials returns the credentials of the configuration, reading those which are set by files
+func newForwardingCredentials(config *Config, log *zap.Logger) *forwardingCredentials {
+	c := &forwardingCredentials{
+		usernameFile: config.ForwardingUsernameFile,
+		passwordFile: config.ForwardingPasswordFile,
+		secretFile:   config.ForwardingClientSecretFile,
+		log:          log,
+		username:     config.ForwardingUsername,
+		password:     config.ForwardingPassword,
+		secret:       config.ClientSecret,
+		relogin:      make(chan struct{}, 1),
+	}
+	c.reload()
+
+	return c
+}
+
+// reload reads the credentials from their files again, keeping the last known value of those which can't be read
+func (c *forwardingCredentials) reload() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.username = c.read("forwarding-username-file", c.usernameFile, c.username)
+	c.password = c.read("forwarding-password-file", c.passwordFile, c.password)
+	c.secret = c.read("forwarding-client-secret-file", c.secretFile, c.secret)
+}
+
+// read returns the credential of a file, the last known value when the file can't be read or is empty
+func (c *forwardingCredentials) read(option, location, last string) string {
+	if location == "" {
+		return last
+	}
+	content, err := os.ReadFile(location)
+	if err != nil {
+		c.log.Warn("unable to read the credential of the forwarding proxy, the last known value is kept",
+			zap.String("option", option),
+			zap.Error(err))
+		return last
+	}
+	// the trailing line break of the files written by hand or by the secret mounts is not part of the credential
+	value := strings.TrimRight(string(content), "\r\n")
+	if value == "" {
+		c.log.Warn("the credential file of the forwarding proxy is empty, the last known value is kept",
+			zap.String("option", option),
+			zap.String("file", location))
+		return last
+	}
+	if last != "" && value != last {
+		c.log.Info("the credential of the forwarding proxy has been rotated", zap.String("option", option))
+	}
+
+	return value
+}
+
+// user returns the username and password of the forwarding user
+func (c *forwardingCredentials) user() (string, string) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.username, c.password
+}
+
+// clientSecret returns the secret of the client of the proxy
+func (c *forwardingCredentials) clientSecret() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.secret
+}
+
+// wake asks the login loop to reload the credentials and log in again at once
+func (c *forwardingCredentials) wake() {
+	select {
+	case c.relogin <- struct{}{}:
+	default:
+		// a relogin is already pending
+	}
+}
+
+// isRejectedCredential tells if a login failed as the provider rejected the credentials, which may have been rotated
+func isRejectedCredential(err error) bool {
+	var code oauthErrorCode
+
+	return errors.Is(err, ErrInvalidGrant) || (errors.As(err, &code) && code == "invalid_client")
+}
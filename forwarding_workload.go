@@ -0,0 +1,152 @@
+//go:build !noforwarding
+// +build !noforwarding
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// The workload identity headers added by the forwarding proxy, and their default names
+const (
+	workloadHeaderSource = "source"
+	workloadHeaderName   = "name"
+	workloadHeaderPod    = "pod"
+
+	defaultWorkloadSourceHeader = "X-Forwarded-Workload-Source"
+	defaultWorkloadNameHeader   = "X-Forwarded-Workload-Name"
+	defaultWorkloadPodHeader    = "X-Forwarded-Workload-Pod"
+)
+
+// kubernetesServiceAccountDir is where kubernetes mounts the service account of the pod
+var kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// isForwardingWorkloadValid checks the names of the workload identity headers
+func (r *Config) isForwardingWorkloadValid() error {
+	for kind, header := range r.ForwardingWorkloadHeaders {
+		switch kind {
+		case workloadHeaderSource, workloadHeaderName, workloadHeaderPod:
+		default:
+			return fmt.Errorf("invalid workload identity header %q, must be one of %s|%s|%s", kind, workloadHeaderSource, workloadHeaderName, workloadHeaderPod)
+		}
+		if strings.ContainsAny(header, " \t\r\n:") {
+			return fmt.Errorf("invalid name %q for the workload identity header %s", header, kind)
+		}
+	}
+
+	return nil
+}
+
+// forwardingWorkload adds the identity of the local caller to the outbound requests, so the destination knows which
+// workload the request comes from, and not only the proxy signing it
+type forwardingWorkload struct {
+	// the names of the headers, empty when the header is not added
+	sourceHeader string
+	nameHeader   string
+	podHeader    string
+	// the static name of the workload, if any
+	name string
+	// the namespace/name of the pod, resolved once at startup when running on kubernetes
+	pod string
+	// the destination domains which do not get the identity headers
+	skipDomains []string
+}
+
+// newForwardingWorkload creates the workload identity of the forwarding proxy
+func newForwardingWorkload(config *Config, pod string) *forwardingWorkload {
+	headerOf := func(kind, fallback string) string {
+		if header, found := config.ForwardingWorkloadHeaders[kind]; found {
+			return http.CanonicalHeaderKey(header)
+		}
+		return fallback
+	}
+
+	return &forwardingWorkload{
+		sourceHeader: headerOf(workloadHeaderSource, defaultWorkloadSourceHeader),
+		nameHeader:   headerOf(workloadHeaderName, defaultWorkloadNameHeader),
+		podHeader:    headerOf(workloadHeaderPod, defaultWorkloadPodHeader),
+		name:         config.ForwardingWorkloadName,
+		pod:          pod,
+		skipDomains:  config.ForwardingWorkloadSkipDomains,
+	}
+}
+
+// identify sets the identity headers of an outbound request to a signed host. The values set by the caller are
+// always replaced or removed, so a caller cannot impersonate another workload.
+func (w *forwardingWorkload) identify(req *http.Request) {
+	if containsSubString(req.URL.Hostname(), w.skipDomains) {
+		return
+	}
+	for header, value := range map[string]string{
+		w.sourceHeader: req.RemoteAddr,
+		w.nameHeader:   w.name,
+		w.podHeader:    w.pod,
+	} {
+		switch {
+		case header == "":
+		case value == "":
+			req.Header.Del(header)
+		default:
+			req.Header.Set(header, value)
+		}
+	}
+}
+
+// resolveKubernetesPod returns the namespace/name of the pod, when a service account token is mounted. The bound
+// tokens carry the pod in their claims, the namespace of the service account and the hostname are used otherwise.
+func resolveKubernetesPod(dir string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(dir, "token"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if token, err := jose.ParseJWT(strings.TrimSpace(string(content))); err == nil {
+		if claims, err := token.Claims(); err == nil {
+			if bound, ok := claims["kubernetes.io"].(map[string]interface{}); ok {
+				namespace, _ := bound["namespace"].(string)
+				pod, _ := bound["pod"].(map[string]interface{})
+				name, _ := pod["name"].(string)
+				if namespace != "" && name != "" {
+					return namespace + "/" + name, nil
+				}
+			}
+		}
+	}
+
+	namespace, err := os.ReadFile(filepath.Join(dir, "namespace"))
+	if err != nil {
+		return "", err
+	}
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+
+	return strings.TrimSpace(string(namespace)) + "/" + name, nil
+}
@@ -0,0 +1,85 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// providerSessionID returns the session of the provider the token of the user was issued in, if any
+func providerSessionID(user *userContext) string {
+	for _, name := range []string{claimSessionID, claimSessionState} {
+		if sid, found, err := user.claims.StringClaim(name); err == nil && found && sid != "" {
+			return sid
+		}
+	}
+
+	return ""
+}
+
+// indexProviderSession records the server-side session by the session of the provider, so that the front-channel
+// logout of the provider invalidates it
+func (r *oauthProxy) indexProviderSession(user *userContext, id string, ttl time.Duration) {
+	if !r.config.EnableFrontchannelLogout {
+		return
+	}
+	sid := providerSessionID(user)
+	if sid == "" {
+		return
+	}
+	if err := r.setProviderSession(sid, id, ttl); err != nil {
+		r.log.Warn("unable to index the session by the session of the provider", zap.Error(err))
+	}
+}
+
+// frontchannelLogoutHandler logs the user out when the provider embeds this endpoint in an iframe of its logout page
+// (openid connect front-channel logout): the cookies are cleared, as well as the server-side session opened in the
+// session of the provider (sid). The response is an empty page, which only the provider may frame.
+func (r *oauthProxy) frontchannelLogoutHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, span, logger := r.traceSpan(req.Context(), "front-channel logout handler")
+	if span != nil {
+		defer span.End()
+	}
+
+	issuer, _ := queryParam(req.URL.RawQuery, "iss")
+	if issuer != r.idp.Issuer.String() {
+		r.errorResponse(w, req.WithContext(ctx), "the issuer of the front-channel logout does not match the provider", http.StatusBadRequest, nil)
+		return
+	}
+
+	// @metric increment the logout counter
+	oauthTokensMetric.WithLabelValues("logout").Inc()
+
+	r.clearAllCookies(req, w)
+	if sid, _ := queryParam(req.URL.RawQuery, "sid"); sid != "" && r.config.EnableServerSideSessions {
+		if err := r.deleteProviderSession(sid); err != nil {
+			logger.Warn("unable to remove the session of the provider from the store", zap.Error(err))
+		}
+	}
+
+	// the security filter denies the frames, but the provider must frame this page
+	w.Header().Del(headerXFrameOptions)
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+r.idp.Issuer.Scheme+"://"+r.idp.Issuer.Host)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,104 @@
+//go:build !noreverse && !nostores
+// +build !noreverse,!nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resty "gopkg.in/resty.v1"
+)
+
+func TestFrontchannelLogoutDisabled(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:          cfg.WithOAuthURI(frontchannelLogoutURL) + "?iss=test&sid=test",
+			ExpectedCode: http.StatusNotFound,
+		},
+	})
+}
+
+func TestFrontchannelLogout(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableFrontchannelLogout = true
+	cfg.EnableRefreshTokens = true
+	cfg.EnableServerSideSessions = true
+	cfg.EnableSecurityFilter = true
+	cfg.EnableFrameDeny = true
+	cfg.EncryptionKey = testKey
+	cfg.StoreURL = "memory://"
+	p := newFakeProxy(cfg)
+	issuer := p.proxy.idp.Issuer
+	sid, ok := defaultTestTokenClaims[claimSessionState].(string)
+	require.True(t, ok)
+
+	var sessionID string
+	login := func(int, *resty.Request, *resty.Response) {
+		cookie, found := p.cookies[cfg.CookieRefreshName]
+		require.True(t, found)
+		sessionID = cookie.Value
+		id, err := p.proxy.store.Get(providerSessionPrefix + sid)
+		require.NoError(t, err)
+		assert.Equal(t, sessionID, id)
+	}
+	logout := func(_ int, _ *resty.Request, resp *resty.Response) {
+		assert.Empty(t, resp.Header().Get(headerXFrameOptions))
+		assert.Empty(t, resp.Body())
+		assert.Contains(t, strings.Join(resp.Header()["Set-Cookie"], "\n"), cfg.CookieAccessName+"=")
+
+		// the server-side session of the provider session is gone
+		value, err := p.proxy.store.Get(serverSessionPrefix + sessionID)
+		require.NoError(t, err)
+		assert.Empty(t, value)
+	}
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    login,
+		},
+		{
+			// the logout of another provider is refused
+			URI:          cfg.WithOAuthURI(frontchannelLogoutURL) + "?iss=" + url.QueryEscape("https://other.example.com/auth/realms/test") + "&sid=" + sid,
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			URI:          cfg.WithOAuthURI(frontchannelLogoutURL) + "?sid=" + sid,
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			URI:          cfg.WithOAuthURI(frontchannelLogoutURL) + "?iss=" + url.QueryEscape(issuer.String()) + "&sid=" + sid,
+			ExpectedCode: http.StatusOK,
+			ExpectedHeaders: map[string]string{
+				"Content-Security-Policy": "frame-ancestors " + issuer.Scheme + "://" + issuer.Host,
+				"Content-Type":            "text/html; charset=utf-8",
+			},
+			OnResponse: logout,
+		},
+	})
+}
@@ -22,6 +22,7 @@ require (
 	github.com/fsnotify/fsnotify v1.5.4
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
+	github.com/google/cel-go v0.12.6
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/csrf v1.7.1
 	github.com/gorilla/websocket v1.5.0
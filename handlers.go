@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -16,7 +19,6 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -33,6 +35,7 @@ import (
 
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
 	gcsrf "github.com/gorilla/csrf"
 	"github.com/oneconcern/keycloak-gatekeeper/version"
 
@@ -56,18 +59,22 @@ func (r *oauthProxy) getRedirectionURL(w http.ResponseWriter, req *http.Request)
 		if req.TLS != nil {
 			scheme = secureScheme
 		}
-		// @QUESTION: should I use the X-Forwarded-<header>?? ..
-		redirect = fmt.Sprintf("%s://%s",
-			defaultTo(req.Header.Get("X-Forwarded-Proto"), scheme),
-			defaultTo(req.Header.Get("X-Forwarded-Host"), req.Host))
+		scheme = defaultTo(req.Header.Get("X-Forwarded-Proto"), scheme)
+		host := defaultTo(req.Header.Get("X-Forwarded-Host"), req.Host)
+		// the Forwarded header sent by trusted proxies takes precedence
+		if forwarded := getForwarded(req); forwarded != nil {
+			scheme = defaultTo(forwarded.Proto, scheme)
+			host = defaultTo(forwarded.Host, host)
+		}
+		redirect = fmt.Sprintf("%s://%s", scheme, host)
 	default:
 		redirect = r.config.RedirectionURL
 	}
 
-	state, _ := req.Cookie(requestStateCookie)
-	if state != nil && req.URL.Query().Get("state") != state.Value {
-		logger.Error("state in cookie and url query parameter do not match", zap.String("cookie-state", state.Value),
-			zap.String("url-state", req.URL.Query().Get("state")))
+	state, _, found := r.getStateParameter(req)
+	if queryState, _ := queryParam(req.URL.RawQuery, "state"); found && queryState != state {
+		logger.Error("state in cookie and url query parameter do not match", zap.String("cookie-state", state),
+			zap.String("url-state", queryState))
 		// clear all cookies in response
 		r.clearAllCookies(req, w)
 		r.errorResponse(w, req.WithContext(ctx), "state parameter mismatch", http.StatusForbidden, nil)
@@ -88,7 +95,14 @@ func (r *oauthProxy) oauthAuthorizationHandler(w http.ResponseWriter, req *http.
 		return
 	}
 
-	client, err := r.getOAuthClient(r.getRedirectionURL(w, req.WithContext(ctx)))
+	// step: the login may ask for an offline session, e.g. to keep the user signed in
+	var scopes []string
+	if offline, _ := queryParam(req.URL.RawQuery, "offline"); offline == "true" && r.config.EnableOfflineTokens &&
+		!containedIn(scopeOfflineAccess, r.config.Scopes, false) {
+		scopes = append(scopes, scopeOfflineAccess)
+	}
+
+	client, err := r.getOAuthClient(r.getRedirectionURL(w, req.WithContext(ctx)), scopes...)
 	if err != nil {
 		r.errorResponse(w, req.WithContext(ctx), "failed to retrieve the oauth client for authorization", http.StatusInternalServerError, err)
 		return
@@ -100,7 +114,34 @@ func (r *oauthProxy) oauthAuthorizationHandler(w http.ResponseWriter, req *http.
 		accessType = "offline"
 	}
 
-	authURL := client.AuthCodeURL(req.URL.Query().Get("state"), accessType, "")
+	queryState, _ := queryParam(req.URL.RawQuery, "state")
+	authURL := client.AuthCodeURL(queryState, accessType, "")
+
+	// step: bind the id token to the authorization with a nonce, kept with the state
+	if state, nonce, found := r.getStateParameter(req); found && state == queryState && nonce != "" {
+		authURL = authURL + "&" + url.Values{"nonce": {nonce}}.Encode()
+		// step: a step-up asks for a new login at the authentication context class required
+		if acr, _, stepUp := r.getStepUp(req, queryState); stepUp {
+			authURL = authURL + "&" + url.Values{"acr_values": {acr}, "prompt": {"login"}}.Encode()
+		}
+	} else {
+		authURL = authURL + "&" + url.Values{"nonce": {r.writeAuthorizationStateCookie(req, w, queryState)}}.Encode()
+	}
+
+	// step: add a proof key for code exchange, the verifier is kept until the callback
+	if r.pkce {
+		verifier, err := newCodeVerifier()
+		if err != nil {
+			r.errorResponse(w, req.WithContext(ctx), "failed to generate a code verifier", http.StatusInternalServerError, err)
+			return
+		}
+		if err := r.writeCodeVerifierCookie(req, w, queryState, verifier); err != nil {
+			r.errorResponse(w, req.WithContext(ctx), "failed to encode the code verifier", http.StatusInternalServerError, err)
+			return
+		}
+		challenge := url.Values{"code_challenge": {codeChallenge(verifier)}, "code_challenge_method": {codeChallengeMethodS256}}
+		authURL = authURL + "&" + challenge.Encode()
+	}
 	logger.Debug("incoming authorization request from client address",
 		zap.String("access_type", accessType),
 		zap.String("auth_url", authURL),
@@ -117,8 +158,7 @@ func (r *oauthProxy) oauthAuthorizationHandler(w http.ResponseWriter, req *http.
 		return
 	}
 
-	demo := req.URL.Query().Get("demo")
-	if demo != "" {
+	if demo, _ := queryParam(req.URL.RawQuery, "demo"); demo != "" {
 		newParams := url.Values{"demo": {demo}}
 		q := newParams.Encode()
 		authURL = authURL + "&" + q
@@ -138,20 +178,43 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 		r.errorResponse(w, req.WithContext(ctx), "", http.StatusNotAcceptable, nil)
 		return
 	}
-	// step: ensure we have a authorization code
-	code := req.URL.Query().Get("code")
-	if code == "" {
-		r.errorResponse(w, req.WithContext(ctx), "no code in query", http.StatusBadRequest, nil)
+	// step: the provider may return an error instead of a code, e.g. when the user denied the authorization
+	if failure, found := queryParam(req.URL.RawQuery, "error"); found {
+		r.callbackErrorHandler(w, req.WithContext(ctx), failure)
+		return
+	}
+	// step: ensure we have a well-formed authorization code and state, before contacting the provider
+	code, _ := queryParam(req.URL.RawQuery, "code")
+	state, hasState := queryParam(req.URL.RawQuery, "state")
+	if reason := checkCallbackParameters(code, state, hasState); reason != "" {
+		r.rejectCallback(w, req, reason)
 		return
 	}
 
-	client, err := r.getOAuthClient(r.getRedirectionURL(w, req.WithContext(ctx)))
+	// step: retrieve the code verifier of the authorization, if any
+	var verifier string
+	if r.pkce {
+		var err error
+		if verifier, err = r.getCodeVerifier(req, state); err != nil {
+			r.errorResponse(w, req.WithContext(ctx), "the code verifier of the authorization is missing or has expired", http.StatusBadRequest, err)
+			return
+		}
+		r.clearCookie(req, w, pkceCookie)
+	}
+
+	redirectionURL := r.getRedirectionURL(w, req.WithContext(ctx))
+	client, err := r.getOAuthClient(redirectionURL)
 	if err != nil {
 		r.errorResponse(w, req.WithContext(ctx), "unable to create a oauth2 client", http.StatusInternalServerError, err)
 		return
 	}
 
-	resp, err := exchangeAuthenticationCode(client, code)
+	var resp oauth2.TokenResponse
+	if verifier != "" || r.clientAssertion != nil {
+		resp, err = r.exchangeAuthenticationCodeWithVerifier(ctx, code, redirectionURL, verifier)
+	} else {
+		resp, err = r.exchangeAuthenticationCode(ctx, client, code)
+	}
 	if err != nil {
 		r.accessForbidden(w, req.WithContext(ctx), "unable to exchange code for access token", err.Error())
 		return
@@ -166,6 +229,17 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 
 		return
 	}
+
+	// step: the id token must carry the nonce of the authorization, else it may be replayed from another one
+	if _, nonce, found := r.getStateParameter(req); found {
+		if err = checkNonce(token, nonce); err != nil {
+			logger.Error("nonce in cookie and id token do not match", zap.String("cookie-nonce", nonce), zap.Error(err))
+			// clear all cookies in response
+			r.clearAllCookies(req, w)
+			r.errorResponse(w, req.WithContext(ctx), "nonce mismatch", http.StatusForbidden, nil)
+			return
+		}
+	}
 	access, id, err := parseToken(resp.AccessToken)
 	if err == nil {
 		token = access
@@ -191,39 +265,129 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 
 		return
 	}
+	if err := r.openSession(w, req.WithContext(ctx), token, identity, resp, logger); err != nil {
+		r.errorResponse(w, req.WithContext(ctx), "unable to open the session", http.StatusInternalServerError, err)
+		return
+	}
+
+	// step: a step-up returns the user to the uri requested, once authenticated at the level required
+	queryState, _ := queryParam(req.URL.RawQuery, "state")
+	acr, stepUpURI, stepUp := r.getStepUp(req, queryState)
+	if stepUp && !acrSatisfies(acrOf(token), acr) {
+		r.accessForbidden(w, req.WithContext(ctx), "the authentication level required was not reached")
+		return
+	}
+
+	// step: decode the request variable
+	redirectURI := "/"
+	if stepUp {
+		redirectURI = stepUpURI
+	} else if queryState != "" && r.keepsRequestURI() {
+		// the uri requested before the login is kept in the store, the state being its handle
+		redirectURI = r.takeRequestURI(req, queryState, logger)
+	} else if queryState != "" {
+		// if the authorization has set a state, we now check if the calling client
+		// requested a specific landing URL to end the authentication handshake
+		if encodedRequestURI, _ := req.Cookie(r.requestCookieName(req, requestURICookie)); encodedRequestURI != nil {
+			// some clients URL-escape padding characters
+			unescapedValue, err := url.PathUnescape(encodedRequestURI.Value)
+			if err != nil {
+				logger.Warn("app did send a corrupted redirectURI in cookie: invalid url espcaping", zap.Error(err))
+			}
+			// Since the value is passed with a cookie, we do not expect the client to use base64url (but the
+			// base64-encoded value may itself be url-encoded).
+			// This is safe for browsers using atob() but needs to be treated with care for nodeJS clients,
+			// which natively use base64url encoding, and url-escape padding '=' characters.
+			decoded, err := base64.StdEncoding.DecodeString(unescapedValue)
+			if err != nil {
+				logger.Warn("app did send a corrupted redirectURI in cookie: invalid base64url encoding",
+					zap.Error(err),
+					zap.String("encoded_value", unescapedValue))
+			}
+			redirectURI = string(decoded)
+		}
+	}
+
+	// step: the cookie may have been set by a sibling domain, so we only redirect to local paths or to allowed urls
+	switch {
+	case isRelativeRedirect(redirectURI):
+		if r.config.BaseURI != "" {
+			// assuming state starts with slash
+			redirectURI = r.config.BaseURI + redirectURI
+		}
+	case r.isAllowedRedirect(redirectURI):
+	default:
+		logger.Warn("refusing to redirect to an url which is not allowed", zap.String("redirect_uri", redirectURI))
+		redirectURI = defaultTo(r.config.BaseURI, "/")
+	}
+
+	// step: a request interrupted by the login is only replayed once confirmed by the user
+	if r.config.EnableLoginReplay {
+		if queryState, _ := queryParam(req.URL.RawQuery, "state"); r.renderLoginReplay(w, req.WithContext(ctx), queryState, redirectURI) {
+			return
+		}
+	}
+
+	r.redirectToRequestURI(redirectURI, w, req.WithContext(ctx), http.StatusTemporaryRedirect)
+}
+
+// openSession drops the cookies of a new session, once the tokens of a grant are verified: the access token, the
+// refresh token kept in a server-side session, in the store or in its own cookie, and the id token when kept
+func (r *oauthProxy) openSession(w http.ResponseWriter, req *http.Request, token jose.JWT, identity *oidc.Identity, resp oauth2.TokenResponse, logger Logger) error {
 	accessToken := token.Encode()
 
 	// step: are we encrypting the access token?
+	var err error
 	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
 		if accessToken, err = encodeText(accessToken, r.config.EncryptionKey); err != nil {
-			r.errorResponse(w, req.WithContext(ctx), "unable to encode the access token", http.StatusInternalServerError, err)
-
-			return
+			return fmt.Errorf("unable to encode the access token: %w", err)
 		}
 	}
 
 	logger.Info("issuing access token for user",
 		zap.String("email", identity.Email),
 		zap.String("expires", identity.ExpiresAt.Format(time.RFC3339)),
-		zap.String("duration", time.Until(identity.ExpiresAt).String()))
+		zap.String("duration", r.until(identity.ExpiresAt).String()))
 
 	// @metric a token has been issued
 	oauthTokensMetric.WithLabelValues("issued").Inc()
 
 	// step: does the response have a refresh token and we do NOT ignore refresh tokens?
+	var accessDuration time.Duration
+	var sessionID string
 	if r.config.EnableRefreshTokens && resp.RefreshToken != "" {
 		var encrypted string
 		encrypted, err = encodeText(resp.RefreshToken, r.config.EncryptionKey)
 		if err != nil {
-			r.errorResponse(w, req.WithContext(ctx), "failed to encrypt the refresh token", http.StatusInternalServerError, err)
-			return
+			return fmt.Errorf("failed to encrypt the refresh token: %w", err)
 		}
 
 		// drop in the access token - cookie expiration = access token
-		r.dropAccessTokenCookie(req.WithContext(ctx), w, accessToken, r.getAccessCookieExpiration(token, resp.RefreshToken))
-
-		switch r.useStore() {
-		case true:
+		accessDuration = r.getAccessCookieExpiration(token, resp.RefreshToken)
+		if r.config.EnableOfflineTokens && isOfflineToken(resp.RefreshToken) {
+			// the offline session outlives the session of the provider, the cookies last as long
+			accessDuration = r.config.OfflineSessionDuration
+			logger.Info("opening an offline session for user",
+				zap.String("email", identity.Email),
+				zap.Duration("duration", accessDuration))
+
+			// @metric an offline session has been opened
+			oauthTokensMetric.WithLabelValues("offline").Inc()
+		}
+		r.dropAccessTokenCookie(req, w, accessToken, accessDuration)
+
+		switch {
+		case r.config.EnableServerSideSessions:
+			// the refresh token is kept in the store, the cookie only carries the session id: without
+			// a session, the user is authenticated again once the access token expires
+			if id, err := r.createServerSession(identity.ID, encrypted, accessDuration); err != nil {
+				logger.Warn("failed to save the session in the store", zap.Error(err))
+			} else {
+				r.dropRefreshTokenCookie(req, w, id, accessDuration)
+				sessionID = id
+				r.indexProviderSession(identity, id, accessDuration)
+			}
+		case r.useStore():
 			if err = r.StoreRefreshToken(token, encrypted); err != nil {
 				logger.Warn("failed to save the refresh token in the store", zap.Error(err))
 			}
@@ -231,46 +395,44 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 			// notes: not all idp refresh tokens are readable, google for example, so we attempt to decode into
 			// a jwt and if possible extract the expiration, else we default to 10 days
 			if _, ident, err := parseToken(resp.RefreshToken); err != nil {
-				r.dropRefreshTokenCookie(req.WithContext(ctx), w, encrypted, 0)
+				r.dropRefreshTokenCookie(req, w, encrypted, 0)
 			} else {
-				r.dropRefreshTokenCookie(req.WithContext(ctx), w, encrypted, time.Until(ident.ExpiresAt))
+				r.dropRefreshTokenCookie(req, w, encrypted, r.until(ident.ExpiresAt))
 			}
 		}
 	} else {
-		r.dropAccessTokenCookie(req.WithContext(ctx), w, accessToken, time.Until(identity.ExpiresAt))
+		accessDuration = r.until(identity.ExpiresAt)
+		r.dropAccessTokenCookie(req, w, accessToken, accessDuration)
 	}
 
-	// step: decode the request variable
-	redirectURI := "/"
-	if req.URL.Query().Get("state") != "" {
-		// if the authorization has set a state, we now check if the calling client
-		// requested a specific landing URL to end the authentication handshake
-		if encodedRequestURI, _ := req.Cookie(requestURICookie); encodedRequestURI != nil {
-			// some clients URL-escape padding characters
-			unescapedValue, err := url.PathUnescape(encodedRequestURI.Value)
-			if err != nil {
-				logger.Warn("app did send a corrupted redirectURI in cookie: invalid url espcaping", zap.Error(err))
-			}
-			// Since the value is passed with a cookie, we do not expect the client to use base64url (but the
-			// base64-encoded value may itself be url-encoded).
-			// This is safe for browsers using atob() but needs to be treated with care for nodeJS clients,
-			// which natively use base64url encoding, and url-escape padding '=' characters.
-			decoded, err := base64.StdEncoding.DecodeString(unescapedValue)
-			if err != nil {
-				logger.Warn("app did send a corrupted redirectURI in cookie: invalid base64url encoding",
-					zap.Error(err),
-					zap.String("encoded_value", unescapedValue))
-			}
-			redirectURI = string(decoded)
+	// step: the idle timeout of the session starts with the login
+	if r.config.SessionIdleTimeout > 0 {
+		if err := r.recordSessionActivity(w, req, identity.ID, sessionID, r.now()); err != nil {
+			return fmt.Errorf("unable to record the activity of the session: %w", err)
 		}
 	}
 
-	if r.config.BaseURI != "" {
-		// assuming state starts with slash
-		redirectURI = r.config.BaseURI + redirectURI
+	return r.keepIDToken(w, req, resp.IDToken)
+}
+
+// keepIDToken drops the id token into its cookie, when the id token is kept: the cookie follows the same encryption
+// as the access token, and expires with the id token, so a stale id token is never forwarded upstream
+func (r *oauthProxy) keepIDToken(w http.ResponseWriter, req *http.Request, idToken string) error {
+	if r.config.CookieIDTokenName == "" || idToken == "" {
+		return nil
+	}
+	_, identity, err := parseToken(idToken)
+	if err != nil {
+		return fmt.Errorf("unable to parse the id token: %w", err)
+	}
+	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
+		if idToken, err = encodeText(idToken, r.config.EncryptionKey); err != nil {
+			return fmt.Errorf("unable to encode the id token: %w", err)
+		}
 	}
+	r.dropIDTokenCookie(req, w, idToken, r.until(identity.ExpiresAt))
 
-	r.redirectToURL(redirectURI, w, req.WithContext(ctx), http.StatusTemporaryRedirect)
+	return nil
 }
 
 // loginHandler provide's a generic endpoint for clients to perform a user_credentials login to the provider
@@ -296,9 +458,25 @@ func (r *oauthProxy) loginHandler(w http.ResponseWriter, req *http.Request) {
 		}
 
 		start := time.Now()
-		token, err := client.UserCredsToken(username, password)
+		var token oauth2.TokenResponse
+		// the refused credentials are not retried, so they count once against the brute force detection of the provider
+		err = r.retry(ctx, loginBackoff, func(ctx context.Context) error {
+			var err error
+			if r.clientAssertion != nil {
+				token, err = r.requestToken(ctx, url.Values{
+					"grant_type": []string{oauth2.GrantTypeUserCreds},
+					"username":   []string{username},
+					"password":   []string{password},
+					"scope":      []string{strings.Join(append(r.config.Scopes, oidc.DefaultScope...), " ")},
+				})
+			} else {
+				token, err = client.UserCredsToken(username, password)
+			}
+
+			return refusedGrant(err)
+		})
 		if err != nil {
-			if strings.HasPrefix(err.Error(), oauth2.ErrorInvalidGrant) {
+			if strings.HasPrefix(err.Error(), oauth2.ErrorInvalidGrant) || errors.Is(err, ErrInvalidGrant) {
 				return "invalid user credentials provided", http.StatusUnauthorized, err
 			}
 			return "unable to request the access token via grant_type 'password'", http.StatusInternalServerError, err
@@ -311,7 +489,12 @@ func (r *oauthProxy) loginHandler(w http.ResponseWriter, req *http.Request) {
 			return "unable to decode the access token", http.StatusNotImplemented, err
 		}
 
-		r.dropAccessTokenCookie(req.WithContext(ctx), w, token.AccessToken, time.Until(identity.ExpiresAt))
+		r.dropAccessTokenCookie(req.WithContext(ctx), w, token.AccessToken, r.until(identity.ExpiresAt))
+		if r.config.SessionIdleTimeout > 0 {
+			if err := r.recordSessionActivity(w, req, identity.ID, "", r.now()); err != nil {
+				return "unable to record the activity of the session", http.StatusInternalServerError, err
+			}
+		}
 
 		// @metric a token has been issued
 		oauthTokensMetric.WithLabelValues("login").Inc()
@@ -355,8 +538,23 @@ func (r *oauthProxy) logoutHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// step: can either use the id token or the refresh token
+	identityToken := user.token.Encode()
+	var offline bool
+	if refresh, _, err := r.retrieveRefreshToken(req, user); err == nil {
+		identityToken = refresh
+		offline = r.config.EnableOfflineTokens && isOfflineToken(refresh)
+	}
+
 	// step: check if the user has a state session and if so revoke it
-	if r.useStore() {
+	switch {
+	case r.config.EnableServerSideSessions:
+		if id, err := r.serverSessionID(req); err == nil {
+			if err := r.deleteServerSession(id); err != nil {
+				logger.Warn("unable to remove the session from store", zap.Error(err))
+			}
+		}
+	case r.useStore():
 		go func() {
 			if err := r.DeleteRefreshToken(user.token); err != nil {
 				logger.Error("unable to remove the refresh token from store", zap.Error(err))
@@ -364,10 +562,13 @@ func (r *oauthProxy) logoutHandler(w http.ResponseWriter, req *http.Request) {
 		}()
 	}
 
-	// step: can either use the id token or the refresh token
-	identityToken := user.token.Encode()
-	if refresh, _, err := r.retrieveRefreshToken(req, user); err == nil {
-		identityToken = refresh
+	// step: the offline token outlives the session of the provider, so it is revoked on its own
+	if offline {
+		if err := r.revokeOfflineToken(ctx, identityToken); err != nil {
+			logger.Error("unable to revoke the offline token", zap.Error(err))
+		} else {
+			logger.Info("successfully revoked the offline token")
+		}
 	}
 
 	r.commonLogout(ctx, w, req, identityToken, func(w http.ResponseWriter) {
@@ -384,22 +585,15 @@ func (r *oauthProxy) commonLogout(ctx context.Context, w http.ResponseWriter, re
 
 	// @check if the redirection is there
 	var redirectURL string
-	for k := range req.URL.Query() {
-		if k == "redirect" {
-			redirectURL = req.URL.Query().Get("redirect")
-			if redirectURL == "" {
-				// we can default to redirection url
-				redirectURL = strings.TrimSuffix(r.config.RedirectionURL, "/oauth/callback")
-			}
+	if redirect, found := queryParam(req.URL.RawQuery, "redirect"); found {
+		redirectURL = redirect
+		if redirectURL == "" {
+			// we can default to redirection url
+			redirectURL = strings.TrimSuffix(r.config.RedirectionURL, "/oauth/callback")
 		}
 	}
 
-	// set the default revocation url
-	revokeDefault := ""
-	if r.idp.EndSessionEndpoint != nil {
-		revokeDefault = r.idp.EndSessionEndpoint.String()
-	}
-	revocationURL := defaultTo(r.config.RevocationEndpoint, revokeDefault)
+	revocationURL := r.revocationURL()
 	logger.Debug("logout config",
 		zap.String("redirect_url", redirectURL),
 		zap.String("revocation_url", revocationURL),
@@ -429,35 +623,57 @@ func (r *oauthProxy) commonLogout(ctx context.Context, w http.ResponseWriter, re
 
 	// step: do we have a revocation endpoint?
 	if revocationURL != "" {
-		client, err := r.client.OAuthClient()
-		if err != nil {
-			//nolint:contextcheck
-			r.errorResponse(w, req.WithContext(ctx), "unable to retrieve the openid client", http.StatusInternalServerError, err)
-			return
+		logger.Debug("revoking user session")
+		if err := r.revokeRefreshToken(ctx, revocationURL, token); err != nil {
+			logger.Error("unable to revoke the session on the revocation endpoint", zap.Error(err))
+		} else {
+			logger.Info("successfully logged out of the endpoint")
 		}
+	}
+
+	// step: should we redirect the user
+	if redirectURL != "" {
+		logger.Debug("redirecting to logout", zap.String("url", redirectURL))
+		r.redirectToURL(redirectURL, w, req.WithContext(ctx), http.StatusTemporaryRedirect)
+	} else {
+		successResponder(w)
+	}
+}
 
-		// step: add the authentication headers
-		encodedID := url.QueryEscape(r.config.ClientID)
-		encodedSecret := url.QueryEscape(r.config.ClientSecret)
+// revocationURL returns the endpoint revoking the refresh tokens, empty when there is none
+func (r *oauthProxy) revocationURL() string {
+	revokeDefault := ""
+	if r.idp.EndSessionEndpoint != nil {
+		revokeDefault = r.idp.EndSessionEndpoint.String()
+	}
 
-		logger.Debug("revoking user session")
-		// step: construct the url for revocation
-		request, err := http.NewRequestWithContext(ctx, http.MethodPost, revocationURL, bytes.NewBufferString(fmt.Sprintf("refresh_token=%s", token)))
-		if err != nil {
-			//nolint:contextcheck
-			r.errorResponse(w, req.WithContext(ctx), "unable to construct the revocation request", http.StatusInternalServerError, err)
-			return
-		}
+	return defaultTo(r.config.RevocationEndpoint, revokeDefault)
+}
+
+// revokeRefreshToken posts the refresh token to the revocation endpoint, authenticated as the client
+func (r *oauthProxy) revokeRefreshToken(ctx context.Context, revocationURL, token string) error {
+	return r.postRevocation(ctx, revocationURL, url.Values{"refresh_token": []string{token}}, http.StatusNoContent)
+}
 
-		// step: add the authentication headers and content-type
-		request.SetBasicAuth(encodedID, encodedSecret)
-		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+// revokeOfflineToken revokes an offline token at the token revocation endpoint (RFC 7009) of the provider: unlike the
+// other refresh tokens, it is not revoked with the session of the provider
+// NOTE: this endpoint is keycloak-specific
+func (r *oauthProxy) revokeOfflineToken(ctx context.Context, token string) error {
+	revocationURL := fmt.Sprintf("%s/protocol/openid-connect/revoke", strings.TrimSuffix(r.config.DiscoveryURL, "/.well-known/openid-configuration"))
 
+	return r.postRevocation(ctx, revocationURL, url.Values{
+		"token":           []string{token},
+		"token_type_hint": []string{"refresh_token"},
+	}, http.StatusOK)
+}
+
+// postRevocation posts a token to a revocation endpoint, authenticated as the client
+func (r *oauthProxy) postRevocation(ctx context.Context, revocationURL string, form url.Values, expected int) error {
+	return r.retry(ctx, revocationBackoff, func(ctx context.Context) error {
 		start := time.Now()
-		response, err := client.HttpClient().Do(request)
+		response, err := r.postAsClient(ctx, revocationURL, form)
 		if err != nil {
-			logger.Error("unable to post to revocation endpoint", zap.Error(err))
-			return
+			return err
 		}
 		defer func() {
 			_ = response.Body.Close()
@@ -465,25 +681,18 @@ func (r *oauthProxy) commonLogout(ctx context.Context, w http.ResponseWriter, re
 
 		oauthLatencyMetric.WithLabelValues("revocation").Observe(time.Since(start).Seconds())
 
-		// step: check the response
-		switch response.StatusCode {
-		case http.StatusNoContent:
-			logger.Info("successfully logged out of the endpoint")
-		default:
-			content, _ := io.ReadAll(response.Body)
-			logger.Error("invalid response from revocation endpoint",
-				zap.Int("status", response.StatusCode),
-				zap.ByteString("response", content))
+		// step: check the response, only the failures of the provider are retried
+		if response.StatusCode == expected {
+			return nil
+		}
+		content, _ := io.ReadAll(response.Body)
+		err = fmt.Errorf("invalid response from revocation endpoint, status %d: %s", response.StatusCode, content)
+		if response.StatusCode < http.StatusInternalServerError {
+			return permanent(err)
 		}
-	}
 
-	// step: should we redirect the user
-	if redirectURL != "" {
-		logger.Debug("redirecting to logout", zap.String("url", redirectURL))
-		r.redirectToURL(redirectURL, w, req.WithContext(ctx), http.StatusTemporaryRedirect)
-	} else {
-		successResponder(w)
-	}
+		return err
+	})
 }
 
 // expirationHandler checks if the token has expired
@@ -494,7 +703,7 @@ func (r *oauthProxy) expirationHandler(w http.ResponseWriter, req *http.Request)
 	}
 
 	user, err := r.getIdentity(req)
-	if err != nil || user.isExpired() {
+	if err != nil || user.isExpired(r.now()) {
 		r.errorResponse(w, req.WithContext(ctx), "", http.StatusUnauthorized, nil)
 		return
 	}
@@ -558,12 +767,31 @@ func (r *oauthProxy) tokenHandler(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// healthHandler is a health check handler for the service
+// healthHandler is a health check handler for the service. The dependencies are checked when enabled, responding
+// 503 whenever a critical dependency is down. The certificates close to their expiry and the stale documents of the
+// provider only turn the status into a warning, still responding 200.
 func (r *oauthProxy) healthHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", jsonMime)
 	w.Header().Set(versionHeader, version.GetVersion())
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte(`{"status":"OK"}`))
+
+	response := healthResponse{Status: healthStatusOK}
+	if r.config.HealthCheckDependencies {
+		w.Header().Set("Cache-Control", "no-store")
+		response = r.checkDependencies(req.Context())
+	}
+	if r.jwks != nil {
+		if refreshed := r.jwks.lastRefresh(); !refreshed.IsZero() {
+			response.JWKSRefreshedAt = &refreshed
+		}
+	}
+	r.checkLifetimes(&response, time.Now())
+	if response.Status == healthStatusDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	content, _ := json.Marshal(response)
+	_, _ = w.Write(content)
 }
 
 // debugHandler is responsible for providing the pprof
@@ -605,8 +833,13 @@ func (r *oauthProxy) debugHandler(w http.ResponseWriter, req *http.Request) {
 
 // retrieveRefreshToken retrieves the refresh token from store or cookie
 func (r *oauthProxy) retrieveRefreshToken(req *http.Request, user *userContext) (token, encrypted string, err error) {
-	switch r.useStore() {
-	case true:
+	switch {
+	case r.config.EnableServerSideSessions:
+		var id string
+		if id, err = r.serverSessionID(req); err == nil {
+			token, err = r.getServerSession(id)
+		}
+	case r.useStore():
 		token, err = r.GetRefreshToken(user.token)
 	default:
 		token, err = r.getRefreshTokenFromCookie(req)
@@ -651,7 +884,7 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 	// exp: expiration of the access token
 	// expiresIn: expiration of the ID token
 
-	token, newRefreshToken, accessExpiresAt, refreshExpiresIn, err := getRefreshedToken(r.client, refresh)
+	token, newRefreshToken, idToken, accessExpiresAt, refreshExpiresIn, err := r.getRefreshedToken(context.Background(), refresh)
 	if err != nil {
 		switch err {
 		case ErrRefreshTokenExpired:
@@ -667,7 +900,19 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 		return err
 	}
 
-	accessExpiresIn := time.Until(accessExpiresAt)
+	// step: the refreshed token must be issued to the user of the session
+	if subject := subjectOf(token); subject != user.id {
+		if !r.config.AllowRefreshSubjectChange {
+			r.terminateChangedSession(ctx, w, req, user, subject, defaultTo(newRefreshToken, refresh))
+			return ErrRefreshSubjectChanged
+		}
+		logger.Warn("the refreshed access token is issued to another subject than the session",
+			zap.String("client_ip", clientIP),
+			zap.String("subject", user.id),
+			zap.String("refreshed_subject", subject))
+	}
+
+	accessExpiresIn := r.until(accessExpiresAt)
 
 	// get the expiration of the new refresh token
 	if newRefreshToken != "" {
@@ -680,7 +925,7 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 
 	logger.Info("injecting the refreshed access token cookie",
 		zap.String("client_ip", clientIP),
-		zap.String("cookie_name", r.config.CookieAccessName),
+		zap.String("cookie_name", r.cookieName(r.config.CookieAccessName)),
 		zap.String("email", user.email),
 		zap.Duration("refresh_expires_in", refreshExpiresIn),
 		zap.Duration("expires_in", accessExpiresIn))
@@ -695,9 +940,43 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 		}
 	}
 
-	// step: inject the refreshed access token
+	// step: inject the refreshed access token, which cookie lasts as long as the session when it is offline
+	if r.config.EnableOfflineTokens && isOfflineToken(refresh) {
+		accessExpiresIn = refreshExpiresIn
+	}
 	r.dropAccessTokenCookie(req.WithContext(ctx), w, accessToken, accessExpiresIn)
 
+	// step: reissue the id token along with the access token, as the upstream gets both
+	if err := r.keepIDToken(w, req.WithContext(ctx), idToken); err != nil {
+		logger.Error("internal error while keeping the refreshed id token",
+			zap.String("client_ip", clientIP), zap.String("email", user.email), zap.Error(err))
+		return ErrEncode
+	}
+
+	// step: keep the renewed refresh token in the session, and extend the session cookie
+	if r.config.EnableServerSideSessions {
+		if newRefreshToken != "" {
+			if encrypted, err = encodeText(newRefreshToken, r.config.EncryptionKey); err != nil {
+				logger.Error("internal error while encrypting refresh token",
+					zap.String("client_ip", clientIP), zap.String("email", user.email), zap.Error(err))
+				return ErrEncryption
+			}
+		}
+		id, err := r.serverSessionID(req)
+		if err != nil {
+			return err
+		}
+		if err := r.updateServerSession(id, encrypted, refreshExpiresIn); err != nil {
+			logger.Warn("unable to update the session in the store", zap.Error(err))
+			return ErrNoSessionStateFound
+		}
+		r.dropRefreshTokenCookie(req.WithContext(ctx), w, id, refreshExpiresIn)
+		r.indexProviderSession(user, id, refreshExpiresIn)
+
+		user.token = token
+		return nil
+	}
+
 	// step: inject the renewed refresh token
 	if newRefreshToken != "" {
 		logger.Debug("renew refresh cookie with new refresh token",
@@ -729,6 +1008,100 @@ func (r *oauthProxy) refreshToken(w http.ResponseWriter, req *http.Request, user
 	return nil
 }
 
+// terminateChangedSession ends a session whose refreshed token is issued to another subject: the session is removed,
+// the refresh token revoked, and the user must login again
+func (r *oauthProxy) terminateChangedSession(ctx context.Context, w http.ResponseWriter, req *http.Request, user *userContext, subject, refresh string) {
+	// @metric a session has been terminated as its refreshed token is of another subject
+	oauthTokensMetric.WithLabelValues("refresh-subject-changed").Inc()
+	// audit trail of the terminated sessions
+	r.log.Warn("the refreshed access token is issued to another subject than the session, terminating the session",
+		zap.String("client_ip", req.RemoteAddr),
+		zap.String("subject", user.id),
+		zap.String("email", user.email),
+		zap.String("refreshed_subject", subject))
+
+	switch {
+	case r.config.EnableServerSideSessions:
+		if id, err := r.serverSessionID(req); err == nil {
+			if err := r.deleteServerSession(id); err != nil {
+				r.log.Warn("unable to remove the session from store", zap.Error(err))
+			}
+		}
+	case r.useStore():
+		if err := r.DeleteRefreshToken(user.token); err != nil {
+			r.log.Warn("unable to remove the refresh token from store", zap.Error(err))
+		}
+	}
+	r.clearAllCookies(req.WithContext(ctx), w)
+
+	if revocationURL := r.revocationURL(); revocationURL != "" {
+		go func() {
+			if err := r.revokeRefreshToken(context.Background(), revocationURL, refresh); err != nil {
+				r.log.Error("unable to revoke the refresh token of the terminated session", zap.Error(err))
+			}
+		}()
+	}
+}
+
 func (r *oauthProxy) forbiddenHandler(w http.ResponseWriter, req *http.Request) {
 	r.accessForbidden(w, req, "access denied")
 }
+
+// isRelativeRedirect tells if the redirection target is a path on this host, even once unescaped
+func isRelativeRedirect(target string) bool {
+	unescaped, err := url.PathUnescape(target)
+	if err != nil {
+		return false
+	}
+	for _, value := range []string{target, unescaped} {
+		// browsers consider "/\host" like "//host", and ignore tabs and new lines
+		if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") || strings.ContainsAny(value, "\\\t\r\n") {
+			return false
+		}
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	return u.Scheme == "" && u.Host == "" && u.User == nil && u.Opaque == ""
+}
+
+// isAllowedRedirect tells if the absolute redirection target matches one of the allowed redirect urls
+func (r *oauthProxy) isAllowedRedirect(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || u.User != nil || u.Host == "" {
+		return false
+	}
+	for _, pattern := range r.config.AllowedRedirectURLs {
+		if matchRedirectURL(u, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchRedirectURL matches an url against a pattern, e.g. https://*.example.com/app/*.
+//
+// The host of the pattern is a glob. Its path is a glob too, but a trailing '/*' matches any sub path.
+func matchRedirectURL(target *url.URL, pattern string) bool {
+	p, err := url.Parse(pattern)
+	if err != nil || !strings.EqualFold(p.Scheme, target.Scheme) {
+		return false
+	}
+	if matched, _ := path.Match(strings.ToLower(p.Host), strings.ToLower(target.Host)); !matched {
+		return false
+	}
+
+	switch {
+	case p.Path == "" || p.Path == "/*":
+		return true
+	case strings.HasSuffix(p.Path, "/*"):
+		prefix := strings.TrimSuffix(p.Path, "*")
+		return target.Path == strings.TrimSuffix(prefix, "/") || strings.HasPrefix(target.Path, prefix)
+	default:
+		matched, _ := path.Match(p.Path, target.Path)
+		return matched
+	}
+}
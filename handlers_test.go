@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -16,9 +19,21 @@ limitations under the License.
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resty "gopkg.in/resty.v1"
 )
 
 func TestDebugHandler(t *testing.T) {
@@ -138,6 +153,109 @@ func TestLoginHandler(t *testing.T) {
 	newFakeProxy(nil).RunTests(t, requests)
 }
 
+func TestClientTokenHandler(t *testing.T) {
+	c := newFakeKeycloakConfig()
+	c.EnableClientTokenHandler = true
+	c.ClientTokenAudience = "test"
+	c.ClientTokenKeys = map[string]string{"batch": "secret"}
+	c.ClientTokenRateLimit = 2
+	uri := c.WithOAuthURI(clientTokenURL)
+	requests := []fakeRequest{
+		{
+			URI:          uri,
+			Method:       http.MethodPost,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          uri,
+			Method:       http.MethodPost,
+			BasicAuth:    true,
+			Username:     "batch",
+			Password:     "wrong",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:                     uri,
+			Method:                  http.MethodPost,
+			BasicAuth:               true,
+			Username:                "batch",
+			Password:                "secret",
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: "access_token",
+			ExpectedHeaders:         map[string]string{"Cache-Control": "no-store"},
+		},
+		{ // served from the cache
+			URI:                     uri,
+			Method:                  http.MethodPost,
+			BasicAuth:               true,
+			Username:                "batch",
+			Password:                "secret",
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: "access_token",
+		},
+		{
+			URI:          uri,
+			Method:       http.MethodPost,
+			BasicAuth:    true,
+			Username:     "batch",
+			Password:     "secret",
+			ExpectedCode: http.StatusTooManyRequests,
+		},
+	}
+	newFakeProxy(c).RunTests(t, requests)
+}
+
+func TestClientTokenHandlerAudience(t *testing.T) {
+	c := newFakeKeycloakConfig()
+	c.EnableClientTokenHandler = true
+	c.ClientTokenAudience = "another-api"
+	c.ClientTokenKeys = map[string]string{"batch": "secret"}
+	requests := []fakeRequest{
+		{
+			URI:          c.WithOAuthURI(clientTokenURL),
+			Method:       http.MethodPost,
+			BasicAuth:    true,
+			Username:     "batch",
+			Password:     "secret",
+			ExpectedCode: http.StatusInternalServerError,
+		},
+	}
+	newFakeProxy(c).RunTests(t, requests)
+}
+
+func TestClientTokenIssuerMintsOnce(t *testing.T) {
+	issuer := newClientTokenIssuer(1)
+	var mints int32
+	release := make(chan struct{})
+	mint := func() (string, string, time.Time, error) {
+		atomic.AddInt32(&mints, 1)
+		<-release
+		return "token", "openid", time.Now().Add(time.Hour), nil
+	}
+
+	var group sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			token, _, _, _, err := issuer.get(mint)
+			assert.NoError(t, err)
+			assert.Equal(t, "token", token)
+		}()
+	}
+	// the rate limit is checked while the token is being minted
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&mints) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, issuer.allow("batch"))
+	assert.False(t, issuer.allow("batch"))
+	close(release)
+	group.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mints))
+	_, _, _, cached, err := issuer.get(mint)
+	require.NoError(t, err)
+	assert.True(t, cached)
+}
+
 func TestLogoutHandlerBadRequest(t *testing.T) {
 	requests := []fakeRequest{
 		{
@@ -330,14 +448,144 @@ func TestCallbackURL(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestCallbackRedirectURI(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.AllowedRedirectURLs = []string{"https://*.example.com/app/*"}
+	requestURI := func(location string) []*http.Cookie {
+		return []*http.Cookie{{Name: requestURICookie, Value: base64.StdEncoding.EncodeToString([]byte(location))}}
+	}
+	requests := []fakeRequest{
+		{
+			URI:              cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			Cookies:          requestURI("/admin?page=1"),
+			ExpectedLocation: "/admin?page=1",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+		{
+			URI:              cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			Cookies:          requestURI("https://www.example.com/app/home"),
+			ExpectedLocation: "https://www.example.com/app/home",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+		{
+			URI:              cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			Cookies:          requestURI("https://evil.com/app/home"),
+			ExpectedLocation: "/",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+		{
+			URI:              cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			Cookies:          requestURI("//evil.com"),
+			ExpectedLocation: "/",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+		{
+			URI:              cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			Cookies:          requestURI("/%2F%2Fevil.com"),
+			ExpectedLocation: "/",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestCallbackRestoresRequestURI(t *testing.T) {
+	cs := []struct {
+		RequestURI string
+		Expected   string
+	}{
+		{RequestURI: "/search?tag=a&tag=b"},
+		{RequestURI: "/search?q=a;b&x=%26y&=empty&flag&empty="},
+		{RequestURI: "/search?q=%2F%2Fevil.com&q=%3D%3D"},
+		{RequestURI: "/a//b/./c/?x=1"},
+		{RequestURI: "/p;v=1?a=&a=&&"},
+		{RequestURI: "/search?q=a+b%20c#results"},
+		{RequestURI: "/café?q=é", Expected: "/caf%C3%A9?q=%C3%A9"},
+	}
+	cfg := newFakeKeycloakConfig()
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	for _, c := range cs {
+		req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+cfg.WithOAuthURI(callbackURL)+"?code=fake&state=state", nil)
+		require.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: requestURICookie, Value: base64.StdEncoding.EncodeToString([]byte(c.RequestURI))})
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		expected := c.Expected
+		if expected == "" {
+			expected = c.RequestURI
+		}
+		assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "request uri: %s", c.RequestURI)
+		assert.Equal(t, expected, resp.Header.Get("Location"), "the request uri is restored byte for byte")
+	}
+}
+
+func TestIsRelativeRedirect(t *testing.T) {
+	cases := map[string]bool{
+		"/":                   true,
+		"/admin":              true,
+		"/admin?q=%2F%2F":     true,
+		"":                    false,
+		"admin":               false,
+		"//evil.com":          false,
+		"/\\evil.com":         false,
+		"/\tevil.com":         false,
+		"https://evil.com":    false,
+		"http://a@evil.com/":  false,
+		"/%2F%2Fevil.com":     false,
+		"%2F%2Fevil.com":      false,
+		"/%5Cevil.com":        false,
+		"javascript:alert(1)": false,
+	}
+	for target, expected := range cases {
+		assert.Equal(t, expected, isRelativeRedirect(target), "target: %q", target)
+	}
+}
+
+func TestMatchRedirectURL(t *testing.T) {
+	cases := []struct {
+		Pattern  string
+		Target   string
+		Expected bool
+	}{
+		{Pattern: "https://app.example.com", Target: "https://app.example.com/any/path", Expected: true},
+		{Pattern: "https://app.example.com", Target: "http://app.example.com/", Expected: false},
+		{Pattern: "https://*.example.com/app/*", Target: "https://WWW.example.com/app", Expected: true},
+		{Pattern: "https://*.example.com/app/*", Target: "https://www.example.com/app/a/b", Expected: true},
+		{Pattern: "https://*.example.com/app/*", Target: "https://www.example.com/application", Expected: false},
+		{Pattern: "https://*.example.com/app/*", Target: "https://example.com.evil.com/app/", Expected: false},
+		{Pattern: "https://app.example.com/home", Target: "https://app.example.com/home", Expected: true},
+		{Pattern: "https://app.example.com/home", Target: "https://app.example.com/home/other", Expected: false},
+	}
+	for _, c := range cases {
+		target, err := url.Parse(c.Target)
+		require.NoError(t, err)
+		assert.Equal(t, c.Expected, matchRedirectURL(target, c.Pattern), "pattern: %s, target: %s", c.Pattern, c.Target)
+	}
+
+	p := &oauthProxy{config: &Config{AllowedRedirectURLs: []string{"https://app.example.com"}}}
+	assert.True(t, p.isAllowedRedirect("https://app.example.com/home"))
+	assert.False(t, p.isAllowedRedirect("https://user@app.example.com/home"))
+	assert.False(t, p.isAllowedRedirect("/home"))
+}
+
 func TestHealthHandler(t *testing.T) {
 	c := newFakeKeycloakConfig()
 	requests := []fakeRequest{
 		{
-			URI:             c.WithOAuthURI(healthURL),
-			ExpectedCode:    http.StatusOK,
-			ExpectedContent: `{"status":"OK"}`,
-			ExpectedHeaders: map[string]string{"Content-Type": jsonMime},
+			URI:                     c.WithOAuthURI(healthURL),
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `{"status":"OK","jwks_refreshed_at":"`,
+			ExpectedHeaders:         map[string]string{"Content-Type": jsonMime},
 		},
 		{
 			URI:             c.WithOAuthURI(healthURL),
@@ -348,3 +596,253 @@ func TestHealthHandler(t *testing.T) {
 	}
 	newFakeProxy(nil).RunTests(t, requests)
 }
+
+func TestPKCEAuthorization(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnablePKCE = true
+	cfg.EncryptionKey = testKey
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(location string, cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, location, nil)
+		require.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		return resp
+	}
+
+	resp := get(p.getServiceURL() + cfg.WithOAuthURI(authorizationURL) + "?state=xyz")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	authorization, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "S256", authorization.Query().Get("code_challenge_method"))
+
+	// the challenge is the base64url encoded sha256 of the verifier, kept in an encrypted cookie with the state
+	verifierCookie := findCookie(pkceCookie, resp.Cookies())
+	require.NotNil(t, verifierCookie)
+	value, err := decodeText(verifierCookie.Value, testKey)
+	require.NoError(t, err)
+	items := strings.SplitN(value, "|", 2)
+	require.Len(t, items, 2)
+	assert.Equal(t, "xyz", items[0])
+	assert.Len(t, items[1], 43)
+	sum := sha256.Sum256([]byte(items[1]))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:]), authorization.Query().Get("code_challenge"))
+
+	// the provider refuses the code with another verifier
+	resp = get(authorization.String())
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	callback := resp.Header.Get("Location")
+	forged, err := encodeText("xyz|"+strings.Repeat("a", 43), testKey)
+	require.NoError(t, err)
+	resp = get(callback, &http.Cookie{Name: pkceCookie, Value: forged})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = get(authorization.String())
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	resp = get(resp.Header.Get("Location"), &http.Cookie{Name: pkceCookie, Value: verifierCookie.Value})
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.NotNil(t, findCookie(cfg.CookieAccessName, resp.Cookies()))
+	cleared := findCookie(pkceCookie, resp.Cookies())
+	if assert.NotNil(t, cleared, "the code verifier is used once") {
+		assert.Empty(t, cleared.Value)
+	}
+}
+
+func TestPKCECallbackWithoutVerifier(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnablePKCE = true
+	cfg.EncryptionKey = testKey
+	other, err := encodeText("another|"+strings.Repeat("a", 43), testKey)
+	require.NoError(t, err)
+
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			// a missing or expired verifier
+			URI:                     cfg.WithOAuthURI(callbackURL) + "?code=fake&state=xyz",
+			ExpectedCode:            http.StatusBadRequest,
+			ExpectedContentContains: "the code verifier of the authorization is missing or has expired",
+		},
+		{
+			// the verifier of another authorization
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fake&state=xyz",
+			Cookies:      []*http.Cookie{{Name: pkceCookie, Path: "/", Value: other}},
+			ExpectedCode: http.StatusBadRequest,
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fake&state=xyz",
+			Cookies:      []*http.Cookie{{Name: pkceCookie, Path: "/", Value: "not encrypted"}},
+			ExpectedCode: http.StatusBadRequest,
+		},
+	})
+}
+
+func TestNonceAuthorization(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(location string, cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, location, nil)
+		require.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		return resp
+	}
+	login := func() (*http.Response, *http.Cookie) {
+		resp := get(p.getServiceURL() + cfg.WithOAuthURI(authorizationURL) + "?state=xyz")
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		authorization, err := url.Parse(resp.Header.Get("Location"))
+		require.NoError(t, err)
+
+		// the nonce is kept with the state of the authorization
+		state := findCookie(requestStateCookie, resp.Cookies())
+		require.NotNil(t, state)
+		assert.Equal(t, "xyz|"+authorization.Query().Get("nonce"), state.Value)
+
+		resp = get(authorization.String())
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+		return get(resp.Header.Get("Location"), state), state
+	}
+
+	resp, _ := login()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.NotNil(t, findCookie(cfg.CookieAccessName, resp.Cookies()))
+
+	// the id token of another authorization is refused, as a state mismatch
+	p.idp.forgedNonce = "forged"
+	resp, _ = login()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	if access := findCookie(cfg.CookieAccessName, resp.Cookies()); access != nil {
+		assert.Empty(t, access.Value)
+	}
+	if cleared := findCookie(requestStateCookie, resp.Cookies()); assert.NotNil(t, cleared) {
+		assert.Empty(t, cleared.Value)
+	}
+
+	// the authorizations started before the nonces are not bound to one
+	p.idp.forgedNonce = ""
+	resp = get(p.getServiceURL()+cfg.WithOAuthURI(callbackURL)+"?code=fake&state=xyz", &http.Cookie{Name: requestStateCookie, Value: "xyz"})
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+}
+
+func TestClientAssertionAuthentication(t *testing.T) {
+	block, _ := pem.Decode([]byte(fakePrivateKey))
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	require.NoError(t, err)
+	cfg := newFakeKeycloakConfig()
+	cfg.ClientSecret = ""
+	cfg.ClientAssertionKey = writeTestAssertionKey(t, "RSA PRIVATE KEY", block.Bytes)
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	auth := newFakeAuthServer()
+	auth.assertionKey = &key.PublicKey
+	p := newFakeProxyWithAuthServer(cfg, auth)
+	p.idp.setTokenExpiration(1000 * time.Millisecond)
+
+	// the code exchange, the refresh and the password grants are authenticated with the assertion
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			OnResponse:    func(int, *resty.Request, *resty.Response) { <-time.After(1000 * time.Millisecond) },
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:             fakeAuthAllURL,
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedCookies: map[string]string{cfg.CookieAccessName: ""},
+		},
+		{
+			URI:          cfg.WithOAuthURI(loginURL),
+			Method:       http.MethodPost,
+			FormValues:   map[string]string{"username": validUsername, "password": validPassword},
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			URI:          cfg.WithOAuthURI(loginURL),
+			Method:       http.MethodPost,
+			FormValues:   map[string]string{"username": validUsername, "password": "wrong"},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	})
+}
+
+func TestRefreshSubjectChanged(t *testing.T) {
+	for _, allowed := range []bool{false, true} {
+		cfg := newFakeKeycloakConfig()
+		cfg.EnableRefreshTokens = true
+		cfg.EncryptionKey = testKey
+		cfg.AllowRefreshSubjectChange = allowed
+		p := newFakeProxy(cfg)
+		p.idp.setTokenExpiration(1000 * time.Millisecond)
+		login := func(int, *resty.Request, *resty.Response) {
+			// the account of the user is merged into another one
+			p.idp.refreshedSubject = "7f0c2a4e-merged"
+			<-time.After(1000 * time.Millisecond)
+		}
+
+		refreshed := fakeRequest{
+			URI:             fakeAuthAllURL,
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedCookies: map[string]string{cfg.CookieAccessName: ""},
+		}
+		if !allowed {
+			// the session is terminated and the user must login again
+			refreshed = fakeRequest{
+				URI:             fakeAuthAllURL,
+				ExpectedCode:    http.StatusTemporaryRedirect,
+				ExpectedCookies: map[string]string{cfg.CookieAccessName: "", cfg.CookieRefreshName: ""},
+				ExpectedCookiesValidator: map[string]func(string) bool{
+					cfg.CookieAccessName:  func(value string) bool { return value == "" },
+					cfg.CookieRefreshName: func(value string) bool { return value == "" },
+				},
+			}
+		}
+		p.RunTests(t, []fakeRequest{
+			{
+				URI:           fakeAuthAllURL,
+				HasLogin:      true,
+				Redirects:     true,
+				OnResponse:    login,
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+			},
+			refreshed,
+		})
+
+		if !allowed {
+			assert.Eventually(t, func() bool {
+				return atomic.LoadInt32(&p.idp.revocations) == 1
+			}, 5*time.Second, 10*time.Millisecond, "the refresh token of the terminated session is revoked")
+		} else {
+			assert.Equal(t, int32(0), atomic.LoadInt32(&p.idp.revocations))
+		}
+	}
+}
@@ -0,0 +1,126 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Encodings of multi-valued identity headers
+const (
+	// headerEncodingJoin joins the values with a delimiter (the default, with a comma)
+	headerEncodingJoin = "join"
+	// headerEncodingURL url-encodes the values, then joins them with a delimiter
+	headerEncodingURL = "url"
+	// headerEncodingRepeat repeats the header once per value
+	headerEncodingRepeat = "repeat"
+	// headerEncodingJSON encodes the values as a JSON array
+	headerEncodingJSON = "json"
+
+	defaultHeaderDelimiter = ","
+)
+
+// headerEncoder sets a multi-valued header
+type headerEncoder func(header http.Header, name string, values []string)
+
+// newHeaderEncoder builds an encoder from its specification, i.e. an encoding optionally followed by
+// a colon and a delimiter, e.g. "join:;", "url", "repeat" or "json"
+func newHeaderEncoder(spec string) (headerEncoder, error) {
+	encoding, delimiter := spec, defaultHeaderDelimiter
+	if i := strings.Index(spec, ":"); i >= 0 {
+		encoding, delimiter = spec[:i], spec[i+1:]
+		if delimiter == "" || strings.ContainsAny(delimiter, "\r\n") {
+			return nil, fmt.Errorf("invalid delimiter in header encoding %q", spec)
+		}
+	}
+
+	switch encoding {
+	case headerEncodingJoin:
+		return func(header http.Header, name string, values []string) {
+			header.Set(name, strings.Join(values, delimiter))
+		}, nil
+	case headerEncodingURL:
+		return func(header http.Header, name string, values []string) {
+			encoded := make([]string, 0, len(values))
+			for _, value := range values {
+				encoded = append(encoded, strings.ReplaceAll(url.QueryEscape(value), "+", "%20"))
+			}
+			header.Set(name, strings.Join(encoded, delimiter))
+		}, nil
+	case headerEncodingRepeat, headerEncodingJSON:
+		if strings.Contains(spec, ":") {
+			return nil, fmt.Errorf("header encoding %q does not take a delimiter", encoding)
+		}
+		if encoding == headerEncodingRepeat {
+			return func(header http.Header, name string, values []string) {
+				header.Del(name)
+				for _, value := range values {
+					header.Add(name, value)
+				}
+			}, nil
+		}
+		return func(header http.Header, name string, values []string) {
+			if values == nil {
+				values = []string{}
+			}
+			var encoded strings.Builder
+			enc := json.NewEncoder(&encoded)
+			enc.SetEscapeHTML(false)
+			_ = enc.Encode(values)
+			header.Set(name, strings.TrimSuffix(encoded.String(), "\n"))
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid header encoding %q, must be one of %s|%s|%s|%s", spec,
+			headerEncodingJoin, headerEncodingURL, headerEncodingRepeat, headerEncodingJSON)
+	}
+}
+
+// makeHeaderEncoders builds the encoders of the multi-valued identity headers, by canonical header name
+func makeHeaderEncoders(specs map[string]string) (map[string]headerEncoder, error) {
+	encoders := make(map[string]headerEncoder, len(specs))
+	for name, spec := range specs {
+		encoder, err := newHeaderEncoder(spec)
+		if err != nil {
+			return nil, err
+		}
+		encoders[http.CanonicalHeaderKey(name)] = encoder
+	}
+
+	return encoders, nil
+}
+
+// claimValues returns the values of a multi-valued claim, if it is one
+func claimValues(claim interface{}) ([]string, bool) {
+	switch list := claim.(type) {
+	case []string:
+		return list, true
+	case []interface{}:
+		values := make([]string, 0, len(list))
+		for _, value := range list {
+			values = append(values, fmt.Sprintf("%v", value))
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,115 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resty "gopkg.in/resty.v1"
+)
+
+func TestHeaderEncoder(t *testing.T) {
+	values := []string{"Sales, EMEA", "R&D", "client:role"}
+	cs := []struct {
+		Spec     string
+		Expected []string
+	}{
+		{Spec: "join", Expected: []string{"Sales, EMEA,R&D,client:role"}},
+		{Spec: "join:;", Expected: []string{"Sales, EMEA;R&D;client:role"}},
+		{Spec: "join:|:", Expected: []string{"Sales, EMEA|:R&D|:client:role"}},
+		{Spec: "url", Expected: []string{"Sales%2C%20EMEA,R%26D,client%3Arole"}},
+		{Spec: "url: ", Expected: []string{"Sales%2C%20EMEA R%26D client%3Arole"}},
+		{Spec: "repeat", Expected: values},
+		{Spec: "json", Expected: []string{`["Sales, EMEA","R&D","client:role"]`}},
+	}
+	for _, c := range cs {
+		encoder, err := newHeaderEncoder(c.Spec)
+		require.NoError(t, err, "spec: %s", c.Spec)
+		header := http.Header{"X-Auth-Groups": []string{"stale"}}
+		encoder(header, "X-Auth-Groups", values)
+		assert.Equal(t, c.Expected, header.Values("X-Auth-Groups"), "spec: %s", c.Spec)
+	}
+
+	encoder, err := newHeaderEncoder("json")
+	require.NoError(t, err)
+	header := http.Header{}
+	encoder(header, "X-Auth-Groups", nil)
+	assert.Equal(t, "[]", header.Get("X-Auth-Groups"))
+
+	for _, spec := range []string{"", "csv", "join:", "join:\n", "repeat:;", "json:,"} {
+		_, err := newHeaderEncoder(spec)
+		assert.Error(t, err, "spec: %q", spec)
+	}
+}
+
+func TestIdentityHeaderEncodings(t *testing.T) {
+	claims := jose.Claims{
+		"groups":      []string{"Sales, EMEA", "R&D"},
+		"departments": []string{"a,b", "c"},
+	}
+
+	// defaults are unchanged
+	cfg := newFakeKeycloakConfig()
+	cfg.AddClaims = []string{"departments"}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			TokenClaims:   claims,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Groups":      "Sales, EMEA,R&D",
+				"X-Auth-Departments": "[a,b c]",
+			},
+		},
+	})
+
+	cfg = newFakeKeycloakConfig()
+	cfg.AddClaims = []string{"departments"}
+	cfg.IdentityHeaderEncodings = map[string]string{
+		"x-auth-groups":      "url",
+		"X-Auth-Roles":       "repeat",
+		"X-Auth-Departments": "json",
+	}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			TokenClaims:   claims,
+			Roles:         []string{"client:admin", "user"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Groups":      "Sales%2C%20EMEA,R%26D",
+				"X-Auth-Departments": `["a,b","c"]`,
+			},
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				var upstream fakeUpstreamResponse
+				require.NoError(t, json.Unmarshal(resp.Body(), &upstream))
+				assert.Subset(t, upstream.Headers.Values("X-Auth-Roles"), []string{"client:admin", "user"})
+			},
+		},
+	})
+}
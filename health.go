@@ -0,0 +1,173 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	healthStatusOK   = "OK"
+	healthStatusDown = "DOWN"
+	// healthStatusWarning is the status of a proxy which serves the requests, but needs the attention of the operators
+	healthStatusWarning = "WARNING"
+)
+
+// dependencyCheck checks a dependency of the proxy can be reached. The critical dependencies take the proxy
+// down when they cannot be reached.
+type dependencyCheck struct {
+	name     string
+	critical bool
+	check    func(context.Context) error
+}
+
+// checkDependencies checks the store and the discovery endpoint of the provider concurrently, each check being
+// bounded by the health check timeout. The provider is not critical: an outage of the provider affects all the
+// replicas alike, while taking them down would also reject the requests bearing valid tokens.
+func (r *oauthProxy) checkDependencies(ctx context.Context) healthResponse {
+	var checks []dependencyCheck
+	if r.store != nil {
+		checks = append(checks, dependencyCheck{
+			name:     "store",
+			critical: true,
+			check: func(ctx context.Context) error {
+				return pingStore(ctx, r.store)
+			},
+		})
+	}
+	if r.idpClient != nil {
+		checks = append(checks, dependencyCheck{name: "discovery", check: r.checkDiscovery})
+	}
+
+	response := healthResponse{Status: healthStatusOK, Dependencies: make([]dependencyHealth, len(checks))}
+	done := make(chan struct{}, len(checks))
+	for i, x := range checks {
+		go func(i int, x dependencyCheck) {
+			response.Dependencies[i] = r.checkDependency(ctx, x)
+			done <- struct{}{}
+		}(i, x)
+	}
+	for range checks {
+		<-done
+	}
+
+	for _, x := range response.Dependencies {
+		if x.Critical && x.Status != healthStatusOK {
+			response.Status = healthStatusDown
+		}
+	}
+
+	return response
+}
+
+// checkDependency runs a check, which is abandoned after the health check timeout
+func (r *oauthProxy) checkDependency(ctx context.Context, x dependencyCheck) dependencyHealth {
+	ctx, cancel := context.WithTimeout(ctx, r.config.HealthCheckTimeout)
+	defer cancel()
+
+	result := dependencyHealth{Name: x.name, Status: healthStatusOK, Critical: x.critical}
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- x.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = fmt.Errorf("no response within %s", r.config.HealthCheckTimeout)
+	}
+	result.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result.Status = healthStatusDown
+		result.Error = err.Error()
+		r.log.Warn("a dependency of the proxy is down", zap.String("dependency", x.name), zap.Error(err))
+	}
+
+	return result
+}
+
+// checkDiscovery checks the discovery document of the provider can be retrieved
+func (r *oauthProxy) checkDiscovery(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.config.DiscoveryURL+discoveryPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.idpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("the discovery endpoint responded " + resp.Status)
+	}
+
+	return nil
+}
+
+// checkLifetimes reports the expiry of the certificates and the age of the documents of the provider, warning
+// about the ones within their threshold. The warnings do not take the proxy down.
+func (r *oauthProxy) checkLifetimes(response *healthResponse, now time.Time) {
+	for _, x := range r.certificates.list() {
+		left := x.expiresAt.Sub(now)
+		response.Certificates = append(response.Certificates, certificateHealth{
+			Purpose:         x.purpose,
+			Subject:         x.subject,
+			ExpiresAt:       x.expiresAt,
+			DaysUntilExpiry: math.Round(left.Hours()/24*100) / 100,
+		})
+		if threshold := r.config.HealthCertificateExpiryWarning; threshold > 0 && left < threshold {
+			if left <= 0 {
+				response.Warnings = append(response.Warnings, fmt.Sprintf("the %s certificate %q has expired", x.purpose, x.subject))
+			} else {
+				response.Warnings = append(response.Warnings, fmt.Sprintf("the %s certificate %q expires in %s", x.purpose, x.subject, left.Round(time.Minute)))
+			}
+		}
+	}
+
+	age := func(name string, since time.Time, threshold time.Duration) *float64 {
+		if since.IsZero() {
+			return nil
+		}
+		elapsed := now.Sub(since)
+		if threshold > 0 && elapsed > threshold {
+			response.Warnings = append(response.Warnings, fmt.Sprintf("the cached %s of the provider is %s old", name, elapsed.Round(time.Second)))
+		}
+		seconds := math.Round(elapsed.Seconds())
+		return &seconds
+	}
+	response.DiscoveryAge = age("discovery document", r.discoveredAt, r.config.HealthDiscoveryAgeWarning)
+	if r.jwks != nil {
+		response.JWKSAge = age("JWKS", r.jwks.lastRefresh(), r.config.HealthJWKSAgeWarning)
+	}
+
+	if response.Status == healthStatusOK && len(response.Warnings) > 0 {
+		response.Status = healthStatusWarning
+	}
+}
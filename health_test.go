@@ -0,0 +1,158 @@
+//go:build !noreverse && !nostores
+// +build !noreverse,!nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hangingStore never responds to the pings
+type hangingStore struct {
+	storage
+}
+
+func (s *hangingStore) Ping(ctx context.Context) error {
+	<-ctx.Done()
+	time.Sleep(time.Second)
+	return ctx.Err()
+}
+
+func TestHealthHandlerDependencies(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.HealthCheckDependencies = true
+	cfg.StoreURL = "redis://" + newFakeRedisServer(t).addr()
+	p := newFakeProxy(cfg)
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:                     cfg.WithOAuthURI(healthURL),
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `{"status":"OK","dependencies":[{"name":"store","status":"OK","critical":true,`,
+			ExpectedHeaders:         map[string]string{"Content-Type": jsonMime},
+		},
+	})
+
+	report := p.proxy.checkDependencies(context.Background())
+	require.Len(t, report.Dependencies, 2)
+	assert.Equal(t, "discovery", report.Dependencies[1].Name)
+	assert.Equal(t, healthStatusOK, report.Dependencies[1].Status)
+	assert.False(t, report.Dependencies[1].Critical)
+}
+
+func TestHealthHandlerStoreDown(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.HealthCheckDependencies = true
+	cfg.StoreURL = "redis://127.0.0.1:1"
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:                     cfg.WithOAuthURI(healthURL),
+			ExpectedCode:            http.StatusServiceUnavailable,
+			ExpectedContentContains: `{"status":"DOWN","dependencies":[{"name":"store","status":"DOWN","critical":true,`,
+		},
+	})
+}
+
+func TestHealthHandlerTimeout(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.HealthCheckDependencies = true
+	cfg.HealthCheckTimeout = 50 * time.Millisecond
+	p := newFakeProxy(cfg)
+	p.proxy.store = &hangingStore{storage: newTestMemoryStore(t, "memory://")}
+
+	start := time.Now()
+	report := p.proxy.checkDependencies(context.Background())
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "the health endpoint does not wait for the hanging checks")
+	assert.Equal(t, healthStatusDown, report.Status)
+	require.NotEmpty(t, report.Dependencies)
+	assert.Equal(t, "no response within 50ms", report.Dependencies[0].Error)
+}
+
+func TestHealthHandlerDiscoveryDown(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.HealthCheckDependencies = true
+	p := newFakeProxy(cfg)
+	p.proxy.config.DiscoveryURL += "/missing"
+
+	// the provider is not a critical dependency
+	report := p.proxy.checkDependencies(context.Background())
+	assert.Equal(t, healthStatusOK, report.Status)
+	require.Len(t, report.Dependencies, 1)
+	assert.Equal(t, "discovery", report.Dependencies[0].Name)
+	assert.Equal(t, healthStatusDown, report.Dependencies[0].Status)
+	assert.Contains(t, report.Dependencies[0].Error, "the discovery endpoint responded 404")
+}
+
+func TestHealthHandlerLifetimes(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.HealthCertificateExpiryWarning = 14 * 24 * time.Hour
+	cfg.HealthJWKSAgeWarning = time.Hour
+	p := newFakeProxy(cfg)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	for purpose, expiry := range map[string]time.Duration{
+		certificatePurposeListener:       60 * 24 * time.Hour,
+		certificatePurposeUpstreamClient: 2 * 24 * time.Hour,
+	} {
+		certificate, err := createCertificate(key, []string{purpose + ".example.com"}, expiry)
+		require.NoError(t, err)
+		p.proxy.certificates.record(purpose, purpose+".pem", certificate)
+	}
+
+	// step: a certificate close to its expiry turns the status into a warning, still serving 200
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:                     cfg.WithOAuthURI(healthURL),
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `{"status":"WARNING",`,
+		},
+	})
+
+	report := healthResponse{Status: healthStatusOK}
+	p.proxy.checkLifetimes(&report, time.Now())
+	assert.Equal(t, healthStatusWarning, report.Status)
+	require.Len(t, report.Certificates, 2)
+	assert.Equal(t, certificatePurposeUpstreamClient, report.Certificates[0].Purpose)
+	assert.InDelta(t, 2, report.Certificates[0].DaysUntilExpiry, 0.01)
+	assert.Equal(t, certificatePurposeListener, report.Certificates[1].Purpose)
+	require.Len(t, report.Warnings, 1)
+	assert.Contains(t, report.Warnings[0], `the upstream-client certificate "upstream-client.example.com" expires in`)
+	require.NotNil(t, report.DiscoveryAge)
+	require.NotNil(t, report.JWKSAge)
+
+	// step: the signing keys getting stale are reported
+	report = healthResponse{Status: healthStatusOK}
+	p.proxy.checkLifetimes(&report, time.Now().Add(2*time.Hour))
+	require.Len(t, report.Warnings, 2)
+	assert.Contains(t, report.Warnings[1], "the cached JWKS of the provider is 2h0m")
+	assert.InDelta(t, 2*time.Hour.Seconds(), *report.JWKSAge, 5)
+
+	// step: the warnings do not hide a critical dependency being down
+	report = healthResponse{Status: healthStatusDown}
+	p.proxy.checkLifetimes(&report, time.Now())
+	assert.Equal(t, healthStatusDown, report.Status)
+}
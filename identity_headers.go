@@ -0,0 +1,273 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The identity headers injected upstream, named after the headers-prefix unless renamed in header-names
+const (
+	identityHeaderAudience  = "audience"
+	identityHeaderClaims    = "claims"
+	identityHeaderEmail     = "email"
+	identityHeaderExpiresIn = "expires-in"
+	identityHeaderGroups    = "groups"
+	identityHeaderIDToken   = "id-token"
+	identityHeaderRoles     = "roles"
+	identityHeaderSubject   = "subject"
+	identityHeaderToken     = "token"
+	identityHeaderUserID    = "userid"
+	identityHeaderUsername  = "username"
+)
+
+// Encodings of the values of the identity headers which are not ascii, the ascii values being left as they are
+const (
+	// identityValueRFC8187 percent-encodes the utf-8 value as an ext-value of RFC 8187, e.g. UTF-8''S%C3%B8ren
+	identityValueRFC8187 = "rfc8187"
+	// identityValueBase64 encodes the utf-8 value as an encoded-word of RFC 2047, e.g. =?UTF-8?b?U8O4cmVu?=
+	identityValueBase64 = "base64"
+)
+
+// identityHeaderSuffixes are the names of the identity headers after the prefix
+var identityHeaderSuffixes = map[string]string{
+	identityHeaderAudience:  "Audience",
+	identityHeaderClaims:    "Claims",
+	identityHeaderEmail:     "Email",
+	identityHeaderExpiresIn: "ExpiresIn",
+	identityHeaderGroups:    "Groups",
+	identityHeaderIDToken:   "ID-Token",
+	identityHeaderRoles:     "Roles",
+	identityHeaderSubject:   "Subject",
+	identityHeaderToken:     "Token",
+	identityHeaderUserID:    "Userid",
+	identityHeaderUsername:  "Username",
+}
+
+// isIdentityHeadersValid validates the prefix and the names of the identity headers
+func (r *Config) isIdentityHeadersValid() error {
+	if r.HeadersPrefix != "" && !headerNameFilter.MatchString(r.HeadersPrefix) {
+		return fmt.Errorf("invalid headers-prefix %q, must be a valid header name", r.HeadersPrefix)
+	}
+	if r.EncodeIdentityHeaders != "" && r.EncodeIdentityHeaders != identityValueRFC8187 && r.EncodeIdentityHeaders != identityValueBase64 {
+		return fmt.Errorf("the encode-identity-headers must be one of %s|%s", identityValueRFC8187, identityValueBase64)
+	}
+	if r.ClaimsHeaderMaxSize < 0 {
+		return errors.New("the claims-header-max-size cannot be negative")
+	}
+	keys := make([]string, 0, len(identityHeaderSuffixes))
+	for key := range identityHeaderSuffixes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for key, name := range r.HeaderNames {
+		if _, found := identityHeaderSuffixes[key]; !found {
+			return fmt.Errorf("unknown identity header %q in header-names, must be one of %s", key, strings.Join(keys, "|"))
+		}
+		if !headerNameFilter.MatchString(name) {
+			return fmt.Errorf("invalid name %q of the %s identity header, must be a valid header name", name, key)
+		}
+	}
+	// the identity headers are told apart by their names
+	named := make(map[string]string, len(keys))
+	for _, key := range keys {
+		name := http.CanonicalHeaderKey(r.identityHeaderName(key))
+		if other, found := named[name]; found {
+			return fmt.Errorf("the %s and %s identity headers are both named %s", other, key, name)
+		}
+		named[name] = key
+	}
+
+	return nil
+}
+
+// identityHeaderName returns the name of an identity header: its name in header-names, else prefixed
+func (r *Config) identityHeaderName(key string) string {
+	if name, found := r.HeaderNames[key]; found {
+		return name
+	}
+
+	return defaultTo(r.HeadersPrefix, defaultHeadersPrefix) + identityHeaderSuffixes[key]
+}
+
+// claimHeaderName returns the name of the header of a claim added with add-claims
+func (r *Config) claimHeaderName(claim string) string {
+	return defaultTo(r.HeadersPrefix, defaultHeadersPrefix) + toHeader(claim)
+}
+
+// identityHeaderNames returns the names of all the identity headers, which only the proxy sets upstream
+func (r *Config) identityHeaderNames() []string {
+	names := make([]string, 0, len(identityHeaderSuffixes)+len(r.AddClaims))
+	for key := range identityHeaderSuffixes {
+		names = append(names, r.identityHeaderName(key))
+	}
+	for _, claim := range r.AddClaims {
+		names = append(names, r.claimHeaderName(claim))
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// spoofableHeaderNames returns the names of the headers the proxy may set upstream, derived from the configuration:
+// the clients cannot send them
+func (r *Config) spoofableHeaderNames() []string {
+	names := append(r.identityHeaderNames(), headerXForwardedAgent)
+	sort.Strings(names)
+
+	return names
+}
+
+// scrubIdentityHeadersMiddleware removes from the requests of the clients the headers which only the proxy sets, so a
+// forged identity never reaches the upstream, whatever the resource
+func (r *oauthProxy) scrubIdentityHeadersMiddleware() func(http.Handler) http.Handler {
+	names := r.config.spoofableHeaderNames()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for _, name := range names {
+				req.Header.Del(name)
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// isASCII tells if the value is only made of ascii characters
+func isASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encodeRFC8187 encodes a value as an ext-value of RFC 8187, all the characters but the attr-chars being
+// percent-encoded
+func encodeRFC8187(value string) string {
+	const hex = "0123456789ABCDEF"
+	encoded := make([]byte, 0, len("UTF-8''")+3*len(value))
+	encoded = append(encoded, "UTF-8''"...)
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte("!#$&+-.^_`|~", c) >= 0:
+			encoded = append(encoded, c)
+		default:
+			encoded = append(encoded, '%', hex[c>>4], hex[c&0x0f])
+		}
+	}
+
+	return string(encoded)
+}
+
+// identityValueEncoder returns the encoding of the values of the identity headers which are not ascii, or nil when
+// the values are sent as they are
+func identityValueEncoder(encoding string) func(string) string {
+	switch encoding {
+	case identityValueRFC8187:
+		return encodeRFC8187
+	case identityValueBase64:
+		return func(value string) string {
+			return mime.BEncoding.Encode("UTF-8", value)
+		}
+	}
+
+	return nil
+}
+
+// claimsHeader is the identity of the user sent upstream as a single json header
+type claimsHeader struct {
+	ID            string                 `json:"id"`
+	Email         string                 `json:"email,omitempty"`
+	PreferredName string                 `json:"preferred_username,omitempty"`
+	Roles         []string               `json:"roles,omitempty"`
+	Groups        []string               `json:"groups,omitempty"`
+	Audiences     []string               `json:"aud,omitempty"`
+	ExpiresAt     int64                  `json:"exp"`
+	Claims        map[string]interface{} `json:"claims,omitempty"`
+}
+
+// claimsHeaderOf returns the identity of the user, with the claims of add-claims found in the token
+func claimsHeaderOf(user *userContext, custom []string) claimsHeader {
+	x := claimsHeader{
+		ID:            user.id,
+		Email:         user.email,
+		PreferredName: user.preferredName,
+		Roles:         user.roles,
+		Groups:        user.groups,
+		Audiences:     user.audiences,
+		ExpiresAt:     user.expiresAt.Unix(),
+	}
+	for _, name := range custom {
+		if value, found := user.claims[name]; found {
+			if x.Claims == nil {
+				x.Claims = make(map[string]interface{}, len(custom))
+			}
+			x.Claims[name] = value
+		}
+	}
+
+	return x
+}
+
+// encodeClaimsHeader encodes the identity as compact json, itself base64url encoded when it is not ascii: the
+// upstream tells them apart as the json starts with a brace
+func encodeClaimsHeader(x claimsHeader) (string, error) {
+	content, err := json.Marshal(x)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range content {
+		if c >= utf8.RuneSelf {
+			return base64.RawURLEncoding.EncodeToString(content), nil
+		}
+	}
+
+	return string(content), nil
+}
+
+// claimsHeaderValue returns the value of the claims header, and whether the claims of add-claims were left out of it
+// as it would exceed the maximum size. The value is empty when the identity alone exceeds the maximum size.
+func claimsHeaderValue(user *userContext, custom []string, maxSize int) (string, bool, error) {
+	x := claimsHeaderOf(user, custom)
+	value, err := encodeClaimsHeader(x)
+	if err != nil || len(value) <= maxSize {
+		return value, false, err
+	}
+	if x.Claims == nil {
+		return "", false, nil
+	}
+	x.Claims = nil
+	if value, err = encodeClaimsHeader(x); err != nil || len(value) <= maxSize {
+		return value, true, err
+	}
+
+	return "", true, nil
+}
@@ -0,0 +1,361 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resty "gopkg.in/resty.v1"
+)
+
+func TestIdentityHeadersDefault(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.AddClaims = []string{"department"}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:      fakeAuthAllURL,
+			HasToken: true,
+			// the values sent by the client are replaced, or removed when the token has no such claim
+			Headers: map[string]string{
+				"X-Auth-Email":      "admin@example.com",
+				"X-Auth-Department": "finance",
+			},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Email":    "gambol99@gmail.com",
+				"X-Auth-Username": "rjayawardene",
+				"X-Auth-Subject":  "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+			},
+			ExpectedNoProxyHeaders: []string{"X-Auth-Department"},
+		},
+		{
+			URI:                    "/auth_all/white_listed/test",
+			Headers:                map[string]string{"X-Auth-Email": "admin@example.com"},
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedNoProxyHeaders: []string{"X-Auth-Email"},
+		},
+	})
+}
+
+func TestIdentityHeadersRemapped(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenHeader = true
+	cfg.AddClaims = []string{"department"}
+	cfg.HeadersPrefix = "X-Forwarded-"
+	cfg.HeaderNames = map[string]string{
+		identityHeaderAudience:  "Remote-Audience",
+		identityHeaderEmail:     "Remote-Email",
+		identityHeaderExpiresIn: "Remote-Expires-In",
+		identityHeaderGroups:    "Remote-Groups",
+		identityHeaderIDToken:   "Remote-ID-Token",
+		identityHeaderRoles:     "Remote-Roles",
+		identityHeaderSubject:   "Remote-Subject",
+		identityHeaderToken:     "Remote-Token",
+		identityHeaderUserID:    "Remote-Userid",
+		identityHeaderUsername:  "Remote-User",
+	}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:         fakeAuthAllURL,
+			HasToken:    true,
+			TokenClaims: map[string]interface{}{"department": "sales"},
+			Headers: map[string]string{
+				"Remote-User":            "admin",
+				"X-Forwarded-Department": "finance",
+			},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"Remote-Email":           "gambol99@gmail.com",
+				"Remote-User":            "rjayawardene",
+				"Remote-Subject":         "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+				"X-Forwarded-Department": "sales",
+			},
+			ExpectedNoProxyHeaders: []string{"X-Auth-Email", "X-Auth-Username", "X-Auth-Token", "X-Auth-Department"},
+		},
+		{
+			URI:                    "/auth_all/white_listed/test",
+			Headers:                map[string]string{"Remote-User": "admin", "X-Forwarded-Department": "finance"},
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedNoProxyHeaders: []string{"Remote-User", "X-Forwarded-Department"},
+		},
+	})
+}
+
+func TestIsIdentityHeadersValid(t *testing.T) {
+	cases := []struct {
+		Config *Config
+		Ok     bool
+	}{
+		{Config: &Config{}, Ok: true},
+		{Config: &Config{HeadersPrefix: "X-Forwarded-"}, Ok: true},
+		{Config: &Config{HeaderNames: map[string]string{"username": "Remote-User", "groups": "Remote-Groups"}}, Ok: true},
+		{Config: &Config{HeadersPrefix: "X Forwarded"}},
+		{Config: &Config{HeaderNames: map[string]string{"name": "Remote-Name"}}},
+		{Config: &Config{HeaderNames: map[string]string{"username": "Remote User"}}},
+		{Config: &Config{HeaderNames: map[string]string{"username": ""}}},
+		{Config: &Config{HeaderNames: map[string]string{"username": "remote-user", "email": "Remote-User"}}},
+		{Config: &Config{HeaderNames: map[string]string{"username": "X-Auth-Email"}}},
+		{Config: &Config{ClaimsHeaderMaxSize: -1}},
+		{Config: &Config{EncodeIdentityHeaders: identityValueRFC8187}, Ok: true},
+		{Config: &Config{EncodeIdentityHeaders: identityValueBase64}, Ok: true},
+		{Config: &Config{EncodeIdentityHeaders: "url"}},
+	}
+	for i, c := range cases {
+		err := c.Config.isIdentityHeadersValid()
+		assert.Equal(t, c.Ok, err == nil, "case %d: %v", i, err)
+	}
+}
+
+func TestIdentityHeaderNames(t *testing.T) {
+	c := &Config{
+		HeadersPrefix: "X-Forwarded-",
+		HeaderNames:   map[string]string{"username": "Remote-User"},
+		AddClaims:     []string{"given_name"},
+	}
+	assert.Equal(t, "Remote-User", c.identityHeaderName(identityHeaderUsername))
+	assert.Equal(t, "X-Forwarded-Email", c.identityHeaderName(identityHeaderEmail))
+	assert.Equal(t, "X-Forwarded-Given-Name", c.claimHeaderName("given_name"))
+	assert.Contains(t, c.identityHeaderNames(), "X-Forwarded-Given-Name")
+	assert.NotContains(t, c.identityHeaderNames(), "X-Forwarded-Username")
+	assert.Len(t, c.identityHeaderNames(), len(identityHeaderSuffixes)+1)
+
+	assert.Equal(t, "X-Auth-Email", (&Config{}).identityHeaderName(identityHeaderEmail))
+}
+
+func TestClaimsHeader(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableClaimsHeader = true
+	cfg.AddClaims = []string{"department"}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			TokenClaims:   map[string]interface{}{"department": "sales"},
+			Roles:         []string{"user"},
+			Headers:       map[string]string{"X-Auth-Claims": `{"id":"admin"}`},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				var upstream fakeUpstreamResponse
+				require.NoError(t, json.Unmarshal(resp.Body(), &upstream))
+				var claims claimsHeader
+				require.NoError(t, json.Unmarshal([]byte(upstream.Headers.Get("X-Auth-Claims")), &claims))
+				assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", claims.ID)
+				assert.Equal(t, "gambol99@gmail.com", claims.Email)
+				assert.Equal(t, "rjayawardene", claims.PreferredName)
+				assert.Contains(t, claims.Roles, "user")
+				assert.NotZero(t, claims.ExpiresAt)
+				assert.Equal(t, map[string]interface{}{"department": "sales"}, claims.Claims)
+			},
+		},
+		{
+			URI:                    "/auth_all/white_listed/test",
+			Headers:                map[string]string{"X-Auth-Claims": `{"id":"admin"}`},
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedNoProxyHeaders: []string{"X-Auth-Claims"},
+		},
+	})
+
+	cfg = newFakeKeycloakConfig()
+	cfg.EnableClaimsHeader = true
+	cfg.HeaderNames = map[string]string{identityHeaderClaims: "X-Identity"}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:                    fakeAuthAllURL,
+			HasToken:               true,
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedNoProxyHeaders: []string{"X-Auth-Claims"},
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				var upstream fakeUpstreamResponse
+				require.NoError(t, json.Unmarshal(resp.Body(), &upstream))
+				assert.True(t, strings.HasPrefix(upstream.Headers.Get("X-Identity"), `{"id":"1e11e539-`))
+			},
+		},
+	})
+}
+
+func TestClaimsHeaderValue(t *testing.T) {
+	user := &userContext{
+		id:            "subject",
+		email:         "gambol99@gmail.com",
+		preferredName: "rohith",
+		roles:         []string{"user"},
+		audiences:     []string{"test"},
+		expiresAt:     time.Unix(1700000000, 0),
+		claims:        jose.Claims{"department": "sales", "motto": strings.Repeat("a", 200)},
+	}
+
+	value, trimmed, err := claimsHeaderValue(user, []string{"department", "missing"}, defaultClaimsHeaderMaxSize)
+	require.NoError(t, err)
+	assert.False(t, trimmed)
+	assert.Equal(t, `{"id":"subject","email":"gambol99@gmail.com","preferred_username":"rohith","roles":["user"],"aud":["test"],"exp":1700000000,"claims":{"department":"sales"}}`, value)
+
+	// the add-claims are left out above the maximum size, then the whole header
+	value, trimmed, err = claimsHeaderValue(user, []string{"department", "motto"}, 200)
+	require.NoError(t, err)
+	assert.True(t, trimmed)
+	assert.Equal(t, `{"id":"subject","email":"gambol99@gmail.com","preferred_username":"rohith","roles":["user"],"aud":["test"],"exp":1700000000}`, value)
+	value, trimmed, err = claimsHeaderValue(user, []string{"department", "motto"}, 50)
+	require.NoError(t, err)
+	assert.True(t, trimmed)
+	assert.Empty(t, value)
+	value, _, err = claimsHeaderValue(user, nil, 50)
+	require.NoError(t, err)
+	assert.Empty(t, value)
+
+	// the json is base64url encoded when it is not ascii
+	user.preferredName = "rené"
+	value, _, err = claimsHeaderValue(user, nil, defaultClaimsHeaderMaxSize)
+	require.NoError(t, err)
+	assert.NotContains(t, value, "{")
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	require.NoError(t, err)
+	var claims claimsHeader
+	require.NoError(t, json.Unmarshal(content, &claims))
+	assert.Equal(t, "rené", claims.PreferredName)
+}
+
+func TestScrubIdentityHeaders(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.HeadersPrefix = "X-Forwarded-"
+	cfg.AddClaims = []string{"given_name"}
+	cfg.HeaderNames = map[string]string{identityHeaderUsername: "Remote-User"}
+	spoofed := map[string]string{
+		"X-Forwarded-Email":      "admin@example.com",
+		"X-Forwarded-Roles":      "admin",
+		"X-Forwarded-Claims":     `{"id":"admin"}`,
+		"X-Forwarded-Given-Name": "admin",
+		"X-Forwarded-Agent":      "gatekeeper",
+		"Remote-User":            "admin",
+	}
+	names := make([]string, 0, len(spoofed))
+	for name := range spoofed {
+		names = append(names, name)
+	}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:                    "/auth_all/white_listed/test",
+			Headers:                spoofed,
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedNoProxyHeaders: names,
+		},
+		{
+			// the headers which are not set by the proxy are left as sent
+			URI:                  "/auth_all/white_listed/test",
+			Headers:              map[string]string{"X-Auth-Email": "admin@example.com"},
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"X-Auth-Email": "admin@example.com"},
+		},
+	})
+
+	assert.Subset(t, cfg.spoofableHeaderNames(), names)
+}
+
+func TestIdentityValueEncoder(t *testing.T) {
+	assert.Nil(t, identityValueEncoder(""))
+
+	rfc8187 := identityValueEncoder(identityValueRFC8187)
+	cs := []struct {
+		Value    string
+		Expected string
+	}{
+		{Value: "Søren Ñuñez", Expected: "UTF-8''S%C3%B8ren%20%C3%91u%C3%B1ez"},
+		{Value: "party 🎉", Expected: "UTF-8''party%20%F0%9F%8E%89"},
+		// a combining acute accent, rather than a precomposed é
+		{Value: "Rene\u0301", Expected: "UTF-8''Rene%CC%81"},
+		{Value: "a/b;c=d,é", Expected: "UTF-8''a%2Fb%3Bc%3Dd%2C%C3%A9"},
+	}
+	for i, c := range cs {
+		assert.Equal(t, c.Expected, rfc8187(c.Value), "case %d", i)
+	}
+
+	encodeBase64 := identityValueEncoder(identityValueBase64)
+	decoder := new(mime.WordDecoder)
+	for i, c := range cs {
+		encoded := encodeBase64(c.Value)
+		assert.True(t, isASCII(encoded), "case %d", i)
+		assert.True(t, strings.HasPrefix(encoded, "=?UTF-8?b?"), "case %d", i)
+		decoded, err := decoder.DecodeHeader(encoded)
+		require.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Value, decoded, "case %d", i)
+	}
+	assert.Equal(t, "=?UTF-8?b?U8O4cmVu?=", encodeBase64("Søren"))
+}
+
+func TestIdentityHeadersEncodedOverHTTP2(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(&fakeUpstreamService{})
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	claims := map[string]interface{}{
+		"preferred_username": "Søren Ñuñez 🎉",
+		"name":               "Rene\u0301",
+	}
+	for _, encoding := range []string{identityValueRFC8187, identityValueBase64} {
+		cfg := newFakeKeycloakConfig()
+		cfg.UpstreamEnableHTTP2 = true
+		cfg.EncodeIdentityHeaders = encoding
+		cfg.AddClaims = []string{"name"}
+		cfg.Resources = []*Resource{
+			{URL: "/h2/*", Methods: allHTTPMethods, Upstream: upstream.URL, UpstreamTLS: &UpstreamTLS{SkipVerify: true}},
+		}
+		encode := identityValueEncoder(encoding)
+		newFakeProxy(cfg).RunTests(t, []fakeRequest{
+			{
+				URI:           "/h2/test",
+				HasToken:      true,
+				TokenClaims:   claims,
+				Groups:        []string{"/équipe", "/staff"},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+				ExpectedProxyHeaders: map[string]string{
+					"X-Auth-Username": encode("Søren Ñuñez 🎉"),
+					"X-Auth-Name":     encode("Rene\u0301"),
+					"X-Auth-Email":    "gambol99@gmail.com",
+				},
+				OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+					var echoed fakeUpstreamResponse
+					require.NoError(t, json.Unmarshal(resp.Body(), &echoed))
+					assert.Equal(t, "HTTP/2.0", echoed.Proto)
+					// the groups are encoded once joined
+					assert.Equal(t, encode("/équipe,/staff"), echoed.Headers.Get("X-Auth-Groups"))
+				},
+			},
+		})
+	}
+}
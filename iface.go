@@ -1,6 +1,14 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+)
 
 // storage is used to hold the offline refresh token, assuming you don't want to use
 // the default practice of a encrypted cookie
@@ -15,6 +23,86 @@ type storage interface {
 	Close() error
 }
 
+// expiringStorage is implemented by stores which entries may expire
+type expiringStorage interface {
+	// SetWithTTL adds an entry to the store, which expires after the duration
+	SetWithTTL(string, string, time.Duration) error
+}
+
+// collectingStorage is implemented by stores which purge their expired entries in the background
+type collectingStorage interface {
+	// collectGarbage purges the expired entries at every interval, until the context is done
+	collectGarbage(context.Context, time.Duration, *zap.Logger)
+}
+
+// checkedStorage is implemented by stores which depend on a remote service, to check it can be reached
+type checkedStorage interface {
+	// Ping checks the store can be reached
+	Ping(context.Context) error
+}
+
+// revocationStorage is implemented by stores shared by the replicas, which record the revocations of the sessions
+// atomically
+type revocationStorage interface {
+	// addRevocation records the revocation of the sessions of a subject at a time, and forgets the revocations older
+	// than the max age
+	addRevocation(subject string, at time.Time, maxAge time.Duration) error
+	// revocations lists the latest revocation of each subject since a time
+	revocations(since time.Time) (map[string]time.Time, error)
+}
+
+// rateLimitingStorage is implemented by stores shared by the replicas, which consume the tokens of a rate limit
+// atomically
+type rateLimitingStorage interface {
+	// takeTokens takes up to the wanted tokens from the bucket of the key, which holds up to the capacity and is
+	// refilled over the window, and returns the number of tokens taken
+	takeTokens(key string, capacity, want int, window time.Duration) (int, error)
+}
+
+// indexingStorage is implemented by stores shared by the replicas, which update the index of the sessions of the
+// subjects atomically. The sessions expire from the index with their entries.
+type indexingStorage interface {
+	// indexSession adds the entry of a session to the sessions of the subject, until it expires after the ttl if
+	// positive
+	indexSession(subject, key string, ttl time.Duration) error
+	// unindexSessions removes the entries of sessions from the sessions of the subject, and the subject from the
+	// index once it has no session left
+	unindexSessions(subject string, keys ...string) error
+	// indexedSessions lists the entries of the sessions of the subject which have not expired
+	indexedSessions(subject string) ([]string, error)
+	// indexedSubjects lists the subjects which have sessions which have not expired
+	indexedSubjects() ([]string, error)
+}
+
+// Store is the contract of the stores plugged with RegisterStore, e.g. in a file added to a fork:
+//
+//	func init() {
+//		RegisterStore("dynamodb", newDynamoDBStore)
+//	}
+//
+// The implementations must be safe for concurrent use, and pass the conformance test suite (RunStoreConformanceTests).
+// The stores depending on a remote service may also implement Ping(context.Context) error, which is called by
+// the health endpoint when the dependencies are checked.
+type Store interface {
+	// Set adds or overwrites an entry, which expires after the ttl if positive, or never expires otherwise
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// Get retrieves an entry, or an empty value without error when the entry is missing or expired
+	Get(ctx context.Context, key string) (string, error)
+	// Delete removes an entry, without error when the entry is missing
+	Delete(ctx context.Context, key string) error
+	// Close releases the resources of the store
+	Close() error
+}
+
+// StoreOptions are the options of the configuration passed to the store factories
+type StoreOptions struct {
+	// TLSConfig is the tls configuration of the connection to the store, if any
+	TLSConfig *tls.Config
+}
+
+// StoreFactory creates a store from the store url
+type StoreFactory func(location *url.URL, options StoreOptions) (Store, error)
+
 // reverseProxy is a wrapper for any underlying handler
 type reverseProxy interface {
 	ServeHTTP(rw http.ResponseWriter, req *http.Request)
@@ -0,0 +1,231 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+// Triggers of a refresh of the signing keys
+const (
+	jwksRefreshStartup    = "startup"
+	jwksRefreshBackground = "background"
+	jwksRefreshUnknownKey = "unknown-key"
+)
+
+// The documents of the provider cached by the proxy
+const (
+	oidcDocumentDiscovery = "discovery"
+	oidcDocumentJWKS      = "jwks"
+)
+
+// jwksRefreshKey is the key of the refreshes of the keys in flight, shared by the triggers
+const jwksRefreshKey = "jwks"
+
+// jwksCache holds the signing keys of the provider. The keys are refreshed in the background, and on demand when a
+// token is signed with an unknown key: the refreshes on demand are rate limited, and the concurrent ones share a
+// single fetch, so a key rotation does not lead every request to fetch the keys.
+type jwksCache struct {
+	client   *http.Client
+	endpoint string
+	issuer   string
+	log      *zap.Logger
+	// minInterval is the minimum interval between two attempts of a refresh on demand
+	minInterval time.Duration
+
+	sync.RWMutex
+	keys []signingKey
+	// refreshed is the time of the last successful refresh, attempted the time of the last attempt
+	refreshed time.Time
+	attempted time.Time
+
+	refreshes singleflight.Group
+}
+
+func newJWKSCache(client *http.Client, config oidc.ProviderConfig, minInterval time.Duration, log *zap.Logger) *jwksCache {
+	return &jwksCache{
+		client:      client,
+		endpoint:    config.KeysEndpoint.String(),
+		issuer:      config.Issuer.String(),
+		minInterval: minInterval,
+		log:         log,
+	}
+}
+
+// fetch retrieves the signing keys from the provider, the keys which cannot be read are skipped
+func (c *jwksCache) fetch(ctx context.Context) ([]signingKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the keys endpoint responded with %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("unable to decode the keys: %w", err)
+	}
+	keys := make([]signingKey, 0, len(set.Keys))
+	for _, raw := range set.Keys {
+		k, err := parseSigningKey(raw)
+		if err != nil {
+			c.log.Debug("skipping a key of the provider which cannot be read", zap.Error(err))
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the provider has no signing key")
+	}
+
+	return keys, nil
+}
+
+// refresh replaces the signing keys by the ones of the provider
+func (c *jwksCache) refresh(ctx context.Context, trigger string) error {
+	c.Lock()
+	c.attempted = time.Now()
+	c.Unlock()
+
+	keys, err := c.fetch(ctx)
+	if err != nil {
+		// @metric a refresh of the signing keys failed
+		jwksRefreshFailuresMetric.WithLabelValues(trigger).Inc()
+		c.log.Warn("unable to refresh the signing keys of the provider", zap.String("trigger", trigger), zap.Error(err))
+
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.keys = keys
+	c.refreshed = time.Now()
+	// @metric the time the signing keys were retrieved
+	oidcDocumentFetchMetric.WithLabelValues(oidcDocumentJWKS).Set(float64(c.refreshed.Unix()))
+	c.log.Debug("refreshed the signing keys of the provider", zap.String("trigger", trigger), zap.Int("keys", len(keys)))
+
+	return nil
+}
+
+// refreshUnknownKey refreshes the keys on demand, when a token is signed with an unknown key. The refresh is skipped
+// within the minimum interval of the last attempt, and the concurrent refreshes wait for a single fetch.
+func (c *jwksCache) refreshUnknownKey() error {
+	_, err, _ := c.refreshes.Do(jwksRefreshKey, func() (interface{}, error) {
+		c.RLock()
+		tooSoon := time.Since(c.attempted) < c.minInterval
+		c.RUnlock()
+		if tooSoon {
+			return nil, nil
+		}
+
+		return nil, c.refresh(context.Background(), jwksRefreshUnknownKey)
+	})
+
+	return err
+}
+
+// refreshPeriodically refreshes the keys in the background, until the context is done
+func (c *jwksCache) refreshPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _, _ = c.refreshes.Do(jwksRefreshKey, func() (interface{}, error) {
+				return nil, c.refresh(ctx, jwksRefreshBackground)
+			})
+		}
+	}
+}
+
+// lastRefresh returns the time of the last successful refresh, zero if the keys were never retrieved
+func (c *jwksCache) lastRefresh() time.Time {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.refreshed
+}
+
+// keysOf returns the keys which may have signed the token: the key with its key id, all the keys otherwise
+func (c *jwksCache) keysOf(token jose.JWT) []signingKey {
+	c.RLock()
+	defer c.RUnlock()
+
+	kid, found := token.KeyID()
+	if !found {
+		return c.keys
+	}
+	for _, k := range c.keys {
+		if k.ID() == kid {
+			return []signingKey{k}
+		}
+	}
+
+	return nil
+}
+
+// verifySignature checks the signature of the token with the known keys
+func (c *jwksCache) verifySignature(token jose.JWT) bool {
+	algorithm := token.Header[jose.HeaderKeyAlgorithm]
+	for _, k := range c.keysOf(token) {
+		if k.verify(algorithm, []byte(token.Data()), token.Signature) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verify checks the claims and the signature of the token, the keys are refreshed when none of them matches. The
+// signing algorithm of the token must have been accepted beforehand.
+func (c *jwksCache) verify(clientID string, token jose.JWT) error {
+	// the claims are checked first, to throw out the invalid tokens without verifying their signature
+	if err := oidc.VerifyClaims(token, c.issuer, clientID); err != nil {
+		return fmt.Errorf("oidc: JWT claims invalid: %v", err)
+	}
+	if c.verifySignature(token) {
+		return nil
+	}
+	if err := c.refreshUnknownKey(); err != nil {
+		return fmt.Errorf("oidc: unable to sync key set from remote source: %v", err)
+	}
+	if !c.verifySignature(token) {
+		return errors.New("oidc: unable to verify JWT signature: no matching keys")
+	}
+
+	return nil
+}
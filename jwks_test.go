@@ -0,0 +1,150 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotateKey replaces the signing key of the provider
+func (r *fakeAuthServer) rotateKey(t *testing.T, kid string) {
+	privateKey, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	require.NoError(t, err)
+	r.key = jose.JWK{
+		ID:       kid,
+		Type:     "RSA",
+		Alg:      "RS256",
+		Use:      "sig",
+		Exponent: privateKey.PublicKey.E,
+		Modulus:  privateKey.PublicKey.N,
+	}
+	r.signer = jose.NewSignerRSA(kid, *privateKey)
+}
+
+func TestJWKSStartup(t *testing.T) {
+	proxy, auth, _ := newTestProxyService(nil)
+	require.NotNil(t, proxy.jwks)
+	assert.False(t, proxy.jwks.lastRefresh().IsZero())
+
+	signed, err := auth.signToken(newTestToken(auth.getLocation()).claims)
+	require.NoError(t, err)
+	requests := atomic.LoadInt32(&auth.keyRequests)
+	assert.NoError(t, proxy.verifyToken(proxy.client, *signed))
+	// the known keys are not fetched again
+	assert.Equal(t, requests, atomic.LoadInt32(&auth.keyRequests))
+}
+
+func TestJWKSUnknownKey(t *testing.T) {
+	proxy, auth, _ := newTestProxyService(nil)
+	auth.rotateKey(t, "rotated-kid")
+	signed, err := auth.signToken(newTestToken(auth.getLocation()).claims)
+	require.NoError(t, err)
+
+	// the keys were refreshed within the minimum interval: the unknown key is refused without a refresh
+	requests := atomic.LoadInt32(&auth.keyRequests)
+	assert.Error(t, proxy.verifyToken(proxy.client, *signed))
+	assert.Equal(t, requests, atomic.LoadInt32(&auth.keyRequests))
+
+	// once the interval has elapsed, the concurrent verifications share a single refresh
+	proxy.jwks.minInterval = time.Hour
+	proxy.jwks.Lock()
+	proxy.jwks.attempted = time.Time{}
+	proxy.jwks.Unlock()
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- proxy.verifyToken(proxy.client, *signed)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, requests+1, atomic.LoadInt32(&auth.keyRequests))
+}
+
+func TestJWKSRefreshPeriodically(t *testing.T) {
+	proxy, auth, _ := newTestProxyService(nil)
+	refreshed := proxy.jwks.lastRefresh()
+	auth.rotateKey(t, "rotated-kid")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go proxy.jwks.refreshPeriodically(ctx, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return proxy.jwks.lastRefresh().After(refreshed)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the rotated key is known without a refresh on demand
+	proxy.jwks.minInterval = time.Hour
+	signed, err := auth.signToken(newTestToken(auth.getLocation()).claims)
+	require.NoError(t, err)
+	assert.NoError(t, proxy.verifyToken(proxy.client, *signed))
+}
+
+func TestJWKSRefreshFailure(t *testing.T) {
+	proxy, _, _ := newTestProxyService(nil)
+	refreshed := proxy.jwks.lastRefresh()
+	keys := proxy.jwks.keys
+
+	// the keys are kept when the provider cannot be reached
+	proxy.jwks.endpoint = "http://127.0.0.1:1/certs"
+	assert.Error(t, proxy.jwks.refresh(context.Background(), jwksRefreshBackground))
+	assert.Equal(t, refreshed, proxy.jwks.lastRefresh())
+	assert.Equal(t, keys, proxy.jwks.keys)
+}
+
+func TestJWKSExtraIssuers(t *testing.T) {
+	previous := newFakeAuthServer()
+	defer previous.Close()
+	previous.rotateKey(t, "previous-kid")
+	cfg := newFakeKeycloakConfig()
+	cfg.ExtraIssuers = []string{previous.getLocation()}
+	proxy, auth, _ := newTestProxyService(cfg)
+	require.Contains(t, proxy.extraIssuers, previous.getLocation())
+
+	// step: the tokens of both issuers are accepted, each verified with the keys of its issuer
+	signed, err := auth.signToken(newTestToken(auth.getLocation()).claims)
+	require.NoError(t, err)
+	assert.NoError(t, proxy.verifyToken(proxy.client, *signed))
+	signed, err = previous.signToken(newTestToken(previous.getLocation()).claims)
+	require.NoError(t, err)
+	assert.NoError(t, proxy.verifyToken(proxy.client, *signed))
+
+	// step: a token claiming an extra issuer is not verified with the keys of the provider
+	signed, err = auth.signToken(newTestToken(previous.getLocation()).claims)
+	require.NoError(t, err)
+	assert.Error(t, proxy.verifyToken(proxy.client, *signed))
+
+	// step: the other issuers are refused
+	signed, err = auth.signToken(newTestToken("https://unknown.example.com/realms/x").claims)
+	require.NoError(t, err)
+	assert.Error(t, proxy.verifyToken(proxy.client, *signed))
+}
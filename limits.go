@@ -0,0 +1,186 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// Limits on the size of requests, which may be measured before being enforced
+const (
+	limitTokenSize         = "token-size"
+	limitCookieChunks      = "cookie-chunks"
+	limitRequestHeaderSize = "request-header-size"
+	// the size of the request bodies is always enforced, as the body of a request let through is not measured
+	limitRequestBodySize = "request-body-size"
+)
+
+// Modes of a limit
+const (
+	limitModeEnforce = "enforce"
+	limitModeMeasure = "measure"
+)
+
+// limitViolationLogSampling is the sampling rate of the logs about limit violations: one violation out of N is logged
+const limitViolationLogSampling = 100
+
+var knownLimits = []string{limitTokenSize, limitCookieChunks, limitRequestHeaderSize}
+
+// requestLimit caps some measure of the incoming requests.
+//
+// The same check serves both modes: in measure mode, violations are counted and logged but the request goes through.
+type requestLimit struct {
+	name       string
+	max        int
+	mode       string
+	violations uint64
+}
+
+// newRequestLimit returns a limit, or nil when there is no such limit configured
+func newRequestLimit(name string, max int, measured []string) *requestLimit {
+	if max <= 0 {
+		return nil
+	}
+	mode := limitModeEnforce
+	if containsString(name, measured) {
+		mode = limitModeMeasure
+	}
+
+	return &requestLimit{name: name, max: max, mode: mode}
+}
+
+// exceeded tells if the limit is exceeded and enforced. Violations are counted and logged in both modes.
+func (l *requestLimit) exceeded(log *zap.Logger, size int, fields ...zap.Field) bool {
+	if l == nil || size <= l.max {
+		return false
+	}
+
+	// @metric a request has exceeded a limit
+	limitViolationsMetric.WithLabelValues(l.name, l.mode).Inc()
+	if n := atomic.AddUint64(&l.violations, 1); n%limitViolationLogSampling == 1 {
+		log.Warn("request limit exceeded", append(fields,
+			zap.String("limit", l.name),
+			zap.String("mode", l.mode),
+			zap.Int("size", size),
+			zap.Int("max", l.max),
+			zap.Uint64("violations", n))...)
+	}
+
+	return l.mode == limitModeEnforce
+}
+
+// requestHeaderSize is the size of the request line and headers, as received on the wire
+func requestHeaderSize(req *http.Request) int {
+	// e.g. "GET /uri HTTP/1.1\r\n"
+	size := len(req.Method) + len(req.URL.RequestURI()) + len(req.Proto) + 4
+	if req.Host != "" && req.Header.Get("Host") == "" {
+		size += len("Host: \r\n") + len(req.Host)
+	}
+	for name, values := range req.Header {
+		for _, value := range values {
+			// e.g. "Name: value\r\n"
+			size += len(name) + len(value) + 4
+		}
+	}
+
+	return size
+}
+
+// requestHeaderSizeMiddleware rejects requests with oversized headers
+func (r *oauthProxy) requestHeaderSizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.headerSizeLimit.exceeded(r.log, requestHeaderSize(req), zap.String("client_ip", req.RemoteAddr), zap.String("path", req.URL.Path)) {
+			// the violation is already logged (sampled)
+			errorResponse(w, "", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// maxRequestBodySizeOf returns the maximum size of the request bodies of a resource: its own limit, else the global one
+func (r *oauthProxy) maxRequestBodySizeOf(resource *Resource) int {
+	if resource != nil && resource.MaxRequestBodySize != nil {
+		return *resource.MaxRequestBodySize
+	}
+
+	return r.config.MaxRequestBodySize
+}
+
+// limitedRequestBody is a request body capped by http.MaxBytesReader, which tells if the body exceeded the limit
+type limitedRequestBody struct {
+	io.ReadCloser
+	max      int
+	read     int
+	exceeded bool
+	// violation counts and logs the violation, once
+	violation func(size int)
+}
+
+func (b *limitedRequestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += n
+	// the reader returns an error, rather than more than the limit
+	if err != nil && err != io.EOF && b.read >= b.max && !b.exceeded {
+		b.exceeded = true
+		b.violation(b.read + 1)
+	}
+
+	return n, err
+}
+
+// isRequestBodyTooLarge tells if the body of a request exceeded its limit while being proxied
+func isRequestBodyTooLarge(req *http.Request) bool {
+	body, ok := req.Body.(*limitedRequestBody)
+
+	return ok && body.exceeded
+}
+
+// requestBodySizeMiddleware rejects the requests announcing a body larger than the limit of a resource, and caps the
+// bodies of the others, so the upstream request is aborted once the limit is exceeded
+func (r *oauthProxy) requestBodySizeMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	limit := newRequestLimit(limitRequestBodySize, r.maxRequestBodySizeOf(resource), nil)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fields := []zap.Field{zap.String("client_ip", req.RemoteAddr), zap.String("path", req.URL.Path)}
+			if req.ContentLength > int64(limit.max) {
+				// the body is not read
+				limit.exceeded(r.log, int(req.ContentLength), fields...)
+				errorResponse(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			// the body is replaced in place, as the proxy stage forwards the request it has been given
+			if req.Body != nil && req.Body != http.NoBody {
+				req.Body = &limitedRequestBody{
+					ReadCloser: http.MaxBytesReader(w, req.Body, int64(limit.max)),
+					max:        limit.max,
+					violation:  func(size int) { limit.exceeded(r.log, size, fields...) },
+				}
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
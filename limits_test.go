@@ -0,0 +1,195 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestLimit(t *testing.T) {
+	assert.Nil(t, newRequestLimit(limitTokenSize, 0, nil))
+
+	var none *requestLimit
+	assert.False(t, none.exceeded(zap.NewNop(), 1<<20))
+
+	enforced := newRequestLimit(limitTokenSize, 10, []string{limitCookieChunks})
+	require.NotNil(t, enforced)
+	assert.Equal(t, limitModeEnforce, enforced.mode)
+	assert.False(t, enforced.exceeded(zap.NewNop(), 10))
+	assert.True(t, enforced.exceeded(zap.NewNop(), 11))
+
+	measured := newRequestLimit(limitCookieChunks, 10, []string{limitCookieChunks})
+	require.NotNil(t, measured)
+	assert.Equal(t, limitModeMeasure, measured.mode)
+
+	// violations are logged with sampling
+	core, logs := observer.New(zapcore.WarnLevel)
+	for i := 0; i <= limitViolationLogSampling; i++ {
+		assert.False(t, measured.exceeded(zap.New(core), 11))
+	}
+	assert.Equal(t, 2, logs.FilterMessage("request limit exceeded").Len())
+	assert.Equal(t, uint64(limitViolationLogSampling+1), measured.violations)
+}
+
+func TestRequestHeaderSize(t *testing.T) {
+	req := newFakeHTTPRequest(http.MethodGet, "/test")
+	req.Proto = "HTTP/1.1"
+	req.Host = ""
+	req.Header.Set("X-Test", "value")
+	assert.Equal(t, len("GET /test HTTP/1.1\r\n")+len("X-Test: value\r\n"), requestHeaderSize(req))
+}
+
+func TestTokenSizeLimit(t *testing.T) {
+	for _, measured := range []bool{false, true} {
+		c := newFakeKeycloakConfig()
+		c.MaxTokenSize = 64
+		c.EnableMetrics = true
+		expected := http.StatusRequestHeaderFieldsTooLarge
+		if measured {
+			c.MeasuredLimits = []string{limitTokenSize}
+			expected = http.StatusOK
+		}
+		requests := []fakeRequest{
+			{
+				URI:           "/auth_all/test",
+				HasToken:      true,
+				ExpectedProxy: measured,
+				ExpectedCode:  expected,
+			},
+			{
+				URI:                     c.WithOAuthURI(metricsURL),
+				ExpectedCode:            http.StatusOK,
+				ExpectedContentContains: `proxy_limit_violations_total{limit="token-size",mode="` + newRequestLimit(limitTokenSize, c.MaxTokenSize, c.MeasuredLimits).mode + `"}`,
+			},
+		}
+		newFakeProxy(c).RunTests(t, requests)
+	}
+}
+
+func TestRequestHeaderSizeLimit(t *testing.T) {
+	c := newFakeKeycloakConfig()
+	c.MaxRequestHeaderSize = 2048
+	requests := []fakeRequest{
+		{
+			URI:           "/auth_all/white_listed/test",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/auth_all/white_listed/test",
+			Headers:       map[string]string{"X-Large": strings.Repeat("a", 2048)},
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+	newFakeProxy(c).RunTests(t, requests)
+}
+
+// chunkedReader hides the length of a body, so the request streams it without Content-Length
+type chunkedReader struct {
+	io.Reader
+}
+
+func TestRequestBodySizeLimit(t *testing.T) {
+	var received []int
+	var lock sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		received = append(received, len(body))
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	unlimited, larger := 0, 4096
+	c := newFakeKeycloakConfig()
+	c.Upstream = upstream.URL
+	c.MaxRequestBodySize = 1024
+	c.Resources = []*Resource{
+		{URL: "/upload/*", WhiteListed: true, Methods: allHTTPMethods},
+		{URL: "/archive/*", WhiteListed: true, Methods: allHTTPMethods, MaxRequestBodySize: &larger},
+		{URL: "/import/*", WhiteListed: true, Methods: allHTTPMethods, MaxRequestBodySize: &unlimited},
+	}
+	p := newFakeProxy(c)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	var err error
+	p.proxy.upstream, err = p.proxy.newUpstreamProxy(nil, nil)
+	require.NoError(t, err)
+
+	cs := []struct {
+		URI      string
+		Size     int
+		Chunked  bool
+		Expected int
+	}{
+		{URI: "/upload/file", Size: 1024, Expected: http.StatusOK},
+		{URI: "/upload/file", Size: 1024, Chunked: true, Expected: http.StatusOK},
+		{URI: "/upload/file", Size: 1025, Expected: http.StatusRequestEntityTooLarge},
+		{URI: "/upload/file", Size: 8 << 10, Chunked: true, Expected: http.StatusRequestEntityTooLarge},
+		{URI: "/archive/file", Size: 4096, Expected: http.StatusOK},
+		{URI: "/archive/file", Size: 4097, Chunked: true, Expected: http.StatusRequestEntityTooLarge},
+		{URI: "/import/file", Size: 8 << 10, Chunked: true, Expected: http.StatusOK},
+	}
+	for i, x := range cs {
+		lock.Lock()
+		received = nil
+		lock.Unlock()
+
+		var body io.Reader = bytes.NewReader(make([]byte, x.Size))
+		if x.Chunked {
+			body = chunkedReader{body}
+		}
+		req, err := http.NewRequest(http.MethodPost, p.getServiceURL()+x.URI, body)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "case %d", i)
+		content, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, x.Expected, resp.StatusCode, "case %d", i)
+
+		lock.Lock()
+		if x.Expected == http.StatusOK {
+			assert.Equal(t, []int{x.Size}, received, "case %d: the upstream got the whole body", i)
+		} else {
+			assert.Contains(t, string(content), "request body too large", "case %d", i)
+			assert.Empty(t, received, "case %d: the upstream never got a truncated body", i)
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,200 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+// loginReplayDuration is the time left to the user to log in and confirm the replay of a kept request
+const loginReplayDuration = 10 * time.Minute
+
+// loginReplay is a request interrupted by the login, kept in the store until the user confirms its replay
+type loginReplay struct {
+	Method      string `json:"method"`
+	URI         string `json:"uri"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+	ExpiresAt   int64  `json:"expires_at"`
+}
+
+// loginReplayPage asks the user to confirm the replay of the request, which is never replayed without a
+// deliberate action
+var loginReplayPage = template.Must(template.New("login-replay").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="UTF-8">
+  <title>Submit the form again?</title>
+</head>
+<body>
+  <p>Your session had expired when you submitted a form to {{ .URI }}. The form was kept while you signed in.</p>
+  <form method="POST" action="{{ .Action }}">
+    <input type="hidden" name="state" value="{{ .State }}">
+    <button type="submit">Submit the form again</button>
+    <a href="{{ .Cancel }}">Discard the form</a>
+  </form>
+</body>
+</html>
+`))
+
+// readLoginReplay reads the request of a browser to keep it during the login, when its body is small enough
+func (r *oauthProxy) readLoginReplay(req *http.Request) (*loginReplay, bool) {
+	if !r.config.EnableLoginReplay || !isBrowserRequest(req) {
+		return nil, false
+	}
+	limit := int64(r.config.LoginReplayMaxSize)
+	if req.ContentLength > limit {
+		return nil, false
+	}
+	var body []byte
+	if req.Body != nil {
+		content, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+		if err != nil || int64(len(content)) > limit {
+			return nil, false
+		}
+		body = content
+	}
+
+	return &loginReplay{
+		Method:      req.Method,
+		URI:         req.URL.RequestURI(),
+		ContentType: req.Header.Get("Content-Type"),
+		Body:        body,
+		ExpiresAt:   time.Now().Add(loginReplayDuration).Unix(),
+	}, true
+}
+
+// keepLoginReplay keeps the request in the store until the login of the state completes
+func (r *oauthProxy) keepLoginReplay(state string, replay *loginReplay) error {
+	value, err := json.Marshal(replay)
+	if err != nil {
+		return err
+	}
+
+	return r.setLoginReplay(state, string(value), loginReplayDuration)
+}
+
+// findLoginReplay returns the request kept during the login of the state, if it has not expired
+func (r *oauthProxy) findLoginReplay(state string) (*loginReplay, bool) {
+	value, err := r.getLoginReplay(state)
+	if err != nil {
+		return nil, false
+	}
+	replay := &loginReplay{}
+	if err := json.Unmarshal([]byte(value), replay); err != nil {
+		r.log.Warn("unable to decode the request kept during the login", zap.Error(err))
+		return nil, false
+	}
+	if time.Now().Unix() > replay.ExpiresAt {
+		_ = r.deleteLoginReplay(state)
+		return nil, false
+	}
+
+	return replay, true
+}
+
+// isLoginState checks the state is the one of the login flow of the browser, kept in the state cookie
+func (r *oauthProxy) isLoginState(req *http.Request, state string) bool {
+	expected, _, found := r.getStateParameter(req)
+
+	return found && state != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(state)) == 1
+}
+
+// renderLoginReplay renders the confirmation of the replay at the end of the login, when a request was kept by the
+// login of the state
+func (r *oauthProxy) renderLoginReplay(w http.ResponseWriter, req *http.Request, state, cancel string) bool {
+	if !r.isLoginState(req, state) {
+		return false
+	}
+	replay, found := r.findLoginReplay(state)
+	if !found {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	noSniff(w)
+	w.WriteHeader(http.StatusOK)
+	if err := loginReplayPage.Execute(w, map[string]string{
+		"Action": r.config.WithOAuthURI(loginReplayURL),
+		"Cancel": cancel,
+		"State":  state,
+		"URI":    replay.URI,
+	}); err != nil {
+		r.log.Error("unable to render the confirmation of the replay", zap.Error(err))
+	}
+
+	return true
+}
+
+// loginReplayHandler replays the request kept during the login, once confirmed by the user. The state posted by the
+// confirmation must be the one of the state cookie, and the request is replayed once.
+func (r *oauthProxy) loginReplayHandler(w http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(w, req.Body, 1024)
+	state := req.PostFormValue("state")
+	if !r.isLoginState(req, state) {
+		r.errorResponse(w, req, "the confirmation of the replay does not match the login", http.StatusBadRequest, nil)
+		return
+	}
+	replay, found := r.findLoginReplay(state)
+	if !found {
+		r.errorResponse(w, req, "the request kept during the login has expired", http.StatusGone, nil)
+		return
+	}
+	if err := r.deleteLoginReplay(state); err != nil {
+		r.errorResponse(w, req, "unable to remove the request kept during the login", http.StatusInternalServerError, err)
+		return
+	}
+
+	// step: the request is routed again, with the cookies of the new session
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, nil)
+	replayed, err := http.NewRequestWithContext(ctx, replay.Method, replay.URI, bytes.NewReader(replay.Body))
+	if err != nil {
+		r.errorResponse(w, req, "unable to replay the request kept during the login", http.StatusInternalServerError, err)
+		return
+	}
+	replayed.Header = req.Header.Clone()
+	replayed.Header.Del("Content-Length")
+	replayed.Header.Del("Content-Type")
+	if replay.ContentType != "" {
+		replayed.Header.Set("Content-Type", replay.ContentType)
+	}
+	replayed.Host = req.Host
+	replayed.RemoteAddr = req.RemoteAddr
+	replayed.RequestURI = replay.URI
+	replayed.TLS = req.TLS
+
+	r.log.Info("replaying the request kept during the login",
+		zap.String("method", replay.Method),
+		zap.String("uri", replay.URI))
+
+	r.router.ServeHTTP(w, replayed)
+}
@@ -0,0 +1,178 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replayedRequest is the request received by the upstream
+type replayedRequest struct {
+	method      string
+	uri         string
+	contentType string
+	body        string
+}
+
+func newLoginReplayConfig() *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableLoginReplay = true
+	cfg.LoginReplayMaxSize = 64
+	cfg.EncryptionKey = testKey
+	cfg.StoreURL = "memory://"
+
+	return cfg
+}
+
+func TestLoginReplayNotNavigation(t *testing.T) {
+	browser := map[string]string{"Accept": "text/html,application/xhtml+xml"}
+
+	// without the login replay, only the navigations are redirected to the login
+	newFakeProxy(newFakeKeycloakConfig()).RunTests(t, []fakeRequest{
+		{
+			URI:          "/auth_all/test",
+			Method:       http.MethodPost,
+			Redirects:    true,
+			Headers:      browser,
+			FormValues:   map[string]string{"comment": "hello"},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          "/auth_all/test",
+			Method:       http.MethodDelete,
+			Redirects:    true,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          "/auth_all/test",
+			Redirects:    true,
+			Headers:      browser,
+			ExpectedCode: http.StatusTemporaryRedirect,
+		},
+	})
+
+	newFakeProxy(newLoginReplayConfig()).RunTests(t, []fakeRequest{
+		{
+			URI:          "/auth_all/test",
+			Method:       http.MethodPost,
+			Redirects:    true,
+			Headers:      browser,
+			FormValues:   map[string]string{"comment": "hello"},
+			ExpectedCode: http.StatusSeeOther,
+		},
+		{
+			// the api clients are not redirected
+			URI:          "/auth_all/test",
+			Method:       http.MethodPost,
+			Redirects:    true,
+			FormValues:   map[string]string{"comment": "hello"},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			// the body is too large to be kept
+			URI:          "/auth_all/test",
+			Method:       http.MethodPost,
+			Redirects:    true,
+			Headers:      browser,
+			FormValues:   map[string]string{"comment": strings.Repeat("hello", 20)},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	})
+}
+
+func TestLoginReplay(t *testing.T) {
+	p := newFakeProxy(newLoginReplayConfig())
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	var replayed []replayedRequest
+	p.proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		replayed = append(replayed, replayedRequest{
+			method:      req.Method,
+			uri:         req.URL.RequestURI(),
+			contentType: req.Header.Get("Content-Type"),
+			body:        string(body),
+		})
+		w.WriteHeader(http.StatusOK)
+	})
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+	service, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+
+	// step: the form is posted without a session, kept during the login and confirmed at the end of the login
+	req, err := http.NewRequest(http.MethodPost, service.String()+"/auth_all/form?tab=1", strings.NewReader("comment=hello"))
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	page, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(page), `action="/oauth/replay"`)
+	assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"))
+	assert.Empty(t, replayed, "the form must not be replayed without a confirmation")
+
+	var state string
+	for _, cookie := range jar.Cookies(service) {
+		if cookie.Name == requestStateCookie {
+			state = strings.SplitN(cookie.Value, "|", 2)[0]
+		}
+	}
+	require.NotEmpty(t, state)
+	assert.Contains(t, string(page), state)
+
+	// step: a confirmation which does not match the login is refused
+	resp, err = client.PostForm(service.String()+"/oauth/replay", url.Values{"state": {"forged"}})
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// step: the form is replayed once, with the new session
+	resp, err = client.PostForm(service.String()+"/oauth/replay", url.Values{"state": {state}})
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, replayed, 1)
+	assert.Equal(t, replayedRequest{
+		method:      http.MethodPost,
+		uri:         "/auth_all/form?tab=1",
+		contentType: "application/x-www-form-urlencoded",
+		body:        "comment=hello",
+	}, replayed[0])
+
+	resp, err = client.PostForm(service.String()+"/oauth/replay", url.Values{"state": {state}})
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	assert.Len(t, replayed, 1)
+}
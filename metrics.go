@@ -1,11 +1,10 @@
 package main
 
 import (
-	"net"
-	"net/http"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -29,12 +28,170 @@ var (
 		},
 		[]string{"action"},
 	)
+	// latencyMetric is kept for compatibility with existing dashboards: it is superseded by totalDurationMetric
 	latencyMetric = prometheus.NewSummary(
 		prometheus.SummaryOpts{
 			Name: "proxy_request_duration_seconds",
-			Help: "A summary of the http request latency for proxy requests (seconds)",
+			Help: "A summary of the http request latency for proxy requests (seconds). Deprecated: use proxy_request_total_duration_seconds",
 		},
 	)
+	totalDurationMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "proxy_request_total_duration_seconds",
+			Help:    "The end-to-end duration of the http requests handled by the proxy (seconds)",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"resource", "method"},
+	)
+	authDurationMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "proxy_auth_duration_seconds",
+			Help:    "The duration of the processing by the proxy (authentication, token refresh, authorization) before a request is sent upstream (seconds)",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"resource", "method"},
+	)
+	upstreamDurationMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "proxy_upstream_duration_seconds",
+			Help:    "The duration from sending a request upstream to receiving the response headers (seconds)",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"resource", "method"},
+	)
+	limitViolationsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_limit_violations_total",
+			Help: "The requests exceeding a limit, partitioned by limit and mode (requests are only rejected in enforce mode)",
+		},
+		[]string{"limit", "mode"},
+	)
+	ocspFetchErrorsMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_ocsp_fetch_errors_total",
+			Help: "The total amount of failed fetches of the ocsp response stapled to the listener certificate",
+		},
+	)
+	ocspStapleProducedMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "proxy_ocsp_staple_this_update_timestamp_seconds",
+			Help: "The time the stapled ocsp response was produced, from which the age of the staple is derived",
+		},
+	)
+	ocspStapleNextUpdateMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "proxy_ocsp_staple_next_update_timestamp_seconds",
+			Help: "The time the stapled ocsp response expires",
+		},
+	)
+	certificateExpiryMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_tls_certificate_expiry_timestamp_seconds",
+			Help: "The time the earliest expiring certificate loaded from a file expires, partitioned by purpose (listener, upstream-client or forwarding-ca)",
+		},
+		[]string{"purpose"},
+	)
+	oidcDocumentFetchMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_oidc_document_fetch_timestamp_seconds",
+			Help: "The time the document of the provider was last retrieved, partitioned by document (discovery or jwks)",
+		},
+		[]string{"document"},
+	)
+	ocspStapleValidMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "proxy_ocsp_staple_valid",
+			Help: "Whether a valid ocsp response is stapled to the listener certificate (1) or not (0)",
+		},
+	)
+	storePurgedEntriesMetric = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "proxy_store_purged_entries_total",
+			Help: "The total amount of expired entries purged from the store",
+		},
+	)
+	revocationEvictionsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_revocation_evictions_total",
+			Help: "The revocations of sessions evicted from memory, partitioned by reason (expired past the session-revocation-max-age, or over the capacity)",
+		},
+		[]string{"reason"},
+	)
+	authFailuresMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_auth_failures_total",
+			Help: "The authentication failures, partitioned by reason, family of user agent and client id of the bearer token",
+		},
+		[]string{"reason", "user_agent", "client_id"},
+	)
+	callbackRejectionsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_callback_rejections_total",
+			Help: "The callbacks rejected before the code exchange, partitioned by reason (missing or malformed parameters)",
+		},
+		[]string{"reason"},
+	)
+	jwksRefreshFailuresMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_jwks_refresh_failures_total",
+			Help: "The failed refreshes of the signing keys of the provider, partitioned by trigger (startup, background or unknown key)",
+		},
+		[]string{"trigger"},
+	)
+	rateLimitFallbacksMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_rate_limit_fallbacks_total",
+			Help: "The requests limited by the replica alone, as the store sharing the rate limit was unavailable, partitioned by limit",
+		},
+		[]string{"limit"},
+	)
+	rateLimitedRequestsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_rate_limited_requests_total",
+			Help: "The requests refused as their caller exceeded the request rate limit, partitioned by key (subject or ip)",
+		},
+		[]string{"key"},
+	)
+	captureEventsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_capture_events_total",
+			Help: "The request captures started, stopped or expired, and the requests they captured, partitioned by event",
+		},
+		[]string{"event"},
+	)
+	forwardingLoginMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_forwarding_login_total",
+			Help: "The logins of the forwarding proxy to acquire the tokens signing the outbound requests, partitioned by result (success or failure)",
+		},
+		[]string{"result"},
+	)
+	forwardingRefreshMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_forwarding_refresh_total",
+			Help: "The refreshes of the tokens of the forwarding proxy, partitioned by result (success, failure or expired refresh token)",
+		},
+		[]string{"result"},
+	)
+	forwardingRequestsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_forwarding_requests_total",
+			Help: "The requests relayed by the forwarding proxy, partitioned by outcome (signed, passed through when the domain is not signed, or excluded by its path)",
+		},
+		[]string{"outcome"},
+	)
+	forwardingLoginBackoffMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_forwarding_login_backoff_seconds",
+			Help: "The delay before the next attempt of the failed login of each identity of the forwarding proxy, zero once logged in (seconds)",
+		},
+		[]string{"identity"},
+	)
+	forwardingTokenExpiryMetric = newExpiryCollector(prometheus.NewDesc(
+		"proxy_forwarding_token_expiry_seconds",
+		"The lifetime left to the current token of each identity of the forwarding proxy (seconds)",
+		[]string{"identity"}, nil,
+	))
 	statusMetric = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "proxy_request_status_total",
@@ -47,29 +204,63 @@ var (
 func init() {
 	prometheus.MustRegister(certificateRotationMetric)
 	prometheus.MustRegister(latencyMetric)
+	prometheus.MustRegister(totalDurationMetric)
+	prometheus.MustRegister(authDurationMetric)
+	prometheus.MustRegister(upstreamDurationMetric)
 	prometheus.MustRegister(oauthLatencyMetric)
 	prometheus.MustRegister(oauthTokensMetric)
 	prometheus.MustRegister(statusMetric)
+	prometheus.MustRegister(authFailuresMetric)
+	prometheus.MustRegister(limitViolationsMetric)
+	prometheus.MustRegister(ocspFetchErrorsMetric)
+	prometheus.MustRegister(ocspStapleProducedMetric)
+	prometheus.MustRegister(ocspStapleNextUpdateMetric)
+	prometheus.MustRegister(ocspStapleValidMetric)
+	prometheus.MustRegister(storePurgedEntriesMetric)
+	prometheus.MustRegister(revocationEvictionsMetric)
+	prometheus.MustRegister(callbackRejectionsMetric)
+	prometheus.MustRegister(jwksRefreshFailuresMetric)
+	prometheus.MustRegister(rateLimitFallbacksMetric)
+	prometheus.MustRegister(rateLimitedRequestsMetric)
+	prometheus.MustRegister(certificateExpiryMetric)
+	prometheus.MustRegister(oidcDocumentFetchMetric)
+	prometheus.MustRegister(captureEventsMetric)
+	prometheus.MustRegister(forwardingLoginMetric)
+	prometheus.MustRegister(forwardingRefreshMetric)
+	prometheus.MustRegister(forwardingRequestsMetric)
+	prometheus.MustRegister(forwardingLoginBackoffMetric)
+	prometheus.MustRegister(forwardingTokenExpiryMetric)
+}
+
+// expiryCollector exports the time left until some expiries, computed when the metrics are collected so the gauges
+// are not stale between two updates of the expiries
+type expiryCollector struct {
+	desc *prometheus.Desc
+	// the expiries by label value, as time.Time
+	expiries sync.Map
+}
+
+func newExpiryCollector(desc *prometheus.Desc) *expiryCollector {
+	return &expiryCollector{desc: desc}
+}
+
+// set sets the expiry of a label value
+func (c *expiryCollector) set(label string, expiry time.Time) {
+	c.expiries.Store(label, expiry)
+}
+
+// remove stops exporting the expiry of a label value
+func (c *expiryCollector) remove(label string) {
+	c.expiries.Delete(label)
 }
 
-func (r *oauthProxy) metricsHandler() http.Handler {
-	if !r.config.EnableMetrics {
-		return nil
-	}
-	return promhttp.Handler()
+func (c *expiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
 }
 
-// proxyMetricsHandler forwards the request to the prometheus handler
-func (r *oauthProxy) proxyMetricsHandler(w http.ResponseWriter, req *http.Request) {
-	if !r.config.EnableMetrics {
-		return
-	}
-	if r.config.LocalhostMetrics {
-		// option to only give access to a localhost metrics collection agent
-		if !net.ParseIP(realIP(req)).IsLoopback() {
-			r.accessForbidden(w, req)
-			return
-		}
-	}
-	r.metricsHandler().ServeHTTP(w, req)
+func (c *expiryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.expiries.Range(func(label, expiry interface{}) bool {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Until(expiry.(time.Time)).Seconds(), label.(string))
+		return true
+	})
 }
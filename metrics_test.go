@@ -25,3 +25,29 @@ func TestMetricsMiddleware(t *testing.T) {
 	}
 	newFakeProxy(cfg).RunTests(t, requests)
 }
+
+func TestDurationMetrics(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableMetrics = true
+	cfg.LocalhostMetrics = true
+	requests := []fakeRequest{
+		{
+			URI:           testAdminURI,
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:                     cfg.WithOAuthURI(metricsURL),
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `proxy_auth_duration_seconds_count{method="GET",resource="` + fakeAdminRoleURL + `"}`,
+		},
+		{
+			URI:                     cfg.WithOAuthURI(metricsURL),
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: "proxy_request_total_duration_seconds_bucket",
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
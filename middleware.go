@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -18,6 +21,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
@@ -51,13 +55,15 @@ func entrypointMiddleware(next http.Handler) http.Handler {
 		req.URL.RawPath = req.URL.Path
 
 		// @step: create a context for the request
-		scope := &RequestScope{}
-		resp := middleware.NewWrapResponseWriter(w, 1)
 		start := time.Now()
+		scope := &RequestScope{Started: start}
+		resp := middleware.NewWrapResponseWriter(w, 1)
 		next.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), contextScopeName, scope)))
 
 		// @metric record the time taken then response code
-		latencyMetric.Observe(time.Since(start).Seconds())
+		taken := time.Since(start).Seconds()
+		latencyMetric.Observe(taken)
+		totalDurationMetric.WithLabelValues(scope.Resource, req.Method).Observe(taken)
 		statusMetric.WithLabelValues(fmt.Sprintf("%d", resp.Status()), req.Method).Inc()
 
 		// place back the original uri for proxying request
@@ -67,6 +73,41 @@ func entrypointMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// forwardedMiddleware retains the Forwarded element describing the client, when the request comes from trusted proxies
+func (r *oauthProxy) forwardedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		values := req.Header.Values(headerForwarded)
+		scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+		if len(values) == 0 || !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		peer, _, _ := net.SplitHostPort(req.RemoteAddr)
+		if !isTrustedProxy(net.ParseIP(peer), r.trustedProxies) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		elements, err := parseForwarded(values)
+		if err != nil {
+			r.log.Warn("ignoring the Forwarded header sent by a trusted proxy", zap.String("client_ip", req.RemoteAddr), zap.Error(err))
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		// the client is the first hop from the end which is not a trusted proxy
+		for i := len(elements) - 1; i >= 0; i-- {
+			if i == 0 || !isTrustedProxy(forwardedNodeIP(elements[i].For), r.trustedProxies) {
+				scope.Forwarded = &elements[i]
+				break
+			}
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
 // requestIDMiddleware is responsible for adding a request id if none found
 func (r *oauthProxy) requestIDMiddleware(header string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -95,17 +136,56 @@ func (r *oauthProxy) loggingMiddleware(next http.Handler) http.Handler {
 		}
 		next.ServeHTTP(resp, req.WithContext(ctx))
 		addr := req.RemoteAddr
-		logger.Info("client request",
+		fields := []zapcore.Field{
 			zap.Duration("latency", time.Since(start)),
 			zap.Int("status", resp.Status()),
 			zap.Int("bytes", resp.BytesWritten()),
 			zap.String("client_ip", addr),
 			zap.String("method", req.Method),
 			zap.String("path", req.URL.Path),
-			zap.String("protocol", req.Proto))
+			zap.String("protocol", req.Proto),
+		}
+		if scope, ok := ctx.Value(contextScopeName).(*RequestScope); ok && scope.AuthDecision != "" {
+			fields = append(fields, zap.String("auth_decision", scope.AuthDecision))
+		}
+		logger.Info("client request", fields...)
 	})
 }
 
+// methodPolicyMiddleware rejects requests to the upstream with a method which is not allowed, before any authentication takes place
+func (r *oauthProxy) methodPolicyMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	allowed := r.config.AllowedMethods
+	if resource != nil && len(resource.AllowedMethods) > 0 {
+		allowed = resource.AllowedMethods
+	}
+	if len(allowed) == 0 {
+		// no policy: all methods known to the router are permitted
+		allowed = allHTTPMethods
+	}
+
+	allowedMethods := make(map[string]struct{}, len(allowed))
+	for _, m := range allowed {
+		if r.config.RejectNonStandardMethods && !isValidHTTPMethod(m) {
+			continue
+		}
+		allowedMethods[m] = struct{}{}
+	}
+	allowHeader := strings.Join(allowed, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if _, ok := allowedMethods[req.Method]; !ok {
+				w.Header().Set("Allow", allowHeader)
+				methodNotAllowedHandler(w, req)
+
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
 // authenticationMiddleware is responsible for verifying the access token
 func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -115,12 +195,69 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 				defer span.End()
 			}
 
+			// step: the requests already denied, e.g. to the clients outside of the networks of the resource, are not
+			// authenticated
+			if scope, ok := ctx.Value(contextScopeName).(*RequestScope); ok && scope.AccessDenied {
+				next.ServeHTTP(w, req)
+				return
+			}
+
 			clientIP := req.RemoteAddr
 
+			// step: expire the session cookies left over by a previous cookie domain
+			if r.config.EnableCookieDomainCleanup {
+				r.expireStaleCookies(req, w)
+			}
+
+			// step: the users on the listeners trusting an upstream authenticator are authenticated by it, without
+			// login flow
+			if r.isTrustedAuthentication(req) {
+				user, err := r.trustedAuthenticator.identity(req.WithContext(ctx))
+				if err == nil && user.isExpired(r.now()) {
+					err = ErrAccessTokenExpired
+				}
+				if err != nil {
+					reason := authFailureInvalid
+					switch err {
+					case ErrNoTrustedIdentity:
+						reason = authFailureMissing
+					case ErrAccessTokenExpired:
+						reason = authFailureExpired
+					}
+					logger.Warn("no valid identity from the trusted authenticator, refusing the request",
+						append(r.recordAuthFailure(req, reason),
+							zap.String("client_ip", clientIP),
+							zap.Error(err))...)
+					errorResponse(w, "", http.StatusUnauthorized)
+					next.ServeHTTP(w, req.WithContext(r.revokeProxy(w, req)))
+					return
+				}
+
+				scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+				if !ok {
+					panic("corrupted context: expected *RequestScope")
+				}
+				scope.Identity = user
+				next.ServeHTTP(w, req.WithContext(context.WithValue(ctx, contextScopeName, scope)))
+				return
+			}
+
 			// grab the user identity from the request
 			user, err := r.getIdentity(req.WithContext(ctx))
+			if err == ErrTokenTooLarge || err == ErrTooManyCookieChunks {
+				// the violation is already logged (sampled)
+				r.recordAuthFailure(req, authFailureTooLarge)
+				errorResponse(w, "", http.StatusRequestHeaderFieldsTooLarge)
+				next.ServeHTTP(w, req.WithContext(r.revokeProxy(w, req)))
+				return
+			}
 			if err != nil {
-				logger.Warn("no session found in request, redirecting for authorization", zap.Error(err))
+				reason := authFailureInvalid
+				if err == ErrSessionNotFound {
+					reason = authFailureMissing
+				}
+				logger.Warn("no session found in request, redirecting for authorization",
+					append(r.recordAuthFailure(req, reason), zap.Error(err))...)
 				next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req.WithContext(ctx))))
 				return
 			}
@@ -133,14 +270,40 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 			scope.Identity = user
 			ctx = context.WithValue(ctx, contextScopeName, scope)
 
+			// step: end the sessions idle for too long, even though the tokens are still valid
+			if r.config.SessionIdleTimeout > 0 && !user.bearerToken {
+				if err := r.checkSessionActivity(w, req.WithContext(ctx), user); err != nil {
+					logger.Warn("the session is idle, redirecting for authorization",
+						append(r.recordAuthFailure(req, authFailureIdle),
+							zap.String("client_ip", clientIP),
+							zap.String("email", user.email),
+							zap.Error(err))...)
+					r.clearAllCookies(req, w)
+					next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req.WithContext(ctx))))
+					return
+				}
+			}
+
+			// step: refuse the tokens issued to the sessions revoked since, even though they are still valid
+			if r.revocations != nil && r.revocations.revoked(user.id, user.issuedAt) {
+				logger.Warn("the session has been revoked, redirecting for authorization",
+					append(r.recordAuthFailure(req, authFailureRevoked),
+						zap.String("client_ip", clientIP),
+						zap.String("email", user.email))...)
+				r.clearAllCookies(req, w)
+				next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req.WithContext(ctx))))
+				return
+			}
+
 			// step: skip if we are running skip-token-verification
 			if r.config.SkipTokenVerification {
 				r.log.Warn("skip token verification enabled, skipping verification - TESTING ONLY")
-				if user.isExpired() {
+				if user.isExpired(r.now()) {
 					logger.Warn("the session has expired and token verification is switched off",
-						zap.String("client_ip", clientIP),
-						zap.String("username", user.name),
-						zap.String("expired_on", user.expiresAt.String()))
+						append(r.recordAuthFailure(req, authFailureExpired),
+							zap.String("client_ip", clientIP),
+							zap.String("username", user.name),
+							zap.String("expired_on", user.expiresAt.String()))...)
 
 					next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req.WithContext(ctx))))
 					return
@@ -155,8 +318,9 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 				// something messed up in the token
 				if err != ErrAccessTokenExpired {
 					logger.Warn("access token failed verification",
-						zap.String("client_ip", clientIP),
-						zap.Error(err))
+						append(r.recordAuthFailure(req, authFailureInvalid),
+							zap.String("client_ip", clientIP),
+							zap.Error(err))...)
 
 					next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
 					return
@@ -165,9 +329,10 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 				// step: check if we are refreshing the access tokens and if not re-auth
 				if !r.config.EnableRefreshTokens {
 					logger.Warn("session expired and access token refresh is disabled",
-						zap.String("client_ip", clientIP),
-						zap.String("email", user.name),
-						zap.String("expired_on", user.expiresAt.String()))
+						append(r.recordAuthFailure(req, authFailureExpired),
+							zap.String("client_ip", clientIP),
+							zap.String("email", user.name),
+							zap.String("expired_on", user.expiresAt.String()))...)
 
 					next.ServeHTTP(w, req.WithContext(r.redirectToAuthorization(w, req)))
 					return
@@ -179,6 +344,11 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 
 				// step : refresh the token, update user and session
 				if err = r.refreshToken(w, req.WithContext(ctx), user); err != nil {
+					logger.Warn("unable to refresh the access token",
+						append(r.recordAuthFailure(req, authFailureRefreshFailed),
+							zap.String("client_ip", clientIP),
+							zap.String("email", user.email),
+							zap.Error(err))...)
 					switch err {
 					case ErrEncode, ErrEncryption:
 						r.errorResponse(w, req, err.Error(), http.StatusInternalServerError, err)
@@ -255,12 +425,66 @@ func (r *oauthProxy) checkClaim(user *userContext, claimName string, match *rege
 	return false
 }
 
+// clientNetworkMiddleware refuses the requests of the clients outside of the networks of a resource, before any
+// authentication
+func (r *oauthProxy) clientNetworkMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	newDecisionTrace := r.newDecisionTracer(resource)
+	// the networks of the resource, the denied ones negated
+	networks := append([]string{}, resource.AllowedCIDRs...)
+	for _, cidr := range resource.DeniedCIDRs {
+		networks = append(networks, "!"+cidr)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, span, logger := r.traceSpan(req.Context(), "client network middleware")
+			if span != nil {
+				defer span.End()
+			}
+
+			scope, ok := ctx.Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			if scope.AccessDenied {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			var decision *decisionTrace
+			if newDecisionTrace != nil {
+				decision = newDecisionTrace(req)
+			}
+
+			ip := r.clientIP(req)
+			reason := resource.refusesClient(ip)
+			decision.add("cidr", reason == "", networks, []string{ip.String()})
+			if reason != "" {
+				// the client is refused before any authentication, so there is no user yet
+				decision.explain(logger, span, &userContext{}, "denied")
+				logger.Warn("access denied, "+reason,
+					zap.String("access", "denied"),
+					zap.Stringer("client_ip", ip),
+					zap.String("remote_addr", req.RemoteAddr),
+					zap.String("resource", resource.route()))
+
+				// the refused clients are neither authenticated nor proxied
+				next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+				return
+			}
+
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
+
 // admissionMiddleware is responsible for checking the access token against the protected resource
 func (r *oauthProxy) admissionMiddleware(resource *Resource) func(http.Handler) http.Handler {
 	claimMatches := make(map[string]*regexp.Regexp)
 	for k, v := range r.config.MatchClaims {
 		claimMatches[k] = regexp.MustCompile(v)
 	}
+	newDecisionTrace := r.newDecisionTracer(resource)
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -280,24 +504,49 @@ func (r *oauthProxy) admissionMiddleware(resource *Resource) func(http.Handler)
 			}
 			user := scope.Identity
 
+			var decision *decisionTrace
+			if newDecisionTrace != nil {
+				decision = newDecisionTrace(req)
+			}
+
 			// @step: we need to check the roles
-			if !hasAccess(resource.Roles, user.roles, !resource.RequireAnyRole, false) {
+			roles, byMethod := resource.rolesFor(req.Method)
+			hasRoles := hasAccess(roles, user.roles, !resource.RequireAnyRole, false)
+			decision.add("roles", hasRoles, roles, user.roles)
+			if !hasRoles {
+				required := "all"
+				if resource.RequireAnyRole {
+					required = "any"
+				}
+				// the roles of the resource, or the method-roles of the method of the request
+				rule := "roles"
+				if byMethod {
+					rule = "method-roles." + req.Method
+				}
+				decision.explain(logger, span, user, "denied")
 				logger.Warn("access denied, invalid roles",
 					zap.String("access", "denied"),
 					zap.String("email", user.email),
-					zap.String("resource", resource.URL),
-					zap.String("roles", resource.getRoles()))
+					zap.String("resource", resource.route()),
+					zap.String("method", req.Method),
+					zap.String("rule", rule),
+					zap.String("roles", strings.Join(roles, ",")),
+					zap.String("required", required),
+					zap.Strings("missing_roles", missingFrom(roles, user.roles)))
 
 				next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
 				return
 			}
 
 			// @step: check if we have any groups, the groups are there
-			if !hasAccess(resource.Groups, user.groups, false, true) {
+			hasGroups := hasAccess(resource.Groups, user.groups, false, true)
+			decision.add("groups", hasGroups, resource.Groups, user.groups)
+			if !hasGroups {
+				decision.explain(logger, span, user, "denied")
 				logger.Warn("access denied, invalid groups",
 					zap.String("access", "denied"),
 					zap.String("email", user.email),
-					zap.String("resource", resource.URL),
+					zap.String("resource", resource.route()),
 					zap.String("groups", strings.Join(resource.Groups, ",")))
 
 				next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
@@ -306,17 +555,94 @@ func (r *oauthProxy) admissionMiddleware(resource *Resource) func(http.Handler)
 
 			// step: if we have any claim matching, lets validate the tokens has the claims
 			for claimName, match := range claimMatches {
-				if !r.checkClaim(user, claimName, match, resource.URL) {
+				hasClaim := r.checkClaim(user, claimName, match, resource.route())
+				decision.addClaim(user, claimName, match.String(), hasClaim)
+				if !hasClaim {
+					decision.explain(logger, span, user, "denied")
+					next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+					return
+				}
+			}
+
+			// step: the expression of the resource must be true, its errors denying the access
+			if resource.expression != nil {
+				allowed, err := resource.expression.evaluate(expressionVariablesOf(req, user))
+				decision.add("expression", allowed, []string{resource.Expression}, nil)
+				if !allowed {
+					reason := "the expression is false"
+					if err != nil {
+						reason = err.Error()
+					}
+					decision.explain(logger, span, user, "denied")
+					logger.Warn("access denied, expression not met",
+						zap.String("access", "denied"),
+						zap.String("email", user.email),
+						zap.String("resource", resource.route()),
+						zap.String("expression", resource.Expression),
+						zap.String("reason", reason))
+
+					next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
+					return
+				}
+			}
+
+			// step: the session must be authenticated with the authentication context class of the resource, else it
+			// steps up its authentication
+			if resource.ACR != "" {
+				hasACR := user.hasACR(resource.ACR)
+				decision.add("acr", hasACR, []string{resource.ACR}, []string{user.acr})
+				if !hasACR {
+					decision.explain(logger, span, user, "denied")
+					logger.Warn("access denied, insufficient authentication level",
+						zap.String("access", "denied"),
+						zap.String("email", user.email),
+						zap.String("resource", resource.route()),
+						zap.String("acr", user.acr),
+						zap.String("required", resource.ACR))
+
+					next.ServeHTTP(w, req.WithContext(r.stepUpAuthentication(w, req.WithContext(ctx), user, resource.ACR)))
+					return
+				}
+			}
+
+			// step: check the permission with the authorization services of keycloak, if any
+			if r.config.EnableUMA && resource.UMAResource != "" {
+				permission := umaPermission(resource)
+				granted, err := r.checkUMAPermission(ctx, user, permission)
+				if err != nil {
+					if !r.config.UMAFailOpen {
+						decision.add("uma", false, []string{permission}, nil)
+						decision.explain(logger, span, user, "denied")
+						r.errorResponse(w, req.WithContext(ctx), "unable to check the permission with the authorization server", http.StatusBadGateway, err)
+						next.ServeHTTP(w, req.WithContext(r.revokeProxy(w, req.WithContext(ctx))))
+						return
+					}
+					logger.Warn("unable to check the permission with the authorization server, access permitted (uma-fail-open)",
+						zap.String("email", user.email),
+						zap.String("permission", permission),
+						zap.Error(err))
+					granted = true
+				}
+				decision.add("uma", granted, []string{permission}, nil)
+				if !granted {
+					decision.explain(logger, span, user, "denied")
+					logger.Warn("access denied, uma permission not granted",
+						zap.String("access", "denied"),
+						zap.String("email", user.email),
+						zap.String("resource", resource.route()),
+						zap.String("permission", permission))
+
 					next.ServeHTTP(w, req.WithContext(r.accessForbidden(w, req.WithContext(ctx))))
 					return
 				}
 			}
 
+			decision.explain(logger, span, user, "permitted")
 			logger.Debug("access permitted to resource",
 				zap.String("access", "permitted"),
 				zap.String("email", user.email),
 				zap.Duration("expires", time.Until(user.expiresAt)),
-				zap.String("resource", resource.URL))
+				zap.String("resource", resource.route()))
 
 			next.ServeHTTP(w, req.WithContext(ctx))
 		})
@@ -337,27 +663,65 @@ func (r *oauthProxy) responseHeaderMiddleware(headers map[string]string) func(ht
 	}
 }
 
+// resourceResponseHeadersMiddleware sets the static response headers of a resource, over the global ones, on the
+// responses of the upstream as well as on those of the proxy
+func (r *oauthProxy) resourceResponseHeadersMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			scope.ResponseHeaders = resource.ResponseHeaders
+			for k, v := range resource.ResponseHeaders {
+				w.Header().Set(k, v)
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
 // identityHeadersMiddleware is responsible for adding the authentication headers to upstream
 func (r *oauthProxy) identityHeadersMiddleware(custom []string) func(http.Handler) http.Handler {
 	// config-driven request header setters
 	setters := make([]func(*http.Request, *userContext), 0, 20)
 
+	// multi-valued headers are joined with a comma, unless configured otherwise
+	encoders, _ := makeHeaderEncoders(r.config.IdentityHeaderEncodings)
+	setValues := func(req *http.Request, name string, values []string) {
+		if encoder, ok := encoders[http.CanonicalHeaderKey(name)]; ok {
+			encoder(req.Header, name, values)
+			return
+		}
+		req.Header.Set(name, strings.Join(values, defaultHeaderDelimiter))
+	}
+
 	if r.config.EnableClaimsHeaders {
+		audience := r.config.identityHeaderName(identityHeaderAudience)
+		email := r.config.identityHeaderName(identityHeaderEmail)
+		expiresIn := r.config.identityHeaderName(identityHeaderExpiresIn)
+		groups := r.config.identityHeaderName(identityHeaderGroups)
+		roles := r.config.identityHeaderName(identityHeaderRoles)
+		subject := r.config.identityHeaderName(identityHeaderSubject)
+		userID := r.config.identityHeaderName(identityHeaderUserID)
+		username := r.config.identityHeaderName(identityHeaderUsername)
 		setters = append(setters, func(req *http.Request, user *userContext) {
-			req.Header.Set("X-Auth-Audience", strings.Join(user.audiences, ","))
-			req.Header.Set("X-Auth-Email", user.email)
-			req.Header.Set("X-Auth-ExpiresIn", user.expiresAt.String())
-			req.Header.Set("X-Auth-Groups", strings.Join(user.groups, ","))
-			req.Header.Set("X-Auth-Roles", strings.Join(user.roles, ","))
-			req.Header.Set("X-Auth-Subject", user.id)
-			req.Header.Set("X-Auth-Userid", user.name)
-			req.Header.Set("X-Auth-Username", user.name)
+			setValues(req, audience, user.audiences)
+			req.Header.Set(email, user.email)
+			req.Header.Set(expiresIn, user.expiresAt.String())
+			setValues(req, groups, user.groups)
+			setValues(req, roles, user.roles)
+			req.Header.Set(subject, user.id)
+			req.Header.Set(userID, user.name)
+			req.Header.Set(username, user.name)
 		})
 	}
 
 	if r.config.EnableTokenHeader {
+		token := r.config.identityHeaderName(identityHeaderToken)
 		setters = append(setters, func(req *http.Request, user *userContext) {
-			req.Header.Set("X-Auth-Token", user.token.Encode())
+			req.Header.Set(token, user.token.Encode())
 		})
 	}
 
@@ -367,25 +731,90 @@ func (r *oauthProxy) identityHeadersMiddleware(custom []string) func(http.Handle
 		})
 	}
 
+	if r.config.EnableIDTokenHeader {
+		header := r.config.identityHeaderName(identityHeaderIDToken)
+		setters = append(setters, func(req *http.Request, _ *userContext) {
+			if idToken, err := r.getIDTokenFromCookie(req); err == nil {
+				req.Header.Set(header, idToken)
+			}
+		})
+	}
+
 	// are we filtering out the cookies to upstream ?
-	// NOTE: cookies are actually just redacted
+	// NOTE: cookies are either redacted or dropped, according to the cookie filter mode
 	if !r.config.EnableAuthorizationCookies {
-		cookieFilter := []string{r.config.CookieAccessName, r.config.CookieRefreshName}
+		cookieFilter := r.filteredCookieNames(r.config.CookieAccessName, r.config.CookieRefreshName)
+		if r.config.CookieIDTokenName != "" {
+			cookieFilter = append(cookieFilter, r.filteredCookieNames(r.config.CookieIDTokenName)...)
+		}
 		setters = append(setters, func(req *http.Request, _ *userContext) {
-			_ = filterCookies(req, cookieFilter)
+			_ = filterCookies(req, cookieFilter, r.config.CookieFilterMode == cookieFilterDrop)
+		})
+	}
+
+	if r.config.EnableClaimsHeader {
+		header := r.config.identityHeaderName(identityHeaderClaims)
+		maxSize := r.config.ClaimsHeaderMaxSize
+		if maxSize <= 0 {
+			maxSize = defaultClaimsHeaderMaxSize
+		}
+		setters = append(setters, func(req *http.Request, user *userContext) {
+			value, trimmed, err := claimsHeaderValue(user, custom, maxSize)
+			if err != nil || value == "" || trimmed {
+				_, logger := r.traceSpanRequest(req)
+				switch {
+				case err != nil:
+					logger.Warn("unable to encode the claims header", zap.String("header", header), zap.Error(err))
+				case value == "":
+					logger.Warn("the claims header exceeds the claims-header-max-size, it is not sent",
+						zap.String("header", header), zap.String("email", user.email), zap.Int("max-size", maxSize))
+				default:
+					logger.Warn("the claims header exceeds the claims-header-max-size, the add-claims are left out of it",
+						zap.String("header", header), zap.String("email", user.email), zap.Int("max-size", maxSize))
+				}
+			}
+			if value != "" {
+				req.Header.Set(header, value)
+			}
 		})
 	}
 
 	if r.config.EnableClaimsHeaders {
 		customClaims := make(map[string]string)
 		for _, x := range custom {
-			customClaims[x] = fmt.Sprintf("X-Auth-%s", toHeader(x))
+			customClaims[x] = r.config.claimHeaderName(x)
 		}
 		setters = append(setters, func(req *http.Request, user *userContext) {
 			// inject any custom claims
 			for claim, header := range customClaims {
-				if claim, found := user.claims[claim]; found {
-					req.Header.Set(header, fmt.Sprintf("%v", claim))
+				claim, found := user.claims[claim]
+				if !found {
+					continue
+				}
+				if _, encoded := encoders[http.CanonicalHeaderKey(header)]; encoded {
+					if values, ok := claimValues(claim); ok {
+						setValues(req, header, values)
+						continue
+					}
+				}
+				req.Header.Set(header, fmt.Sprintf("%v", claim))
+			}
+		})
+	}
+
+	// the values which are not ascii are encoded once set, whichever setter or header encoding set them
+	if encode := identityValueEncoder(r.config.EncodeIdentityHeaders); encode != nil {
+		names := r.config.identityHeaderNames()
+		for i, name := range names {
+			names[i] = http.CanonicalHeaderKey(name)
+		}
+		setters = append(setters, func(req *http.Request, _ *userContext) {
+			for _, name := range names {
+				values := req.Header[name]
+				for i, value := range values {
+					if !isASCII(value) {
+						values[i] = encode(value)
+					}
 				}
 			}
 		})
@@ -473,7 +902,7 @@ func (r *oauthProxy) csrfConfigMiddleware() func(http.Handler) http.Handler {
 		// Encryption algorithm is AES-256
 		r.log.Info("enabling CSRF protection")
 		return gcsrf.Protect([]byte(r.config.EncryptionKey),
-			gcsrf.CookieName(r.config.CSRFCookieName),
+			gcsrf.CookieName(r.cookieName(r.config.CSRFCookieName)),
 			gcsrf.RequestHeader(r.config.CSRFHeader),
 			gcsrf.Domain(r.config.CookieDomain),
 			gcsrf.SameSite(csrfSameSiteValue(r.config.SameSiteCookie)),
@@ -519,7 +948,7 @@ func (r *oauthProxy) csrfSkipResourceMiddleware(resource *Resource) func(http.Ha
 			}
 		}
 
-		r.log.Info("CSRF check enabled for resource", zap.String("resource", resource.URL))
+		r.log.Info("CSRF check enabled for resource", zap.String("resource", resource.route()))
 		return func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 				scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
@@ -16,11 +16,13 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
@@ -30,6 +32,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/rs/cors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	resty "gopkg.in/resty.v1"
 )
 
@@ -83,6 +86,11 @@ const (
 )
 
 func newFakeProxy(cfg *Config) *fakeProxy {
+	return newFakeProxyWithAuthServer(cfg, newFakeAuthServer())
+}
+
+// newFakeProxyWithAuthServer creates a fake proxy against a fake oauth service prepared by the test
+func newFakeProxyWithAuthServer(cfg *Config, auth *fakeAuthServer) *fakeProxy {
 	log.SetOutput(io.Discard)
 	c := new(Config)
 	if cfg == nil {
@@ -91,7 +99,6 @@ func newFakeProxy(cfg *Config) *fakeProxy {
 		*c = *cfg
 	}
 
-	auth := newFakeAuthServer()
 	c.DiscoveryURL = auth.getLocation()
 	c.RevocationEndpoint = auth.getRevocationURL()
 	proxy, err := newProxy(c)
@@ -608,6 +615,92 @@ func TestStrangeAdminRequests(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestMethodPolicy(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.AllowedMethods = defaultAllowedMethods
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+		{
+			URL:            "/dav*",
+			WhiteListed:    true,
+			Methods:        []string{http.MethodGet, "PROPFIND"},
+			AllowedMethods: []string{http.MethodGet, "PROPFIND"},
+		},
+		{
+			URL:         "/public*",
+			WhiteListed: true,
+			Methods:     allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/public/test",
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{ // TRACE is rejected by default
+			URI:             "/public/test",
+			Method:          http.MethodTrace,
+			ExpectedCode:    http.StatusMethodNotAllowed,
+			ExpectedHeaders: map[string]string{"Allow": strings.Join(defaultAllowedMethods, ", ")},
+		},
+		{ // the method policy is enforced before authentication
+			URI:          "/admin/test",
+			Method:       http.MethodTrace,
+			ExpectedCode: http.StatusMethodNotAllowed,
+		},
+		{
+			URI:           "/dav/folder",
+			Method:        "PROPFIND",
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{
+			URI:             "/dav/folder",
+			Method:          http.MethodPut,
+			ExpectedCode:    http.StatusMethodNotAllowed,
+			ExpectedHeaders: map[string]string{"Allow": "GET, PROPFIND"},
+		},
+		{ // unknown methods are rejected by the router
+			URI:          "/public/test",
+			Method:       "BREW",
+			ExpectedCode: http.StatusMethodNotAllowed,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestRejectNonStandardMethods(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.RejectNonStandardMethods = true
+	cfg.Resources = []*Resource{
+		{
+			URL:         "/public*",
+			WhiteListed: true,
+			Methods:     allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/public/test",
+			Method:        http.MethodPatch,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{
+			URI:             "/public/test",
+			Method:          "MKCOL",
+			ExpectedCode:    http.StatusMethodNotAllowed,
+			ExpectedHeaders: map[string]string{"Allow": strings.Join(allHTTPMethods, ", ")},
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
 func TestWhiteListedRequests(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.Resources = []*Resource{
@@ -704,6 +797,188 @@ func TestBlackAndWhiteListedRequests(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestRegexResources(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Headers = map[string]string{"X-Custom": "custom"}
+	cfg.Resources = []*Resource{
+		{
+			URLRegex: "/api/v[0-9]+/admin/.*",
+			Methods:  allHTTPMethods,
+			Roles:    []string{"admin"},
+			Groups:   []string{"staff"},
+		},
+		{
+			URL:         "/api/v1/admin/health",
+			WhiteListed: true,
+			Methods:     allHTTPMethods,
+		},
+		{
+			URLRegex:    "/api/v[0-9]+/reports/[0-9]+",
+			BlackListed: true,
+			Methods:     allHTTPMethods,
+		},
+		{
+			URLRegex:    "/exports/[a-z]+",
+			WhiteListed: true,
+			Methods:     []string{http.MethodGet},
+		},
+		{
+			URL:     "/*",
+			Methods: allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		{ // the resources with a uri take precedence
+			URI:           "/api/v1/admin/health",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/api/v2/admin/users",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:                  "/api/v2/admin/users",
+			HasToken:             true,
+			Roles:                []string{"admin"},
+			Groups:               []string{"staff"},
+			ExpectedProxy:        true,
+			ExpectedProxyHeaders: map[string]string{"X-Custom": "custom"},
+			ExpectedCode:         http.StatusOK,
+		},
+		{ // the roles of the regex resource apply
+			URI:          "/api/v2/admin/users",
+			HasToken:     true,
+			Roles:        []string{fakeTestRole},
+			Groups:       []string{"staff"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // and its groups
+			URI:          "/api/v2/admin/users",
+			HasToken:     true,
+			Roles:        []string{"admin"},
+			Groups:       []string{"other"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/api/v2/reports/12",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // the regex matches the whole path
+			URI:           "/api/v2/reports/12/summary",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/exports/orders",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/exports/orders",
+			Method:       http.MethodPost,
+			ExpectedCode: http.StatusMethodNotAllowed,
+		},
+		{ // the other paths are served by the catch-all route
+			URI:          "/exports/orders/2021",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestHeaderConditionResources(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/api/*",
+			Headers: map[string]string{"X-Client-Type": "mobile"},
+			Methods: allHTTPMethods,
+			Roles:   []string{"mobile"},
+		},
+		{
+			URL:     "/api/*",
+			Methods: allHTTPMethods,
+			Roles:   []string{"web"},
+		},
+		{
+			URL:         "/api/status",
+			Headers:     map[string]string{"User-Agent": "kube-probe/*"},
+			WhiteListed: true,
+			Methods:     allHTTPMethods,
+		},
+		{
+			URL:     "/*",
+			Methods: allHTTPMethods,
+		},
+	}
+	mobile := map[string]string{"X-Client-Type": "mobile"}
+	requests := []fakeRequest{
+		{
+			URI:           "/api/orders",
+			Headers:       mobile,
+			HasToken:      true,
+			Roles:         []string{"mobile"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/api/orders",
+			Headers:      mobile,
+			HasToken:     true,
+			Roles:        []string{"web"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/api/orders",
+			HasToken:      true,
+			Roles:         []string{"web"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/api/orders",
+			HasToken:     true,
+			Roles:        []string{"mobile"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/api/orders",
+			Headers:      map[string]string{"X-Client-Type": "tablet"},
+			HasToken:     true,
+			Roles:        []string{"mobile"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // the header-scoped exemption
+			URI:           "/api/status",
+			Headers:       map[string]string{"User-Agent": "kube-probe/1.27"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{ // the other requests are served by the next less specific uri
+			URI:          "/api/status",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          "/api/status",
+			HasToken:     true,
+			Roles:        []string{"mobile"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/api/status",
+			Headers:       mobile,
+			HasToken:      true,
+			Roles:         []string{"mobile"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
 func TestRequireAnyRoles(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.Resources = []*Resource{
@@ -848,6 +1123,161 @@ func TestGroupPermissionsMiddleware(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestGroupWildcardsMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/engineering*",
+			Methods: allHTTPMethods,
+			Groups:  []string{"/engineering/*"},
+		},
+		{
+			URL:     "/platform*",
+			Methods: allHTTPMethods,
+			Groups:  []string{"/engineering/platform", "/ops/*"},
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/engineering",
+			HasToken:      true,
+			Groups:        []string{"/engineering"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/engineering",
+			HasToken:      true,
+			Groups:        []string{"/engineering/platform/sre"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/engineering",
+			HasToken:      true,
+			Groups:        []string{"/engineering/"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/engineering",
+			HasToken:     true,
+			Groups:       []string{"/engineering2", "/sales/engineering"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/platform",
+			HasToken:      true,
+			Groups:        []string{"/engineering/platform"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// a plain group is matched exactly, neither its subgroups nor its parent
+			URI:          "/platform",
+			HasToken:     true,
+			Groups:       []string{"/engineering/platform/sre", "/engineering", "/engineering/platform/"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// any of the groups of the resource grants the access
+			URI:           "/platform",
+			HasToken:      true,
+			Groups:        []string{"/sales", "/ops/oncall"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestMethodRolesMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:         "/api/things*",
+			Methods:     allHTTPMethods,
+			Roles:       []string{"reader"},
+			MethodRoles: map[string][]string{http.MethodPost: {"writer"}, http.MethodPut: {"writer"}},
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/api/things",
+			HasToken:      true,
+			Roles:         []string{"reader"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/api/things",
+			Method:       http.MethodPost,
+			HasToken:     true,
+			Roles:        []string{"reader"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/api/things",
+			Method:        http.MethodPut,
+			HasToken:      true,
+			Roles:         []string{"writer"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the methods without method roles require the roles of the resource
+			URI:          "/api/things",
+			Method:       http.MethodDelete,
+			HasToken:     true,
+			Roles:        []string{"writer"},
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestExpressionMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:        "/finance/*",
+			Methods:    allHTTPMethods,
+			Expression: "'admin' in user.roles || (user.claims.department == 'finance' && request.method == 'GET')",
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/finance/reports",
+			HasToken:      true,
+			TokenClaims:   jose.Claims{"department": "finance"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/finance/reports",
+			Method:       http.MethodPost,
+			HasToken:     true,
+			TokenClaims:  jose.Claims{"department": "finance"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/finance/reports",
+			Method:        http.MethodPost,
+			HasToken:      true,
+			Roles:         []string{"admin"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the claim is missing: the evaluation fails, denying the access
+			URI:          "/finance/reports",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
 func TestRolePermissionsMiddleware(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.Resources = []*Resource{
@@ -1167,6 +1597,45 @@ func TestCheckRefreshTokens(t *testing.T) {
 	p.RunTests(t, requests)
 }
 
+func TestCheckRefreshIDToken(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.CookieIDTokenName = "kc-id"
+	cfg.EncryptionKey = testKey
+	fn := func(no int, req *resty.Request, resp *resty.Response) {
+		if no == 0 {
+			<-time.After(1000 * time.Millisecond)
+		}
+	}
+	// the id token forwarded upstream is the refreshed one, not the expired one of the login
+	fresh := func(value string) bool {
+		_, identity, err := parseToken(value)
+		return err == nil && identity.ExpiresAt.After(time.Now())
+	}
+	p := newFakeProxy(cfg)
+	p.idp.setTokenExpiration(1000 * time.Millisecond)
+
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			OnResponse:    fn,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:                      fakeAuthAllURL,
+			Redirects:                false,
+			ExpectedProxy:            true,
+			ExpectedCode:             http.StatusOK,
+			ExpectedCookies:          map[string]string{cfg.CookieAccessName: ""},
+			ExpectedCookiesValidator: map[string]func(string) bool{cfg.CookieIDTokenName: fresh},
+		},
+	}
+	p.RunTests(t, requests)
+}
+
 func TestCheckEncryptedCookie(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.EnableRefreshTokens = true
@@ -1520,6 +1989,77 @@ func TestCustomHeadersUpstream(t *testing.T) {
 	}
 }
 
+func TestDefaultDenyStrict(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableDefaultDenyStrict = true
+	cfg.Resources = append(cfg.Resources,
+		&Resource{URL: "/conditional/*", Methods: allHTTPMethods, Headers: map[string]string{"X-Tenant": "acme"}},
+		&Resource{URLRegex: "/regex/v[0-9]+/.*", Methods: allHTTPMethods},
+	)
+	requests := []fakeRequest{
+		{
+			// the paths matching no resource are refused, even without a session
+			URI:          "/unknown",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/unknown/path",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// the resources are still protected
+			URI:          "/auth_all/test",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:           "/auth_all/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/auth_all/white_listed/test",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/regex/v1/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/regex/test",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/conditional/test",
+			HasToken:      true,
+			Headers:       map[string]string{"X-Tenant": "acme"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the requests meeting none of the header conditions of the resources of a uri match no resource
+			URI:          "/conditional/test",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// the oauth endpoints remain reachable
+			URI:          cfg.WithOAuthURI(healthURL),
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			URI:          cfg.WithOAuthURI(tokenURL),
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
 func TestRolesAdmissionHandlerClaims(t *testing.T) {
 	requests := []struct {
 		Matches map[string]string
@@ -1659,3 +2199,278 @@ func TestRolesAdmissionHandlerClaims(t *testing.T) {
 		newFakeProxy(cfg).RunTests(t, []fakeRequest{c.Request})
 	}
 }
+
+func TestClientNetworkResources(t *testing.T) {
+	resources := []*Resource{
+		{
+			URL:          "/admin/*",
+			Methods:      allHTTPMethods,
+			Roles:        []string{fakeAdminRole},
+			AllowedCIDRs: []string{"127.0.0.0/8", "2001:db8::/32"},
+			DeniedCIDRs:  []string{"127.0.0.2", "2001:db8:dead::/48"},
+		},
+		{
+			URL:          "/status/*",
+			WhiteListed:  true,
+			Methods:      allHTTPMethods,
+			AllowedCIDRs: []string{"10.0.0.0/8"},
+		},
+		{
+			URL:         "/*",
+			Methods:     allHTTPMethods,
+			DeniedCIDRs: []string{"203.0.113.0/24"},
+		},
+	}
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = resources
+	requests := []fakeRequest{
+		{
+			URI:           "/admin/users",
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the roles are still required from the allowed networks
+			URI:          "/admin/users",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// a refused client is not sent to login
+			URI:          "/status/health",
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// our peer is not a trusted proxy, its X-Forwarded-For header is ignored
+			URI:          "/status/health",
+			Headers:      map[string]string{"X-Forwarded-For": "10.0.0.1"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/api/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+
+	// the client of a trusted proxy is the right-most entry of X-Forwarded-For which is not a trusted proxy
+	cfg = newFakeKeycloakConfig()
+	cfg.ForwardedTrustedProxies = []string{"127.0.0.1"}
+	cfg.Resources = resources
+	requests = []fakeRequest{
+		{
+			URI:           "/status/health",
+			Headers:       map[string]string{"X-Forwarded-For": "203.0.113.5, 10.0.0.1"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/api/test",
+			HasToken:     true,
+			Headers:      map[string]string{"X-Forwarded-For": "10.0.0.1, 203.0.113.5"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/admin/users",
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole},
+			Headers:       map[string]string{"X-Forwarded-For": "2001:db8:cafe::1"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin/users",
+			HasToken:     true,
+			Roles:        []string{fakeAdminRole},
+			Headers:      map[string]string{"X-Forwarded-For": "2001:db8:dead::1"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/admin/users",
+			HasToken:     true,
+			Roles:        []string{fakeAdminRole},
+			Headers:      map[string]string{"X-Forwarded-For": "127.0.0.2"},
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	const edge = `for=192.0.2.43;proto=https;host=example.com`
+	upstreamHeaders := func(resp *resty.Response) http.Header {
+		var upstream fakeUpstreamResponse
+		require.NoError(t, json.Unmarshal(resp.Body(), &upstream))
+		return upstream.Headers
+	}
+
+	// the Forwarded header of a trusted proxy is retained, and our own element is appended
+	c := newFakeKeycloakConfig()
+	c.ForwardedTrustedProxies = []string{"127.0.0.1"}
+	newFakeProxy(c).RunTests(t, []fakeRequest{
+		{
+			URI:           "/auth_all/white_listed/test",
+			Headers:       map[string]string{"Forwarded": edge},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Forwarded-For":  "192.0.2.43",
+				"X-Forwarded-Host": "",
+			},
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				forwarded := upstreamHeaders(resp).Get("Forwarded")
+				assert.True(t, strings.HasPrefix(forwarded, edge+", for=127.0.0.1;host="), forwarded)
+				assert.True(t, strings.HasSuffix(forwarded, ";proto=http"), forwarded)
+			},
+		},
+		{
+			URI:           "/auth_all/white_listed/test",
+			Headers:       map[string]string{"Forwarded": `for="192.0.2.43`},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Forwarded-For": "127.0.0.1",
+			},
+		},
+	})
+
+	// the Forwarded header of an untrusted peer is dropped
+	c = newFakeKeycloakConfig()
+	newFakeProxy(c).RunTests(t, []fakeRequest{
+		{
+			URI:           "/auth_all/white_listed/test",
+			Headers:       map[string]string{"Forwarded": edge},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Forwarded-For": "127.0.0.1",
+			},
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				forwarded := upstreamHeaders(resp).Get("Forwarded")
+				assert.True(t, strings.HasPrefix(forwarded, "for=127.0.0.1;host="), forwarded)
+			},
+		},
+	})
+
+	// X-Forwarded headers may be replaced by the Forwarded header
+	c = newFakeKeycloakConfig()
+	c.ForwardedHeaders = forwardedHeadersForwarded
+	newFakeProxy(c).RunTests(t, []fakeRequest{
+		{
+			URI:                    "/auth_all/white_listed/test",
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedProxyHeaders:   map[string]string{"Forwarded": ""},
+			ExpectedNoProxyHeaders: []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"},
+		},
+	})
+
+	// or be the only ones sent upstream, the Forwarded header of an untrusted peer being dropped
+	c = newFakeKeycloakConfig()
+	c.ForwardedHeaders = forwardedHeadersXForward
+	newFakeProxy(c).RunTests(t, []fakeRequest{
+		{
+			URI:                    "/auth_all/white_listed/test",
+			Headers:                map[string]string{"Forwarded": edge},
+			ExpectedProxy:          true,
+			ExpectedCode:           http.StatusOK,
+			ExpectedProxyHeaders:   map[string]string{"X-Forwarded-For": "127.0.0.1"},
+			ExpectedNoProxyHeaders: []string{"Forwarded"},
+		},
+	})
+
+	// while the Forwarded header of a trusted proxy is relayed as is
+	c = newFakeKeycloakConfig()
+	c.ForwardedHeaders = forwardedHeadersXForward
+	c.ForwardedTrustedProxies = []string{"127.0.0.1"}
+	newFakeProxy(c).RunTests(t, []fakeRequest{
+		{
+			URI:                  "/auth_all/white_listed/test",
+			Headers:              map[string]string{"Forwarded": edge},
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"Forwarded": edge},
+		},
+	})
+}
+
+func TestResourceResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("X-Frame-Policy", "upstream")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.ResponseHeaders = map[string]string{"X-Frame-Policy": "global", "X-Feature-Beta": "off"}
+	cfg.Resources = append(cfg.Resources,
+		&Resource{
+			URL:             "/api/*",
+			Methods:         allHTTPMethods,
+			Upstream:        upstream.URL,
+			ResponseHeaders: map[string]string{"Cache-Control": "no-store"},
+		},
+		&Resource{
+			URL:             "/beta/*",
+			Methods:         allHTTPMethods,
+			WhiteListed:     true,
+			ResponseHeaders: map[string]string{"X-Feature-Beta": "on"},
+		},
+		&Resource{
+			URL:             "/retired/*",
+			Methods:         allHTTPMethods,
+			BlackListed:     true,
+			ResponseHeaders: map[string]string{"Cache-Control": "no-store"},
+		},
+	)
+	single := func(name, value string) func(int, *resty.Request, *resty.Response) {
+		return func(i int, _ *resty.Request, resp *resty.Response) {
+			assert.Equal(t, []string{value}, resp.Header().Values(name), "case %d, header %s", i, name)
+		}
+	}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			// the headers of the resource, then the global ones, override those of the upstream
+			URI:             "/api/orders",
+			HasToken:        true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedHeaders: map[string]string{"X-Feature-Beta": "off"},
+			OnResponse:      single("Cache-Control", "no-store"),
+		},
+		{
+			URI:          "/api/orders",
+			HasToken:     true,
+			ExpectedCode: http.StatusOK,
+			OnResponse:   single("X-Frame-Policy", "global"),
+		},
+		{
+			// the responses of the proxy carry them too
+			URI:             "/api/orders",
+			ExpectedCode:    http.StatusUnauthorized,
+			ExpectedHeaders: map[string]string{"Cache-Control": "no-store", "X-Frame-Policy": "global"},
+		},
+		{
+			URI:             "/beta/index.html",
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedHeaders: map[string]string{"X-Feature-Beta": "on", "X-Frame-Policy": "global"},
+		},
+		{
+			URI:             "/retired/index.html",
+			ExpectedCode:    http.StatusForbidden,
+			ExpectedHeaders: map[string]string{"Cache-Control": "no-store"},
+		},
+		{
+			URI:             fakeAuthAllURL,
+			HasToken:        true,
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedHeaders: map[string]string{"Cache-Control": "", "X-Feature-Beta": "off"},
+		},
+	})
+}
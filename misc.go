@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -17,8 +20,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/jose"
@@ -53,11 +61,49 @@ func (r *oauthProxy) redirectToURL(url string, w http.ResponseWriter, req *http.
 	return r.revokeProxy(w, req)
 }
 
+// redirectToRequestURI redirects the client to the uri it requested before the login. Unlike redirectToURL, the
+// location is kept byte for byte: the path is not cleaned, and only the bytes which cannot be sent in a header
+// are escaped.
+func (r *oauthProxy) redirectToRequestURI(location string, w http.ResponseWriter, req *http.Request, statusCode int) context.Context {
+	r.log.Debug("redirecting to", zap.String("location", location))
+	w.Header().Add("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+	w.Header().Set("Location", escapeHeaderURL(location))
+	w.WriteHeader(statusCode)
+
+	return r.revokeProxy(w, req)
+}
+
 // redirectToAuthorization redirects the user to authorization handler
 func (r *oauthProxy) redirectToAuthorization(w http.ResponseWriter, req *http.Request) context.Context {
 	if r.config.NoRedirects {
+		return r.accessUnauthorized(w, req)
+	}
+
+	// step: HEAD requests from load balancers or link unfurlers do not initiate a login flow, nor write any cookie
+	if req.Method == http.MethodHead && !r.config.EnableHeadRedirects && !isBrowserRequest(req) {
+		ctx := r.revokeProxy(w, req)
+		if scope, ok := ctx.Value(contextScopeName).(*RequestScope); ok {
+			scope.AuthDecision = authDecisionHeadUnauthenticated
+		}
 		r.errorResponse(w, req, "", http.StatusUnauthorized, nil)
-		return r.revokeProxy(w, req)
+
+		return ctx
+	}
+
+	// step: only the navigations initiate a login flow, the other requests would lose their body on the way unless
+	// it is kept for a replay after the login
+	var replay *loginReplay
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		var kept bool
+		if replay, kept = r.readLoginReplay(req); !kept {
+			ctx := r.revokeProxy(w, req)
+			if scope, ok := ctx.Value(contextScopeName).(*RequestScope); ok {
+				scope.AuthDecision = authDecisionNotNavigation
+			}
+			r.errorResponse(w, req, "", http.StatusUnauthorized, nil)
+
+			return ctx
+		}
 	}
 
 	// step: add a state referrer to the authorization page
@@ -69,6 +115,19 @@ func (r *oauthProxy) redirectToAuthorization(w http.ResponseWriter, req *http.Re
 		r.errorResponse(w, req, "refusing to redirect to authorization endpoint, skip token verification switched on", http.StatusForbidden, nil)
 		return r.revokeProxy(w, req)
 	}
+	if replay == nil && r.keepsRequestURI() {
+		r.keepRequestURI(uuid, req)
+	}
+	if replay != nil {
+		if err := r.keepLoginReplay(uuid, replay); err != nil {
+			r.errorResponse(w, req, "unable to keep the request during the login", http.StatusUnauthorized, err)
+			return r.revokeProxy(w, req)
+		}
+		// the browser follows with a GET, rather than posting the body to the authorization endpoint
+		r.redirectToURL(r.config.WithOAuthURI(authorizationURL+authQuery), w, req, http.StatusSeeOther)
+
+		return r.revokeProxy(w, req)
+	}
 	if r.config.InvalidAuthRedirectsWith303 {
 		r.redirectToURL(r.config.WithOAuthURI(authorizationURL+authQuery), w, req, http.StatusSeeOther)
 	} else {
@@ -78,6 +137,24 @@ func (r *oauthProxy) redirectToAuthorization(w http.ResponseWriter, req *http.Re
 	return r.revokeProxy(w, req)
 }
 
+// isBrowserRequest tells if a request comes from a browser navigating to a page, rather than from an api client,
+// a load balancer or a link unfurler
+func isBrowserRequest(req *http.Request) bool {
+	if mode := req.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	for _, accept := range req.Header.Values("Accept") {
+		for _, media := range strings.Split(accept, ",") {
+			switch strings.TrimSpace(strings.SplitN(media, ";", 2)[0]) {
+			case "text/html", "application/xhtml+xml":
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // getAccessCookieExpiration calculates the expiration of the access token cookie
 func (r *oauthProxy) getAccessCookieExpiration(token jose.JWT, refresh string) time.Duration {
 	// notes: by default the duration of the access token will be the configuration option, if
@@ -85,7 +162,7 @@ func (r *oauthProxy) getAccessCookieExpiration(token jose.JWT, refresh string) t
 	// refresh token
 	duration := r.config.AccessTokenDuration
 	if _, ident, err := parseToken(refresh); err == nil {
-		delta := time.Until(ident.ExpiresAt)
+		delta := r.until(ident.ExpiresAt)
 		if delta > 0 {
 			duration = delta
 		}
@@ -96,3 +173,107 @@ func (r *oauthProxy) getAccessCookieExpiration(token jose.JWT, refresh string) t
 
 	return duration
 }
+
+// accessForbidden redirects the user to the forbidden page
+func (r *oauthProxy) accessForbidden(w http.ResponseWriter, req *http.Request, msgs ...string) context.Context {
+	_, logger := r.traceSpanRequest(req)
+
+	// are we using a custom http template for 403?
+	if r.config.hasCustomForbiddenPage() {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		noSniff(w)
+		w.WriteHeader(http.StatusForbidden)
+		name := path.Base(r.config.ForbiddenPage)
+		if err := r.Render(w, name, r.config.Tags); err != nil {
+			logger.Error("failed to render the template", zap.Error(err), zap.String("template", name))
+		}
+	} else {
+		var msg string
+		if len(msgs) > 0 {
+			r.log.Warn("user forbidden access", zap.Strings("extra_messages", msgs))
+
+			switch len(msgs) {
+			case 1:
+				msg = msgs[0]
+			default: // > 1
+				msg = strings.Join(msgs[:2], " ")
+			}
+		}
+		// extraMsg goes to log but only the 2 first ones are to be returned as end user error
+		r.errorResponse(w, req, msg, http.StatusForbidden, nil)
+	}
+
+	return r.revokeProxy(w, req)
+}
+
+// upstreamFailureStatus returns the status of the response to a request the upstream failed to respond: a gateway
+// timeout when the upstream timed out, else a bad gateway
+func upstreamFailureStatus(err error) int {
+	var e net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &e) && e.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// upstreamFailure responds to a request the upstream failed to respond, with the custom error page if any. The json
+// clients keep getting the error response.
+func (r *oauthProxy) upstreamFailure(w http.ResponseWriter, req *http.Request, code int, err error) {
+	if !r.config.hasCustomErrorPage() || isJSONRequest(req) {
+		r.errorResponse(w, req, "", code, err)
+		return
+	}
+	_, logger := r.traceSpanRequest(req)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	noSniff(w)
+	w.WriteHeader(code)
+	name := path.Base(r.config.ErrorPage)
+	model := mergeMaps(make(map[string]string, len(r.config.Tags)+3), r.config.Tags)
+	model["status_code"] = strconv.Itoa(code)
+	model["status"] = http.StatusText(code)
+	model["request_id"] = req.Header.Get(r.config.RequestIDHeader)
+	if err := r.Render(w, name, model); err != nil {
+		logger.Error("failed to render the template", zap.Error(err), zap.String("template", name))
+	}
+}
+
+// isJSONRequest tells if a request accepts json, and not html
+func isJSONRequest(req *http.Request) bool {
+	json := false
+	for _, accept := range req.Header.Values("Accept") {
+		for _, media := range strings.Split(accept, ",") {
+			switch media = strings.TrimSpace(strings.SplitN(media, ";", 2)[0]); {
+			case media == "text/html" || media == "application/xhtml+xml":
+				return false
+			case media == "application/json" || strings.HasSuffix(media, "+json"):
+				json = true
+			}
+		}
+	}
+
+	return json
+}
+
+// accessUnauthorized responds a 401 to a request without session, with the custom unauthorized page if any
+func (r *oauthProxy) accessUnauthorized(w http.ResponseWriter, req *http.Request) context.Context {
+	_, logger := r.traceSpanRequest(req)
+
+	// are we using a custom http template for 401?
+	if r.config.hasCustomUnauthorizedPage() {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		noSniff(w)
+		w.WriteHeader(http.StatusUnauthorized)
+		name := path.Base(r.config.UnauthorizedPage)
+		model := mergeMaps(make(map[string]string, len(r.config.Tags)+1), r.config.Tags)
+		model["request_uri"] = req.URL.RequestURI()
+		if err := r.Render(w, name, model); err != nil {
+			logger.Error("failed to render the template", zap.Error(err), zap.String("template", name))
+		}
+	} else {
+		r.errorResponse(w, req, "", http.StatusUnauthorized, nil)
+	}
+
+	return r.revokeProxy(w, req)
+}
@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -16,11 +19,20 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	resty "gopkg.in/resty.v1"
 )
 
 func TestRedirectToAuthorizationUnauthorized(t *testing.T) {
@@ -30,6 +42,119 @@ func TestRedirectToAuthorizationUnauthorized(t *testing.T) {
 	newFakeProxy(nil).RunTests(t, requests)
 }
 
+func TestRedirectToAuthorizationUnauthorizedPage(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.UnauthorizedPage = "templates/unauthorized.html.tmpl"
+	requests := []fakeRequest{
+		{
+			URI:          "/auth_all/test?page=2",
+			ExpectedCode: http.StatusUnauthorized,
+			ExpectedHeaders: map[string]string{
+				"Content-Type":           "text/html; charset=utf-8",
+				"X-Content-Type-Options": "nosniff",
+			},
+			ExpectedContentContains: "Sorry, you must be signed in to access /auth_all/test?page=2",
+		},
+		{
+			// the denied requests of a session still get the forbidden response
+			URI:          "/admin/test",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestCreateTemplatesInvalid(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "unauthorized.html.tmpl")
+	require.NoError(t, os.WriteFile(page, []byte("<p>{{ .request_uri </p>"), 0600))
+	cfg := newFakeKeycloakConfig()
+	cfg.UnauthorizedPage = page
+
+	p := &oauthProxy{config: cfg, log: zap.NewNop()}
+	assert.Error(t, p.createTemplates())
+}
+
+func TestUpstreamFailurePage(t *testing.T) {
+	// a refused connection: nothing listens on the port anymore
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := "http://" + listener.Addr().String()
+	require.NoError(t, listener.Close())
+	maintenance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("upstream maintenance"))
+	}))
+	defer maintenance.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRequestID = true
+	cfg.RequestIDHeader = "X-Request-ID"
+	cfg.ErrorPage = "templates/error.html.tmpl"
+	cfg.Resources = []*Resource{
+		{URL: "/down/*", WhiteListed: true, Upstream: refused},
+		{URL: "/maintenance/*", WhiteListed: true, Upstream: maintenance.URL},
+	}
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:          "/down/test",
+			Headers:      map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8", "X-Request-ID": "5f3c"},
+			ExpectedCode: http.StatusBadGateway,
+			ExpectedHeaders: map[string]string{
+				"Content-Type":           "text/html; charset=utf-8",
+				"X-Content-Type-Options": "nosniff",
+			},
+			ExpectedContentContains: "Request id: 5f3c",
+		},
+		{
+			URI:                     "/down/test",
+			ExpectedCode:            http.StatusBadGateway,
+			ExpectedContentContains: "502 Bad Gateway",
+		},
+		{
+			// the json clients keep getting the error response
+			URI:             "/down/test",
+			Headers:         map[string]string{"Accept": "application/json"},
+			ExpectedCode:    http.StatusBadGateway,
+			ExpectedHeaders: map[string]string{"Content-Type": jsonMime},
+		},
+		{
+			// the failures of the upstream are passed through
+			URI:             "/maintenance/test",
+			Headers:         map[string]string{"Accept": "text/html"},
+			ExpectedCode:    http.StatusServiceUnavailable,
+			ExpectedContent: "upstream maintenance",
+		},
+	})
+}
+
+func TestUpstreamFailureStatus(t *testing.T) {
+	assert.Equal(t, http.StatusBadGateway, upstreamFailureStatus(errors.New("dial tcp 127.0.0.1:80: connect: connection refused")))
+	assert.Equal(t, http.StatusGatewayTimeout, upstreamFailureStatus(context.DeadlineExceeded))
+	assert.Equal(t, http.StatusGatewayTimeout, upstreamFailureStatus(&net.DNSError{Err: "i/o timeout", IsTimeout: true}))
+}
+
+func TestIsJSONRequest(t *testing.T) {
+	cases := []struct {
+		Accept   string
+		Expected bool
+	}{
+		{Accept: "application/json", Expected: true},
+		{Accept: "application/problem+json;q=0.9, */*;q=0.1", Expected: true},
+		{Accept: "text/html,application/json"},
+		{Accept: "*/*"},
+		{},
+	}
+	for i, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.Accept != "" {
+			req.Header.Set("Accept", c.Accept)
+		}
+		assert.Equal(t, c.Expected, isJSONRequest(req), "case %d", i)
+	}
+}
+
 func TestRedirectToAuthorization(t *testing.T) {
 	requests := []fakeRequest{
 		{
@@ -57,6 +182,65 @@ func TestRedirectToAuthorizationWith303Enabled(t *testing.T) {
 	newFakeProxy(cfg).RunTests(t, requests)
 }
 
+func TestRedirectToAuthorizationHead(t *testing.T) {
+	noCookies := func(no int, req *resty.Request, resp *resty.Response) {
+		assert.Empty(t, resp.Cookies(), "case %d, no cookie expected", no)
+	}
+	requests := []fakeRequest{
+		{
+			// a load balancer does not initiate a login flow
+			URI:          "/admin",
+			Method:       http.MethodHead,
+			Redirects:    true,
+			OnResponse:   noCookies,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:              "/admin",
+			Method:           http.MethodHead,
+			Redirects:        true,
+			Headers:          map[string]string{"Accept": "text/html,application/xhtml+xml;q=0.9"},
+			ExpectedLocation: "/oauth/authorize?state",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+	}
+	newFakeProxy(nil).RunTests(t, requests)
+
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableHeadRedirects = true
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:              "/admin",
+			Method:           http.MethodHead,
+			Redirects:        true,
+			ExpectedLocation: "/oauth/authorize?state",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+	})
+}
+
+func TestIsBrowserRequest(t *testing.T) {
+	cs := []struct {
+		Headers  map[string]string
+		Expected bool
+	}{
+		{Headers: map[string]string{}},
+		{Headers: map[string]string{"Accept": "*/*"}},
+		{Headers: map[string]string{"Accept": "application/json"}},
+		{Headers: map[string]string{"Accept": "text/html"}, Expected: true},
+		{Headers: map[string]string{"Accept": "application/json, application/xhtml+xml;q=0.9"}, Expected: true},
+		{Headers: map[string]string{"Sec-Fetch-Mode": "navigate"}, Expected: true},
+		{Headers: map[string]string{"Sec-Fetch-Mode": "cors", "Accept": "text/html"}},
+	}
+	for i, c := range cs {
+		req := newFakeHTTPRequest(http.MethodHead, "/")
+		for k, v := range c.Headers {
+			req.Header.Set(k, v)
+		}
+		assert.Equal(t, c.Expected, isBrowserRequest(req), "case %d", i)
+	}
+}
+
 func TestRedirectToAuthorizationSkipToken(t *testing.T) {
 	requests := []fakeRequest{
 		{URI: "/admin", ExpectedCode: http.StatusUnauthorized},
@@ -0,0 +1,33 @@
+//go:build nocapture
+// +build nocapture
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// the capture of the requests is excluded from this build
+type requestCapture struct{}
+
+func newRequestCapture(size int) *requestCapture {
+	return nil
+}
+
+func (r *Config) isCaptureValid() error {
+	if r.EnableCaptureEndpoint {
+		return errors.New("the request capture is excluded from this build: you can't enable the capture endpoint")
+	}
+	return nil
+}
+
+func (r *oauthProxy) captureMiddleware(next http.Handler) http.Handler {
+	return next
+}
+
+func (r *oauthProxy) startCaptureHandler(w http.ResponseWriter, req *http.Request) {}
+
+func (r *oauthProxy) captureHandler(w http.ResponseWriter, req *http.Request) {}
+
+func (r *oauthProxy) stopCaptureHandler(w http.ResponseWriter, req *http.Request) {}
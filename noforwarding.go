@@ -19,3 +19,18 @@ func (r *oauthProxy) createForwardingProxy() error {
 func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 	return func(_ *http.Request, _ *http.Response) {}
 }
+
+func (r *oauthProxy) shutdownForwarding() error {
+	return nil
+}
+
+// the forwarding credentials are excluded from this build
+type forwardingCredentials struct{}
+
+func (r *oauthProxy) reloadForwarding() bool {
+	return false
+}
+
+func (r *oauthProxy) clientSecret() string {
+	return r.config.ClientSecret
+}
@@ -0,0 +1,73 @@
+//go:build noreverse
+// +build noreverse
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the state held by the reverse proxy is not used in this build
+type (
+	clientTokenIssuer  struct{}
+	deviceGrants       struct{}
+	exchangedTokens    struct{}
+	externalAuthorizer struct{}
+	rateLimitedLog     struct{}
+	requestLimit       struct{}
+	requestRateLimit   struct{}
+	umaPermissions     struct{}
+
+	trustedAuthenticator struct{}
+)
+
+func (r *Config) isReverseProxyValid() error {
+	return errors.New("reverse proxy mode is not enabled in this build: you must enable EnableForwarding")
+}
+
+// isReverseProxyUnused rejects the options of the reverse proxy, which is not compiled in this build
+func (r *Config) isReverseProxyUnused() error {
+	options := []struct {
+		name string
+		set  bool
+	}{
+		{"upstream-url", r.Upstream != ""},
+		{"resources", len(r.Resources) > 0},
+		{"enable-login-handler", r.EnableLoginHandler},
+		{"enable-refresh-tokens", r.EnableRefreshTokens},
+		{"enable-logout-redirect", r.EnableLogoutRedirect},
+		{"enable-token-exchange", r.EnableTokenExchange},
+		{"enable-uma", r.EnableUMA},
+		{"enable-client-token-handler", r.EnableClientTokenHandler},
+		{"enable-claims-header", r.EnableClaimsHeader},
+		{"external-authz-url", r.ExternalAuthzURL != ""},
+		{"trusted-authenticator", r.TrustedAuthenticator != ""},
+		{"allowed-redirect-urls", len(r.AllowedRedirectURLs) > 0},
+		{"match-claims", len(r.MatchClaims) > 0},
+		{"add-claims", len(r.AddClaims) > 0},
+		{"response-headers", len(r.ResponseHeaders) > 0},
+	}
+	var set []string
+	for _, option := range options {
+		if option.set {
+			set = append(set, option.name)
+		}
+	}
+	if len(set) > 0 {
+		return fmt.Errorf("reverse proxy mode is not enabled in this build: you can't set %s", strings.Join(set, ", "))
+	}
+
+	return nil
+}
+
+func (r *oauthProxy) createReverseProxy() error {
+	return errors.New("reverse proxy mode is not enabled in this build")
+}
+
+func (r *oauthProxy) createAdminServices() {}
+
+func (r *oauthProxy) selfTestAuthorization(path string, user *userContext) (string, error) {
+	return "reverse proxy mode is not enabled in this build", errSelfTestSkipped
+}
@@ -0,0 +1,23 @@
+//go:build noreverse
+// +build noreverse
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReverseProxyOptionsRejected(t *testing.T) {
+	cfg := newDefaultConfig()
+	assert.NoError(t, cfg.isReverseProxyUnused())
+
+	cfg.Upstream = "http://127.0.0.1:8080"
+	cfg.Resources = []*Resource{{URL: "/admin*", Roles: []string{"admin"}}}
+	cfg.EnableRefreshTokens = true
+	err := cfg.isReverseProxyUnused()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "upstream-url, resources, enable-refresh-tokens")
+	}
+}
@@ -4,9 +4,13 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"time"
 
 	"github.com/coreos/go-oidc/jose"
+	"go.uber.org/zap"
 )
 
 func (r *Config) isStoreValid() error {
@@ -16,10 +20,21 @@ func (r *Config) isStoreValid() error {
 	return nil
 }
 
-func createStorage(location string) (storage, error) {
+// RegisterStore is a no-op, as the stores are disabled in this build
+func RegisterStore(scheme string, factory StoreFactory) {}
+
+func createStorage(location string, tlsConfig *tls.Config) (storage, error) {
 	return nil, nil
 }
 
+func newEncryptedStore(store storage, key string, log *zap.Logger) storage {
+	return store
+}
+
+func pingStore(ctx context.Context, store storage) error {
+	return nil
+}
+
 func (r *oauthProxy) useStore() bool {
 	return false
 }
@@ -32,6 +47,14 @@ func (r *oauthProxy) CloseStore() error {
 	return nil
 }
 
+func (r *oauthProxy) persistRevocation(subject string, at time.Time) error {
+	return nil
+}
+
+func (r *oauthProxy) loadRevocations() error {
+	return nil
+}
+
 func (r *oauthProxy) GetRefreshToken(token jose.JWT) (string, error) {
 	return "", nil
 }
@@ -39,3 +62,71 @@ func (r *oauthProxy) GetRefreshToken(token jose.JWT) (string, error) {
 func (r *oauthProxy) DeleteRefreshToken(token jose.JWT) error {
 	return nil
 }
+
+func (r *oauthProxy) createServerSession(subject, value string, ttl time.Duration) (string, error) {
+	return "", ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) getServerSession(id string) (string, error) {
+	return "", ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) updateServerSession(id, value string, ttl time.Duration) error {
+	return ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) deleteServerSession(id string) error {
+	return nil
+}
+
+func (r *oauthProxy) getServerSessionActivity(id string) (time.Time, error) {
+	return time.Time{}, ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) setServerSessionActivity(id string, at time.Time) error {
+	return ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) revokeSessions(subject string) (int, error) {
+	return 0, nil
+}
+
+func (r *oauthProxy) revokeAllSessions() (int, error) {
+	return 0, nil
+}
+
+func (r *oauthProxy) setLoginReplay(state, value string, ttl time.Duration) error {
+	return ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) getLoginReplay(state string) (string, error) {
+	return "", ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) deleteLoginReplay(state string) error {
+	return nil
+}
+
+func (r *oauthProxy) setRequestURI(state, uri string, ttl time.Duration) error {
+	return ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) getRequestURI(state string) (string, error) {
+	return "", ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) deleteRequestURI(state string) error {
+	return nil
+}
+
+func (r *oauthProxy) setProviderSession(sid, id string, ttl time.Duration) error {
+	return ErrNoSessionStateFound
+}
+
+func (r *oauthProxy) deleteProviderSession(sid string) error {
+	return nil
+}
+
+func sharedRateLimitStore(store storage) (rateLimitingStorage, bool) {
+	return nil, false
+}
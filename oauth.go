@@ -17,11 +17,15 @@ package main
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -31,8 +35,13 @@ import (
 	"go.uber.org/zap"
 )
 
-// getOAuthClient returns a oauth2 client from the openid client
-func (r *oauthProxy) getOAuthClient(redirectionURL string) (*oauth2.Client, error) {
+// codeChallengeMethodS256 is the method of the proof key for code exchange used by the proxy
+const codeChallengeMethodS256 = "S256"
+
+// getOAuthClient returns a oauth2 client from the openid client, requesting the extra scopes if any
+func (r *oauthProxy) getOAuthClient(redirectionURL string, extraScopes ...string) (*oauth2.Client, error) {
+	scopes := append(append([]string{}, r.config.Scopes...), extraScopes...)
+
 	return oauth2.NewClient(r.idpClient, oauth2.Config{
 		Credentials: oauth2.ClientCredentials{
 			ID:     r.config.ClientID,
@@ -41,14 +50,48 @@ func (r *oauthProxy) getOAuthClient(redirectionURL string) (*oauth2.Client, erro
 		AuthMethod:  oauth2.AuthMethodClientSecretBasic,
 		AuthURL:     r.idp.AuthEndpoint.String(),
 		RedirectURL: redirectionURL,
-		Scope:       append(r.config.Scopes, oidc.DefaultScope...),
+		Scope:       append(scopes, oidc.DefaultScope...),
 		TokenURL:    r.idp.TokenEndpoint.String(),
 	})
 }
 
+// verifyTokenSignature checks the signing algorithm, the claims and the signature of the token
+func (r *oauthProxy) verifyTokenSignature(client *oidc.Client, token jose.JWT) error {
+	if err := checkSigningAlgorithm(token, r.config.AcceptedSigningAlgorithms); err != nil {
+		return err
+	}
+	if cache := r.extraIssuerOf(token); cache != nil {
+		if err := cache.verify(r.config.ClientID, token); err != nil {
+			return err
+		}
+		r.log.Debug("the token was verified by an extra issuer", zap.String("issuer", cache.issuer))
+
+		return nil
+	}
+	if r.jwks != nil {
+		return r.jwks.verify(r.config.ClientID, token)
+	}
+
+	return client.VerifyJWT(token)
+}
+
+// extraIssuerOf returns the keys of the extra issuer of the token, nil when issued by the provider of the discovery url
+func (r *oauthProxy) extraIssuerOf(token jose.JWT) *jwksCache {
+	if len(r.extraIssuers) == 0 {
+		return nil
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return nil
+	}
+	issuer, _, _ := claims.StringClaim("iss")
+
+	return r.extraIssuers[strings.TrimRight(issuer, "/")]
+}
+
 // verifyToken verify that the token in the user context is valid
 func (r *oauthProxy) verifyToken(client *oidc.Client, token jose.JWT) error {
-	if err := client.VerifyJWT(token); err != nil {
+	if err := r.verifyTokenSignature(client, token); err != nil {
 		if strings.Contains(err.Error(), "token is expired") {
 			return ErrAccessTokenExpired
 		}
@@ -95,22 +138,24 @@ func (r *oauthProxy) verifyToken(client *oidc.Client, token jose.JWT) error {
 }
 
 // getRefreshedToken attempts to refresh the access token, returning the parsed token, optionally with a renewed
-// refresh token and the time the access and refresh tokens expire
+// refresh token and id token, and the time the access and refresh tokens expire
 //
 // NOTE: we may be able to extract the specific (non-standard) claim refresh_expires_in and refresh_expires
 // from response.RawBody.
 // When not available, keycloak provides us with the same (for now) expiry value for ID token.
-func getRefreshedToken(client *oidc.Client, t string) (jose.JWT, string, time.Time, time.Duration, error) {
-	cl, err := client.OAuthClient()
-	if err != nil {
-		return jose.JWT{}, "", time.Time{}, time.Duration(0), err
-	}
-	response, err := getToken(cl, oauth2.GrantTypeRefreshToken, t)
-	if err != nil {
-		if strings.Contains(err.Error(), "refresh token has expired") {
-			return jose.JWT{}, "", time.Time{}, time.Duration(0), ErrRefreshTokenExpired
+func (r *oauthProxy) getRefreshedToken(ctx context.Context, t string) (jose.JWT, string, string, time.Time, time.Duration, error) {
+	var response oauth2.TokenResponse
+	err := r.retry(ctx, refreshBackoff, func(ctx context.Context) error {
+		var err error
+		response, err = r.requestRefreshedToken(ctx, t)
+		if errors.Is(err, ErrRefreshTokenExpired) {
+			return permanent(err)
 		}
-		return jose.JWT{}, "", time.Time{}, time.Duration(0), err
+
+		return err
+	})
+	if err != nil {
+		return jose.JWT{}, "", "", time.Time{}, time.Duration(0), err
 	}
 
 	// extracts non-standard claims about refresh token, to get refresh token expiry
@@ -126,17 +171,282 @@ func getRefreshedToken(client *oidc.Client, t string) (jose.JWT, string, time.Ti
 			refreshExpiresIn = time.Duration(asInt) * time.Second
 		}
 	}
+	// the offline tokens do not expire with the session of the provider (keycloak reports a zero refresh_expires_in):
+	// the offline session lasts while it is refreshed, unless idle for longer than the session idle timeout
+	if r.config.EnableOfflineTokens && isOfflineToken(defaultTo(response.RefreshToken, t)) {
+		refreshExpiresIn = r.config.OfflineSessionDuration
+	}
 	token, identity, err := parseToken(response.AccessToken)
 	if err != nil {
-		return jose.JWT{}, "", time.Time{}, time.Duration(0), err
+		return jose.JWT{}, "", "", time.Time{}, time.Duration(0), err
+	}
+
+	return token, response.RefreshToken, response.IDToken, identity.ExpiresAt, refreshExpiresIn, nil
+}
+
+// requestRefreshedToken requests a new access token with the refresh token
+func (r *oauthProxy) requestRefreshedToken(ctx context.Context, t string) (oauth2.TokenResponse, error) {
+	// the client of the openid provider authenticates with the client-secret, not with the rotated secret of a file
+	if r.clientAssertion != nil || r.config.ForwardingClientSecretFile != "" {
+		response, err := r.requestToken(ctx, url.Values{
+			"grant_type":    []string{oauth2.GrantTypeRefreshToken},
+			"refresh_token": []string{t},
+		})
+		if errors.Is(err, ErrInvalidGrant) {
+			return oauth2.TokenResponse{}, ErrRefreshTokenExpired
+		}
+
+		return response, err
+	}
+
+	cl, err := r.client.OAuthClient()
+	if err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+	response, err := getToken(cl, oauth2.GrantTypeRefreshToken, t)
+	if err != nil {
+		if strings.Contains(err.Error(), "refresh token has expired") {
+			return oauth2.TokenResponse{}, ErrRefreshTokenExpired
+		}
+		return oauth2.TokenResponse{}, err
+	}
+
+	return response, nil
+}
+
+// exchangeAuthenticationCode exchanges the authentication code with the oauth server for a access token. A code is
+// only redeemed once: should a lost response be retried, the provider refuses the code again, which is not retried.
+func (r *oauthProxy) exchangeAuthenticationCode(ctx context.Context, client *oauth2.Client, code string) (oauth2.TokenResponse, error) {
+	var response oauth2.TokenResponse
+	err := r.retry(ctx, codeExchangeBackoff, func(context.Context) error {
+		var err error
+		response, err = getToken(client, oauth2.GrantTypeAuthCode, code)
+
+		return refusedGrant(err)
+	})
+
+	return response, err
+}
+
+// newCodeVerifier returns a random code verifier for the proof key for code exchange (RFC 7636)
+func newCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(cryptorand.Reader, b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// checkNonce checks the nonce claim of an id token is the nonce of the authorization. The id tokens issued without
+// nonce are only accepted when the authorization did not send any.
+func checkNonce(token jose.JWT, nonce string) error {
+	claims, err := token.Claims()
+	if err != nil {
+		return err
+	}
+	claim, _, err := claims.StringClaim(claimNonce)
+	if err != nil {
+		return err
+	}
+	if claim != nonce {
+		return ErrNonceMismatch
+	}
+
+	return nil
+}
+
+// codeChallenge returns the S256 code challenge of a code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// usePKCE tells if the authorization code flow uses a proof key for code exchange, either enabled or advertised
+// by the provider. The code verifier is encrypted, so the provider cannot be followed without an encryption key.
+func (r *oauthProxy) usePKCE(hc *http.Client) bool {
+	if r.config.EnablePKCE {
+		return true
+	}
+	methods, err := fetchCodeChallengeMethods(hc, r.config.DiscoveryURL)
+	if err != nil {
+		r.log.Warn("unable to retrieve the code challenge methods supported by the provider", zap.Error(err))
+		return false
+	}
+	if !containedIn(codeChallengeMethodS256, methods, false) {
+		return false
+	}
+	if len(r.config.EncryptionKey) != 16 && len(r.config.EncryptionKey) != 32 {
+		r.log.Warn("the provider supports PKCE, but an encryption key of 16 or 32 characters is required to use it")
+		return false
+	}
+	r.log.Info("the provider supports PKCE, the authorization code flow uses a code challenge")
+
+	return true
+}
+
+// exchangeAuthenticationCodeWithVerifier exchanges the authentication code with the oauth server for a access token,
+// with the code verifier of the authorization if any
+func (r *oauthProxy) exchangeAuthenticationCodeWithVerifier(ctx context.Context, code, redirectionURL, verifier string) (oauth2.TokenResponse, error) {
+	form := url.Values{
+		"grant_type":   []string{oauth2.GrantTypeAuthCode},
+		"code":         []string{code},
+		"redirect_uri": []string{redirectionURL},
+	}
+	if verifier != "" {
+		form.Set("code_verifier", verifier)
+	}
+
+	var response oauth2.TokenResponse
+	err := r.retry(ctx, codeExchangeBackoff, func(ctx context.Context) error {
+		var err error
+		response, err = r.requestToken(ctx, form)
+
+		return refusedGrant(err)
+	})
+
+	return response, err
+}
+
+// exchangeToken exchanges an access token for another one, restricted to the requested audience (RFC 8693)
+func (r *oauthProxy) exchangeToken(ctx context.Context, subjectToken, audience string) (string, time.Time, error) {
+	var response oauth2.TokenResponse
+	err := r.retry(ctx, tokenExchangeBackoff, func(ctx context.Context) error {
+		var err error
+		response, err = r.requestToken(ctx, url.Values{
+			"grant_type":           []string{grantTypeTokenExchange},
+			"subject_token":        []string{subjectToken},
+			"subject_token_type":   []string{tokenTypeAccessToken},
+			"requested_token_type": []string{tokenTypeAccessToken},
+			"audience":             []string{audience},
+		})
+
+		return refusedGrant(err)
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	_, identity, err := parseToken(response.AccessToken)
+	if err != nil {
+		return "", time.Time{}, err
 	}
 
-	return token, response.RefreshToken, identity.ExpiresAt, refreshExpiresIn, nil
+	return response.AccessToken, identity.ExpiresAt, nil
+}
+
+// requestToken requests a grant from the token endpoint of the provider
+func (r *oauthProxy) requestToken(ctx context.Context, form url.Values) (oauth2.TokenResponse, error) {
+	start := time.Now()
+	resp, err := r.postAsClient(ctx, r.idp.TokenEndpoint.String(), form)
+
+	return readTokenResponse(form, start, resp, err)
+}
+
+// requestTokenAs requests a grant from the token endpoint of the provider, as another client than the proxy
+func (r *oauthProxy) requestTokenAs(ctx context.Context, credentials oauth2.ClientCredentials, form url.Values) (oauth2.TokenResponse, error) {
+	start := time.Now()
+	resp, err := r.postForm(ctx, r.idp.TokenEndpoint.String(), form, &credentials)
+
+	return readTokenResponse(form, start, resp, err)
 }
 
-// exchangeAuthenticationCode exchanges the authentication code with the oauth server for a access token
-func exchangeAuthenticationCode(client *oauth2.Client, code string) (oauth2.TokenResponse, error) {
-	return getToken(client, oauth2.GrantTypeAuthCode, code)
+// readTokenResponse reads the response of the token endpoint to a grant
+func readTokenResponse(form url.Values, start time.Time, resp *http.Response, err error) (oauth2.TokenResponse, error) {
+	if err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(content, &failure) == nil && failure.Error == oauth2.ErrorInvalidGrant {
+			return oauth2.TokenResponse{}, fmt.Errorf("%w: the %s grant failed with status %d: %s", ErrInvalidGrant, form.Get("grant_type"), resp.StatusCode, content)
+		}
+		if failure.Error != "" {
+			return oauth2.TokenResponse{}, fmt.Errorf("%w: the %s grant failed with status %d: %s", oauthErrorCode(failure.Error), form.Get("grant_type"), resp.StatusCode, content)
+		}
+		return oauth2.TokenResponse{}, fmt.Errorf("the %s grant failed with status %d: %s", form.Get("grant_type"), resp.StatusCode, content)
+	}
+	observeTokenRequest(form.Get("grant_type"), start)
+
+	var response tokenResponse
+	if err := json.Unmarshal(content, &response); err != nil {
+		return oauth2.TokenResponse{}, err
+	}
+
+	return oauth2.TokenResponse{
+		AccessToken:  response.AccessToken,
+		TokenType:    response.TokenType,
+		Expires:      response.ExpiresIn,
+		IDToken:      response.IDToken,
+		RefreshToken: response.RefreshToken,
+		Scope:        response.Scope,
+		RawBody:      content,
+	}, nil
+}
+
+// oauthErrorCode is the error code of a failed request to the token endpoint, e.g. slow_down
+type oauthErrorCode string
+
+func (e oauthErrorCode) Error() string {
+	return string(e)
+}
+
+// refusedGrant marks a grant refused by the provider as a permanent failure: only the failures to reach the provider,
+// or of the provider itself, are worth retrying
+func refusedGrant(err error) error {
+	var code oauthErrorCode
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrInvalidGrant), strings.HasPrefix(err.Error(), oauth2.ErrorInvalidGrant):
+		return permanent(err)
+	case errors.As(err, &code) && code != oauthErrorServerError && code != oauthErrorTemporarilyUnavailable:
+		return permanent(err)
+	}
+
+	return err
+}
+
+// postAsClient posts a form to an endpoint of the provider, authenticated as the client: with a signed client
+// assertion (private_key_jwt) when configured, else with the client secret (client_secret_basic)
+func (r *oauthProxy) postAsClient(ctx context.Context, endpoint string, form url.Values) (*http.Response, error) {
+	if r.clientAssertion != nil {
+		assertion, err := r.clientAssertion.sign(r.config.ClientID, r.idp.TokenEndpoint.String())
+		if err != nil {
+			return nil, err
+		}
+		form.Set("client_id", r.config.ClientID)
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", assertion)
+
+		return r.postForm(ctx, endpoint, form, nil)
+	}
+
+	return r.postForm(ctx, endpoint, form, &oauth2.ClientCredentials{ID: r.config.ClientID, Secret: r.clientSecret()})
+}
+
+// postForm posts a form to an endpoint of the provider, authenticated with the credentials of a client if any
+func (r *oauthProxy) postForm(ctx context.Context, endpoint string, form url.Values, credentials *oauth2.ClientCredentials) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if credentials != nil {
+		req.SetBasicAuth(url.QueryEscape(credentials.ID), url.QueryEscape(credentials.Secret))
+	}
+
+	return r.idpClient.Do(req)
 }
 
 // getUserinfo is responsible for getting the userinfo from the IDP
@@ -177,6 +487,13 @@ func getToken(client *oauth2.Client, grantType, code string) (oauth2.TokenRespon
 	if err != nil {
 		return token, err
 	}
+	observeTokenRequest(grantType, start)
+
+	return token, err
+}
+
+// observeTokenRequest records the metrics of a successful token request
+func observeTokenRequest(grantType string, start time.Time) {
 	taken := time.Since(start).Seconds()
 	switch grantType {
 	case oauth2.GrantTypeAuthCode:
@@ -185,9 +502,37 @@ func getToken(client *oauth2.Client, grantType, code string) (oauth2.TokenRespon
 	case oauth2.GrantTypeRefreshToken:
 		oauthTokensMetric.WithLabelValues("renew").Inc()
 		oauthLatencyMetric.WithLabelValues("renew").Observe(taken)
+	case grantTypeTokenExchange:
+		// @metric observe the time taken for a token exchange
+		oauthLatencyMetric.WithLabelValues("token-exchange").Observe(taken)
 	}
+}
 
-	return token, err
+// subjectOf returns the subject of a token, empty when the token has none
+func subjectOf(token jose.JWT) string {
+	claims, err := token.Claims()
+	if err != nil {
+		return ""
+	}
+	subject, _, _ := claims.StringClaim("sub")
+
+	return subject
+}
+
+// isOfflineToken checks the refresh token is an offline token of keycloak. The offline tokens may have no expiry, so
+// they are not parsed as identities.
+func isOfflineToken(t string) bool {
+	token, err := jose.ParseJWT(t)
+	if err != nil {
+		return false
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return false
+	}
+	kind, _, _ := claims.StringClaim(claimTokenType)
+
+	return kind == tokenTypeOffline
 }
 
 // parseToken retrieves the user identity from the token
@@ -196,6 +541,10 @@ func parseToken(t string) (jose.JWT, *oidc.Identity, error) {
 	if err != nil {
 		return jose.JWT{}, nil, err
 	}
+	// the tokens are parsed whatever their signing algorithm, but never unsigned
+	if token.Header[jose.HeaderKeyAlgorithm] == signingAlgorithmNone {
+		return jose.JWT{}, nil, errors.New("the token is not signed")
+	}
 	claims, err := token.Claims()
 	if err != nil {
 		return jose.JWT{}, nil, err
@@ -0,0 +1,251 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspMinRefresh and ocspMaxRefresh bound the interval between two fetches of the OCSP response
+	ocspMinRefresh = time.Minute
+	ocspMaxRefresh = 24 * time.Hour
+	// ocspDefaultRefresh is the interval between two fetches when the response has no nextUpdate
+	ocspDefaultRefresh = time.Hour
+	// ocspMaxBackoff bounds the delay before retrying a failed fetch
+	ocspMaxBackoff = 30 * time.Minute
+	// ocspFetchTimeout is the timeout of a request to the OCSP responder
+	ocspFetchTimeout = 30 * time.Second
+)
+
+var (
+	// errNoOCSPResponder is returned when the certificate does not advertise any OCSP responder
+	errNoOCSPResponder = errors.New("the certificate does not advertise any ocsp responder")
+	// errNoOCSPIssuer is returned when the certificate chain does not include the issuer, required to query the responder
+	errNoOCSPIssuer = errors.New("the certificate chain does not include the issuer")
+)
+
+// ocspStapler fetches and caches the OCSP response for the listener certificate, in the background.
+//
+// The certificate is served without a staple whenever no valid response is available.
+type ocspStapler struct {
+	sync.RWMutex
+	// certificate is the current certificate
+	certificate tls.Certificate
+	// response is the current OCSP response, if any
+	response *ocsp.Response
+	staple   []byte
+	// refresh triggers an immediate fetch
+	refresh chan struct{}
+	client  *http.Client
+	log     *zap.Logger
+}
+
+// newOCSPStapler creates a stapler for a certificate and starts fetching its OCSP response
+func newOCSPStapler(certificate tls.Certificate, log *zap.Logger) *ocspStapler {
+	s := &ocspStapler{
+		certificate: certificate,
+		refresh:     make(chan struct{}, 1),
+		client:      &http.Client{Timeout: ocspFetchTimeout},
+		log:         log,
+	}
+	go s.run()
+
+	return s
+}
+
+// update replaces the certificate, e.g. after a rotation, and triggers an immediate fetch
+func (s *ocspStapler) update(certificate tls.Certificate) {
+	s.Lock()
+	s.certificate, s.response, s.staple = certificate, nil, nil
+	s.Unlock()
+
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// stapled returns the certificate with the current OCSP response attached, if still valid
+func (s *ocspStapler) stapled(certificate tls.Certificate) tls.Certificate {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.response != nil && (s.response.NextUpdate.IsZero() || time.Now().Before(s.response.NextUpdate)) {
+		certificate.OCSPStaple = s.staple
+	}
+
+	return certificate
+}
+
+func (s *ocspStapler) run() {
+	backoff := ocspMinRefresh
+	for {
+		wait, err := s.fetch()
+		switch {
+		case errors.Is(err, errNoOCSPResponder), errors.Is(err, errNoOCSPIssuer):
+			s.log.Info("ocsp stapling disabled for the certificate", zap.Error(err))
+			wait = ocspMaxRefresh
+		case err != nil:
+			// @metric a fetch of the ocsp response failed
+			ocspFetchErrorsMetric.Inc()
+			s.log.Warn("unable to fetch the ocsp response, serving the certificate without a fresh staple",
+				zap.Duration("retry_in", backoff), zap.Error(err))
+			wait = backoff
+			if backoff *= 2; backoff > ocspMaxBackoff {
+				backoff = ocspMaxBackoff
+			}
+		default:
+			backoff = ocspMinRefresh
+		}
+		s.updateMetrics()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.refresh:
+			timer.Stop()
+			backoff = ocspMinRefresh
+		}
+	}
+}
+
+// fetch requests the OCSP response for the current certificate, and returns the delay until the next fetch
+func (s *ocspStapler) fetch() (time.Duration, error) {
+	s.RLock()
+	certificate := s.certificate
+	s.RUnlock()
+
+	leaf, issuer, err := parseCertificateChain(certificate)
+	if err != nil {
+		return 0, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return 0, errNoOCSPResponder
+	}
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ocspFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(request))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("the ocsp responder responded with status %d", resp.StatusCode)
+	}
+	staple, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+	response, err := ocsp.ParseResponseForCert(staple, leaf, issuer)
+	if err != nil {
+		return 0, err
+	}
+	if response.Status != ocsp.Good {
+		return 0, fmt.Errorf("the ocsp responder reports the certificate with status %d", response.Status)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if !bytes.Equal(s.certificate.Certificate[0], certificate.Certificate[0]) {
+		// the certificate was rotated meanwhile: the refresh is already pending
+		return ocspMinRefresh, nil
+	}
+	s.response, s.staple = response, staple
+	s.log.Info("fetched the ocsp response for the certificate",
+		zap.String("responder", leaf.OCSPServer[0]),
+		zap.Time("this_update", response.ThisUpdate),
+		zap.Time("next_update", response.NextUpdate))
+
+	return ocspRefreshDelay(response, time.Now()), nil
+}
+
+// ocspRefreshDelay is halfway to the next update of the response, so a fresh response is available before expiry
+func ocspRefreshDelay(response *ocsp.Response, now time.Time) time.Duration {
+	if response.NextUpdate.IsZero() {
+		return ocspDefaultRefresh
+	}
+	delay := response.NextUpdate.Sub(now) / 2
+	switch {
+	case delay < ocspMinRefresh:
+		return ocspMinRefresh
+	case delay > ocspMaxRefresh:
+		return ocspMaxRefresh
+	default:
+		return delay
+	}
+}
+
+func (s *ocspStapler) updateMetrics() {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.response == nil {
+		ocspStapleValidMetric.Set(0)
+		return
+	}
+	ocspStapleProducedMetric.Set(float64(s.response.ThisUpdate.Unix()))
+	ocspStapleNextUpdateMetric.Set(float64(s.response.NextUpdate.Unix()))
+	if s.response.NextUpdate.IsZero() || time.Now().Before(s.response.NextUpdate) {
+		ocspStapleValidMetric.Set(1)
+	} else {
+		ocspStapleValidMetric.Set(0)
+	}
+}
+
+// parseCertificateChain returns the leaf certificate and its issuer, which must follow in the chain
+func parseCertificateChain(certificate tls.Certificate) (*x509.Certificate, *x509.Certificate, error) {
+	if len(certificate.Certificate) < 2 {
+		return nil, nil, errNoOCSPIssuer
+	}
+	leaf := certificate.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return nil, nil, err
+		}
+	}
+	issuer, err := x509.ParseCertificate(certificate.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return leaf, issuer, nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// fakeOCSPResponder signs OCSP responses for the certificates issued by a test authority
+type fakeOCSPResponder struct {
+	server   *httptest.Server
+	issuer   *x509.Certificate
+	key      *ecdsa.PrivateKey
+	status   int32
+	requests int32
+}
+
+func newFakeOCSPResponder(t *testing.T) *fakeOCSPResponder {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		NotAfter:              time.Now().Add(time.Hour),
+		NotBefore:             time.Now().Add(-time.Minute),
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test authority"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	issuer, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	r := &fakeOCSPResponder{issuer: issuer, key: key, status: http.StatusOK}
+	r.server = httptest.NewServer(http.HandlerFunc(r.handle))
+	t.Cleanup(r.server.Close)
+
+	return r
+}
+
+func (r *fakeOCSPResponder) handle(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&r.requests, 1)
+	if status := atomic.LoadInt32(&r.status); status != http.StatusOK {
+		w.WriteHeader(int(status))
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	response, err := ocsp.CreateResponse(r.issuer, r.issuer, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, r.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	_, _ = w.Write(response)
+}
+
+// issue creates a certificate chain, with the issuer, advertising the responder
+func (r *fakeOCSPResponder) issue(t *testing.T, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		NotAfter:     time.Now().Add(time.Hour),
+		NotBefore:    time.Now().Add(-time.Minute),
+		OCSPServer:   []string{r.server.URL},
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, r.issuer, &key.PublicKey, r.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der, r.issuer.Raw}, PrivateKey: key}
+}
+
+func newTestOCSPStapler(certificate tls.Certificate) *ocspStapler {
+	return &ocspStapler{
+		certificate: certificate,
+		refresh:     make(chan struct{}, 1),
+		client:      http.DefaultClient,
+		log:         zap.NewNop(),
+	}
+}
+
+func TestOCSPStapler(t *testing.T) {
+	responder := newFakeOCSPResponder(t)
+	certificate := responder.issue(t, 2)
+	s := newTestOCSPStapler(certificate)
+
+	// no staple until the response is fetched
+	assert.Empty(t, s.stapled(certificate).OCSPStaple)
+
+	wait, err := s.fetch()
+	require.NoError(t, err)
+	assert.InDelta(t, float64(30*time.Minute), float64(wait), float64(time.Minute))
+	staple := s.stapled(certificate).OCSPStaple
+	require.NotEmpty(t, staple)
+	response, err := ocsp.ParseResponse(staple, responder.issuer)
+	require.NoError(t, err)
+	assert.Equal(t, ocsp.Good, response.Status)
+
+	// a rotated certificate is served without the previous staple, until the immediate fetch
+	rotated := responder.issue(t, 3)
+	s.update(rotated)
+	assert.Empty(t, s.stapled(rotated).OCSPStaple)
+	select {
+	case <-s.refresh:
+	default:
+		t.Error("expected an immediate fetch on rotation")
+	}
+
+	// the certificate is still served on fetch failures
+	atomic.StoreInt32(&responder.status, http.StatusServiceUnavailable)
+	_, err = s.fetch()
+	assert.Error(t, err)
+	assert.Empty(t, s.stapled(rotated).OCSPStaple)
+}
+
+func TestOCSPStaplerRotation(t *testing.T) {
+	responder := newFakeOCSPResponder(t)
+	c := &certificationRotation{certificate: responder.issue(t, 2), log: zap.NewNop()}
+	c.enableOCSPStapling()
+
+	assert.Eventually(t, func() bool {
+		crt, err := c.GetCertificate(nil)
+		return err == nil && len(crt.OCSPStaple) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	requests := atomic.LoadInt32(&responder.requests)
+	require.NoError(t, c.storeCertificate(responder.issue(t, 3)))
+	assert.Eventually(t, func() bool {
+		crt, err := c.GetCertificate(nil)
+		return err == nil && len(crt.OCSPStaple) > 0 && atomic.LoadInt32(&responder.requests) > requests
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestOCSPStaplerNotApplicable(t *testing.T) {
+	responder := newFakeOCSPResponder(t)
+	certificate := responder.issue(t, 2)
+
+	// the issuer is required to query the responder
+	s := newTestOCSPStapler(tls.Certificate{Certificate: certificate.Certificate[:1]})
+	_, err := s.fetch()
+	assert.Equal(t, errNoOCSPIssuer, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		NotAfter:     time.Now().Add(time.Hour),
+		SerialNumber: big.NewInt(4),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, responder.issuer, &key.PublicKey, responder.key)
+	require.NoError(t, err)
+	s = newTestOCSPStapler(tls.Certificate{Certificate: [][]byte{der, responder.issuer.Raw}})
+	_, err = s.fetch()
+	assert.Equal(t, errNoOCSPResponder, err)
+}
+
+func TestOCSPRefreshDelay(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, ocspDefaultRefresh, ocspRefreshDelay(&ocsp.Response{}, now))
+	assert.Equal(t, 2*time.Hour, ocspRefreshDelay(&ocsp.Response{NextUpdate: now.Add(4 * time.Hour)}, now))
+	assert.Equal(t, ocspMinRefresh, ocspRefreshDelay(&ocsp.Response{NextUpdate: now.Add(time.Second)}, now))
+	assert.Equal(t, ocspMaxRefresh, ocspRefreshDelay(&ocsp.Response{NextUpdate: now.Add(7 * 24 * time.Hour)}, now))
+}
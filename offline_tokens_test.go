@@ -0,0 +1,109 @@
+//go:build !noreverse && !nostores
+// +build !noreverse,!nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineTokens(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EnableServerSideSessions = true
+	cfg.EnableOfflineTokens = true
+	cfg.EnableSessionCookies = false
+	cfg.OfflineSessionDuration = 90 * 24 * time.Hour
+	cfg.EncryptionKey = testKey
+	cfg.StoreURL = "memory://"
+	p := newFakeProxy(cfg)
+	p.idp.setTokenExpiration(time.Second)
+
+	get := func(uri string, cookies map[string]*http.Cookie) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+uri, nil)
+		require.NoError(t, err)
+		for _, c := range cookies {
+			req.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+		}
+		// the redirections are followed until the callback of the login
+		client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasSuffix(via[len(via)-1].URL.Path, callbackURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		}}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		for _, c := range resp.Cookies() {
+			cookies[c.Name] = c
+		}
+		return resp
+	}
+	offlineSession := func(id string) bool {
+		value, err := p.proxy.getServerSession(id)
+		require.NoError(t, err)
+		refresh, err := decodeText(value, cfg.EncryptionKey)
+		require.NoError(t, err)
+		return isOfflineToken(refresh)
+	}
+
+	// step: a regular login keeps a regular refresh token
+	cookies := make(map[string]*http.Cookie)
+	resp := get(cfg.WithOAuthURI(authorizationURL), cookies)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	require.Contains(t, cookies, cfg.CookieRefreshName)
+	assert.False(t, offlineSession(cookies[cfg.CookieRefreshName].Value))
+
+	// step: the login asks for an offline session, which cookies last for the offline session duration
+	cookies = make(map[string]*http.Cookie)
+	resp = get(cfg.WithOAuthURI(authorizationURL)+"?offline=true", cookies)
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	require.Contains(t, cookies, cfg.CookieRefreshName)
+	require.Contains(t, cookies, cfg.CookieAccessName)
+	expires := time.Now().Add(cfg.OfflineSessionDuration)
+	assert.WithinDuration(t, expires, cookies[cfg.CookieRefreshName].Expires, time.Minute)
+	assert.WithinDuration(t, expires, cookies[cfg.CookieAccessName].Expires, time.Minute)
+	assert.True(t, offlineSession(cookies[cfg.CookieRefreshName].Value))
+
+	// step: the expired access token is refreshed with the offline token, the session is renewed
+	<-time.After(1500 * time.Millisecond)
+	login := cookies[cfg.CookieAccessName].Value
+	resp = get("/auth_all/test", cookies)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get(testProxyAccepted))
+	require.Contains(t, cookies, cfg.CookieAccessName)
+	assert.NotEqual(t, login, cookies[cfg.CookieAccessName].Value)
+	assert.WithinDuration(t, time.Now().Add(cfg.OfflineSessionDuration), cookies[cfg.CookieAccessName].Expires, time.Minute)
+	assert.True(t, offlineSession(cookies[cfg.CookieRefreshName].Value))
+
+	// step: the logout revokes the offline token
+	id := cookies[cfg.CookieRefreshName].Value
+	resp = get(cfg.WithOAuthURI(logoutURL), cookies)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&p.idp.offlineRevocations))
+	_, err := p.proxy.getServerSession(id)
+	assert.Error(t, err)
+}
@@ -0,0 +1,508 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/oneconcern/keycloak-gatekeeper/version"
+)
+
+// openAPIVersion is the version of the OpenAPI specification the documents comply with
+const openAPIVersion = "3.0.3"
+
+// openAPIDocument is an OpenAPI document, limited to the objects used to describe the endpoints of the proxy
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	Name   string `json:"name,omitempty"`
+	In     string `json:"in,omitempty"`
+}
+
+// openAPIEndpoint describes an endpoint of the proxy. The responses reference the go types written by the
+// handlers, so the document cannot drift from the code.
+type openAPIEndpoint struct {
+	method        string
+	path          string
+	summary       string
+	tag           string
+	authenticated bool
+	parameters    []openAPIParameter
+	form          []string
+	body          interface{}
+	responses     map[int]interface{}
+}
+
+// openAPIRedirect marks the responses redirecting the client, without content
+type openAPIRedirect struct{}
+
+// openAPIText marks the responses with a text content
+type openAPIText struct{}
+
+// openAPIEndpoints lists the endpoints of the proxy enabled by the configuration
+func (r *Config) openAPIEndpoints() []openAPIEndpoint {
+	query := func(name, description string, required bool) openAPIParameter {
+		return openAPIParameter{Name: name, In: "query", Description: description, Required: required, Schema: &openAPISchema{Type: "string"}}
+	}
+
+	endpoints := []openAPIEndpoint{
+		{
+			method: http.MethodGet, path: authorizationURL, tag: "oauth",
+			summary:    "Redirects the client to the authorization endpoint of the provider",
+			parameters: []openAPIParameter{query("state", "the url to return to after the login", false)},
+			responses: map[int]interface{}{
+				http.StatusTemporaryRedirect:   openAPIRedirect{},
+				http.StatusNotAcceptable:       errorMessage{},
+				http.StatusForbidden:           errorMessage{},
+				http.StatusInternalServerError: errorMessage{},
+			},
+		},
+		{
+			method: http.MethodGet, path: callbackURL, tag: "oauth",
+			summary: "Exchanges the authorization code for the tokens and redirects the client to the requested url",
+			parameters: []openAPIParameter{
+				query("code", "the authorization code", true),
+				query("state", "the state of the authorization request", false),
+			},
+			responses: map[int]interface{}{
+				http.StatusTemporaryRedirect:   openAPIRedirect{},
+				http.StatusBadRequest:          errorMessage{},
+				http.StatusForbidden:           errorMessage{},
+				http.StatusInternalServerError: errorMessage{},
+			},
+		},
+		{
+			method: http.MethodGet, path: expiredURL, tag: "oauth",
+			summary: "Checks the access token of the client has not expired",
+			responses: map[int]interface{}{
+				http.StatusOK:           nil,
+				http.StatusUnauthorized: errorMessage{},
+			},
+		},
+		{
+			method: http.MethodGet, path: logoutURL, tag: "oauth", authenticated: true,
+			summary:    "Clears the session of the client and revokes the tokens at the provider",
+			parameters: []openAPIParameter{query("redirect", "the url to redirect the client to after the logout", false)},
+			responses: map[int]interface{}{
+				http.StatusOK:                  nil,
+				http.StatusTemporaryRedirect:   openAPIRedirect{},
+				http.StatusBadRequest:          errorMessage{},
+				http.StatusInternalServerError: errorMessage{},
+			},
+		},
+		{
+			method: http.MethodGet, path: tokenURL, tag: "oauth", authenticated: true,
+			summary: "Returns the claims of the access token of the client",
+			responses: map[int]interface{}{
+				http.StatusOK:           jose.Claims{},
+				http.StatusUnauthorized: errorMessage{},
+			},
+		},
+		{
+			method: http.MethodPost, path: loginURL, tag: "oauth",
+			summary: "Exchanges the credentials of a user for the tokens, via the password grant",
+			form:    []string{"username", "password"},
+			responses: map[int]interface{}{
+				http.StatusOK:                  tokenResponse{},
+				http.StatusBadRequest:          errorMessage{},
+				http.StatusUnauthorized:        errorMessage{},
+				http.StatusNotImplemented:      errorMessage{},
+				http.StatusInternalServerError: errorMessage{},
+			},
+		},
+		{
+			method: http.MethodGet, path: healthURL, tag: "admin",
+			summary: "Reports the health of the proxy",
+			responses: map[int]interface{}{
+				http.StatusOK: healthResponse{},
+			},
+		},
+	}
+
+	if r.HealthCheckDependencies {
+		endpoints[len(endpoints)-1].summary = "Reports the health of the proxy and of its dependencies"
+		endpoints[len(endpoints)-1].responses[http.StatusServiceUnavailable] = healthResponse{}
+	}
+	if r.EnableRefreshTokens {
+		endpoints = append(endpoints, openAPIEndpoint{
+			method: http.MethodGet, path: refreshURL, tag: "oauth", authenticated: true,
+			summary: "Refreshes the access token of the client and returns its claims",
+			responses: map[int]interface{}{
+				http.StatusOK:                  jose.Claims{},
+				http.StatusUnauthorized:        errorMessage{},
+				http.StatusInternalServerError: errorMessage{},
+			},
+		})
+	}
+	if r.EnableClientTokenHandler {
+		endpoints = append(endpoints, openAPIEndpoint{
+			method: http.MethodPost, path: clientTokenURL, tag: "oauth",
+			summary: "Hands over a client credentials access token to a trusted caller",
+			responses: map[int]interface{}{
+				http.StatusOK:                  tokenResponse{},
+				http.StatusUnauthorized:        errorMessage{},
+				http.StatusTooManyRequests:     errorMessage{},
+				http.StatusInternalServerError: errorMessage{},
+			},
+		})
+	}
+	if r.EnableDeviceFlow {
+		endpoints = append(endpoints,
+			openAPIEndpoint{
+				method: http.MethodPost, path: deviceURL, tag: "oauth",
+				summary: "Starts a device authorization grant, polled by the proxy until the user authorizes it",
+				responses: map[int]interface{}{
+					http.StatusOK:              deviceAuthorization{},
+					http.StatusTooManyRequests: errorMessage{},
+					http.StatusBadGateway:      errorMessage{},
+				},
+			},
+			openAPIEndpoint{
+				method: http.MethodGet, path: deviceURL + "/{device_code}", tag: "oauth",
+				summary: "Hands over the tokens of an authorized device authorization grant, once",
+				parameters: []openAPIParameter{
+					{Name: "device_code", In: "path", Description: "the device code of the grant", Required: true, Schema: &openAPISchema{Type: "string"}},
+					query("cookie", "opens a session with cookies rather than returning the tokens", false),
+				},
+				responses: map[int]interface{}{
+					http.StatusOK:                  tokenResponse{},
+					http.StatusNoContent:           nil,
+					http.StatusBadRequest:          errorMessage{},
+					http.StatusForbidden:           errorMessage{},
+					http.StatusNotFound:            errorMessage{},
+					http.StatusInternalServerError: errorMessage{},
+				},
+			})
+	}
+	if r.EnableMetrics {
+		endpoints = append(endpoints, openAPIEndpoint{
+			method: http.MethodGet, path: metricsURL, tag: "admin",
+			summary: "Exposes the prometheus metrics of the proxy",
+			responses: map[int]interface{}{
+				http.StatusOK:        openAPIText{},
+				http.StatusForbidden: errorMessage{},
+			},
+		})
+	}
+	if r.EnableSelfTestEndpoint {
+		endpoints = append(endpoints, openAPIEndpoint{
+			method: http.MethodGet, path: selfTestURL, tag: "admin",
+			summary: "Exercises the login flow against the provider and reports the outcome of each step",
+			responses: map[int]interface{}{
+				http.StatusOK:                 selfTestReport{},
+				http.StatusServiceUnavailable: selfTestReport{},
+			},
+		})
+	}
+	if r.EnableSessionRevocation {
+		revocation := map[int]interface{}{
+			http.StatusOK:                  revokedSessions{},
+			http.StatusUnauthorized:        errorMessage{},
+			http.StatusInternalServerError: errorMessage{},
+		}
+		endpoints = append(endpoints,
+			openAPIEndpoint{
+				method: http.MethodDelete, path: sessionsURL, tag: "admin", authenticated: true,
+				summary:   "Revokes all the sessions",
+				responses: revocation,
+			},
+			openAPIEndpoint{
+				method: http.MethodDelete, path: sessionsURL + "/{subject}", tag: "admin", authenticated: true,
+				summary: "Revokes the sessions of a subject",
+				parameters: []openAPIParameter{
+					{Name: "subject", In: "path", Description: "the subject of the sessions", Required: true, Schema: &openAPISchema{Type: "string"}},
+				},
+				responses: revocation,
+			})
+	}
+	if r.EnableCaptureEndpoint {
+		capture := map[int]interface{}{
+			http.StatusOK:           captureReport{},
+			http.StatusUnauthorized: errorMessage{},
+		}
+		endpoints = append(endpoints,
+			openAPIEndpoint{
+				method: http.MethodPost, path: captureURL, tag: "admin", authenticated: true,
+				summary: "Starts a capture of the redacted headers of a sample of the requests, replacing the current one",
+				body:    captureSettings{},
+				responses: map[int]interface{}{
+					http.StatusOK:                  captureReport{},
+					http.StatusBadRequest:          errorMessage{},
+					http.StatusUnauthorized:        errorMessage{},
+					http.StatusInternalServerError: errorMessage{},
+				},
+			},
+			openAPIEndpoint{
+				method: http.MethodGet, path: captureURL, tag: "admin", authenticated: true,
+				summary:   "Returns the state of the capture and the requests it captured",
+				responses: capture,
+			},
+			openAPIEndpoint{
+				method: http.MethodDelete, path: captureURL, tag: "admin", authenticated: true,
+				summary: "Stops the capture and drops the requests it captured",
+				responses: map[int]interface{}{
+					http.StatusNoContent:    nil,
+					http.StatusUnauthorized: errorMessage{},
+				},
+			})
+	}
+	if r.EnableOpenAPIEndpoint {
+		endpoints = append(endpoints, openAPIEndpoint{
+			method: http.MethodGet, path: openAPIURL, tag: "admin",
+			summary: "Describes the endpoints of the proxy",
+			responses: map[int]interface{}{
+				http.StatusOK: openAPIDocument{},
+			},
+		})
+	}
+	if r.EnablePipelineEndpoint {
+		endpoints = append(endpoints, openAPIEndpoint{
+			method: http.MethodGet, path: pipelineURL, tag: "admin",
+			summary: "Lists in order the middlewares run by the requests of each route",
+			responses: map[int]interface{}{
+				http.StatusOK: pipelineReport{},
+			},
+		})
+	}
+
+	return endpoints
+}
+
+// generateOpenAPI generates the OpenAPI document of the endpoints enabled by the configuration
+func (r *Config) generateOpenAPI() *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:       version.Prog,
+			Description: version.Description,
+			Version:     version.GetVersion(),
+		},
+		Paths: make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas: make(map[string]*openAPISchema),
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"bearer": {Type: "http", Scheme: "bearer"},
+				"cookie": {Type: "apiKey", In: "cookie", Name: r.CookieAccessName},
+			},
+		},
+	}
+
+	for _, x := range r.openAPIEndpoints() {
+		operation := &openAPIOperation{
+			OperationID: strings.ToLower(x.method) + openAPIOperationName(x.path),
+			Summary:     x.summary,
+			Tags:        []string{x.tag},
+			Parameters:  x.parameters,
+			Responses:   make(map[string]openAPIResponse),
+		}
+		if x.authenticated {
+			operation.Security = []map[string][]string{{"bearer": {}}, {"cookie": {}}}
+		}
+		if len(x.form) > 0 {
+			form := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema), Required: x.form}
+			for _, name := range x.form {
+				form.Properties[name] = &openAPISchema{Type: "string"}
+			}
+			operation.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content:  map[string]openAPIMediaType{"application/x-www-form-urlencoded": {Schema: form}},
+			}
+		}
+		if x.body != nil {
+			operation.RequestBody = &openAPIRequestBody{
+				Required: true,
+				Content:  map[string]openAPIMediaType{jsonMime: {Schema: doc.schema(reflect.TypeOf(x.body))}},
+			}
+		}
+		for code, body := range x.responses {
+			response := openAPIResponse{Description: http.StatusText(code)}
+			switch body.(type) {
+			case nil, openAPIRedirect:
+			case openAPIText:
+				response.Content = map[string]openAPIMediaType{"text/plain": {Schema: &openAPISchema{Type: "string"}}}
+			default:
+				response.Content = map[string]openAPIMediaType{jsonMime: {Schema: doc.schema(reflect.TypeOf(body))}}
+			}
+			operation.Responses[strconv.Itoa(code)] = response
+		}
+
+		location := path.Clean(r.WithOAuthURI(x.path))
+		if doc.Paths[location] == nil {
+			doc.Paths[location] = make(map[string]*openAPIOperation)
+		}
+		doc.Paths[location][strings.ToLower(x.method)] = operation
+	}
+
+	return doc
+}
+
+// openAPIOperationName converts the path of an endpoint to an operation name, e.g. /client-token to ClientToken
+func openAPIOperationName(location string) string {
+	var name strings.Builder
+	for _, word := range strings.FieldsFunc(location, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9')
+	}) {
+		name.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+
+	return name.String()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the schema of a go type, as encoded by encoding/json. The named structs are added to the
+// components of the document and referenced.
+func (d *openAPIDocument) schema(t reflect.Type) *openAPISchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		ref := &openAPISchema{Ref: "#/components/schemas/" + t.Name()}
+		if _, found := d.Components.Schemas[t.Name()]; !found {
+			// register the name before walking the fields, for the recursive types
+			d.Components.Schemas[t.Name()] = nil
+			d.Components.Schemas[t.Name()] = d.structSchema(t)
+		}
+		return ref
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		return &openAPISchema{Type: "array", Items: d.schema(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: d.schema(t.Elem())}
+	case reflect.Struct:
+		return d.structSchema(t)
+	default:
+		// any value
+		return &openAPISchema{}
+	}
+}
+
+// structSchema returns the schema of the exported fields of a struct, named after their json tag
+func (d *openAPIDocument) structSchema(t reflect.Type) *openAPISchema {
+	schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if j := strings.Index(tag, ","); j >= 0 {
+			name, options = tag[:j], tag[j+1:]
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = d.schema(field.Type)
+		if !containsString("omitempty", strings.Split(options, ",")) {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	sort.Strings(schema.Required)
+
+	return schema
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newOpenAPIConfig() *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	cfg.EnableClientTokenHandler = true
+	cfg.EnableMetrics = true
+	cfg.EnableSelfTestEndpoint = true
+	cfg.EnableSessionRevocation = true
+	cfg.EnableOpenAPIEndpoint = true
+	cfg.EnablePipelineEndpoint = true
+	cfg.EnableDeviceFlow = true
+	cfg.EnableCaptureEndpoint = true
+	cfg.CaptureToken = "capture"
+	cfg.HealthCheckDependencies = true
+
+	return cfg
+}
+
+func TestGenerateOpenAPI(t *testing.T) {
+	doc := newOpenAPIConfig().generateOpenAPI()
+	assert.Equal(t, openAPIVersion, doc.OpenAPI)
+
+	var paths []string
+	for location := range doc.Paths {
+		paths = append(paths, location)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{
+		"/oauth/authorize", "/oauth/callback", "/oauth/capture", "/oauth/client-token", "/oauth/device",
+		"/oauth/device/{device_code}", "/oauth/expired", "/oauth/health", "/oauth/login", "/oauth/logout", "/oauth/metrics",
+		"/oauth/openapi.json", "/oauth/pipeline", "/oauth/refresh", "/oauth/self-test", "/oauth/sessions",
+		"/oauth/sessions/{subject}", "/oauth/token",
+	}, paths)
+
+	login := doc.Paths["/oauth/login"]["post"]
+	require.NotNil(t, login)
+	assert.Equal(t, "postLogin", login.OperationID)
+	assert.Equal(t, "#/components/schemas/tokenResponse", login.Responses["200"].Content[jsonMime].Schema.Ref)
+	assert.Equal(t, "#/components/schemas/errorMessage", login.Responses["401"].Content[jsonMime].Schema.Ref)
+	assert.Contains(t, login.RequestBody.Content, "application/x-www-form-urlencoded")
+	assert.NotEmpty(t, doc.Paths["/oauth/token"]["get"].Security)
+	assert.Empty(t, doc.Paths["/oauth/health"]["get"].Security)
+
+	// all the references are resolved
+	content, err := json.Marshal(doc)
+	require.NoError(t, err)
+	for _, ref := range strings.Split(string(content), `"$ref":"#/components/schemas/`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		assert.NotNil(t, doc.Components.Schemas[name], "schema: %s", name)
+	}
+
+	// the features which are not enabled are not described
+	doc = newFakeKeycloakConfig().generateOpenAPI()
+	assert.NotContains(t, doc.Paths, "/oauth/sessions")
+	assert.NotContains(t, doc.Paths, "/oauth/openapi.json")
+}
+
+func TestOpenAPISchemaMatchesTypes(t *testing.T) {
+	doc := newOpenAPIConfig().generateOpenAPI()
+
+	// the properties of the schemas are the fields encoded by the handlers
+	cs := []struct {
+		Name  string
+		Value interface{}
+	}{
+		{Name: "tokenResponse", Value: tokenResponse{RefreshToken: "refresh", Scope: "openid"}},
+		{Name: "errorMessage", Value: errorMessage{}},
+		{Name: "deviceAuthorization", Value: deviceAuthorization{VerificationURIComplete: "uri", Interval: 5}},
+		{Name: "healthResponse", Value: healthResponse{Dependencies: []dependencyHealth{{Error: "error"}}, JWKSRefreshedAt: &time.Time{},
+			JWKSAge: new(float64), DiscoveryAge: new(float64), Certificates: []certificateHealth{{Subject: "subject"}}, Warnings: []string{"warning"}}},
+		{Name: "certificateHealth", Value: certificateHealth{Subject: "subject"}},
+		{Name: "dependencyHealth", Value: dependencyHealth{Error: "error"}},
+		{Name: "revokedSessions", Value: revokedSessions{}},
+		{Name: "pipelineReport", Value: pipelineReport{}},
+		{Name: "captureSettings", Value: captureSettings{SampleRate: 0.5, MaxRequests: 10, Path: "/"}},
+		{Name: "captureReport", Value: captureReport{SampleRate: 0.5, MaxRequests: 10, Path: "/", EndsAt: &time.Time{}, ExpiresAt: &time.Time{}}},
+		{Name: "capturedRequest", Value: capturedRequest{UpstreamSeconds: 1}},
+		{Name: "pipelineRouteReport", Value: pipelineRouteReport{Resource: "resource"}},
+		{Name: "pipelineStageReport", Value: pipelineStageReport{}},
+		{Name: "selfTestReport", Value: selfTestReport{}},
+		{Name: "selfTestStep", Value: selfTestStep{Message: "message"}},
+	}
+	for _, c := range cs {
+		schema := doc.Components.Schemas[c.Name]
+		if !assert.NotNil(t, schema, "schema: %s", c.Name) {
+			continue
+		}
+		content, err := json.Marshal(c.Value)
+		require.NoError(t, err)
+		var fields map[string]interface{}
+		require.NoError(t, json.Unmarshal(content, &fields))
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+			assert.Contains(t, schema.Properties, name, "schema: %s", c.Name)
+		}
+		assert.Len(t, schema.Properties, len(names), "schema: %s", c.Name)
+	}
+
+	assert.Equal(t, []string{"access_token", "expires_in", "id_token", "token_type"}, doc.Components.Schemas["tokenResponse"].Required)
+	assert.Equal(t, "integer", doc.Components.Schemas["tokenResponse"].Properties["expires_in"].Type)
+	assert.Equal(t, "array", doc.Components.Schemas["selfTestReport"].Properties["steps"].Type)
+	assert.Equal(t, "#/components/schemas/selfTestStep", doc.Components.Schemas["selfTestReport"].Properties["steps"].Items.Ref)
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	cfg := newOpenAPIConfig()
+	px := newFakeProxy(cfg)
+	router, ok := px.proxy.router.(chi.Routes)
+	require.True(t, ok)
+
+	// the operations of the document are routed
+	for location, operations := range cfg.generateOpenAPI().Paths {
+		for method := range operations {
+			route := strings.ReplaceAll(location, "{subject}", "alice")
+			assert.True(t, router.Match(chi.NewRouteContext(), strings.ToUpper(method), route), "route: %s %s", method, location)
+		}
+	}
+
+	// the routes of the proxy are documented
+	doc := cfg.generateOpenAPI()
+	require.NoError(t, chi.Walk(router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		route = strings.ReplaceAll(route, "/*/", "/")
+		if !strings.HasPrefix(route, cfg.OAuthURI+"/") || strings.HasSuffix(route, "/*") {
+			return nil
+		}
+		assert.Contains(t, doc.Paths, route, "route: %s %s", method, route)
+		return nil
+	}))
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	cfg := newOpenAPIConfig()
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:                     cfg.WithOAuthURI(openAPIURL),
+			ExpectedCode:            http.StatusOK,
+			ExpectedContentContains: `"openapi":"3.0.3"`,
+			ExpectedHeaders:         map[string]string{"Content-Type": jsonMime},
+		},
+	})
+
+	newFakeProxy(newFakeKeycloakConfig()).RunTests(t, []fakeRequest{
+		{
+			URI:          newFakeKeycloakConfig().WithOAuthURI(openAPIURL),
+			ExpectedCode: http.StatusNotFound,
+		},
+	})
+}
+
+func TestExportOpenAPI(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "openapi.json")
+	app := newOauthProxyApp()
+	require.NoError(t, app.Run([]string{"keycloak-gatekeeper", "--" + exportOpenAPIFlag, location, "--enable-refresh-tokens"}))
+
+	content, err := os.ReadFile(location)
+	require.NoError(t, err)
+	var doc openAPIDocument
+	require.NoError(t, json.Unmarshal(content, &doc))
+	assert.Contains(t, doc.Paths, "/oauth/refresh")
+	assert.NotContains(t, doc.Paths, "/oauth/client-token")
+}
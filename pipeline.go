@@ -0,0 +1,227 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/rs/cors"
+)
+
+// The routes of the reverse proxy, each running its own stages after the global ones
+const (
+	pipelineRouteGlobal          = "global"
+	pipelineRouteOAuth           = "oauth"
+	pipelineRouteDebug           = "debug"
+	pipelineRouteProtected       = "protected"
+	pipelineRouteWhiteListed     = "white-listed"
+	pipelineRouteBlackListed     = "black-listed"
+	pipelineRouteDefaultNotFound = "default-not-found"
+	pipelineRouteDefaultOpen     = "default-open"
+	// the requests matching no resource are refused without any stage, with enable-default-deny-strict
+	pipelineRouteDefaultDenyStrict = "default-deny-strict"
+)
+
+// pipelineStage is a middleware of the request pipeline. The middleware is only built when the stage is enabled.
+type pipelineStage struct {
+	name    string
+	global  bool
+	enabled bool
+	build   func() func(http.Handler) http.Handler
+}
+
+// pipeline returns the ordered stages run by the requests of a route, outermost first: the global stages, installed
+// on the router for all the requests, then the stages of the route. This is the only place defining the order of the
+// middlewares, which must preserve the following:
+//   - the request id is set before the entrypoint, so every log line and upstream request carries it
+//   - the CORS preflights are answered before any stage of a route, in particular before the authentication
+//   - the response headers of a resource are set before any other stage of its route, so its refusals carry them
+//   - the proxy stage wraps the authentication, so the cookies set by a refresh are written before proxying
+//   - the networks of the clients are checked before the authentication, so the refused clients are not sent to login
+//   - the rate limit follows the authentication, so the callers with a session are limited by subject
+//   - the request body is capped before the proxy stage, which forwards the capped body
+//   - the identity headers sent by the clients are removed before any stage of a route, but after the capture
+//   - the identity headers are set after the admission, from the identity it has checked
+//   - the external authorization follows the admission, so the webhook only decides on the admitted requests
+func (r *oauthProxy) pipeline(route string, resource *Resource) []pipelineStage {
+	stages := []pipelineStage{
+		{name: "recoverer", enabled: true, build: func() func(http.Handler) http.Handler {
+			return middleware.Recoverer
+		}},
+		{name: "tracing", enabled: r.config.EnableTracing, build: func() func(http.Handler) http.Handler {
+			return r.proxyTracingMiddleware
+		}},
+		{name: "request-id", enabled: r.config.EnableRequestID, build: func() func(http.Handler) http.Handler {
+			r.log.Info("enabled the correlation request id middleware")
+			return r.requestIDMiddleware(r.config.RequestIDHeader)
+		}},
+		{name: "entrypoint", enabled: true, build: func() func(http.Handler) http.Handler {
+			return entrypointMiddleware
+		}},
+		{name: "forwarded", enabled: len(r.trustedProxies) > 0, build: func() func(http.Handler) http.Handler {
+			return r.forwardedMiddleware
+		}},
+		{name: "request-header-size", enabled: r.headerSizeLimit != nil, build: func() func(http.Handler) http.Handler {
+			return r.requestHeaderSizeMiddleware
+		}},
+		// the logging relies on the response writer wrapped by the entrypoint
+		{name: "logging", enabled: r.config.EnableLogging, build: func() func(http.Handler) http.Handler {
+			return r.loggingMiddleware
+		}},
+		// the capture records the status set by the stages which follow, and the headers sent by the client
+		{name: "capture", enabled: r.capture != nil, build: func() func(http.Handler) http.Handler {
+			return r.captureMiddleware
+		}},
+		// the headers which only the proxy sets are removed from the requests of all the routes, white-listed or not
+		{name: "scrub-identity-headers", enabled: true, build: func() func(http.Handler) http.Handler {
+			return r.scrubIdentityHeadersMiddleware()
+		}},
+		{name: "security", enabled: r.config.EnableSecurityFilter, build: func() func(http.Handler) http.Handler {
+			return r.securityMiddleware
+		}},
+		{name: "cors", enabled: len(r.config.CorsOrigins) > 0, build: func() func(http.Handler) http.Handler {
+			return cors.New(cors.Options{
+				AllowedOrigins:   r.config.CorsOrigins,
+				AllowedMethods:   r.config.CorsMethods,
+				AllowedHeaders:   r.config.CorsHeaders,
+				AllowCredentials: r.config.CorsCredentials,
+				ExposedHeaders:   r.config.CorsExposedHeaders,
+				MaxAge:           int(r.config.CorsMaxAge.Seconds()),
+				Debug:            r.config.Verbose,
+			}).Handler
+		}},
+		{name: "response-headers", enabled: len(r.config.ResponseHeaders) > 0, build: func() func(http.Handler) http.Handler {
+			return r.responseHeaderMiddleware(r.config.ResponseHeaders)
+		}},
+	}
+	for i := range stages {
+		stages[i].global = true
+	}
+
+	csrf := r.config.EnableCSRF
+	csrfProtect := pipelineStage{name: "csrf-protect", enabled: csrf, build: r.csrfProtectMiddleware}
+	csrfHeader := pipelineStage{name: "csrf-header", enabled: csrf, build: r.csrfHeaderMiddleware}
+	responseHeaders := pipelineStage{name: "resource-response-headers", enabled: resource != nil && len(resource.ResponseHeaders) > 0, build: func() func(http.Handler) http.Handler {
+		return r.resourceResponseHeadersMiddleware(resource)
+	}}
+	methodPolicy := pipelineStage{name: "method-policy", enabled: true, build: func() func(http.Handler) http.Handler {
+		return r.methodPolicyMiddleware(resource)
+	}}
+	proxy := pipelineStage{name: "proxy", enabled: true, build: func() func(http.Handler) http.Handler {
+		return r.proxyMiddleware(resource)
+	}}
+	requestBodySize := pipelineStage{name: "request-body-size", enabled: r.maxRequestBodySizeOf(resource) > 0, build: func() func(http.Handler) http.Handler {
+		return r.requestBodySizeMiddleware(resource)
+	}}
+	requestsPerSecond, _ := r.rateLimitOf(resource)
+	rateLimit := pipelineStage{name: "rate-limit", enabled: requestsPerSecond > 0, build: func() func(http.Handler) http.Handler {
+		return r.rateLimitMiddleware(resource)
+	}}
+	clientNetwork := pipelineStage{name: "client-network", enabled: resource != nil && resource.restrictsClients(), build: func() func(http.Handler) http.Handler {
+		return r.clientNetworkMiddleware(resource)
+	}}
+	proxyDeny := pipelineStage{name: "proxy-deny", enabled: true, build: func() func(http.Handler) http.Handler {
+		return proxyDenyMiddleware
+	}}
+	authentication := pipelineStage{name: "authentication", enabled: true, build: r.authenticationMiddleware}
+
+	switch route {
+	case pipelineRouteOAuth:
+		// the endpoints add the login flow or the authentication on their own
+		stages = append(stages,
+			proxyDeny,
+			// handles the CSRF state, but skips the check on the POST endpoints
+			pipelineStage{name: "csrf-skip", enabled: csrf, build: r.csrfSkipMiddleware},
+			csrfProtect,
+			csrfHeader)
+	case pipelineRouteDebug:
+		stages = append(stages, proxyDeny)
+	case pipelineRouteProtected:
+		stages = append(stages,
+			responseHeaders,
+			methodPolicy,
+			requestBodySize,
+			proxy,
+			clientNetwork,
+			pipelineStage{name: "websocket-token", enabled: r.config.WebSocketTokenSubprotocol != "", build: func() func(http.Handler) http.Handler {
+				return r.webSocketTokenMiddleware
+			}},
+			authentication,
+			rateLimit,
+			pipelineStage{name: "admission", enabled: true, build: func() func(http.Handler) http.Handler {
+				return r.admissionMiddleware(resource)
+			}},
+			pipelineStage{name: "external-authz", enabled: r.config.ExternalAuthzURL != "", build: func() func(http.Handler) http.Handler {
+				return r.externalAuthzMiddleware(resource)
+			}},
+			pipelineStage{name: "identity-headers", enabled: true, build: func() func(http.Handler) http.Handler {
+				return r.identityHeadersMiddleware(r.config.AddClaims)
+			}},
+			pipelineStage{name: "token-exchange", enabled: r.config.EnableTokenExchange && resource.ExchangeAudience != "", build: func() func(http.Handler) http.Handler {
+				return r.tokenExchangeMiddleware(resource)
+			}},
+			pipelineStage{name: "csrf-skip-resource", enabled: csrf, build: func() func(http.Handler) http.Handler {
+				return r.csrfSkipResourceMiddleware(resource)
+			}},
+			csrfProtect,
+			csrfHeader)
+	case pipelineRouteWhiteListed:
+		stages = append(stages, responseHeaders, methodPolicy, requestBodySize, proxy, clientNetwork)
+	case pipelineRouteBlackListed:
+		stages = append(stages, responseHeaders)
+	case pipelineRouteDefaultOpen:
+		// the white-listed resources are never rate limited, unlike the routes open by default
+		stages = append(stages, methodPolicy, requestBodySize, proxy, clientNetwork, rateLimit)
+	case pipelineRouteDefaultNotFound:
+		// the routes which are not declared are only authenticated when denied by default
+		authentication.enabled = r.config.EnableDefaultDeny
+		stages = append(stages, authentication)
+	}
+
+	return stages
+}
+
+// buildPipeline builds the middlewares of the enabled stages, either the global ones or the ones of the route
+func buildPipeline(stages []pipelineStage, global bool) []func(http.Handler) http.Handler {
+	var middlewares []func(http.Handler) http.Handler
+	for _, x := range stages {
+		if x.global == global && x.enabled {
+			middlewares = append(middlewares, x.build())
+		}
+	}
+
+	return middlewares
+}
+
+// routeMiddlewares builds the middlewares of a route, recording its stages for the pipeline endpoint
+func (r *oauthProxy) routeMiddlewares(route string, resource *Resource) []func(http.Handler) http.Handler {
+	stages := r.pipeline(route, resource)
+
+	report := pipelineRouteReport{Route: route, Stages: make([]pipelineStageReport, 0, len(stages))}
+	if resource != nil {
+		report.Resource = resource.String()
+	}
+	for _, x := range stages {
+		report.Stages = append(report.Stages, pipelineStageReport{Name: x.name, Global: x.global, Enabled: x.enabled})
+	}
+	r.pipelineRoutes = append(r.pipelineRoutes, report)
+
+	return buildPipeline(stages, false)
+}
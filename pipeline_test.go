@@ -0,0 +1,200 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	resty "gopkg.in/resty.v1"
+)
+
+// newPipelineConfig enables the features adding stages to the pipeline
+func newPipelineConfig() *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRequestID = true
+	cfg.EnableLogging = true
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	cfg.CorsOrigins = []string{"*"}
+	cfg.CorsMethods = []string{http.MethodGet, http.MethodPost}
+	cfg.ResponseHeaders = map[string]string{"X-Pipeline": "true"}
+	cfg.WebSocketTokenSubprotocol = "bearer"
+
+	return cfg
+}
+
+// stageIndex returns the position of a stage in the pipeline, or -1
+func stageIndex(stages []pipelineStage, name string) int {
+	for i, x := range stages {
+		if x.name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func TestPipelineOrder(t *testing.T) {
+	cfg := newPipelineConfig()
+	cfg.EnableTracing = true
+	cfg.EnableSecurityFilter = true
+	cfg.EnableCSRF = true
+	cfg.EnableTokenExchange = true
+	cfg.ExternalAuthzURL = "http://127.0.0.1:8181/v1/data/gatekeeper"
+	p := &oauthProxy{config: cfg, log: zap.NewNop(), capture: newRequestCapture(10)}
+	maxBodySize := 1 << 20
+	resource := &Resource{
+		URL: "/api*", Methods: allHTTPMethods, ExchangeAudience: "api", MaxRequestBodySize: &maxBodySize,
+		AllowedCIDRs: []string{"10.0.0.0/8"}, RateLimit: &RateLimit{RequestsPerSecond: 10},
+		ResponseHeaders: map[string]string{"Cache-Control": "no-store"},
+	}
+
+	routes := []string{pipelineRouteOAuth, pipelineRouteDebug, pipelineRouteProtected, pipelineRouteWhiteListed,
+		pipelineRouteBlackListed, pipelineRouteDefaultNotFound, pipelineRouteDefaultOpen}
+	for _, route := range routes {
+		stages := p.pipeline(route, resource)
+		names := make(map[string]bool, len(stages))
+		global := true
+		for _, x := range stages {
+			assert.False(t, names[x.name], "route %s: the stage %s is repeated", route, x.name)
+			names[x.name] = true
+			// the global stages all run before the stages of the route
+			assert.False(t, x.global && !global, "route %s: the global stage %s follows a stage of the route", route, x.name)
+			global = x.global
+		}
+		assert.True(t, stageIndex(stages, "request-id") < stageIndex(stages, "entrypoint"), "route %s", route)
+		assert.True(t, stageIndex(stages, "entrypoint") < stageIndex(stages, "logging"), "route %s", route)
+		assert.True(t, stageIndex(stages, "cors") < stageIndex(stages, "response-headers"), "route %s", route)
+		assert.True(t, stageIndex(stages, "capture") < stageIndex(stages, "scrub-identity-headers"), "route %s", route)
+	}
+
+	stages := p.pipeline(pipelineRouteProtected, resource)
+	order := []string{"cors", "resource-response-headers", "method-policy", "request-body-size", "proxy", "client-network", "websocket-token", "authentication", "rate-limit", "admission",
+		"external-authz", "identity-headers", "token-exchange", "csrf-protect"}
+	for i := 1; i < len(order); i++ {
+		assert.True(t, stageIndex(stages, order[i-1]) < stageIndex(stages, order[i]), "%s runs before %s", order[i-1], order[i])
+	}
+	for _, x := range stages {
+		assert.True(t, x.enabled, "stage %s", x.name)
+	}
+
+	// the stages of the disabled features are listed, but not built
+	p = &oauthProxy{config: newFakeKeycloakConfig(), log: zap.NewNop()}
+	stages = p.pipeline(pipelineRouteProtected, resource)
+	assert.Len(t, stages, 27)
+	for _, name := range []string{"request-id", "cors", "websocket-token", "token-exchange", "csrf-protect"} {
+		require.NotEqual(t, -1, stageIndex(stages, name), name)
+		assert.False(t, stages[stageIndex(stages, name)].enabled, name)
+	}
+	assert.Len(t, buildPipeline(stages, true), 3, "only the recoverer, the entrypoint and the scrubbing are global by default")
+}
+
+func TestPipelineInvariants(t *testing.T) {
+	cfg := newPipelineConfig()
+	fn := func(no int, req *resty.Request, resp *resty.Response) {
+		if no == 0 {
+			<-time.After(1000 * time.Millisecond)
+		}
+	}
+	p := newFakeProxy(cfg)
+	p.idp.setTokenExpiration(1000 * time.Millisecond)
+
+	requests := []fakeRequest{
+		{ // the request id reaches the upstream of the white-listed resources
+			URI:                  "/auth_all/white_listed/test",
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"X-Request-ID": ""},
+		},
+		{ // the CORS preflights are answered before the authentication
+			URI:    testAdminURI,
+			Method: http.MethodOptions,
+			Headers: map[string]string{
+				"Origin":                        "127.0.0.1",
+				"Access-Control-Request-Method": http.MethodGet,
+			},
+			ExpectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": http.MethodGet,
+				"Location":                     "",
+			},
+		},
+		{ // the request id reaches the upstream of the protected resources
+			URI:                  fakeAuthAllURL,
+			HasLogin:             true,
+			Redirects:            true,
+			OnResponse:           fn,
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{"X-Request-ID": ""},
+		},
+		{ // the cookies of the refreshed session are set, before the response of the upstream
+			URI:                  fakeAuthAllURL,
+			ExpectedProxy:        true,
+			ExpectedCode:         http.StatusOK,
+			ExpectedCookies:      map[string]string{cfg.CookieAccessName: ""},
+			ExpectedHeaders:      map[string]string{"X-Pipeline": "true"},
+			ExpectedProxyHeaders: map[string]string{"X-Request-ID": ""},
+		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestPipelineHandler(t *testing.T) {
+	cfg := newPipelineConfig()
+	cfg.EnablePipelineEndpoint = true
+	p := newFakeProxy(cfg)
+
+	resp, err := http.Get(p.getServiceURL() + cfg.WithOAuthURI(pipelineURL))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var report pipelineReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+
+	routes := make(map[string]pipelineRouteReport, len(report.Routes))
+	for _, x := range report.Routes {
+		routes[x.Route+" "+x.Resource] = x
+	}
+	require.Contains(t, routes, pipelineRouteOAuth+" ")
+	var resource *Resource
+	for _, x := range p.proxy.config.Resources {
+		if x.URL == fakeAdminRoleURL {
+			resource = x
+		}
+	}
+	require.NotNil(t, resource)
+	protected, found := routes[pipelineRouteProtected+" "+resource.String()]
+	require.True(t, found)
+
+	// the report lists the stages of the pipeline, in order
+	stages := p.proxy.pipeline(pipelineRouteProtected, resource)
+	require.Len(t, protected.Stages, len(stages))
+	for i, x := range stages {
+		assert.Equal(t, pipelineStageReport{Name: x.name, Global: x.global, Enabled: x.enabled}, protected.Stages[i])
+	}
+	assert.True(t, protected.Stages[stageIndex(stages, "request-id")].Enabled)
+	assert.False(t, protected.Stages[stageIndex(stages, "tracing")].Enabled)
+}
@@ -0,0 +1,128 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// rateLimitPrefix namespaces the buckets of the rate limits shared by the replicas in the store
+	rateLimitPrefix = "ratelimit."
+	// sharedRateLimitLeaseDuration is the lifetime of the tokens taken in advance by a replica
+	sharedRateLimitLeaseDuration = 5 * time.Second
+	// sharedRateLimitBatchRatio is the fraction of the limit taken at once while a caller is far under its limit
+	sharedRateLimitBatchRatio = 10
+	// sharedRateLimitLogInterval is the minimum interval between two logs about the unavailable store
+	sharedRateLimitLogInterval = 10 * time.Second
+)
+
+// rateLimitLease holds the tokens a replica took in advance for a caller
+type rateLimitLease struct {
+	tokens  int
+	expires time.Time
+}
+
+// sharedRateLimit is a token bucket per caller held in the store, so the limit holds across the replicas. While a
+// caller is far under its limit, a replica takes a batch of tokens at once and spends them locally, to avoid a round
+// trip to the store on every request: the tokens it does not spend within the lease are lost, so the limit is never
+// exceeded, but a caller may be refused slightly before it.
+type sharedRateLimit struct {
+	// name identifies the limit in the keys of the store and in the metrics
+	name   string
+	store  rateLimitingStorage
+	limit  int
+	window time.Duration
+	// batch is the number of tokens taken at once
+	batch int
+	log   *zap.Logger
+	// failures logs the unavailability of the store at most once per interval
+	failures rateLimitedLog
+
+	sync.Mutex
+	leases map[string]rateLimitLease
+}
+
+func newSharedRateLimit(name string, store rateLimitingStorage, limit int, window time.Duration, log *zap.Logger) *sharedRateLimit {
+	batch := limit / sharedRateLimitBatchRatio
+	if batch < 1 {
+		batch = 1
+	}
+
+	return &sharedRateLimit{
+		name:   name,
+		store:  store,
+		limit:  limit,
+		window: window,
+		batch:  batch,
+		log:    log,
+		leases: make(map[string]rateLimitLease),
+	}
+}
+
+// spendLease spends a token taken in advance for the caller, if any
+func (l *sharedRateLimit) spendLease(caller string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	lease, found := l.leases[caller]
+	if !found || lease.tokens <= 0 || time.Now().After(lease.expires) {
+		delete(l.leases, caller)
+		return false
+	}
+	lease.tokens--
+	l.leases[caller] = lease
+
+	return true
+}
+
+// allow tells if the caller has not exceeded its rate limit across the replicas. When the store is unavailable, the
+// caller is limited by the local limiter of the replica instead.
+func (l *sharedRateLimit) allow(caller string, local func(string) bool) bool {
+	if l.spendLease(caller) {
+		return true
+	}
+
+	taken, err := l.store.takeTokens(rateLimitPrefix+l.name+"."+caller, l.limit, l.batch, l.window)
+	if err != nil {
+		// @metric the store sharing the rate limit is unavailable
+		rateLimitFallbacksMetric.WithLabelValues(l.name).Inc()
+		if allowed, suppressed := l.failures.allow(sharedRateLimitLogInterval); allowed {
+			l.log.Warn("unable to reach the store sharing the rate limit, limiting the callers per replica",
+				zap.String("limit", l.name),
+				zap.Uint64("suppressed", suppressed),
+				zap.Error(err))
+		}
+
+		return local(caller)
+	}
+	if taken == 0 {
+		return false
+	}
+	if taken > 1 {
+		l.Lock()
+		l.leases[caller] = rateLimitLease{tokens: taken - 1, expires: time.Now().Add(sharedRateLimitLeaseDuration)}
+		l.Unlock()
+	}
+
+	return true
+}
@@ -0,0 +1,120 @@
+//go:build !noreverse && !nostores
+// +build !noreverse,!nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestSharedRateLimit creates the rate limit of a replica, with its own connection to the store
+func newTestSharedRateLimit(t *testing.T, location string, limit int) *sharedRateLimit {
+	store, err := createStorage(location, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.Close() })
+	limiting, ok := sharedRateLimitStore(newEncryptedStore(store, testKey, zap.NewNop()))
+	require.True(t, ok)
+
+	return newSharedRateLimit("test", limiting, limit, time.Minute, zap.NewNop())
+}
+
+func TestSharedRateLimitStore(t *testing.T) {
+	store, err := createStorage("memory://", nil)
+	require.NoError(t, err)
+	_, ok := sharedRateLimitStore(store)
+	assert.False(t, ok, "the memory store is not shared by the replicas")
+}
+
+func TestSharedRateLimitReplicas(t *testing.T) {
+	const limit = 60
+	master := newFakeRedisServer(t)
+	replicas := make([]*sharedRateLimit, 3)
+	for i := range replicas {
+		replicas[i] = newTestSharedRateLimit(t, "redis://"+master.addr(), limit)
+	}
+	local := func(string) bool {
+		t.Error("the local limiter must not be used while the store is available")
+		return false
+	}
+
+	// step: the callers hammer all the replicas concurrently
+	var allowed, requests int32
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, replica := range replicas {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(replica *sharedRateLimit) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					atomic.AddInt32(&requests, 1)
+					if replica.allow("caller", local) {
+						atomic.AddInt32(&allowed, 1)
+					}
+				}
+			}(replica)
+		}
+	}
+	wg.Wait()
+
+	// the limit holds across the replicas, give or take the tokens refilled during the test and the leases left
+	refilled := int32(time.Since(start)*limit/time.Minute) + 1
+	assert.LessOrEqual(t, atomic.LoadInt32(&allowed), limit+refilled)
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&allowed), int32(limit-len(replicas)*replicas[0].batch))
+	// the callers far under the limit do not reach the store on every request
+	assert.Less(t, master.evalCount(), int(atomic.LoadInt32(&requests)))
+
+	// the other callers have their own limit
+	assert.True(t, replicas[0].allow("other", local))
+}
+
+func TestSharedRateLimitLease(t *testing.T) {
+	master := newFakeRedisServer(t)
+	replica := newTestSharedRateLimit(t, "redis://"+master.addr(), 60)
+	require.Equal(t, 6, replica.batch)
+
+	// step: far under the limit, the tokens are taken by batches
+	for i := 0; i < 12; i++ {
+		assert.True(t, replica.allow("caller", nil))
+	}
+	assert.Equal(t, 2, master.evalCount())
+
+	// step: the expired leases are not spent
+	replica.Lock()
+	replica.leases["caller"] = rateLimitLease{tokens: 100, expires: time.Now().Add(-time.Second)}
+	replica.Unlock()
+	assert.True(t, replica.allow("caller", nil))
+	assert.Equal(t, 3, master.evalCount())
+}
+
+func TestSharedRateLimitFallback(t *testing.T) {
+	// the store cannot be reached: the callers are limited by each replica
+	issuer := newClientTokenIssuer(2)
+	issuer.shared = newTestSharedRateLimit(t, "redis://127.0.0.1:1", 2)
+	assert.True(t, issuer.allow("caller"))
+	assert.True(t, issuer.allow("caller"))
+	assert.False(t, issuer.allow("caller"))
+	assert.True(t, issuer.allow("other"))
+}
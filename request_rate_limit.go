@@ -0,0 +1,181 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Keys of the request rate limit: the subject of the session, else the client ip
+const (
+	rateLimitKeySubject = "subject"
+	rateLimitKeyIP      = "ip"
+)
+
+const (
+	// requestRateLimitMaxBuckets bounds the callers of a rate limit, the least recently seen being forgotten
+	requestRateLimitMaxBuckets = 10000
+	// requestRateLimitLogInterval is the minimum interval between two logs about the refused requests
+	requestRateLimitLogInterval = 10 * time.Second
+)
+
+// requestRateLimit is a token bucket per caller, refilled at the rate of the limit up to its burst. The buckets are
+// held in a lru list, so the memory stays flat whatever the number of callers: a forgotten caller gets a full bucket.
+type requestRateLimit struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+	// refusals logs the refused requests at most once per interval
+	refusals rateLimitedLog
+
+	sync.Mutex
+	// buckets indexes the elements of the lru list by caller
+	buckets map[string]*list.Element
+	// lru holds the buckets, the most recently used first
+	lru        *list.List
+	maxBuckets int
+}
+
+type tokenBucket struct {
+	caller  string
+	tokens  float64
+	updated time.Time
+}
+
+// newRequestRateLimit returns a rate limit, or nil when there is no limit
+func newRequestRateLimit(requestsPerSecond, burst int, now func() time.Time) *requestRateLimit {
+	if requestsPerSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = requestsPerSecond
+	}
+
+	return &requestRateLimit{
+		rate:       float64(requestsPerSecond),
+		burst:      float64(burst),
+		now:        now,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxBuckets: requestRateLimitMaxBuckets,
+	}
+}
+
+// take takes a token from the bucket of a caller, or returns the delay until the bucket holds a token again
+func (l *requestRateLimit) take(caller string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	e, found := l.buckets[caller]
+	if !found {
+		e = l.lru.PushFront(&tokenBucket{caller: caller, tokens: l.burst, updated: now})
+		l.buckets[caller] = e
+		for l.lru.Len() > l.maxBuckets {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).caller)
+		}
+	}
+	l.lru.MoveToFront(e)
+
+	bucket := e.Value.(*tokenBucket)
+	if elapsed := now.Sub(bucket.updated); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed.Seconds()*l.rate)
+	}
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimitOf returns the rate limit of the requests to a resource: its own rate limit, else the global one
+func (r *oauthProxy) rateLimitOf(resource *Resource) (int, int) {
+	if resource != nil && resource.RateLimit != nil {
+		return resource.RateLimit.RequestsPerSecond, resource.RateLimit.Burst
+	}
+
+	return r.config.RateLimitRequestsPerSecond, r.config.RateLimitBurst
+}
+
+// rateLimitMiddleware refuses with a 429 the requests of the callers exceeding the rate limit of a resource, keyed by
+// the subject of their session, else by their client ip
+func (r *oauthProxy) rateLimitMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	limit := r.requestRateLimit
+	if resource != nil && resource.RateLimit != nil {
+		limit = newRequestRateLimit(resource.RateLimit.RequestsPerSecond, resource.RateLimit.Burst, r.now)
+	} else if limit == nil {
+		// the global rate limit is shared by the routes
+		limit = newRequestRateLimit(r.config.RateLimitRequestsPerSecond, r.config.RateLimitBurst, r.now)
+		r.requestRateLimit = limit
+	}
+	route := allRoutes
+	if resource != nil {
+		route = resource.route()
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			if scope.AccessDenied {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			key, caller := rateLimitKeyIP, r.clientIP(req).String()
+			if scope.Identity != nil {
+				key, caller = rateLimitKeySubject, scope.Identity.id
+			}
+			allowed, wait := limit.take(key + ":" + caller)
+			if allowed {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			// @metric the requests refused by the rate limit
+			rateLimitedRequestsMetric.WithLabelValues(key).Inc()
+			if log, suppressed := limit.refusals.allow(requestRateLimitLogInterval); log {
+				_, logger := r.traceSpanRequest(req)
+				logger.Warn("request rate limit exceeded",
+					zap.String("key", key),
+					zap.String("caller", caller),
+					zap.String("resource", route),
+					zap.Uint64("suppressed", suppressed))
+			}
+
+			// the refused requests are neither admitted nor proxied
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			errorResponse(w, "request rate limit exceeded", http.StatusTooManyRequests)
+			_ = r.revokeProxy(w, req)
+		})
+	}
+}
@@ -0,0 +1,148 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestRateLimit(t *testing.T) {
+	assert.Nil(t, newRequestRateLimit(0, 10, time.Now))
+
+	clock := newFakeClock()
+	limit := newRequestRateLimit(2, 4, clock.Now)
+	for i := 0; i < 4; i++ {
+		allowed, _ := limit.take("subject:alice")
+		assert.True(t, allowed, "request %d of the burst", i)
+	}
+	allowed, wait := limit.take("subject:alice")
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// the buckets are per caller
+	allowed, _ = limit.take("subject:bob")
+	assert.True(t, allowed)
+
+	// the bucket is refilled at the rate of the limit, up to the burst
+	clock.advance(250 * time.Millisecond)
+	allowed, wait = limit.take("subject:alice")
+	assert.False(t, allowed)
+	assert.Equal(t, 250*time.Millisecond, wait)
+	clock.advance(250 * time.Millisecond)
+	allowed, _ = limit.take("subject:alice")
+	assert.True(t, allowed)
+	clock.advance(time.Hour)
+	for i := 0; i < 4; i++ {
+		allowed, _ = limit.take("subject:alice")
+		assert.True(t, allowed, "request %d of the burst", i)
+	}
+	allowed, _ = limit.take("subject:alice")
+	assert.False(t, allowed)
+
+	// the burst defaults to the requests per second
+	limit = newRequestRateLimit(3, 0, clock.Now)
+	for i := 0; i < 3; i++ {
+		allowed, _ = limit.take("ip:192.0.2.43")
+		assert.True(t, allowed)
+	}
+	allowed, _ = limit.take("ip:192.0.2.43")
+	assert.False(t, allowed)
+}
+
+func TestRequestRateLimitBuckets(t *testing.T) {
+	clock := newFakeClock()
+	limit := newRequestRateLimit(1, 1, clock.Now)
+	limit.maxBuckets = 10
+
+	allowed, _ := limit.take("ip:192.0.2.1")
+	assert.True(t, allowed)
+	for i := 0; i < 100; i++ {
+		limit.take(fmt.Sprintf("ip:198.51.100.%d", i))
+		assert.LessOrEqual(t, limit.lru.Len(), 10)
+		assert.Equal(t, limit.lru.Len(), len(limit.buckets))
+	}
+
+	// the least recently seen caller has been forgotten, with its empty bucket
+	_, found := limit.buckets["ip:192.0.2.1"]
+	assert.False(t, found)
+	allowed, _ = limit.take("ip:192.0.2.1")
+	assert.True(t, allowed)
+	allowed, _ = limit.take("ip:198.51.100.99")
+	assert.False(t, allowed)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.RateLimitRequestsPerSecond = 1
+	cfg.RateLimitBurst = 2
+	cfg.Resources = append(cfg.Resources, &Resource{
+		URL:       "/reports/*",
+		Methods:   allHTTPMethods,
+		RateLimit: &RateLimit{RequestsPerSecond: 1, Burst: 3},
+	})
+	other := jose.Claims{"sub": "other-subject"}
+	refused := testutil.ToFloat64(rateLimitedRequestsMetric.WithLabelValues(rateLimitKeySubject))
+
+	requests := []fakeRequest{
+		{URI: "/auth_all/test", HasToken: true, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/auth_all/test", HasToken: true, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{
+			URI:             "/auth_all/test",
+			HasToken:        true,
+			ExpectedCode:    http.StatusTooManyRequests,
+			ExpectedHeaders: map[string]string{"Retry-After": "1"},
+		},
+		// the limit is per subject
+		{URI: "/auth_all/test", HasToken: true, TokenClaims: other, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		// the white-listed resources are never rate limited
+		{URI: "/auth_all/white_listed/test", ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/auth_all/white_listed/test", ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/auth_all/white_listed/test", ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		// the rate limit of a resource takes precedence over the global one
+		{URI: "/reports/1", HasToken: true, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/reports/2", HasToken: true, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/reports/3", HasToken: true, ExpectedProxy: true, ExpectedCode: http.StatusOK},
+		{URI: "/reports/4", HasToken: true, ExpectedCode: http.StatusTooManyRequests},
+	}
+	p := newFakeProxy(cfg)
+	// the clock is stopped, so the buckets are not refilled between the requests
+	p.proxy.clock = &fakeClock{now: time.Now()}
+	p.RunTests(t, requests)
+	assert.Equal(t, refused+2, testutil.ToFloat64(rateLimitedRequestsMetric.WithLabelValues(rateLimitKeySubject)))
+}
+
+func TestRateLimitValid(t *testing.T) {
+	require.NoError(t, (&Resource{URL: "/api/*", RateLimit: &RateLimit{RequestsPerSecond: 10, Burst: 20}}).valid())
+	assert.Error(t, (&Resource{URL: "/api/*", RateLimit: &RateLimit{RequestsPerSecond: -1}}).valid())
+	assert.Error(t, (&Resource{URL: "/public/*", WhiteListed: true, RateLimit: &RateLimit{RequestsPerSecond: 10}}).valid())
+
+	resource, err := newResource().parse("uri=/api/*|rate-limit-requests-per-second=10|rate-limit-burst=20")
+	require.NoError(t, err)
+	assert.Equal(t, &RateLimit{RequestsPerSecond: 10, Burst: 20}, resource.RateLimit)
+	_, err = newResource().parse("uri=/api/*|rate-limit-burst=many")
+	assert.Error(t, err)
+}
@@ -0,0 +1,61 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// requestURIDuration is the time left to the user to log in, before the uri requested is forgotten
+const requestURIDuration = 10 * time.Minute
+
+// keepsRequestURI tells if the uris requested before the logins are kept in the store
+func (r *oauthProxy) keepsRequestURI() bool {
+	return r.config.EnableRequestURIStore && r.useStore()
+}
+
+// keepRequestURI keeps the uri of a request interrupted by the login in the store: neither the cookies nor the
+// provider see it, the state of the authorization being its handle
+func (r *oauthProxy) keepRequestURI(state string, req *http.Request) {
+	if err := r.setRequestURI(state, req.URL.RequestURI(), requestURIDuration); err != nil {
+		r.log.Warn("unable to keep the uri requested before the login, the user lands on the default page", zap.Error(err))
+	}
+}
+
+// takeRequestURI returns the uri requested before the login of the state, which is forgotten once redirected to.
+// The default page is returned when it has expired, or when the state is not the one of the browser.
+func (r *oauthProxy) takeRequestURI(req *http.Request, state string, logger Logger) string {
+	if !r.isLoginState(req, state) {
+		logger.Info("the state of the login is not the one of the browser, redirecting to the default page")
+		return "/"
+	}
+	uri, err := r.getRequestURI(state)
+	if err != nil {
+		logger.Info("the uri requested before the login is missing or has expired, redirecting to the default page")
+		return "/"
+	}
+	if err := r.deleteRequestURI(state); err != nil {
+		logger.Warn("unable to remove the uri requested before the login from the store", zap.Error(err))
+	}
+
+	return uri
+}
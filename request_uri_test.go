@@ -0,0 +1,104 @@
+//go:build !noreverse && !nostores
+// +build !noreverse,!nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newRequestURIProxy(t *testing.T) (*fakeProxy, *[]string) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRequestURIStore = true
+	cfg.EncryptionKey = testKey
+	cfg.StoreURL = "memory://"
+	p := newFakeProxy(cfg)
+	t.Cleanup(func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	})
+	var landed []string
+	p.proxy.upstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		landed = append(landed, req.URL.RequestURI())
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return p, &landed
+}
+
+func TestRequestURIStore(t *testing.T) {
+	p, landed := newRequestURIProxy(t)
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	var locations []string
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			locations = append(locations, req.URL.String())
+			return nil
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.getServiceURL()+"/auth_all/orders?customer=42", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/html")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"/auth_all/orders?customer=42"}, *landed)
+
+	// the uri is seen neither by the provider, nor in the cookies
+	require.NotEmpty(t, locations)
+	for _, location := range locations[:len(locations)-1] {
+		assert.NotContains(t, location, "customer", location)
+	}
+	service, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+	for _, cookie := range jar.Cookies(service) {
+		assert.NotContains(t, cookie.Value, "customer", cookie.Name)
+	}
+}
+
+func TestTakeRequestURI(t *testing.T) {
+	p, _ := newRequestURIProxy(t)
+	logger := zap.NewNop()
+	withState := func(state string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/callback", nil)
+		req.AddCookie(&http.Cookie{Name: requestStateCookie, Value: state + "|nonce"})
+		return req
+	}
+	require.NoError(t, p.proxy.setRequestURI("state", "/orders?customer=42", requestURIDuration))
+	assert.True(t, strings.HasPrefix(requestURIKey("state"), requestURIPrefix))
+	assert.NotContains(t, requestURIKey("state"), "state", "only the hash of the handle is kept")
+
+	// the state must be the one of the browser
+	assert.Equal(t, "/", p.proxy.takeRequestURI(withState("other"), "state", logger))
+	// the uri is only redirected to once
+	assert.Equal(t, "/orders?customer=42", p.proxy.takeRequestURI(withState("state"), "state", logger))
+	assert.Equal(t, "/", p.proxy.takeRequestURI(withState("state"), "state", logger))
+}
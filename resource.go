@@ -18,7 +18,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -29,8 +33,19 @@ type Resource struct {
 	URL string `json:"uri" yaml:"uri"`
 	// Several URLs sharing the same config: expanded as as many resources
 	URLs []string `json:"uris" yaml:"uris"`
+	// URLRegex is a regular expression matching the whole path of the requests, in place of the uri: the resources
+	// with a uri take precedence, except the catch-all one, then the regexes in the order of the resources
+	URLRegex string `json:"url-regex" yaml:"url-regex"`
+	// Headers are conditions on the request headers, by name: an exact value or a glob. The resources of a uri are
+	// told apart by their conditions, the first one matching the request winning
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	// ResponseHeaders are set on the responses to the requests of the resource, over those of the upstream and the
+	// global response-headers
+	ResponseHeaders map[string]string `json:"response-headers" yaml:"response-headers"`
 	// Methods the method type
 	Methods []string `json:"methods" yaml:"methods"`
+	// AllowedMethods overrides the global list of methods proxied to the upstream for this resource
+	AllowedMethods []string `json:"allowed-methods" yaml:"allowed-methods"`
 	// WhiteListed permits the prefix through
 	WhiteListed bool `json:"white-listed" yaml:"white-listed"`
 	// BlackListed denies the prefix through
@@ -39,16 +54,77 @@ type Resource struct {
 	RequireAnyRole bool `json:"require-any-role" yaml:"require-any-role"`
 	// Roles the roles required to access this url
 	Roles []string `json:"roles" yaml:"roles"`
+	// MethodRoles are the roles required by some methods, in place of the roles of the resource, by method
+	MethodRoles map[string][]string `json:"method-roles" yaml:"method-roles"`
 	// Groups is a list of groups the user is in
 	Groups []string `json:"groups" yaml:"groups"`
+	// Expression is an expression, in a subset of the common expression language, the request must meet once its
+	// roles and groups are checked, e.g. 'admin' in user.roles || request.method == 'GET'
+	Expression string `json:"expression" yaml:"expression"`
+	// ACR is the authentication context class the session must have been authenticated with, e.g. a level of
+	// assurance reached with a second factor: the browsers are sent back to the provider to step up
+	ACR string `json:"acr" yaml:"acr"`
+	// AllowedCIDRs are the networks, ips or cidrs, of the clients allowed to access the resource: any client when empty
+	AllowedCIDRs []string `json:"allowed-cidrs" yaml:"allowed-cidrs"`
+	// DeniedCIDRs are the networks of the clients refused the access to the resource, even when allowed
+	DeniedCIDRs []string `json:"denied-cidrs" yaml:"denied-cidrs"`
 	// EnableCSRF enables CSRF check on this upstream Resource
 	EnableCSRF bool `json:"enable-csrf" yaml:"enable-csrf"`
 	// StripBasePath is the prefix to strip from URL before sending upstream
 	StripBasePath string `json:"strip-basepath" yaml:"strip-basepath"`
+	// ExchangeAudience is the audience of the token exchanged for the access token before it is forwarded upstream
+	ExchangeAudience string `json:"exchange-audience" yaml:"exchange-audience"`
+	// UMAResource is the resource of the authorization services of keycloak the permissions are checked against
+	UMAResource string `json:"uma-resource" yaml:"uma-resource"`
+	// UMAScopes are the scopes of the uma resource required to access this resource
+	UMAScopes []string `json:"uma-scopes" yaml:"uma-scopes"`
 	// Upstream is the upstream endpoint i.e whom were proxying to
 	Upstream string `json:"upstream-url" yaml:"upstream-url" usage:"url for the upstream endpoint you wish to proxy this resource"`
-	// TODO: UpstreamCA is the path to a CA certificate in PEM format to validate the upstream certificate
-	// UpstreamCA string `json:"upstream-ca" yaml:"upstream-ca" usage:"the path to a file container a CA certificate to validate the upstream tls endpoint for this resource"`
+	// UpstreamTLS are the tls settings of the upstream of this resource, in place of the global upstream tls settings
+	UpstreamTLS *UpstreamTLS `json:"upstream-tls" yaml:"upstream-tls"`
+	// RateLimit is the rate limit of the requests to this resource, in place of the global rate limit
+	RateLimit *RateLimit `json:"rate-limit" yaml:"rate-limit"`
+	// MaxRequestBodySize is the maximum size of the request bodies to this resource, in place of the global limit (0
+	// for no limit)
+	MaxRequestBodySize *int `json:"max-request-body-size" yaml:"max-request-body-size"`
+
+	// the url regex, the header conditions, the networks of the clients and the expression, compiled when the
+	// resource is validated
+	regex      *regexp.Regexp
+	headers    []headerCondition
+	allowed    []*net.IPNet
+	denied     []*net.IPNet
+	expression *accessExpression
+}
+
+// RateLimit is the rate of the requests allowed per user, or per client ip for the requests without a session
+type RateLimit struct {
+	// RequestsPerSecond is the rate of the requests, 0 for no limit
+	RequestsPerSecond int `json:"requests-per-second" yaml:"requests-per-second"`
+	// Burst is the number of requests allowed at once, the requests per second when 0
+	Burst int `json:"burst" yaml:"burst"`
+}
+
+// headerCondition is a condition on a request header, an exact value or a glob
+type headerCondition struct {
+	name  string
+	value string
+	glob  *regexp.Regexp
+}
+
+// matches checks if a value of the header meets the condition: a missing header only meets an empty value
+func (c headerCondition) matches(header http.Header) bool {
+	values := header.Values(c.name)
+	if len(values) == 0 {
+		return c.value == ""
+	}
+	for _, v := range values {
+		if (c.glob == nil && v == c.value) || (c.glob != nil && c.glob.MatchString(v)) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func newResource() *Resource {
@@ -65,7 +141,7 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 	for _, x := range strings.Split(resource, "|") {
 		kp := strings.Split(x, "=")
 		if len(kp) != 2 {
-			return nil, errors.New("invalid resource keypair, should be (uri|uris|roles|methods|white-listed)=comma_values")
+			return nil, errors.New("invalid resource keypair, should be (uri|uris|url-regex|headers|roles|method-roles|groups|allowed-cidrs|denied-cidrs|methods|white-listed)=comma_values")
 		}
 		switch kp[0] {
 		case "uri":
@@ -81,6 +157,26 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 				}
 
 			}
+		case "url-regex":
+			r.URLRegex = kp[1]
+		case "headers":
+			r.Headers = make(map[string]string)
+			for _, condition := range strings.Split(kp[1], ",") {
+				i := strings.Index(condition, ":")
+				if i < 0 {
+					return nil, errors.New("invalid resource header condition, should be name:value")
+				}
+				r.Headers[condition[:i]] = condition[i+1:]
+			}
+		case "response-headers":
+			r.ResponseHeaders = make(map[string]string)
+			for _, header := range strings.Split(kp[1], ",") {
+				i := strings.Index(header, ":")
+				if i < 0 {
+					return nil, errors.New("invalid resource response header, should be name:value")
+				}
+				r.ResponseHeaders[header[:i]] = header[i+1:]
+			}
 		case "methods":
 			r.Methods = strings.Split(kp[1], ",")
 			if len(r.Methods) == 1 {
@@ -88,6 +184,8 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 					r.Methods = allHTTPMethods
 				}
 			}
+		case "allowed-methods":
+			r.AllowedMethods = strings.Split(kp[1], ",")
 		case "require-any-role":
 			v, err := strconv.ParseBool(kp[1])
 			if err != nil {
@@ -96,8 +194,21 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 			r.RequireAnyRole = v
 		case "roles":
 			r.Roles = strings.Split(kp[1], ",")
+		case "method-roles":
+			r.MethodRoles = make(map[string][]string)
+			for _, rule := range strings.Split(kp[1], ",") {
+				i := strings.Index(rule, ":")
+				if i < 0 {
+					return nil, errors.New("invalid resource method roles, should be method:role;role")
+				}
+				r.MethodRoles[rule[:i]] = strings.Split(rule[i+1:], ";")
+			}
 		case "groups":
 			r.Groups = strings.Split(kp[1], ",")
+		case "allowed-cidrs":
+			r.AllowedCIDRs = strings.Split(kp[1], ",")
+		case "denied-cidrs":
+			r.DeniedCIDRs = strings.Split(kp[1], ",")
 		case "white-listed":
 			value, err := strconv.ParseBool(kp[1])
 			if err != nil {
@@ -106,6 +217,47 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 			r.WhiteListed = value
 		case "upstream-url":
 			r.Upstream = kp[1]
+		case "upstream-ca":
+			r.upstreamTLS().CA = kp[1]
+		case "upstream-skip-tls-verify":
+			v, err := strconv.ParseBool(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of upstream-skip-tls-verify must be true|TRUE|T or it's false equivalent")
+			}
+			r.upstreamTLS().SkipVerify = v
+		case "upstream-client-certificate":
+			r.upstreamTLS().ClientCertificate = kp[1]
+		case "upstream-client-private-key":
+			r.upstreamTLS().ClientPrivateKey = kp[1]
+		case "upstream-server-name":
+			r.upstreamTLS().ServerName = kp[1]
+		case "max-request-body-size":
+			v, err := strconv.Atoi(kp[1])
+			if err != nil {
+				return nil, errors.New("the value of max-request-body-size must be an integer")
+			}
+			r.MaxRequestBodySize = &v
+		case "rate-limit-requests-per-second", "rate-limit-burst":
+			v, err := strconv.Atoi(kp[1])
+			if err != nil {
+				return nil, fmt.Errorf("the value of %s must be an integer", kp[0])
+			}
+			if r.RateLimit == nil {
+				r.RateLimit = &RateLimit{}
+			}
+			if kp[0] == "rate-limit-burst" {
+				r.RateLimit.Burst = v
+			} else {
+				r.RateLimit.RequestsPerSecond = v
+			}
+		case "exchange-audience":
+			r.ExchangeAudience = kp[1]
+		case "acr":
+			r.ACR = kp[1]
+		case "uma-resource":
+			r.UMAResource = kp[1]
+		case "uma-scopes":
+			r.UMAScopes = strings.Split(kp[1], ",")
 		case "strip-basepath":
 			r.StripBasePath = kp[1]
 		case "enable-csrf":
@@ -136,7 +288,13 @@ func (r *Resource) valid() error {
 	if r.URL != "" && len(r.URLs) > 0 {
 		return errors.New("can't specify both uri and uris")
 	}
-	if r.URL == "" && len(r.URLs) == 0 {
+	if r.URLRegex != "" && (r.URL != "" || len(r.URLs) > 0) {
+		return errors.New("can't specify both url-regex and uri or uris")
+	}
+	if err := r.compile(); err != nil {
+		return err
+	}
+	if r.URL == "" && len(r.URLs) == 0 && r.URLRegex == "" {
 		return errors.New("resource does not have url")
 	}
 	if r.URL == "" && len(r.URLs) > 0 {
@@ -151,7 +309,41 @@ func (r *Resource) valid() error {
 	}
 	if r.Upstream != "" {
 		if _, err := url.Parse(r.Upstream); err != nil {
-			return fmt.Errorf("upstream specified for resource %s is not a valid URL: %q", r.URL, r.Upstream)
+			return fmt.Errorf("upstream specified for resource %s is not a valid URL: %q", r.route(), r.Upstream)
+		}
+	}
+	if r.RequireAnyRole && len(r.Roles) == 0 && len(r.MethodRoles) == 0 {
+		return fmt.Errorf("the resource %s requires any of its roles, but has no roles", r.route())
+	}
+	if len(r.MethodRoles) > 0 && (r.WhiteListed || r.BlackListed) {
+		return fmt.Errorf("the resource %s is white or black listed, it cannot require method-roles", r.route())
+	}
+	if r.Expression != "" && (r.WhiteListed || r.BlackListed) {
+		return fmt.Errorf("the resource %s is white or black listed, it cannot require an expression", r.route())
+	}
+	if r.ACR != "" && (r.WhiteListed || r.BlackListed) {
+		return fmt.Errorf("the resource %s is white or black listed, it cannot require an acr", r.route())
+	}
+	if r.MaxRequestBodySize != nil && *r.MaxRequestBodySize < 0 {
+		return fmt.Errorf("the max-request-body-size of resource %s must be positive (or 0 for no limit)", r.route())
+	}
+	if r.RateLimit != nil {
+		if r.WhiteListed {
+			return fmt.Errorf("the white-listed resource %s cannot be rate limited", r.route())
+		}
+		if r.RateLimit.RequestsPerSecond < 0 || r.RateLimit.Burst < 0 {
+			return fmt.Errorf("the rate limit of resource %s must be positive (or 0 for no limit)", r.route())
+		}
+	}
+	if len(r.UMAScopes) > 0 && r.UMAResource == "" {
+		return fmt.Errorf("the uma-scopes of resource %s require an uma-resource", r.route())
+	}
+	if err := isResponseHeadersValid(r.ResponseHeaders); err != nil {
+		return fmt.Errorf("invalid response-headers of resource %s: %w", r.route(), err)
+	}
+	if r.UpstreamTLS != nil {
+		if err := r.UpstreamTLS.isValid(); err != nil {
+			return fmt.Errorf("invalid upstream tls settings for resource %s: %w", r.route(), err)
 		}
 	}
 
@@ -159,25 +351,80 @@ func (r *Resource) valid() error {
 	if len(r.Methods) == 0 {
 		r.Methods = allHTTPMethods
 	}
-	// step: check the method is valid
+	// step: check the allowed methods are well-formed
+	for _, m := range r.AllowedMethods {
+		if !isValidMethodName(m) {
+			return fmt.Errorf("invalid allowed method %s", m)
+		}
+	}
+	// step: check the method is valid: extension methods must be explicitly allowed
 	for _, m := range r.Methods {
-		if !isValidHTTPMethod(m) {
+		if !isValidHTTPMethod(m) && !containsString(m, r.AllowedMethods) {
 			return fmt.Errorf("invalid method %s", m)
 		}
 	}
+	// step: check the methods of the method roles are the methods of the resource
+	for m, roles := range r.MethodRoles {
+		if !isValidHTTPMethod(m) && !containsString(m, r.AllowedMethods) {
+			return fmt.Errorf("invalid method %s in the method-roles of resource %s", m, r.route())
+		}
+		if !containsString(m, r.Methods) {
+			return fmt.Errorf("the method-roles of resource %s require roles for %s, a method the resource does not match", r.route(), m)
+		}
+		if r.RequireAnyRole && len(roles) == 0 {
+			return fmt.Errorf("the resource %s requires any of its roles, but has no roles for %s", r.route(), m)
+		}
+	}
 
 	return nil
 }
 
+// upstreamTLS returns the tls settings of the upstream of this resource, created on first use
+func (r *Resource) upstreamTLS() *UpstreamTLS {
+	if r.UpstreamTLS == nil {
+		r.UpstreamTLS = &UpstreamTLS{}
+	}
+
+	return r.UpstreamTLS
+}
+
 // getRoles returns a list of roles for this resource
 func (r Resource) getRoles() string {
 	return strings.Join(r.Roles, ",")
 }
 
+// rolesFor returns the roles required by a method, and whether they are the method-roles of the method rather than
+// the roles of the resource
+func (r *Resource) rolesFor(method string) ([]string, bool) {
+	if roles, found := r.MethodRoles[method]; found {
+		return roles, true
+	}
+
+	return r.Roles, false
+}
+
+// methodRoles returns the method roles of the resource, sorted by method
+func (r *Resource) methodRoles() string {
+	list := make([]string, 0, len(r.MethodRoles))
+	for method, roles := range r.MethodRoles {
+		list = append(list, method+"="+strings.Join(roles, ","))
+	}
+	sort.Strings(list)
+
+	return strings.Join(list, ";")
+}
+
 // String returns a string representation of the resource
 func (r Resource) String() string {
+	location := "uri: " + r.URL
+	if r.isRegex() {
+		location = "url-regex: " + r.URLRegex
+	}
+	if r.isConditional() {
+		location += ", headers: " + r.conditions()
+	}
 	if r.WhiteListed {
-		return fmt.Sprintf("uri: %s, white-listed", r.URL)
+		return fmt.Sprintf("%s, white-listed", location)
 	}
 
 	roles := "authentication only"
@@ -190,6 +437,308 @@ func (r Resource) String() string {
 	if len(r.Methods) > 0 {
 		methods = strings.Join(r.Methods, ",")
 	}
+	if len(r.MethodRoles) > 0 {
+		roles += ", method-roles: " + r.methodRoles()
+	}
+	if r.Expression != "" {
+		roles += ", expression: " + r.Expression
+	}
+	if r.ACR != "" {
+		roles += ", acr: " + r.ACR
+	}
+
+	return fmt.Sprintf("%s, methods: %s, required: %s", location, methods, roles)
+}
+
+// route returns the url of the resource, or its url regex
+func (r *Resource) route() string {
+	if r.isRegex() {
+		return r.URLRegex
+	}
+
+	return r.URL
+}
+
+// compile compiles the url regex of the resource, matching the whole path, its header conditions, the networks of its
+// clients and its expression, and names the methods of its method roles in upper case
+func (r *Resource) compile() error {
+	if r.isRegex() {
+		regex, err := regexp.Compile("^(?:" + r.URLRegex + ")$")
+		if err != nil {
+			return fmt.Errorf("the url-regex %s of the resource is not a valid regex: %w", r.URLRegex, err)
+		}
+		r.regex = regex
+	}
+	r.headers = make([]headerCondition, 0, len(r.Headers))
+	for name, value := range r.Headers {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("the resource %s has a header condition without a name", r.route())
+		}
+		condition := headerCondition{name: http.CanonicalHeaderKey(name), value: value}
+		if strings.ContainsAny(value, "*?") {
+			glob := strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(value))
+			condition.glob = regexp.MustCompile("^" + glob + "$")
+		}
+		r.headers = append(r.headers, condition)
+	}
+	if len(r.MethodRoles) > 0 {
+		methodRoles := make(map[string][]string, len(r.MethodRoles))
+		for method, roles := range r.MethodRoles {
+			m := strings.ToUpper(method)
+			if _, found := methodRoles[m]; found {
+				return fmt.Errorf("the method-roles of resource %s define the roles of %s twice", r.route(), m)
+			}
+			methodRoles[m] = roles
+		}
+		r.MethodRoles = methodRoles
+	}
+	var err error
+	if r.allowed, err = parseNetworks("allowed cidr", r.AllowedCIDRs); err != nil {
+		return fmt.Errorf("the resource %s has an %w", r.route(), err)
+	}
+	if r.denied, err = parseNetworks("denied cidr", r.DeniedCIDRs); err != nil {
+		return fmt.Errorf("the resource %s has an %w", r.route(), err)
+	}
+	r.expression = nil
+	if r.Expression != "" {
+		if r.expression, err = compileAccessExpression(r.Expression); err != nil {
+			location := r.route()
+			if location == "" {
+				location = strings.Join(r.URLs, ",")
+			}
+			return fmt.Errorf("the expression of resource %s is invalid: %w", location, err)
+		}
+	}
+
+	return nil
+}
+
+// restrictsClients checks if the resource is only accessed by the clients of some networks
+func (r *Resource) restrictsClients() bool {
+	return len(r.AllowedCIDRs) > 0 || len(r.DeniedCIDRs) > 0
+}
+
+// refusesClient returns why the resource refuses the access to a client ip, or an empty string when it is accepted.
+// The denied networks take precedence over the allowed ones, and an ip which is unknown is only accepted without
+// allowed networks.
+func (r *Resource) refusesClient(ip net.IP) string {
+	if inNetworks(ip, r.denied) {
+		return "the client ip belongs to the denied cidrs"
+	}
+	if len(r.allowed) > 0 && !inNetworks(ip, r.allowed) {
+		return "the client ip does not belong to the allowed cidrs"
+	}
+
+	return ""
+}
+
+// isConditional checks if the resource only applies to the requests meeting some header conditions
+func (r *Resource) isConditional() bool {
+	return len(r.Headers) > 0
+}
+
+// conditions returns the header conditions of the resource, sorted by name
+func (r *Resource) conditions() string {
+	list := make([]string, 0, len(r.Headers))
+	for name, value := range r.Headers {
+		list = append(list, http.CanonicalHeaderKey(name)+"="+value)
+	}
+	sort.Strings(list)
+
+	return strings.Join(list, ",")
+}
+
+// matchesHeaders checks if the request headers meet all the header conditions of the resource
+func (r *Resource) matchesHeaders(header http.Header) bool {
+	for _, c := range r.headers {
+		if !c.matches(header) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isRegex checks if the resource matches the paths with its url regex
+func (r *Resource) isRegex() bool {
+	return r.URLRegex != ""
+}
+
+// prefix returns the literal part of the url of the resource, before the wildcard if any
+func (r *Resource) prefix() string {
+	return strings.TrimSuffix(r.URL, wildcard)
+}
+
+// isPrefix checks if the resource protects all the paths starting with its url
+func (r *Resource) isPrefix() bool {
+	return strings.HasSuffix(r.URL, wildcard)
+}
+
+// matches checks if the resource protects a path
+func (r *Resource) matches(path string) bool {
+	if r.isRegex() {
+		return r.regex != nil && r.regex.MatchString(path)
+	}
+	if r.isPrefix() {
+		return strings.HasPrefix(path, r.prefix())
+	}
+
+	return path == r.URL
+}
+
+// precedes checks if the resource takes precedence over another one: the most specific url wins, i.e. the
+// longest prefix, then an exact url over a wildcard. The url regexes come after the urls but before the catch-all
+// route, in their order.
+func (r *Resource) precedes(other *Resource) bool {
+	switch {
+	case r.isRegex() && other.isRegex():
+		return false
+	case r.isRegex():
+		return other.URL == allRoutes
+	case other.isRegex():
+		return r.URL != allRoutes
+	}
+	if len(r.prefix()) != len(other.prefix()) {
+		return len(r.prefix()) > len(other.prefix())
+	}
+
+	return !r.isPrefix() && other.isPrefix()
+}
+
+// coversRoles checks if some required roles include all the other required roles
+func coversRoles(roles []string, anyRole bool, other []string, otherAnyRole bool) bool {
+	if len(other) == 0 {
+		return true
+	}
+	requiresAll := !anyRole || len(roles) == 1
+	switch {
+	case len(roles) == 0:
+		return false
+	case !otherAnyRole && !(requiresAll && isSubset(other, roles)):
+		return false
+	case otherAnyRole && requiresAll && !intersects(roles, other):
+		return false
+	case otherAnyRole && !requiresAll && !isSubset(roles, other):
+		return false
+	}
+
+	return true
+}
+
+// covers checks if the requirements of the resource include all the requirements of another one
+func (r *Resource) covers(other *Resource) bool {
+	switch {
+	case r.BlackListed:
+		return true
+	case other.BlackListed:
+		return false
+	case other.WhiteListed:
+		return true
+	case r.WhiteListed:
+		return false
+	}
+
+	// the required roles, of the resources and of each of their method roles
+	if !coversRoles(r.Roles, r.RequireAnyRole, other.Roles, other.RequireAnyRole) {
+		return false
+	}
+	for _, methods := range []map[string][]string{r.MethodRoles, other.MethodRoles} {
+		for method := range methods {
+			roles, _ := r.rolesFor(method)
+			otherRoles, _ := other.rolesFor(method)
+			if !coversRoles(roles, r.RequireAnyRole, otherRoles, other.RequireAnyRole) {
+				return false
+			}
+		}
+	}
+	// any of the groups is required
+	if len(other.Groups) > 0 && (len(r.Groups) == 0 || !isSubset(r.Groups, other.Groups)) {
+		return false
+	}
+	// the expressions are only known to be the same when they are written the same
+	if other.Expression != "" && other.Expression != r.Expression {
+		return false
+	}
+	// the authentication context class, or a higher level
+	if !acrSatisfies(r.ACR, other.ACR) {
+		return false
+	}
+
+	return true
+}
+
+// resourceConflict is a resource overriding the paths of a less specific resource, with weaker requirements
+type resourceConflict struct {
+	winner     *Resource
+	overridden *Resource
+}
+
+// resourceConflicts lists the resources taking precedence over the paths of other resources, without
+// including all of their requirements
+func resourceConflicts(resources []*Resource) []resourceConflict {
+	var conflicts []resourceConflict
+	for _, winner := range resources {
+		for _, overridden := range resources {
+			nested := strings.HasPrefix(winner.prefix(), overridden.prefix()) || (winner.isRegex() && overridden.URL == allRoutes)
+			if winner == overridden || !overridden.isPrefix() || !nested {
+				continue
+			}
+			if winner.precedes(overridden) && !winner.covers(overridden) {
+				conflicts = append(conflicts, resourceConflict{winner: winner, overridden: overridden})
+			}
+		}
+	}
+
+	return conflicts
+}
+
+// sortResourcesByPrecedence orders the resources from the most specific to the least specific
+func sortResourcesByPrecedence(resources []*Resource) {
+	sort.SliceStable(resources, func(i, j int) bool {
+		return resources[i].precedes(resources[j])
+	})
+}
+
+// regexResourceRoute is a resource matched by its url regex, with the handler of its route
+type regexResourceRoute struct {
+	resource *Resource
+	handler  http.Handler
+}
+
+// regexResourcesMiddleware serves the requests which path matches the url regex of a resource with its route, the
+// first matching resource winning, and passes the others on to the catch-all route
+func regexResourcesMiddleware(routes []regexResourceRoute) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for _, x := range routes {
+				if x.resource.matches(req.URL.Path) && x.resource.matchesHeaders(req.Header) {
+					x.handler.ServeHTTP(w, req)
+					return
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// isSubset checks all the values are in the list
+func isSubset(values, list []string) bool {
+	for _, v := range values {
+		if !containsString(v, list) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// intersects checks if any of the values is in the list
+func intersects(values, list []string) bool {
+	for _, v := range values {
+		if containsString(v, list) {
+			return true
+		}
+	}
 
-	return fmt.Sprintf("uri: %s, methods: %s, required: %s", r.URL, methods, roles)
+	return false
 }
@@ -16,9 +16,15 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDecodeResourceBad(t *testing.T) {
@@ -32,6 +38,7 @@ func TestDecodeResourceBad(t *testing.T) {
 		{Option: "uri=/|white-listed=ERROR"},
 		{Option: "uri=/|require-any-role=BAD"},
 		{Option: "uris=,/toto"},
+		{Option: "uri=/api/*|headers=X-Client-Type"},
 	}
 	for i, c := range cs {
 		if _, err := newResource().parse(c.Option); err == nil {
@@ -85,10 +92,56 @@ func TestResourceParseOk(t *testing.T) {
 			Option:   "uri=/*|require-any-role=true",
 			Resource: &Resource{URL: "/*", Methods: allHTTPMethods, RequireAnyRole: true},
 		},
+		{
+			Option:   "uri=/api/*|response-headers=Cache-Control:no-store,X-Feature:beta",
+			Resource: &Resource{URL: "/api/*", Methods: allHTTPMethods, ResponseHeaders: map[string]string{"Cache-Control": "no-store", "X-Feature": "beta"}},
+		},
+		{
+			Option:   "uri=/payments/*|acr=2",
+			Resource: &Resource{URL: "/payments/*", Methods: allHTTPMethods, ACR: "2"},
+		},
 		{
 			Option:   "uris=/*,/more,/another|require-any-role=true",
 			Resource: &Resource{URLs: []string{"/*", "/more", "/another"}, Methods: allHTTPMethods, RequireAnyRole: true},
 		},
+		{
+			Option:   "uri=/dav*|methods=GET,PROPFIND|allowed-methods=GET,PROPFIND",
+			Resource: &Resource{URL: "/dav*", Methods: []string{"GET", "PROPFIND"}, AllowedMethods: []string{"GET", "PROPFIND"}},
+		},
+		{
+			Option:   "uri=/orders/*|exchange-audience=orders-api",
+			Resource: &Resource{URL: "/orders/*", Methods: allHTTPMethods, ExchangeAudience: "orders-api"},
+		},
+		{
+			Option:   "uri=/orders/*|uma-resource=orders|uma-scopes=read,write",
+			Resource: &Resource{URL: "/orders/*", Methods: allHTTPMethods, UMAResource: "orders", UMAScopes: []string{"read", "write"}},
+		},
+		{
+			Option:   "url-regex=/api/v[0-9]+/admin/.*|roles=admin",
+			Resource: &Resource{URLRegex: "/api/v[0-9]+/admin/.*", Roles: []string{"admin"}, Methods: allHTTPMethods},
+		},
+		{
+			Option:   "uri=/api/*|headers=X-Client-Type:mobile,User-Agent:okhttp/*|roles=mobile",
+			Resource: &Resource{URL: "/api/*", Headers: map[string]string{"X-Client-Type": "mobile", "User-Agent": "okhttp/*"}, Roles: []string{"mobile"}, Methods: allHTTPMethods},
+		},
+		{
+			Option: "uri=/api/things*|roles=reader|method-roles=POST:writer,DELETE:writer;admin",
+			Resource: &Resource{
+				URL: "/api/things*", Roles: []string{"reader"}, Methods: allHTTPMethods,
+				MethodRoles: map[string][]string{http.MethodPost: {"writer"}, http.MethodDelete: {"writer", "admin"}},
+			},
+		},
+		{
+			Option:   "uri=/admin/*|allowed-cidrs=10.8.0.0/16,2001:db8::/32|denied-cidrs=10.8.1.0/24|roles=admin",
+			Resource: &Resource{URL: "/admin/*", AllowedCIDRs: []string{"10.8.0.0/16", "2001:db8::/32"}, DeniedCIDRs: []string{"10.8.1.0/24"}, Roles: []string{"admin"}, Methods: allHTTPMethods},
+		},
+		{
+			Option: "uri=/appliance/*|upstream-url=https://appliance.internal|upstream-skip-tls-verify=true|upstream-server-name=appliance",
+			Resource: &Resource{
+				URL: "/appliance/*", Methods: allHTTPMethods, Upstream: "https://appliance.internal",
+				UpstreamTLS: &UpstreamTLS{SkipVerify: true, ServerName: "appliance"},
+			},
+		},
 	}
 	for i, x := range cs {
 		r, err := newResource().parse(x.Option)
@@ -134,6 +187,43 @@ func TestIsValid(t *testing.T) {
 				URLs: []string{"/test", "/another"},
 			},
 		},
+		{
+			Resource: &Resource{
+				URL:            "/dav*",
+				Methods:        []string{"GET", "PROPFIND"},
+				AllowedMethods: []string{"GET", "PROPFIND"},
+			},
+			Ok: true,
+		},
+		{
+			Resource: &Resource{
+				URL:     "/dav*",
+				Methods: []string{"GET", "PROPFIND"},
+			},
+		},
+		{
+			Resource: &Resource{
+				URL:            "/dav*",
+				AllowedMethods: []string{"propfind"},
+			},
+		},
+		{
+			Resource: &Resource{URL: "/test", UpstreamTLS: &UpstreamTLS{CA: testCertificateFile, ServerName: "localhost"}},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", UMAResource: "orders", UMAScopes: []string{"read"}},
+			Ok:       true,
+		},
+		{
+			Resource: &Resource{URL: "/test", UMAScopes: []string{"read"}},
+		},
+		{
+			Resource: &Resource{URL: "/test", UpstreamTLS: &UpstreamTLS{CA: "./tests/does_not_exist"}},
+		},
+		{
+			Resource: &Resource{URL: "/test", UpstreamTLS: &UpstreamTLS{ClientCertificate: testCertificateFile}},
+		},
 	}
 
 	for i, c := range testCases {
@@ -166,3 +256,378 @@ func TestGetRoles(t *testing.T) {
 		t.Error("the resource roles not as expected")
 	}
 }
+
+func TestSortResourcesByPrecedence(t *testing.T) {
+	expected := []string{"/api/admin/users", "/api/admin/*", "/api/admin", "/api/*", "/*"}
+	orders := [][]string{
+		{"/*", "/api/*", "/api/admin", "/api/admin/*", "/api/admin/users"},
+		{"/api/admin/users", "/*", "/api/admin/*", "/api/*", "/api/admin"},
+	}
+	for _, order := range orders {
+		var resources []*Resource
+		for _, u := range order {
+			resources = append(resources, &Resource{URL: u})
+		}
+		sortResourcesByPrecedence(resources)
+		var urls []string
+		for _, x := range resources {
+			urls = append(urls, x.URL)
+		}
+		assert.Equal(t, expected, urls, "order: %v", order)
+	}
+}
+
+func TestSortResourcesByPrecedenceRegex(t *testing.T) {
+	resources := []*Resource{
+		{URL: "/*"},
+		{URLRegex: "/api/v[0-9]+/admin/.*"},
+		{URL: "/api/*"},
+		{URLRegex: "/reports/[0-9]+"},
+		{URL: "/api/v1/admin/health"},
+	}
+	sortResourcesByPrecedence(resources)
+	var routes []string
+	for _, x := range resources {
+		routes = append(routes, x.route())
+	}
+	assert.Equal(t, []string{"/api/v1/admin/health", "/api/*", "/api/v[0-9]+/admin/.*", "/reports/[0-9]+", "/*"}, routes,
+		"the urls first, then the regexes in their order, then the catch-all route")
+}
+
+func TestResourceURLRegex(t *testing.T) {
+	resource := &Resource{URLRegex: "/api/v[0-9]+/admin/.*"}
+	require.NoError(t, resource.valid())
+	assert.True(t, resource.matches("/api/v2/admin/users"))
+	assert.True(t, resource.matches("/api/v10/admin/"))
+	assert.False(t, resource.matches("/api/vx/admin/users"))
+	assert.False(t, resource.matches("/public/api/v2/admin/users"), "the regex matches the whole path")
+	assert.True(t, strings.HasPrefix(resource.String(), "url-regex: /api/v[0-9]+/admin/.*, "))
+
+	assert.Error(t, (&Resource{URLRegex: "/api/(v1"}).valid())
+	assert.Error(t, (&Resource{URLRegex: "/api/.*", RequireAnyRole: true}).valid(), "any of no roles is required")
+	assert.Error(t, (&Resource{URL: "/api/*", URLRegex: "/api/.*"}).valid())
+	assert.Error(t, (&Resource{URLs: []string{"/api"}, URLRegex: "/api/.*"}).valid())
+	assert.False(t, (&Resource{URLRegex: "/api/.*"}).matches("/api/users"), "the regex is compiled when validated")
+}
+
+func TestResourceHeaders(t *testing.T) {
+	resource := &Resource{URL: "/api/*", Headers: map[string]string{
+		"x-client-type": "mobile",
+		"User-Agent":    "okhttp/*",
+	}}
+	require.NoError(t, resource.valid())
+	assert.Contains(t, resource.String(), "headers: User-Agent=okhttp/*,X-Client-Type=mobile")
+
+	cs := []struct {
+		Headers map[string][]string
+		Matches bool
+	}{
+		{Headers: map[string][]string{"X-Client-Type": {"mobile"}, "User-Agent": {"okhttp/4.9.0"}}, Matches: true},
+		{Headers: map[string][]string{"X-Client-Type": {"web", "mobile"}, "User-Agent": {"okhttp/4.9.0"}}, Matches: true},
+		{Headers: map[string][]string{"X-Client-Type": {"Mobile"}, "User-Agent": {"okhttp/4.9.0"}}},
+		{Headers: map[string][]string{"X-Client-Type": {"mobile"}, "User-Agent": {"curl/7.68.0"}}},
+		{Headers: map[string][]string{"X-Client-Type": {"mobile"}}},
+		{Headers: map[string][]string{"X-Client-Type": {"mobile"}, "User-Agent": {""}}},
+		{},
+	}
+	for i, c := range cs {
+		header := make(http.Header)
+		for name, values := range c.Headers {
+			for _, v := range values {
+				header.Add(name, v)
+			}
+		}
+		assert.Equal(t, c.Matches, resource.matchesHeaders(header), "case %d", i)
+	}
+
+	// a resource without conditions matches any request, an empty condition a missing header
+	assert.True(t, (&Resource{URL: "/api/*"}).matchesHeaders(nil))
+	empty := &Resource{URL: "/api/*", Headers: map[string]string{"X-Debug": ""}}
+	require.NoError(t, empty.valid())
+	assert.True(t, empty.matchesHeaders(nil))
+	assert.False(t, empty.matchesHeaders(http.Header{"X-Debug": {"1"}}))
+	assert.Error(t, (&Resource{URL: "/api/*", Headers: map[string]string{" ": "1"}}).valid())
+}
+
+func TestResourceMethodRoles(t *testing.T) {
+	resource := &Resource{
+		URL:         "/api/things*",
+		Roles:       []string{"reader"},
+		MethodRoles: map[string][]string{"post": {"writer"}, http.MethodPut: {"writer"}, http.MethodOptions: {}},
+	}
+	require.NoError(t, resource.valid())
+	assert.Contains(t, resource.String(), "required: reader, method-roles: OPTIONS=;POST=writer;PUT=writer")
+
+	cs := []struct {
+		Method   string
+		Roles    []string
+		ByMethod bool
+	}{
+		{Method: http.MethodGet, Roles: []string{"reader"}},
+		{Method: http.MethodPost, Roles: []string{"writer"}, ByMethod: true},
+		{Method: http.MethodPut, Roles: []string{"writer"}, ByMethod: true},
+		{Method: http.MethodOptions, Roles: []string{}, ByMethod: true},
+		{Method: http.MethodDelete, Roles: []string{"reader"}},
+	}
+	for i, c := range cs {
+		roles, byMethod := resource.rolesFor(c.Method)
+		assert.Equal(t, c.Roles, roles, "case %d", i)
+		assert.Equal(t, c.ByMethod, byMethod, "case %d", i)
+	}
+
+	// any of the method roles is required with require-any-role, even without roles for the other methods
+	anyRole := &Resource{URL: "/api/*", RequireAnyRole: true, MethodRoles: map[string][]string{http.MethodPost: {"writer", "admin"}}}
+	require.NoError(t, anyRole.valid())
+
+	bad := []*Resource{
+		{URL: "/api/*", MethodRoles: map[string][]string{"FETCH": {"reader"}}},
+		{URL: "/api/*", MethodRoles: map[string][]string{"get": {"reader"}, http.MethodGet: {"writer"}}},
+		{URL: "/api/*", Methods: []string{http.MethodGet}, MethodRoles: map[string][]string{http.MethodPost: {"writer"}}},
+		{URL: "/api/*", WhiteListed: true, MethodRoles: map[string][]string{http.MethodPost: {"writer"}}},
+		{URL: "/api/*", RequireAnyRole: true, Roles: []string{"reader"}, MethodRoles: map[string][]string{http.MethodPost: {}}},
+	}
+	for i, x := range bad {
+		assert.Error(t, x.valid(), "case %d", i)
+	}
+}
+
+func TestResourceExpression(t *testing.T) {
+	resource := &Resource{URL: "/finance/*", Roles: []string{"reader"}, Expression: "'finance' in user.groups || 'admin' in user.roles"}
+	require.NoError(t, resource.valid())
+	require.NotNil(t, resource.expression)
+	assert.Contains(t, resource.String(), "expression: 'finance' in user.groups || 'admin' in user.roles")
+
+	err := (&Resource{URL: "/finance/*", Expression: "'admin' in roles"}).valid()
+	require.Error(t, err)
+	assert.Equal(t, "the expression of resource /finance/* is invalid: column 12: undeclared reference to 'roles'", err.Error())
+	err = (&Resource{URLs: []string{"/finance/*", "/ledger/*"}, Expression: "user.email"}).valid()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the expression of resource /finance/*,/ledger/* is invalid")
+
+	bad := []*Resource{
+		{URL: "/public/*", WhiteListed: true, Expression: "true"},
+		{URL: "/internal/*", BlackListed: true, Expression: "true"},
+	}
+	for i, x := range bad {
+		assert.Error(t, x.valid(), "case %d", i)
+	}
+}
+
+func TestResourceACR(t *testing.T) {
+	resource := &Resource{URL: "/payments/*", ACR: "2"}
+	require.NoError(t, resource.valid())
+	assert.Contains(t, resource.String(), "acr: 2")
+
+	bad := []*Resource{
+		{URL: "/public/*", WhiteListed: true, ACR: "2"},
+		{URL: "/internal/*", BlackListed: true, ACR: "2"},
+	}
+	for i, x := range bad {
+		assert.Error(t, x.valid(), "case %d", i)
+	}
+}
+
+func TestResourceResponseHeadersValid(t *testing.T) {
+	cs := []struct {
+		Headers map[string]string
+		Ok      bool
+	}{
+		{Headers: map[string]string{"Cache-Control": "no-store"}, Ok: true},
+		{Headers: map[string]string{"x-feature": "beta", "Content-Security-Policy": "default-src 'self'"}, Ok: true},
+		{Headers: map[string]string{"Connection": "close"}},
+		{Headers: map[string]string{"transfer-encoding": "chunked"}},
+		{Headers: map[string]string{"Upgrade": "websocket"}},
+		{Headers: map[string]string{"Keep-Alive": "timeout=5"}},
+		{Headers: map[string]string{"X Feature": "beta"}},
+		{Headers: map[string]string{"X-Feature": "beta\r\nSet-Cookie: a=b"}},
+	}
+	for i, c := range cs {
+		resource := &Resource{URL: "/api/*", ResponseHeaders: c.Headers}
+		assert.Equal(t, c.Ok, resource.valid() == nil, "case %d", i)
+		assert.Equal(t, c.Ok, isResponseHeadersValid(c.Headers) == nil, "case %d", i)
+	}
+}
+
+func TestResourceClientNetworks(t *testing.T) {
+	resource := &Resource{
+		URL:          "/admin/*",
+		AllowedCIDRs: []string{"10.8.0.0/16", "192.0.2.43", "2001:db8::/32"},
+		DeniedCIDRs:  []string{"10.8.1.0/24", "2001:db8:dead::/48"},
+	}
+	require.NoError(t, resource.valid())
+	assert.True(t, resource.restrictsClients())
+
+	cs := []struct {
+		IP      string
+		Refused string
+	}{
+		{IP: "10.8.0.1"},
+		{IP: "192.0.2.43"},
+		{IP: "::ffff:10.8.0.1"},
+		{IP: "2001:db8:cafe::17"},
+		{IP: "10.8.1.5", Refused: "denied"},
+		{IP: "2001:db8:dead::1", Refused: "denied"},
+		{IP: "10.9.0.1", Refused: "allowed"},
+		{IP: "192.0.2.44", Refused: "allowed"},
+		{IP: "2001:db9::1", Refused: "allowed"},
+		{Refused: "allowed"},
+	}
+	for i, c := range cs {
+		reason := resource.refusesClient(net.ParseIP(c.IP))
+		if c.Refused == "" {
+			assert.Empty(t, reason, "case %d", i)
+			continue
+		}
+		assert.Contains(t, reason, c.Refused, "case %d", i)
+	}
+
+	// without allowed networks, only the denied ones are refused
+	denied := &Resource{URL: "/api/*", DeniedCIDRs: []string{"203.0.113.0/24"}}
+	require.NoError(t, denied.valid())
+	assert.Empty(t, denied.refusesClient(net.ParseIP("198.51.100.1")))
+	assert.Empty(t, denied.refusesClient(nil))
+	assert.NotEmpty(t, denied.refusesClient(net.ParseIP("203.0.113.9")))
+	assert.False(t, (&Resource{URL: "/api/*"}).restrictsClients())
+
+	assert.Error(t, (&Resource{URL: "/api/*", AllowedCIDRs: []string{"10.0.0.0/33"}}).valid())
+	assert.Error(t, (&Resource{URL: "/api/*", DeniedCIDRs: []string{"office"}}).valid())
+}
+
+func TestResourceMatches(t *testing.T) {
+	assert.True(t, (&Resource{URL: "/api/*"}).matches("/api/users"))
+	assert.True(t, (&Resource{URL: "/admin*"}).matches("/administration"))
+	assert.True(t, (&Resource{URL: "/api"}).matches("/api"))
+	assert.False(t, (&Resource{URL: "/api"}).matches("/api/users"))
+	assert.False(t, (&Resource{URL: "/api/*"}).matches("/other"))
+}
+
+func TestResourceConflicts(t *testing.T) {
+	cs := []struct {
+		Parent   *Resource
+		Nested   *Resource
+		Conflict bool
+	}{
+		{
+			Parent: &Resource{URL: "/api/*", Roles: []string{"user"}},
+			Nested: &Resource{URL: "/api/admin/*", Roles: []string{"user", "admin"}},
+		},
+		{
+			Parent:   &Resource{URL: "/api/*", Roles: []string{"user"}},
+			Nested:   &Resource{URL: "/api/admin/*", Roles: []string{"admin"}},
+			Conflict: true,
+		},
+		{
+			Parent:   &Resource{URL: "/api/*", Roles: []string{"user"}},
+			Nested:   &Resource{URL: "/api/public/*", WhiteListed: true},
+			Conflict: true,
+		},
+		{
+			Parent: &Resource{URL: "/api/*", Roles: []string{"user"}},
+			Nested: &Resource{URL: "/api/internal/*", BlackListed: true},
+		},
+		{
+			Parent: &Resource{URL: "/api/*", Roles: []string{"user", "admin"}, RequireAnyRole: true},
+			Nested: &Resource{URL: "/api/admin", Roles: []string{"admin"}},
+		},
+		{
+			Parent:   &Resource{URL: "/api/*", Roles: []string{"user", "admin"}},
+			Nested:   &Resource{URL: "/api/admin", Roles: []string{"user", "admin"}, RequireAnyRole: true},
+			Conflict: true,
+		},
+		{
+			Parent:   &Resource{URL: "/api/*", Groups: []string{"staff"}},
+			Nested:   &Resource{URL: "/api/admin/*", Roles: []string{"admin"}},
+			Conflict: true,
+		},
+		{
+			// the method roles of the parent are required by the nested resource too
+			Parent:   &Resource{URL: "/api/*", Roles: []string{"reader"}, MethodRoles: map[string][]string{http.MethodPost: {"writer"}}},
+			Nested:   &Resource{URL: "/api/things/*", Roles: []string{"reader"}},
+			Conflict: true,
+		},
+		{
+			Parent: &Resource{URL: "/api/*", Roles: []string{"reader"}, MethodRoles: map[string][]string{http.MethodPost: {"writer"}}},
+			Nested: &Resource{URL: "/api/things/*", Roles: []string{"reader"}, MethodRoles: map[string][]string{http.MethodPost: {"writer", "admin"}}},
+		},
+		{
+			// the expression of the parent is required by the nested resource too
+			Parent:   &Resource{URL: "/api/*", Roles: []string{"user"}, Expression: "request.method == 'GET'"},
+			Nested:   &Resource{URL: "/api/things/*", Roles: []string{"user"}},
+			Conflict: true,
+		},
+		{
+			Parent: &Resource{URL: "/api/*", Roles: []string{"user"}, Expression: "request.method == 'GET'"},
+			Nested: &Resource{URL: "/api/things/*", Roles: []string{"user", "admin"}, Expression: "request.method == 'GET'"},
+		},
+		{
+			// the authentication level of the parent, or a higher one, is required by the nested resource too
+			Parent:   &Resource{URL: "/payments/*", ACR: "2"},
+			Nested:   &Resource{URL: "/payments/receipts/*", ACR: "1"},
+			Conflict: true,
+		},
+		{
+			Parent: &Resource{URL: "/payments/*", ACR: "2"},
+			Nested: &Resource{URL: "/payments/transfers/*", ACR: "3"},
+		},
+		{
+			// the exact urls do not protect the nested paths
+			Parent: &Resource{URL: "/api", Roles: []string{"user"}},
+			Nested: &Resource{URL: "/api/public", WhiteListed: true},
+		},
+		{
+			// unrelated paths
+			Parent: &Resource{URL: "/api/*", Roles: []string{"user"}},
+			Nested: &Resource{URL: "/public/*", WhiteListed: true},
+		},
+		{
+			// the regexes override the catch-all route only
+			Parent:   &Resource{URL: "/*", Roles: []string{"user"}},
+			Nested:   &Resource{URLRegex: "/api/v[0-9]+/public/.*", WhiteListed: true},
+			Conflict: true,
+		},
+		{
+			Parent: &Resource{URL: "/api/*", Roles: []string{"user"}},
+			Nested: &Resource{URLRegex: "/api/v[0-9]+/public/.*", WhiteListed: true},
+		},
+	}
+	for i, c := range cs {
+		conflicts := resourceConflicts([]*Resource{c.Parent, c.Nested})
+		if !c.Conflict {
+			assert.Empty(t, conflicts, "case %d", i)
+			continue
+		}
+		if assert.Len(t, conflicts, 1, "case %d", i) {
+			assert.Equal(t, c.Nested, conflicts[0].winner, "case %d", i)
+			assert.Equal(t, c.Parent, conflicts[0].overridden, "case %d", i)
+		}
+	}
+}
+
+func BenchmarkRegexResources(b *testing.B) {
+	served := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	var routes []regexResourceRoute
+	for i := 0; i < 50; i++ {
+		resource := &Resource{URLRegex: fmt.Sprintf("/api/v[0-9]+/service%d/.*", i)}
+		if err := resource.valid(); err != nil {
+			b.Fatal(err)
+		}
+		routes = append(routes, regexResourceRoute{resource: resource, handler: served})
+	}
+	handler := regexResourcesMiddleware(routes)(served)
+
+	for name, path := range map[string]string{
+		"first":    "/api/v1/service0/orders",
+		"last":     "/api/v1/service49/orders",
+		"no-match": "/public/index.html",
+	} {
+		b.Run(name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handler.ServeHTTP(w, req)
+			}
+		})
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -17,66 +20,369 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"net/http/httputil"
 
 	"github.com/go-chi/chi"
-	"github.com/rs/cors"
 	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 )
 
+// isReverseProxyUnused validates the configuration of the forwarding mode, which ignores the options of the reverse proxy
+func (r *Config) isReverseProxyUnused() error {
+	return nil
+}
+
+// isReverseProxyValid validates the configuration of the reverse proxy mode
+func (r *Config) isReverseProxyValid() error {
+	if r.SameSiteCookie != "" && r.SameSiteCookie != SameSiteStrict && r.SameSiteCookie != SameSiteLax && r.SameSiteCookie != SameSiteNone {
+		return errors.New("same-site-cookie must be one of Strict|Lax|None")
+	}
+	if r.MaxTokenSize < 0 || r.MaxCookieChunks < 0 || r.MaxRequestHeaderSize < 0 || r.MaxRequestBodySize < 0 {
+		return errors.New("max-token-size, max-cookie-chunks, max-request-header-size and max-request-body-size must be positive (or 0 for no limit)")
+	}
+	if r.RateLimitRequestsPerSecond < 0 || r.RateLimitBurst < 0 {
+		return errors.New("rate-limit-requests-per-second and rate-limit-burst must be positive (or 0 for no limit)")
+	}
+	for _, limit := range r.MeasuredLimits {
+		if !containsString(limit, knownLimits) {
+			return fmt.Errorf("invalid measured limit %q, must be one of %s", limit, strings.Join(knownLimits, "|"))
+		}
+	}
+	if r.CookieFilterMode != "" && r.CookieFilterMode != cookieFilterRedact && r.CookieFilterMode != cookieFilterDrop {
+		return errors.New("cookie-filter-mode must be one of redact|drop")
+	}
+	if r.EnablePartitionedCookies && (!r.SecureCookie || r.SameSiteCookie != SameSiteNone) {
+		return errors.New("enable-partitioned-cookies requires secure-cookie and same-site-cookie to be None")
+	}
+	if r.CookieNameSuffix != "" {
+		if r.EnableClientIDCookieSuffix {
+			return errors.New("you cannot set both cookie-name-suffix and enable-client-id-cookie-suffix")
+		}
+		if !cookieNameSuffixFilter.MatchString(r.CookieNameSuffix) || cookieChunkSuffixFilter.MatchString(r.CookieNameSuffix) {
+			return fmt.Errorf("invalid cookie name suffix %q, must only contain letters, digits, '_', '.' or '-' and not look like a cookie chunk", r.CookieNameSuffix)
+		}
+	}
+	if _, err := parseTrustedProxies(r.ForwardedTrustedProxies); err != nil {
+		return err
+	}
+	if r.ForwardedHeaders != "" && !containsString(r.ForwardedHeaders, []string{forwardedHeadersBoth, forwardedHeadersForwarded, forwardedHeadersXForward}) {
+		return errors.New("forwarded-headers must be one of both|forwarded|x-forwarded")
+	}
+	if _, err := makeHeaderEncoders(r.IdentityHeaderEncodings); err != nil {
+		return err
+	}
+	if err := r.isIdentityHeadersValid(); err != nil {
+		return err
+	}
+	if err := isResponseHeadersValid(r.ResponseHeaders); err != nil {
+		return fmt.Errorf("invalid response-headers: %w", err)
+	}
+	if strings.ContainsAny(r.WebSocketTokenSubprotocol, " \t,;\"") {
+		return fmt.Errorf("invalid websocket token subprotocol %q, must be a single subprotocol name", r.WebSocketTokenSubprotocol)
+	}
+	if err := r.isTrustedAuthenticatorValid(); err != nil {
+		return err
+	}
+	for _, pattern := range r.AllowedRedirectURLs {
+		if u, err := url.Parse(pattern); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid allowed redirect url %q, must be an absolute url", pattern)
+		}
+	}
+
+	switch r.Upstream {
+	case "":
+		if r.EnableDefaultDeny && !r.EnableDefaultNotFound && !r.EnableDefaultDenyStrict {
+			return errors.New("you expect some default fallback routing, but have not specified an upstream endpoint to proxy to")
+		}
+		for _, resource := range r.Resources {
+			if resource.Upstream == "" {
+				return fmt.Errorf("you did not set any default upstream and you have not specified an upstream endpoint to proxy to on resource: %s", resource.route())
+			}
+		}
+	default:
+		if _, err := url.Parse(r.Upstream); err != nil {
+			return fmt.Errorf("the upstream endpoint is invalid, %s", err)
+		}
+	}
+
+	if !r.SkipUpstreamTLSVerify && r.UpstreamCA == "" {
+		return fmt.Errorf("you cannot require to check upstream tls and omit to specify the root ca to verify it: %s", r.UpstreamCA)
+	}
+
+	// step: if token verification is enabled (skip is off), we need the below checks
+	if !r.SkipTokenVerification {
+		if err := r.isTokenConfigValid(); err != nil {
+			return err
+		}
+	}
+	// check: ensure the method policy is valid
+	for _, m := range r.AllowedMethods {
+		if !isValidMethodName(m) {
+			return fmt.Errorf("invalid allowed method %s", m)
+		}
+		if r.RejectNonStandardMethods && !isValidHTTPMethod(m) {
+			return fmt.Errorf("the allowed method %s is not a standard method, but reject-nonstandard-methods is enabled", m)
+		}
+	}
+
+	// check: ensure each of the resource are valid
+	newResources := make([]*Resource, 0, len(r.Resources))
+	for _, resource := range r.Resources {
+		if len(resource.AllowedMethods) == 0 && len(r.AllowedMethods) > 0 {
+			// the resource abides by the global method policy
+			resource.AllowedMethods = append([]string{}, r.AllowedMethods...)
+		}
+		if err := resource.valid(); err != nil {
+			return err
+		}
+		if r.RejectNonStandardMethods {
+			for _, m := range resource.AllowedMethods {
+				if !isValidHTTPMethod(m) {
+					return fmt.Errorf("the allowed method %s on resource %s is not a standard method, but reject-nonstandard-methods is enabled", m, resource.route())
+				}
+			}
+		}
+		// expand resources with multiple urls
+		if len(resource.URLs) > 0 {
+			for _, u := range resource.URLs {
+				res := &Resource{
+					URL:                u,
+					URLs:               nil,
+					Methods:            append([]string{}, resource.Methods...),
+					AllowedMethods:     append([]string{}, resource.AllowedMethods...),
+					WhiteListed:        resource.WhiteListed,
+					BlackListed:        resource.BlackListed,
+					RequireAnyRole:     resource.RequireAnyRole,
+					Roles:              append([]string{}, resource.Roles...),
+					MethodRoles:        resource.MethodRoles,
+					Groups:             append([]string{}, resource.Groups...),
+					Expression:         resource.Expression,
+					ACR:                resource.ACR,
+					AllowedCIDRs:       append([]string{}, resource.AllowedCIDRs...),
+					DeniedCIDRs:        append([]string{}, resource.DeniedCIDRs...),
+					EnableCSRF:         resource.EnableCSRF,
+					StripBasePath:      resource.StripBasePath,
+					Upstream:           resource.Upstream,
+					UpstreamTLS:        resource.UpstreamTLS,
+					RateLimit:          resource.RateLimit,
+					MaxRequestBodySize: resource.MaxRequestBodySize,
+					ExchangeAudience:   resource.ExchangeAudience,
+					UMAResource:        resource.UMAResource,
+					UMAScopes:          append([]string{}, resource.UMAScopes...),
+					Headers:            resource.Headers,
+					ResponseHeaders:    resource.ResponseHeaders,
+				}
+				newResources = append(newResources, res)
+			}
+		} else {
+			newResources = append(newResources, resource)
+		}
+	}
+	r.Resources = newResources
+	if r.EnableLongestMatch {
+		sortResourcesByPrecedence(r.Resources)
+	}
+
+	// check for duplicate uris in resources, the resources of a uri being told apart by their header conditions
+	uris := make(map[string]struct{}, len(r.Resources))
+	regexes := make(map[string]struct{})
+	for _, resource := range r.Resources {
+		seen := uris
+		if resource.isRegex() {
+			seen = regexes
+		}
+		key := resource.route() + " " + resource.conditions()
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+		} else {
+			return errors.New("a duplicate entry in resource URIs has been found")
+		}
+		if resource.URL == allRoutes && r.EnableDefaultDeny && resource.WhiteListed && !resource.isConditional() {
+			return errors.New("you've asked for a default denial (EnableDefaultDeny is true by default) but whitelisted everything")
+		}
+	}
+
+	if r.EnableDefaultDenyStrict && r.EnableDefaultNotFound {
+		return errors.New("you cannot set both enable-default-deny-strict and enable-default-notfound, the paths matching no resource are either refused or not found")
+	}
+
+	// step: validate the claims are validate regex's
+	for k, claim := range r.MatchClaims {
+		if _, err := regexp.Compile(claim); err != nil {
+			return fmt.Errorf("the claim matcher: %s for claim: %s is not a valid regex", claim, k)
+		}
+	}
+
+	// step: validity checks for the token exchange
+	for _, resource := range r.Resources {
+		if resource.ExchangeAudience != "" && !r.EnableTokenExchange {
+			return fmt.Errorf("the resource %s requires a token exchange, but enable-token-exchange is not set", resource.route())
+		}
+	}
+	if r.EnableTokenExchange && r.ClientSecret == "" && r.ClientAssertionKey == "" {
+		return errors.New("the token exchange requires a confidential client: you have not specified the client secret or assertion key")
+	}
+
+	// step: validity checks for the uma permissions
+	for _, resource := range r.Resources {
+		if resource.UMAResource != "" && !r.EnableUMA {
+			return fmt.Errorf("the resource %s requires uma permissions, but enable-uma is not set", resource.route())
+		}
+		if resource.UMAResource != "" && resource.WhiteListed {
+			return fmt.Errorf("the resource %s is white-listed, its uma permissions cannot be checked", resource.route())
+		}
+	}
+	if r.EnableUMA && r.SkipTokenVerification {
+		return errors.New("the uma permissions cannot be checked when the token verification is skipped")
+	}
+	if r.UMACacheTTL < 0 {
+		return errors.New("the uma-cache-ttl cannot be negative")
+	}
+	if err := r.isExternalAuthzValid(); err != nil {
+		return err
+	}
+
+	// step: validity checks for the client token handler
+	if r.EnableClientTokenHandler {
+		if r.ClientSecret == "" {
+			return errors.New("the client token handler requires a confidential client: you have not specified the client secret")
+		}
+		if r.ClientTokenAudience == "" {
+			return errors.New("the client token handler requires a client-token-audience")
+		}
+		if len(r.ClientTokenAllowedSubjects) == 0 && len(r.ClientTokenKeys) == 0 {
+			return errors.New("the client token handler requires some allowed callers, with client-token-allowed-subjects or client-token-keys")
+		}
+		if len(r.ClientTokenAllowedSubjects) > 0 && r.TLSCaCertificate == "" {
+			return errors.New("client-token-allowed-subjects requires mutual TLS, with tls-ca-certificate")
+		}
+		if r.ClientTokenRateLimit < 0 {
+			return errors.New("client-token-rate-limit must be a number >= 0")
+		}
+	}
+
+	// step: validity checks for CSRF options
+	if r.EnableCSRF {
+		if r.EncryptionKey == "" {
+			return fmt.Errorf("flag EnableCSRF requires EncryptionKey to be set")
+		}
+		var found bool
+		for _, resource := range r.Resources {
+			if resource.EnableCSRF {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("flag EnableCSRF is set but no protected resource sets EnableCSRF")
+		}
+	}
+	return nil
+}
+
 // createReverseProxy creates a reverse proxy
 func (r *oauthProxy) createReverseProxy() error {
 	r.log.Info("enabled reverse proxy mode, default upstream url", zap.String("url", r.config.Upstream))
+	r.cookieSuffix = r.makeCookieNameSuffix()
+	r.trustedProxies, _ = parseTrustedProxies(r.config.ForwardedTrustedProxies)
+	r.cookieChunker = r.makeCookieChunker()
+	r.cookieDropper = r.makeCookieDropper()
+	r.tokenSizeLimit = newRequestLimit(limitTokenSize, r.config.MaxTokenSize, r.config.MeasuredLimits)
+	r.cookieChunksLimit = newRequestLimit(limitCookieChunks, r.config.MaxCookieChunks, r.config.MeasuredLimits)
+	r.headerSizeLimit = newRequestLimit(limitRequestHeaderSize, r.config.MaxRequestHeaderSize, r.config.MeasuredLimits)
+	if r.config.TrustedAuthenticator != "" {
+		r.trustedAuthenticator = newTrustedAuthenticator(r.config)
+	}
+	if r.config.EnableUMA {
+		r.umaCache = newUMAPermissions()
+	}
+	if r.config.ExternalAuthzURL != "" {
+		r.externalAuthz = newExternalAuthorizer(r.config)
+	}
+
 	if err := r.createStdProxy(r.endpoint); err != nil {
 		return err
 	}
-	engine := chi.NewRouter()
-	r.useDefaultStack(engine)
-
-	// @step: configure CORS middleware
-	r.useCors(engine)
-
-	r.router = engine
-
-	if len(r.config.ResponseHeaders) > 0 {
-		engine.Use(r.responseHeaderMiddleware(r.config.ResponseHeaders))
+	// step: let the router know about the extension methods we may proxy (e.g. WebDAV), before any route is declared
+	extensionMethods := append([]string{}, r.config.AllowedMethods...)
+	for _, x := range r.config.Resources {
+		extensionMethods = append(extensionMethods, x.AllowedMethods...)
+	}
+	for _, m := range extensionMethods {
+		if !isValidHTTPMethod(m) && !r.config.RejectNonStandardMethods {
+			chi.RegisterMethod(m)
+		}
 	}
 
-	// configure CSRF middleware
+	// configure CSRF middleware, before the stages protecting against CSRF are built
 	r.csrf = r.csrfConfigMiddleware()
+	if r.config.EnableCaptureEndpoint {
+		r.capture = newRequestCapture(r.config.CaptureBufferSize)
+	}
+
+	engine := chi.NewRouter()
+	engine.NotFound(emptyHandler)
+	engine.Use(buildPipeline(r.pipeline(pipelineRouteGlobal, nil), true)...)
+	// unknown methods are rejected by the router
+	engine.MethodNotAllowed(r.methodPolicyMiddleware(nil)(http.HandlerFunc(methodNotAllowedHandler)).ServeHTTP)
+
+	r.router = engine
 
 	// step: add the handlers for oauth
-	engine.With(
-		proxyDenyMiddleware,
-		r.csrfSkipMiddleware(), // handle CSRF state, but skip check on POST endpoints below
-		r.csrfProtectMiddleware(),
-		r.csrfHeaderMiddleware()).Route(r.config.OAuthURI,
+	engine.With(r.routeMiddlewares(pipelineRouteOAuth, nil)...).Route(r.config.OAuthURI,
 		func(e chi.Router) {
 			e.NotFound(http.NotFound)
 			e.MethodNotAllowed(methodNotAllowedHandler)
 
-			e.HandleFunc(authorizationURL, r.oauthAuthorizationHandler)
-			e.Get(callbackURL, r.oauthCallbackHandler)
+			e.With(r.loginFlowMiddleware).HandleFunc(authorizationURL, r.oauthAuthorizationHandler)
+			e.With(r.loginFlowMiddleware).Get(callbackURL, r.oauthCallbackHandler)
 			e.Get(expiredURL, r.expirationHandler)
 
 			e.With(r.authenticationMiddleware()).Get(logoutURL, r.logoutHandler)
+			if r.config.EnableFrontchannelLogout {
+				e.With(r.loginFlowMiddleware).Get(frontchannelLogoutURL, r.frontchannelLogoutHandler)
+			}
 			e.With(r.authenticationMiddleware()).Get(tokenURL, r.tokenHandler)
 
 			if r.config.EnableRefreshTokens {
 				e.With(r.authenticationMiddleware()).Get(refreshURL, r.refreshHandler)
 			}
 
-			e.Post(loginURL, r.loginHandler)
+			e.With(r.loginFlowMiddleware).Post(loginURL, r.loginHandler)
+
+			if r.config.EnableLoginReplay {
+				e.With(r.loginFlowMiddleware).Post(loginReplayURL, r.loginReplayHandler)
+			}
+
+			if r.config.EnableClientTokenHandler {
+				r.clientTokens = newClientTokenIssuer(r.config.ClientTokenRateLimit)
+				if store, ok := sharedRateLimitStore(r.store); ok && r.config.EnableDistributedRateLimit {
+					r.clientTokens.shared = newSharedRateLimit(clientTokenRateLimitName, store, r.config.ClientTokenRateLimit, clientTokenRateWindow, r.log)
+				}
+				e.Post(clientTokenURL, r.clientTokenHandler)
+			}
+
+			if r.config.EnableDeviceFlow {
+				r.deviceGrants = newDeviceGrants()
+				e.Post(deviceURL, r.deviceAuthorizationHandler)
+				e.Get(deviceURL+"/{device_code}", r.deviceTokenHandler)
+			}
 
 			if r.config.ListenAdmin == "" {
 				e.Mount("/", r.createAdminRoutes())
@@ -86,7 +392,7 @@ func (r *oauthProxy) createReverseProxy() error {
 	if r.config.ListenAdmin == "" {
 		// if no dedicated admin listener is set, publish debug routes on main listener
 		if debugEngine := r.createDebugRoutes(); debugEngine != nil {
-			engine.With(proxyDenyMiddleware).Mount(debugURL, debugEngine)
+			engine.With(r.routeMiddlewares(pipelineRouteDebug, nil)...).Mount(debugURL, debugEngine)
 		}
 	}
 
@@ -95,26 +401,44 @@ func (r *oauthProxy) createReverseProxy() error {
 		return err
 	}
 
+	// step: warn about the resources overriding less specific resources with weaker requirements
+	for _, conflict := range resourceConflicts(r.config.Resources) {
+		r.log.Warn("a resource overrides a less specific resource without its requirements",
+			zap.String("resource", conflict.winner.String()),
+			zap.String("overridden", conflict.overridden.String()),
+			zap.String("winner", conflict.winner.route()))
+	}
+
 	// step: provision the protected resources
 	addDefaultDeny := r.config.EnableDefaultDeny
 	for _, x := range r.config.Resources {
+		if err := x.compile(); err != nil {
+			return err
+		}
+		if x.isRegex() {
+			continue
+		}
 		if x.URL[len(x.URL)-1:] == "/" {
 			r.log.Warn("the resource url is not a prefix",
 				zap.String("resource", x.URL),
 				zap.String("change", x.URL),
 				zap.String("amended", strings.TrimRight(x.URL, "/")))
 		}
-		if x.URL == allRoutes && r.config.EnableDefaultDeny {
+		if x.URL == allRoutes && !x.isConditional() && r.config.EnableDefaultDeny {
 			addDefaultDeny = false
 		}
 	}
 
 	// step: define expected behaviour on default route: "/*"
-	if addDefaultDeny {
+	var defaultRoute http.Handler
+	if r.config.EnableDefaultDenyStrict {
+		// the requests matching no resource are refused before any stage of a route
+		r.routeMiddlewares(pipelineRouteDefaultDenyStrict, nil)
+		defaultRoute = http.HandlerFunc(r.unmatchedPathHandler)
+	} else if addDefaultDeny {
 		if r.config.EnableDefaultNotFound {
 			r.log.Info("routes which are not explicitly declared as resources will respond 401 not authenticated or 404 NotFound for authenticated users")
-			engine.With(r.authenticationMiddleware()).
-				Handle(allRoutes, http.HandlerFunc(methodNotFoundHandler))
+			defaultRoute = chi.Chain(r.routeMiddlewares(pipelineRouteDefaultNotFound, nil)...).HandlerFunc(methodNotFoundHandler)
 		} else {
 			r.log.Info("adding a default denial to protected resources: all routes to upstream require authentication")
 			r.config.Resources = append(r.config.Resources, &Resource{URL: allRoutes, Methods: allHTTPMethods})
@@ -124,56 +448,80 @@ func (r *oauthProxy) createReverseProxy() error {
 			// this setting kicks in only on default catch all route, not if one has been explicitly set up
 			foundAllRoutes := false
 			for _, x := range r.config.Resources {
-				if x.URL == allRoutes {
+				if x.URL == allRoutes && !x.isConditional() {
 					foundAllRoutes = true
 					break
 				}
 			}
 			if !foundAllRoutes {
 				r.log.Info("routes which are not explicitly declared as resources will respond 404 NotFound")
-				engine.Handle(allRoutes, http.HandlerFunc(methodNotFoundHandler))
+				defaultRoute = chi.Chain(r.routeMiddlewares(pipelineRouteDefaultNotFound, nil)...).HandlerFunc(methodNotFoundHandler)
 			}
 		} else {
 			r.log.Warn("routes to upstream are not configured to be denied by default")
-			engine.With(r.proxyMiddleware(nil)).HandleFunc(allRoutes, emptyHandler)
+			defaultRoute = chi.Chain(r.routeMiddlewares(pipelineRouteDefaultOpen, nil)...).HandlerFunc(emptyHandler)
 		}
 	}
 
+	// step: the resources sharing a uri are told apart by their header conditions, the url-regex resources are
+	// served by the catch-all route, when no other route matches the path
+	var (
+		uris        []string
+		regexRoutes []regexResourceRoute
+	)
+	sharing := make(map[string][]*Resource)
 	for _, x := range r.config.Resources {
 		r.log.Info("protecting resource", zap.String("resource", x.String()))
-		switch {
-		case !x.WhiteListed && !x.BlackListed:
-			e := engine.With(
-				r.proxyMiddleware(x),
-				r.authenticationMiddleware(),
-				r.admissionMiddleware(x),
-				r.identityHeadersMiddleware(r.config.AddClaims),
-				r.csrfSkipResourceMiddleware(x),
-				r.csrfProtectMiddleware(),
-				r.csrfHeaderMiddleware())
-			e.Handle(x.URL, http.HandlerFunc(methodNotAllowedHandler))
-			for _, m := range x.Methods {
-				e.MethodFunc(m, x.URL, emptyHandler)
-			}
-		case x.WhiteListed:
-			e := engine.With(
-				r.proxyMiddleware(x),
-			)
-			e.Handle(x.URL, http.HandlerFunc(methodNotAllowedHandler))
-			for _, m := range x.Methods {
-				e.MethodFunc(m, x.URL, emptyHandler)
+		if x.isRegex() {
+			regexRoutes = append(regexRoutes, regexResourceRoute{resource: x, handler: r.resourceHandler(x)})
+			continue
+		}
+		if _, found := sharing[x.URL]; !found {
+			uris = append(uris, x.URL)
+		}
+		sharing[x.URL] = append(sharing[x.URL], x)
+	}
+	if r.config.EnableDefaultDenyStrict {
+		r.logResourcesSummary()
+	}
+	catchAll := defaultRoute
+	if resources, found := sharing[allRoutes]; found {
+		catchAll = r.conditionalResourcesHandler(resources, defaultRoute)
+	}
+	if len(regexRoutes) > 0 {
+		catchAll = regexResourcesMiddleware(regexRoutes)(catchAll)
+	}
+	engine.Handle(allRoutes, catchAll)
+
+	// step: the routes of the other uris, the least specific first: the requests meeting none of the header conditions
+	// of the resources of a uri are served by the route of the next less specific uri, as if it was not declared
+	sort.SliceStable(uris, func(i, j int) bool {
+		return sharing[uris[j]][0].precedes(sharing[uris[i]][0])
+	})
+	routes := make(map[string]http.Handler, len(uris))
+	for _, uri := range uris {
+		if uri == allRoutes {
+			continue
+		}
+		resources := sharing[uri]
+		fallback, covering := catchAll, ""
+		for other := range routes {
+			x := sharing[other][0]
+			if x.isPrefix() && strings.HasPrefix(resources[0].prefix(), x.prefix()) && len(x.prefix()) >= len(covering) {
+				fallback, covering = routes[other], x.prefix()
 			}
-		case x.BlackListed:
-			fallthrough
-		default:
-			engine.Handle(x.URL, http.HandlerFunc(r.forbiddenHandler))
 		}
+		routes[uri] = r.conditionalResourcesHandler(resources, fallback)
+		engine.Handle(uri, routes[uri])
 	}
 
 	// startup information
 
 	if r.config.EnableSessionCookies {
 		r.log.Info("using session cookies only for access and refresh tokens")
+		if r.config.EnableOfflineTokens {
+			r.log.Warn("the offline sessions end when the browser is closed, as the session cookies are enabled")
+		}
 	}
 
 	for name, value := range r.config.MatchClaims {
@@ -192,6 +540,10 @@ func (r *oauthProxy) createReverseProxy() error {
 		r.log.Info("session access tokens will be encrypted")
 	}
 
+	if r.config.EnableDebugAuthorization && !r.config.Verbose {
+		r.log.Warn("debug-authorization is enabled without verbose logging: authorization traces will not be logged")
+	}
+
 	if r.config.SkipUpstreamTLSVerify && r.config.UpstreamCA != "" {
 		r.log.Warn("you have specified an upstream CA to check, but have left the skip-upstream-tls-verify parameter to true (the default)")
 	}
@@ -199,13 +551,103 @@ func (r *oauthProxy) createReverseProxy() error {
 	return nil
 }
 
+// conditionalResourcesHandler serves the requests with the first of the resources of a uri which header conditions
+// they meet, or with the fallback when they meet none
+func (r *oauthProxy) conditionalResourcesHandler(resources []*Resource, fallback http.Handler) http.Handler {
+	if len(resources) == 1 && !resources[0].isConditional() {
+		return r.resourceHandler(resources[0])
+	}
+	if fallback == nil {
+		fallback = http.HandlerFunc(methodNotFoundHandler)
+	}
+	handlers := make([]http.Handler, 0, len(resources))
+	for i, x := range resources {
+		if !x.isConditional() && i < len(resources)-1 {
+			r.log.Warn("the resource has no header conditions, the resources of its uri declared after it never apply",
+				zap.String("resource", x.String()))
+		}
+		handlers = append(handlers, r.resourceHandler(x))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i, x := range resources {
+			if x.matchesHeaders(req.Header) {
+				handlers[i].ServeHTTP(w, req)
+				return
+			}
+		}
+		fallback.ServeHTTP(w, req)
+	})
+}
+
+// resourceHandler returns the handler of the route of a resource, built as the router builds the routes of the
+// resources with a uri of their own
+func (r *oauthProxy) resourceHandler(x *Resource) http.Handler {
+	if x.BlackListed {
+		return chi.Chain(r.routeMiddlewares(pipelineRouteBlackListed, x)...).HandlerFunc(r.forbiddenHandler)
+	}
+	kind := pipelineRouteProtected
+	if x.WhiteListed {
+		kind = pipelineRouteWhiteListed
+	}
+
+	return chi.Chain(r.routeMiddlewares(kind, x)...).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !containsString(req.Method, x.Methods) {
+			methodNotAllowedHandler(w, req)
+			return
+		}
+		emptyHandler(w, req)
+	})
+}
+
+// unmatchedPathHandler refuses the requests which path matches no resource, with enable-default-deny-strict
+func (r *oauthProxy) unmatchedPathHandler(w http.ResponseWriter, req *http.Request) {
+	_, logger := r.traceSpanRequest(req)
+	logger.Warn("access denied, the path matches no resource (enable-default-deny-strict)",
+		zap.String("access", "denied"),
+		zap.String("method", req.Method),
+		zap.String("path", req.URL.Path),
+		zap.Stringer("client_ip", r.clientIP(req)))
+
+	r.accessForbidden(w, req, "access denied")
+}
+
+// logResourcesSummary logs the routes of the resources by kind, with the note that the other paths are refused
+func (r *oauthProxy) logResourcesSummary() {
+	var protected, whiteListed, blackListed []string
+	for _, x := range r.config.Resources {
+		location := x.route()
+		if x.isConditional() {
+			location += " [" + x.conditions() + "]"
+		}
+		switch {
+		case x.WhiteListed:
+			whiteListed = append(whiteListed, location)
+		case x.BlackListed:
+			blackListed = append(blackListed, location)
+		default:
+			protected = append(protected, location)
+		}
+		if x.URL == allRoutes && !x.isConditional() {
+			r.log.Warn("the resource matches all the paths, the strict default denial never applies", zap.String("resource", x.String()))
+		}
+	}
+	r.log.Info("resources summary",
+		zap.Strings("protected", protected),
+		zap.Strings("white_listed", whiteListed),
+		zap.Strings("black_listed", blackListed))
+	r.log.Warn("STRICT DEFAULT DENY IS ACTIVE: the requests which path matches none of these resources are refused with a 403, the oauth endpoints remain reachable",
+		zap.Int("resources", len(r.config.Resources)),
+		zap.String("oauth", r.config.WithOAuthURI("*")))
+}
+
 // proxyMiddleware is responsible for handling reverse proxy request to the upstream endpoint
 func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http.Handler {
 	var upstreamHost, upstreamScheme, upstreamBasePath, stripBasePath, matched string
 	if resource != nil && resource.Upstream != "" {
 		// resource-specific routing to upstream
 		u, _ := url.Parse(resource.Upstream)
-		matched = resource.URL
+		matched = resource.route()
 		upstreamHost = u.Host
 		upstreamScheme = u.Scheme
 		upstreamBasePath = u.Path
@@ -215,8 +657,10 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 		upstreamScheme = r.endpoint.Scheme
 		upstreamBasePath = r.endpoint.Path
 	}
+	var resourceLabel string
 	if resource != nil {
 		stripBasePath = resource.StripBasePath
+		resourceLabel = resource.route()
 	}
 
 	// config-driven header setters
@@ -236,21 +680,25 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 			}
 		})
 	}
-	cookieFilter := make([]string, 0, 4)
-	cookieFilter = append(cookieFilter, requestURICookie, requestStateCookie)
+	cookieFilter := make([]string, 0, 4+len(r.config.FilterCookies))
+	cookieFilter = append(cookieFilter, r.filteredCookieNames(requestURICookie, requestStateCookie, activityCookie, pkceCookie)...)
+	cookieFilter = append(cookieFilter, r.config.FilterCookies...)
 	if r.config.EnableCSRF {
 		setters = append(setters, func(req *http.Request) {
 			// remove csrf header
 			req.Header.Del(r.config.CSRFHeader)
 		})
-		cookieFilter = append(cookieFilter, r.config.CSRFCookieName)
+		cookieFilter = append(cookieFilter, r.filteredCookieNames(r.config.CSRFCookieName)...)
 	}
 	if !r.config.EnableAuthorizationCookies {
-		cookieFilter = append(cookieFilter, r.config.CookieAccessName, r.config.CookieRefreshName)
+		cookieFilter = append(cookieFilter, r.filteredCookieNames(r.config.CookieAccessName, r.config.CookieRefreshName)...)
+		if r.config.CookieIDTokenName != "" {
+			cookieFilter = append(cookieFilter, r.filteredCookieNames(r.config.CookieIDTokenName)...)
+		}
 	}
 	setters = append(setters, func(req *http.Request) {
 		// cookies filtered to upstream
-		_ = filterCookies(req, cookieFilter)
+		_ = filterCookies(req, cookieFilter, r.config.CookieFilterMode == cookieFilterDrop)
 	})
 
 	setHeaders := func(req *http.Request) {
@@ -270,9 +718,11 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 			}
 
 			// @step: retrieve the request scope
+			var sc *RequestScope
 			scope := req.Context().Value(contextScopeName)
 			if scope != nil {
-				sc, ok := scope.(*RequestScope)
+				var ok bool
+				sc, ok = scope.(*RequestScope)
 				if !ok {
 					panic("corrupted context: expected *RequestScope")
 				}
@@ -287,12 +737,25 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 			}
 
 			// @step: add the proxy forwarding headers
-			req.Header.Add("X-Forwarded-For", realIP(req)) // TODO(fredbi): check if still necessary with net/http/httputil reverse proxy
-			req.Header.Set("X-Forwarded-Host", req.Host)
-			if fp := req.Header.Get("X-Forwarded-Proto"); fp != "" {
-				req.Header.Set("X-Forwarded-Proto", fp)
+			if r.config.ForwardedHeaders != forwardedHeadersForwarded {
+				req.Header.Add("X-Forwarded-For", realIP(req)) // TODO(fredbi): check if still necessary with net/http/httputil reverse proxy
+				req.Header.Set("X-Forwarded-Host", req.Host)
+				if fp := req.Header.Get("X-Forwarded-Proto"); fp != "" {
+					req.Header.Set("X-Forwarded-Proto", fp)
+				} else {
+					req.Header.Set("X-Forwarded-Proto", upstreamScheme)
+				}
 			} else {
-				req.Header.Set("X-Forwarded-Proto", upstreamScheme)
+				// a nil value prevents the reverse proxy from adding X-Forwarded-For
+				req.Header[headerXForwardedFor] = nil
+				req.Header.Del("X-Forwarded-Host")
+				req.Header.Del("X-Forwarded-Proto")
+			}
+			if r.config.ForwardedHeaders != forwardedHeadersXForward {
+				r.appendForwarded(req)
+			} else if peer, _, _ := net.SplitHostPort(req.RemoteAddr); !isTrustedProxy(net.ParseIP(peer), r.trustedProxies) {
+				// the Forwarded header of an untrusted peer is not relayed, even though we do not append to it
+				req.Header.Del(headerForwarded)
 			}
 
 			// config-driven headers
@@ -319,7 +782,14 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 			}
 			logger.Debug("proxying to upstream", zap.String("matched_resource", matched), zap.Stringer("upstream_url", req.URL), zap.String("host_header", req.Host))
 
-			r.upstream.ServeHTTP(w, req)
+			if sc != nil && !sc.Started.IsZero() {
+				// @metric record the time spent by the proxy before going upstream
+				sc.Resource = resourceLabel
+				sc.UpstreamStarted = time.Now()
+				authDurationMetric.WithLabelValues(resourceLabel, req.Method).Observe(sc.UpstreamStarted.Sub(sc.Started).Seconds())
+			}
+
+			r.upstreamOf(resource).ServeHTTP(w, req)
 
 			if r.config.Verbose {
 				// debug response headers
@@ -329,13 +799,31 @@ func (r *oauthProxy) proxyMiddleware(resource *Resource) func(http.Handler) http
 	}
 }
 
+// appendForwarded appends the element describing the hop from our peer to the Forwarded header sent upstream.
+//
+// The Forwarded header sent by a peer which is not a trusted proxy is dropped.
+func (r *oauthProxy) appendForwarded(req *http.Request) {
+	peer, _, _ := net.SplitHostPort(req.RemoteAddr)
+	values := req.Header.Values(headerForwarded)
+	if !isTrustedProxy(net.ParseIP(peer), r.trustedProxies) {
+		values = nil
+	}
+
+	element := forwardedElement{For: "unknown", Host: req.Host, Proto: unsecureScheme}
+	if peer != "" {
+		element.For = formatForwardedNode(peer)
+	}
+	if req.TLS != nil {
+		element.Proto = secureScheme
+	}
+	req.Header.Set(headerForwarded, strings.Join(append(values, formatForwardedElement(element)), ", "))
+}
+
 // createStdProxy creates a reverse http proxy client to the upstream
 // TODO(fredbi): support multiple proxies with possibly different dialers and TLS configs
 func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
-	dialer := (&net.Dialer{
-		KeepAlive: r.config.UpstreamKeepaliveTimeout,
-		Timeout:   r.config.UpstreamTimeout, // NOTE(http2): in order to properly receive response headers, this have to be less than ServerWriteTimeout
-	}).DialContext
+	// NOTE(http2): in order to properly receive response headers, the timeout has to be less than ServerWriteTimeout
+	dialer := newDialer("upstream-local-address", r.config.UpstreamLocalAddress, r.config.UpstreamTimeout, r.config.UpstreamKeepaliveTimeout)
 
 	// are we using a unix socket?
 	// TODO(fredbi): this does not work with multiple upstream configuration
@@ -357,9 +845,73 @@ func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
 	if err != nil {
 		return err
 	}
+	if r.upstream, err = r.newUpstreamProxy(dialer, tlsConfig); err != nil {
+		return err
+	}
+
+	// step: the resources with their own upstream tls settings get their own transport, one per distinct settings
+	r.resourceUpstreams = make(map[*Resource]reverseProxy)
+	proxies := make(map[UpstreamTLS]reverseProxy)
+	for _, resource := range r.config.Resources {
+		if resource.UpstreamTLS == nil {
+			continue
+		}
+		proxy, found := proxies[*resource.UpstreamTLS]
+		if !found {
+			if tlsConfig, err = r.buildUpstreamTLSConfig(resource.UpstreamTLS); err != nil {
+				return fmt.Errorf("invalid upstream tls settings for resource %s: %w", resource.route(), err)
+			}
+			if proxy, err = r.newUpstreamProxy(dialer, tlsConfig); err != nil {
+				return err
+			}
+			proxies[*resource.UpstreamTLS] = proxy
+		}
+		r.resourceUpstreams[resource] = proxy
+	}
+	r.warnUnverifiedUpstreams(upstream)
 
+	return nil
+}
+
+// warnUnverifiedUpstreams warns once about each https upstream which certificate is not verified
+func (r *oauthProxy) warnUnverifiedUpstreams(upstream *url.URL) {
+	warned := make(map[string]bool)
+	warn := func(location string, skipVerify bool) {
+		u, err := url.Parse(location)
+		if err != nil || u.Scheme != secureScheme || !skipVerify || warned[location] {
+			return
+		}
+		warned[location] = true
+		r.warnSkippedVerification(location)
+	}
+	if upstream != nil {
+		warn(upstream.String(), r.config.SkipUpstreamTLSVerify)
+	}
+	for _, resource := range r.config.Resources {
+		location := resource.Upstream
+		if location == "" && upstream != nil {
+			location = upstream.String()
+		}
+		if resource.UpstreamTLS != nil {
+			warn(location, resource.UpstreamTLS.SkipVerify)
+			continue
+		}
+		warn(location, r.config.SkipUpstreamTLSVerify)
+	}
+}
+
+// upstreamOf returns the reverse proxy to the upstream of a resource
+func (r *oauthProxy) upstreamOf(resource *Resource) reverseProxy {
+	if proxy, found := r.resourceUpstreams[resource]; found {
+		return proxy
+	}
+
+	return r.upstream
+}
+
+// newUpstreamProxy creates a reverse proxy to the upstreams, with its own transport
+func (r *oauthProxy) newUpstreamProxy(dialer dialFunc, tlsConfig *tls.Config) (reverseProxy, error) {
 	transport := &http.Transport{
-		ForceAttemptHTTP2:     true,
 		DialContext:           dialer,
 		TLSClientConfig:       tlsConfig,
 		TLSHandshakeTimeout:   r.config.UpstreamTLSHandshakeTimeout,
@@ -369,10 +921,17 @@ func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
 		ExpectContinueTimeout: r.config.UpstreamExpectContinueTimeout,
 		ResponseHeaderTimeout: r.config.UpstreamResponseHeaderTimeout,
 	}
-	if err = http2.ConfigureTransport(transport); err != nil {
-		return err
+	if r.config.UpstreamEnableHTTP2 {
+		transport.ForceAttemptHTTP2 = true
+		if err := http2.ConfigureTransport(transport); err != nil {
+			return nil, err
+		}
+	} else {
+		// a non-nil map disables the upgrade to http/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
 	}
-	r.upstream = &httputil.ReverseProxy{
+
+	return &httputil.ReverseProxy{
 		Director:  func(*http.Request) {}, // most of the work is already done by middleware above. Some of this could be done by Director just as well
 		Transport: transport,
 		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
@@ -382,10 +941,25 @@ func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
 				span.SetStatus(trace.Status{Code: trace.StatusCodeInternal, Message: err.Error()})
 			}
 
+			if isRequestBodyTooLarge(req) {
+				// the violation is already logged (sampled), the upstream request is aborted rather than truncated
+				errorResponse(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			logger.Warn("reverse proxy error", zap.Error(err))
-			r.errorResponse(w, req, "", http.StatusBadGateway, err)
+			r.upstreamFailure(w, req, upstreamFailureStatus(err), err)
 		},
 		ModifyResponse: func(res *http.Response) error {
+			// @metric record the time taken by the upstream to respond
+			if sc, ok := res.Request.Context().Value(contextScopeName).(*RequestScope); ok && !sc.UpstreamStarted.IsZero() {
+				upstreamDurationMetric.WithLabelValues(sc.Resource, res.Request.Method).Observe(time.Since(sc.UpstreamStarted).Seconds())
+			}
+			// the client offered the subprotocol carrying its token, which must be echoed when no other is negotiated
+			if sc, ok := res.Request.Context().Value(contextScopeName).(*RequestScope); ok && sc.WebSocketSubprotocol != "" &&
+				res.StatusCode == http.StatusSwitchingProtocols && res.Header.Get(headerWebSocketProtocol) == "" {
+				res.Header.Set(headerWebSocketProtocol, sc.WebSocketSubprotocol)
+			}
+
 			if r.config.Verbose {
 				// debug response headers
 				r.log.Debug("response from upstream",
@@ -415,6 +989,15 @@ func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
 			for hdr := range r.config.Headers {
 				res.Header.Del(hdr)
 			}
+			// the static response headers override those of the upstream
+			for hdr := range r.config.ResponseHeaders {
+				res.Header.Del(hdr)
+			}
+			if sc, ok := res.Request.Context().Value(contextScopeName).(*RequestScope); ok {
+				for hdr := range sc.ResponseHeaders {
+					res.Header.Del(hdr)
+				}
+			}
 
 			if len(r.config.CorsOrigins) > 0 {
 				// remove cors headers from upstream
@@ -428,22 +1011,46 @@ func (r *oauthProxy) createStdProxy(upstream *url.URL) error {
 			}
 			return nil
 		},
+	}, nil
+}
+
+// createTemplates loads the custom template
+func (r *oauthProxy) createTemplates() error {
+	var list []string
+
+	if r.config.SignInPage != "" {
+		r.log.Debug("loading the custom sign in page", zap.String("page", r.config.SignInPage))
+		list = append(list, r.config.SignInPage)
+	}
+
+	if r.config.ForbiddenPage != "" {
+		r.log.Debug("loading the custom sign forbidden page", zap.String("page", r.config.ForbiddenPage))
+		list = append(list, r.config.ForbiddenPage)
+	}
+
+	if r.config.UnauthorizedPage != "" {
+		r.log.Debug("loading the custom unauthorized page", zap.String("page", r.config.UnauthorizedPage))
+		list = append(list, r.config.UnauthorizedPage)
+	}
+
+	if r.config.ErrorPage != "" {
+		r.log.Debug("loading the custom error page", zap.String("page", r.config.ErrorPage))
+		list = append(list, r.config.ErrorPage)
+	}
+
+	if len(list) > 0 {
+		r.log.Info("loading the custom templates", zap.String("templates", strings.Join(list, ",")))
+		templates, err := template.ParseFiles(list...)
+		if err != nil {
+			return fmt.Errorf("unable to load the custom templates: %w", err)
+		}
+		r.templates = templates
 	}
 
 	return nil
 }
 
-func (r *oauthProxy) useCors(engine chi.Router) {
-	if len(r.config.CorsOrigins) > 0 {
-		c := cors.New(cors.Options{
-			AllowedOrigins:   r.config.CorsOrigins,
-			AllowedMethods:   r.config.CorsMethods,
-			AllowedHeaders:   r.config.CorsHeaders,
-			AllowCredentials: r.config.CorsCredentials,
-			ExposedHeaders:   r.config.CorsExposedHeaders,
-			MaxAge:           int(r.config.CorsMaxAge.Seconds()),
-			Debug:            r.config.Verbose,
-		})
-		engine.Use(c.Handler)
-	}
+// Render implements the echo Render interface
+func (r *oauthProxy) Render(w io.Writer, name string, data interface{}) error {
+	return r.templates.ExecuteTemplate(w, name, data)
 }
@@ -0,0 +1,184 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// revocationShards is the number of shards of the revocation set, so that the writers do not contend on a lock
+	revocationShards = 32
+	// revocationsReloadInterval is the interval between two reloads of the revocations persisted in the store, e.g. by
+	// the other replicas
+	revocationsReloadInterval = time.Minute
+)
+
+// revocationSet holds the revocations of the sessions, checked on every request: the tokens of a revoked subject
+// issued before the revocation are refused. A revocation is forgotten after the maximum lifetime of the refresh
+// tokens, as no session opened before it is left by then, and the oldest revocations are evicted beyond the capacity.
+type revocationSet struct {
+	shards [revocationShards]revocationShard
+	// all is the time of the revocation of all the sessions in unix ns, zero if none
+	all    int64
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+// revocationShard holds the revocations of the subjects hashed to the shard
+type revocationShard struct {
+	sync.RWMutex
+	// entries indexes the elements of the order list by subject
+	entries map[string]*list.Element
+	// order holds the revocations, the latest recorded first
+	order      *list.List
+	maxEntries int
+}
+
+type revocation struct {
+	subject string
+	at      time.Time
+}
+
+// newRevocationSet creates a revocation set holding up to the max entries, spread over the shards
+func newRevocationSet(maxEntries int, maxAge time.Duration, now func() time.Time) *revocationSet {
+	set := &revocationSet{maxAge: maxAge, now: now}
+	perShard := (maxEntries + revocationShards - 1) / revocationShards
+	for i := range set.shards {
+		set.shards[i].entries = make(map[string]*list.Element)
+		set.shards[i].order = list.New()
+		set.shards[i].maxEntries = perShard
+	}
+
+	return set
+}
+
+// add records the revocation of the sessions of a subject at a time, or of all the sessions when the subject is empty
+func (r *revocationSet) add(subject string, at time.Time) {
+	if subject == "" {
+		for {
+			current := atomic.LoadInt64(&r.all)
+			if current >= at.UnixNano() || atomic.CompareAndSwapInt64(&r.all, current, at.UnixNano()) {
+				return
+			}
+		}
+	}
+
+	shard := r.shard(subject)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if e, found := shard.entries[subject]; found {
+		if entry := e.Value.(*revocation); at.After(entry.at) {
+			entry.at = at
+		}
+		shard.order.MoveToFront(e)
+	} else {
+		shard.entries[subject] = shard.order.PushFront(&revocation{subject: subject, at: at})
+	}
+	// the expired revocations are pruned from the oldest, then the oldest beyond the capacity are evicted
+	expired := r.now().Add(-r.maxAge)
+	for e := shard.order.Back(); e != nil && !e.Value.(*revocation).at.After(expired); e = shard.order.Back() {
+		shard.remove(e)
+		revocationEvictionsMetric.WithLabelValues("expired").Inc()
+	}
+	for shard.order.Len() > shard.maxEntries {
+		shard.remove(shard.order.Back())
+		revocationEvictionsMetric.WithLabelValues("capacity").Inc()
+	}
+}
+
+// revoked tells if a token of the subject issued at the time belongs to a revoked session
+func (r *revocationSet) revoked(subject string, issuedAt time.Time) bool {
+	if all := atomic.LoadInt64(&r.all); all != 0 && r.refuses(time.Unix(0, all), issuedAt) {
+		return true
+	}
+
+	shard := r.shard(subject)
+	shard.RLock()
+	e, found := shard.entries[subject]
+	var at time.Time
+	if found {
+		at = e.Value.(*revocation).at
+	}
+	shard.RUnlock()
+
+	return found && r.refuses(at, issuedAt)
+}
+
+// refuses tells if a revocation, which has not expired, is later than the issuance of a token. The issuance is dated
+// to the second by the iat claim, so the tokens issued within the second of the revocation are accepted, e.g. on the
+// login which follows it. A token without iat cannot be dated after the revocation, and is refused until it expires.
+func (r *revocationSet) refuses(at, issuedAt time.Time) bool {
+	if !at.After(r.now().Add(-r.maxAge)) {
+		return false
+	}
+
+	return issuedAt.IsZero() || issuedAt.Before(at.Truncate(time.Second))
+}
+
+// shard returns the shard of a subject, by its fnv-1a hash
+func (r *revocationSet) shard(subject string) *revocationShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(subject); i++ {
+		hash ^= uint32(subject[i])
+		hash *= 16777619
+	}
+
+	return &r.shards[hash%revocationShards]
+}
+
+func (r *revocationShard) remove(e *list.Element) {
+	r.order.Remove(e)
+	delete(r.entries, e.Value.(*revocation).subject)
+}
+
+// revokeSubject refuses the tokens already issued to the subject, or to all the subjects when empty, and keeps the
+// revocation in the store when persisted
+func (r *oauthProxy) revokeSubject(subject string) {
+	if r.revocations == nil {
+		return
+	}
+	at := r.now()
+	r.revocations.add(subject, at)
+	if r.config.EnableSessionRevocationPersistence {
+		if err := r.persistRevocation(subject, at); err != nil {
+			r.log.Warn("unable to keep the revocation in the store, it is lost on restart", zap.Error(err))
+		}
+	}
+}
+
+// reloadRevocations reloads the revocations persisted in the store at every interval, until the context is done
+func (r *oauthProxy) reloadRevocations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.loadRevocations(); err != nil {
+				r.log.Warn("unable to reload the revocations from the store", zap.Error(err))
+			}
+		}
+	}
+}
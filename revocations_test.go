@@ -0,0 +1,157 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationSet(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	set := newRevocationSet(100, time.Hour, func() time.Time { return now })
+	issued := now
+	now = now.Add(time.Second)
+	set.add("alice", now.Add(300*time.Millisecond))
+
+	assert.True(t, set.revoked("alice", issued))
+	assert.False(t, set.revoked("alice", now), "a token issued within the second of the revocation is accepted")
+	assert.False(t, set.revoked("alice", now.Add(time.Second)), "a token issued after the revocation is accepted")
+	assert.True(t, set.revoked("alice", time.Time{}), "a token without iat is refused")
+	assert.False(t, set.revoked("bob", issued))
+	assert.False(t, set.revoked("bob", time.Time{}))
+	// an earlier revocation does not lift the latest
+	set.add("alice", issued.Add(-time.Minute))
+	assert.True(t, set.revoked("alice", now))
+
+	// the revocations are forgotten after the max age
+	now = now.Add(time.Hour)
+	assert.False(t, set.revoked("alice", issued))
+
+	// the revocation of all the sessions
+	set.add("", now)
+	assert.True(t, set.revoked("bob", now.Add(-time.Second)))
+	assert.False(t, set.revoked("bob", now))
+	assert.True(t, set.revoked("bob", time.Time{}))
+	now = now.Add(time.Hour)
+	assert.False(t, set.revoked("bob", issued))
+	assert.False(t, set.revoked("bob", time.Time{}), "a token without iat is accepted once the revocation is forgotten")
+}
+
+func TestRevocationSetEviction(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	// a single revocation per shard
+	set := newRevocationSet(revocationShards, time.Hour, func() time.Time { return now })
+	first, second := "subject-0", ""
+	for i := 1; second == ""; i++ {
+		if subject := fmt.Sprintf("subject-%d", i); set.shard(subject) == set.shard(first) {
+			second = subject
+		}
+	}
+
+	capacity := testutil.ToFloat64(revocationEvictionsMetric.WithLabelValues("capacity"))
+	set.add(first, now)
+	set.add(second, now)
+	assert.False(t, set.revoked(first, now.Add(-time.Second)), "the oldest revocation is evicted beyond the capacity")
+	assert.True(t, set.revoked(second, now.Add(-time.Second)))
+	assert.Equal(t, capacity+1, testutil.ToFloat64(revocationEvictionsMetric.WithLabelValues("capacity")))
+
+	// the expired revocations are pruned by the next revocation of the shard
+	expired := testutil.ToFloat64(revocationEvictionsMetric.WithLabelValues("expired"))
+	now = now.Add(2 * time.Hour)
+	set.add(first, now)
+	assert.Equal(t, 1, set.shard(first).order.Len())
+	assert.Equal(t, expired+1, testutil.ToFloat64(revocationEvictionsMetric.WithLabelValues("expired")))
+	assert.Equal(t, capacity+1, testutil.ToFloat64(revocationEvictionsMetric.WithLabelValues("capacity")))
+}
+
+func TestRevokedSessionIsRefused(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	p := newFakeProxy(cfg)
+	p.proxy.revocations = newRevocationSet(100, time.Hour, time.Now)
+	subject, ok := defaultTestTokenClaims["sub"].(string)
+	require.True(t, ok)
+	// the sessions were revoked a minute ago
+	revokedAt := time.Now().Add(-time.Minute)
+	p.proxy.revocations.add(subject, revokedAt)
+
+	p.RunTests(t, []fakeRequest{
+		{
+			// the token was issued before the revocation
+			URI:          fakeAuthAllURL + "/test",
+			HasToken:     true,
+			TokenClaims:  jose.Claims{"iat": float64(time.Now().Add(-2 * time.Minute).Unix())},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			// the token was issued within the second of the revocation, e.g. by the login which followed it
+			URI:           fakeAuthAllURL + "/test",
+			HasToken:      true,
+			TokenClaims:   jose.Claims{"iat": float64(revokedAt.Unix())},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           fakeAuthAllURL + "/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+}
+
+func newBenchmarkRevocationSet(subjects []string) *revocationSet {
+	set := newRevocationSet(len(subjects), time.Hour, time.Now)
+	for i := range subjects {
+		subjects[i] = fmt.Sprintf("subject-%d", i)
+		set.add(subjects[i], time.Now())
+	}
+
+	return set
+}
+
+func BenchmarkRevocationSetRevoked(b *testing.B) {
+	subjects := make([]string, 10000)
+	set := newBenchmarkRevocationSet(subjects)
+	issued := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			set.revoked(subjects[i%len(subjects)], issued)
+		}
+	})
+}
+
+func BenchmarkRevocationSetAdd(b *testing.B) {
+	subjects := make([]string, 10000)
+	set := newBenchmarkRevocationSet(subjects)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			set.add(subjects[i%len(subjects)], time.Now())
+		}
+	})
+}
@@ -35,6 +35,10 @@ type certificationRotation struct {
 	privateKeyFile string
 	// the logger for this service
 	log *zap.Logger
+	// stapler attaches the OCSP response to the certificate, when enabled
+	stapler *ocspStapler
+	// expiries tracks the expiry of the certificate, when reported
+	expiries *certificateExpiries
 }
 
 // newCertificateRotator creates a new certificate
@@ -110,14 +114,39 @@ func (c *certificationRotation) storeCertificate(certifacte tls.Certificate) err
 	c.Lock()
 	defer c.Unlock()
 	c.certificate = certifacte
+	c.expiries.record(certificatePurposeListener, c.certificateFile, certifacte)
+	if c.stapler != nil {
+		// the OCSP response of the previous certificate does not apply
+		c.stapler.update(certifacte)
+	}
 
 	return nil
 }
 
+// trackExpiry reports the expiry of the certificate, and of the ones replacing it
+func (c *certificationRotation) trackExpiry(expiries *certificateExpiries) {
+	c.Lock()
+	defer c.Unlock()
+	c.expiries = expiries
+	expiries.record(certificatePurposeListener, c.certificateFile, c.certificate)
+}
+
+// enableOCSPStapling starts fetching the OCSP response for the certificate, and staples it
+func (c *certificationRotation) enableOCSPStapling() {
+	c.Lock()
+	defer c.Unlock()
+	c.stapler = newOCSPStapler(c.certificate, c.log)
+}
+
 // GetCertificate is responsible for retrieving
 func (c *certificationRotation) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	c.RLock()
 	defer c.RUnlock()
 
+	if c.stapler != nil {
+		certificate := c.stapler.stapled(c.certificate)
+		return &certificate, nil
+	}
+
 	return &c.certificate, nil
 }
@@ -0,0 +1,208 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/oidc"
+)
+
+// Status of a self-test step
+const (
+	selfTestPassed  = "passed"
+	selfTestFailed  = "failed"
+	selfTestSkipped = "skipped"
+)
+
+// errSelfTestSkipped is returned by the self-test steps which do not apply to the configuration
+var errSelfTestSkipped = errors.New("skipped")
+
+// selfTestStep is the outcome of a step of the self-test
+type selfTestStep struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_ms"`
+	Message  string  `json:"message,omitempty"`
+}
+
+// selfTestReport is the outcome of the self-test
+type selfTestReport struct {
+	Passed bool           `json:"passed"`
+	Steps  []selfTestStep `json:"steps"`
+}
+
+// run runs a step, which is skipped whenever a step it depends on did not pass
+func (s *selfTestReport) run(name string, ready bool, step func() (string, error)) bool {
+	result := selfTestStep{Name: name, Status: selfTestSkipped}
+	defer func() {
+		s.Steps = append(s.Steps, result)
+	}()
+	if !ready {
+		result.Message = "a previous step did not pass"
+		return false
+	}
+
+	start := time.Now()
+	message, err := step()
+	result.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+	switch {
+	case errors.Is(err, errSelfTestSkipped):
+		result.Message = message
+		return false
+	case err != nil:
+		result.Status, result.Message = selfTestFailed, err.Error()
+		s.Passed = false
+		return false
+	default:
+		result.Status, result.Message = selfTestPassed, message
+		return true
+	}
+}
+
+// selfTest exercises the login flow against the provider, from the discovery to the upstream, using either
+// the configured test user or the client credentials
+func (r *oauthProxy) selfTest(ctx context.Context) *selfTestReport {
+	report := &selfTestReport{Passed: true, Steps: make([]selfTestStep, 0, 6)}
+
+	verified := r.client != nil
+	discovered := report.run("discovery", true, func() (string, error) {
+		if !verified {
+			return "token verification is disabled", errSelfTestSkipped
+		}
+		config, err := oidc.FetchProviderConfig(r.idpClient, r.config.DiscoveryURL)
+		if err != nil {
+			return "", err
+		}
+		if config.TokenEndpoint == nil {
+			return "", errors.New("the provider does not publish a token endpoint")
+		}
+		if err = r.config.isProviderConfigValid(config); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("issuer: %s", config.Issuer), nil
+	})
+
+	var accessToken string
+	obtained := report.run("token", discovered, func() (string, error) {
+		client, err := r.client.OAuthClient()
+		if err != nil {
+			return "", err
+		}
+		if r.config.SelfTestUsername != "" {
+			token, err := client.UserCredsToken(r.config.SelfTestUsername, r.config.SelfTestPassword)
+			if err != nil {
+				return "", err
+			}
+			accessToken = token.AccessToken
+
+			return "grant_type: password", nil
+		}
+		token, err := client.ClientCredsToken(r.config.Scopes)
+		if err != nil {
+			return "", err
+		}
+		accessToken = token.AccessToken
+
+		return "grant_type: client_credentials", nil
+	})
+
+	var user *userContext
+	identified := report.run("identity", obtained, func() (string, error) {
+		token, _, err := parseToken(accessToken)
+		if err != nil {
+			return "", err
+		}
+		if err = r.verifyToken(r.client, token); err != nil {
+			return "", err
+		}
+		if user, err = extractIdentity(token, r.config.identityClaims()); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("user: %s, roles: %s", user.name, strings.Join(user.roles, ",")), nil
+	})
+
+	report.run("authorization", identified, func() (string, error) {
+		return r.selfTestAuthorization(r.config.SelfTestPath, user)
+	})
+
+	report.run("cookie", obtained, func() (string, error) {
+		if r.config.EncryptionKey == "" {
+			return "no encryption key configured", errSelfTestSkipped
+		}
+		encrypted, err := encodeText(accessToken, r.config.EncryptionKey)
+		if err != nil {
+			return "", err
+		}
+		decrypted, err := decodeText(encrypted, r.config.EncryptionKey)
+		if err != nil {
+			return "", err
+		}
+		if decrypted != accessToken {
+			return "", errors.New("the decrypted cookie does not match the token")
+		}
+
+		return fmt.Sprintf("encrypted cookie size: %d", len(encrypted)), nil
+	})
+
+	report.run("upstream", true, func() (string, error) {
+		return r.selfTestUpstream(ctx)
+	})
+
+	return report
+}
+
+// selfTestUpstream checks the upstream accepts connections
+func (r *oauthProxy) selfTestUpstream(ctx context.Context) (string, error) {
+	if r.config.EnableForwarding || r.config.Upstream == "" {
+		return "no upstream configured", errSelfTestSkipped
+	}
+	upstream, err := url.Parse(r.config.Upstream)
+	if err != nil {
+		return "", err
+	}
+
+	network, address := "tcp", upstream.Host
+	switch upstream.Scheme {
+	case "unix":
+		network, address = "unix", upstream.Host+upstream.Path
+	case secureScheme:
+		if upstream.Port() == "" {
+			address = net.JoinHostPort(upstream.Hostname(), "443")
+		}
+	default:
+		if upstream.Port() == "" {
+			address = net.JoinHostPort(upstream.Hostname(), "80")
+		}
+	}
+
+	dial := newDialer("upstream-local-address", r.config.UpstreamLocalAddress, r.config.UpstreamTimeout, 0)
+	conn, err := dial(ctx, network, address)
+	if err != nil {
+		return "", err
+	}
+	_ = conn.Close()
+
+	return fmt.Sprintf("connected to %s", address), nil
+}
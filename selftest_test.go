@@ -0,0 +1,115 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func selfTestStatuses(report *selfTestReport) map[string]string {
+	statuses := make(map[string]string, len(report.Steps))
+	for _, step := range report.Steps {
+		statuses[step.Name] = step.Status
+	}
+	return statuses
+}
+
+func TestSelfTest(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.EncryptionKey = testKey
+	cfg.SelfTestUsername = validUsername
+	cfg.SelfTestPassword = validPassword
+	cfg.SelfTestPath = "/admin/users"
+	cfg.Resources = []*Resource{
+		{URL: "/admin*", Methods: allHTTPMethods},
+		{URL: "/*", Methods: allHTTPMethods, Roles: []string{"missing-role"}},
+	}
+	proxy, _, _ := newTestProxyService(cfg)
+
+	report := proxy.selfTest(context.Background())
+	assert.True(t, report.Passed, "report: %+v", report.Steps)
+	assert.Equal(t, map[string]string{
+		"discovery":     selfTestPassed,
+		"token":         selfTestPassed,
+		"identity":      selfTestPassed,
+		"authorization": selfTestPassed,
+		"cookie":        selfTestPassed,
+		"upstream":      selfTestPassed,
+	}, selfTestStatuses(report))
+
+	// the most specific resource denies the access to the user
+	proxy.config.SelfTestPath = "/other"
+	report = proxy.selfTest(context.Background())
+	assert.False(t, report.Passed)
+	assert.Equal(t, selfTestFailed, selfTestStatuses(report)["authorization"])
+}
+
+func TestSelfTestFailures(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.SelfTestUsername = validUsername
+	cfg.SelfTestPassword = "invalid"
+	proxy, _, _ := newTestProxyService(cfg)
+
+	report := proxy.selfTest(context.Background())
+	assert.False(t, report.Passed)
+	assert.Equal(t, map[string]string{
+		"discovery":     selfTestPassed,
+		"token":         selfTestFailed,
+		"identity":      selfTestSkipped,
+		"authorization": selfTestSkipped,
+		"cookie":        selfTestSkipped,
+		"upstream":      selfTestFailed,
+	}, selfTestStatuses(report))
+}
+
+func TestSelfTestHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.Upstream = upstream.URL
+	cfg.EnableSelfTestEndpoint = true
+	_, _, svc := newTestProxyService(cfg)
+
+	resp, err := http.Get(svc + cfg.WithOAuthURI(selfTestURL))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report selfTestReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.True(t, report.Passed)
+	// the client credentials are used without a test user
+	assert.Equal(t, "grant_type: client_credentials", report.Steps[1].Message)
+}
@@ -46,6 +46,9 @@ import (
 )
 
 type oauthProxy struct {
+	// the requests in flight through the forwarding proxy, first for the alignment of the atomic operations
+	forwardInflight int64
+
 	client      *oidc.Client
 	config      *Config
 	endpoint    *url.URL
@@ -61,6 +64,67 @@ type oauthProxy struct {
 	upstream    reverseProxy
 	csrf        func(http.Handler) http.Handler
 
+	clientTokens   *clientTokenIssuer
+	exchangedCache *exchangedTokens
+	umaCache       *umaPermissions
+	externalAuthz  *externalAuthorizer
+
+	// the reverse proxies to the upstreams of the resources with their own tls settings
+	resourceUpstreams map[*Resource]reverseProxy
+
+	// limits on requests, either enforced or measured
+	tokenSizeLimit    *requestLimit
+	cookieChunksLimit *requestLimit
+	headerSizeLimit   *requestLimit
+	// the rate limit of the requests per user or client ip, shared by the routes without their own rate limit
+	requestRateLimit *requestRateLimit
+
+	// proxies trusted to set the Forwarded header
+	trustedProxies []*net.IPNet
+
+	// the upstream authenticator trusted to authenticate the users, if any
+	trustedAuthenticator *trustedAuthenticator
+
+	// suffix appended to the name of the cookies dropped by this instance
+	cookieSuffix string
+
+	// the authorization code flow uses a proof key for code exchange (PKCE)
+	pkce bool
+
+	// logs the callbacks rejected before the code exchange, at most once per interval
+	callbackRejections rateLimitedLog
+
+	// signs the assertions authenticating the client to the provider, in place of the client secret
+	clientAssertion *clientAssertion
+
+	// serializes the updates of the index of the sessions, when the store does not update it atomically
+	sessionIndexLock sync.Mutex
+
+	// the signing keys of the provider, which verify the tokens
+	jwks *jwksCache
+	// the signing keys of the extra issuers, by issuer, which only verify the tokens
+	extraIssuers map[string]*jwksCache
+	// the time the discovery document of the provider was retrieved
+	discoveredAt time.Time
+
+	// the expiry of the certificates loaded from files, reported by the health endpoint
+	certificates *certificateExpiries
+
+	// the device authorization endpoint of the provider, and the device authorization grants polled on behalf of the CLIs
+	deviceEndpoint string
+	deviceGrants   *deviceGrants
+
+	// the capture of a sample of the requests, started from the admin endpoint
+	capture *requestCapture
+
+	// the stages of the routes of the reverse proxy, reported by the pipeline endpoint
+	pipelineRoutes []pipelineRouteReport
+
+	// waits between two attempts of a call to the provider, time.After unless replaced by a fake clock in the tests
+	retryAfter func(time.Duration) <-chan time.Time
+	// tells the time of the session lifetimes and the token renewals, the clock of the host unless replaced in the tests
+	clock clock
+
 	// preconfigured closures
 	cookieChunker func(string, string) int
 	cookieDropper func(string, string, string, time.Duration) *http.Cookie
@@ -69,6 +133,17 @@ type oauthProxy struct {
 	forwardCtx       context.Context //nolint:containedctx
 	forwardCancel    func()
 	forwardWaitGroup *errgroup.Group
+	// the credentials of the forwarding logins, reloaded when rotated
+	forwardCredentials *forwardingCredentials
+
+	// context that drives the store's background goroutines
+	storeCtx    context.Context //nolint:containedctx
+	storeCancel func()
+
+	// revocations holds the revoked sessions, when the session revocation is enabled
+	revocations *revocationSet
+	// serializes the updates of the revocations kept in the store, when the store does not record them atomically
+	revocationsLock sync.Mutex
 }
 
 func init() {
@@ -85,12 +160,10 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	log.Info("starting the service", zap.String("prog", version.Prog), zap.String("author", version.Author), zap.String("version", version.GetVersion()))
 	svc := &oauthProxy{
-		config: config,
-		log:    log,
+		config:       config,
+		log:          log,
+		certificates: newCertificateExpiries(),
 	}
-	svc.cookieChunker = svc.makeCookieChunker()
-	svc.cookieDropper = svc.makeCookieDropper()
-
 	// parse the upstream endpoint
 	if svc.endpoint, err = url.Parse(config.Upstream); err != nil {
 		return nil, err
@@ -98,9 +171,45 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	// initialize the store if any
 	if config.StoreURL != "" {
-		if svc.store, err = createStorage(config.StoreURL); err != nil {
+		tlsConfig, err := config.storeRedisTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if svc.store, err = createStorage(config.StoreURL, tlsConfig); err != nil {
+			return nil, err
+		}
+		svc.storeCtx, svc.storeCancel = context.WithCancel(context.Background())
+		if collecting, ok := svc.store.(collectingStorage); ok && config.StoreGCInterval > 0 {
+			go collecting.collectGarbage(svc.storeCtx, config.StoreGCInterval, log)
+		}
+		if config.EncryptionKey != "" {
+			svc.store = newEncryptedStore(svc.store, config.EncryptionKey, log)
+		}
+		log.Info("using the store for the refresh tokens", zap.String("store", redactURL(config.StoreURL)))
+		if strings.HasPrefix(config.StoreURL, memoryStoreScheme+"://") {
+			log.Warn("the refresh tokens are held in memory: the sessions do not survive a restart and are not shared between replicas")
+		}
+	}
+	if config.EnableSessionRevocation {
+		svc.revocations = newRevocationSet(config.SessionRevocationMaxEntries, config.sessionRevocationMaxAge(), svc.now)
+		if config.EnableSessionRevocationPersistence && svc.store != nil {
+			if err := svc.loadRevocations(); err != nil {
+				log.Warn("unable to reload the revocations from the store", zap.Error(err))
+			}
+			go svc.reloadRevocations(svc.storeCtx, revocationsReloadInterval)
+		}
+	}
+	if config.EnableRequestURIStore && config.StoreURL == "" {
+		log.Warn("there is no store to keep the uris requested before the logins, the landing page is still read from the request_uri cookie")
+	}
+
+	if config.ClientAssertionKey != "" {
+		if svc.clientAssertion, err = newClientAssertion(config.ClientAssertionKey, config.ClientAssertionKID); err != nil {
 			return nil, err
 		}
+		log.Info("the client authenticates to the provider with a signed assertion",
+			zap.String("algorithm", svc.clientAssertion.algorithm),
+			zap.String("kid", config.ClientAssertionKID))
 	}
 
 	// initialize the openid client
@@ -110,9 +219,10 @@ func newProxy(config *Config) (*oauthProxy, error) {
 		}
 	} else {
 		log.Warn("TESTING ONLY CONFIG - access token verification has been disabled")
+		log.Warn("the nonce of the id tokens is not checked when token verification is disabled")
 	}
 
-	if config.ClientID == "" && config.ClientSecret == "" {
+	if config.ClientID == "" && config.ClientSecret == "" && config.ClientAssertionKey == "" {
 		log.Warn("client credentials are not set, depending on provider (confidential|public) you might be unable to auth")
 	}
 
@@ -167,31 +277,40 @@ func createLogger(config *Config) (*zap.Logger, error) {
 	return c.Build()
 }
 
-// useDefaultStack sets the default middleware stack for router
-func (r *oauthProxy) useDefaultStack(engine chi.Router) {
-	engine.MethodNotAllowed(emptyHandler)
-	engine.NotFound(emptyHandler)
-	engine.Use(middleware.Recoverer)
-
-	if r.config.EnableTracing {
-		engine.Use(r.proxyTracingMiddleware)
+// listenerHandler returns the handler of a listener, the requests of the listeners trusting the upstream
+// authenticator are marked as such
+func (r *oauthProxy) listenerHandler(listen string) http.Handler {
+	if r.trustedAuthenticator == nil || !r.config.trustsAuthenticatorOn(listen) {
+		return r.router
 	}
 
-	// @check if the request tracking id middleware is enabled
-	if r.config.EnableRequestID {
-		r.log.Info("enabled the correlation request id middleware")
-		engine.Use(r.requestIDMiddleware(r.config.RequestIDHeader))
-	}
-	// @step: enable the entrypoint middleware
-	engine.Use(entrypointMiddleware)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.router.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextTrustedAuthenticator, true)))
+	})
+}
 
-	if r.config.EnableLogging {
-		engine.Use(r.loggingMiddleware)
+// Shutdown stops the proxy on termination. The forwarding proxy is drained within the forwarding-drain-timeout, the
+// reverse proxy stops at once. The store is closed last, once its background goroutines have stopped.
+func (r *oauthProxy) Shutdown() error {
+	var err error
+	if r.config.EnableForwarding {
+		err = r.shutdownForwarding()
 	}
+	if erc := r.CloseStore(); erc != nil && err == nil {
+		err = erc
+	}
+
+	return err
+}
 
-	if r.config.EnableSecurityFilter {
-		engine.Use(r.securityMiddleware)
+// Reload reloads the credentials of the forwarding proxy on SIGHUP, and logs it in again at once. It returns false
+// when there is nothing to reload, the signal then stopping the proxy.
+func (r *oauthProxy) Reload() bool {
+	if !r.config.EnableForwarding {
+		return false
 	}
+
+	return r.reloadForwarding()
 }
 
 // Run starts the proxy service
@@ -204,7 +323,7 @@ func (r *oauthProxy) Run() error {
 	// step: create the main http(s) server
 	server := &http.Server{
 		Addr:              r.config.Listen,
-		Handler:           r.router,
+		Handler:           r.listenerHandler(r.config.Listen),
 		ReadTimeout:       r.config.ServerReadTimeout,
 		ReadHeaderTimeout: r.config.ServerReadTimeout,
 		WriteTimeout:      r.config.ServerWriteTimeout,
@@ -234,7 +353,7 @@ func (r *oauthProxy) Run() error {
 		}
 		httpsvc := &http.Server{
 			Addr:              r.config.ListenHTTP,
-			Handler:           r.router,
+			Handler:           r.listenerHandler(r.config.ListenHTTP),
 			ReadTimeout:       r.config.ServerReadTimeout,
 			ReadHeaderTimeout: r.config.ServerReadTimeout,
 			WriteTimeout:      r.config.ServerWriteTimeout,
@@ -325,6 +444,7 @@ type listenerConfig struct {
 	useFileTLS          bool     // indicates we are using certificates from files
 	useLetsEncryptTLS   bool     // indicates we are using letsencrypt
 	useSelfSignedTLS    bool     // indicates we are using the self-signed tls
+	ocspStapling        bool     // indicates we staple the ocsp response to the certificate
 
 	// advanced TLS settings
 	*tlsAdvancedConfig
@@ -347,6 +467,7 @@ func makeListenerConfig(config *Config) listenerConfig {
 		clientCerts:       nil,
 		useLetsEncryptTLS: config.UseLetsEncrypt,
 		useSelfSignedTLS:  config.EnabledSelfSignedTLS,
+		ocspStapling:      !config.DisableOCSPStapling,
 		tlsAdvancedConfig: &tlsAdvancedConfig{
 			tlsMinVersion:               config.TLSMinVersion,
 			tlsCurvePreferences:         config.TLSCurvePreferences,
@@ -450,11 +571,15 @@ func (r *oauthProxy) createHTTPListener(config listenerConfig) (net.Listener, er
 				r.log.Error("error while setting certificate rotator", zap.Error(err))
 				return nil, err
 			}
+			rotate.trackExpiry(r.certificates)
 			// start watching the files for changes
 			if err := rotate.watch(); err != nil {
 				r.log.Error("error while setting file watch on certificate", zap.Error(err))
 				return nil, err
 			}
+			if config.ocspStapling {
+				rotate.enableOCSPStapling()
+			}
 
 			getCertificate = rotate.GetCertificate
 		}
@@ -492,28 +617,6 @@ func (r *oauthProxy) createHTTPListener(config listenerConfig) (net.Listener, er
 	return listener, nil
 }
 
-// createTemplates loads the custom template
-func (r *oauthProxy) createTemplates() error {
-	var list []string
-
-	if r.config.SignInPage != "" {
-		r.log.Debug("loading the custom sign in page", zap.String("page", r.config.SignInPage))
-		list = append(list, r.config.SignInPage)
-	}
-
-	if r.config.ForbiddenPage != "" {
-		r.log.Debug("loading the custom sign forbidden page", zap.String("page", r.config.ForbiddenPage))
-		list = append(list, r.config.ForbiddenPage)
-	}
-
-	if len(list) > 0 {
-		r.log.Info("loading the custom templates", zap.String("templates", strings.Join(list, ",")))
-		r.templates = template.Must(template.ParseFiles(list...))
-	}
-
-	return nil
-}
-
 // newOpenIDClient initializes the openID configuration, note: the redirection url is deliberately left blank
 // in order to retrieve it from the host header on request
 func (r *oauthProxy) newOpenIDClient() (*oidc.Client, oidc.ProviderConfig, *http.Client, error) {
@@ -532,9 +635,10 @@ func (r *oauthProxy) newOpenIDClient() (*oidc.Client, oidc.ProviderConfig, *http
 			return nil, config, nil, err
 		}
 	}
+	proxyOf := newProxyFunc(r.config)
 	hc := &http.Client{
 		Transport: &http.Transport{
-			Proxy: func(_ *http.Request) (*url.URL, error) {
+			Proxy: func(req *http.Request) (*url.URL, error) {
 				if r.config.OpenIDProviderProxy != "" {
 					idpProxyURL, erp := url.Parse(r.config.OpenIDProviderProxy)
 					if erp != nil {
@@ -545,10 +649,10 @@ func (r *oauthProxy) newOpenIDClient() (*oidc.Client, oidc.ProviderConfig, *http
 					return idpProxyURL, nil
 				}
 
-				// no proxy used
-				//nolint:nilnil
-				return nil, nil
+				// the upstream proxy, if any
+				return proxyOf(req.URL)
 			},
+			DialContext: newDialer("openid-provider-local-address", r.config.OpenIDProviderLocalAddress, providerDialTimeout, providerDialKeepAlive),
 			TLSClientConfig: &tls.Config{
 				//nolint:gas
 				InsecureSkipVerify: r.config.SkipOpenIDProviderTLSVerify,
@@ -558,27 +662,33 @@ func (r *oauthProxy) newOpenIDClient() (*oidc.Client, oidc.ProviderConfig, *http
 		Timeout: time.Second * 10,
 	}
 
-	// step: attempt to retrieve the provider configuration
-	completeCh := make(chan bool)
-	go func() {
-		for {
-			r.log.Info("attempting to retrieve configuration discovery url",
-				zap.String("url", r.config.DiscoveryURL),
-				zap.String("timeout", r.config.OpenIDProviderTimeout.String()))
-			if config, err = oidc.FetchProviderConfig(hc, r.config.DiscoveryURL); err == nil {
-				break // break and complete
-			}
-			r.log.Warn("failed to get provider configuration from discovery", zap.Error(err))
-			time.Sleep(time.Second * 3)
+	// step: attempt to retrieve the provider configuration, until the timeout
+	r.log.Info("attempting to retrieve configuration discovery url",
+		zap.String("url", r.config.DiscoveryURL),
+		zap.String("timeout", r.config.OpenIDProviderTimeout.String()))
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.OpenIDProviderTimeout)
+	defer cancel()
+	err = r.retry(ctx, discoveryBackoff, func(context.Context) error {
+		var erf error
+		config, erf = oidc.FetchProviderConfig(hc, r.config.DiscoveryURL)
+
+		return erf
+	})
+	if err != nil {
+		return nil, config, nil, fmt.Errorf("failed to retrieve the provider configuration from discovery url: %w", err)
+	}
+	r.log.Info("successfully retrieved openid configuration from the discovery")
+	r.discoveredAt = time.Now()
+	// @metric the time the discovery document was retrieved
+	oidcDocumentFetchMetric.WithLabelValues(oidcDocumentDiscovery).Set(float64(r.discoveredAt.Unix()))
+	if err = r.config.isProviderConfigValid(config); err != nil {
+		return nil, config, nil, err
+	}
+	r.pkce = r.usePKCE(hc)
+	if r.config.EnableDeviceFlow {
+		if r.deviceEndpoint, err = r.config.fetchDeviceAuthorizationEndpoint(hc); err != nil {
+			return nil, config, nil, fmt.Errorf("the device flow is enabled: %w", err)
 		}
-		completeCh <- true
-	}()
-	// wait for timeout or successful retrieval
-	select {
-	case <-time.After(r.config.OpenIDProviderTimeout):
-		return nil, config, nil, errors.New("failed to retrieve the provider configuration from discovery url")
-	case <-completeCh:
-		r.log.Info("successfully retrieved openid configuration from the discovery")
 	}
 
 	client, err := oidc.NewClient(oidc.ClientConfig{
@@ -597,12 +707,24 @@ func (r *oauthProxy) newOpenIDClient() (*oidc.Client, oidc.ProviderConfig, *http
 	// start the provider sync for key rotation
 	client.SyncProviderConfig(r.config.DiscoveryURL)
 
-	return client, config, hc, nil
-}
+	// step: retrieve the signing keys, a failure is retried on the first token signed with an unknown key
+	if config.KeysEndpoint != nil {
+		r.jwks = newJWKSCache(hc, config, r.config.JWKSMinRefreshInterval, r.log)
+		_ = r.jwks.refresh(ctx, jwksRefreshStartup)
+		if r.config.JWKSRefreshInterval > 0 {
+			go r.jwks.refreshPeriodically(context.Background(), r.config.JWKSRefreshInterval)
+		}
+	}
+	if len(r.config.ExtraIssuers) > 0 {
+		if r.jwks == nil {
+			return nil, config, hc, errors.New("the extra issuers require the provider to announce its keys endpoint")
+		}
+		if err = r.discoverExtraIssuers(ctx, hc); err != nil {
+			return nil, config, hc, err
+		}
+	}
 
-// Render implements the echo Render interface
-func (r *oauthProxy) Render(w io.Writer, name string, data interface{}) error {
-	return r.templates.ExecuteTemplate(w, name, data)
+	return client, config, hc, nil
 }
 
 func (r *oauthProxy) buildProxyTLSConfig() (*tls.Config, error) {
@@ -4,10 +4,35 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestForwardingProxy(t *testing.T) {
@@ -36,3 +61,1375 @@ func TestForwardingProxy(t *testing.T) {
 	<-time.After(time.Duration(100) * time.Millisecond)
 	p.RunTests(t, requests)
 }
+
+func TestForwardingProxyMetrics(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = validPassword
+	logins := testutil.ToFloat64(forwardingLoginMetric.WithLabelValues("success"))
+
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	expiry := func() (time.Time, bool) {
+		x, found := forwardingTokenExpiryMetric.expiries.Load(validUsername)
+		if !found {
+			return time.Time{}, false
+		}
+		return x.(time.Time), true
+	}
+	require.Eventually(t, func() bool {
+		_, found := expiry()
+		return found
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the login is counted, and the lifetime left to the token exported
+	assert.Equal(t, logins+1, testutil.ToFloat64(forwardingLoginMetric.WithLabelValues("success")))
+	expires, _ := expiry()
+	assert.True(t, expires.After(time.Now()))
+	assert.GreaterOrEqual(t, testutil.CollectAndCount(forwardingTokenExpiryMetric), 1)
+
+	// the lifetime is no longer exported once the proxy stops
+	p.proxy.forwardCancel()
+	_ = p.proxy.forwardWaitGroup.Wait()
+	_, found := expiry()
+	assert.False(t, found)
+}
+
+func TestForwardingProxyShutdownDuringBackoff(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = "invalid"
+	cfg.ForwardingDrainTimeout = 2 * time.Second
+	failures := testutil.ToFloat64(forwardingLoginMetric.WithLabelValues("failure"))
+
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+
+	// the login fails, and is retried after a backoff
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(forwardingLoginMetric.WithLabelValues("failure")) > failures
+	}, 5*time.Second, 50*time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, p.proxy.Shutdown())
+	assert.Less(t, int64(time.Since(start)), int64(cfg.ForwardingDrainTimeout), "the backoff is interrupted by the shutdown")
+
+	// no connection is accepted once shut down
+	_, err := net.Dial("tcp", p.proxy.listener.Addr().String())
+	assert.Error(t, err)
+}
+
+func TestForwardingProxyCredentialFiles(t *testing.T) {
+	dir := t.TempDir()
+	usernameFile := filepath.Join(dir, "username")
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(usernameFile, []byte(validUsername+"\n"), 0o600))
+	require.NoError(t, os.WriteFile(passwordFile, []byte("invalid\n"), 0o600))
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingUsernameFile = usernameFile
+	cfg.ForwardingPasswordFile = passwordFile
+	counter := func(result string) func() float64 {
+		return func() float64 {
+			return testutil.ToFloat64(forwardingLoginMetric.WithLabelValues(result))
+		}
+	}
+	failures, logins := counter("failure"), counter("success")
+	failed, succeeded := failures(), logins()
+
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	require.Eventually(t, func() bool { return failures() > failed }, 5*time.Second, 50*time.Millisecond)
+
+	// the rejected password is read again before the next attempt
+	require.NoError(t, os.WriteFile(passwordFile, []byte(validPassword+"\n"), 0o600))
+	require.Eventually(t, func() bool { return logins() > succeeded }, 5*time.Second, 50*time.Millisecond)
+	_, found := forwardingTokenExpiryMetric.expiries.Load(validUsername)
+	assert.True(t, found, "the identity is named after the username of the file")
+
+	// the reload logs in again at once, with the last known password when the file can't be read
+	require.NoError(t, os.Remove(passwordFile))
+	succeeded = logins()
+	require.True(t, p.proxy.Reload())
+	require.Eventually(t, func() bool { return logins() > succeeded }, 5*time.Second, 50*time.Millisecond)
+	username, password := p.proxy.forwardCredentials.user()
+	assert.Equal(t, validUsername, username)
+	assert.Equal(t, validPassword, password)
+}
+
+func TestForwardingCredentials(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("first\r\n"), 0o600))
+	cfg := newFakeKeycloakConfig()
+	cfg.ClientSecret = ""
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingClientSecretFile = secretFile
+
+	credentials := newForwardingCredentials(cfg, zap.NewNop())
+	assert.Equal(t, "first", credentials.clientSecret(), "the trailing line break is not part of the secret")
+	username, _ := credentials.user()
+	assert.Equal(t, validUsername, username)
+	r := &oauthProxy{config: cfg, forwardCredentials: credentials}
+	assert.Equal(t, "first", r.clientSecret())
+
+	require.NoError(t, os.WriteFile(secretFile, []byte("second with spaces "), 0o600))
+	credentials.reload()
+	assert.Equal(t, "second with spaces ", r.clientSecret())
+	// the last known secret is kept while the file is empty or missing
+	require.NoError(t, os.WriteFile(secretFile, nil, 0o600))
+	credentials.reload()
+	assert.Equal(t, "second with spaces ", r.clientSecret())
+	require.NoError(t, os.Remove(secretFile))
+	credentials.reload()
+	assert.Equal(t, "second with spaces ", r.clientSecret())
+
+	// the wake-ups don't pile up
+	credentials.wake()
+	credentials.wake()
+	<-credentials.relogin
+	select {
+	case <-credentials.relogin:
+		t.Fatal("a single relogin is pending")
+	default:
+	}
+
+	// there is nothing to reload in the reverse proxy
+	assert.False(t, (&oauthProxy{config: newFakeKeycloakConfig()}).Reload())
+}
+
+func TestIsForwardingCredentialsValid(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("secret"), 0o600))
+	cs := []struct {
+		Config func(*Config)
+		Error  string
+	}{
+		{Config: func(c *Config) { c.ForwardingPasswordFile = secretFile }},
+		{Config: func(c *Config) {
+			c.ForwardingUsernameFile, c.ForwardingPasswordFile = secretFile, secretFile
+			c.ForwardingUsername = ""
+		}},
+		{Config: func(c *Config) { c.ForwardingPasswordFile = filepath.Join(dir, "missing") }, Error: "unable to read the forwarding-password"},
+		{Config: func(c *Config) { c.ForwardingPassword, c.ForwardingPasswordFile = validPassword, secretFile }, Error: "you cannot set both the forwarding-password"},
+		{Config: func(c *Config) { c.ForwardingUsername = ""; c.ForwardingPasswordFile = secretFile }, Error: "no forwarding username"},
+		{Config: func(c *Config) {
+			c.ForwardingGrantType, c.ForwardingUsername, c.ClientSecret = oauth2.GrantTypeClientCreds, "", ""
+			c.ForwardingClientSecretFile = secretFile
+		}},
+		{Config: func(c *Config) {
+			c.ForwardingGrantType, c.ForwardingUsername = oauth2.GrantTypeClientCreds, ""
+			c.ClientSecret, c.ForwardingClientSecretFile = fakeSecret, secretFile
+		}, Error: "you cannot set both the client-secret"},
+		{Config: func(c *Config) {
+			c.ForwardingGrantType, c.ForwardingUsername = oauth2.GrantTypeClientCreds, ""
+			c.ForwardingPasswordFile = secretFile
+		}, Error: "you cannot set forwarding-username or forwarding-password"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.DiscoveryURL = "https://keycloak.example.com/realms/test"
+		cfg.ForwardingUsername = validUsername
+		c.Config(cfg)
+		err := cfg.isForwardingValid()
+		if c.Error == "" {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		if assert.Error(t, err, "case %d", i) {
+			assert.Contains(t, err.Error(), c.Error, "case %d", i)
+		}
+	}
+}
+
+func TestForwardingProxyShutdownDrainsRequests(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = validPassword
+	cfg.ForwardingDrainTimeout = 5 * time.Second
+
+	p := newFakeProxy(cfg)
+	defer p.idp.Close()
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	proxyURL, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	status := make(chan int, 1)
+	go func() {
+		resp, err := client.Get(s.URL + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&p.proxy.forwardInflight) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- p.proxy.Shutdown()
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("the shutdown did not wait for the request in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// the request in flight finishes, then the shutdown completes
+	close(release)
+	assert.Equal(t, http.StatusOK, <-status)
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(cfg.ForwardingDrainTimeout):
+		t.Fatal("the shutdown did not complete within the drain timeout")
+	}
+}
+
+func TestWaitAfterLoginFailure(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	clock := &fakeRetryClock{}
+	cfg := newFakeKeycloakConfig()
+	cfg.ForwardingLoginBackoffMax = 4 * time.Second
+	r := &oauthProxy{config: cfg, log: zap.NewNop(), retryAfter: clock.after, forwardCtx: context.Background()}
+	identity := &forwardingIdentity{name: "backoff-test"}
+	defer forwardingLoginBackoffMetric.DeleteLabelValues(identity.name)
+	state := &forwardingState{}
+	unavailable := errors.New("the provider is unavailable")
+	for i := 0; i < 6; i++ {
+		state.failures++
+		require.NoError(t, r.waitAfterLoginFailure(zap.New(core), identity, state, unavailable))
+	}
+
+	// the delay doubles from a second up to the max, with jitter
+	policy := forwardingLoginBackoff
+	policy.max = cfg.ForwardingLoginBackoffMax
+	delays := clock.recorded()
+	require.Len(t, delays, 6)
+	assertBackoffDelays(t, policy, delays)
+	assert.InDelta(t, delays[5].Seconds(), testutil.ToFloat64(forwardingLoginBackoffMetric.WithLabelValues(identity.name)), 0.001)
+
+	// a warning per backoff step: 1s, 2s then 4s, the identical failures at the max being suppressed
+	warnings := logs.TakeAll()
+	require.Len(t, warnings, 3)
+	state.failures++
+	require.NoError(t, r.waitAfterLoginFailure(zap.New(core), identity, state, errors.New("invalid credentials")))
+	warnings = logs.TakeAll()
+	require.Len(t, warnings, 1, "another failure is logged at once")
+	assert.Equal(t, int64(3), warnings[0].ContextMap()["suppressed"])
+
+	// the backoff stops with the proxy
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.forwardCtx = ctx
+	r.retryAfter = nil
+	state.failures++
+	assert.Error(t, r.waitAfterLoginFailure(zap.NewNop(), identity, state, unavailable))
+}
+
+func TestForwardingSignerRequestsMetric(t *testing.T) {
+	signer := &forwardingSigner{domains: []string{"example.com"}}
+	signed := testutil.ToFloat64(forwardingRequestsMetric.WithLabelValues("signed"))
+	passed := testutil.ToFloat64(forwardingRequestsMetric.WithLabelValues("passthrough"))
+
+	for _, uri := range []string{"http://orders.example.com/", "http://example.com/", "http://other.org/"} {
+		signer.sign(httptest.NewRequest(http.MethodGet, uri, nil))
+	}
+	assert.Equal(t, signed+2, testutil.ToFloat64(forwardingRequestsMetric.WithLabelValues("signed")))
+	assert.Equal(t, passed+1, testutil.ToFloat64(forwardingRequestsMetric.WithLabelValues("passthrough")))
+}
+
+func TestForwardingProxyClientCredentials(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingGrantType = oauth2.GrantTypeClientCreds
+
+	// the tokens of the service account are issued without refresh token, and short-lived
+	p := newFakeProxyWithAuthServer(cfg, newFakeAuthServer().setTokenExpiration(3*time.Second))
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	s := httptest.NewServer(&fakeUpstreamService{})
+	defer s.Close()
+
+	proxyURL, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	signedWith := func() string {
+		resp, err := client.Get(s.URL + "/test")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var upstream fakeUpstreamResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upstream))
+
+		return strings.TrimPrefix(upstream.Headers.Get("Authorization"), "Bearer ")
+	}
+
+	var first string
+	require.Eventually(t, func() bool {
+		first = signedWith()
+		return first != ""
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the token is acquired again before it expires
+	var renewed string
+	require.Eventually(t, func() bool {
+		renewed = signedWith()
+		return renewed != first
+	}, 5*time.Second, 100*time.Millisecond)
+	token, identity, err := parseToken(renewed)
+	require.NoError(t, err)
+	assert.True(t, identity.ExpiresAt.After(time.Now()), "the renewed token is valid")
+	assert.NoError(t, p.proxy.verifyToken(p.proxy.client, token))
+}
+
+func TestForwardingProxyAudiences(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = validPassword
+	cfg.ForwardingAudiences = map[string]string{"127.0.0.1": "orders-api"}
+
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	s := httptest.NewServer(&fakeUpstreamService{})
+	defer s.Close()
+
+	proxyURL, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	var signed string
+	require.Eventually(t, func() bool {
+		resp, err := client.Get(s.URL + "/test")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var upstream fakeUpstreamResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upstream))
+		signed = strings.TrimPrefix(upstream.Headers.Get("Authorization"), "Bearer ")
+
+		return signed != ""
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, identity, err := parseToken(signed)
+	require.NoError(t, err)
+	aud, _, _ := identity.StringClaim("aud")
+	assert.Equal(t, "orders-api", aud)
+}
+
+func TestForwardingProxyDomainAudience(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingGrantType = oauth2.GrantTypeClientCreds
+	cfg.ForwardingDomainAudience = map[string]string{"127.0.0.1": "orders-api"}
+
+	// the tokens of the audiences are renewed on their own, before they expire
+	p := newFakeProxyWithAuthServer(cfg, newFakeAuthServer().setTokenExpiration(3*time.Second))
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	s := httptest.NewServer(&fakeUpstreamService{})
+	defer s.Close()
+
+	proxyURL, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	signedWith := func() string {
+		resp, err := client.Get(s.URL + "/test")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var upstream fakeUpstreamResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upstream))
+
+		return strings.TrimPrefix(upstream.Headers.Get("Authorization"), "Bearer ")
+	}
+
+	var first string
+	require.Eventually(t, func() bool {
+		first = signedWith()
+		return first != ""
+	}, 5*time.Second, 50*time.Millisecond)
+	_, identity, err := parseToken(first)
+	require.NoError(t, err)
+	aud, _, _ := identity.StringClaim("aud")
+	assert.Equal(t, "orders-api", aud)
+
+	var renewed string
+	require.Eventually(t, func() bool {
+		renewed = signedWith()
+		return renewed != first
+	}, 5*time.Second, 100*time.Millisecond)
+	_, identity, err = parseToken(renewed)
+	require.NoError(t, err)
+	aud, _, _ = identity.StringClaim("aud")
+	assert.Equal(t, "orders-api", aud)
+	assert.True(t, identity.ExpiresAt.After(time.Now()), "the renewed token is valid")
+}
+
+func TestRenewForwardingAudiences(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingGrantType = oauth2.GrantTypeClientCreds
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+
+	signer := &forwardingSigner{log: zap.NewNop()}
+	signer.use("orders-api")
+	idle := time.Now().Add(-2 * forwardingAudienceIdleTimeout).Unix()
+	signer.grantedUses.Store("billing-api", &idle)
+	due := time.Now().Add(-time.Second)
+	state := &forwardingState{audiences: map[string]*forwardingGrantedToken{
+		"orders-api":  {authorization: "Bearer orders", expiration: time.Now().Add(time.Minute), renewAt: due},
+		"billing-api": {authorization: "Bearer billing", expiration: time.Now().Add(time.Minute), renewAt: due},
+		"users-api":   {authorization: "Bearer users", expiration: time.Now().Add(time.Minute), renewAt: time.Now().Add(time.Minute)},
+	}}
+	p.proxy.renewForwardingAudiences(state, signer)
+
+	// the token of the unused audience is dropped, the one due is renewed, the other is kept as is
+	granted, ok := signer.granted.Load().(map[string]string)
+	require.True(t, ok)
+	assert.Len(t, granted, 2)
+	assert.NotContains(t, granted, "billing-api")
+	assert.NotEqual(t, "Bearer orders", granted["orders-api"])
+	assert.True(t, state.audiences["orders-api"].renewAt.After(time.Now()))
+	assert.Equal(t, "Bearer users", granted["users-api"])
+}
+
+func TestRenewForwardingAudiencesClock(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingGrantType = oauth2.GrantTypeClientCreds
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	clock := newFakeClock()
+	p.proxy.clock = clock
+	now := clock.Now()
+
+	signer := &forwardingSigner{log: zap.NewNop(), clock: clock}
+	signer.use("orders-api")
+	idle := now.Add(-forwardingAudienceIdleTimeout).Unix()
+	signer.grantedUses.Store("billing-api", &idle)
+	state := &forwardingState{audiences: map[string]*forwardingGrantedToken{
+		// due exactly now
+		"orders-api": {authorization: "Bearer orders", expiration: now.Add(time.Minute), renewAt: now},
+		// unused for exactly the idle timeout
+		"billing-api": {authorization: "Bearer billing", expiration: now.Add(time.Minute), renewAt: now.Add(-time.Second)},
+		// due in a nanosecond
+		"users-api": {authorization: "Bearer users", expiration: now.Add(time.Minute), renewAt: now.Add(time.Nanosecond)},
+	}}
+	p.proxy.renewForwardingAudiences(state, signer)
+
+	granted, ok := signer.granted.Load().(map[string]string)
+	require.True(t, ok)
+	assert.Len(t, granted, 3, "the tokens are dropped once unused for longer than the idle timeout")
+	assert.NotEqual(t, "Bearer orders", granted["orders-api"])
+	assert.NotEqual(t, "Bearer billing", granted["billing-api"])
+	assert.Equal(t, "Bearer users", granted["users-api"])
+
+	// the renewal is scheduled at 85% of the lifetime left on the clock of the proxy
+	_, identity, err := parseToken(strings.TrimPrefix(granted["orders-api"], "Bearer "))
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(getWithin(identity.ExpiresAt, now, 0.85)), state.audiences["orders-api"].renewAt)
+}
+
+func TestWaitForwardingRenewalInThePast(t *testing.T) {
+	clock := newFakeClock()
+	r := &oauthProxy{log: zap.NewNop(), clock: clock, forwardCtx: context.Background()}
+	state := &forwardingState{audiences: map[string]*forwardingGrantedToken{
+		"orders-api": {authorization: "Bearer orders", renewAt: clock.Now().Add(-time.Hour)},
+	}}
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- r.waitForwardingRenewal(state, &forwardingSigner{}, nil, clock.Now().Add(-time.Minute))
+	}()
+	select {
+	case renew := <-done:
+		assert.True(t, renew, "a renewal scheduled in the past is due at once")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the renewal scheduled in the past is waited for")
+	}
+	assert.Equal(t, "Bearer orders", state.audiences["orders-api"].authorization, "the audiences are renewed by the next wait")
+}
+
+func TestForwardingProxyIdentities(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = validPassword
+	cfg.ForwardingIdentities = []*ForwardingIdentity{
+		{Domains: []string{"127.0.0.1"}, ClientID: "partner", ClientSecret: fakeSecret},
+	}
+
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	s := httptest.NewServer(&fakeUpstreamService{})
+	defer s.Close()
+
+	proxyURL, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	var signed string
+	require.Eventually(t, func() bool {
+		resp, err := client.Get(s.URL + "/test")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var upstream fakeUpstreamResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upstream))
+		signed = strings.TrimPrefix(upstream.Headers.Get("Authorization"), "Bearer ")
+
+		return signed != ""
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the requests to the domain are signed by the service account of the client of the identity
+	_, identity, err := parseToken(signed)
+	require.NoError(t, err)
+	azp, _, _ := identity.StringClaim("azp")
+	assert.Equal(t, "partner", azp)
+}
+
+func TestForwardingSignerIdentities(t *testing.T) {
+	identities := []*forwardingIdentity{{name: "partner-a"}, {name: "partner-b"}}
+	for _, x := range identities {
+		x := x
+		x.update = func(token jose.JWT) {
+			x.signature.Store(&forwardingSignature{authorization: "Bearer " + x.name})
+		}
+		x.update(jose.JWT{})
+	}
+	signer := &forwardingSigner{
+		domains: []string{"internal.example.com"},
+		identities: newForwardingIdentityDomains(identities, []*ForwardingIdentity{
+			{Domains: []string{"example.com"}},
+			{Domains: []string{".b.example.com", "partner-b.org"}},
+		}),
+	}
+	base := newTestToken("https://idp").getToken()
+	signer.update(base)
+	authorizationOf := func(uri string) string {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		signer.sign(req)
+		return req.Header.Get(authorizationHeader)
+	}
+
+	// the longest domain the host ends with selects the identity
+	assert.Equal(t, "Bearer partner-a", authorizationOf("http://a.example.com/"))
+	assert.Equal(t, "Bearer partner-a", authorizationOf("http://example.com:8443/"))
+	assert.Equal(t, "Bearer partner-b", authorizationOf("http://api.b.example.com/"))
+	assert.Equal(t, "Bearer partner-b", authorizationOf("http://API.Partner-B.org/"))
+	// the other hosts are signed as before
+	assert.Equal(t, "Bearer partner-a", authorizationOf("http://internal.example.com/"))
+	assert.Equal(t, "Bearer "+base.Encode(), authorizationOf("http://internal.example.org.internal.example.com.test/"))
+	assert.Empty(t, authorizationOf("http://notpartner-b.org/"))
+	assert.Empty(t, authorizationOf("http://other.org/"))
+}
+
+func TestForwardingProxyTunnels(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = validPassword
+	cfg.ForwardingDomains = []string{"127.0.0.1"}
+	cfg.SkipUpstreamTLSVerify = true
+
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	s := httptest.NewTLSServer(&fakeUpstreamService{})
+	defer s.Close()
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	require.NoError(t, err)
+
+	proxyURL, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		//nolint:gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	get := func(host string) (*http.Response, fakeUpstreamResponse) {
+		resp, err := client.Get("https://" + net.JoinHostPort(host, port) + "/test")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var upstream fakeUpstreamResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upstream))
+
+		return resp, upstream
+	}
+
+	// the listed host is intercepted and signed
+	require.Eventually(t, func() bool {
+		_, upstream := get("127.0.0.1")
+		return strings.HasPrefix(upstream.Headers.Get(authorizationHeader), "Bearer ")
+	}, 5*time.Second, 50*time.Millisecond)
+	resp, _ := get("127.0.0.1")
+	assert.False(t, resp.TLS.PeerCertificates[0].Equal(s.Certificate()), "the tunnel to a signed host is intercepted")
+
+	// the other hosts are tunneled as is, with the certificate of the upstream
+	resp, upstream := get("localhost")
+	assert.True(t, resp.TLS.PeerCertificates[0].Equal(s.Certificate()), "the tunnel to another host is not intercepted")
+	assert.Empty(t, upstream.Headers.Get(authorizationHeader))
+	assert.Empty(t, upstream.Headers.Get("X-Forwarded-Agent"))
+}
+
+func TestForwardingProxyUpstreamProxy(t *testing.T) {
+	setProxyEnvironment(t, nil)
+	s := httptest.NewTLSServer(&fakeUpstreamService{})
+	defer s.Close()
+	parent, server := newFakeParentProxy(t, s.Listener.Addr().String(), "egress:secret")
+
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableForwarding = true
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = validPassword
+	cfg.ForwardingDomains = []string{"orders.test"}
+	cfg.SkipUpstreamTLSVerify = true
+	cfg.UpstreamProxy = "http://egress:secret@" + server.Listener.Addr().String()
+
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	proxyURL, err := url.Parse(p.getServiceURL())
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		//nolint:gosec
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	get := func(host string) (*http.Response, fakeUpstreamResponse) {
+		resp, err := client.Get("https://" + host + ":8443/test")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var upstream fakeUpstreamResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&upstream))
+
+		return resp, upstream
+	}
+
+	// the intercepted requests are signed, and relayed in a tunnel through the upstream proxy
+	require.Eventually(t, func() bool {
+		_, upstream := get("orders.test")
+		return strings.HasPrefix(upstream.Headers.Get(authorizationHeader), "Bearer ")
+	}, 5*time.Second, 50*time.Millisecond)
+	// the other tunnels are opened through the upstream proxy as they are
+	resp, upstream := get("other.test")
+	assert.True(t, resp.TLS.PeerCertificates[0].Equal(s.Certificate()))
+	assert.Empty(t, upstream.Headers.Get(authorizationHeader))
+	assert.Contains(t, parent.requested(), "orders.test:8443")
+	assert.Contains(t, parent.requested(), "other.test:8443")
+}
+
+func TestForwardingProxyHTTP2(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := newFakeKeycloakConfig()
+		cfg.EnableForwarding = true
+		cfg.ForwardingUsername = validUsername
+		cfg.ForwardingPassword = validPassword
+		cfg.SkipUpstreamTLSVerify = true
+		cfg.UpstreamEnableHTTP2 = enabled
+
+		p := newFakeProxy(cfg)
+		upstream, release := newStreamingUpstream(t)
+		proxyURL, err := url.Parse(p.getServiceURL())
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			//nolint:gosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+
+		// the intercepted requests are relayed over http/2 when the destination offers it, and streamed back
+		resp, err := client.Get(upstream.URL + "/test")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		proto := readStreamed(t, resp, release)
+		if enabled {
+			assert.Equal(t, "HTTP/2.0", proto)
+		} else {
+			assert.Equal(t, "HTTP/1.1", proto)
+		}
+		p.proxy.forwardCancel()
+		_ = p.proxy.forwardWaitGroup.Wait()
+		p.idp.Close()
+		p.proxy.server.Close()
+	}
+}
+
+func TestInterceptsTunnel(t *testing.T) {
+	cs := []struct {
+		Domains    []string
+		MITMAll    bool
+		Identities []*ForwardingIdentity
+		TLS        []*ForwardingTLS
+		Host       string
+		Expected   bool
+	}{
+		{Host: "anything.org:443", Expected: true},
+		{Domains: []string{"example.com"}, Host: "api.example.com:443", Expected: true},
+		{Domains: []string{"example.com"}, Host: "other.org:443"},
+		{Domains: []string{"example.com"}, MITMAll: true, Host: "other.org:443", Expected: true},
+		{Domains: []string{"example.com"}, Identities: []*ForwardingIdentity{{Domains: []string{"partner.org"}}}, Host: "api.partner.org:443", Expected: true},
+		{Domains: []string{"example.com"}, Identities: []*ForwardingIdentity{{Domains: []string{"partner.org"}}}, Host: "notpartner.org:443"},
+		{Domains: []string{"example.com"}, TLS: []*ForwardingTLS{{Domains: []string{"appliance.internal"}}}, Host: "appliance.internal:8443", Expected: true},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.ForwardingDomains = c.Domains
+		cfg.ForwardingMITMAll = c.MITMAll
+		cfg.ForwardingIdentities = c.Identities
+		cfg.ForwardingTLS = c.TLS
+		proxy := &oauthProxy{config: cfg}
+		assert.Equal(t, c.Expected, proxy.interceptsTunnel(c.Host), "case %d", i)
+	}
+}
+
+func TestForwardingSignerAudiences(t *testing.T) {
+	var exchanges int32
+	signer := &forwardingSigner{
+		audiences: newForwardingAudiences(map[string]string{
+			"example.com":        "default-api",
+			"orders.example.com": "orders-api",
+			"denied.example.com": fakeDeniedAudience,
+		}, nil),
+		exchange: func(token, audience string) (string, time.Time, error) {
+			atomic.AddInt32(&exchanges, 1)
+			if audience == fakeDeniedAudience {
+				return "", time.Time{}, errors.New("access denied")
+			}
+			return audience + "|" + token, time.Now().Add(time.Hour), nil
+		},
+		log: zap.NewNop(),
+	}
+	authorizationOf := func(uri string) string {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		signer.sign(req)
+		return req.Header.Get(authorizationHeader)
+	}
+	base := newTestToken("https://idp").getToken()
+	signer.update(base)
+
+	// the most specific domain applies
+	assert.Equal(t, "Bearer orders-api|"+base.Encode(), authorizationOf("http://orders.example.com:8080/"))
+	assert.Equal(t, "Bearer default-api|"+base.Encode(), authorizationOf("http://www.example.com/"))
+	// the exchanged tokens are cached
+	assert.Equal(t, "Bearer orders-api|"+base.Encode(), authorizationOf("http://orders.example.com/"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&exchanges))
+	// the other domains get the base token, as the failed exchanges
+	assert.Equal(t, "Bearer "+base.Encode(), authorizationOf("http://other.org/"))
+	assert.Equal(t, "Bearer "+base.Encode(), authorizationOf("http://denied.example.com/"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&exchanges))
+
+	// a new base token is exchanged again
+	renewed := newTestToken("https://idp")
+	renewed.newJTI()
+	token := renewed.getToken()
+	signer.update(token)
+	assert.Equal(t, "Bearer orders-api|"+token.Encode(), authorizationOf("http://orders.example.com/"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&exchanges))
+}
+
+func TestForwardingSignerGrantedAudiences(t *testing.T) {
+	signer := &forwardingSigner{
+		audiences: newForwardingAudiences(nil, map[string]string{
+			"orders.example.com": "orders-api",
+			"denied.example.com": fakeDeniedAudience,
+		}),
+		acquisitions: make(chan forwardingAcquisition),
+		log:          zap.NewNop(),
+	}
+	// the refresh loop acquires the tokens of the audiences
+	var acquisitions int32
+	go func() {
+		tokens := make(map[string]*forwardingGrantedToken)
+		for acquisition := range signer.acquisitions {
+			atomic.AddInt32(&acquisitions, 1)
+			if acquisition.audience == fakeDeniedAudience {
+				acquisition.authorization <- ""
+				continue
+			}
+			tokens[acquisition.audience] = &forwardingGrantedToken{authorization: "Bearer " + acquisition.audience}
+			signer.publish(tokens)
+			acquisition.authorization <- tokens[acquisition.audience].authorization
+		}
+	}()
+	defer close(signer.acquisitions)
+	authorizationOf := func(uri string) string {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		signer.sign(req)
+		return req.Header.Get(authorizationHeader)
+	}
+	base := newTestToken("https://idp").getToken()
+	signer.update(base)
+
+	assert.Equal(t, "Bearer orders-api", authorizationOf("http://orders.example.com/"))
+	assert.Equal(t, "Bearer orders-api", authorizationOf("http://orders.example.com/"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&acquisitions), "the token of the audience is acquired once")
+	// the domains without an audience, or which token can't be acquired, are signed with the forwarding token
+	assert.Equal(t, "Bearer "+base.Encode(), authorizationOf("http://other.org/"))
+	assert.Equal(t, "Bearer "+base.Encode(), authorizationOf("http://denied.example.com/"))
+	assert.False(t, signer.lastUse("orders-api").IsZero())
+}
+
+func TestIsForwardingValid(t *testing.T) {
+	cs := []struct {
+		GrantType  string
+		Username   string
+		Password   string
+		Secret     string
+		TLS        *ForwardingTLS
+		Domains    []string
+		Audiences  map[string]string
+		Granted    map[string]string
+		Identities []*ForwardingIdentity
+		Workload   map[string]string
+		Header     string
+		Excluded   []string
+		Error      string
+	}{
+		{Username: validUsername, Password: validPassword},
+		{GrantType: oauth2.GrantTypeUserCreds, Username: validUsername, Password: validPassword},
+		{GrantType: oauth2.GrantTypeUserCreds, Password: validPassword, Error: "no forwarding username"},
+		{GrantType: oauth2.GrantTypeClientCreds, Secret: fakeSecret},
+		{GrantType: oauth2.GrantTypeClientCreds, Error: "requires the client secret"},
+		{GrantType: oauth2.GrantTypeClientCreds, Secret: fakeSecret, Username: validUsername, Error: "you cannot set forwarding-username"},
+		{GrantType: oauth2.GrantTypeClientCreds, Secret: fakeSecret, Password: validPassword, Error: "you cannot set forwarding-username"},
+		{GrantType: "implicit", Error: "invalid forwarding grant type"},
+		{Username: validUsername, Password: validPassword, TLS: &ForwardingTLS{Domains: []string{"appliance.internal"}, UpstreamTLS: UpstreamTLS{SkipVerify: true}}},
+		{Username: validUsername, Password: validPassword, TLS: &ForwardingTLS{UpstreamTLS: UpstreamTLS{SkipVerify: true}}, Error: "must list the destination domains"},
+		{Username: validUsername, Password: validPassword, TLS: &ForwardingTLS{Domains: []string{"internal"}, UpstreamTLS: UpstreamTLS{CA: "./tests/does_not_exist"}}, Error: "is not accessible"},
+		{Username: validUsername, Password: validPassword, Secret: fakeSecret, Audiences: map[string]string{"orders.internal": "orders-api"}},
+		{Username: validUsername, Password: validPassword, Secret: fakeSecret, Domains: []string{"internal"}, Audiences: map[string]string{"orders.internal": "orders-api"}},
+		{Username: validUsername, Password: validPassword, Audiences: map[string]string{"orders.internal": "orders-api"}, Error: "require a confidential client"},
+		{Username: validUsername, Password: validPassword, Secret: fakeSecret, Audiences: map[string]string{"orders.internal": ""}, Error: "invalid forwarding audience"},
+		{Username: validUsername, Password: validPassword, Secret: fakeSecret, Domains: []string{"example.com"}, Audiences: map[string]string{"orders.internal": "orders-api"}, Error: "must be one of the forwarding-domains"},
+		{GrantType: oauth2.GrantTypeClientCreds, Secret: fakeSecret, Granted: map[string]string{"orders.internal": "orders-api"}},
+		{GrantType: oauth2.GrantTypeClientCreds, Secret: fakeSecret, Granted: map[string]string{"orders.internal": ""}, Error: "invalid forwarding domain audience"},
+		{Username: validUsername, Password: validPassword, Granted: map[string]string{"orders.internal": "orders-api"}, Error: "require a confidential client"},
+		{GrantType: oauth2.GrantTypeClientCreds, Secret: fakeSecret, Domains: []string{"example.com"}, Granted: map[string]string{"orders.internal": "orders-api"}, Error: "must be one of the forwarding-domains"},
+		{GrantType: oauth2.GrantTypeClientCreds, Secret: fakeSecret, Audiences: map[string]string{"orders.internal": "orders-api"}, Granted: map[string]string{"orders.internal": "orders-api"}, Error: "set with both"},
+		{Username: validUsername, Password: validPassword, Identities: []*ForwardingIdentity{
+			{Domains: []string{"partner-a.example.com"}, Username: "partner-a", Password: "secret"},
+			{Domains: []string{"partner-b.example.com", "b.partner-a.example.com"}, ClientID: "partner-b", ClientSecret: "secret"},
+		}},
+		{Username: validUsername, Password: validPassword, Identities: []*ForwardingIdentity{
+			{Domains: []string{"partner-a.example.com"}, Username: "partner-a", Password: "secret"},
+			{Domains: []string{".Partner-A.example.com"}, ClientID: "partner-b", ClientSecret: "secret"},
+		}, Error: "is signed by several forwarding identities"},
+		{Username: validUsername, Password: validPassword, Identities: []*ForwardingIdentity{
+			{Domains: []string{"partner-a.example.com"}, Username: "partner-a", ClientID: "partner-a", ClientSecret: "secret"},
+		}, Error: "either a user"},
+		{Username: validUsername, Password: validPassword, Identities: []*ForwardingIdentity{
+			{Domains: []string{"partner-a.example.com"}, ClientID: "partner-a"},
+		}, Error: "has no client secret"},
+		{Username: validUsername, Password: validPassword, Identities: []*ForwardingIdentity{
+			{Domains: []string{"partner-a.example.com"}},
+		}, Error: "must set either a username and password"},
+		{Username: validUsername, Password: validPassword, Identities: []*ForwardingIdentity{
+			{Username: "partner-a", Password: "secret"},
+		}, Error: "must list the destination domains"},
+		{Username: validUsername, Password: validPassword, Workload: map[string]string{"source": "X-Client", "pod": ""}},
+		{Username: validUsername, Password: validPassword, Workload: map[string]string{"address": "X-Client"}, Error: "invalid workload identity header"},
+		{Username: validUsername, Password: validPassword, Workload: map[string]string{"name": "X Workload"}, Error: "invalid name"},
+		{Username: validUsername, Password: validPassword, Header: "X-Forwarded-Access-Token"},
+		{Username: validUsername, Password: validPassword, Header: "X Token", Error: "invalid forwarding-token-header"},
+		{Username: validUsername, Password: validPassword, Excluded: []string{"api.example.com/public/*", "/health"}},
+		{Username: validUsername, Password: validPassword, Excluded: []string{"api.example.com"}, Error: "invalid forwarding exclude path"},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.DiscoveryURL = "https://keycloak.example.com/realms/test"
+		cfg.ClientSecret = c.Secret
+		cfg.ForwardingGrantType = c.GrantType
+		cfg.ForwardingUsername = c.Username
+		cfg.ForwardingPassword = c.Password
+		cfg.ForwardingDomains = c.Domains
+		cfg.ForwardingAudiences = c.Audiences
+		cfg.ForwardingDomainAudience = c.Granted
+		cfg.ForwardingIdentities = c.Identities
+		cfg.ForwardingWorkloadHeaders = c.Workload
+		cfg.ForwardingExcludePaths = c.Excluded
+		if c.Header != "" {
+			cfg.ForwardingTokenHeader = c.Header
+		}
+		if c.TLS != nil {
+			cfg.ForwardingTLS = []*ForwardingTLS{c.TLS}
+		}
+		err := cfg.isForwardingValid()
+		if c.Error == "" {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		if assert.Error(t, err, "case %d", i) {
+			assert.Contains(t, err.Error(), c.Error, "case %d", i)
+		}
+	}
+
+	// the tokens must be written to a header
+	cfg := newFakeKeycloakConfig()
+	cfg.DiscoveryURL = "https://keycloak.example.com/realms/test"
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = validPassword
+	cfg.ForwardingTokenHeader = ""
+	assert.Error(t, cfg.isForwardingValid())
+
+	// nor may the drain timeout be negative
+	cfg.ForwardingTokenHeader = authorizationHeader
+	cfg.ForwardingDrainTimeout = -time.Second
+	assert.Error(t, cfg.isForwardingValid())
+}
+
+func TestForwardingSignerWorkload(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.ForwardingWorkloadName = "billing"
+	cfg.ForwardingWorkloadHeaders = map[string]string{workloadHeaderSource: "x-workload-client"}
+	cfg.ForwardingWorkloadSkipDomains = []string{"public.example.com"}
+	signer := &forwardingSigner{
+		domains:  []string{"example.com"},
+		workload: newForwardingWorkload(cfg, ""),
+	}
+	signed := func(uri string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.RemoteAddr = "10.0.0.12:41234"
+		req.Header.Set(defaultWorkloadPodHeader, "spoofed/pod")
+		req.Header.Set(defaultWorkloadNameHeader, "spoofed")
+		signer.sign(req)
+		return req.Header
+	}
+
+	headers := signed("http://orders.example.com/")
+	assert.Equal(t, "10.0.0.12:41234", headers.Get("X-Workload-Client"))
+	assert.Equal(t, "billing", headers.Get(defaultWorkloadNameHeader))
+	// the pod is unknown outside of kubernetes, the value of the caller is not relayed
+	assert.Empty(t, headers.Get(defaultWorkloadPodHeader))
+	assert.Empty(t, headers.Get(defaultWorkloadSourceHeader))
+
+	// the skipped and the unsigned domains are relayed as is
+	for _, uri := range []string{"http://public.example.com/", "http://other.org/"} {
+		headers = signed(uri)
+		assert.Empty(t, headers.Get("X-Workload-Client"), uri)
+		assert.Equal(t, "spoofed", headers.Get(defaultWorkloadNameHeader), uri)
+	}
+}
+
+func TestForwardingSignerTokenHeader(t *testing.T) {
+	identity := &forwardingIdentity{name: "partner"}
+	identity.signature.Store(&forwardingSignature{token: "partner", authorization: "Bearer partner"})
+	signer := &forwardingSigner{
+		domains:    []string{"example.com"},
+		identities: []forwardingIdentityDomain{{domain: "partner.org", identity: identity}},
+	}
+	signer.signature.Store(&forwardingSignature{token: "proxy", authorization: "Bearer proxy"})
+	signed := func(uri string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.Header.Set(authorizationHeader, "Basic caller")
+		signer.sign(req)
+		return req.Header
+	}
+
+	cs := []struct {
+		Header   string
+		Prefix   string
+		Expected map[string]string
+	}{
+		{Expected: map[string]string{authorizationHeader: "Bearer proxy"}},
+		{Header: authorizationHeader, Prefix: "Bearer ", Expected: map[string]string{authorizationHeader: "Bearer proxy"}},
+		{Header: "authorization", Prefix: "Token ", Expected: map[string]string{authorizationHeader: "Token proxy"}},
+		{Header: "X-Forwarded-Access-Token", Expected: map[string]string{authorizationHeader: "Basic caller", "X-Forwarded-Access-Token": "proxy"}},
+		{Header: "X-Api-Token", Prefix: "JWT ", Expected: map[string]string{authorizationHeader: "Basic caller", "X-Api-Token": "JWT proxy"}},
+	}
+	for i, c := range cs {
+		signer.tokenHeader = c.Header
+		signer.tokenPrefix = c.Prefix
+		headers := signed("http://orders.example.com/")
+		for name, value := range c.Expected {
+			assert.Equal(t, value, headers.Get(name), "case %d, header %s", i, name)
+		}
+	}
+
+	// the identities write their tokens to the same header, the unsigned hosts are relayed as is
+	headers := signed("http://api.partner.org/")
+	assert.Equal(t, "JWT partner", headers.Get("X-Api-Token"))
+	assert.Equal(t, "Basic caller", headers.Get(authorizationHeader))
+	headers = signed("http://other.org/")
+	assert.Empty(t, headers.Get("X-Api-Token"))
+	assert.Equal(t, "Basic caller", headers.Get(authorizationHeader))
+}
+
+func TestForwardingSignerExcludePaths(t *testing.T) {
+	identity := &forwardingIdentity{name: "partner"}
+	identity.signature.Store(&forwardingSignature{token: "partner", authorization: "Bearer partner"})
+	exclusions, err := newForwardingExclusions([]string{"api.example.com/public/*", "api.example.com/health", "partner.org/*", "/metrics"})
+	require.NoError(t, err)
+	signer := &forwardingSigner{
+		domains:    []string{"example.com"},
+		identities: []forwardingIdentityDomain{{domain: "partner.org", identity: identity}},
+		exclusions: exclusions,
+	}
+	signer.signature.Store(&forwardingSignature{token: "proxy", authorization: "Bearer proxy"})
+	excluded := testutil.ToFloat64(forwardingRequestsMetric.WithLabelValues("excluded"))
+
+	cs := []struct {
+		URI      string
+		Expected string
+	}{
+		// a host matched without path restrictions
+		{URI: "http://orders.example.com/public/list", Expected: "Bearer proxy"},
+		// a host matched with path restrictions
+		{URI: "http://api.example.com/private/orders", Expected: "Bearer proxy"},
+		{URI: "http://api.example.com/public/list"},
+		{URI: "http://v2.api.example.com/public/"},
+		{URI: "http://api.example.com/public", Expected: "Bearer proxy"},
+		{URI: "http://api.example.com/Public/list", Expected: "Bearer proxy"},
+		{URI: "http://api.example.com/health"},
+		{URI: "http://api.example.com/health/live", Expected: "Bearer proxy"},
+		// the paths of any host, and the identities
+		{URI: "http://orders.example.com/metrics"},
+		{URI: "http://api.partner.org/orders"},
+	}
+	for _, c := range cs {
+		req := httptest.NewRequest(http.MethodGet, c.URI, nil)
+		signer.sign(req)
+		assert.Equal(t, c.Expected, req.Header.Get(authorizationHeader), c.URI)
+		if c.Expected == "" {
+			assert.Empty(t, req.Header.Get("X-Forwarded-Agent"), c.URI)
+		}
+	}
+	assert.Equal(t, excluded+5, testutil.ToFloat64(forwardingRequestsMetric.WithLabelValues("excluded")))
+
+	for _, entry := range []string{"api.example.com", "api.example.com/*/private", "*.example.com/public/*", "api.example.com:8443/public"} {
+		_, err := newForwardingExclusions([]string{entry})
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestResolveKubernetesPod(t *testing.T) {
+	// not running on kubernetes
+	pod, err := resolveKubernetesPod(t.TempDir())
+	require.NoError(t, err)
+	assert.Empty(t, pod)
+
+	// the pod of a bound token
+	dir := t.TempDir()
+	token, err := jose.NewJWT(jose.JOSEHeader{"alg": "RS256"}, jose.Claims{
+		"kubernetes.io": map[string]interface{}{
+			"namespace": "billing",
+			"pod":       map[string]interface{}{"name": "billing-7d4b9c-x2k8p"},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte(token.Encode()), 0600))
+	pod, err = resolveKubernetesPod(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "billing/billing-7d4b9c-x2k8p", pod)
+
+	// a legacy token: the namespace of the service account and the hostname of the pod
+	dir = t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("legacy"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "namespace"), []byte("orders\n"), 0600))
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		name, err = os.Hostname()
+		require.NoError(t, err)
+	}
+	pod, err = resolveKubernetesPod(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "orders/"+name, pod)
+}
+
+func TestForwardingSignerRefresh(t *testing.T) {
+	signer := &forwardingSigner{domains: []string{"signed.example.com"}}
+	issued := make(map[string]bool)
+	var tokens []jose.JWT
+	for i := 0; i < 10; i++ {
+		token := newTestToken("https://idp")
+		token.newJTI()
+		jwt := token.getToken()
+		tokens = append(tokens, jwt)
+		issued["Bearer "+jwt.Encode()] = true
+	}
+
+	// the requests are not signed before the first token
+	req := httptest.NewRequest(http.MethodGet, "http://signed.example.com/", nil)
+	signer.sign(req)
+	assert.Empty(t, req.Header.Get(authorizationHeader))
+
+	// the tokens are swapped while the requests are signed
+	signer.update(tokens[0])
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				req := httptest.NewRequest(http.MethodGet, "http://signed.example.com/", nil)
+				signer.sign(req)
+				if !assert.True(t, issued[req.Header.Get(authorizationHeader)]) {
+					return
+				}
+				unsigned := httptest.NewRequest(http.MethodGet, "http://other.example.com/", nil)
+				signer.sign(unsigned)
+				assert.Empty(t, unsigned.Header.Get(authorizationHeader))
+			}
+		}()
+	}
+	for _, token := range tokens {
+		signer.update(token)
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	req = httptest.NewRequest(http.MethodGet, "http://signed.example.com/", nil)
+	signer.sign(req)
+	assert.Equal(t, "Bearer "+tokens[len(tokens)-1].Encode(), req.Header.Get(authorizationHeader))
+}
+
+func TestForwardingLoopConcurrentSigning(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.ForwardingUsername = validUsername
+	cfg.ForwardingPassword = validPassword
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	// the clock of the proxy is past the expiry of the tokens, so each one is renewed at once
+	clock := newFakeClock()
+	clock.now = time.Now().Add(24 * time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	p.proxy.clock = clock
+	p.proxy.log = zap.NewNop()
+	p.proxy.forwardCtx = ctx
+	p.proxy.forwardCredentials = newForwardingCredentials(p.config, zap.NewNop())
+	signer := &forwardingSigner{log: zap.NewNop(), clock: clock}
+	identity := &forwardingIdentity{
+		name:        "concurrent-signing",
+		login:       p.proxy.forwardingLogin,
+		refreshes:   true,
+		update:      signer.update,
+		credentials: p.proxy.forwardCredentials,
+	}
+	counter := func(metric *prometheus.CounterVec) func() float64 {
+		return func() float64 {
+			return testutil.ToFloat64(metric.WithLabelValues("success"))
+		}
+	}
+	logins, refreshes := counter(forwardingLoginMetric), counter(forwardingRefreshMetric)
+	loggedIn, refreshed := logins(), refreshes()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- p.proxy.forwardingLoop(identity, signer, nil)
+	}()
+
+	// the requests are signed while the loop refreshes the token, and is woken up to log in again
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				req := httptest.NewRequest(http.MethodGet, "http://signed.example.com/", nil)
+				signer.sign(req)
+				if authorization := req.Header.Get(authorizationHeader); authorization != "" {
+					assert.True(t, strings.HasPrefix(authorization, "Bearer "))
+				}
+			}
+		}()
+	}
+	require.Eventually(t, func() bool {
+		identity.credentials.wake()
+		return logins() > loggedIn+3 && refreshes() > refreshed+3
+	}, 10*time.Second, 10*time.Millisecond)
+	close(done)
+	wg.Wait()
+
+	cancel()
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop is still running once canceled")
+	}
+}
+
+func BenchmarkForwardingSigner(b *testing.B) {
+	token := newTestToken("https://idp").getToken()
+
+	b.Run("snapshot", func(b *testing.B) {
+		signer := &forwardingSigner{}
+		signer.update(token)
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			req := httptest.NewRequest(http.MethodGet, "http://signed.example.com/", nil)
+			for pb.Next() {
+				signer.sign(req)
+			}
+		})
+	})
+
+	// the token guarded by a lock and encoded for each request, as signed before the snapshots
+	b.Run("locked", func(b *testing.B) {
+		var lock sync.RWMutex
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			req := httptest.NewRequest(http.MethodGet, "http://signed.example.com/", nil)
+			for pb.Next() {
+				lock.RLock()
+				current := token
+				lock.RUnlock()
+				req.Header.Set(authorizationHeader, fmt.Sprintf("Bearer %s", current.Encode()))
+			}
+		})
+	})
+}
+
+func TestForwardingTransports(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.ForwardingTLS = []*ForwardingTLS{
+		{Domains: []string{"appliance.internal"}, UpstreamTLS: UpstreamTLS{SkipVerify: true}},
+		{Domains: []string{"corp.internal"}, UpstreamTLS: UpstreamTLS{CA: testCertificateFile, ServerName: "localhost"}},
+	}
+	px := &oauthProxy{config: cfg, log: zap.NewNop()}
+	transports, err := px.createForwardingTransports()
+	require.NoError(t, err)
+	require.Len(t, transports, 2)
+
+	appliance := transports.of("appliance.internal")
+	require.NotNil(t, appliance)
+	assert.True(t, appliance.TLSClientConfig.InsecureSkipVerify)
+	corp := transports.of("api.corp.internal")
+	require.NotNil(t, corp)
+	assert.False(t, corp.TLSClientConfig.InsecureSkipVerify)
+	assert.Equal(t, "localhost", corp.TLSClientConfig.ServerName)
+	assert.NotNil(t, corp.TLSClientConfig.RootCAs)
+	// the other destinations use the default transport
+	assert.Nil(t, transports.of("example.com"))
+}
+
+func TestForwardingTransportsExpiredClientCertificate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	certificate, err := createCertificate(key, []string{"gatekeeper.internal"}, time.Hour)
+	require.NoError(t, err)
+	cfg := newFakeKeycloakConfig()
+	cfg.ForwardingTLS = []*ForwardingTLS{{
+		Domains: []string{"mtls.internal", "mtls.corp"},
+		UpstreamTLS: UpstreamTLS{
+			ClientCertificate: writeTestAssertionKey(t, "CERTIFICATE", certificate.Certificate[0]),
+			ClientPrivateKey:  writeTestAssertionKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+		},
+	}}
+	core, logs := observer.New(zapcore.ErrorLevel)
+	clock := newFakeClock()
+	clock.now = time.Now()
+	px := &oauthProxy{config: cfg, log: zap.New(core), clock: clock}
+
+	transports, err := px.createForwardingTransports()
+	require.NoError(t, err)
+	assert.Zero(t, logs.Len(), "a valid client certificate is not reported")
+	transport := transports.of("api.mtls.internal")
+	require.NotNil(t, transport)
+
+	// the certificate expires while the proxy runs: the next handshakes still present it, and the first one reports it
+	clock.advance(2 * time.Hour)
+	for i := 0; i < 3; i++ {
+		presented, err := transport.TLSClientConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+		require.NoError(t, err)
+		assert.Equal(t, certificate.Certificate, presented.Certificate)
+	}
+	reported := logs.FilterMessageSnippet("client certificate has expired").AllUntimed()
+	require.Len(t, reported, 1)
+	assert.Equal(t, []interface{}{"mtls.internal", "mtls.corp"}, reported[0].ContextMap()["domains"])
+
+	// an expired certificate is reported on startup
+	logs.TakeAll()
+	_, err = px.createForwardingTransports()
+	require.NoError(t, err)
+	assert.Equal(t, 1, logs.FilterMessageSnippet("client certificate has expired").Len())
+
+	// a client certificate which can't be loaded fails the startup
+	cfg.ForwardingTLS[0].ClientCertificate = filepath.Join(t.TempDir(), "missing.pem")
+	_, err = px.createForwardingTransports()
+	assert.Error(t, err)
+}
@@ -16,10 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -374,6 +376,58 @@ func TestDisableAuthorizationCookie(t *testing.T) {
 			ExpectedCode:            http.StatusOK,
 			ExpectedProxy:           true,
 		},
+		{
+			URI: "/auth_all/test",
+			Cookies: []*http.Cookie{
+				{Name: c.CookieAccessName, Value: signed.Encode()},
+				{Name: c.CookieAccessName + "-1", Value: "chunk"},
+				{Name: c.CookieAccessName + "-level", Value: "high"},
+				{Name: c.CookieRefreshName, Value: "refresh"},
+			},
+			HasToken:                true,
+			ExpectedContentContains: "kc-access=redacted; kc-access-1=redacted; kc-access-level=high; kc-state=redacted",
+			ExpectedCode:            http.StatusOK,
+			ExpectedProxy:           true,
+		},
+	}
+	p.RunTests(t, requests)
+}
+
+func TestDropAuthorizationCookie(t *testing.T) {
+	c := newFakeKeycloakConfig()
+	c.EnableAuthorizationCookies = false
+	c.CookieFilterMode = cookieFilterDrop
+	c.FilterCookies = []string{"session*"}
+	p := newFakeProxy(c)
+	token := newTestToken(p.idp.getLocation())
+	signed, _ := p.idp.signToken(token.claims)
+
+	requests := []fakeRequest{
+		{
+			URI: "/auth_all/test",
+			Cookies: []*http.Cookie{
+				{Name: c.CookieAccessName, Value: signed.Encode()},
+				{Name: c.CookieAccessName + "-1", Value: "chunk"},
+				{Name: c.CookieAccessName + "-level", Value: "high"},
+				{Name: c.CookieRefreshName, Value: "refresh"},
+				{Name: "session_id", Value: "id"},
+				{Name: "mycookie", Value: "myvalue"},
+			},
+			HasToken:                true,
+			ExpectedContentContains: `"Cookie":["kc-access-level=high; mycookie=myvalue"]`,
+			ExpectedCode:            http.StatusOK,
+			ExpectedProxy:           true,
+		},
+		{
+			URI: "/auth_all/test",
+			Cookies: []*http.Cookie{
+				{Name: c.CookieAccessName, Value: signed.Encode()},
+			},
+			HasToken:               true,
+			ExpectedNoProxyHeaders: []string{"Cookie"},
+			ExpectedCode:           http.StatusOK,
+			ExpectedProxy:          true,
+		},
 	}
 	p.RunTests(t, requests)
 }
@@ -438,10 +492,14 @@ func newFakeKeycloakConfig() *Config {
 		EnableLogging:              false,
 		EnableLoginHandler:         true,
 		EnableTokenHeader:          true,
+		ForwardingLoginBackoffMax:  5 * time.Minute,
+		ForwardingTokenHeader:      authorizationHeader,
+		ForwardingTokenPrefix:      authorizationType + " ",
 		Listen:                     "127.0.0.1:0",
 		OAuthURI:                   "/oauth",
 		OpenIDProviderTimeout:      time.Second * 5,
 		Scopes:                     []string{},
+		UpstreamEnableHTTP2:        true,
 		Verbose:                    false,
 		Resources: []*Resource{
 			{
@@ -509,6 +567,7 @@ type fakeUpstreamResponse struct {
 	Address string      `json:"address"`
 	Headers http.Header `json:"headers"`
 	Message string      `json:"message"`
+	Proto   string      `json:"proto"`
 }
 
 // fakeUpstreamService acts as a fake upstream service, returns the headers and request
@@ -524,6 +583,7 @@ func (f *fakeUpstreamService) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		Address: r.RemoteAddr,
 		Headers: r.Header,
 		Message: "upstream called",
+		Proto:   r.Proto,
 	})
 	if err != nil {
 		panic(fmt.Sprintf("test error: could not marshal: %v", err))
@@ -531,6 +591,50 @@ func (f *fakeUpstreamService) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	_, _ = w.Write(content)
 }
 
+// newStreamingUpstream starts an https upstream offering http/2, which streams the protocol of the request before
+// holding the response until released
+func newStreamingUpstream(t *testing.T) (*httptest.Server, chan struct{}) {
+	release := make(chan struct{})
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprintln(w, req.Proto)
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+		_, _ = fmt.Fprintln(w, "done")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+
+	return upstream, release
+}
+
+// readStreamed reads the protocol streamed by the upstream before it is released, then the rest of the response
+func readStreamed(t *testing.T, resp *http.Response, release chan struct{}) string {
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line := make(chan string, 1)
+	go func() {
+		proto, _ := reader.ReadString('\n')
+		line <- strings.TrimSpace(proto)
+	}()
+	var proto string
+	select {
+	case proto = <-line:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the response is buffered until the upstream completes")
+	}
+	close(release)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "done\n", string(rest))
+
+	return proto
+}
+
 type fakeToken struct {
 	claims jose.Claims
 }
@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -20,6 +23,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc/jose"
 	"go.uber.org/zap"
@@ -29,10 +33,22 @@ import (
 func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
 	var isBearer bool
 	// step: check for a bearer token or cookie with jwt token
-	access, isBearer, err := getTokenInRequest(req, r.config.CookieAccessName)
+	name := r.requestCookieName(req, r.config.CookieAccessName)
+	access, isBearer, err := getTokenInRequest(req, name, r.rankAccessToken)
 	if err != nil {
 		return nil, err
 	}
+	if !isBearer && hasDuplicateCookies(req, name) {
+		r.log.Warn("the session cookie is sent more than once, e.g. after a change of the cookie domain",
+			zap.String("cookie", name),
+			zap.String("client_ip", req.RemoteAddr))
+	}
+	if r.tokenSizeLimit.exceeded(r.log, len(access), zap.String("client_ip", req.RemoteAddr), zap.Bool("bearer", isBearer)) {
+		return nil, ErrTokenTooLarge
+	}
+	if !isBearer && r.cookieChunksLimit.exceeded(r.log, countCookieChunks(req, name), zap.String("client_ip", req.RemoteAddr)) {
+		return nil, ErrTooManyCookieChunks
+	}
 	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie && !isBearer {
 		if access, err = decodeText(access, r.config.EncryptionKey); err != nil {
 			return nil, ErrDecryption
@@ -42,7 +58,7 @@ func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
 	if err != nil {
 		return nil, err
 	}
-	user, err := extractIdentity(token)
+	user, err := extractIdentity(token, r.config.identityClaims())
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +76,7 @@ func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
 
 // getRefreshTokenFromCookie returns the refresh token from the cookie if any
 func (r *oauthProxy) getRefreshTokenFromCookie(req *http.Request) (string, error) {
-	token, err := getTokenInCookie(req, r.config.CookieRefreshName)
+	token, err := getRankedTokenInCookie(req, r.requestCookieName(req, r.config.CookieRefreshName), r.rankRefreshToken)
 	if err != nil {
 		return "", err
 	}
@@ -68,8 +84,36 @@ func (r *oauthProxy) getRefreshTokenFromCookie(req *http.Request) (string, error
 	return token, nil
 }
 
-// getTokenInRequest returns the access token from the http request
-func getTokenInRequest(req *http.Request, name string) (string, bool, error) {
+// serverSessionID returns the server-side session id carried by the refresh cookie
+func (r *oauthProxy) serverSessionID(req *http.Request) (string, error) {
+	id, err := r.getRefreshTokenFromCookie(req)
+	if err != nil {
+		return "", err
+	}
+	if !serverSessionIDFilter.MatchString(id) {
+		return "", ErrNoSessionStateFound
+	}
+
+	return id, nil
+}
+
+// getIDTokenFromCookie returns the id token from the cookie if any
+func (r *oauthProxy) getIDTokenFromCookie(req *http.Request) (string, error) {
+	token, err := getRankedTokenInCookie(req, r.requestCookieName(req, r.config.CookieIDTokenName), r.rankAccessToken)
+	if err != nil {
+		return "", err
+	}
+	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
+		if token, err = decodeText(token, r.config.EncryptionKey); err != nil {
+			return "", ErrDecryption
+		}
+	}
+
+	return token, nil
+}
+
+// getTokenInRequest returns the access token from the http request, see getRankedTokenInCookie for the rank
+func getTokenInRequest(req *http.Request, name string, rank func(string) int) (string, bool, error) {
 	bearer := true
 	// step: check for a token in the authorization header
 	token, err := getTokenInBearer(req)
@@ -77,7 +121,7 @@ func getTokenInRequest(req *http.Request, name string) (string, bool, error) {
 		if err != ErrSessionNotFound {
 			return "", false, err
 		}
-		if token, err = getTokenInCookie(req, name); err != nil {
+		if token, err = getRankedTokenInCookie(req, name, rank); err != nil {
 			return token, false, err
 		}
 		bearer = false
@@ -104,27 +148,259 @@ func getTokenInBearer(req *http.Request) (string, error) {
 	return items[1], nil
 }
 
+// countCookieChunks returns the number of chunks of a cookie in the request
+func countCookieChunks(req *http.Request, name string) int {
+	if findCookie(name, req.Cookies()) == nil {
+		return 0
+	}
+	chunks := 1
+	for findCookie(name+"-"+strconv.Itoa(chunks), req.Cookies()) != nil {
+		chunks++
+	}
+
+	return chunks
+}
+
 // getTokenInCookie retrieves the access token from the request cookies
 func getTokenInCookie(req *http.Request, name string) (string, error) {
-	var token bytes.Buffer
+	return getRankedTokenInCookie(req, name, nil)
+}
 
-	if cookie := findCookie(name, req.Cookies()); cookie != nil {
-		token.WriteString(cookie.Value)
+// getRankedTokenInCookie retrieves a token from the request cookies.
+//
+// A cookie is sent more than once when it is set on several domains, e.g. after a change of the cookie domain, and
+// the browsers do not tell the domains apart. The variants of the token are then ranked, the first variant with the
+// highest rank wins: a rank of 0 stands for a variant which cannot be decoded.
+func getRankedTokenInCookie(req *http.Request, name string, rank func(string) int) (string, error) {
+	candidates := cookieCandidates(req, name)
+	if len(candidates) == 0 {
+		return "", ErrSessionNotFound
 	}
+	if len(candidates) == 1 || rank == nil {
+		return decompressCookieValue(candidates[0])
+	}
+
+	var token string
+	var err error
+	best := -1
+	for _, candidate := range candidates {
+		value, erd := decompressCookieValue(candidate)
+		if erd != nil {
+			if best < 0 {
+				err = erd
+			}
+			continue
+		}
+		if score := rank(value); score > best {
+			token, err, best = value, nil, score
+		}
+	}
+
+	return token, err
+}
 
-	// add also divided cookies
+// cookieCandidates returns the possible values of a cookie and its chunks, in the order of the request.
+//
+// When the cookie is sent once, the value is the concatenation of the chunks. Otherwise, the chunks of the variants
+// are mixed up: the n-th variant is assembled with the n-th variant of each chunk (or its only variant), with all
+// the chunks then less and less of them, since the variants may not have the same number of chunks.
+func cookieCandidates(req *http.Request, name string) []string {
+	heads := cookieValues(req, name)
+	var chunks [][]string
 	for i := 1; i < 600; i++ {
-		cookie := findCookie(name+"-"+strconv.Itoa(i), req.Cookies())
-		if cookie == nil {
+		values := cookieValues(req, name+"-"+strconv.Itoa(i))
+		if len(values) == 0 {
 			break
-		} else {
-			token.WriteString(cookie.Value)
 		}
+		chunks = append(chunks, values)
+	}
+	if len(heads) == 0 {
+		return nil
 	}
 
-	if token.Len() == 0 {
-		return "", ErrSessionNotFound
+	duplicated := len(heads) > 1
+	for _, values := range chunks {
+		duplicated = duplicated || len(values) > 1
+	}
+	if !duplicated {
+		var token bytes.Buffer
+		token.WriteString(heads[0])
+		for _, values := range chunks {
+			token.WriteString(values[0])
+		}
+
+		return []string{token.String()}
+	}
+
+	candidates := make([]string, 0, len(heads)*(len(chunks)+1))
+	for n, head := range heads {
+		for count := len(chunks); count >= 0; count-- {
+			var token bytes.Buffer
+			token.WriteString(head)
+			for _, values := range chunks[:count] {
+				if n < len(values) {
+					token.WriteString(values[n])
+				} else {
+					token.WriteString(values[len(values)-1])
+				}
+			}
+			candidates = append(candidates, token.String())
+		}
+	}
+
+	return candidates
+}
+
+// cookieValues returns the values of all the cookies with the name in the request
+func cookieValues(req *http.Request, name string) []string {
+	var values []string
+	for _, cookie := range req.Cookies() {
+		if cookie.Name == name {
+			values = append(values, cookie.Value)
+		}
+	}
+
+	return values
+}
+
+// hasDuplicateCookies checks if a cookie or one of its chunks is sent more than once
+func hasDuplicateCookies(req *http.Request, name string) bool {
+	if len(cookieValues(req, name)) > 1 {
+		return true
+	}
+	for i := 1; i < 600; i++ {
+		values := cookieValues(req, name+"-"+strconv.Itoa(i))
+		if len(values) == 0 {
+			return false
+		}
+		if len(values) > 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rankAccessToken ranks the variants of the access and id token cookies: a verified token wins over a token which
+// has not expired, e.g. assembled with the chunk of another variant, which wins over an expired token, which wins
+// over a value which cannot be decrypted or parsed
+func (r *oauthProxy) rankAccessToken(value string) int {
+	var err error
+	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
+		if value, err = decodeText(value, r.config.EncryptionKey); err != nil {
+			return 0
+		}
+	}
+	token, err := jose.ParseJWT(value)
+	if err != nil {
+		return 0
+	}
+	claims, err := token.Claims()
+	if err != nil {
+		return 0
+	}
+	if expires, ok, err := claims.TimeClaim("exp"); err == nil && ok && r.now().After(expires) {
+		return 1
+	}
+	if r.client != nil && r.verifyTokenSignature(r.client, token) == nil {
+		return 3
+	}
+
+	return 2
+}
+
+// rankRefreshToken ranks the variants of the refresh cookie: a session id or a refresh token which can be decrypted
+// wins over any other value
+func (r *oauthProxy) rankRefreshToken(value string) int {
+	if r.config.EnableServerSideSessions {
+		if serverSessionIDFilter.MatchString(value) {
+			return 1
+		}
+
+		return 0
+	}
+	if _, err := decodeText(value, r.config.EncryptionKey); err != nil {
+		return 0
+	}
+
+	return 1
+}
+
+// sessionActivityInterval is the minimum interval between two records of the activity of a session, so the
+// activity cookie is not dropped on every request
+func (r *oauthProxy) sessionActivityInterval() time.Duration {
+	interval := time.Minute
+	if quarter := r.config.SessionIdleTimeout / 4; quarter < interval {
+		interval = quarter
+	}
+
+	return interval
+}
+
+// checkSessionActivity refuses the sessions which have been idle for longer than the idle timeout, and records
+// the activity of the session when it has not been recorded for a while
+func (r *oauthProxy) checkSessionActivity(w http.ResponseWriter, req *http.Request, user *userContext) error {
+	last, id, err := r.getSessionActivity(req, user)
+	if err != nil {
+		return err
+	}
+	now := r.now()
+	idle := now.Sub(last)
+	if idle > r.config.SessionIdleTimeout {
+		return ErrSessionIdle
+	}
+	if idle >= r.sessionActivityInterval() {
+		if err := r.recordSessionActivity(w, req, user.id, id, now); err != nil {
+			r.log.Warn("unable to record the activity of the session", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// getSessionActivity returns the last activity of the session, and the id of the server-side session if any.
+// The activity of the server-side sessions is kept in the store, the activity of the other sessions in the
+// encrypted activity cookie, bound to the subject. A missing activity is handled like an idle session.
+func (r *oauthProxy) getSessionActivity(req *http.Request, user *userContext) (time.Time, string, error) {
+	if r.config.EnableServerSideSessions {
+		if id, err := r.serverSessionID(req); err == nil {
+			last, err := r.getServerSessionActivity(id)
+			return last, id, err
+		}
+	}
+
+	cookie, err := req.Cookie(r.requestCookieName(req, activityCookie))
+	if err != nil {
+		return time.Time{}, "", ErrSessionIdle
+	}
+	value, err := decodeText(cookie.Value, r.config.EncryptionKey)
+	if err != nil {
+		return time.Time{}, "", ErrDecryption
+	}
+	i := strings.LastIndex(value, "|")
+	if i < 0 || value[:i] != user.id {
+		return time.Time{}, "", ErrInvalidSession
+	}
+	seconds, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidSession
+	}
+
+	return time.Unix(seconds, 0), "", nil
+}
+
+// recordSessionActivity records the last activity of a session, in the store for a server-side session, or
+// in the activity cookie otherwise, which expires after the idle timeout
+func (r *oauthProxy) recordSessionActivity(w http.ResponseWriter, req *http.Request, subject, id string, at time.Time) error {
+	if id != "" {
+		return r.setServerSessionActivity(id, at)
+	}
+
+	value, err := encodeText(subject+"|"+strconv.FormatInt(at.Unix(), 10), r.config.EncryptionKey)
+	if err != nil {
+		return ErrEncryption
 	}
+	r.dropCookie(w, req, r.cookieName(activityCookie), value, r.config.SessionIdleTimeout)
 
-	return token.String(), nil
+	return nil
 }
@@ -1,3 +1,6 @@
+//go:build !noreverse
+// +build !noreverse
+
 /*
 Copyright 2015 All rights reserved.
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -18,9 +21,14 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resty "gopkg.in/resty.v1"
 )
 
 func TestGetIndentity(t *testing.T) {
@@ -124,7 +132,7 @@ func TestGetTokenInRequest(t *testing.T) {
 				})
 			}
 		}
-		access, bearer, err := getTokenInRequest(req, defaultName)
+		access, bearer, err := getTokenInRequest(req, defaultName, nil)
 		switch x.Error {
 		case nil:
 			assert.NoError(t, err, "case %d should not have thrown an error", i)
@@ -180,3 +188,145 @@ func TestGetRefreshTokenFromCookie(t *testing.T) {
 		}
 	}
 }
+
+func TestSessionIdleTimeout(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EncryptionKey = testKey
+	cfg.SessionIdleTimeout = time.Hour
+	subject, ok := defaultTestTokenClaims["sub"].(string)
+	require.True(t, ok)
+
+	activity := func(subject string, at time.Time) []*http.Cookie {
+		value, err := encodeText(subject+"|"+strconv.FormatInt(at.Unix(), 10), testKey)
+		require.NoError(t, err)
+		return []*http.Cookie{{Name: activityCookie, Path: "/", Value: value}}
+	}
+	noActivityRecorded := func(i int, _ *resty.Request, resp *resty.Response) {
+		assert.Nil(t, findCookie(activityCookie, resp.Cookies()), "case %d, the activity is recorded at most once a minute", i)
+	}
+
+	requests := []fakeRequest{
+		{
+			// the login starts the idle timeout
+			URI:              cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			ExpectedCookies:  map[string]string{activityCookie: ""},
+			ExpectedLocation: "/",
+			ExpectedCode:     http.StatusTemporaryRedirect,
+		},
+		{
+			URI:            "/auth_all/test",
+			HasToken:       true,
+			HasCookieToken: true,
+			Cookies:        activity(subject, time.Now()),
+			ExpectedProxy:  true,
+			ExpectedCode:   http.StatusOK,
+			OnResponse:     noActivityRecorded,
+		},
+		{
+			URI:             "/auth_all/test",
+			HasToken:        true,
+			HasCookieToken:  true,
+			Cookies:         activity(subject, time.Now().Add(-10*time.Minute)),
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedCookies: map[string]string{activityCookie: ""},
+		},
+		{
+			// the access token is still valid, but the session has been idle for too long
+			URI:              "/auth_all/test",
+			HasToken:         true,
+			HasCookieToken:   true,
+			Redirects:        true,
+			Cookies:          activity(subject, time.Now().Add(-2*time.Hour)),
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedLocation: "/oauth/authorize?state",
+		},
+		{
+			URI:              "/auth_all/test",
+			HasToken:         true,
+			HasCookieToken:   true,
+			Redirects:        true,
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedLocation: "/oauth/authorize?state",
+		},
+		{
+			// the activity of a session cannot be replayed for another subject
+			URI:              "/auth_all/test",
+			HasToken:         true,
+			HasCookieToken:   true,
+			Redirects:        true,
+			Cookies:          activity("another", time.Now()),
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedLocation: "/oauth/authorize?state",
+		},
+		{
+			// the bearer tokens are not sessions
+			URI:           "/auth_all/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    noActivityRecorded,
+		},
+	}
+	newFakeProxy(cfg).RunTests(t, requests)
+}
+
+func TestCheckSessionActivityClock(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EncryptionKey = testKey
+	cfg.SessionIdleTimeout = 10 * time.Minute
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	clock := newFakeClock()
+	p.proxy.clock = clock
+	user := &userContext{id: "subject"}
+
+	// the activity is recorded at the login
+	login := clock.Now()
+	recorder := httptest.NewRecorder()
+	require.NoError(t, p.proxy.recordSessionActivity(recorder, newFakeHTTPRequest(http.MethodGet, "/"), user.id, "", login))
+	activity := findCookie(activityCookie, recorder.Result().Cookies())
+	require.NotNil(t, activity)
+	assert.True(t, login.Add(cfg.SessionIdleTimeout).Equal(activity.Expires))
+	check := func() (*http.Cookie, error) {
+		req := newFakeHTTPRequest(http.MethodGet, "/auth_all/test")
+		req.AddCookie(activity)
+		recorder := httptest.NewRecorder()
+		err := p.proxy.checkSessionActivity(recorder, req, user)
+
+		return findCookie(activityCookie, recorder.Result().Cookies()), err
+	}
+
+	// a request within the activity interval does not record the activity again
+	clock.advance(p.proxy.sessionActivityInterval() - time.Second)
+	recorded, err := check()
+	require.NoError(t, err)
+	assert.Nil(t, recorded)
+
+	// a session idle for exactly the idle timeout is still active
+	clock.advance(cfg.SessionIdleTimeout - p.proxy.sessionActivityInterval() + time.Second)
+	recorded, err = check()
+	require.NoError(t, err)
+	require.NotNil(t, recorded, "the activity is recorded again")
+	assert.True(t, clock.Now().Add(cfg.SessionIdleTimeout).Equal(recorded.Expires))
+
+	// a second later, the same activity is idle for too long
+	clock.advance(time.Second)
+	_, err = check()
+	assert.Equal(t, ErrSessionIdle, err)
+
+	// while the activity recorded by the previous request extends the session
+	activity = recorded
+	_, err = check()
+	assert.NoError(t, err)
+}
+
+func TestSessionActivityInterval(t *testing.T) {
+	p := &oauthProxy{config: &Config{SessionIdleTimeout: time.Hour}}
+	assert.Equal(t, time.Minute, p.sessionActivityInterval())
+	p.config.SessionIdleTimeout = 2 * time.Minute
+	assert.Equal(t, 30*time.Second, p.sessionActivityInterval())
+}
@@ -0,0 +1,115 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// stepUpStatePrefix marks the part of the state cookie recording that the authorization steps up the authentication
+// of the session, after the state and the nonce
+const stepUpStatePrefix = "step-up:"
+
+// writeStepUpStateCookie sets the state cookie of an authorization stepping up the authentication of the session to
+// an authentication context class, recording the uri the user returns to, and returns the state
+func (r *oauthProxy) writeStepUpStateCookie(req *http.Request, w http.ResponseWriter, acr string) string {
+	state := uuid.NewString()
+	stepUp := url.Values{"acr": {acr}, "uri": {req.URL.RequestURI()}}
+	r.dropCookie(w, req, r.cookieName(requestStateCookie), state+"|"+uuid.NewString()+"|"+stepUpStatePrefix+stepUp.Encode(), 0)
+
+	return state
+}
+
+// splitStepUpState splits the value of the state cookie into the state and the nonce, and the step-up if any
+func splitStepUpState(value string) (string, url.Values) {
+	i := strings.LastIndex(value, "|")
+	if i < 0 || !strings.HasPrefix(value[i+1:], stepUpStatePrefix) {
+		return value, nil
+	}
+	stepUp, err := url.ParseQuery(strings.TrimPrefix(value[i+1:], stepUpStatePrefix))
+	if err != nil || stepUp.Get("acr") == "" {
+		return value[:i], nil
+	}
+
+	return value[:i], stepUp
+}
+
+// getStepUp returns the authentication context class and the uri of the step-up recorded in the state cookie of the
+// authorization with the state, if any
+func (r *oauthProxy) getStepUp(req *http.Request, state string) (string, string, bool) {
+	cookie, err := req.Cookie(r.requestCookieName(req, requestStateCookie))
+	if err != nil {
+		return "", "", false
+	}
+	_, stepUp := splitStepUpState(cookie.Value)
+	if stepUp == nil {
+		return "", "", false
+	}
+	if expected, _, _ := r.getStateParameter(req); state == "" || expected != state {
+		return "", "", false
+	}
+
+	return stepUp.Get("acr"), stepUp.Get("uri"), true
+}
+
+// acrOf returns the authentication context class of the session a token was issued in
+func acrOf(token jose.JWT) string {
+	claims, err := token.Claims()
+	if err != nil {
+		return ""
+	}
+	acr, _, _ := claims.StringClaim(claimACR)
+
+	return acr
+}
+
+// stepUpAuthentication responds to a request of a session which is not authenticated with the authentication context
+// class required by a resource: the browsers are sent back to the provider to log in again at the level required,
+// returning to the uri requested, while the other clients are refused with a 401 telling the level required
+func (r *oauthProxy) stepUpAuthentication(w http.ResponseWriter, req *http.Request, user *userContext, acr string) context.Context {
+	if user.isBearer() || r.config.NoRedirects || r.config.SkipTokenVerification ||
+		(req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		w.Header().Set(headerWWWAuthenticate, fmt.Sprintf(
+			`%s error="insufficient_user_authentication", error_description="a different authentication level is required", acr_values=%q`,
+			authorizationType, acr))
+		r.errorResponse(w, req, "", http.StatusUnauthorized, nil)
+
+		return r.revokeProxy(w, req)
+	}
+
+	state := r.writeStepUpStateCookie(req, w, acr)
+	r.log.Debug("stepping up the authentication of the session",
+		zap.String("email", user.email),
+		zap.String("acr", user.acr),
+		zap.String("required", acr))
+	location := r.config.WithOAuthURI(authorizationURL + "?state=" + state)
+	if r.config.InvalidAuthRedirectsWith303 {
+		return r.redirectToURL(location, w, req, http.StatusSeeOther)
+	}
+
+	return r.redirectToURL(location, w, req, http.StatusTemporaryRedirect)
+}
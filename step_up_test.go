@@ -0,0 +1,203 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStepUpConfig() *Config {
+	c := newFakeKeycloakConfig()
+	c.Resources = []*Resource{
+		{
+			URL:     "/payments/*",
+			Methods: allHTTPMethods,
+			ACR:     "2",
+		},
+		{
+			URL:     "/auth_all/*",
+			Methods: allHTTPMethods,
+		},
+	}
+
+	return c
+}
+
+func TestStepUpMiddleware(t *testing.T) {
+	insufficient := `Bearer error="insufficient_user_authentication", error_description="a different authentication level is required", acr_values="2"`
+	newFakeProxy(newStepUpConfig()).RunTests(t, []fakeRequest{
+		{
+			URI:           "/payments/transfer",
+			HasToken:      true,
+			TokenClaims:   map[string]interface{}{"acr": "2"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// a higher level of assurance satisfies the resource
+			URI:           "/payments/transfer",
+			HasToken:      true,
+			TokenClaims:   map[string]interface{}{"acr": "3"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:             "/payments/transfer",
+			HasToken:        true,
+			TokenClaims:     map[string]interface{}{"acr": "1"},
+			ExpectedCode:    http.StatusUnauthorized,
+			ExpectedHeaders: map[string]string{headerWWWAuthenticate: insufficient},
+		},
+		{
+			URI:             "/payments/transfer",
+			HasToken:        true,
+			ExpectedCode:    http.StatusUnauthorized,
+			ExpectedHeaders: map[string]string{headerWWWAuthenticate: insufficient},
+		},
+		{
+			// the browsers are sent back to the provider
+			URI:              "/payments/transfer",
+			HasToken:         true,
+			HasCookieToken:   true,
+			TokenClaims:      map[string]interface{}{"acr": "1"},
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedLocation: "/oauth/authorize?state=",
+		},
+		{
+			// the requests which would lose their body are refused
+			URI:             "/payments/transfer",
+			Method:          http.MethodPost,
+			HasToken:        true,
+			HasCookieToken:  true,
+			TokenClaims:     map[string]interface{}{"acr": "1"},
+			ExpectedCode:    http.StatusUnauthorized,
+			ExpectedHeaders: map[string]string{headerWWWAuthenticate: insufficient},
+		},
+		{
+			URI:           "/auth_all/test",
+			HasToken:      true,
+			TokenClaims:   map[string]interface{}{"acr": "1"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+}
+
+func TestStepUpAuthorization(t *testing.T) {
+	cfg := newStepUpConfig()
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(location string, cookies ...*http.Cookie) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, location, nil)
+		require.NoError(t, err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		return resp
+	}
+	token := newTestToken(p.idp.getLocation())
+	token.merge(map[string]interface{}{"acr": "1"})
+	signed, err := p.idp.signToken(token.claims)
+	require.NoError(t, err)
+	session := &http.Cookie{Name: cfg.CookieAccessName, Value: signed.Encode()}
+
+	stepUp := func() *http.Response {
+		resp := get(p.getServiceURL()+"/payments/transfer?amount=10", session)
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		state := findCookie(requestStateCookie, resp.Cookies())
+		require.NotNil(t, state)
+		assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), cfg.WithOAuthURI(authorizationURL)+"?state="))
+
+		// the provider is asked for a new login at the level required
+		resp = get(p.getServiceURL()+resp.Header.Get("Location"), state)
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+		authorization, err := url.Parse(resp.Header.Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "2", authorization.Query().Get("acr_values"))
+		assert.Equal(t, "login", authorization.Query().Get("prompt"))
+
+		resp = get(authorization.String())
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+		return get(resp.Header.Get("Location"), state)
+	}
+
+	// the user returns to the uri requested
+	resp := stepUp()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "/payments/transfer?amount=10", resp.Header.Get("Location"))
+	assert.NotNil(t, findCookie(cfg.CookieAccessName, resp.Cookies()))
+
+	// the user is refused when the provider did not reach the level required
+	p.idp.reachedACR = "1"
+	resp = stepUp()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestSplitStepUpState(t *testing.T) {
+	state, stepUp := splitStepUpState("state|nonce|" + stepUpStatePrefix + url.Values{"acr": {"2"}, "uri": {"/payments?a=1&b=2"}}.Encode())
+	assert.Equal(t, "state|nonce", state)
+	assert.Equal(t, "2", stepUp.Get("acr"))
+	assert.Equal(t, "/payments?a=1&b=2", stepUp.Get("uri"))
+
+	state, stepUp = splitStepUpState("state|nonce")
+	assert.Equal(t, "state|nonce", state)
+	assert.Nil(t, stepUp)
+
+	state, stepUp = splitStepUpState("state|nonce|" + stepUpStatePrefix + "uri=%2F")
+	assert.Equal(t, "state|nonce", state)
+	assert.Nil(t, stepUp, "a step-up requires an acr")
+}
+
+func TestACRSatisfies(t *testing.T) {
+	cases := []struct {
+		ACR      string
+		Required string
+		Expected bool
+	}{
+		{Expected: true},
+		{ACR: "1", Expected: true},
+		{ACR: "2", Required: "2", Expected: true},
+		{ACR: "3", Required: "2", Expected: true},
+		{ACR: "1", Required: "2"},
+		{Required: "2"},
+		{ACR: "gold", Required: "gold", Expected: true},
+		{ACR: "silver", Required: "gold"},
+		{ACR: "3", Required: "gold"},
+	}
+	for i, c := range cases {
+		assert.Equal(t, c.Expected, acrSatisfies(c.ACR, c.Required), "case %d", i)
+	}
+}
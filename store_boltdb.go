@@ -19,15 +19,27 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"go.uber.org/zap"
 )
 
-var dbName = []byte("keycloak")
+var (
+	dbName = []byte("keycloak")
+	// legacyExpiryBucketName held the expiration time of the entries set with a ttl, before the envelopes
+	legacyExpiryBucketName = []byte("keycloak-expiry")
+)
+
+// boltdbEnvelopeHeader prefixes the entries set with a ttl, followed by the expiration time and the value.
+// The entries set without ttl are stored as is, and cannot start with a zero byte.
+var boltdbEnvelopeHeader = []byte{0x00, 0x01}
 
 var (
 	// ErrNoBoltdbBucket means the bucket does not exist
@@ -37,6 +49,7 @@ var (
 // A local file store used to hold the refresh tokens
 type boltdbStore struct {
 	client *bolt.DB
+	now    func() time.Time
 }
 
 func newBoltDBStore(location *url.URL) (storage, error) {
@@ -51,15 +64,59 @@ func newBoltDBStore(location *url.URL) (storage, error) {
 
 	// step: create the bucket
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, e := tx.CreateBucketIfNotExists(dbName)
-		return e
+		bucket, e := tx.CreateBucketIfNotExists(dbName)
+		if e != nil {
+			return e
+		}
+		return migrateBoltDBExpiry(tx, bucket)
 	})
 
 	return &boltdbStore{
 		client: db,
+		now:    time.Now,
 	}, err
 }
 
+// migrateBoltDBExpiry moves the expiration times of the legacy bucket into the envelopes of the entries
+func migrateBoltDBExpiry(tx *bolt.Tx, bucket *bolt.Bucket) error {
+	expiry := tx.Bucket(legacyExpiryBucketName)
+	if expiry == nil {
+		return nil
+	}
+	err := expiry.ForEach(func(key, expiresAt []byte) error {
+		value := bucket.Get(key)
+		if value == nil || len(expiresAt) != 8 {
+			return nil
+		}
+		expires := time.Unix(0, int64(binary.BigEndian.Uint64(expiresAt)))
+		return bucket.Put(key, newBoltDBEnvelope(expires, value))
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.DeleteBucket(legacyExpiryBucketName)
+}
+
+// newBoltDBEnvelope wraps a value with its expiration time
+func newBoltDBEnvelope(expires time.Time, value []byte) []byte {
+	envelope := make([]byte, len(boltdbEnvelopeHeader)+8, len(boltdbEnvelopeHeader)+8+len(value))
+	copy(envelope, boltdbEnvelopeHeader)
+	binary.BigEndian.PutUint64(envelope[len(boltdbEnvelopeHeader):], uint64(expires.UnixNano()))
+
+	return append(envelope, value...)
+}
+
+// openBoltDBEnvelope returns the value of an entry and its expiration time, if any
+func openBoltDBEnvelope(entry []byte) ([]byte, time.Time) {
+	size := len(boltdbEnvelopeHeader) + 8
+	if len(entry) < size || !bytes.HasPrefix(entry, boltdbEnvelopeHeader) {
+		return entry, time.Time{}
+	}
+
+	return entry[size:], time.Unix(0, int64(binary.BigEndian.Uint64(entry[len(boltdbEnvelopeHeader):size])))
+}
+
 // Set adds a token to the store
 func (r *boltdbStore) Set(key, value string) error {
 	return r.client.Update(func(tx *bolt.Tx) error {
@@ -71,6 +128,17 @@ func (r *boltdbStore) Set(key, value string) error {
 	})
 }
 
+// SetWithTTL adds a token to the store, which expires after the duration
+func (r *boltdbStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	return r.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dbName)
+		if bucket == nil {
+			return ErrNoBoltdbBucket
+		}
+		return bucket.Put([]byte(key), newBoltDBEnvelope(r.now().Add(ttl), []byte(value)))
+	})
+}
+
 // Get retrieves a token from the store
 func (r *boltdbStore) Get(key string) (string, error) {
 	var value string
@@ -79,7 +147,12 @@ func (r *boltdbStore) Get(key string) (string, error) {
 		if bucket == nil {
 			return ErrNoBoltdbBucket
 		}
-		value = string(bucket.Get([]byte(key)))
+		// expired entries are not returned
+		v, expires := openBoltDBEnvelope(bucket.Get([]byte(key)))
+		if !expires.IsZero() && !r.now().Before(expires) {
+			return nil
+		}
+		value = string(v)
 		return nil
 	})
 
@@ -101,3 +174,56 @@ func (r *boltdbStore) Delete(key string) error {
 func (r *boltdbStore) Close() error {
 	return r.client.Close()
 }
+
+// collectGarbage purges the expired entries at every interval, until the context is done
+func (r *boltdbStore) collectGarbage(ctx context.Context, interval time.Duration, log *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := r.purge()
+			if err != nil {
+				log.Warn("unable to purge the expired entries from the boltdb store", zap.Error(err))
+				continue
+			}
+			// @metric the expired entries purged from the store
+			storePurgedEntriesMetric.Add(float64(purged))
+			log.Debug("purged the expired entries from the boltdb store", zap.Int("purged", purged))
+		}
+	}
+}
+
+// purge deletes the expired entries and returns their number
+func (r *boltdbStore) purge() (int, error) {
+	purged := 0
+	err := r.client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dbName)
+		if bucket == nil {
+			return ErrNoBoltdbBucket
+		}
+		now := r.now()
+		// the keys are collected first: the bucket cannot be modified while iterating
+		var expired [][]byte
+		err := bucket.ForEach(func(key, entry []byte) error {
+			if _, expires := openBoltDBEnvelope(entry); !expires.IsZero() && !now.Before(expires) {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		purged = len(expired)
+		return nil
+	})
+
+	return purged, err
+}
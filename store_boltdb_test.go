@@ -22,13 +22,21 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	resty "gopkg.in/resty.v1"
 )
 
 type fakeBoltDBStore struct {
@@ -120,6 +128,164 @@ func TestBoltDelete(t *testing.T) {
 	assert.Empty(t, v)
 }
 
+func TestBoltEncryptedStore(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+
+	testEncryptedStoreRoundTrip(t, s.store)
+}
+
+func TestBoltStoreConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) Store {
+		s := newTestBoldDB(t)
+		t.Cleanup(s.close)
+		return &builtinStore{storage: s.store}
+	})
+}
+
+func TestBoltSetWithTTL(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+
+	require.NoError(t, s.store.SetWithTTL("test", "value", time.Hour))
+	v, err := s.store.Get("test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", v)
+
+	require.NoError(t, s.store.SetWithTTL("expired", "value", time.Nanosecond))
+	<-time.After(time.Millisecond)
+	v, err = s.store.Get("expired")
+	assert.NoError(t, err)
+	assert.Empty(t, v)
+
+	// a later set without ttl never expires
+	require.NoError(t, s.store.Set("expired", "value"))
+	v, err = s.store.Get("expired")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", v)
+
+	require.NoError(t, s.store.Delete("test"))
+	v, err = s.store.Get("test")
+	assert.NoError(t, err)
+	assert.Empty(t, v)
+}
+
+func boltdbRawEntry(t *testing.T, s *boltdbStore, key string) []byte {
+	var entry []byte
+	require.NoError(t, s.client.View(func(tx *bolt.Tx) error {
+		entry = append(entry, tx.Bucket(dbName).Get([]byte(key))...)
+		return nil
+	}))
+
+	return entry
+}
+
+func TestBoltPurge(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	now := time.Now()
+	s.store.now = func() time.Time { return now }
+
+	require.NoError(t, s.store.SetWithTTL("expiring", "value", time.Minute))
+	require.NoError(t, s.store.SetWithTTL("lasting", "value", time.Hour))
+	require.NoError(t, s.store.Set("forever", "value"))
+	value, expires := openBoltDBEnvelope(boltdbRawEntry(t, s.store, "expiring"))
+	assert.Equal(t, "value", string(value))
+	assert.Equal(t, now.Add(time.Minute).UnixNano(), expires.UnixNano())
+	assert.Equal(t, "value", string(boltdbRawEntry(t, s.store, "forever")))
+
+	purged, err := s.store.purge()
+	require.NoError(t, err)
+	assert.Zero(t, purged)
+
+	now = now.Add(2 * time.Minute)
+	purged, err = s.store.purge()
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Empty(t, boltdbRawEntry(t, s.store, "expiring"))
+	assert.NotEmpty(t, boltdbRawEntry(t, s.store, "lasting"))
+	assert.NotEmpty(t, boltdbRawEntry(t, s.store, "forever"))
+}
+
+func TestBoltCollectGarbage(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+
+	require.NoError(t, s.store.SetWithTTL("expiring", "value", time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.store.collectGarbage(ctx, 10*time.Millisecond, zap.NewNop())
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(boltdbRawEntry(t, s.store, "expiring")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the garbage collection to stop with the context")
+	}
+}
+
+func TestCloseStoreStopsGarbageCollection(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &oauthProxy{store: s.store, storeCtx: ctx, storeCancel: cancel}
+	done := make(chan struct{})
+	go func() {
+		s.store.collectGarbage(ctx, time.Hour, zap.NewNop())
+		close(done)
+	}()
+
+	require.NoError(t, p.CloseStore())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the garbage collection to stop when the store is closed")
+	}
+}
+
+func TestBoltLegacyExpiryMigration(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+
+	expired := make([]byte, 8)
+	binary.BigEndian.PutUint64(expired, uint64(time.Now().Add(-time.Minute).UnixNano()))
+	require.NoError(t, s.store.client.Update(func(tx *bolt.Tx) error {
+		expiry, err := tx.CreateBucketIfNotExists(legacyExpiryBucketName)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket(dbName)
+		if err := bucket.Put([]byte("expired"), []byte("value")); err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("forever"), []byte("value")); err != nil {
+			return err
+		}
+		return expiry.Put([]byte("expired"), expired)
+	}))
+	require.NoError(t, s.store.client.Update(func(tx *bolt.Tx) error {
+		return migrateBoltDBExpiry(tx, tx.Bucket(dbName))
+	}))
+
+	v, err := s.store.Get("expired")
+	require.NoError(t, err)
+	assert.Empty(t, v)
+	v, err = s.store.Get("forever")
+	require.NoError(t, err)
+	assert.Equal(t, "value", v)
+	require.NoError(t, s.store.client.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket(legacyExpiryBucketName))
+		return nil
+	}))
+}
+
 func TestBoldClose(t *testing.T) {
 	s := newTestBoldDB(t)
 	defer s.close()
@@ -130,10 +296,173 @@ func TestBoldClose(t *testing.T) {
 }
 
 func TestCreateStorageBoltDB(t *testing.T) {
-	store, err := createStorage("boltdb:////tmp/bolt")
+	store, err := createStorage("boltdb:////tmp/bolt", nil)
 	assert.NotNil(t, store)
 	assert.NoError(t, err)
 	if store != nil {
 		os.Remove("/tmp/bolt")
 	}
 }
+
+func TestServerSideSessions(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EnableServerSideSessions = true
+	cfg.EncryptionKey = testKey
+	cfg.StoreURL = "boltdb:///" + filepath.Join(t.TempDir(), "sessions")
+	p := newFakeProxy(cfg)
+	p.idp.setTokenExpiration(1000 * time.Millisecond)
+
+	var sessionID string
+	fn := func(no int, req *resty.Request, resp *resty.Response) {
+		if no != 0 {
+			return
+		}
+		// the refresh cookie only holds the session id, the refresh token is in the store
+		cookie, found := p.cookies[cfg.CookieRefreshName]
+		require.True(t, found)
+		sessionID = cookie.Value
+		assert.Regexp(t, serverSessionIDFilter, sessionID)
+		value, err := p.proxy.store.Get(serverSessionPrefix + sessionID)
+		require.NoError(t, err)
+		refresh, err := decodeText(value, cfg.EncryptionKey)
+		require.NoError(t, err)
+		assert.NotEmpty(t, refresh)
+
+		<-time.After(1000 * time.Millisecond)
+	}
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			OnResponse:    fn,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the access token has expired and is refreshed from the session
+			URI:             fakeAuthAllURL,
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedCookies: map[string]string{cfg.CookieAccessName: ""},
+		},
+	})
+}
+
+func TestServerSideSessionStoreUnavailable(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	proxy, _, _ := newTestProxyService(nil)
+	proxy.store = s.store
+
+	id, err := proxy.createServerSession("subject", "value", time.Hour)
+	require.NoError(t, err)
+	value, err := proxy.getServerSession(id)
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+	_, err = proxy.getServerSession("unknown")
+	assert.Equal(t, ErrNoSessionStateFound, err)
+
+	// an unavailable store is handled like an expired session
+	require.NoError(t, s.store.Close())
+	_, err = proxy.getServerSession(id)
+	assert.Equal(t, ErrNoSessionStateFound, err)
+}
+
+func TestRevocationPersistence(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSessionRevocationPersistence = true
+	cfg.SessionRevocationMaxAge = time.Hour
+	proxy, _, _ := newTestProxyService(cfg)
+	proxy.store = s.store
+	proxy.revocations = newRevocationSet(100, time.Hour, time.Now)
+	issued := time.Now().Add(-time.Minute)
+	proxy.revokeSubject("alice")
+
+	// the revocations are reloaded on restart
+	restarted, _, _ := newTestProxyService(cfg)
+	restarted.store = s.store
+	restarted.revocations = newRevocationSet(100, time.Hour, time.Now)
+	assert.False(t, restarted.revocations.revoked("alice", issued))
+	require.NoError(t, restarted.loadRevocations())
+	assert.True(t, restarted.revocations.revoked("alice", issued))
+	assert.False(t, restarted.revocations.revoked("bob", issued))
+}
+
+func TestSessionRevocation(t *testing.T) {
+	s := newTestBoldDB(t)
+	defer s.close()
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSessionRevocation = true
+	proxy, _, _ := newTestProxyService(cfg)
+	proxy.store = s.store
+
+	first, err := proxy.createServerSession("alice", "value", time.Hour)
+	require.NoError(t, err)
+	_, err = proxy.createServerSession("alice", "value", time.Hour)
+	require.NoError(t, err)
+	other, err := proxy.createServerSession("bob", "value", time.Hour)
+	require.NoError(t, err)
+
+	// a logged out session is not counted
+	require.NoError(t, proxy.deleteServerSession(first))
+	revoked, err := proxy.revokeSessions("alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+	revoked, err = proxy.revokeSessions("alice")
+	require.NoError(t, err)
+	assert.Equal(t, 0, revoked)
+
+	revoked, err = proxy.revokeAllSessions()
+	require.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+	_, err = proxy.getServerSession(other)
+	assert.Equal(t, ErrNoSessionStateFound, err)
+}
+
+func TestSessionRevocationHandler(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableSessionRevocation = true
+	cfg.SessionRevocationRole = "session-admin"
+	cfg.SessionRevocationToken = "static-token"
+	cfg.StoreURL = "boltdb:///" + filepath.Join(t.TempDir(), "sessions")
+	proxy, auth, svc := newTestProxyService(cfg)
+
+	_, err := proxy.createServerSession("alice", "value", time.Hour)
+	require.NoError(t, err)
+	_, err = proxy.createServerSession("bob", "value", time.Hour)
+	require.NoError(t, err)
+
+	token := newTestToken(auth.getLocation())
+	token.addRealmRoles([]string{"session-admin"})
+	signed, err := auth.signToken(token.claims)
+	require.NoError(t, err)
+	unprivileged, err := auth.signToken(newTestToken(auth.getLocation()).claims)
+	require.NoError(t, err)
+
+	cs := []struct {
+		URI      string
+		Bearer   string
+		Code     int
+		Expected string
+	}{
+		{URI: "/oauth/sessions/alice", Code: http.StatusUnauthorized},
+		{URI: "/oauth/sessions/alice", Bearer: "invalid", Code: http.StatusUnauthorized},
+		{URI: "/oauth/sessions/alice", Bearer: unprivileged.Encode(), Code: http.StatusUnauthorized},
+		{URI: "/oauth/sessions/alice", Bearer: signed.Encode(), Code: http.StatusOK, Expected: `{"revoked":1}`},
+		{URI: "/oauth/sessions", Bearer: "static-token", Code: http.StatusOK, Expected: `{"revoked":1}`},
+		{URI: "/oauth/sessions", Bearer: "static-token", Code: http.StatusOK, Expected: `{"revoked":0}`},
+	}
+	for i, c := range cs {
+		resp, err := resty.New().R().SetAuthToken(c.Bearer).Delete(svc + c.URI)
+		require.NoError(t, err)
+		assert.Equal(t, c.Code, resp.StatusCode(), "case %d", i)
+		if c.Expected != "" {
+			assert.JSONEq(t, c.Expected, string(resp.Body()), "case %d", i)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+//go:build !nostores
+// +build !nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// RunStoreConformanceTests checks a store honors the Store contract: missing entries, overwrites, expiry
+// and concurrent access. The store is created empty for each test.
+func RunStoreConformanceTests(t *testing.T, newStore func(t *testing.T) Store) {
+	ctx := context.Background()
+
+	t.Run("missing entries", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		value, err := store.Get(ctx, "missing")
+		require.NoError(t, err)
+		assert.Empty(t, value)
+		assert.NoError(t, store.Delete(ctx, "missing"))
+	})
+
+	t.Run("set and delete", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		require.NoError(t, store.Set(ctx, "key", "value", 0))
+		value, err := store.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, "value", value)
+
+		require.NoError(t, store.Delete(ctx, "key"))
+		value, err = store.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Empty(t, value)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		require.NoError(t, store.Set(ctx, "key", "first", 0))
+		require.NoError(t, store.Set(ctx, "key", "second", 0))
+		value, err := store.Get(ctx, "key")
+		require.NoError(t, err)
+		assert.Equal(t, "second", value)
+
+		// overwriting an expiring entry without ttl removes the expiry
+		require.NoError(t, store.Set(ctx, "expiring", "first", 100*time.Millisecond))
+		require.NoError(t, store.Set(ctx, "expiring", "second", 0))
+		time.Sleep(200 * time.Millisecond)
+		value, err = store.Get(ctx, "expiring")
+		require.NoError(t, err)
+		assert.Equal(t, "second", value)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		require.NoError(t, store.Set(ctx, "expiring", "value", 100*time.Millisecond))
+		require.NoError(t, store.Set(ctx, "lasting", "value", time.Hour))
+		value, err := store.Get(ctx, "expiring")
+		require.NoError(t, err)
+		assert.Equal(t, "value", value)
+
+		assert.Eventually(t, func() bool {
+			value, err := store.Get(ctx, "expiring")
+			return err == nil && value == ""
+		}, 5*time.Second, 50*time.Millisecond)
+		value, err = store.Get(ctx, "lasting")
+		require.NoError(t, err)
+		assert.Equal(t, "value", value)
+	})
+
+	t.Run("concurrent access", func(t *testing.T) {
+		store := newStore(t)
+		defer store.Close()
+
+		const workers, operations = 8, 25
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for j := 0; j < operations; j++ {
+					key, value := fmt.Sprintf("key-%d-%d", worker, j), fmt.Sprintf("value-%d-%d", worker, j)
+					assert.NoError(t, store.Set(ctx, key, value, time.Hour))
+					assert.NoError(t, store.Set(ctx, "shared", value, 0))
+					got, err := store.Get(ctx, key)
+					assert.NoError(t, err)
+					assert.Equal(t, value, got)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		value, err := store.Get(ctx, "shared")
+		require.NoError(t, err)
+		assert.Regexp(t, `^value-\d+-\d+$`, value)
+	})
+}
+
+// builtinStore adapts the built-in stores to the Store contract
+type builtinStore struct {
+	storage storage
+}
+
+func (s *builtinStore) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	return setWithTTL(s.storage, key, value, ttl)
+}
+
+func (s *builtinStore) Get(_ context.Context, key string) (string, error) {
+	return s.storage.Get(key)
+}
+
+func (s *builtinStore) Delete(_ context.Context, key string) error {
+	return s.storage.Delete(key)
+}
+
+func (s *builtinStore) Close() error {
+	return s.storage.Close()
+}
+
+// conformanceStoreScheme is the scheme of a store registered by the tests, backed by the memory store
+const conformanceStoreScheme = "conformance"
+
+func init() {
+	RegisterStore(conformanceStoreScheme, func(location *url.URL, _ StoreOptions) (Store, error) {
+		store, err := newMemoryStore(location)
+		if err != nil {
+			return nil, err
+		}
+
+		return &builtinStore{storage: store}, nil
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) Store {
+		return &builtinStore{storage: newTestMemoryStore(t, "memory://")}
+	})
+}
+
+func TestRedisStoreConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) Store {
+		store, err := createStorage("redis://"+newFakeRedisServer(t).addr(), nil)
+		require.NoError(t, err)
+		return &builtinStore{storage: store}
+	})
+}
+
+func TestEncryptedStoreConformance(t *testing.T) {
+	RunStoreConformanceTests(t, func(t *testing.T) Store {
+		return &builtinStore{storage: newEncryptedStore(newTestMemoryStore(t, "memory://"), testKey, zap.NewNop())}
+	})
+}
+
+func TestRegisterStore(t *testing.T) {
+	store, err := createStorage(conformanceStoreScheme+"://?max-entries=10", nil)
+	require.NoError(t, err)
+	defer store.Close()
+	plugged, ok := store.(*pluggedStore)
+	require.True(t, ok)
+
+	// the plugged stores honor the ttl passed to the store
+	require.NoError(t, setWithTTL(store, "key", "value", time.Hour))
+	value, err := store.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+	memory := plugged.store.(*builtinStore).storage.(*memoryStore)
+	assert.False(t, memory.entries["key"].Value.(*memoryStoreEntry).expires.IsZero())
+
+	// the schemes cannot be registered twice
+	assert.Panics(t, func() {
+		RegisterStore("redis", func(*url.URL, StoreOptions) (Store, error) { return nil, nil })
+	})
+}
@@ -0,0 +1,93 @@
+//go:build !nostores
+// +build !nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// encryptedValuePrefix versions the encrypted values: the values without prefix were written in plaintext,
+// before the encryption was enabled. The prefix cannot be confused with the base64 encoding of the values.
+const encryptedValuePrefix = "enc.v1:"
+
+// encryptedStore encrypts the values written to the underlying store, with the same AES-GCM helpers as the cookies
+type encryptedStore struct {
+	storage
+	key string
+	log *zap.Logger
+}
+
+// newEncryptedStore wraps a store, encrypting the values with the key
+func newEncryptedStore(store storage, key string, log *zap.Logger) storage {
+	return &encryptedStore{storage: store, key: key, log: log}
+}
+
+// Set encrypts and adds a value to the store
+func (r *encryptedStore) Set(key, value string) error {
+	encrypted, err := r.encrypt(value)
+	if err != nil {
+		return err
+	}
+
+	return r.storage.Set(key, encrypted)
+}
+
+// SetWithTTL encrypts and adds a value to the store, which expires after the duration when the store supports it
+func (r *encryptedStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	encrypted, err := r.encrypt(value)
+	if err != nil {
+		return err
+	}
+
+	return setWithTTL(r.storage, key, encrypted, ttl)
+}
+
+// Get retrieves and decrypts a value from the store. The plaintext values are returned as is, while the
+// values which cannot be decrypted are treated as missing.
+func (r *encryptedStore) Get(key string) (string, error) {
+	value, err := r.storage.Get(key)
+	if err != nil || !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, err
+	}
+	decrypted, err := decodeText(strings.TrimPrefix(value, encryptedValuePrefix), r.key)
+	if err != nil {
+		r.log.Warn("unable to decrypt the value from the store, ignoring the entry", zap.Error(err))
+		return "", nil
+	}
+
+	return decrypted, nil
+}
+
+// Ping checks the underlying store can be reached
+func (r *encryptedStore) Ping(ctx context.Context) error {
+	return pingStore(ctx, r.storage)
+}
+
+func (r *encryptedStore) encrypt(value string) (string, error) {
+	encrypted, err := encodeText(value, r.key)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedValuePrefix + encrypted, nil
+}
@@ -0,0 +1,125 @@
+//go:build !nostores
+// +build !nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testEncryptedStoreRoundTrip checks the values are encrypted in the underlying store
+func testEncryptedStoreRoundTrip(t *testing.T, underlying storage) {
+	store := newEncryptedStore(underlying, testKey, zap.NewNop())
+
+	require.NoError(t, store.Set("key", "value"))
+	raw, err := underlying.Get("key")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(raw, encryptedValuePrefix))
+	assert.NotContains(t, raw, "value")
+
+	value, err := store.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	require.NoError(t, setWithTTL(store, "expiring", "value", time.Hour))
+	value, err = store.Get("expiring")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	require.NoError(t, store.Delete("key"))
+	value, err = store.Get("key")
+	require.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	testEncryptedStoreRoundTrip(t, newTestMemoryStore(t, "memory://"))
+}
+
+func TestEncryptedStoreMigration(t *testing.T) {
+	underlying := newTestMemoryStore(t, "memory://")
+	store := newEncryptedStore(underlying, testKey, zap.NewNop())
+
+	// the entries written before the encryption was enabled are still readable
+	require.NoError(t, underlying.Set("plaintext", "value"))
+	value, err := store.Get("plaintext")
+	require.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	// the corrupted entries are treated as missing
+	require.NoError(t, underlying.Set("corrupted", encryptedValuePrefix+"not-encrypted"))
+	value, err = store.Get("corrupted")
+	require.NoError(t, err)
+	assert.Empty(t, value)
+
+	// the entries encrypted with another key are treated as missing
+	other := newEncryptedStore(underlying, strings.Repeat("x", len(testKey)), zap.NewNop())
+	require.NoError(t, other.Set("other", "value"))
+	value, err = store.Get("other")
+	require.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestEncryptedStoreTTL(t *testing.T) {
+	underlying := newTestMemoryStore(t, "memory://")
+	now := time.Now()
+	underlying.now = func() time.Time { return now }
+	store := newEncryptedStore(underlying, testKey, zap.NewNop())
+
+	require.NoError(t, setWithTTL(store, "expiring", "value", time.Minute))
+	now = now.Add(2 * time.Minute)
+	value, err := store.Get("expiring")
+	require.NoError(t, err)
+	assert.Empty(t, value, "the ttl is passed to the underlying store")
+}
+
+func BenchmarkEncryptedStore(b *testing.B) {
+	value := strings.Repeat("refresh-token", 80)
+	run := func(b *testing.B, store storage) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := store.Set("key", value); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := store.Get("key"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	newStore := func() storage {
+		store, err := newMemoryStore(&url.URL{Scheme: memoryStoreScheme})
+		if err != nil {
+			b.Fatal(err)
+		}
+		return store
+	}
+
+	b.Run("plaintext", func(b *testing.B) {
+		run(b, newStore())
+	})
+	b.Run("encrypted", func(b *testing.B) {
+		run(b, newEncryptedStore(newStore(), testKey, zap.NewNop()))
+	})
+}
@@ -0,0 +1,165 @@
+//go:build !nostores
+// +build !nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMemoryStoreMaxEntries is the default capacity of the memory store
+const defaultMemoryStoreMaxEntries = 10000
+
+// memoryStore is a local store holding the refresh tokens in memory, evicting the least recently used
+// entries beyond its capacity: the entries are lost on restart and are not shared between replicas
+type memoryStore struct {
+	sync.Mutex
+	// entries indexes the elements of the lru list by key
+	entries map[string]*list.Element
+	// lru holds the entries, the most recently used first
+	lru        *list.List
+	maxEntries int
+	// ttl is the expiration of the entries set without an explicit ttl, if any
+	ttl time.Duration
+	now func() time.Time
+}
+
+type memoryStoreEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// newMemoryStore creates a memory store, e.g. memory://?max-entries=10000&ttl=24h
+func newMemoryStore(location *url.URL) (storage, error) {
+	maxEntries, ttl, err := parseMemoryStoreURL(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryStore{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        time.Now,
+	}, nil
+}
+
+// parseMemoryStoreURL returns the capacity and the default ttl of the memory store
+func parseMemoryStoreURL(location *url.URL) (int, time.Duration, error) {
+	maxEntries, ttl := defaultMemoryStoreMaxEntries, time.Duration(0)
+	query := location.Query()
+	if v := query.Get("max-entries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid max-entries %q for the memory store, must be a positive integer", v)
+		}
+		maxEntries = n
+	}
+	if v := query.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("invalid ttl %q for the memory store, must be a positive duration", v)
+		}
+		ttl = d
+	}
+
+	return maxEntries, ttl, nil
+}
+
+// Set adds a token to the store, which expires after the default ttl of the store if any
+func (r *memoryStore) Set(key, value string) error {
+	return r.SetWithTTL(key, value, r.ttl)
+}
+
+// SetWithTTL adds a token to the store, which expires after the duration
+func (r *memoryStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	r.Lock()
+	defer r.Unlock()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = r.now().Add(ttl)
+	}
+	if e, found := r.entries[key]; found {
+		entry := e.Value.(*memoryStoreEntry)
+		entry.value, entry.expires = value, expires
+		r.lru.MoveToFront(e)
+
+		return nil
+	}
+	r.entries[key] = r.lru.PushFront(&memoryStoreEntry{key: key, value: value, expires: expires})
+	for r.lru.Len() > r.maxEntries {
+		r.remove(r.lru.Back())
+	}
+
+	return nil
+}
+
+// Get retrieves a token from the store
+func (r *memoryStore) Get(key string) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	e, found := r.entries[key]
+	if !found {
+		return "", nil
+	}
+	entry := e.Value.(*memoryStoreEntry)
+	if !entry.expires.IsZero() && !r.now().Before(entry.expires) {
+		r.remove(e)
+		return "", nil
+	}
+	r.lru.MoveToFront(e)
+
+	return entry.value, nil
+}
+
+// Delete remove the key
+func (r *memoryStore) Delete(key string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if e, found := r.entries[key]; found {
+		r.remove(e)
+	}
+
+	return nil
+}
+
+// Close drops the entries
+func (r *memoryStore) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.entries = make(map[string]*list.Element)
+	r.lru.Init()
+
+	return nil
+}
+
+func (r *memoryStore) remove(e *list.Element) {
+	r.lru.Remove(e)
+	delete(r.entries, e.Value.(*memoryStoreEntry).key)
+}
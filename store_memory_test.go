@@ -0,0 +1,242 @@
+//go:build !nostores
+// +build !nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resty "gopkg.in/resty.v1"
+)
+
+func newTestMemoryStore(t *testing.T, location string) *memoryStore {
+	u, err := url.Parse(location)
+	require.NoError(t, err)
+	s, err := newMemoryStore(u)
+	require.NoError(t, err)
+	store, ok := s.(*memoryStore)
+	require.True(t, ok)
+
+	return store
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := newTestMemoryStore(t, "memory://")
+	assert.Equal(t, defaultMemoryStoreMaxEntries, s.maxEntries)
+
+	require.NoError(t, s.Set("test", "value"))
+	v, err := s.Get("test")
+	require.NoError(t, err)
+	assert.Equal(t, "value", v)
+
+	require.NoError(t, s.Set("test", "updated"))
+	v, err = s.Get("test")
+	require.NoError(t, err)
+	assert.Equal(t, "updated", v)
+
+	require.NoError(t, s.Delete("test"))
+	v, err = s.Get("test")
+	require.NoError(t, err)
+	assert.Empty(t, v)
+	assert.NoError(t, s.Delete("test"))
+	assert.NoError(t, s.Close())
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	s := newTestMemoryStore(t, "memory://?max-entries=2")
+
+	require.NoError(t, s.Set("a", "1"))
+	require.NoError(t, s.Set("b", "2"))
+	// a is used more recently than b
+	v, _ := s.Get("a")
+	assert.Equal(t, "1", v)
+	require.NoError(t, s.Set("c", "3"))
+
+	v, _ = s.Get("b")
+	assert.Empty(t, v, "the least recently used entry is evicted")
+	v, _ = s.Get("a")
+	assert.Equal(t, "1", v)
+	v, _ = s.Get("c")
+	assert.Equal(t, "3", v)
+	assert.Len(t, s.entries, 2)
+	assert.Equal(t, 2, s.lru.Len())
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	s := newTestMemoryStore(t, "memory://?ttl=1h")
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	require.NoError(t, s.Set("default", "1"))
+	require.NoError(t, setWithTTL(s, "explicit", "2", time.Minute))
+
+	now = now.Add(2 * time.Minute)
+	v, _ := s.Get("explicit")
+	assert.Empty(t, v, "the ttl passed to the store is honored")
+	v, _ = s.Get("default")
+	assert.Equal(t, "1", v)
+	assert.Len(t, s.entries, 1)
+
+	now = now.Add(time.Hour)
+	v, _ = s.Get("default")
+	assert.Empty(t, v, "the default ttl of the store is honored")
+	assert.Empty(t, s.entries)
+
+	// the entries set without ttl never expire
+	s.ttl = 0
+	require.NoError(t, s.Set("forever", "3"))
+	now = now.Add(365 * 24 * time.Hour)
+	v, _ = s.Get("forever")
+	assert.Equal(t, "3", v)
+}
+
+func TestMemoryStoreURL(t *testing.T) {
+	cs := []struct {
+		URL   string
+		Error string
+	}{
+		{URL: "memory://"},
+		{URL: "memory://?max-entries=10&ttl=24h"},
+		{URL: "memory://?max-entries=0", Error: "invalid max-entries"},
+		{URL: "memory://?max-entries=many", Error: "invalid max-entries"},
+		{URL: "memory://?ttl=-1h", Error: "invalid ttl"},
+		{URL: "memory://?ttl=forever", Error: "invalid ttl"},
+	}
+	for _, c := range cs {
+		cfg := &Config{StoreURL: c.URL}
+		err := cfg.isStoreValid()
+		if c.Error == "" {
+			assert.NoError(t, err, "url: %s", c.URL)
+			continue
+		}
+		if assert.Error(t, err, "url: %s", c.URL) {
+			assert.Contains(t, err.Error(), c.Error)
+		}
+	}
+}
+
+func TestMemoryStoreRefreshTokens(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EncryptionKey = testKey
+	cfg.StoreURL = "memory://?max-entries=10"
+	p := newFakeProxy(cfg)
+	// the values are encrypted with the encryption key
+	encrypted, ok := p.proxy.store.(*encryptedStore)
+	require.True(t, ok)
+	_, ok = encrypted.storage.(*memoryStore)
+	require.True(t, ok)
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  200,
+		},
+	})
+}
+
+func TestMemoryStoreSessionIdleTimeout(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableRefreshTokens = true
+	cfg.EnableServerSideSessions = true
+	cfg.EncryptionKey = testKey
+	cfg.SessionIdleTimeout = time.Hour
+	cfg.StoreURL = "memory://"
+	p := newFakeProxy(cfg)
+	memory, ok := p.proxy.store.(*encryptedStore).storage.(*memoryStore)
+	require.True(t, ok)
+
+	// rewinds the activity of the server-side sessions
+	rewind := func(int, *resty.Request, *resty.Response) {
+		var ids []string
+		memory.Lock()
+		for key := range memory.entries {
+			if strings.HasPrefix(key, sessionActivityPrefix) {
+				ids = append(ids, strings.TrimPrefix(key, sessionActivityPrefix))
+			}
+		}
+		memory.Unlock()
+		require.Len(t, ids, 1)
+		require.NoError(t, p.proxy.setServerSessionActivity(ids[0], time.Now().Add(-2*time.Hour)))
+	}
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    rewind,
+		},
+		{
+			// the access token is still valid, but the session has been idle for too long
+			URI:              "/auth_all/test",
+			Redirects:        true,
+			ExpectedCode:     http.StatusTemporaryRedirect,
+			ExpectedLocation: "/oauth/authorize?state",
+		},
+	})
+}
+
+func TestLocalSessionIndexExpiry(t *testing.T) {
+	store := newTestMemoryStore(t, "memory://")
+	clock := newFakeClock()
+	index := &localSessionIndex{store: store, lock: &sync.Mutex{}, now: clock.Now}
+
+	require.NoError(t, index.indexSession("alice", "session.first", time.Hour))
+	require.NoError(t, index.indexSession("alice", "refresh", 0))
+	require.NoError(t, index.indexSession("bob", "session.second", time.Minute))
+	// the latest expiration of a member is kept
+	require.NoError(t, index.indexSession("bob", "session.second", time.Second))
+
+	subjects, err := index.indexedSubjects()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, subjects)
+
+	// the expired sessions are pruned, with the subjects having no session left
+	clock.advance(2 * time.Minute)
+	subjects, err = index.indexedSubjects()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, subjects)
+	sessions, err := index.indexedSessions("bob")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+	clock.advance(time.Hour)
+	sessions, err = index.indexedSessions("alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"refresh"}, sessions)
+
+	require.NoError(t, index.unindexSessions("alice", "refresh"))
+	subjects, err = index.indexedSubjects()
+	require.NoError(t, err)
+	assert.Empty(t, subjects)
+	value, err := store.Get(subjectSessionsPrefix + "alice")
+	require.NoError(t, err)
+	assert.Empty(t, value)
+}
@@ -0,0 +1,122 @@
+//go:build !nostores
+// +build !nostores
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// storageFactory creates a store from the store url
+type storageFactory func(*url.URL, StoreOptions) (storage, error)
+
+var (
+	storeFactoriesLock sync.RWMutex
+	// storeFactories are the factories of the stores keyed by url scheme
+	storeFactories = map[string]storageFactory{
+		"redis": func(location *url.URL, _ StoreOptions) (storage, error) {
+			return newRedisStore(location, nil)
+		},
+		redisTLSScheme: func(location *url.URL, options StoreOptions) (storage, error) {
+			return newRedisStore(location, options.TLSConfig)
+		},
+		redisSentinelScheme: func(location *url.URL, _ StoreOptions) (storage, error) {
+			return newRedisSentinelStore(location)
+		},
+		redisClusterScheme: func(location *url.URL, _ StoreOptions) (storage, error) {
+			return newRedisClusterStore(location)
+		},
+		"boltdb": func(location *url.URL, _ StoreOptions) (storage, error) {
+			return newBoltDBStore(location)
+		},
+		memoryStoreScheme: func(location *url.URL, _ StoreOptions) (storage, error) {
+			return newMemoryStore(location)
+		},
+	}
+)
+
+// RegisterStore makes a store available for the store urls with the scheme. It panics when the scheme is
+// already registered, e.g. by a built-in store.
+func RegisterStore(scheme string, factory StoreFactory) {
+	storeFactoriesLock.Lock()
+	defer storeFactoriesLock.Unlock()
+
+	if _, found := storeFactories[scheme]; found {
+		panic(fmt.Sprintf("a store is already registered for the scheme %s", scheme))
+	}
+	storeFactories[scheme] = func(location *url.URL, options StoreOptions) (storage, error) {
+		store, err := factory(location, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return &pluggedStore{store: store}, nil
+	}
+}
+
+// storeFactory returns the factory registered for the scheme
+func storeFactory(scheme string) (storageFactory, bool) {
+	storeFactoriesLock.RLock()
+	defer storeFactoriesLock.RUnlock()
+	factory, found := storeFactories[scheme]
+
+	return factory, found
+}
+
+// pluggedStore adapts a store registered with RegisterStore
+type pluggedStore struct {
+	store Store
+}
+
+// Set adds a token to the store
+func (r *pluggedStore) Set(key, value string) error {
+	return r.store.Set(context.Background(), key, value, 0)
+}
+
+// SetWithTTL adds a token to the store, which expires after the duration
+func (r *pluggedStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	return r.store.Set(context.Background(), key, value, ttl)
+}
+
+// Get retrieves a token from the store
+func (r *pluggedStore) Get(key string) (string, error) {
+	return r.store.Get(context.Background(), key)
+}
+
+// Delete removes a key from the store
+func (r *pluggedStore) Delete(key string) error {
+	return r.store.Delete(context.Background(), key)
+}
+
+// Ping checks the store can be reached, when it implements Ping
+func (r *pluggedStore) Ping(ctx context.Context) error {
+	if s, ok := r.store.(checkedStorage); ok {
+		return s.Ping(ctx)
+	}
+
+	return nil
+}
+
+// Close closes of any open resources
+func (r *pluggedStore) Close() error {
+	return r.store.Close()
+}
@@ -19,41 +19,78 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-oidc/jose"
 	"go.uber.org/zap"
 )
 
+// revocationsKey holds the revocations of the sessions in the store
+const revocationsKey = "revocations"
+
 func (r *Config) isStoreValid() error {
 	if r.StoreURL != "" {
-		if _, err := url.Parse(r.StoreURL); err != nil {
+		u, err := url.Parse(r.StoreURL)
+		if err != nil {
 			return fmt.Errorf("the store url is invalid, error: %s", err)
 		}
+		tlsConfig, err := r.storeRedisTLSConfig()
+		if err != nil {
+			return err
+		}
+		if tlsConfig != nil && u.Scheme != redisTLSScheme {
+			return fmt.Errorf("the redis store tls options require a %s:// store url", redisTLSScheme)
+		}
+		switch u.Scheme {
+		case "redis", redisTLSScheme:
+			if _, err := parseRedisURL(u); err != nil {
+				return err
+			}
+		case redisSentinelScheme:
+			if _, _, err := parseRedisSentinelURL(u); err != nil {
+				return err
+			}
+		case redisClusterScheme:
+			if _, err := parseRedisClusterURL(u); err != nil {
+				return err
+			}
+		case memoryStoreScheme:
+			if _, _, err := parseMemoryStoreURL(u); err != nil {
+				return err
+			}
+		default:
+			if strings.Contains(u.Scheme, "sentinel") && strings.Contains(u.Scheme, "cluster") {
+				return fmt.Errorf("unsupported store %s: cluster and sentinel options cannot be mixed", u.Scheme)
+			}
+		}
 	}
 	return nil
 }
 
-// createStorage creates the store client for use
-func createStorage(location string) (storage, error) {
-	var store storage
-	var err error
-
+// createStorage creates the store client for use, from the factory registered for the scheme of the url
+func createStorage(location string, tlsConfig *tls.Config) (storage, error) {
 	u, err := url.Parse(location)
 	if err != nil {
 		return nil, err
 	}
-	switch u.Scheme {
-	case "redis":
-		store, err = newRedisStore(u)
-	case "boltdb":
-		store, err = newBoltDBStore(u)
-	default:
+	factory, found := storeFactory(u.Scheme)
+	if !found {
 		return nil, fmt.Errorf("unsupported store: %s", u.Scheme)
 	}
 
-	return store, err
+	return factory(u, StoreOptions{TLSConfig: tlsConfig})
 }
 
 // useStore checks if we are using a store to hold the refresh tokens
@@ -63,7 +100,16 @@ func (r *oauthProxy) useStore() bool {
 
 // StoreRefreshToken the token to the store
 func (r *oauthProxy) StoreRefreshToken(token jose.JWT, value string) error {
-	return r.store.Set(getHashKey(&token), value)
+	key := getHashKey(&token)
+	if err := r.store.Set(key, value); err != nil {
+		return err
+	}
+	// the refresh token is removed from the index when it is deleted, on refresh or logout
+	if user, err := extractIdentity(token, r.config.identityClaims()); err == nil {
+		return r.indexSession(user.id, key, 0)
+	}
+
+	return nil
 }
 
 // Get retrieves a token from the store, the key we are using here is the access token
@@ -82,20 +128,533 @@ func (r *oauthProxy) GetRefreshToken(token jose.JWT) (string, error) {
 
 // DeleteRefreshToken removes a key from the store
 func (r *oauthProxy) DeleteRefreshToken(token jose.JWT) error {
-	if err := r.store.Delete(getHashKey(&token)); err != nil {
+	key := getHashKey(&token)
+	if err := r.store.Delete(key); err != nil {
 		r.log.Error("unable to delete token", zap.Error(err))
 
 		return err
 	}
+	if user, err := extractIdentity(token, r.config.identityClaims()); err == nil && r.config.EnableSessionRevocation {
+		return r.sessionIndex().unindexSessions(user.id, key)
+	}
+
+	return nil
+}
+
+const (
+	// serverSessionPrefix namespaces the server-side sessions in the store
+	serverSessionPrefix = "session."
+	// subjectSessionsPrefix namespaces the index of the sessions of a subject in the store
+	subjectSessionsPrefix = "subject."
+	// subjectsKey is the index of the subjects having sessions in the store
+	subjectsKey = "subjects"
+	// sessionActivityPrefix namespaces the last activity of the server-side sessions in the store
+	sessionActivityPrefix = "activity."
+	// loginReplayPrefix namespaces the requests kept during a login in the store, by the state of the login
+	loginReplayPrefix = "replay."
+	// requestURIPrefix namespaces the uris requested before a login in the store, by the hash of the state of the login
+	requestURIPrefix = "request-uri."
+	// providerSessionPrefix namespaces the server-side sessions in the store by the session of the provider (sid)
+	providerSessionPrefix = "sid."
+)
+
+// setWithTTL adds an entry which expires, when the store supports it
+func setWithTTL(store storage, key, value string, ttl time.Duration) error {
+	if s, ok := store.(expiringStorage); ok && ttl > 0 {
+		return s.SetWithTTL(key, value, ttl)
+	}
+
+	return store.Set(key, value)
+}
+
+// pingStore checks the store can be reached, when it depends on a remote service
+func pingStore(ctx context.Context, store storage) error {
+	if s, ok := store.(checkedStorage); ok {
+		return s.Ping(ctx)
+	}
 
 	return nil
 }
 
-// Close is used to close off any resources
+// createServerSession stores a value for a new server-side session of the subject and returns the session id
+func (r *oauthProxy) createServerSession(subject, value string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(cryptorand.Reader, b); err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	if err := setWithTTL(r.store, serverSessionPrefix+id, value, ttl); err != nil {
+		return "", err
+	}
+
+	return id, r.indexSession(subject, serverSessionPrefix+id, ttl)
+}
+
+// getServerSession retrieves the value of a server-side session.
+//
+// An unavailable store is handled like an expired session.
+func (r *oauthProxy) getServerSession(id string) (string, error) {
+	value, err := r.store.Get(serverSessionPrefix + id)
+	if err != nil {
+		r.log.Warn("unable to retrieve the session from the store", zap.Error(err))
+
+		return "", ErrNoSessionStateFound
+	}
+	if value == "" {
+		return "", ErrNoSessionStateFound
+	}
+
+	return value, nil
+}
+
+// updateServerSession replaces the value of a server-side session
+func (r *oauthProxy) updateServerSession(id, value string, ttl time.Duration) error {
+	return setWithTTL(r.store, serverSessionPrefix+id, value, ttl)
+}
+
+// deleteServerSession removes a server-side session from the store
+func (r *oauthProxy) deleteServerSession(id string) error {
+	if r.config.SessionIdleTimeout > 0 {
+		if err := r.store.Delete(sessionActivityPrefix + id); err != nil {
+			return err
+		}
+	}
+
+	return r.store.Delete(serverSessionPrefix + id)
+}
+
+// getServerSessionActivity returns the last activity of a server-side session. The activity expires from the
+// store after the idle timeout.
+func (r *oauthProxy) getServerSessionActivity(id string) (time.Time, error) {
+	value, err := r.store.Get(sessionActivityPrefix + id)
+	if err != nil {
+		r.log.Warn("unable to retrieve the session activity from the store", zap.Error(err))
+
+		return time.Time{}, ErrNoSessionStateFound
+	}
+	if value == "" {
+		return time.Time{}, ErrSessionIdle
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrInvalidSession
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+// setServerSessionActivity records the last activity of a server-side session
+func (r *oauthProxy) setServerSessionActivity(id string, at time.Time) error {
+	return setWithTTL(r.store, sessionActivityPrefix+id, strconv.FormatInt(at.Unix(), 10), r.config.SessionIdleTimeout)
+}
+
+// indexSession records a store entry as a session of the subject until it expires, so that it may be revoked
+func (r *oauthProxy) indexSession(subject, key string, ttl time.Duration) error {
+	if !r.config.EnableSessionRevocation || subject == "" || strings.Contains(subject, "\n") {
+		return nil
+	}
+
+	return r.sessionIndex().indexSession(subject, key, ttl)
+}
+
+// sessionIndex returns the index of the sessions: kept atomically by the stores shared by the replicas, or under
+// the lock of the replica otherwise
+func (r *oauthProxy) sessionIndex() indexingStorage {
+	store := r.store
+	if encrypted, ok := store.(*encryptedStore); ok {
+		store = encrypted.storage
+	}
+	if indexing, ok := store.(indexingStorage); ok {
+		return indexing
+	}
+
+	return &localSessionIndex{store: r.store, lock: &r.sessionIndexLock, now: r.now}
+}
+
+// revokeSessions deletes all the sessions of a subject from the store, and refuses the tokens already issued to the
+// subject. It returns the number of revoked sessions: the expired, refreshed or logged out sessions are not counted.
+func (r *oauthProxy) revokeSessions(subject string) (int, error) {
+	r.revokeSubject(subject)
+
+	return r.deleteSessions(subject)
+}
+
+// deleteSessions deletes all the sessions of a subject from the store, and returns the number of deleted sessions
+func (r *oauthProxy) deleteSessions(subject string) (int, error) {
+	index := r.sessionIndex()
+	keys, err := index.indexedSessions(subject)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, key := range keys {
+		value, err := r.store.Get(key)
+		if err != nil {
+			return revoked, err
+		}
+		if value == "" {
+			continue
+		}
+		if err := r.store.Delete(key); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+
+	return revoked, index.unindexSessions(subject, keys...)
+}
+
+// revokeAllSessions deletes the sessions of all the subjects from the store, and refuses all the tokens already
+// issued. It returns the number of revoked sessions.
+func (r *oauthProxy) revokeAllSessions() (int, error) {
+	r.revokeSubject("")
+
+	subjects, err := r.sessionIndex().indexedSubjects()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, subject := range subjects {
+		revoked, err := r.deleteSessions(subject)
+		total += revoked
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// localSessionIndex keeps the index of the sessions in the store, under the lock of the replica: it is used with the
+// stores which are not shared by the replicas, or which do not update the index atomically. An index is kept as the
+// lines "<expiration in unix ms>\t<member>", the members which never expire having a zero expiration, and its
+// expired members are pruned on every update.
+type localSessionIndex struct {
+	store storage
+	lock  *sync.Mutex
+	now   func() time.Time
+}
+
+// indexSession adds the entry of a session to the sessions of the subject, and the subject to the index
+func (r *localSessionIndex) indexSession(subject, key string, ttl time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var expires int64
+	if ttl > 0 {
+		expires = r.now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	}
+	if err := r.add(subjectSessionsPrefix+subject, key, expires); err != nil {
+		return err
+	}
+
+	return r.add(subjectsKey, subject, expires)
+}
+
+// unindexSessions removes the entries of sessions of the subject, and the subject once it has no session left
+func (r *localSessionIndex) unindexSessions(subject string, keys ...string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	members, err := r.load(subjectSessionsPrefix + subject)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		delete(members, key)
+	}
+	if err := r.save(subjectSessionsPrefix+subject, members); err != nil || len(members) > 0 {
+		return err
+	}
+	subjects, err := r.load(subjectsKey)
+	if err != nil {
+		return err
+	}
+	delete(subjects, subject)
+
+	return r.save(subjectsKey, subjects)
+}
+
+// indexedSessions lists the entries of the sessions of the subject which have not expired
+func (r *localSessionIndex) indexedSessions(subject string) ([]string, error) {
+	return r.list(subjectSessionsPrefix + subject)
+}
+
+// indexedSubjects lists the subjects which have sessions which have not expired
+func (r *localSessionIndex) indexedSubjects() ([]string, error) {
+	return r.list(subjectsKey)
+}
+
+// add adds a member to an index, keeping the latest of its expirations
+func (r *localSessionIndex) add(index, member string, expires int64) error {
+	members, err := r.load(index)
+	if err != nil {
+		return err
+	}
+	if current, found := members[member]; found && (current == 0 || (expires != 0 && current > expires)) {
+		expires = current
+	}
+	members[member] = expires
+
+	return r.save(index, members)
+}
+
+func (r *localSessionIndex) list(index string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	members, err := r.load(index)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(members))
+	for member := range members {
+		list = append(list, member)
+	}
+	sort.Strings(list)
+
+	return list, nil
+}
+
+// load reads the members of an index which have not expired, with their expiration
+func (r *localSessionIndex) load(index string) (map[string]int64, error) {
+	value, err := r.store.Get(index)
+	if err != nil {
+		return nil, err
+	}
+	now := r.now().UnixNano() / int64(time.Millisecond)
+	members := make(map[string]int64)
+	for _, line := range splitIndex(value) {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		expires, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || (expires != 0 && expires <= now) {
+			continue
+		}
+		members[fields[1]] = expires
+	}
+
+	return members, nil
+}
+
+// save writes the members of an index, or deletes the index once empty
+func (r *localSessionIndex) save(index string, members map[string]int64) error {
+	if len(members) == 0 {
+		return r.store.Delete(index)
+	}
+	lines := make([]string, 0, len(members))
+	for member, expires := range members {
+		lines = append(lines, strconv.FormatInt(expires, 10)+"\t"+member)
+	}
+	sort.Strings(lines)
+
+	return r.store.Set(index, strings.Join(lines, "\n"))
+}
+
+// splitIndex splits an index stored as a list of lines
+func splitIndex(index string) []string {
+	if index == "" {
+		return []string{}
+	}
+
+	return strings.Split(index, "\n")
+}
+
+// CloseStore stops the background goroutines of the store, then closes it
 func (r *oauthProxy) CloseStore() error {
+	if r.storeCancel != nil {
+		r.storeCancel()
+	}
 	if r.store != nil {
 		return r.store.Close()
 	}
 
 	return nil
 }
+
+// revocationStore returns the store of the revocations: recorded atomically by the stores shared by the replicas, or
+// under the lock of the replica otherwise
+func (r *oauthProxy) revocationStore() revocationStorage {
+	store := r.store
+	if encrypted, ok := store.(*encryptedStore); ok {
+		store = encrypted.storage
+	}
+	if revocations, ok := store.(revocationStorage); ok {
+		return revocations
+	}
+
+	return &localRevocations{store: r.store, lock: &r.revocationsLock, now: r.now}
+}
+
+// persistRevocation keeps the revocation of the sessions of a subject in the store, for the max age of the revocations.
+// The subjects spanning lines have no indexed session, and are only revoked in memory.
+func (r *oauthProxy) persistRevocation(subject string, at time.Time) error {
+	if strings.Contains(subject, "\n") {
+		return nil
+	}
+
+	return r.revocationStore().addRevocation(subject, at, r.config.sessionRevocationMaxAge())
+}
+
+// loadRevocations loads the revocations kept in the store into the revocation set
+func (r *oauthProxy) loadRevocations() error {
+	revocations, err := r.revocationStore().revocations(r.now().Add(-r.config.sessionRevocationMaxAge()))
+	if err != nil {
+		return err
+	}
+	for subject, at := range revocations {
+		r.revocations.add(subject, at)
+	}
+
+	return nil
+}
+
+// localRevocations keeps the revocations in the store under the lock of the replica, for the stores which do not
+// record them atomically. The revocations are kept as the lines "<time in unix ms>\t<subject>", the revocation of all
+// the sessions having an empty subject.
+type localRevocations struct {
+	store storage
+	lock  *sync.Mutex
+	now   func() time.Time
+}
+
+// addRevocation records the revocation of the sessions of a subject, pruning the revocations older than the max age
+func (r *localRevocations) addRevocation(subject string, at time.Time, maxAge time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	revocations, err := r.load(r.now().Add(-maxAge))
+	if err != nil {
+		return err
+	}
+	if current, found := revocations[subject]; !found || at.After(current) {
+		revocations[subject] = at
+	}
+	lines := make([]string, 0, len(revocations))
+	for subject, at := range revocations {
+		lines = append(lines, strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)+"\t"+subject)
+	}
+	sort.Strings(lines)
+
+	return setWithTTL(r.store, revocationsKey, strings.Join(lines, "\n"), maxAge)
+}
+
+// revocations lists the revocations since a time
+func (r *localRevocations) revocations(since time.Time) (map[string]time.Time, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.load(since)
+}
+
+func (r *localRevocations) load(since time.Time) (map[string]time.Time, error) {
+	value, err := r.store.Get(revocationsKey)
+	if err != nil {
+		return nil, err
+	}
+	revocations := make(map[string]time.Time)
+	for _, line := range splitIndex(value) {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		ms, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if at := time.Unix(0, ms*int64(time.Millisecond)); at.After(since) {
+			revocations[fields[1]] = at
+		}
+	}
+
+	return revocations, nil
+}
+
+// setLoginReplay keeps a request interrupted by the login of the state, until it is replayed or expires
+func (r *oauthProxy) setLoginReplay(state, value string, ttl time.Duration) error {
+	return setWithTTL(r.store, loginReplayPrefix+state, value, ttl)
+}
+
+// getLoginReplay retrieves the request kept during the login of the state
+func (r *oauthProxy) getLoginReplay(state string) (string, error) {
+	value, err := r.store.Get(loginReplayPrefix + state)
+	if err != nil {
+		r.log.Warn("unable to retrieve the request kept during the login from the store", zap.Error(err))
+
+		return "", ErrNoSessionStateFound
+	}
+	if value == "" {
+		return "", ErrNoSessionStateFound
+	}
+
+	return value, nil
+}
+
+// deleteLoginReplay removes the request kept during the login of the state, which is replayed once
+func (r *oauthProxy) deleteLoginReplay(state string) error {
+	return r.store.Delete(loginReplayPrefix + state)
+}
+
+// requestURIKey returns the key of the uri requested before the login of the state: the state being the handle of the
+// uri, only its hash is kept in the store
+func requestURIKey(state string) string {
+	sum := sha256.Sum256([]byte(state))
+
+	return requestURIPrefix + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// setRequestURI keeps the uri requested before the login of the state, until the login completes or expires
+func (r *oauthProxy) setRequestURI(state, uri string, ttl time.Duration) error {
+	return setWithTTL(r.store, requestURIKey(state), uri, ttl)
+}
+
+// getRequestURI retrieves the uri requested before the login of the state
+func (r *oauthProxy) getRequestURI(state string) (string, error) {
+	value, err := r.store.Get(requestURIKey(state))
+	if err != nil {
+		r.log.Warn("unable to retrieve the uri requested before the login from the store", zap.Error(err))
+
+		return "", ErrNoSessionStateFound
+	}
+	if value == "" {
+		return "", ErrNoSessionStateFound
+	}
+
+	return value, nil
+}
+
+// deleteRequestURI removes the uri requested before the login of the state, which is only redirected to once
+func (r *oauthProxy) deleteRequestURI(state string) error {
+	return r.store.Delete(requestURIKey(state))
+}
+
+// setProviderSession records the server-side session opened in the session of the provider, for the front-channel logout
+func (r *oauthProxy) setProviderSession(sid, id string, ttl time.Duration) error {
+	return setWithTTL(r.store, providerSessionPrefix+sid, id, ttl)
+}
+
+// deleteProviderSession removes the server-side session opened in the session of the provider, if any
+func (r *oauthProxy) deleteProviderSession(sid string) error {
+	id, err := r.store.Get(providerSessionPrefix + sid)
+	if err != nil || id == "" {
+		return err
+	}
+	if err := r.deleteServerSession(id); err != nil {
+		return err
+	}
+
+	return r.store.Delete(providerSessionPrefix + sid)
+}
+
+// sharedRateLimitStore returns the store holding the rate limits shared by the replicas, if the store supports them.
+// The buckets hold no secret, so they skip the encryption of the store.
+func sharedRateLimitStore(store storage) (rateLimitingStorage, bool) {
+	if encrypted, ok := store.(*encryptedStore); ok {
+		store = encrypted.storage
+	}
+	limiting, ok := store.(rateLimitingStorage)
+
+	return limiting, ok
+}
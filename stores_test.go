@@ -22,13 +22,13 @@ import (
 )
 
 func TestCreateStorageRedis(t *testing.T) {
-	store, err := createStorage("redis://127.0.0.1")
+	store, err := createStorage("redis://127.0.0.1", nil)
 	assert.NotNil(t, store)
 	assert.NoError(t, err)
 }
 
 func TestCreateStorageFail(t *testing.T) {
-	store, err := createStorage("not_there:///tmp/bolt")
+	store, err := createStorage("not_there:///tmp/bolt", nil)
 	assert.Nil(t, store)
 	assert.Error(t, err)
 }
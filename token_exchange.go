@@ -0,0 +1,164 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// exchangedTokensMaxEntries bounds the cached tokens, the least recently used being evicted
+const exchangedTokensMaxEntries = 10000
+
+type exchangedToken struct {
+	key     string
+	token   string
+	expires time.Time
+}
+
+// exchangedTokens caches the tokens obtained by token exchange, per (session, audience)
+type exchangedTokens struct {
+	sync.Mutex
+	// tokens indexes the elements of the lru list by key
+	tokens map[string]*list.Element
+	// lru holds the tokens, the most recently used first
+	lru        *list.List
+	maxEntries int
+}
+
+func newExchangedTokens() *exchangedTokens {
+	return &exchangedTokens{
+		tokens:     make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: exchangedTokensMaxEntries,
+	}
+}
+
+func (c *exchangedTokens) get(key string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, found := c.tokens[key]
+	if !found {
+		return "", false
+	}
+	exchanged := e.Value.(*exchangedToken)
+	if time.Now().After(exchanged.expires) {
+		c.remove(e)
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+
+	return exchanged.token, true
+}
+
+func (c *exchangedTokens) set(key, token string, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, found := c.tokens[key]; found {
+		exchanged := e.Value.(*exchangedToken)
+		exchanged.token, exchanged.expires = token, expires
+		c.lru.MoveToFront(e)
+
+		return
+	}
+	c.tokens[key] = c.lru.PushFront(&exchangedToken{key: key, token: token, expires: expires})
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops a token from the cache, the lock being held
+func (c *exchangedTokens) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.tokens, e.Value.(*exchangedToken).key)
+}
+
+// tokenExchangeMiddleware replaces the access token forwarded upstream by a token restricted to the audience
+// of the resource, so a compromised upstream cannot replay the token against another API
+func (r *oauthProxy) tokenExchangeMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	if !r.config.EnableTokenExchange || resource.ExchangeAudience == "" {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	if r.exchangedCache == nil {
+		r.exchangedCache = newExchangedTokens()
+	}
+	audience := resource.ExchangeAudience
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx, span, logger := r.traceSpan(req.Context(), "token exchange middleware")
+			if span != nil {
+				defer span.End()
+			}
+
+			scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+			if !ok {
+				panic("corrupted context: expected *RequestScope")
+			}
+			if scope.AccessDenied || scope.Identity == nil {
+				next.ServeHTTP(w, req)
+				return
+			}
+			user := scope.Identity
+
+			key := getHashKey(&user.token) + "|" + audience
+			token, found := r.exchangedCache.get(key)
+			if !found {
+				var (
+					expires time.Time
+					err     error
+				)
+				if token, expires, err = r.exchangeToken(ctx, user.token.Encode(), audience); err != nil {
+					// @metric a token exchange has failed
+					oauthTokensMetric.WithLabelValues("token-exchange-failed").Inc()
+					r.errorResponse(w, req.WithContext(ctx), "unable to exchange the access token", http.StatusBadGateway, err)
+					next.ServeHTTP(w, req.WithContext(r.revokeProxy(w, req)))
+
+					return
+				}
+
+				// @metric a token has been exchanged
+				oauthTokensMetric.WithLabelValues("token-exchange").Inc()
+				logger.Debug("exchanged the access token",
+					zap.String("email", user.email),
+					zap.String("audience", audience),
+					zap.String("expires", expires.Format(time.RFC3339)))
+				r.exchangedCache.set(key, token, expires)
+			}
+
+			if r.config.EnableTokenHeader {
+				req.Header.Set(r.config.identityHeaderName(identityHeaderToken), token)
+			}
+			if r.config.EnableAuthorizationHeader {
+				req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+			}
+
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
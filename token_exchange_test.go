@@ -0,0 +1,131 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	resty "gopkg.in/resty.v1"
+)
+
+func TestExchangedTokensCache(t *testing.T) {
+	c := newExchangedTokens()
+	c.set("valid", "token", time.Now().Add(time.Minute))
+	c.set("expired", "token", time.Now().Add(-time.Minute))
+
+	token, found := c.get("valid")
+	assert.True(t, found)
+	assert.Equal(t, "token", token)
+	_, found = c.get("expired")
+	assert.False(t, found)
+	_, found = c.get("missing")
+	assert.False(t, found)
+}
+
+func TestExchangedTokensCacheEviction(t *testing.T) {
+	c := newExchangedTokens()
+	c.maxEntries = 2
+	expires := time.Now().Add(time.Minute)
+	c.set("first", "token", expires)
+	c.set("second", "token", expires)
+	_, found := c.get("first")
+	require.True(t, found)
+
+	// the least recently used token is evicted
+	c.set("third", "token", expires)
+	assert.Len(t, c.tokens, 2)
+	_, found = c.get("second")
+	assert.False(t, found)
+	_, found = c.get("first")
+	assert.True(t, found)
+	_, found = c.get("third")
+	assert.True(t, found)
+}
+
+func TestTokenExchangeMiddleware(t *testing.T) {
+	c := newFakeKeycloakConfig()
+	c.EnableTokenExchange = true
+	c.Resources = []*Resource{
+		{
+			URL:              "/orders/*",
+			Methods:          allHTTPMethods,
+			ExchangeAudience: "orders-api",
+		},
+		{
+			URL:              "/denied/*",
+			Methods:          allHTTPMethods,
+			ExchangeAudience: fakeDeniedAudience,
+		},
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+
+	audienceOf := func(resp *resty.Response) string {
+		var upstream fakeUpstreamResponse
+		require.NoError(t, json.Unmarshal(resp.Body(), &upstream))
+		bearer := strings.TrimPrefix(upstream.Headers.Get("Authorization"), "Bearer ")
+		require.Equal(t, bearer, upstream.Headers.Get("X-Auth-Token"))
+		_, identity, err := parseToken(bearer)
+		require.NoError(t, err)
+		aud, _, _ := identity.StringClaim("aud")
+		return aud
+	}
+
+	p := newFakeProxy(c)
+	requests := []fakeRequest{
+		{
+			URI:           "/orders/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				assert.Equal(t, "orders-api", audienceOf(resp))
+			},
+		},
+		{ // resources without an audience get the original token
+			URI:           "/auth_all/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				assert.Equal(t, "test", audienceOf(resp))
+			},
+		},
+		{
+			URI:           "/denied/test",
+			HasToken:      true,
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusBadGateway,
+		},
+		{
+			URI:           "/orders/test",
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusUnauthorized,
+		},
+	}
+	p.RunTests(t, requests)
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	// the hashes of the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+)
+
+// Signature algorithms of the tokens
+const (
+	signingAlgorithmRS256 = "RS256"
+	signingAlgorithmPS256 = "PS256"
+	signingAlgorithmES256 = "ES256"
+	signingAlgorithmES384 = "ES384"
+	// signingAlgorithmNone is the algorithm of the unsigned tokens, never accepted
+	signingAlgorithmNone = "none"
+)
+
+// Types of the signing keys
+const (
+	keyTypeRSA = "RSA"
+	keyTypeEC  = "EC"
+)
+
+// defaultSigningAlgorithms are the algorithms accepted when none is configured
+var defaultSigningAlgorithms = []string{signingAlgorithmRS256}
+
+// signingAlgorithm is the hash and the type of key of a signature algorithm
+type signingAlgorithm struct {
+	hash    crypto.Hash
+	keyType string
+	// curve is the curve of the ecdsa keys
+	curve elliptic.Curve
+	// pss is set for the rsa signatures with the PSS padding
+	pss bool
+}
+
+// signingAlgorithms are the supported signature algorithms of the tokens
+var signingAlgorithms = map[string]signingAlgorithm{
+	signingAlgorithmRS256: {hash: crypto.SHA256, keyType: keyTypeRSA},
+	signingAlgorithmPS256: {hash: crypto.SHA256, keyType: keyTypeRSA, pss: true},
+	signingAlgorithmES256: {hash: crypto.SHA256, keyType: keyTypeEC, curve: elliptic.P256()},
+	signingAlgorithmES384: {hash: crypto.SHA384, keyType: keyTypeEC, curve: elliptic.P384()},
+}
+
+// isSigningAlgorithmsValid checks the accepted signing algorithms
+func isSigningAlgorithmsValid(algorithms []string) error {
+	for _, algorithm := range algorithms {
+		if algorithm == signingAlgorithmNone {
+			return errors.New("the unsigned tokens (none) cannot be accepted")
+		}
+		if _, found := signingAlgorithms[algorithm]; !found {
+			return fmt.Errorf("unsupported signing algorithm %q, must be one of %s|%s|%s|%s", algorithm,
+				signingAlgorithmRS256, signingAlgorithmPS256, signingAlgorithmES256, signingAlgorithmES384)
+		}
+	}
+
+	return nil
+}
+
+// checkSigningAlgorithm checks the token is signed with one of the accepted algorithms
+func checkSigningAlgorithm(token jose.JWT, accepted []string) error {
+	algorithm := token.Header[jose.HeaderKeyAlgorithm]
+	if algorithm == "" || algorithm == signingAlgorithmNone {
+		return errors.New("the token is not signed")
+	}
+	if len(accepted) == 0 {
+		accepted = defaultSigningAlgorithms
+	}
+	if !containedIn(algorithm, accepted, false) {
+		return fmt.Errorf("the token is signed with %s, which is not an accepted signing algorithm", algorithm)
+	}
+
+	return nil
+}
+
+// signingKey is a public key of the provider, verifying the signatures of the tokens
+type signingKey struct {
+	id string
+	// algorithm is the algorithm of the key, when announced by the provider
+	algorithm string
+	keyType   string
+	// public is a *rsa.PublicKey or a *ecdsa.PublicKey
+	public crypto.PublicKey
+}
+
+// ID returns the key id of the key
+func (k signingKey) ID() string {
+	return k.id
+}
+
+// parseSigningKey reads a json web key of the provider
+func parseSigningKey(raw []byte) (signingKey, error) {
+	var jwk struct {
+		ID        string `json:"kid"`
+		Type      string `json:"kty"`
+		Algorithm string `json:"alg"`
+		Use       string `json:"use"`
+		N         string `json:"n"`
+		E         string `json:"e"`
+		Curve     string `json:"crv"`
+		X         string `json:"x"`
+		Y         string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &jwk); err != nil {
+		return signingKey{}, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return signingKey{}, fmt.Errorf("the key %s is not a signing key", jwk.ID)
+	}
+	decode := func(value string) (*big.Int, error) {
+		if value == "" {
+			return nil, fmt.Errorf("the key %s is incomplete", jwk.ID)
+		}
+		// some providers pad the values
+		content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encoding of the key %s: %w", jwk.ID, err)
+		}
+		return new(big.Int).SetBytes(content), nil
+	}
+
+	parsed := signingKey{id: jwk.ID, algorithm: jwk.Algorithm, keyType: jwk.Type}
+	switch jwk.Type {
+	case keyTypeRSA:
+		n, err := decode(jwk.N)
+		if err != nil {
+			return signingKey{}, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return signingKey{}, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return signingKey{}, fmt.Errorf("invalid exponent of the key %s", jwk.ID)
+		}
+		parsed.public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case keyTypeEC:
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return signingKey{}, fmt.Errorf("unsupported curve %q of the key %s", jwk.Curve, jwk.ID)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return signingKey{}, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return signingKey{}, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return signingKey{}, fmt.Errorf("the key %s is not on the curve %s", jwk.ID, jwk.Curve)
+		}
+		parsed.public = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return signingKey{}, fmt.Errorf("unsupported type %q of the key %s", jwk.Type, jwk.ID)
+	}
+
+	return parsed, nil
+}
+
+// verify checks the signature of the data with the algorithm of the token. The type of the key must match the
+// algorithm, so a token cannot be verified with a key of another type than the one it claims.
+func (k signingKey) verify(algorithm string, data, signature []byte) error {
+	spec, found := signingAlgorithms[algorithm]
+	if !found {
+		return fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if spec.keyType != k.keyType || (k.algorithm != "" && k.algorithm != algorithm) {
+		return fmt.Errorf("the key %s cannot verify a %s signature", k.id, algorithm)
+	}
+	hasher := spec.hash.New()
+	_, _ = hasher.Write(data)
+	digest := hasher.Sum(nil)
+
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		if spec.pss {
+			return rsa.VerifyPSS(public, spec.hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(public, spec.hash, digest, signature)
+	case *ecdsa.PublicKey:
+		// the jws signatures are the concatenated r and s, not asn.1 encoded
+		size := (spec.curve.Params().BitSize + 7) / 8
+		if public.Curve != spec.curve || len(signature) != 2*size {
+			return fmt.Errorf("invalid %s signature for the key %s", algorithm, k.id)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(public, digest, r, s) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key %s of type %T", k.id, k.public)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testSigningKey is a key of the provider, with the algorithm it signs the tokens with
+type testSigningKey struct {
+	kid       string
+	algorithm string
+	private   crypto.Signer
+}
+
+// jwk returns the json web key of the public key
+func (k testSigningKey) jwk() map[string]string {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	switch public := k.private.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kid": k.kid, "kty": "RSA", "use": "sig", "n": encode(public.N.Bytes()),
+			"e": encode([]byte{1, 0, 1})}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kid": k.kid, "kty": "EC", "use": "sig", "crv": public.Curve.Params().Name,
+			"x": encode(public.X.Bytes()), "y": encode(public.Y.Bytes())}
+	}
+
+	return nil
+}
+
+// sign returns a token signed with the key, claiming the algorithm of the header
+func (k testSigningKey) sign(t *testing.T, algorithm string, claims jose.Claims) jose.JWT {
+	header, err := json.Marshal(map[string]string{"alg": algorithm, "kid": k.kid, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := crypto.SHA256
+	if algorithm == signingAlgorithmES384 {
+		hash = crypto.SHA384
+	}
+	hasher := hash.New()
+	_, _ = hasher.Write([]byte(unsigned))
+	digest := hasher.Sum(nil)
+
+	var signature []byte
+	switch private := k.private.(type) {
+	case *rsa.PrivateKey:
+		if algorithm == signingAlgorithmPS256 {
+			signature, err = rsa.SignPSS(cryptorand.Reader, private, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(cryptorand.Reader, private, hash, digest)
+		}
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(cryptorand.Reader, private, digest)
+		require.NoError(t, err)
+		size := (private.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+
+	token, err := jose.ParseJWT(unsigned + "." + base64.RawURLEncoding.EncodeToString(signature))
+	require.NoError(t, err)
+
+	return token
+}
+
+// newTestSigningKeys returns the keys of a provider signing with every supported algorithm
+func newTestSigningKeys(t *testing.T) map[string]testSigningKey {
+	rsaKey, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	require.NoError(t, err)
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	require.NoError(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), cryptorand.Reader)
+	require.NoError(t, err)
+
+	return map[string]testSigningKey{
+		signingAlgorithmRS256: {kid: "rsa", algorithm: signingAlgorithmRS256, private: rsaKey},
+		signingAlgorithmPS256: {kid: "rsa", algorithm: signingAlgorithmPS256, private: rsaKey},
+		signingAlgorithmES256: {kid: "ec-p256", algorithm: signingAlgorithmES256, private: p256},
+		signingAlgorithmES384: {kid: "ec-p384", algorithm: signingAlgorithmES384, private: p384},
+	}
+}
+
+// newTestJWKSCache returns the cache of the keys served by a fake provider
+func newTestJWKSCache(t *testing.T, keys map[string]testSigningKey) *jwksCache {
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	served := make(map[string]bool)
+	for _, k := range keys {
+		if !served[k.kid] {
+			served[k.kid] = true
+			set.Keys = append(set.Keys, k.jwk())
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		require.NoError(t, json.NewEncoder(w).Encode(set))
+	}))
+	t.Cleanup(server.Close)
+
+	endpoint, err := url.Parse(server.URL + "/certs")
+	require.NoError(t, err)
+	issuer, err := url.Parse("https://idp.example.com/auth/realms/test")
+	require.NoError(t, err)
+	cache := newJWKSCache(http.DefaultClient, oidc.ProviderConfig{Issuer: issuer, KeysEndpoint: endpoint}, time.Hour, zap.NewNop())
+	require.NoError(t, cache.refresh(context.Background(), jwksRefreshStartup))
+	require.Len(t, cache.keys, len(served))
+
+	return cache
+}
+
+func TestSigningAlgorithms(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	cache := newTestJWKSCache(t, keys)
+	claims := newTestToken(cache.issuer).claims
+
+	for algorithm, k := range keys {
+		token := k.sign(t, algorithm, claims)
+		assert.NoError(t, checkSigningAlgorithm(token, []string{algorithm}), algorithm)
+		assert.NoError(t, cache.verify("test", token), algorithm)
+	}
+}
+
+func TestSigningAlgorithmConfusion(t *testing.T) {
+	keys := newTestSigningKeys(t)
+	cache := newTestJWKSCache(t, keys)
+	claims := newTestToken(cache.issuer).claims
+
+	// a token signed with the rsa key, claiming the key id of the ecdsa key
+	confused := keys[signingAlgorithmRS256]
+	confused.kid = keys[signingAlgorithmES256].kid
+	assert.Error(t, cache.verify("test", confused.sign(t, signingAlgorithmRS256, claims)))
+
+	// an ecdsa signature verified with the rsa key
+	confused = keys[signingAlgorithmES256]
+	confused.kid = keys[signingAlgorithmRS256].kid
+	assert.Error(t, cache.verify("test", confused.sign(t, signingAlgorithmES256, claims)))
+
+	// the ecdsa curve must match the algorithm
+	confused = keys[signingAlgorithmES384]
+	assert.Error(t, cache.verify("test", confused.sign(t, signingAlgorithmES256, claims)))
+}
+
+func TestCheckSigningAlgorithm(t *testing.T) {
+	claims := newTestToken("https://idp.example.com").claims
+	unsigned, err := jose.NewJWT(jose.JOSEHeader{"alg": signingAlgorithmNone}, claims)
+	require.NoError(t, err)
+	assert.Error(t, checkSigningAlgorithm(unsigned, []string{signingAlgorithmRS256}))
+
+	es256, err := jose.NewJWT(jose.JOSEHeader{"alg": signingAlgorithmES256}, claims)
+	require.NoError(t, err)
+	// only RS256 is accepted by default
+	assert.Error(t, checkSigningAlgorithm(es256, nil))
+	assert.NoError(t, checkSigningAlgorithm(es256, []string{signingAlgorithmRS256, signingAlgorithmES256}))
+
+	_, _, err = parseToken(unsigned.Encode())
+	assert.Error(t, err, "the unsigned tokens are never parsed")
+}
+
+func TestIsSigningAlgorithmsValid(t *testing.T) {
+	assert.NoError(t, isSigningAlgorithmsValid([]string{signingAlgorithmRS256, signingAlgorithmPS256, signingAlgorithmES256, signingAlgorithmES384}))
+	assert.Error(t, isSigningAlgorithmsValid([]string{signingAlgorithmNone}))
+	assert.Error(t, isSigningAlgorithmsValid([]string{"HS256"}))
+}
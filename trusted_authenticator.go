@@ -0,0 +1,370 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// trustedAuthenticatorALB is an aws application load balancer, authenticating the users with oidc
+	trustedAuthenticatorALB = "aws-alb"
+	// albDataHeader is the header holding the claims of the user, signed by the load balancer
+	albDataHeader = "X-Amzn-Oidc-Data"
+	// albKeysURL is the location of the public keys of the load balancers of a region
+	albKeysURL = "https://public-keys.auth.elb.%s.amazonaws.com"
+	// albKeyMaxSize bounds the size of the public keys fetched from the authenticator
+	albKeyMaxSize = 16 << 10
+	// albKeyMissTTL is the time a key id unknown to the authenticator is remembered, and not fetched again
+	albKeyMissTTL = time.Minute
+	// albKeyMinInterval is the minimum interval between two fetches of the keys not known yet, which bounds the
+	// fetches triggered by the forged key ids
+	albKeyMinInterval = time.Second
+)
+
+// albKeyIDFilter restricts the key ids to the characters of the uuids issued by the load balancers, since they are
+// part of the url of the public keys
+var albKeyIDFilter = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// isTrustedAuthenticatorValid validates the configuration of the trusted upstream authenticator
+func (r *Config) isTrustedAuthenticatorValid() error {
+	if r.TrustedAuthenticator == "" {
+		return nil
+	}
+	if r.TrustedAuthenticator != trustedAuthenticatorALB {
+		return fmt.Errorf("invalid trusted authenticator %q, must be %s", r.TrustedAuthenticator, trustedAuthenticatorALB)
+	}
+	if len(r.TrustedAuthenticatorSigners) == 0 {
+		return errors.New("trusted-authenticator-signers must list the load balancers trusted to sign the identities")
+	}
+	if r.TrustedAuthenticatorKeysURL == "" && r.TrustedAuthenticatorRegion == "" {
+		return errors.New("trusted-authenticator-region or trusted-authenticator-keys-url is required by the trusted authenticator")
+	}
+	if r.TrustedAuthenticatorKeysURL != "" {
+		u, err := url.Parse(r.TrustedAuthenticatorKeysURL)
+		if err != nil || u.Host == "" || (u.Scheme != secureScheme && !(u.Scheme == unsecureScheme && isLoopbackHost(u.Hostname()))) {
+			return fmt.Errorf("invalid trusted authenticator keys url %q, must be a https url", r.TrustedAuthenticatorKeysURL)
+		}
+	}
+	for _, listen := range r.TrustedAuthenticatorListeners {
+		if listen != r.Listen && listen != r.ListenHTTP {
+			return fmt.Errorf("the trusted authenticator listener %q is neither the listen nor the listen-http interface", listen)
+		}
+	}
+
+	return nil
+}
+
+// trustedAuthenticator verifies the identities set by an aws application load balancer
+type trustedAuthenticator struct {
+	keysURL string
+	signers []string
+	client  *http.Client
+	// mapping are the claims holding the roles and the groups
+	mapping identityClaims
+
+	// minInterval is the minimum interval between two fetches of the keys not known yet
+	minInterval time.Duration
+
+	// the public keys of the load balancers, per key id
+	keysLock sync.RWMutex
+	keys     map[string]*ecdsa.PublicKey
+	// misses holds the expiry of the key ids unknown to the authenticator, fetched the time of the last fetch
+	misses  map[string]time.Time
+	fetched time.Time
+
+	fetches singleflight.Group
+}
+
+// albHeader is the header of the identities signed by the load balancers
+type albHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Signer    string `json:"signer"`
+	Expires   int64  `json:"exp"`
+}
+
+// newTrustedAuthenticator creates the authenticator of the configuration
+func newTrustedAuthenticator(config *Config) *trustedAuthenticator {
+	keysURL := config.TrustedAuthenticatorKeysURL
+	if keysURL == "" {
+		keysURL = fmt.Sprintf(albKeysURL, config.TrustedAuthenticatorRegion)
+	}
+
+	return &trustedAuthenticator{
+		keysURL: strings.TrimRight(keysURL, "/"),
+		signers: config.TrustedAuthenticatorSigners,
+		client:  &http.Client{Timeout: config.OpenIDProviderTimeout},
+		mapping: config.identityClaims(),
+		keys:    make(map[string]*ecdsa.PublicKey),
+		misses:  make(map[string]time.Time),
+
+		minInterval: albKeyMinInterval,
+	}
+}
+
+// isTrustedAuthentication tells if the request comes through a listener trusting the upstream authenticator
+func (r *oauthProxy) isTrustedAuthentication(req *http.Request) bool {
+	trusted, _ := req.Context().Value(contextTrustedAuthenticator).(bool)
+
+	return trusted && r.trustedAuthenticator != nil
+}
+
+// loginFlowMiddleware hides the endpoints of the login flow on the listeners trusting the upstream authenticator,
+// which runs the login flow instead
+func (r *oauthProxy) loginFlowMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.isTrustedAuthentication(req) {
+			http.NotFound(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// identity returns the user authenticated by the load balancer, once the signature of the identity is verified
+func (a *trustedAuthenticator) identity(req *http.Request) (*userContext, error) {
+	data := req.Header.Get(albDataHeader)
+	if data == "" {
+		return nil, ErrNoTrustedIdentity
+	}
+	segments := strings.Split(data, ".")
+	if len(segments) != 3 {
+		return nil, fmt.Errorf("the identity is not a jwt: %d segments", len(segments))
+	}
+
+	// the load balancers pad the base64url encoded segments
+	content, err := decodeALBSegment(segments[0])
+	if err != nil {
+		return nil, err
+	}
+	var header albHeader
+	if err = json.Unmarshal(content, &header); err != nil {
+		return nil, fmt.Errorf("invalid header of the identity: %w", err)
+	}
+	if header.Algorithm != "ES256" {
+		return nil, fmt.Errorf("unsupported signing algorithm of the identity: %q", header.Algorithm)
+	}
+	if !containsString(header.Signer, a.signers) {
+		return nil, ErrUntrustedSigner
+	}
+	key, err := a.publicKey(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decodeALBSegment(segments[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) != 64 {
+		return nil, errors.New("invalid signature of the identity")
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, errors.New("invalid signature of the identity")
+	}
+
+	payload, err := decodeALBSegment(segments[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := make(jose.Claims)
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims of the identity: %w", err)
+	}
+
+	return newTrustedUserContext(header, claims, a.mapping, jose.JWT{
+		RawHeader:  segments[0],
+		RawPayload: segments[1],
+		Payload:    payload,
+		Signature:  signature,
+	})
+}
+
+// newTrustedUserContext maps the claims of an identity signed by the load balancer to the user context
+func newTrustedUserContext(header albHeader, claims jose.Claims, mapping identityClaims, token jose.JWT) (*userContext, error) {
+	id, _, err := claims.StringClaim("sub")
+	if err != nil || id == "" {
+		return nil, errors.New("the identity does not carry the subject of the user")
+	}
+	expiresAt, found, err := claims.TimeClaim("exp")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		expiresAt = time.Unix(header.Expires, 0)
+	}
+	email, _, _ := claims.StringClaim("email")
+	preferredName, found, err := claims.StringClaim(claimPreferredName)
+	if err != nil || !found {
+		preferredName = email
+	}
+	groups, err := extractGroups(claims, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	return &userContext{
+		bearerToken:   true,
+		claims:        claims,
+		email:         email,
+		expiresAt:     expiresAt,
+		groups:        groups,
+		id:            id,
+		name:          preferredName,
+		preferredName: preferredName,
+		roles:         extractRoles(claims, mapping),
+		token:         token,
+	}, nil
+}
+
+// publicKey returns the public key of the load balancers with the key id, fetched once. The key id comes from the
+// identity before its signature is verified: the concurrent requests with the same key id wait for a single fetch,
+// the key ids unknown to the authenticator are remembered for a while, and the fetches of the keys not known yet are
+// rate limited.
+func (a *trustedAuthenticator) publicKey(kid string) (*ecdsa.PublicKey, error) {
+	if !albKeyIDFilter.MatchString(kid) {
+		return nil, fmt.Errorf("invalid key id of the identity: %q", kid)
+	}
+	if key, known, err := a.cachedKey(kid); known {
+		return key, err
+	}
+
+	key, err, _ := a.fetches.Do(kid, func() (interface{}, error) {
+		// the key may have been fetched by a request which completed meanwhile
+		if key, known, err := a.cachedKey(kid); known {
+			return key, err
+		}
+		a.keysLock.Lock()
+		if time.Since(a.fetched) < a.minInterval {
+			a.keysLock.Unlock()
+			return nil, fmt.Errorf("the public key %s of the load balancer is not fetched, the fetches are rate limited", kid)
+		}
+		a.fetched = time.Now()
+		a.keysLock.Unlock()
+
+		key, missing, err := a.fetchKey(kid)
+
+		a.keysLock.Lock()
+		defer a.keysLock.Unlock()
+		if err != nil {
+			if missing {
+				a.addMiss(kid)
+			}
+			return nil, err
+		}
+		a.keys[kid] = key
+
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key.(*ecdsa.PublicKey), nil
+}
+
+// cachedKey returns the public key with the key id when fetched, or an error when the key id is a recent miss, and
+// tells if the key id is known either way
+func (a *trustedAuthenticator) cachedKey(kid string) (*ecdsa.PublicKey, bool, error) {
+	a.keysLock.RLock()
+	defer a.keysLock.RUnlock()
+
+	if key, found := a.keys[kid]; found {
+		return key, true, nil
+	}
+	if expires, found := a.misses[kid]; found && time.Now().Before(expires) {
+		return nil, true, fmt.Errorf("the public key %s of the load balancer is unknown", kid)
+	}
+
+	return nil, false, nil
+}
+
+// addMiss remembers a key id unknown to the authenticator, and forgets the expired ones. The fetches being rate
+// limited, the misses are bounded by the misses ttl over the minimum interval.
+func (a *trustedAuthenticator) addMiss(kid string) {
+	now := time.Now()
+	for k, expires := range a.misses {
+		if !now.Before(expires) {
+			delete(a.misses, k)
+		}
+	}
+	a.misses[kid] = now.Add(albKeyMissTTL)
+}
+
+// fetchKey fetches the public key with the key id from the authenticator, and tells if the authenticator does not
+// know the key. The fetch is shared by the concurrent requests, so it is not bound to the context of any of them.
+func (a *trustedAuthenticator) fetchKey(kid string) (*ecdsa.PublicKey, bool, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, a.keysURL+"/"+kid, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, true, fmt.Errorf("the public key %s of the load balancer responded %d", kid, resp.StatusCode)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, albKeyMaxSize))
+	if err != nil {
+		return nil, false, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, true, fmt.Errorf("the public key %s of the load balancer is not pem encoded", kid)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, true, err
+	}
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, true, fmt.Errorf("the public key %s of the load balancer is not an ecdsa key", kid)
+	}
+
+	return key, false, nil
+}
+
+// decodeALBSegment decodes a segment of the identity, base64url encoded with or without padding
+func decodeALBSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
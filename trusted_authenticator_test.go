@@ -0,0 +1,307 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fakeALBSigner = "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/gatekeeper/50dc6c495c0c9188"
+	fakeALBKeyID  = "8f1c3b4e-3e9c-4a9b-9a42-0c7f6d4e2a11"
+)
+
+// fakeALB signs the identities as an aws application load balancer, and serves its public key
+type fakeALB struct {
+	key     *ecdsa.PrivateKey
+	server  *httptest.Server
+	fetches int32
+	misses  int32
+}
+
+func newFakeALB(t *testing.T) *fakeALB {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	alb := &fakeALB{key: key}
+	alb.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/"+fakeALBKeyID {
+			atomic.AddInt32(&alb.misses, 1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&alb.fetches, 1)
+		_ = pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}))
+	t.Cleanup(alb.server.Close)
+
+	return alb
+}
+
+// sign returns the identity header of the claims, with padded segments as the load balancers do
+func (a *fakeALB) sign(t *testing.T, signer string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]interface{}{
+		"alg": "ES256", "kid": fakeALBKeyID, "signer": signer, "iss": "https://idp", "client": "alb", "exp": time.Now().Add(time.Minute).Unix(),
+	})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	unsigned := base64.URLEncoding.EncodeToString(header) + "." + base64.URLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return unsigned + "." + base64.URLEncoding.EncodeToString(signature)
+}
+
+func newFakeALBClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":                "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"email":              "gambol99@gmail.com",
+		"preferred_username": "rjayawardene",
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"iss":                "https://idp",
+		"realm_access":       map[string]interface{}{"roles": []string{fakeAdminRole}},
+	}
+}
+
+func newTrustedAuthenticatorConfig(alb *fakeALB) *Config {
+	cfg := newFakeKeycloakConfig()
+	cfg.TrustedAuthenticator = trustedAuthenticatorALB
+	cfg.TrustedAuthenticatorKeysURL = alb.server.URL
+	cfg.TrustedAuthenticatorSigners = []string{fakeALBSigner}
+
+	return cfg
+}
+
+func TestTrustedAuthenticator(t *testing.T) {
+	alb := newFakeALB(t)
+	cfg := newTrustedAuthenticatorConfig(alb)
+
+	expired := newFakeALBClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	user := newFakeALBClaims()
+	delete(user, "realm_access")
+	tampered := strings.Split(alb.sign(t, fakeALBSigner, newFakeALBClaims()), ".")
+	tampered[1] = base64.URLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":4102444800}`))
+
+	newFakeProxy(cfg).RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAdminRoleURL,
+			Headers:       map[string]string{albDataHeader: alb.sign(t, fakeALBSigner, newFakeALBClaims())},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Email":   "gambol99@gmail.com",
+				"X-Auth-Subject": "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+				"X-Auth-Userid":  "rjayawardene",
+				"X-Auth-Roles":   fakeAdminRole,
+			},
+		},
+		{
+			// the roles are enforced
+			URI:          fakeAdminRoleURL,
+			Headers:      map[string]string{albDataHeader: alb.sign(t, fakeALBSigner, user)},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// the requests without identity are refused, there is no login flow
+			URI:          fakeAdminRoleURL,
+			Redirects:    true,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          fakeAdminRoleURL,
+			HasToken:     true,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          fakeAdminRoleURL,
+			Headers:      map[string]string{albDataHeader: alb.sign(t, "arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/other/1", newFakeALBClaims())},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          fakeAdminRoleURL,
+			Headers:      map[string]string{albDataHeader: strings.Join(tampered, ".")},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          fakeAdminRoleURL,
+			Headers:      map[string]string{albDataHeader: alb.sign(t, fakeALBSigner, expired)},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:           fakeTestWhitelistedURL,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the load balancer runs the login flow
+			URI:          cfg.WithOAuthURI(authorizationURL),
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			URI:          cfg.WithOAuthURI(callbackURL) + "?code=fake",
+			ExpectedCode: http.StatusNotFound,
+		},
+	})
+
+	// the public key is fetched once
+	assert.Equal(t, int32(1), atomic.LoadInt32(&alb.fetches))
+}
+
+func TestTrustedAuthenticatorUnknownKeys(t *testing.T) {
+	alb := newFakeALB(t)
+	a := newTrustedAuthenticator(newTrustedAuthenticatorConfig(alb))
+
+	// the concurrent requests signed with a key not fetched yet wait for a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := a.publicKey(fakeALBKeyID)
+			assert.NoError(t, err)
+			assert.NotNil(t, key)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&alb.fetches))
+
+	// an unknown key id is remembered, and not fetched again
+	a.fetched = time.Time{}
+	_, err := a.publicKey("forged-1")
+	assert.Error(t, err)
+	_, err = a.publicKey("forged-1")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&alb.misses))
+
+	// the fetches of the keys not known yet are rate limited
+	_, err = a.publicKey("forged-2")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&alb.misses))
+	a.fetched = time.Time{}
+	_, err = a.publicKey("forged-2")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&alb.misses))
+
+	// the known keys are still served
+	key, err := a.publicKey(fakeALBKeyID)
+	assert.NoError(t, err)
+	assert.NotNil(t, key)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&alb.fetches))
+}
+
+func TestTrustedAuthenticatorListeners(t *testing.T) {
+	alb := newFakeALB(t)
+	cfg := newTrustedAuthenticatorConfig(alb)
+	cfg.TrustedAuthenticatorListeners = []string{"127.0.0.1:0"}
+	assert.True(t, cfg.trustsAuthenticatorOn("127.0.0.1:0"))
+	assert.False(t, cfg.trustsAuthenticatorOn("127.0.0.1:8443"))
+
+	// the other listeners run the login flow, and ignore the identities of the load balancer
+	cfg.TrustedAuthenticatorListeners = nil
+	p := newFakeProxy(cfg)
+	p.proxy.config.TrustedAuthenticatorListeners = []string{"127.0.0.1:8080"}
+	direct := httptest.NewServer(p.proxy.listenerHandler(p.proxy.config.Listen))
+	defer direct.Close()
+
+	req, err := http.NewRequest(http.MethodGet, direct.URL+"/admin", nil)
+	require.NoError(t, err)
+	req.Header.Set(albDataHeader, alb.sign(t, fakeALBSigner, newFakeALBClaims()))
+	resp, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}).Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Location"), cfg.WithOAuthURI(authorizationURL))
+}
+
+func TestIsTrustedAuthenticatorValid(t *testing.T) {
+	cs := []struct {
+		Config *Config
+		Error  string
+	}{
+		{Config: &Config{}},
+		{
+			Config: &Config{TrustedAuthenticator: trustedAuthenticatorALB, TrustedAuthenticatorRegion: "eu-west-1", TrustedAuthenticatorSigners: []string{fakeALBSigner}},
+		},
+		{
+			Config: &Config{TrustedAuthenticator: "oauth2-proxy"},
+			Error:  "invalid trusted authenticator",
+		},
+		{
+			Config: &Config{TrustedAuthenticator: trustedAuthenticatorALB, TrustedAuthenticatorRegion: "eu-west-1"},
+			Error:  "trusted-authenticator-signers",
+		},
+		{
+			Config: &Config{TrustedAuthenticator: trustedAuthenticatorALB, TrustedAuthenticatorSigners: []string{fakeALBSigner}},
+			Error:  "trusted-authenticator-region",
+		},
+		{
+			Config: &Config{TrustedAuthenticator: trustedAuthenticatorALB, TrustedAuthenticatorKeysURL: "http://keys.example.com", TrustedAuthenticatorSigners: []string{fakeALBSigner}},
+			Error:  "must be a https url",
+		},
+		{
+			Config: &Config{
+				TrustedAuthenticator:          trustedAuthenticatorALB,
+				TrustedAuthenticatorRegion:    "eu-west-1",
+				TrustedAuthenticatorSigners:   []string{fakeALBSigner},
+				Listen:                        ":8443",
+				ListenHTTP:                    ":8080",
+				TrustedAuthenticatorListeners: []string{":8081"},
+			},
+			Error: "neither the listen nor the listen-http interface",
+		},
+	}
+	for i, c := range cs {
+		err := c.Config.isTrustedAuthenticatorValid()
+		if c.Error == "" {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		if assert.Error(t, err, "case %d", i) {
+			assert.Contains(t, err.Error(), c.Error, "case %d", i)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// umaPermissionsSweepSize is the size of the cache above which the expired permissions are swept
+const umaPermissionsSweepSize = 1024
+
+// umaPermissions caches the permissions granted by the authorization server, per (access token, permission)
+type umaPermissions struct {
+	sync.RWMutex
+	granted map[string]time.Time
+}
+
+func newUMAPermissions() *umaPermissions {
+	return &umaPermissions{
+		granted: make(map[string]time.Time),
+	}
+}
+
+func (c *umaPermissions) isGranted(key string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	expires, found := c.granted[key]
+
+	return found && time.Now().Before(expires)
+}
+
+func (c *umaPermissions) grant(key string, expires time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.granted) >= umaPermissionsSweepSize {
+		now := time.Now()
+		for k, expiry := range c.granted {
+			if now.After(expiry) {
+				delete(c.granted, k)
+			}
+		}
+	}
+	c.granted[key] = expires
+}
+
+// umaPermission returns the permission required by a resource, i.e. the uma resource and its scopes
+func umaPermission(resource *Resource) string {
+	if len(resource.UMAScopes) == 0 {
+		return resource.UMAResource
+	}
+
+	return resource.UMAResource + "#" + strings.Join(resource.UMAScopes, ",")
+}
+
+// checkUMAPermission asks the authorization services of keycloak whether the user is granted a permission. The
+// granted permissions are cached for the uma-cache-ttl, the denied ones are asked again.
+func (r *oauthProxy) checkUMAPermission(ctx context.Context, user *userContext, permission string) (bool, error) {
+	key := getHashKey(&user.token) + "|" + permission
+	if r.umaCache.isGranted(key) {
+		return true, nil
+	}
+
+	form := url.Values{
+		"grant_type":    []string{grantTypeUMATicket},
+		"audience":      []string{r.config.ClientID},
+		"permission":    []string{permission},
+		"response_mode": []string{"decision"},
+	}
+	var granted bool
+	err := r.retry(ctx, umaBackoff, func(ctx context.Context) error {
+		var err error
+		granted, err = r.requestUMADecision(ctx, user, form)
+
+		return err
+	})
+	if err != nil || !granted {
+		return false, err
+	}
+
+	if r.config.UMACacheTTL > 0 {
+		expires := time.Now().Add(r.config.UMACacheTTL)
+		if user.expiresAt.Before(expires) {
+			expires = user.expiresAt
+		}
+		r.umaCache.grant(key, expires)
+	}
+
+	return true, nil
+}
+
+// requestUMADecision asks the authorization server for the decision on a permission, only the failures of the server
+// being worth retrying
+func (r *oauthProxy) requestUMADecision(ctx context.Context, user *userContext, form url.Values) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.idp.TokenEndpoint.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(authorizationHeader, authorizationType+" "+user.token.Encode())
+
+	start := time.Now()
+	resp, err := r.idpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	// @metric observe the time taken to check a permission
+	oauthLatencyMetric.WithLabelValues("uma").Observe(time.Since(start).Seconds())
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var decision struct {
+			Result bool `json:"result"`
+		}
+		if err := json.Unmarshal(content, &decision); err != nil {
+			return false, permanent(fmt.Errorf("invalid decision of the authorization server: %w", err))
+		}
+		return decision.Result, nil
+	case resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	case resp.StatusCode < http.StatusInternalServerError:
+		return false, permanent(fmt.Errorf("the authorization server responded %d: %s", resp.StatusCode, content))
+	default:
+		return false, fmt.Errorf("the authorization server responded %d: %s", resp.StatusCode, content)
+	}
+}
@@ -0,0 +1,151 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUMAPermissionsCache(t *testing.T) {
+	c := newUMAPermissions()
+	c.grant("valid", time.Now().Add(time.Minute))
+	c.grant("expired", time.Now().Add(-time.Minute))
+
+	assert.True(t, c.isGranted("valid"))
+	assert.False(t, c.isGranted("expired"))
+	assert.False(t, c.isGranted("missing"))
+}
+
+func TestUMAPermission(t *testing.T) {
+	assert.Equal(t, "orders", umaPermission(&Resource{UMAResource: "orders"}))
+	assert.Equal(t, "orders#read,write", umaPermission(&Resource{UMAResource: "orders", UMAScopes: []string{"read", "write"}}))
+}
+
+func newUMAConfig() *Config {
+	c := newFakeKeycloakConfig()
+	c.EnableUMA = true
+	c.Resources = []*Resource{
+		{
+			URL:         "/orders/*",
+			Methods:     allHTTPMethods,
+			UMAResource: "orders",
+			UMAScopes:   []string{"read"},
+		},
+		{
+			URL:         "/denied/*",
+			Methods:     allHTTPMethods,
+			UMAResource: fakeDeniedUMAResource,
+		},
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+
+	return c
+}
+
+func TestUMAMiddleware(t *testing.T) {
+	auth := newFakeAuthServer()
+	p := newFakeProxyWithAuthServer(newUMAConfig(), auth)
+
+	// the same token is presented on each request
+	issuedAt := time.Now()
+	claims := jose.Claims{
+		"iat": float64(issuedAt.Unix()),
+		"exp": float64(issuedAt.Add(time.Hour).Unix()),
+	}
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           "/orders/test",
+			HasToken:      true,
+			TokenClaims:   claims,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the granted permission is cached
+			URI:           "/orders/test",
+			HasToken:      true,
+			TokenClaims:   claims,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/denied/test",
+			HasToken:     true,
+			TokenClaims:  claims,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			// the resources without uma resource are not checked
+			URI:           "/auth_all/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/orders/test",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&auth.umaDecisions))
+}
+
+func TestUMAMiddlewareUnavailable(t *testing.T) {
+	auth := newFakeAuthServer()
+	auth.umaUnavailable = true
+	p := newFakeProxyWithAuthServer(newUMAConfig(), auth)
+	p.proxy.retryAfter = (&fakeRetryClock{}).after
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:          "/orders/test",
+			HasToken:     true,
+			ExpectedCode: http.StatusBadGateway,
+		},
+	})
+
+	c := newUMAConfig()
+	c.UMAFailOpen = true
+	p = newFakeProxyWithAuthServer(c, auth)
+	p.proxy.retryAfter = (&fakeRetryClock{}).after
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           "/orders/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			// the permissions granted on failures are not cached
+			URI:           "/orders/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	})
+	// each decision is retried up to the attempts of the policy
+	assert.Equal(t, int32(3*umaBackoff.attempts), atomic.LoadInt32(&auth.umaDecisions))
+}
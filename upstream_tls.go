@@ -0,0 +1,101 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// UpstreamTLS are the tls settings of the connections to an upstream, in place of the global upstream settings
+// (skip-upstream-tls-verify, upstream-ca)
+type UpstreamTLS struct {
+	// CA is the path to a bundle of CA certificates in PEM format verifying the upstream, the system roots otherwise
+	CA string `json:"ca" yaml:"ca"`
+	// SkipVerify skips the verification of the certificate of the upstream
+	SkipVerify bool `json:"skip-verify" yaml:"skip-verify"`
+	// ClientCertificate is the path to the certificate presented to the upstream
+	ClientCertificate string `json:"client-certificate" yaml:"client-certificate"`
+	// ClientPrivateKey is the path to the private key of the client certificate
+	ClientPrivateKey string `json:"client-private-key" yaml:"client-private-key"`
+	// ServerName overrides the name verified in the certificate of the upstream, and sent in the handshake
+	ServerName string `json:"server-name" yaml:"server-name"`
+}
+
+// ForwardingTLS are the tls settings of the forwarding proxy towards some destination domains
+type ForwardingTLS struct {
+	// Domains are the destination domains, as the forwarding domains
+	Domains []string `json:"domains" yaml:"domains"`
+
+	UpstreamTLS `yaml:",inline"`
+}
+
+// isValid checks the files of the settings exist
+func (t *UpstreamTLS) isValid() error {
+	if t.SkipVerify && t.CA != "" {
+		return errors.New("you cannot set both ca and skip-verify in the tls settings of an upstream")
+	}
+	if (t.ClientCertificate == "") != (t.ClientPrivateKey == "") {
+		return errors.New("the client-certificate and client-private-key of an upstream must be set together")
+	}
+	for _, file := range []string{t.CA, t.ClientCertificate, t.ClientPrivateKey} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("the upstream tls file %s is not accessible: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// buildUpstreamTLSConfig returns the tls configuration of the connections to an upstream with its own settings
+func (r *oauthProxy) buildUpstreamTLSConfig(settings *UpstreamTLS) (*tls.Config, error) {
+	//nolint:gas
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: settings.SkipVerify,
+		ServerName:         settings.ServerName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if settings.CA != "" {
+		pool, err := makeCertPool("upstream CA", settings.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if settings.ClientCertificate != "" {
+		certificate, err := tls.LoadX509KeyPair(settings.ClientCertificate, settings.ClientPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+		r.certificates.record(certificatePurposeUpstreamClient, settings.ClientCertificate, certificate)
+	}
+
+	return tlsConfig, nil
+}
+
+// warnSkippedVerification warns about an upstream which certificate is not verified
+func (r *oauthProxy) warnSkippedVerification(upstream string) {
+	r.log.Warn("TLS VERIFICATION DISABLED - the certificate of the upstream is not verified, the connections can be intercepted",
+		zap.String("upstream", upstream))
+}
@@ -0,0 +1,116 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTLSUpstream starts an https upstream, and returns its url and the file of its certificate
+func newTLSUpstream(t *testing.T) (string, string) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+	location := filepath.Join(t.TempDir(), "upstream.pem")
+	require.NoError(t, os.WriteFile(location, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0o600))
+
+	return upstream.URL, location
+}
+
+func TestUpstreamTLSPerResource(t *testing.T) {
+	upstream, ca := newTLSUpstream(t)
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{URL: "/verified/*", WhiteListed: true, Upstream: upstream, UpstreamTLS: &UpstreamTLS{CA: ca}},
+		{URL: "/also-verified/*", WhiteListed: true, Upstream: upstream, UpstreamTLS: &UpstreamTLS{CA: ca}},
+		{URL: "/named/*", WhiteListed: true, Upstream: upstream, UpstreamTLS: &UpstreamTLS{CA: ca, ServerName: "example.com"}},
+		{URL: "/misnamed/*", WhiteListed: true, Upstream: upstream, UpstreamTLS: &UpstreamTLS{CA: ca, ServerName: "other.example.com"}},
+		{URL: "/system/*", WhiteListed: true, Upstream: upstream, UpstreamTLS: &UpstreamTLS{}},
+		{URL: "/appliance/*", WhiteListed: true, Upstream: upstream, UpstreamTLS: &UpstreamTLS{SkipVerify: true}},
+		{URL: "/default/*", WhiteListed: true},
+	}
+	p := newFakeProxy(cfg)
+
+	p.RunTests(t, []fakeRequest{
+		{URI: "/verified/test", ExpectedCode: http.StatusOK},
+		{URI: "/also-verified/test", ExpectedCode: http.StatusOK},
+		{URI: "/named/test", ExpectedCode: http.StatusOK},
+		{URI: "/misnamed/test", ExpectedCode: http.StatusBadGateway},
+		{URI: "/system/test", ExpectedCode: http.StatusBadGateway},
+		{URI: "/appliance/test", ExpectedCode: http.StatusOK},
+		{URI: "/default/test", ExpectedProxy: true, ExpectedCode: http.StatusOK},
+	})
+
+	// the resources with the same settings share a transport
+	assert.Len(t, p.proxy.resourceUpstreams, 6)
+	assert.Same(t, p.proxy.resourceUpstreams[cfg.Resources[0]], p.proxy.resourceUpstreams[cfg.Resources[1]])
+	assert.NotSame(t, p.proxy.resourceUpstreams[cfg.Resources[0]], p.proxy.resourceUpstreams[cfg.Resources[2]])
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		upstream, release := newStreamingUpstream(t)
+		cfg := newFakeKeycloakConfig()
+		cfg.UpstreamEnableHTTP2 = enabled
+		cfg.Resources = []*Resource{
+			{URL: "/stream/*", WhiteListed: true, Upstream: upstream.URL, UpstreamTLS: &UpstreamTLS{SkipVerify: true}},
+		}
+		p := newFakeProxy(cfg)
+
+		resp, err := http.Get(p.getServiceURL() + "/stream/test")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		proto := readStreamed(t, resp, release)
+		if enabled {
+			assert.Equal(t, "HTTP/2.0", proto, "http/2 is negotiated with the upstream")
+		} else {
+			assert.Equal(t, "HTTP/1.1", proto)
+		}
+		p.idp.Close()
+		p.proxy.server.Close()
+	}
+}
+
+func TestBuildUpstreamTLSConfig(t *testing.T) {
+	px := &oauthProxy{config: newFakeKeycloakConfig(), log: zap.NewNop()}
+	tlsConfig, err := px.buildUpstreamTLSConfig(&UpstreamTLS{
+		CA:                testCertificateFile,
+		ClientCertificate: testCertificateFile,
+		ClientPrivateKey:  testPrivateKeyFile,
+		ServerName:        "localhost",
+	})
+	require.NoError(t, err)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.Equal(t, "localhost", tlsConfig.ServerName)
+
+	_, err = px.buildUpstreamTLSConfig(&UpstreamTLS{ClientCertificate: testCertificateFile, ClientPrivateKey: testCertificateFile})
+	assert.Error(t, err)
+}
@@ -17,8 +17,10 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/coreos/go-oidc/jose"
 	"github.com/coreos/go-oidc/oidc"
@@ -27,7 +29,7 @@ import (
 // extractIdentity parse the jwt token and extracts the various elements is order to construct
 //
 // This is function that concentrates keycloak dependencies (i.e. the structure of the token).
-func extractIdentity(token jose.JWT) (*userContext, error) {
+func extractIdentity(token jose.JWT, mapping identityClaims) (*userContext, error) {
 	claims, err := token.Claims()
 	if err != nil {
 		return nil, err
@@ -55,6 +57,131 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 		audiences = aud
 	}
 
+	// @step: extract any group information from the tokens
+	groups, err := extractGroups(claims, mapping)
+	if err != nil {
+		return nil, err
+	}
+	issuedAt, _, _ := claims.TimeClaim(claimIssuedAt)
+
+	// @step: the authentication context class of the session, if any
+	acr, _, _ := claims.StringClaim(claimACR)
+
+	return &userContext{
+		acr:           acr,
+		audiences:     audiences,
+		claims:        claims,
+		email:         identity.Email,
+		expiresAt:     identity.ExpiresAt,
+		groups:        groups,
+		id:            identity.ID,
+		issuedAt:      issuedAt,
+		name:          preferredName,
+		preferredName: preferredName,
+		roles:         extractRoles(claims, mapping),
+		token:         token,
+	}, nil
+}
+
+// identityClaims are the claims holding the roles and the groups of the user, when they differ from the keycloak ones
+type identityClaims struct {
+	// realm is the path of a custom claim holding realm roles, read in addition to the keycloak claim
+	realm []string
+	// client is the path of a custom claim holding client roles by client, read in addition to the keycloak claim
+	client []string
+	// groups is the name of the claim holding the groups, the keycloak claim when empty
+	groups string
+	// stripGroupPrefix removes the leading slash of the group paths
+	stripGroupPrefix bool
+}
+
+// identityClaims returns the claims holding the roles and the groups
+func (r *Config) identityClaims() identityClaims {
+	split := func(path string) []string {
+		if path == "" {
+			return nil
+		}
+		return strings.Split(path, ".")
+	}
+
+	return identityClaims{
+		realm:            split(r.RolesClaim),
+		client:           split(r.ClientRolesClaim),
+		groups:           r.GroupsClaim,
+		stripGroupPrefix: r.StripGroupPrefix,
+	}
+}
+
+// extractGroups returns the groups of the claims: a list, or a string separated by commas or spaces
+func extractGroups(claims jose.Claims, mapping identityClaims) ([]string, error) {
+	name := defaultTo(mapping.groups, claimGroups)
+	var groups []string
+	if value, isString := claims[name].(string); isString {
+		groups = strings.FieldsFunc(value, func(c rune) bool {
+			return c == ',' || unicode.IsSpace(c)
+		})
+	} else {
+		list, _, err := claims.StringsClaim(name)
+		if err != nil {
+			return nil, err
+		}
+		groups = list
+	}
+	if mapping.stripGroupPrefix {
+		for i, group := range groups {
+			groups[i] = strings.TrimPrefix(group, "/")
+		}
+	}
+
+	return groups, nil
+}
+
+// claimAt returns the value of the claim at a path of nested claims
+func claimAt(claims jose.Claims, path []string) (interface{}, bool) {
+	var value interface{} = map[string]interface{}(claims)
+	for _, name := range path {
+		nested, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		if value, isMap = nested[name]; !isMap {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// rolesOf returns the roles of a claim, a list or a comma-separated string; the invalid claims are ignored
+func rolesOf(value interface{}) []string {
+	var roles []string
+	switch list := value.(type) {
+	case []interface{}:
+		for _, r := range list {
+			if role, isString := r.(string); isString && role != "" {
+				roles = append(roles, role)
+			}
+		}
+	case []string:
+		for _, role := range list {
+			if role != "" {
+				roles = append(roles, role)
+			}
+		}
+	case string:
+		for _, role := range strings.Split(list, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return roles
+}
+
+// extractRoles returns the realm roles and the client roles, prefixed by the client, of the claims. The roles of the
+// custom claims are added to the keycloak ones.
+func extractRoles(claims jose.Claims, mapping identityClaims) []string {
 	// @step: extract the realm roles
 	var roleList []string
 	if realmRoles, found := claims[claimRealmAccess].(map[string]interface{}); found {
@@ -68,6 +195,11 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 			// invalid claim is ignored
 		}
 	}
+	if len(mapping.realm) > 0 {
+		if value, found := claimAt(claims, mapping.realm); found {
+			roleList = appendRoles(roleList, rolesOf(value)...)
+		}
+	}
 
 	// @step: extract the client roles from the access token
 	if accesses, found := claims[claimResourceAccess].(map[string]interface{}); found {
@@ -85,31 +217,41 @@ func extractIdentity(token jose.JWT) (*userContext, error) {
 			}
 		}
 	}
+	if len(mapping.client) > 0 {
+		// the roles of each client are either listed, or in the roles claim of the client as keycloak does
+		if accesses, found := claimAt(claims, mapping.client); found {
+			clients, _ := accesses.(map[string]interface{})
+			for name, list := range clients {
+				if scopes, isMap := list.(map[string]interface{}); isMap {
+					list = scopes[claimResourceRoles]
+				}
+				for _, role := range rolesOf(list) {
+					roleList = appendRoles(roleList, name+":"+role)
+				}
+			}
+		}
+	}
 
-	// @step: extract any group information from the tokens
-	groups, _, err := claims.StringsClaim(claimGroups)
-	if err != nil {
-		return nil, err
+	return roleList
+}
+
+// appendRoles adds the roles which are not in the list yet
+func appendRoles(list []string, roles ...string) []string {
+	for _, role := range roles {
+		if !containsString(role, list) {
+			list = append(list, role)
+		}
 	}
 
-	return &userContext{
-		audiences:     audiences,
-		claims:        claims,
-		email:         identity.Email,
-		expiresAt:     identity.ExpiresAt,
-		groups:        groups,
-		id:            identity.ID,
-		name:          preferredName,
-		preferredName: preferredName,
-		roles:         roleList,
-		token:         token,
-	}, nil
+	return list
 }
 
 // userContext holds the information extracted the token
 type userContext struct {
 	// the id of the user
 	id string
+	// the authentication context class of the session, e.g. its level of assurance
+	acr string
 	// the audience for the token
 	audiences []string
 	// whether the context is from a session cookie or authorization header
@@ -122,6 +264,8 @@ type userContext struct {
 	expiresAt time.Time
 	// groups is a collection of groups the user in in
 	groups []string
+	// the time the access token was issued, zero when unknown
+	issuedAt time.Time
 	// a name of the user
 	name string
 	// preferredName is the name of the user
@@ -142,9 +286,9 @@ func (r *userContext) getRoles() string {
 	return strings.Join(r.roles, ",")
 }
 
-// isExpired checks if the token has expired
-func (r *userContext) isExpired() bool {
-	return r.expiresAt.Before(time.Now())
+// isExpired checks if the token has expired at a time
+func (r *userContext) isExpired(now time.Time) bool {
+	return r.expiresAt.Before(now)
 }
 
 // isBearer checks if the token
@@ -157,6 +301,26 @@ func (r *userContext) isCookie() bool {
 	return !r.isBearer()
 }
 
+// hasACR checks the session was authenticated with the authentication context class required, or a higher level
+func (r *userContext) hasACR(required string) bool {
+	return acrSatisfies(r.acr, required)
+}
+
+// acrSatisfies checks an authentication context class satisfies the one required: the same class, or a higher level
+// of assurance when both are levels, as the numeric acr of keycloak
+func acrSatisfies(acr, required string) bool {
+	if required == "" || acr == required {
+		return true
+	}
+	level, err := strconv.Atoi(acr)
+	if err != nil {
+		return false
+	}
+	requiredLevel, err := strconv.Atoi(required)
+
+	return err == nil && level >= requiredLevel
+}
+
 // String returns a string representation of the user context
 func (r *userContext) String() string {
 	return fmt.Sprintf("user: %s, expires: %s, roles: %s", r.preferredName, r.expiresAt.String(), strings.Join(r.roles, ","))
@@ -19,7 +19,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/coreos/go-oidc/jose"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIsAudience(t *testing.T) {
@@ -50,12 +52,14 @@ func TestGetUserRoles(t *testing.T) {
 }
 
 func TestIsExpired(t *testing.T) {
+	now := newFakeClock().Now()
 	user := &userContext{
-		expiresAt: time.Now(),
-	}
-	if !user.isExpired() {
-		t.Error("we should have been false")
+		expiresAt: now,
 	}
+	assert.False(t, user.isExpired(now.Add(-time.Second)))
+	// the token is valid until the instant of its expiry
+	assert.False(t, user.isExpired(now))
+	assert.True(t, user.isExpired(now.Add(time.Nanosecond)))
 }
 
 func TestIsBearerToken(t *testing.T) {
@@ -80,7 +84,7 @@ func TestGetUserContext(t *testing.T) {
 	token := newTestToken("test")
 	token.addRealmRoles(realmRoles)
 	token.addClientRoles("client", []string{"client"})
-	context, err := extractIdentity(token.getToken())
+	context, err := extractIdentity(token.getToken(), identityClaims{})
 	assert.NoError(t, err)
 	assert.NotNil(t, context)
 	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", context.id)
@@ -93,7 +97,7 @@ func TestGetUserRealmRoleContext(t *testing.T) {
 	roles := []string{"dsp-dev-vpn", "vpn-user", "dsp-prod-vpn", "openvpn:dev-vpn"}
 	token := newTestToken("test")
 	token.addRealmRoles(roles)
-	context, err := extractIdentity(token.getToken())
+	context, err := extractIdentity(token.getToken(), identityClaims{})
 	assert.NoError(t, err)
 	assert.NotNil(t, context)
 	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", context.id)
@@ -104,8 +108,79 @@ func TestGetUserRealmRoleContext(t *testing.T) {
 
 func TestUserContextString(t *testing.T) {
 	token := newTestToken("test")
-	context, err := extractIdentity(token.getToken())
+	context, err := extractIdentity(token.getToken(), identityClaims{})
 	assert.NoError(t, err)
 	assert.NotNil(t, context)
 	assert.NotEmpty(t, context.String())
 }
+
+func TestGetUserRoleClaims(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.RolesClaim = "authorities"
+	cfg.ClientRolesClaim = "custom.clients"
+	token := newTestToken("test")
+	token.addRealmRoles([]string{"user"})
+	token.merge(jose.Claims{
+		"authorities": "admin, user,,auditor",
+		"custom": map[string]interface{}{
+			"clients": map[string]interface{}{
+				"billing": []interface{}{"reader"},
+				"orders":  map[string]interface{}{"roles": []interface{}{"writer"}},
+				"invalid": float64(1),
+			},
+		},
+	})
+	context, err := extractIdentity(token.getToken(), cfg.identityClaims())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"user", "admin", "auditor", "billing:reader", "orders:writer"}, context.roles)
+
+	// the nested paths and the lists are read, the malformed claims are ignored
+	cs := []struct {
+		Path     string
+		Claims   jose.Claims
+		Expected []string
+	}{
+		{Path: "a.b", Claims: jose.Claims{"a": map[string]interface{}{"b": []interface{}{"x", float64(1), "y"}}}, Expected: []string{"x", "y"}},
+		{Path: "a.b", Claims: jose.Claims{"a": "b"}},
+		{Path: "a.b", Claims: jose.Claims{"a": map[string]interface{}{"b": map[string]interface{}{}}}},
+		{Path: "a", Claims: jose.Claims{"a": nil}},
+		{Path: "missing", Claims: jose.Claims{"a": "x"}},
+	}
+	for i, c := range cs {
+		cfg.RolesClaim = c.Path
+		assert.Equal(t, c.Expected, extractRoles(c.Claims, cfg.identityClaims()), "case %d", i)
+	}
+}
+
+func TestGetUserGroupsClaim(t *testing.T) {
+	cs := []struct {
+		Claim    string
+		Strip    bool
+		Claims   jose.Claims
+		Expected []string
+	}{
+		{Claims: jose.Claims{"groups": []interface{}{"admin", "dev"}}, Expected: []string{"admin", "dev"}},
+		{Claims: jose.Claims{"groups": "admin, dev ops"}, Expected: []string{"admin", "dev", "ops"}},
+		{Claims: jose.Claims{"groups": []interface{}{"/team/dev"}}, Expected: []string{"/team/dev"}},
+		{Claims: jose.Claims{"groups": []interface{}{"/team/dev"}}, Strip: true, Expected: []string{"team/dev"}},
+		{Claim: "group_membership", Claims: jose.Claims{"group_membership": []interface{}{"/team/dev", "/ops"}}, Strip: true, Expected: []string{"team/dev", "ops"}},
+		{Claim: "group_membership", Claims: jose.Claims{"group_membership": "/team/dev,/ops"}, Strip: true, Expected: []string{"team/dev", "ops"}},
+		{Claim: "group_membership", Claims: jose.Claims{"groups": []interface{}{"admin"}}},
+	}
+	for i, c := range cs {
+		cfg := newFakeKeycloakConfig()
+		cfg.GroupsClaim = c.Claim
+		cfg.StripGroupPrefix = c.Strip
+		token := newTestToken("test")
+		token.merge(c.Claims)
+		context, err := extractIdentity(token.getToken(), cfg.identityClaims())
+		require.NoError(t, err, "case %d", i)
+		assert.Equal(t, c.Expected, context.groups, "case %d", i)
+	}
+
+	// a malformed claim is refused
+	token := newTestToken("test")
+	token.merge(jose.Claims{"groups": float64(1)})
+	_, err := extractIdentity(token.getToken(), identityClaims{})
+	assert.Error(t, err)
+}
@@ -35,6 +35,7 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -59,10 +60,33 @@ var (
 		http.MethodPut,
 		http.MethodTrace,
 	}
+
+	// defaultAllowedMethods are the methods proxied to the upstream by default: all standard methods but TRACE
+	defaultAllowedMethods = []string{
+		http.MethodDelete,
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodOptions,
+		http.MethodPatch,
+		http.MethodPost,
+		http.MethodPut,
+	}
 )
 
 var (
 	symbolsFilter = regexp.MustCompilePOSIX("[_$><\\[\\].,\\+-/'%^&*()!\\\\]+")
+	// methodFilter matches well-formed method names, including extension methods such as WebDAV's PROPFIND or VERSION-CONTROL
+	methodFilter = regexp.MustCompile("^[A-Z]+(-[A-Z]+)*$")
+	// headerNameFilter matches the well-formed header names, i.e. http tokens
+	headerNameFilter = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+	// hopByHopHeaders are the headers of a single connection, which are not set as static response headers
+	hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+	// cookieNameSuffixFilter matches the characters allowed in a cookie name suffix
+	cookieNameSuffixFilter = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	// cookieChunkSuffixFilter matches the suffix of a cookie chunk
+	cookieChunkSuffixFilter = regexp.MustCompile(`^-[0-9]+$`)
+	// serverSessionIDFilter checks the format of the server-side session ids
+	serverSessionIDFilter = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
 )
 
 const (
@@ -128,6 +152,11 @@ func getRequestHostURL(r *http.Request) string {
 		scheme = secureScheme
 	}
 
+	if forwarded := getForwarded(r); forwarded != nil {
+		hostname = defaultTo(forwarded.Host, hostname)
+		scheme = defaultTo(forwarded.Proto, scheme)
+	}
+
 	return fmt.Sprintf("%s://%s", scheme, hostname)
 }
 
@@ -253,6 +282,11 @@ func isValidHTTPMethod(method string) bool {
 	return false
 }
 
+// isValidMethodName ensure this is a well-formed http method, possibly an extension method
+func isValidMethodName(method string) bool {
+	return methodFilter.MatchString(method)
+}
+
 // defaultTo returns the value of the default
 func defaultTo(v, d string) string {
 	if v != "" {
@@ -262,6 +296,57 @@ func defaultTo(v, d string) string {
 	return d
 }
 
+// redactURL strips the password from a url, e.g. before logging it
+func redactURL(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "<invalid url>"
+	}
+
+	return u.Redacted()
+}
+
+// queryParam returns the first value of a query parameter, and whether it is present. The parameters are only
+// separated by '&': the semicolons are part of the values. The malformed parameters and the parameters with an
+// empty name are ignored.
+func queryParam(rawQuery, name string) (string, bool) {
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, value := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			key, value = pair[:i], pair[i+1:]
+		}
+		if key == "" {
+			continue
+		}
+		if k, err := url.QueryUnescape(key); err != nil || k != name {
+			continue
+		}
+		v, err := url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+
+		return v, true
+	}
+
+	return "", false
+}
+
+// escapeHeaderURL escapes the bytes of an url which cannot be sent in a header, i.e. the control and non-ascii
+// bytes, leaving the rest of the url untouched
+func escapeHeaderURL(location string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(location); i++ {
+		if c := location[i]; c < 0x20 || c == 0x7f || c >= utf8.RuneSelf {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+			continue
+		}
+		escaped.WriteByte(location[i])
+	}
+
+	return escaped.String()
+}
+
 // fileExists check if a file exists
 func fileExists(filename string) bool {
 	if _, err := os.Stat(filename); err != nil {
@@ -298,6 +383,18 @@ func hasAccess(need, have []string, all bool, enableWildcard bool) bool {
 	return matched > 0
 }
 
+// missingFrom returns the values which are not in the list
+func missingFrom(values, list []string) []string {
+	missing := make([]string, 0, len(values))
+	for _, x := range values {
+		if !containedIn(x, list, false) {
+			missing = append(missing, x)
+		}
+	}
+
+	return missing
+}
+
 // containedIn checks if a value in a list of a strings
 func containedIn(value string, list []string, enableWildcard bool) bool {
 	for _, x := range list {
@@ -400,10 +497,10 @@ func loadCA(cert, key string) (*tls.Certificate, error) {
 	return &ca, err
 }
 
-// getWithin calculates a duration of x percent of the time period, i.e. something
+// getWithin calculates a duration of x percent of the time period left from now, i.e. something
 // expires in 1 hours, get me a duration within 80%
-func getWithin(expires time.Time, within float64) time.Duration {
-	left := expires.UTC().Sub(time.Now().UTC()).Seconds()
+func getWithin(expires, now time.Time, within float64) time.Duration {
+	left := expires.UTC().Sub(now.UTC()).Seconds()
 	if left <= 0 {
 		return time.Duration(0)
 	}
@@ -426,7 +523,9 @@ func printError(message string, args ...interface{}) *cli.ExitError {
 // realIP retrieves the client ip address from a http request
 func realIP(req *http.Request) string {
 	ra := req.RemoteAddr
-	if ip := req.Header.Get(headerXForwardedFor); ip != "" {
+	if forwarded := getForwarded(req); forwarded != nil && forwardedNodeIP(forwarded.For) != nil {
+		ra = forwardedNodeIP(forwarded.For).String()
+	} else if ip := req.Header.Get(headerXForwardedFor); ip != "" {
 		ra = strings.Split(ip, ", ")[0]
 	} else if ip := req.Header.Get(headerXRealIP); ip != "" {
 		ra = ip
@@ -446,3 +545,20 @@ func containsString(needle string, haystack []string) bool {
 	}
 	return false
 }
+
+// isResponseHeadersValid checks the static response headers are well-formed and end-to-end
+func isResponseHeadersValid(headers map[string]string) error {
+	for name, value := range headers {
+		if !headerNameFilter.MatchString(name) {
+			return fmt.Errorf("invalid response header name %q", name)
+		}
+		if containsString(http.CanonicalHeaderKey(name), hopByHopHeaders) {
+			return fmt.Errorf("the response header %s is hop-by-hop, it cannot be set", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value of the response header %s", name)
+		}
+	}
+
+	return nil
+}
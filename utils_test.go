@@ -432,6 +432,13 @@ func TestContainedIn(t *testing.T) {
 	assert.True(t, containedIn("2/3/4/*", []string{"1", "2/3/4/5/6", "3", "4"}, true))
 
 	assert.True(t, containedIn("1*", []string{"123", "3", "4"}, true))
+
+	// the keycloak group paths
+	assert.True(t, containedIn("/engineering/*", []string{"/engineering"}, true))
+	assert.True(t, containedIn("/engineering/*", []string{"/engineering/"}, true))
+	assert.True(t, containedIn("/engineering/*", []string{"/engineering/platform/sre"}, true))
+	assert.False(t, containedIn("/engineering/*", []string{"/engineering2", "/sales/engineering", "engineering"}, true))
+	assert.False(t, containedIn("/engineering", []string{"/engineering/platform", "/engineering/"}, true))
 }
 
 func TestContainsSubString(t *testing.T) {
@@ -485,25 +492,69 @@ func TestFileExists(t *testing.T) {
 	}
 }
 
+func TestQueryParam(t *testing.T) {
+	cs := []struct {
+		Query    string
+		Name     string
+		Expected string
+		Found    bool
+	}{
+		{Query: "state=a&state=b", Name: "state", Expected: "a", Found: true},
+		{Query: "code=x;y&state=s", Name: "code", Expected: "x;y", Found: true},
+		{Query: "code=x;state=s", Name: "state"},
+		{Query: "=empty&state=", Name: "state", Found: true},
+		{Query: "redirect", Name: "redirect", Found: true},
+		{Query: "state=%zz&state=%2Fok", Name: "state", Expected: "/ok", Found: true},
+		{Query: "st%61te=a+b%26c", Name: "state", Expected: "a b&c", Found: true},
+		{Query: "", Name: "state"},
+	}
+	for _, c := range cs {
+		value, found := queryParam(c.Query, c.Name)
+		assert.Equal(t, c.Expected, value, "query: %s", c.Query)
+		assert.Equal(t, c.Found, found, "query: %s", c.Query)
+	}
+}
+
+func TestEscapeHeaderURL(t *testing.T) {
+	assert.Equal(t, "/search?q=a;b&x=%26&=", escapeHeaderURL("/search?q=a;b&x=%26&="))
+	assert.Equal(t, "/caf%C3%A9", escapeHeaderURL("/café"))
+	assert.Equal(t, "/a%0D%0Ab", escapeHeaderURL("/a\r\nb"))
+}
+
 func TestGetWithin(t *testing.T) {
+	now := newFakeClock().Now()
 	cs := []struct {
 		Expires  time.Time
 		Percent  float64
 		Expected time.Duration
 	}{
 		{
-			Expires:  time.Now().Add(time.Duration(1) * time.Hour),
+			Expires:  now.Add(time.Duration(1) * time.Hour),
 			Percent:  0.10,
-			Expected: 359000000000,
+			Expected: 6 * time.Minute,
 		},
 		{
-			Expires:  time.Now().Add(time.Duration(1) * time.Hour),
+			Expires:  now.Add(time.Duration(1) * time.Hour),
 			Percent:  0.20,
-			Expected: 719000000000,
+			Expected: 12 * time.Minute,
+		},
+		{
+			// the seconds are truncated
+			Expires:  now.Add(1500 * time.Millisecond),
+			Percent:  0.85,
+			Expected: time.Second,
+		},
+		{
+			Expires: now,
+			Percent: 0.85,
+		},
+		{
+			Expires: now.Add(-time.Minute),
+			Percent: 0.85,
 		},
 	}
-	for _, x := range cs {
-		assert.Equal(t, x.Expected, getWithin(x.Expires, x.Percent))
+	for i, x := range cs {
+		assert.Equal(t, x.Expected, getWithin(x.Expires, now, x.Percent), "case %d", i)
 	}
 }
 
@@ -0,0 +1,133 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// isWebSocketUpgrade checks the request is the opening handshake of a websocket
+func isWebSocketUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get(headerUpgrade), "websocket")
+}
+
+// takeSubprotocolToken removes the access token from the subprotocols offered by a websocket upgrade, sent as the
+// element following the prefix, e.g. "bearer, <token>, graphql-ws". The prefix is removed as well, so the upstream
+// only sees the subprotocols it may negotiate.
+func takeSubprotocolToken(req *http.Request, prefix string) (string, bool) {
+	var protocols []string
+	for _, value := range req.Header.Values(headerWebSocketProtocol) {
+		for _, x := range strings.Split(value, ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				protocols = append(protocols, x)
+			}
+		}
+	}
+	for i, x := range protocols {
+		if x != prefix {
+			continue
+		}
+		var token string
+		if i+1 < len(protocols) {
+			token = protocols[i+1]
+			protocols = append(protocols[:i], protocols[i+2:]...)
+		} else {
+			protocols = protocols[:i]
+		}
+		if len(protocols) > 0 {
+			req.Header.Set(headerWebSocketProtocol, strings.Join(protocols, ", "))
+		} else {
+			req.Header.Del(headerWebSocketProtocol)
+		}
+
+		return token, true
+	}
+
+	return "", false
+}
+
+// webSocketTokenMiddleware authenticates the websocket upgrades carrying the access token in their subprotocols, as
+// the browsers cannot set the authorization header on them. The token is moved to the authorization header for the
+// authentication which follows, and an upgrade with an invalid token is refused with a 401 before reaching the
+// upstream, rather than redirected or forbidden.
+func (r *oauthProxy) webSocketTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the upgrades already denied, e.g. to the clients outside of the networks of the resource, are left as is
+		if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); !isWebSocketUpgrade(req) || (ok && scope.AccessDenied) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		token, found := takeSubprotocolToken(req, r.config.WebSocketTokenSubprotocol)
+		if !found {
+			next.ServeHTTP(w, req)
+			return
+		}
+		_, span, logger := r.traceSpan(req.Context(), "websocket token middleware")
+		if span != nil {
+			defer span.End()
+		}
+
+		reason := authFailureMissing
+		var err error = ErrSessionNotFound
+		if token != "" {
+			req.Header.Set(authorizationHeader, authorizationType+" "+token)
+			reason, err = r.checkWebSocketToken(req)
+		}
+		if err != nil {
+			logger.Warn("the access token of the websocket upgrade is not valid, refusing the upgrade",
+				append(r.recordAuthFailure(req, reason),
+					zap.String("client_ip", req.RemoteAddr),
+					zap.Error(err))...)
+			ctx := r.revokeProxy(w, req)
+			r.errorResponse(w, req.WithContext(ctx), "", http.StatusUnauthorized, nil)
+			return
+		}
+
+		// the subprotocol is echoed back to the client, unless the upstream negotiates another one
+		if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok {
+			scope.WebSocketSubprotocol = r.config.WebSocketTokenSubprotocol
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// checkWebSocketToken verifies the access token of a websocket upgrade, returning the reason of the failure if any
+func (r *oauthProxy) checkWebSocketToken(req *http.Request) (string, error) {
+	user, err := r.getIdentity(req)
+	if err != nil {
+		return authFailureInvalid, err
+	}
+	if r.config.SkipTokenVerification {
+		if user.isExpired(r.now()) {
+			return authFailureExpired, ErrAccessTokenExpired
+		}
+		return "", nil
+	}
+	if err := r.verifyToken(r.client, user.token); err != nil {
+		if err == ErrAccessTokenExpired {
+			return authFailureExpired, err
+		}
+		return authFailureInvalid, err
+	}
+
+	return "", nil
+}
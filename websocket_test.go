@@ -0,0 +1,136 @@
+//go:build !noreverse
+// +build !noreverse
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTakeSubprotocolToken(t *testing.T) {
+	cs := []struct {
+		Protocols []string
+		Token     string
+		Found     bool
+		Forwarded string
+	}{
+		{Protocols: []string{"bearer, abc.def.ghi"}, Token: "abc.def.ghi", Found: true},
+		{Protocols: []string{"graphql-ws, bearer, abc.def.ghi"}, Token: "abc.def.ghi", Found: true, Forwarded: "graphql-ws"},
+		{Protocols: []string{"bearer", "abc.def.ghi", "graphql-ws"}, Token: "abc.def.ghi", Found: true, Forwarded: "graphql-ws"},
+		{Protocols: []string{"graphql-ws, bearer"}, Found: true, Forwarded: "graphql-ws"},
+		{Protocols: []string{"graphql-ws, bearer-like"}, Forwarded: "graphql-ws, bearer-like"},
+	}
+	for i, c := range cs {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		for _, x := range c.Protocols {
+			req.Header.Add(headerWebSocketProtocol, x)
+		}
+		token, found := takeSubprotocolToken(req, "bearer")
+		assert.Equal(t, c.Found, found, "case %d", i)
+		assert.Equal(t, c.Token, token, "case %d", i)
+		assert.Equal(t, c.Forwarded, strings.Join(req.Header.Values(headerWebSocketProtocol), ", "), "case %d", i)
+	}
+}
+
+func TestWebSocketTokenSubprotocol(t *testing.T) {
+	// the upstream negotiates graphql-ws when offered, and records the handshakes it received
+	var lock sync.Mutex
+	var received []http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		received = append(received, req.Header.Clone())
+		lock.Unlock()
+		upgrader := websocket.Upgrader{Subprotocols: []string{"graphql-ws"}}
+		c, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		_ = c.Close()
+	}))
+	defer upstream.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.WebSocketTokenSubprotocol = "bearer"
+	cfg.Resources = []*Resource{
+		{URL: "/ws", Methods: []string{http.MethodGet}, Upstream: upstream.URL, UpstreamTLS: &UpstreamTLS{}},
+	}
+	p := newFakeProxy(cfg)
+	defer func() {
+		p.idp.Close()
+		p.proxy.server.Close()
+	}()
+	signed, err := p.idp.signToken(newTestToken(p.idp.getLocation()).claims)
+	require.NoError(t, err)
+	location := "ws" + strings.TrimPrefix(p.getServiceURL(), "http") + "/ws"
+	dial := func(protocols ...string) (*websocket.Conn, *http.Response, error) {
+		dialer := websocket.Dialer{Subprotocols: protocols}
+		return dialer.Dial(location, nil)
+	}
+
+	// step: the subprotocol carrying the token is echoed back, when the upstream negotiates none
+	c, resp, err := dial("bearer", signed.Encode())
+	require.NoError(t, err)
+	_ = c.Close()
+	_ = resp.Body.Close()
+	assert.Equal(t, "bearer", resp.Header.Get(headerWebSocketProtocol))
+
+	// step: the subprotocol negotiated by the upstream is kept
+	c, resp, err = dial("bearer", signed.Encode(), "graphql-ws")
+	require.NoError(t, err)
+	_ = c.Close()
+	_ = resp.Body.Close()
+	assert.Equal(t, "graphql-ws", resp.Header.Get(headerWebSocketProtocol))
+
+	lock.Lock()
+	require.Len(t, received, 2)
+	assert.Empty(t, received[0].Get(headerWebSocketProtocol), "the token is not forwarded in the subprotocols")
+	assert.Equal(t, "graphql-ws", received[1].Get(headerWebSocketProtocol))
+	assert.Equal(t, authorizationType+" "+signed.Encode(), received[1].Get(authorizationHeader))
+	lock.Unlock()
+
+	// step: an invalid or missing token is refused before reaching the upstream
+	for _, protocols := range [][]string{{"bearer", "invalid"}, {"bearer"}} {
+		_, resp, err = dial(protocols...)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	expired := newTestToken(p.idp.getLocation())
+	expired.setExpiration(time.Now().Add(-time.Minute))
+	signed, err = p.idp.signToken(expired.claims)
+	require.NoError(t, err)
+	_, resp, err = dial("bearer", signed.Encode())
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	lock.Lock()
+	assert.Len(t, received, 2)
+	lock.Unlock()
+}